@@ -0,0 +1,75 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/GoogleCloudPlatform/cloud-run-mesh/pkg/mesh"
+)
+
+func init() {
+	subcommands["gen-bootstrap"] = genBootstrap
+}
+
+// genBootstrap renders the bootstrap files when building the image:
+//
+//	krun gen-bootstrap [-out DIR] [-td-template /td_resources/bootstrap_template.yaml]
+//
+// Writes DIR/grpc_bootstrap.json and, if the TD template exists, DIR/envoy_bootstrap.json. The runtime values are
+// ${NAME} placeholders - set MESH_GRPC_BOOTSTRAP and MESH_ENVOY_BOOTSTRAP to the files to use them.
+func genBootstrap(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("gen-bootstrap", flag.ExitOnError)
+	out := fs.String("out", ".", "Output directory")
+	tdTemplate := fs.String("td-template", filepath.Join(mesh.NewTdSidecarEnv().PackageDirectory, "bootstrap_template.yaml"),
+		"Traffic Director bootstrap template")
+	fs.Parse(args)
+
+	if err := os.MkdirAll(*out, 0755); err != nil {
+		return err
+	}
+	data, err := mesh.GenGRPCBootstrap()
+	if err != nil {
+		return err
+	}
+	f := filepath.Join(*out, "grpc_bootstrap.json")
+	if err := ioutil.WriteFile(f, data, 0644); err != nil {
+		return err
+	}
+	log.Println("Generated", f)
+
+	tmpl, err := ioutil.ReadFile(*tdTemplate)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	data, err = mesh.GenEnvoyBootstrap(tmpl)
+	if err != nil {
+		return err
+	}
+	f = filepath.Join(*out, "envoy_bootstrap.json")
+	if err := ioutil.WriteFile(f, data, 0644); err != nil {
+		return err
+	}
+	log.Println("Generated", f)
+	return nil
+}
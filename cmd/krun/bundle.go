@@ -0,0 +1,138 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/GoogleCloudPlatform/cloud-run-mesh/pkg/mesh"
+)
+
+func init() {
+	subcommands["bundle"] = bundle
+}
+
+const bundleUsage = `usage:
+  krun bundle keygen -out key.pem
+  krun bundle create -key key.pem -out bundle.tgz [-ttl 24h] [-aud a,b]
+  krun bundle use bundle.tgz`
+
+// bundle manages offline bootstrap bundles:
+//
+// - keygen creates the ed25519 signing key and prints the public key, to set as MESH_BUNDLE_KEY.
+// - create discovers the mesh using the current env, like the normal startup, and writes a signed bundle with
+// the mesh-env, roots and tokens valid for ttl. Run it in a build step or a job with the workload KSA.
+// - use verifies a bundle with MESH_BUNDLE_KEY and copies it to MESH_BUNDLE, for use at startup.
+func bundle(ctx context.Context, args []string) error {
+	if len(args) == 0 {
+		return errors.New(bundleUsage)
+	}
+	switch args[0] {
+	case "keygen":
+		fs := flag.NewFlagSet("bundle keygen", flag.ExitOnError)
+		out := fs.String("out", "bundle-key.pem", "Signing key file")
+		fs.Parse(args[1:])
+		priv, pub, err := mesh.GenerateBundleKey()
+		if err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(*out, priv, 0600); err != nil {
+			return err
+		}
+		fmt.Print(string(pub))
+		return nil
+	case "create":
+		fs := flag.NewFlagSet("bundle create", flag.ExitOnError)
+		out := fs.String("out", "bundle.tgz", "Bundle file")
+		keyFile := fs.String("key", "bundle-key.pem", "Signing key file")
+		ttl := fs.Duration("ttl", 24*time.Hour, "Lifetime of the tokens")
+		auds := fs.String("aud", "", "Additional token audiences, comma separated")
+		fs.Parse(args[1:])
+
+		kd, err := ioutil.ReadFile(*keyFile)
+		if err != nil {
+			return err
+		}
+		key, err := mesh.ParseBundleKey(kd)
+		if err != nil {
+			return err
+		}
+		kr := mesh.New()
+		kr.SkipSaveCerts = true
+		if err := initPlatform(ctx, kr); err != nil {
+			return err
+		}
+		if err := kr.LoadConfig(ctx); err != nil {
+			return err
+		}
+		var extra []string
+		if *auds != "" {
+			extra = strings.Split(*auds, ",")
+		}
+		b, err := kr.NewBundle(ctx, extra, *ttl)
+		if err != nil {
+			return err
+		}
+		f, err := os.OpenFile(*out, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+		if err != nil {
+			return err
+		}
+		if err := mesh.WriteBundle(f, b, key); err != nil {
+			f.Close()
+			return err
+		}
+		fmt.Println("Created", *out, "tokens", len(b.Tokens), "expires", b.Expires.Format(time.RFC3339))
+		return f.Close()
+	case "use":
+		if len(args) != 2 {
+			return errors.New(bundleUsage)
+		}
+		kr := mesh.New()
+		pub, err := kr.BundlePublicKey()
+		if err != nil {
+			return err
+		}
+		data, err := ioutil.ReadFile(args[1])
+		if err != nil {
+			return err
+		}
+		b, err := mesh.ReadBundle(bytes.NewReader(data), pub)
+		if err != nil {
+			return err
+		}
+		if time.Now().After(b.Expires) {
+			fmt.Println("WARNING: bundle tokens expired", b.Expires.Format(time.RFC3339))
+		}
+		dst := kr.BundlePath()
+		if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(dst, data, 0600); err != nil {
+			return err
+		}
+		fmt.Println("Installed", dst, "namespace", b.Namespace, "created", b.Created.Format(time.RFC3339))
+		return nil
+	}
+	return errors.New(bundleUsage)
+}
@@ -0,0 +1,216 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/GoogleCloudPlatform/cloud-run-mesh/pkg/mesh"
+)
+
+func init() {
+	subcommands["check"] = check
+}
+
+// checkResult is a line in the preflight report.
+type checkResult struct {
+	Name   string
+	OK     bool
+	Detail string
+	Hint   string
+}
+
+// check validates the environment without starting the agent or the app:
+//
+//	krun check
+//
+// Uses the same env and discovery as the normal startup. Returns an error if any check failed.
+func check(ctx context.Context, args []string) error {
+	ctx, cf := context.WithTimeout(ctx, 60*time.Second)
+	defer cf()
+	kr := mesh.New()
+	res := runChecks(ctx, kr)
+	if failed := writeChecks(os.Stdout, res); failed > 0 {
+		return fmt.Errorf("%d checks failed", failed)
+	}
+	return nil
+}
+
+// writeChecks prints the report, with the hints for the failed checks. Returns the number of failed checks.
+func writeChecks(w io.Writer, res []*checkResult) int {
+	failed := 0
+	for _, r := range res {
+		status := "PASS"
+		if !r.OK {
+			status = "FAIL"
+			failed++
+		}
+		fmt.Fprintf(w, "%s %-10s %s\n", status, r.Name, r.Detail)
+		if !r.OK && r.Hint != "" {
+			fmt.Fprintf(w, "     %-10s hint: %s\n", "", r.Hint)
+		}
+	}
+	return failed
+}
+
+func runChecks(ctx context.Context, kr *mesh.KRun) []*checkResult {
+	res := []*checkResult{}
+
+	explicitXDS := os.Getenv("XDS_ADDR") != ""
+	if !explicitXDS {
+		r := &checkResult{Name: "k8s"}
+		res = append(res, r)
+		err := initPlatform(ctx, kr)
+		if err == nil && kr.Cfg == nil {
+			err = errors.New("no config cluster found")
+		}
+		if err != nil {
+			r.Detail = err.Error()
+			r.Hint = "set KUBECONFIG, or PROJECT_ID, CLUSTER_LOCATION and CLUSTER_NAME; the service account needs container.clusterViewer"
+			return res
+		}
+		r.OK = true
+		r.Detail = fmt.Sprintf("%s/%s/%s", kr.ProjectId, kr.ClusterLocation, kr.ClusterName)
+
+		r = &checkResult{Name: "mesh-env"}
+		res = append(res, r)
+		d, err := kr.Cfg.GetCM(ctx, "istio-system", "mesh-env")
+		if err != nil {
+			r.Detail = err.Error()
+			r.Hint = "install the mesh connector (hgate) in the config cluster, and grant the KSA get on istio-system/mesh-env"
+			return res
+		}
+		r.OK = true
+		if v, err := mesh.MigrateMeshEnv(d); err == nil {
+			r.Detail = fmt.Sprintf("version %d", v)
+		}
+		if issues := mesh.ValidateMeshEnv(d); len(issues) > 0 {
+			r.OK = kr.Config("MESH_ENV_STRICT", "") != "true"
+			r.Detail = r.Detail + " " + strings.Join(issues, "; ")
+			r.Hint = "check the mesh-env keys, the schema is in pkg/mesh/meshenv_schema.go"
+		}
+	}
+
+	r := &checkResult{Name: "config"}
+	res = append(res, r)
+	if err := kr.LoadConfig(ctx); err != nil {
+		r.Detail = err.Error()
+		r.Hint = "check mesh-env and the workload certificate settings (CA_POOL, MESH_CA)"
+		return res
+	}
+	if err := kr.ValidateConfig(); err != nil {
+		r.Detail = err.Error()
+		return res
+	}
+	r.OK = true
+	r.Detail = fmt.Sprintf("namespace=%s name=%s ksa=%s trustDomain=%s", kr.Namespace, kr.Name, kr.KSA, kr.TrustDomain)
+
+	ca := kr.SelectCA()
+	if kr.TokenProvider != nil {
+		auds := map[string]bool{kr.TrustDomain: true, ca.Audience: true}
+		for a := range kr.Aud2File {
+			auds[a] = true
+		}
+		for a := range auds {
+			if a == "" {
+				continue
+			}
+			r := &checkResult{Name: "token", Detail: a}
+			res = append(res, r)
+			if _, err := kr.TokenProvider.GetToken(ctx, a); err != nil {
+				r.Detail = a + ": " + err.Error()
+				r.Hint = "grant the GSA roles/container.developer or serviceaccounts/token create in " + kr.Namespace
+				continue
+			}
+			r.OK = true
+		}
+	}
+
+	roots, _ := x509.SystemCertPool()
+	if roots == nil {
+		roots = x509.NewCertPool()
+	}
+	if kr.CitadelRoot != "" {
+		roots.AppendCertsFromPEM([]byte(kr.CitadelRoot))
+	}
+	xds := kr.FindXDSAddr()
+	if xds != "-" {
+		res = append(res, checkTLS(ctx, "xds", xds, roots, kr.Config("ISTIOD_SAN", ""),
+			"check the VPC connector and firewall for port 15012, or MESH_TENANT for managed control plane"))
+	}
+	if ca.Addr != "" && ca.Addr != xds {
+		res = append(res, checkTLS(ctx, "ca", ca.Addr, roots, "", "check MESH_CA and egress to "+ca.Addr))
+	}
+
+	res = append(res, checkIptables())
+	return res
+}
+
+// checkTLS connects to the address and does a TLS handshake, verifying the server certificate.
+func checkTLS(ctx context.Context, name, addr string, roots *x509.CertPool, serverName, hint string) *checkResult {
+	r := &checkResult{Name: name, Detail: addr, Hint: hint}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		r.Detail = addr + ": " + err.Error()
+		return r
+	}
+	if serverName == "" {
+		serverName = host
+	}
+	d := &net.Dialer{Timeout: 5 * time.Second}
+	c, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		r.Detail = addr + ": " + err.Error()
+		return r
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	tc := tls.Client(c, &tls.Config{ServerName: serverName, RootCAs: roots, NextProtos: []string{"h2"}})
+	if err := tc.Handshake(); err != nil {
+		r.Detail = addr + ": TCP ok, TLS " + err.Error()
+		r.Hint = "the server certificate is not trusted - check the mesh roots in mesh-env (CAROOT_*) and ISTIOD_SAN"
+		return r
+	}
+	r.OK = true
+	return r
+}
+
+func checkIptables() *checkResult {
+	r := &checkResult{Name: "iptables"}
+	if os.Getuid() != 0 {
+		r.OK = true
+		r.Detail = "not root, capture disabled (whitebox mode)"
+		return r
+	}
+	out, err := exec.Command("iptables", "-t", "nat", "-L", "-n").CombinedOutput()
+	if err != nil {
+		r.Detail = strings.TrimSpace(string(out)) + " " + err.Error()
+		r.Hint = "requires NET_ADMIN - use CloudRun 2nd gen execution environment, or ISTIO_META_INTERCEPTION_MODE=NONE"
+		return r
+	}
+	r.OK = true
+	r.Detail = "nat table available"
+	return r
+}
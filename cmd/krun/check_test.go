@@ -0,0 +1,108 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestWriteChecks(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		res    []*checkResult
+		failed int
+		out    []string
+	}{
+		{"pass", []*checkResult{{Name: "k8s", OK: true, Detail: "p/l/c", Hint: "unused"}}, 0,
+			[]string{"PASS k8s        p/l/c\n"}},
+		{"fail with hint", []*checkResult{
+			{Name: "k8s", OK: true, Detail: "p/l/c"},
+			{Name: "mesh-env", Detail: "forbidden", Hint: "grant get"},
+		}, 1, []string{"PASS k8s        p/l/c\n", "FAIL mesh-env   forbidden\n", "hint: grant get\n"}},
+		{"fail without hint", []*checkResult{{Name: "xds", Detail: "timeout"}, {Name: "ca", Detail: "timeout"}}, 2,
+			[]string{"FAIL xds        timeout\nFAIL ca         timeout\n"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			b := &bytes.Buffer{}
+			if n := writeChecks(b, tc.res); n != tc.failed {
+				t.Error("Unexpected failed count", n, tc.failed)
+			}
+			for _, o := range tc.out {
+				if !strings.Contains(b.String(), o) {
+					t.Errorf("Missing %q in\n%s", o, b.String())
+				}
+			}
+			if strings.Contains(b.String(), "unused") {
+				t.Error("Hint printed for a passed check", b.String())
+			}
+		})
+	}
+}
+
+func TestCheckTLS(t *testing.T) {
+	// Istiod and the CA use gRPC - the check requires h2.
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	defer srv.Close()
+	addr := srv.Listener.Addr().String()
+	trusted := x509.NewCertPool()
+	trusted.AddCert(srv.Certificate())
+	ctx := context.Background()
+
+	for _, tc := range []struct {
+		name       string
+		addr       string
+		roots      *x509.CertPool
+		serverName string
+		ok         bool
+		detail     string
+	}{
+		{"trusted", addr, trusted, "", true, addr},
+		{"san", addr, trusted, "example.com", true, addr},
+		{"wrong san", addr, trusted, "istiod.istio-system.svc", false, "TCP ok, TLS"},
+		{"untrusted", addr, x509.NewCertPool(), "", false, "TCP ok, TLS"},
+		{"missing port", "127.0.0.1", trusted, "", false, "missing port"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := checkTLS(ctx, "xds", tc.addr, tc.roots, tc.serverName, "hint")
+			if r.OK != tc.ok || !strings.Contains(r.Detail, tc.detail) || r.Hint == "" {
+				t.Error("Unexpected result", r.OK, r.Detail, r.Hint)
+			}
+		})
+	}
+
+	// Nothing listening - the TCP connection fails.
+	srv.Close()
+	if r := checkTLS(ctx, "xds", addr, trusted, "", "hint"); r.OK || strings.Contains(r.Detail, "TCP ok") {
+		t.Error("Expecting connection error", r.Detail)
+	}
+}
+
+func TestCheckIptables(t *testing.T) {
+	if os.Getuid() == 0 {
+		t.Skip("depends on the iptables install when running as root")
+	}
+	if r := checkIptables(); !r.OK || !strings.Contains(r.Detail, "not root") {
+		t.Error("Unexpected result", r)
+	}
+}
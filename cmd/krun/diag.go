@@ -0,0 +1,66 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/GoogleCloudPlatform/cloud-run-mesh/pkg/mesh"
+)
+
+func init() {
+	subcommands["diag"] = diag
+}
+
+// diag runs diagnostics in a running instance - for example from an ssh session:
+//
+//	krun diag capture [-json]
+//
+// 'capture' summarizes the outbound connections by destination, and whether they were redirected to Envoy,
+// to the egress policy, went direct or got no reply. The capture rule counters are listed after the connections.
+func diag(ctx context.Context, args []string) error {
+	if len(args) == 0 || args[0] != "capture" {
+		return errors.New("usage: krun diag capture [-json]")
+	}
+	fs := flag.NewFlagSet("diag capture", flag.ExitOnError)
+	asJSON := fs.Bool("json", false, "JSON output")
+	fs.Parse(args[1:])
+
+	res := mesh.New().CaptureReport()
+	if *asJSON {
+		e := json.NewEncoder(os.Stdout)
+		e.SetIndent("", "  ")
+		return e.Encode(res)
+	}
+	fmt.Printf("%-6s %-40s %-10s %s\n", "PROTO", "DESTINATION", "VERDICT", "COUNT")
+	for _, d := range res.Dests {
+		fmt.Printf("%-6s %-40s %-10s %d\n", d.Proto, d.Dst, d.Verdict, d.Count)
+	}
+	if len(res.Rules) > 0 {
+		fmt.Println()
+		for _, r := range res.Rules {
+			fmt.Println(r)
+		}
+	}
+	for _, e := range res.Errors {
+		fmt.Println("ERROR", e)
+	}
+	return nil
+}
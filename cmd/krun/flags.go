@@ -0,0 +1,162 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"runtime"
+	"sort"
+	"strings"
+
+	"github.com/GoogleCloudPlatform/cloud-run-mesh/pkg/mesh"
+)
+
+func init() {
+	subcommands["run"] = runCmd
+	subcommands["version"] = versionCmd
+	subcommands["env"] = envCmd
+}
+
+// flagConfig holds the settings from the command line, applied to KRun with SetFlagConfig.
+var flagConfig = map[string]string{}
+
+// Short flags for common settings, in addition to the flag for each config key.
+var flagAliases = map[string]string{
+	"local":   "MESH_LOCAL",
+	"dry-run": "MESH_DRY_RUN",
+	"debug":   "MESH_DEBUG",
+}
+
+// flagName returns the flag for a config key - XDS_ADDR is --xds-addr.
+func flagName(key string) string {
+	return strings.ToLower(strings.Replace(key, "_", "-", -1))
+}
+
+// configFlag sets a config key. Bool keys can be used without a value.
+type configFlag struct {
+	key    string
+	isBool bool
+}
+
+func (f *configFlag) String() string {
+	if f == nil {
+		return ""
+	}
+	return flagConfig[f.key]
+}
+
+func (f *configFlag) Set(v string) error {
+	if k := mesh.ConfigKeys[f.key]; k != nil {
+		if err := k.Validate(v); err != nil {
+			return err
+		}
+	}
+	flagConfig[f.key] = v
+	return nil
+}
+
+func (f *configFlag) IsBoolFlag() bool {
+	return f.isBool
+}
+
+// configFlagSet returns a flag set with a flag for each declared config key.
+func configFlagSet(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	keys := []string{}
+	for k := range mesh.ConfigKeys {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		ck := mesh.ConfigKeys[k]
+		usage := ck.Doc
+		if usage == "" {
+			usage = "Sets " + k
+		}
+		if len(ck.Values) > 0 {
+			usage = usage + ", one of " + strings.Join(ck.Values, ",")
+		}
+		if ck.Default != "" {
+			usage = usage + " (default " + ck.Default + ")"
+		}
+		fs.Var(&configFlag{key: k, isBool: ck.Type == mesh.TypeBool}, flagName(k), usage)
+	}
+	for a, k := range flagAliases {
+		ck := mesh.ConfigKeys[k]
+		fs.Var(&configFlag{key: k, isBool: ck != nil && ck.Type == mesh.TypeBool}, a, "Alias for --"+flagName(k))
+	}
+	return fs
+}
+
+// parseConfigFlags parses the flags, and sets the env variables - the agent and the code reading env directly
+// see the same settings. Returns the remaining arguments.
+func parseConfigFlags(name, usage string, args []string) []string {
+	fs := configFlagSet(name)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: krun %s %s\n\nEach flag can also be set as an env variable - --xds-addr is XDS_ADDR.\n\n", name, usage)
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	for k, v := range flagConfig {
+		os.Setenv(k, v)
+	}
+	return fs.Args()
+}
+
+// runCmd is the flag-based form of the default command:
+//
+//	krun run [flags] -- APP_CMD ARGS...
+func runCmd(ctx context.Context, args []string) error {
+	app := parseConfigFlags("run", "[flags] -- APP_CMD ARGS...", args)
+	os.Args = append(os.Args[0:1], app...)
+	runKRun(ctx)
+	return nil
+}
+
+func versionCmd(ctx context.Context, args []string) error {
+	fmt.Printf("krun %s %s %s/%s\n", mesh.BuildVersion, runtime.Version(), runtime.GOOS, runtime.GOARCH)
+	if mesh.BuildCommit != "" {
+		fmt.Printf("commit %s builder %s\n", mesh.BuildCommit, mesh.BuildBuilder)
+	}
+	return nil
+}
+
+// envCmd prints the settings, with the source, as env variables:
+//
+//	krun env [-a] [flags]
+//
+// mesh-env is not loaded - only the local sources (flags, env and the config file) are shown. -a includes the
+// settings using the default value.
+func envCmd(ctx context.Context, args []string) error {
+	all := false
+	rest := []string{}
+	for _, a := range args {
+		if a == "-a" || a == "--all" {
+			all = true
+			continue
+		}
+		rest = append(rest, a)
+	}
+	parseConfigFlags("env", "[-a] [flags]", rest)
+	kr := mesh.New()
+	for k, v := range flagConfig {
+		kr.SetFlagConfig(k, v)
+	}
+	kr.WriteConfigEnv(os.Stdout, all)
+	return nil
+}
@@ -24,6 +24,8 @@ import (
 	"strings"
 	"time"
 
+	"github.com/GoogleCloudPlatform/cloud-run-mesh/pkg/aws"
+	"github.com/GoogleCloudPlatform/cloud-run-mesh/pkg/azure"
 	"github.com/GoogleCloudPlatform/cloud-run-mesh/pkg/gcp"
 	"github.com/GoogleCloudPlatform/cloud-run-mesh/pkg/hbone"
 	"github.com/GoogleCloudPlatform/cloud-run-mesh/pkg/mesh"
@@ -32,9 +34,51 @@ import (
 
 var initDebug func(run *mesh.KRun)
 
+// Subcommands for setup and troubleshooting, selected by the first argument. All other arguments are the app
+// command.
+var subcommands = map[string]func(ctx context.Context, args []string) error{}
+
 func main() {
 	ctx := context.Background()
+	if len(os.Args) > 1 && os.Args[1] == "--local" {
+		os.Setenv("MESH_LOCAL", "true")
+		os.Args = append(os.Args[0:1], os.Args[2:]...)
+	}
+	if len(os.Args) > 1 && os.Args[1] == "--dry-run" {
+		os.Setenv("MESH_DRY_RUN", "true")
+		os.Args = append(os.Args[0:1], os.Args[2:]...)
+	}
+	if len(os.Args) > 1 {
+		if sc, f := subcommands[os.Args[1]]; f {
+			if err := sc(ctx, os.Args[2:]); err != nil {
+				log.Fatal(os.Args[1], " failed: ", err)
+			}
+			return
+		}
+	}
+	runKRun(ctx)
+}
+
+// runKRun starts the agent and the app. The app command is the rest of the command line, or APP_CMD.
+func runKRun(ctx context.Context) {
 	kr := mesh.New()
+	for k, v := range flagConfig {
+		kr.SetFlagConfig(k, v)
+	}
+	if kr.Config("MESH_TLS_POLICY", "") == "fips" {
+		hbone.SetFIPS()
+	}
+	kr.LazyProxy = kr.Config("MESH_LAZY_PROXY", "") == "true"
+	if kr.LazyProxy && kr.Strict() {
+		log.Println("MESH_LAZY_PROXY ignored with MESH_REQUIRED=strict")
+		kr.LazyProxy = false
+	}
+	if kr.Config("MESH_DRY_RUN", "") == "true" {
+		kr.DryRun = true
+		kr.SkipSaveCerts = true
+	} else {
+		kr.InitGoogleAPIs()
+	}
 
 	// If InitForTDFromMeshEnv returns true, then we will use TD mesh
 	if tdSelected, err := kr.InitForTDFromMeshEnv(); tdSelected {
@@ -44,29 +88,100 @@ func main() {
 		startTd(kr)
 		select {}
 	}
-	if os.Getenv("XDS_ADDR") != "" {
+	if kr.Config("MESH_LOCAL", "") == "true" {
+		// Local development, no cloud platform.
+		err := kr.InitLocal(ctx)
+		if err == nil {
+			err = kr.RunPhase(ctx, mesh.PhaseMeshEnv, kr.LoadConfig)
+		}
+		if err != nil {
+			log.Fatal("Failed to init local mode ", err)
+		}
+	} else if os.Getenv("XDS_ADDR") != "" {
 		// Explicit config, bypass auto-discovery
+		if aws.OnECS() {
+			kr.Platform = aws.Platform
+		} else if azure.OnAzure() {
+			kr.Platform = azure.Platform
+		}
 	} else {
-		err := gcp.InitGCP(ctx, kr)
-		if err != nil {
+		kr.LoadStartupCache()
+		if err := kr.LoadBundle(); err != nil {
+			log.Println("Failed to load bootstrap bundle", err)
+		}
+		err := kr.RunPhase(ctx, mesh.PhasePlatform, func(ctx context.Context) error {
+			return initPlatform(ctx, kr)
+		})
+		if err != nil && kr.UseBundle() {
+			log.Println("Failed to find K8S, using bootstrap bundle", time.Since(kr.StartTime), err)
+		} else if err != nil {
 			log.Fatal("Failed to find K8S ", time.Since(kr.StartTime), kr, os.Environ(), err)
 		}
 
 		// Use env and vendor init to discover the mesh - including APIserver, XDS, roots.
-		err = kr.LoadConfig(context.Background())
+		err = kr.RunPhase(ctx, mesh.PhaseMeshEnv, kr.LoadConfig)
 		if err != nil {
 			log.Fatal("Failed to connect to mesh ", time.Since(kr.StartTime), kr, os.Environ(), err)
 		}
+		if err := kr.SaveStartupCache(); err != nil {
+			log.Println("Failed to save startup cache", err)
+		}
+	}
+	if err := kr.ValidateConfig(); err != nil {
+		log.Fatal(err)
+	}
+	if u := kr.UnknownConfig(os.Environ()); len(u) > 0 {
+		log.Println("Unknown settings, ignored", u)
+	}
+	if kr.DryRun {
+		// Discovery is done - print the agent and app commands instead of running them.
+		if err := kr.StartIstioAgent(ctx); err != nil {
+			log.Fatal(err)
+		}
+		kr.StartApp()
+		return
+	}
+	kr.WatchStartupBudget()
+	kr.PublishEvent(mesh.EventStarted, map[string]string{"initTime": time.Since(kr.StartTime).String()})
+	if err := kr.ApplyFilters(ctx); err != nil {
+		log.Println("Failed to apply proxy filters", err)
+	}
+	if err := kr.StartDebugServer(); err != nil {
+		log.Println("Failed to start debug server", err)
+	}
+
+	// Must be started before the agent - pilot-agent uses the socket for SDS if it exists.
+	if err := kr.StartWorkloadAPI(); err != nil {
+		log.Println("Failed to start the SPIFFE Workload API", err)
+	}
+	if err := kr.StartMetricsMerge(); err != nil {
+		log.Println("Failed to start the metrics merge", err)
+	}
+
+	kr.EnableCoreDumps()
+
+	// A pinned proxy version replaces the binaries in the image.
+	if err := kr.DownloadProxy(ctx); err != nil {
+		log.Fatal("Failed to download the proxy ", err)
 	}
 
 	meshMode := true
 
-	if _, err := os.Stat("/usr/local/bin/pilot-agent"); os.IsNotExist(err) {
+	if kr.AgentPath() == "" {
 		meshMode = false
 	}
 	if kr.XDSAddr == "-" {
 		meshMode = false
 	}
+	// Experimental: ztunnel-compatible node proxy, no Envoy.
+	ambient := kr.Config("MESH_MODE", "") == "ambient"
+	if ambient {
+		meshMode = false
+	}
+	// Minimal gateway image - krun routes by SNI.
+	if kr.Gateway != "" && !envoyAvailable(kr) {
+		meshMode = false
+	}
 
 	if meshMode {
 		log.Println("K8S Client initialized", "cluster", kr.ClusterAddress,
@@ -75,30 +190,82 @@ func main() {
 			"name", kr.Name,
 			"labels", kr.Labels, "XDS", kr.XDSAddr, "initTime", time.Since(kr.StartTime))
 		// Use k8s client to autoconfigure, reading from cluster.
-		kr.EnvoyStartTime = time.Now()
-		err := kr.StartIstioAgent()
+		if err := kr.StartALS(); err != nil {
+			log.Println("Failed to start access log receiver", err)
+		}
+		err := kr.RunPhase(ctx, mesh.PhaseProxyStart, kr.StartIstioAgent)
 		if err != nil {
 			log.Fatal("Failed to start the mesh agent ", err)
 		}
-		err = kr.WaitHTTPReady("http://127.0.0.1:15021/healthz/ready", 10*time.Second)
-		if err != nil {
-			cd, err := http.Get("http://127.0.0.1:15000/config_dump")
-			if err == nil {
-				cdb, err := ioutil.ReadAll(cd.Body)
-				if err == nil {
-					//os.Stderr.Write(cdb)
-					ioutil.WriteFile("./var/lib/istio/envoy/config_dump.json", cdb, 0777)
+		kr.StartProxyUpgradeWatcher(ctx)
+		if kr.LazyProxy {
+			// The app starts without waiting - mesh traffic is captured once the proxy is ready.
+			go func() {
+				if err := proxyReady(ctx, kr, 60*time.Second); err != nil {
+					log.Println("Mesh agent not ready, continuing without interception", err)
+					return
 				}
-			}
+				if err := kr.EnableInterception(); err != nil {
+					log.Println("Failed to enable interception", err)
+				}
+			}()
+		} else if err := proxyReady(ctx, kr, readyTimeout(kr)); err != nil {
 			log.Fatal("Mesh agent not ready ", err)
 		}
-		kr.EnvoyReadyTime = time.Now()
 	} else {
 		log.Println("Proxyless init", "cluster", kr.ClusterAddress,
 			"project_number", kr.ProjectNumber, "instanceID", kr.InstanceID,
 			"ksa", kr.KSA, "ns", kr.Namespace,
 			"name", kr.Name,
 			"labels", kr.Labels, "XDS", kr.XDSAddr, "initTime", time.Since(kr.StartTime))
+		if kr.AgentPath() == "" {
+			// No agent to generate the gRPC bootstrap - proxyless apps connect directly to the control plane.
+			if err := kr.WriteGRPCBootstrap(); err != nil {
+				log.Println("Failed to generate gRPC bootstrap", err)
+			}
+		}
+	}
+	// Without Envoy, krun can keep the mesh names and listeners itself.
+	if err := kr.StartXDSClient(ctx); err != nil {
+		log.Println("Failed to start XDS client", err)
+	}
+	kr.StartVersionCheck(ctx)
+
+	if gsa := kr.Config("METADATA_GSA", ""); gsa != "" {
+		mts, err := sts.NewSTS(kr)
+		if err == nil {
+			mts.GSA = gsa
+			kr.MetadataTokenProvider = mts
+		}
+	}
+	if err := kr.StartMetadataProxy(); err != nil {
+		log.Fatal("Failed to start metadata proxy ", err)
+	}
+	if err := kr.RunPhase(ctx, mesh.PhaseSecrets, func(ctx context.Context) error {
+		return gcp.LoadSecrets(ctx, kr)
+	}); err != nil {
+		log.Fatal("Failed to load secrets ", err)
+	}
+	if err := kr.StartCloudSQLProxy(); err != nil {
+		log.Fatal("Cloud SQL proxy not ready ", err)
+	}
+
+	// Must be installed before the app starts - a failure would leave the app with unrestricted egress.
+	if err := kr.StartEgressPolicy(); err != nil {
+		log.Fatal("Failed to start egress policy ", err)
+	}
+	if meshMode {
+		if err := kr.LockEnvoyAdmin(); err != nil {
+			log.Println("Failed to restrict the Envoy admin port", err)
+		}
+	}
+	if err := kr.StartRootless(); err != nil {
+		log.Fatal("Failed to start rootless mode ", err)
+	}
+	if kr.Strict() {
+		if err := kr.CheckRequired(ctx, meshMode); err != nil {
+			log.Fatal("MESH_REQUIRED=strict, not starting the app: ", err)
+		}
 	}
 
 	// TODO: wait for app  ready before binding to port - using same CloudRun 'bind to port 8080' or proper health check
@@ -109,9 +276,15 @@ func main() {
 		go initDebug(kr)
 	}
 
+	if err := kr.StartMeshInfo(); err != nil {
+		log.Println("Failed to start mesh info", err)
+	}
+	if err := kr.RunHooks(ctx, mesh.HookPreStart); err != nil {
+		log.Fatal(err)
+	}
 	kr.StartApp()
 
-	err := kr.WaitAppStartup()
+	err := kr.RunPhase(ctx, mesh.PhaseAppReady, kr.WaitAppStartup)
 	if err != nil {
 		log.Fatal("Timeout waiting for app", err)
 	}
@@ -119,6 +292,20 @@ func main() {
 		"app_start", kr.AppReadyTime.Sub(kr.EnvoyReadyTime),
 		"envoy_time", kr.EnvoyReadyTime.Sub(kr.EnvoyStartTime),
 		"init_time", kr.EnvoyStartTime.Sub(kr.StartTime))
+	kr.ReportStartup(ctx)
+	if err := kr.RunHooks(ctx, mesh.HookPostStart); err != nil {
+		log.Println(err)
+	}
+	if err := kr.RegisterWorkloadEntry(ctx, true); err != nil {
+		log.Println("Failed to register WorkloadEntry", err)
+	}
+	if err := kr.PublishService(ctx); err != nil {
+		log.Println("Failed to publish service", err)
+	}
+	if err := kr.PublishNetworkGateways(ctx); err != nil {
+		log.Println("Failed to publish network gateways", err)
+	}
+	kr.StartStatusReporter()
 
 	// Start the tunnel: accepts H2 streams, forward to 15003 (envoy) which handle mTLS
 	// and applies the metrics/enforcements and forwards to the app on 8080
@@ -151,7 +338,15 @@ func main() {
 	// This code path will change as Envoy support for adding JWT is added and Istio 'hbone'
 	// is fully implemented.
 	hb := hbone.New()
+	hb.WebSocketFallback = kr.Config("HBONE_WEBSOCKET_FALLBACK", "true") == "true"
+	if peers := kr.Config("HBONE_ALLOWED_PEERS", ""); peers != "" {
+		hb.AllowedPeers = strings.Split(peers, ",")
+	}
+	hb.SetKeepAlive(kr.KeepAlive())
 	initPorts(kr, hb)
+	initInbound(kr, hb)
+	hb.Health = kr.Healthy
+	hb.AppProbe = kr.AppProbe
 
 	hbone.Debug = kr.Config("MESH_DEBUG", "") != ""
 	mesh.Debug = kr.Config("MESH_DEBUG", "") != ""
@@ -162,9 +357,91 @@ func main() {
 		log.Fatal("Failed to start h2c on 15009", err)
 	}
 
+	if ambient {
+		startAmbient(kr, hb)
+	}
+	startReverseTunnel(ctx, kr, hb)
+	if kr.EastWestGateway() {
+		startEastWest(ctx, kr, hb)
+	}
+	if kr.Gateway != "" && !envoyAvailable(kr) {
+		startSNIRouter(kr, hb)
+	}
+
 	select {}
 }
 
+// Agent readiness and Envoy admin addresses, replaced in tests.
+var (
+	agentReadyURL = "http://127.0.0.1:15021/healthz/ready"
+	envoyAdminURL = "http://127.0.0.1:15000"
+)
+
+// proxyReady waits for the agent and Envoy to be ready, and starts the features using the proxy.
+// If the proxy is not ready, the Envoy config dump is saved for debugging.
+func proxyReady(ctx context.Context, kr *mesh.KRun, timeout time.Duration) error {
+	err := kr.WaitHTTPReady(agentReadyURL, timeout)
+	if err != nil {
+		if cerr := saveConfigDump(kr.BaseDir + "/var/lib/istio/envoy/config_dump.json"); cerr != nil {
+			log.Println("Failed to save config dump", cerr)
+		}
+		return err
+	}
+	if err := kr.PrewarmGateway(ctx); err != nil {
+		log.Println("Gateway prewarm incomplete", err)
+	}
+	kr.EnvoyReadyTime = time.Now()
+	kr.UnpinControlPlane()
+	kr.PublishEvent(mesh.EventMeshJoined, map[string]string{
+		"xds":       kr.XDSAddr,
+		"readyTime": kr.EnvoyReadyTime.Sub(kr.StartTime).String(),
+	})
+	kr.WatchCertRotation(ctx)
+	kr.StartConfigDumpSnapshots(ctx)
+	kr.StartWatchdog(ctx)
+	kr.StartOutboundDefaults(ctx)
+	kr.StartEndpointCache(ctx)
+	kr.StartStatsExporter()
+	return nil
+}
+
+func saveConfigDump(file string) error {
+	res, err := http.Get(envoyAdminURL + "/config_dump")
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		return fmt.Errorf("config_dump: %s", res.Status)
+	}
+	data, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(file, data, 0644)
+}
+
+// readyTimeout is the time to wait for the proxy before giving up. In strict mode the app is not started
+// without the proxy, so the longer MESH_REQUIRED_TIMEOUT is used.
+func readyTimeout(kr *mesh.KRun) time.Duration {
+	if kr.Strict() {
+		return kr.RequiredTimeout()
+	}
+	d, _ := kr.PhaseTimeout(mesh.PhaseProxyReady)
+	return d
+}
+
+// initPlatform runs the vendor init for the detected platform, finding the config cluster and token provider.
+func initPlatform(ctx context.Context, kr *mesh.KRun) error {
+	if aws.OnECS() {
+		return aws.InitAWS(ctx, kr)
+	}
+	if azure.OnAzure() {
+		return azure.InitAzure(ctx, kr)
+	}
+	return gcp.InitGCP(ctx, kr)
+}
+
 func initPorts(kr *mesh.KRun, hb *hbone.HBone) {
 	for k, v := range kr.MeshEnv {
 		if strings.HasPrefix(k, "PORT_") && len(k) > 5 {
@@ -173,6 +450,129 @@ func initPorts(kr *mesh.KRun, hb *hbone.HBone) {
 	}
 }
 
+// initInbound enables mTLS HBONE on the serving port, for mesh clients using /_hbone/mtls. Unlike /_hbone/15003,
+// mTLS is terminated by krun and streams go directly to the app ports declared with PORT_name.
+func initInbound(kr *mesh.KRun, hb *hbone.HBone) {
+	hb.InboundAuth = kr.InboundAuth()
+	hb.RateLimit = kr.RateLimiter()
+	hb.Mirror = kr.Mirror()
+	if kr.X509KeyPair == nil || kr.TrustedCertPool == nil {
+		return
+	}
+	hb.Cert = kr.X509KeyPair
+	hb.MeshRoots = kr.TrustedCertPool
+	if len(hb.Ports) == 0 {
+		hb.Ports["http"] = kr.Config("PORT_http", "8080")
+	}
+}
+
+// startReverseTunnel registers the instance with the east-west gateway at HBONE_REVERSE_GATEWAY (host or
+// host:port, reachable using the VPC connector). Mesh traffic for the instance is received over the tunnel.
+// The gateway only accepts the registration if the service account (KSA) matches the workload name.
+func startReverseTunnel(ctx context.Context, kr *mesh.KRun, hb *hbone.HBone) {
+	gw := kr.Config("HBONE_REVERSE_GATEWAY", "")
+	if gw == "" {
+		return
+	}
+	if hb.Cert == nil {
+		log.Println("Reverse tunnel requires workload certificates, CA_POOL must be set")
+		return
+	}
+	if !strings.Contains(gw, ":") {
+		gw = gw + ":" + hbone.HBONEPort
+	}
+	go hb.ReverseTunnel(ctx, gw, &hbone.Registration{
+		Name:       kr.Name,
+		InstanceID: kr.InstanceID,
+		Labels:     kr.Labels,
+	})
+}
+
+// startAmbient accepts mTLS HBONE connections from ztunnel and waypoints, using the workload certificate.
+// Streams are forwarded to the app ports declared with PORT_name - there is no L7 processing.
+func startAmbient(kr *mesh.KRun, hb *hbone.HBone) {
+	if kr.X509KeyPair == nil {
+		log.Fatal("Ambient mode requires workload certificates, CA_POOL must be set")
+	}
+	hb.Cert = kr.X509KeyPair
+	hb.MeshRoots = kr.TrustedCertPool
+	if len(hb.Ports) == 0 {
+		hb.Ports["http"] = kr.Config("PORT_http", "8080")
+	}
+	_, err := hbone.ListenAndServeTCP(":"+hbone.HBONEPort, hb.HandleAcceptedHBONE)
+	if err != nil {
+		log.Fatal("Failed to start HBONE on "+hbone.HBONEPort, err)
+	}
+	log.Println("Ambient mode", "hbone", hbone.HBONEPort, "ports", hb.Ports)
+}
+
+// startEastWest forwards HBONE streams from the mesh to CloudRun services, and publishes the gateway address.
+func startEastWest(ctx context.Context, kr *mesh.KRun, hb *hbone.HBone) {
+	stsc, err := sts.NewSTS(kr)
+	if err != nil {
+		log.Fatal("Failed to create token source for east-west gateway", err)
+	}
+	hb.TokenCallback = sts.NewTokenCache(kr, stsc).Token
+	hb.UDPEgress = true
+	hb.AcceptReverse = true
+	hb.HBONEResolver = func(authority string) *hbone.Endpoint {
+		u := kr.CloudRunURL(authority)
+		if u == "" {
+			return nil
+		}
+		return hb.NewEndpoint(u)
+	}
+	if kr.X509KeyPair != nil {
+		// Direct mTLS HBONE, for clients in the same VPC.
+		hb.Cert = kr.X509KeyPair
+		hb.MeshRoots = kr.TrustedCertPool
+		_, err := hbone.ListenAndServeTCP(":"+hbone.HBONEPort, hb.HandleAcceptedHBONE)
+		if err != nil {
+			log.Println("Failed to start HBONE on "+hbone.HBONEPort, err)
+		}
+	}
+	if err := kr.AdvertiseGateway(ctx); err != nil {
+		log.Println("Failed to advertise east-west gateway", err)
+	}
+	log.Println("East-west gateway started", "url", kr.GatewayURL())
+}
+
+func envoyAvailable(kr *mesh.KRun) bool {
+	return kr.EnvoyPath() != ""
+}
+
+// startSNIRouter is used by minimal gateway images, without Envoy. Connections on SNI_PORT (default 15443) are
+// routed by the ClientHello SNI, and forwarded over HBONE without terminating TLS - the same as the Istio
+// east-west gateway in AUTO_PASSTHROUGH mode.
+func startSNIRouter(kr *mesh.KRun, hb *hbone.HBone) {
+	if hb.TokenCallback == nil {
+		stsc, err := sts.NewSTS(kr)
+		if err != nil {
+			log.Println("Failed to create token source for SNI router", err)
+			return
+		}
+		hb.TokenCallback = sts.NewTokenCache(kr, stsc).Token
+	}
+	hb.EndpointResolver = func(sni string) *hbone.Endpoint {
+		authority := hbone.SNIAuthority(sni, "443")
+		if hb.HBONEResolver != nil {
+			return hb.HBONEResolver(authority)
+		}
+		u := kr.CloudRunURL(authority)
+		if u == "" {
+			return nil
+		}
+		return hb.NewEndpoint(u)
+	}
+	port := kr.Config("SNI_PORT", "15443")
+	_, err := hbone.ListenAndServeTCP(":"+port, hb.HandleSNIConn)
+	if err != nil {
+		log.Println("Failed to start SNI router", port, err)
+		return
+	}
+	log.Println("SNI router started, envoy not found", "port", port)
+}
+
 func startTd(kr *mesh.KRun) {
 	if err := kr.LoadTDBootstrapConfigurations(); err != nil {
 		log.Fatalf("Failed to load environment variables for TD due to: %v", err)
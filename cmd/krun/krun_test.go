@@ -0,0 +1,58 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/GoogleCloudPlatform/cloud-run-mesh/pkg/mesh"
+)
+
+func TestProxyNotReady(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/config_dump" {
+			w.Write([]byte(`{"configs": []}`))
+			return
+		}
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+	defer func(r, a string) { agentReadyURL, envoyAdminURL = r, a }(agentReadyURL, envoyAdminURL)
+	agentReadyURL = srv.URL + "/healthz/ready"
+	envoyAdminURL = srv.URL
+
+	kr := mesh.New()
+	kr.BaseDir = t.TempDir()
+	dump := filepath.Join(kr.BaseDir, "/var/lib/istio/envoy/config_dump.json")
+	os.MkdirAll(filepath.Dir(dump), 0755)
+
+	if err := proxyReady(context.Background(), kr, 300*time.Millisecond); err == nil {
+		t.Fatal("Expecting timeout")
+	}
+	if !kr.EnvoyReadyTime.IsZero() {
+		t.Error("Unexpected ready time", kr.EnvoyReadyTime)
+	}
+	data, err := ioutil.ReadFile(dump)
+	if err != nil || string(data) != `{"configs": []}` {
+		t.Error("Missing config dump", string(data), err)
+	}
+}
@@ -0,0 +1,90 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"log"
+	"strings"
+
+	"github.com/GoogleCloudPlatform/cloud-run-mesh/pkg/gcp"
+	"github.com/GoogleCloudPlatform/cloud-run-mesh/pkg/k8s"
+	"github.com/GoogleCloudPlatform/cloud-run-mesh/pkg/mesh"
+)
+
+func init() {
+	subcommands["setup-namespace"] = setupNamespace
+}
+
+// setupNamespace onboards a namespace, replacing the manual steps in google-service-account-template.yaml:
+//
+//	krun setup-namespace [-gsa k8s-NAMESPACE@PROJECT_ID.iam.gserviceaccount.com] [-ksa default] [-labels k=v,...]
+//	  [-workloads NAME,...] NAMESPACE
+//
+// The config cluster is found using KUBECONFIG or the same discovery as the workload (PROJECT_ID, CLUSTER_NAME, etc).
+func setupNamespace(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("setup-namespace", flag.ExitOnError)
+	gsa := fs.String("gsa", "", "Google service account running the CloudRun service. Default k8s-NAMESPACE@PROJECT_ID.iam.gserviceaccount.com")
+	ksa := fs.String("ksa", "default", "K8S service account for the workload")
+	labels := fs.String("labels", "", "Comma separated labels for the namespace, for example istio.io/rev=asm-managed")
+	workloads := fs.String("workloads", "", "Comma separated names of the workloads, to limit access to their config maps")
+	fs.Parse(args)
+
+	kr := mesh.New()
+	if fs.NArg() > 0 {
+		kr.Namespace = fs.Arg(0)
+	}
+	if err := gcp.InitGCP(ctx, kr); err != nil {
+		return err
+	}
+	kc, ok := kr.Cfg.(*k8s.K8S)
+	if !ok || kc.Client == nil {
+		return errors.New("config cluster not found")
+	}
+	if kr.Namespace == "" {
+		return errors.New("missing namespace")
+	}
+	s := &k8s.NamespaceSetup{
+		Namespace: kr.Namespace,
+		KSA:       *ksa,
+		GSA:       *gsa,
+		Labels:    map[string]string{},
+	}
+	if s.GSA == "" {
+		if kr.ProjectId == "" {
+			return errors.New("missing -gsa and PROJECT_ID")
+		}
+		s.GSA = "k8s-" + kr.Namespace + "@" + kr.ProjectId + ".iam.gserviceaccount.com"
+	}
+	for _, w := range strings.Split(*workloads, ",") {
+		if w = strings.TrimSpace(w); w != "" {
+			s.Workloads = append(s.Workloads, w)
+		}
+	}
+	for _, l := range strings.Split(*labels, ",") {
+		kv := strings.SplitN(l, "=", 2)
+		if len(kv) == 2 {
+			s.Labels[kv[0]] = kv[1]
+		}
+	}
+	if err := kc.SetupNamespace(ctx, s); err != nil {
+		return err
+	}
+	log.Println("Namespace ready", "namespace", s.Namespace, "ksa", s.KSA, "gsa", s.GSA,
+		"cluster", kr.ProjectId+"/"+kr.ClusterLocation+"/"+kr.ClusterName)
+	return nil
+}
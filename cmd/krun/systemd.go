@@ -0,0 +1,184 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/GoogleCloudPlatform/cloud-run-mesh/pkg/gcp"
+	"github.com/GoogleCloudPlatform/cloud-run-mesh/pkg/mesh"
+)
+
+func init() {
+	subcommands["install-systemd"] = installSystemd
+}
+
+// Env variables copied to the env file, in addition to the discovered settings.
+var systemdEnvPrefixes = []string{"MESH", "XDS_", "CA_", "ISTIO_", "GATEWAY_", "PORT_", "TRUST_DOMAIN", "APP_",
+	"HBONE_", "DNS_", "OUTBOUND_", "CLOUDSQL_", "SECRET_", "METADATA_", "FLEET_", "CONFIG_CLUSTER", "IMPERSONATE_GSA"}
+
+// installSystemd sets up krun on a VM, for mesh expansion:
+//
+//	krun install-systemd [-name krun] [-dir /etc/systemd/system] [-no-start] [APP_CMD ARGS...]
+//
+//   - the env file /etc/krun/NAME.env is created from the current env and the discovered config (project, cluster,
+//     namespace), so the service doesn't depend on the metadata server at each start.
+//   - the istio directories are created, owned by the proxy uid 1337.
+//   - the unit runs krun as root - iptables capture is set up by krun each time it starts, like on CloudRun.
+func installSystemd(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("install-systemd", flag.ExitOnError)
+	name := fs.String("name", "krun", "Name of the systemd unit")
+	unitDir := fs.String("dir", "/etc/systemd/system", "Directory for the unit file")
+	noStart := fs.Bool("no-start", false, "Only write the files, don't enable and start the unit")
+	fs.Parse(args)
+
+	if os.Getuid() != 0 {
+		return errors.New("install-systemd requires root")
+	}
+	if _, err := exec.LookPath("iptables"); err != nil {
+		log.Println("iptables not found, traffic will not be captured")
+	}
+	bin, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	kr := mesh.New()
+	if err := gcp.InitGCP(ctx, kr); err != nil {
+		// Not fatal - the env file will only have the explicit settings, discovery runs at startup.
+		log.Println("Config discovery failed, using env only", err)
+	}
+	env := systemdEnv(kr, os.Environ())
+
+	envFile := "/etc/krun/" + *name + ".env"
+	if err := os.MkdirAll(filepath.Dir(envFile), 0755); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(envFile, []byte(env), 0600); err != nil {
+		return err
+	}
+
+	for _, d := range []string{"/etc/istio/proxy", "/var/lib/istio/envoy", "/var/lib/istio/data",
+		mesh.WorkloadCertDir[1:], "/var/run/secrets/tokens"} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			return err
+		}
+		os.Chown(d, 1337, 1337)
+	}
+
+	unitFile := filepath.Join(*unitDir, *name+".service")
+	unit := systemdUnit(*name, envFile, append([]string{bin}, fs.Args()...))
+	if err := ioutil.WriteFile(unitFile, []byte(unit), 0644); err != nil {
+		return err
+	}
+	log.Println("Installed", "unit", unitFile, "env", envFile)
+	if *noStart {
+		return nil
+	}
+	for _, c := range [][]string{{"daemon-reload"}, {"enable", "--now", *name + ".service"}} {
+		out, err := exec.Command("systemctl", c...).CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("systemctl %s: %v %s", strings.Join(c, " "), err, out)
+		}
+	}
+	return nil
+}
+
+// systemdEnv returns the env file content - explicit mesh settings plus the discovered config.
+func systemdEnv(kr *mesh.KRun, environ []string) string {
+	vals := map[string]string{}
+	for _, e := range environ {
+		kv := strings.SplitN(e, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		for _, p := range systemdEnvPrefixes {
+			if strings.HasPrefix(kv[0], p) {
+				vals[kv[0]] = kv[1]
+				break
+			}
+		}
+	}
+	for k, v := range map[string]string{
+		"PROJECT_ID":               kr.ProjectId,
+		"PROJECT_NUMBER":           kr.ProjectNumber,
+		"CLUSTER_NAME":             kr.ClusterName,
+		"CLUSTER_LOCATION":         kr.ClusterLocation,
+		"WORKLOAD_NAMESPACE":       kr.Namespace,
+		"WORKLOAD_NAME":            kr.Name,
+		"WORKLOAD_SERVICE_ACCOUNT": kr.KSA,
+	} {
+		if v != "" {
+			vals[k] = v
+		}
+	}
+	keys := []string{}
+	for k := range vals {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	b := &bytes.Buffer{}
+	b.WriteString("# Generated by krun install-systemd\n")
+	for _, k := range keys {
+		b.WriteString(k + "=" + systemdQuote(vals[k]) + "\n")
+	}
+	return b.String()
+}
+
+func systemdUnit(name, envFile string, cmd []string) string {
+	for i, a := range cmd {
+		// ExecStart expands specifiers and env variables.
+		a = strings.ReplaceAll(a, "%", "%%")
+		a = strings.ReplaceAll(a, "$", "$$")
+		cmd[i] = systemdQuote(a)
+	}
+	return fmt.Sprintf(`# Generated by krun install-systemd
+[Unit]
+Description=krun mesh launcher (%s)
+Wants=network-online.target
+After=network-online.target
+
+[Service]
+EnvironmentFile=%s
+ExecStart=%s
+Restart=always
+RestartSec=5
+KillMode=mixed
+LimitNOFILE=65536
+
+[Install]
+WantedBy=multi-user.target
+`, name, envFile, strings.Join(cmd, " "))
+}
+
+// systemdQuote quotes values with spaces or special characters - systemd supports C-style escapes in quotes.
+func systemdQuote(s string) string {
+	if s != "" && !strings.ContainsAny(s, " \t\n\"'\\;") {
+		return s
+	}
+	return strconv.Quote(s)
+}
@@ -0,0 +1,112 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/cloud-run-mesh/pkg/mesh"
+)
+
+func TestSystemdQuote(t *testing.T) {
+	for _, tc := range []struct {
+		in, out string
+	}{
+		{"plain", "plain"},
+		{"a/b:c=d", "a/b:c=d"},
+		{"", `""`},
+		{"a b", `"a b"`},
+		{"a;b", `"a;b"`},
+		{`say "hi"`, `"say \"hi\""`},
+		{"line\nbreak", `"line\nbreak"`},
+		{`back\slash`, `"back\\slash"`},
+	} {
+		t.Run(tc.in, func(t *testing.T) {
+			if got := systemdQuote(tc.in); got != tc.out {
+				t.Errorf("systemdQuote(%q) = %s, want %s", tc.in, got, tc.out)
+			}
+		})
+	}
+}
+
+func TestSystemdEnv(t *testing.T) {
+	kr := mesh.New()
+	kr.ProjectId = "p1"
+	kr.ClusterName = "c1"
+	kr.Namespace = "fortio"
+	kr.KSA = ""
+
+	for _, tc := range []struct {
+		name    string
+		environ []string
+		want    []string
+	}{
+		{
+			name: "discovered",
+			want: []string{"CLUSTER_NAME=c1", "PROJECT_ID=p1", "WORKLOAD_NAMESPACE=fortio"},
+		},
+		{
+			name:    "prefixes",
+			environ: []string{"HOME=/root", "MESH_TENANT=t1", "XDS_ADDR=istiod:15012", "PATH=/bin", "IMPERSONATE_GSA=a@b", "BROKEN"},
+			want: []string{"CLUSTER_NAME=c1", "IMPERSONATE_GSA=a@b", "MESH_TENANT=t1", "PROJECT_ID=p1",
+				"WORKLOAD_NAMESPACE=fortio", "XDS_ADDR=istiod:15012"},
+		},
+		{
+			name:    "discovered overrides env",
+			environ: []string{"PROJECT_ID=other", "APP_PORT=8080"},
+			want:    []string{"APP_PORT=8080", "CLUSTER_NAME=c1", "PROJECT_ID=p1", "WORKLOAD_NAMESPACE=fortio"},
+		},
+		{
+			name:    "quoted",
+			environ: []string{"APP_ARGS=-a 1", "MESH_EMPTY="},
+			want:    []string{`APP_ARGS="-a 1"`, "CLUSTER_NAME=c1", `MESH_EMPTY=""`, "PROJECT_ID=p1", "WORKLOAD_NAMESPACE=fortio"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got := systemdEnv(kr, tc.environ)
+			want := "# Generated by krun install-systemd\n" + strings.Join(tc.want, "\n") + "\n"
+			if got != want {
+				t.Errorf("Unexpected env file\n%s\nwant\n%s", got, want)
+			}
+		})
+	}
+}
+
+func TestSystemdUnit(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		cmd  []string
+		exec string
+	}{
+		{"binary", []string{"/usr/local/bin/krun"}, "/usr/local/bin/krun"},
+		{"args", []string{"/usr/local/bin/krun", "/app/server", "-port", "8080"}, "/usr/local/bin/krun /app/server -port 8080"},
+		{"specifiers", []string{"/krun", "echo", "100%", "$HOME"}, "/krun echo 100%% $$HOME"},
+		{"quoted", []string{"/krun", "sh", "-c", "echo a b"}, `/krun sh -c "echo a b"`},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			unit := systemdUnit("krun", "/etc/krun/krun.env", tc.cmd)
+			if !strings.Contains(unit, "\nExecStart="+tc.exec+"\n") {
+				t.Errorf("Unexpected ExecStart, want %s\n%s", tc.exec, unit)
+			}
+			for _, l := range []string{"Description=krun mesh launcher (krun)", "EnvironmentFile=/etc/krun/krun.env",
+				"Restart=always", "WantedBy=multi-user.target"} {
+				if !strings.Contains(unit, "\n"+l+"\n") {
+					t.Error("Missing", l)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,58 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package meshconnectord
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/GoogleCloudPlatform/cloud-run-mesh/pkg/k8s"
+)
+
+// StartLeaseGC periodically deletes the WorkloadEntries registered by CloudRun instances that stopped renewing
+// their lease - for example instances killed without running the cleanup.
+//
+// The WorkloadEntry is owned by the lease and garbage collected by K8S. The lease is deleted only if it was not
+// renewed since it was listed - an instance that renews late recreates the lease and applies the WorkloadEntry
+// again, so the entry is not deleted explicitly.
+func (sg *MeshConnector) StartLeaseGC(ctx context.Context) {
+	if sg.Client == nil {
+		return
+	}
+	interval, err := time.ParseDuration(sg.Mesh.Config("MESH_LEASE_GC_INTERVAL", "60s"))
+	if err != nil {
+		interval = 60 * time.Second
+	}
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(interval):
+			}
+			expired, err := k8s.ExpiredLeases(ctx, sg.Client, interval)
+			if err != nil {
+				log.Println("Failed to list leases", err)
+				continue
+			}
+			for i := range expired {
+				l := &expired[i]
+				err := k8s.DeleteExpiredLease(ctx, sg.Client, l)
+				log.Println("Expired WorkloadEntry lease", "ns", l.Namespace, "name", l.Name, "err", err)
+			}
+		}
+	}()
+}
@@ -104,6 +104,7 @@ func (sg *MeshConnector) updateMeshEnv(ctx context.Context) error {
 
 // Internal implementation detail for the 'mesh-env' for Istio and MCP.
 // This may change, it is not a stable API - see loadMeshEnv for the other side.
+// The keys are in the version 1 schema, so older krun versions can read them - see mesh.MigrateMeshEnv.
 //
 // Note that XDS_ADDR is not included by default - workloads will use the (I)MCON_ADDR
 // or MCP if MESH_TENANT is set. TD will also be set automatically if ASM clusters are not
@@ -107,12 +107,13 @@ func (sg *MeshConnector) InitSNIGate(ctx context.Context, sniPort string, h2rPor
 	}
 
 	sg.NewWatcher()
+	sg.StartLeaseGC(ctx)
 
 	if kr.Gateway == "" {
 		kr.Gateway = "hgate"
 	}
 
-	err = kr.StartIstioAgent()
+	err = kr.StartIstioAgent(ctx)
 	if err != nil {
 		log.Fatal("Failed to start istio agent and envoy", err)
 	}
@@ -0,0 +1,161 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package aws
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/GoogleCloudPlatform/cloud-run-mesh/pkg/k8s"
+	"github.com/GoogleCloudPlatform/cloud-run-mesh/pkg/mesh"
+)
+
+// Integration with AWS Fargate and ECS - the task metadata endpoint is used instead of the GCP metadata server,
+// and the identity is an OIDC token projected in a file (IRSA - IAM roles for service accounts, or any OIDC
+// provider trusted by the mesh).
+//
+// No AWS SDK is used - the task metadata is a plain HTTP endpoint, and the token is read from the file.
+//
+// The config cluster must be reachable using KUBECONFIG (typically with a token or exec plugin), or XDS_ADDR must
+// be set explicitly. The OIDC token is used for the agent and, if STS_AUDIENCE is set to a workload identity pool
+// provider, exchanged for Google tokens.
+
+// Platform is the value of KRun.Platform and CLOUD_PLATFORM for the agent.
+const Platform = "aws"
+
+// TaskMetadata is a subset of the ECS task metadata v4 response.
+type TaskMetadata struct {
+	Cluster          string `json:"Cluster"`
+	TaskARN          string `json:"TaskARN"`
+	Family           string `json:"Family"`
+	Revision         string `json:"Revision"`
+	AvailabilityZone string `json:"AvailabilityZone"`
+	LaunchType       string `json:"LaunchType"`
+}
+
+// TaskID returns the last component of the task ARN - arn:aws:ecs:us-west-2:111122223333:task/default/158d1c8083dd49d6b527399fd6414f5c
+func (tm *TaskMetadata) TaskID() string {
+	i := strings.LastIndex(tm.TaskARN, "/")
+	if i < 0 {
+		return tm.TaskARN
+	}
+	return tm.TaskARN[i+1:]
+}
+
+// Region returns the region, based on the availability zone - us-west-2a is in us-west-2.
+func (tm *TaskMetadata) Region() string {
+	az := tm.AvailabilityZone
+	if len(az) > 0 && az[len(az)-1] >= 'a' && az[len(az)-1] <= 'z' {
+		return az[0 : len(az)-1]
+	}
+	return az
+}
+
+// OnECS returns true if running in an ECS task, including Fargate.
+func OnECS() bool {
+	return os.Getenv("ECS_CONTAINER_METADATA_URI_V4") != ""
+}
+
+// LoadTaskMetadata gets the task metadata from ECS_CONTAINER_METADATA_URI_V4.
+func LoadTaskMetadata(ctx context.Context) (*TaskMetadata, error) {
+	base := os.Getenv("ECS_CONTAINER_METADATA_URI_V4")
+	if base == "" {
+		return nil, errors.New("ECS_CONTAINER_METADATA_URI_V4 not set")
+	}
+	ctx, cf := context.WithTimeout(ctx, 2*time.Second)
+	defer cf()
+	req, _ := http.NewRequestWithContext(ctx, "GET", base+"/task", nil)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	data, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != 200 {
+		return nil, fmt.Errorf("task metadata status %d %s", res.StatusCode, string(data))
+	}
+	return parseTaskMetadata(data)
+}
+
+func parseTaskMetadata(data []byte) (*TaskMetadata, error) {
+	tm := &TaskMetadata{}
+	err := json.Unmarshal(data, tm)
+	if err != nil {
+		return nil, err
+	}
+	return tm, nil
+}
+
+// FileTokenProvider returns the OIDC token from a file, refreshed by the platform.
+// The audience is fixed when the token is issued - the requested audience is ignored.
+type FileTokenProvider struct {
+	File string
+}
+
+func (f *FileTokenProvider) GetToken(ctx context.Context, aud string) (string, error) {
+	data, err := ioutil.ReadFile(f.File)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// InitAWS loads the ECS task metadata and configures the token provider and config cluster. GCP metadata is not used.
+func InitAWS(ctx context.Context, kr *mesh.KRun) error {
+	kr.Platform = Platform
+	tm, err := LoadTaskMetadata(ctx)
+	if err != nil {
+		log.Println("Failed to load ECS task metadata", err)
+	} else {
+		if kr.InstanceID == "" {
+			kr.InstanceID = tm.TaskID()
+		}
+		if kr.Name == "" {
+			kr.Name = tm.Family
+		}
+		if kr.Rev == "" {
+			kr.Rev = tm.Revision
+		}
+	}
+
+	kc := &k8s.K8S{Mesh: kr}
+	err = kc.K8SClient(ctx)
+	if err != nil {
+		return err
+	}
+	if kc.Client == nil {
+		return errors.New("KUBECONFIG or XDS_ADDR required on ECS")
+	}
+	kr.Cfg = kc
+	kr.TokenProvider = kc
+
+	tf := kr.Config("MESH_OIDC_TOKEN_FILE", os.Getenv("AWS_WEB_IDENTITY_TOKEN_FILE"))
+	if tf != "" {
+		kr.TokenProvider = &FileTokenProvider{File: tf}
+	}
+	log.Println("ECS init", "task", kr.InstanceID, "family", kr.Name, "oidc", tf)
+	return nil
+}
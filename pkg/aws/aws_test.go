@@ -0,0 +1,46 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package aws
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestTaskMetadata(t *testing.T) {
+	tm, err := parseTaskMetadata([]byte(`{"Cluster":"arn:aws:ecs:us-west-2:111122223333:cluster/default",
+"TaskARN":"arn:aws:ecs:us-west-2:111122223333:task/default/158d1c8083dd49d6b527399fd6414f5c",
+"Family":"fortio","Revision":"3","AvailabilityZone":"us-west-2a","LaunchType":"FARGATE"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tm.TaskID() != "158d1c8083dd49d6b527399fd6414f5c" {
+		t.Error("Unexpected task ID", tm.TaskID())
+	}
+	if tm.Region() != "us-west-2" {
+		t.Error("Unexpected region", tm.Region())
+	}
+}
+
+func TestFileTokenProvider(t *testing.T) {
+	f := filepath.Join(t.TempDir(), "token")
+	ioutil.WriteFile(f, []byte("header.payload.sig\n"), 0600)
+	tok, err := (&FileTokenProvider{File: f}).GetToken(context.Background(), "ignored")
+	if err != nil || tok != "header.payload.sig" {
+		t.Error("Unexpected token", tok, err)
+	}
+}
@@ -0,0 +1,204 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package azure
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/GoogleCloudPlatform/cloud-run-mesh/pkg/k8s"
+	"github.com/GoogleCloudPlatform/cloud-run-mesh/pkg/mesh"
+)
+
+// Integration with Azure Container Apps and Container Instances - tokens are issued by the managed identity
+// endpoint, no Azure SDK is used.
+//
+// Container Apps set IDENTITY_ENDPOINT and IDENTITY_HEADER. Container Instances (and VMs) use IMDS at
+// 169.254.169.254. AZURE_CLIENT_ID selects a user assigned identity.
+//
+// The config cluster is loaded from KUBECONFIG - or MESH_KUBECONFIG with the content of the file, for
+// platforms where only env variables can be set. XDS_ADDR can be used to skip the cluster.
+
+// Platform is the value of KRun.Platform and CLOUD_PLATFORM for the agent.
+const Platform = "azure"
+
+const imdsTokenURL = "http://169.254.169.254/metadata/identity/oauth2/token"
+
+// OnAzure returns true if running in Container Apps, or if AZURE_MESH is set for ACI.
+func OnAzure() bool {
+	return os.Getenv("CONTAINER_APP_NAME") != "" || os.Getenv("AZURE_MESH") != ""
+}
+
+// ManagedIdentity returns tokens for the managed identity of the container.
+//
+// Azure AD only issues tokens for registered resources - the mesh audiences (trust domain, istio-ca) can't be
+// used directly. All tokens are issued for Resource, which must be trusted by the mesh and STS - the default
+// api://AzureADTokenExchange is the audience used for workload identity federation.
+type ManagedIdentity struct {
+	// ClientID of an user assigned identity. Empty for the system assigned identity.
+	ClientID string
+
+	// Resource is the audience of the returned tokens.
+	Resource string
+
+	httpClient *http.Client
+
+	m     sync.Mutex
+	token *miToken
+}
+
+type miToken struct {
+	AccessToken string      `json:"access_token"`
+	ExpiresOn   json.Number `json:"expires_on"`
+	expires     time.Time
+}
+
+// NewManagedIdentity creates a token provider using the managed identity endpoint.
+func NewManagedIdentity(clientID string) *ManagedIdentity {
+	return &ManagedIdentity{
+		ClientID:   clientID,
+		Resource:   "api://AzureADTokenExchange",
+		httpClient: &http.Client{Timeout: 5 * time.Second},
+	}
+}
+
+// GetToken implements mesh.TokenProvider. The requested audience is ignored, tokens are cached until 5 minutes
+// before expiration.
+func (mi *ManagedIdentity) GetToken(ctx context.Context, aud string) (string, error) {
+	mi.m.Lock()
+	t := mi.token
+	mi.m.Unlock()
+	if t != nil && time.Now().Add(5*time.Minute).Before(t.expires) {
+		return t.AccessToken, nil
+	}
+
+	req, err := mi.tokenRequest(ctx)
+	if err != nil {
+		return "", err
+	}
+	res, err := mi.httpClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	data, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return "", err
+	}
+	if res.StatusCode != 200 {
+		return "", fmt.Errorf("managed identity token status %d %s", res.StatusCode, string(data))
+	}
+	t, err = parseToken(data)
+	if err != nil {
+		return "", err
+	}
+	mi.m.Lock()
+	mi.token = t
+	mi.m.Unlock()
+	return t.AccessToken, nil
+}
+
+// tokenRequest uses the Container Apps identity endpoint if available, IMDS otherwise.
+func (mi *ManagedIdentity) tokenRequest(ctx context.Context) (*http.Request, error) {
+	q := url.Values{}
+	q.Set("resource", mi.Resource)
+	if mi.ClientID != "" {
+		q.Set("client_id", mi.ClientID)
+	}
+	ep := os.Getenv("IDENTITY_ENDPOINT")
+	if ep != "" {
+		q.Set("api-version", "2019-08-01")
+	} else {
+		ep = imdsTokenURL
+		q.Set("api-version", "2018-02-01")
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", ep+"?"+q.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if h := os.Getenv("IDENTITY_HEADER"); h != "" {
+		req.Header.Set("X-IDENTITY-HEADER", h)
+	} else {
+		req.Header.Set("Metadata", "true")
+	}
+	return req, nil
+}
+
+func parseToken(data []byte) (*miToken, error) {
+	t := &miToken{}
+	err := json.Unmarshal(data, t)
+	if err != nil {
+		return nil, err
+	}
+	if t.AccessToken == "" {
+		return nil, errors.New("empty managed identity token")
+	}
+	exp, err := t.ExpiresOn.Int64()
+	if err != nil {
+		return nil, fmt.Errorf("invalid expires_on %s", t.ExpiresOn)
+	}
+	t.expires = time.Unix(exp, 0)
+	return t, nil
+}
+
+// InitAzure configures the token provider and the config cluster. GCP metadata is not used.
+func InitAzure(ctx context.Context, kr *mesh.KRun) error {
+	kr.Platform = Platform
+	if kr.InstanceID == "" {
+		kr.InstanceID = os.Getenv("CONTAINER_APP_REPLICA_NAME")
+	}
+	if kr.Name == "" {
+		kr.Name = os.Getenv("CONTAINER_APP_NAME")
+	}
+	if kr.Rev == "" {
+		kr.Rev = os.Getenv("CONTAINER_APP_REVISION")
+	}
+
+	if kc := os.Getenv("MESH_KUBECONFIG"); kc != "" && os.Getenv("KUBECONFIG") == "" {
+		dir := kr.BaseDir + "/var/run/secrets/kubeconfig"
+		os.MkdirAll(dir, 0700)
+		err := ioutil.WriteFile(dir+"/config", []byte(kc), 0600)
+		if err != nil {
+			return err
+		}
+		os.Setenv("KUBECONFIG", dir+"/config")
+	}
+	kc := &k8s.K8S{Mesh: kr}
+	err := kc.K8SClient(ctx)
+	if err != nil {
+		return err
+	}
+	if kc.Client == nil {
+		return errors.New("KUBECONFIG, MESH_KUBECONFIG or XDS_ADDR required on Azure")
+	}
+	kr.Cfg = kc
+
+	mi := NewManagedIdentity(kr.Config("AZURE_CLIENT_ID", ""))
+	if r := kr.Config("AZURE_TOKEN_RESOURCE", ""); r != "" {
+		mi.Resource = r
+	}
+	kr.TokenProvider = mi
+	log.Println("Azure init", "app", kr.Name, "replica", kr.InstanceID, "client_id", mi.ClientID)
+	return nil
+}
@@ -0,0 +1,58 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package azure
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestManagedIdentity(t *testing.T) {
+	calls := 0
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if r.Header.Get("X-IDENTITY-HEADER") != "secret" {
+			w.WriteHeader(401)
+			return
+		}
+		if r.URL.Query().Get("resource") != "api://AzureADTokenExchange" || r.URL.Query().Get("client_id") != "cid" {
+			w.WriteHeader(400)
+			return
+		}
+		exp := time.Now().Add(1 * time.Hour).Unix()
+		w.Write([]byte(`{"access_token":"tok","expires_on":"` + strconv.FormatInt(exp, 10) + `"}`))
+	}))
+	defer s.Close()
+	os.Setenv("IDENTITY_ENDPOINT", s.URL)
+	os.Setenv("IDENTITY_HEADER", "secret")
+	defer os.Unsetenv("IDENTITY_ENDPOINT")
+	defer os.Unsetenv("IDENTITY_HEADER")
+
+	mi := NewManagedIdentity("cid")
+	for i := 0; i < 2; i++ {
+		tok, err := mi.GetToken(context.Background(), "istio-ca")
+		if err != nil || tok != "tok" {
+			t.Fatal("Unexpected token", tok, err)
+		}
+	}
+	if calls != 1 {
+		t.Error("Expecting cached token", calls)
+	}
+}
@@ -0,0 +1,101 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcp
+
+import (
+	"strings"
+
+	kubeconfig "k8s.io/client-go/tools/clientcmd/api"
+)
+
+// Connect Gateway allows access to the K8S API server of a fleet (hub) member cluster using Google credentials,
+// without a public endpoint or master authorized networks - the requests are relayed by the Connect agent
+// running in the cluster.
+//
+// Used when:
+// - FLEET_MEMBERSHIP is set, as MEMBERSHIP_NAME or projects/FLEET_PROJECT/locations/LOCATION/memberships/MEMBERSHIP_NAME
+// - MESH is set to //gkehub.googleapis.com/projects/FLEET_PROJECT/locations/LOCATION/memberships/MEMBERSHIP_NAME
+// - the selected GKE cluster has only a private endpoint. The membership name defaults to the cluster name,
+//   which is the default when registering GKE clusters.
+//
+// The GSA must have "roles/gkehub.gatewayReader" (or gatewayEditor for writes) in the fleet project, in addition to
+// the K8S RBAC permissions.
+
+const ConnectGatewayHost = "connectgateway.googleapis.com"
+
+// FleetMembership identifies a cluster registered in a fleet.
+type FleetMembership struct {
+	// Project is the fleet host project. Connect Gateway requires the project number.
+	Project  string
+	Location string
+	Name     string
+}
+
+// ParseMembership parses a membership resource name. A short name is located in the default project, in 'global'.
+func ParseMembership(s string, defProject string) *FleetMembership {
+	s = strings.TrimPrefix(s, "//gkehub.googleapis.com/")
+	s = strings.Trim(s, "/")
+	if s == "" {
+		return nil
+	}
+	m := &FleetMembership{Project: defProject, Location: "global"}
+	parts := strings.Split(s, "/")
+	if len(parts) == 1 {
+		m.Name = parts[0]
+		return m
+	}
+	for i := 0; i+1 < len(parts); i++ {
+		switch parts[i] {
+		case "projects":
+			m.Project = parts[i+1]
+		case "locations":
+			m.Location = parts[i+1]
+		case "memberships":
+			m.Name = parts[i+1]
+		}
+	}
+	if m.Name == "" {
+		return nil
+	}
+	return m
+}
+
+// ConnectGatewayURL returns the base URL of the K8S API server for the member.
+func (m *FleetMembership) ConnectGatewayURL() string {
+	return "https://" + ConnectGatewayHost + "/v1/projects/" + m.Project + "/locations/" + m.Location +
+		"/gkeMemberships/" + m.Name
+}
+
+// connectGatewayConfig returns a kube config using the Connect Gateway and the default Google credentials.
+// The gateway uses a public certificate - no CA data is needed.
+func connectGatewayConfig(m *FleetMembership) *kubeconfig.Config {
+	kc := kubeconfig.NewConfig()
+	ctxName := "connectgateway_" + m.Project + "_" + m.Location + "_" + m.Name
+
+	kc.Contexts[ctxName] = &kubeconfig.Context{
+		Cluster:  ctxName,
+		AuthInfo: ctxName,
+	}
+	kc.Clusters[ctxName] = &kubeconfig.Cluster{
+		Server: m.ConnectGatewayURL(),
+	}
+	kc.AuthInfos[ctxName] = &kubeconfig.AuthInfo{
+		AuthProvider: &kubeconfig.AuthProviderConfig{
+			Name: "gcp",
+		},
+	}
+	kc.CurrentContext = ctxName
+	return kc
+}
@@ -0,0 +1,64 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcp
+
+import (
+	"context"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/GoogleCloudPlatform/cloud-run-mesh/pkg/mesh"
+	errorreporting "google.golang.org/api/clouderrorreporting/v1beta1"
+)
+
+// ErrorReporting sends child process crashes to Cloud Error Reporting, grouped by service and source.
+type ErrorReporting struct {
+	kr *mesh.KRun
+}
+
+func NewErrorReporting(kr *mesh.KRun) *ErrorReporting {
+	return &ErrorReporting{kr: kr}
+}
+
+// ReportError implements mesh.ErrorReporter.
+func (er *ErrorReporting) ReportError(ctx context.Context, ev *mesh.ErrorEvent) error {
+	svc, err := errorreporting.NewService(ctx)
+	if err != nil {
+		return err
+	}
+	service := os.Getenv("K_SERVICE")
+	if service == "" {
+		service = er.kr.Name
+	}
+	// Without a stack trace, Error Reporting requires a report location. The source is used as function name,
+	// so events are grouped per child.
+	msg := ev.Source + " exited: " + ev.Message + "\n" + strings.Join(ev.Lines, "\n")
+	_, err = svc.Projects.Events.Report("projects/"+er.kr.ProjectId, &errorreporting.ReportedErrorEvent{
+		EventTime: ev.Time.UTC().Format(time.RFC3339Nano),
+		Message:   msg,
+		ServiceContext: &errorreporting.ServiceContext{
+			Service: service,
+			Version: os.Getenv("K_REVISION"),
+		},
+		Context: &errorreporting.ErrorContext{
+			ReportLocation: &errorreporting.SourceLocation{
+				FilePath:     ev.Source,
+				FunctionName: ev.Source,
+			},
+		},
+	}).Context(ctx).Do()
+	return err
+}
@@ -0,0 +1,201 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/GoogleCloudPlatform/cloud-run-mesh/pkg/k8s"
+	"github.com/GoogleCloudPlatform/cloud-run-mesh/pkg/mesh"
+	"google.golang.org/api/option"
+	"k8s.io/client-go/kubernetes"
+
+	container "cloud.google.com/go/container/apiv1"
+	containerpb "google.golang.org/genproto/googleapis/container/v1"
+)
+
+// CONFIG_CLUSTERS holds a prioritized, comma separated list of config clusters, for regional DR of the control
+// plane. Each entry is LOCATION/NAME (in the config project), PROJECT/LOCATION/NAME or the resource name
+// projects/PROJECT/locations/LOCATION/clusters/NAME.
+//
+// At startup each cluster is checked in order - the K8S API server must return the istio-system/mesh-env and
+// the in-cluster istiod (or mesh connector) from the mesh-env must accept connections. The first healthy cluster
+// is used, and recorded in ISTIO_META_CLUSTER_ID.
+//
+// CONFIG_CLUSTER_TIMEOUT sets the time allowed for checking each cluster, default 5s.
+
+// ClusterRef identifies a GKE cluster in the CONFIG_CLUSTERS list.
+type ClusterRef struct {
+	Project  string
+	Location string
+	Name     string
+}
+
+// ParseClusterList parses the CONFIG_CLUSTERS value.
+func ParseClusterList(s string, defProject string) ([]*ClusterRef, error) {
+	res := []*ClusterRef{}
+	for _, c := range strings.Split(s, ",") {
+		c = strings.Trim(strings.TrimSpace(c), "/")
+		if c == "" {
+			continue
+		}
+		parts := strings.Split(c, "/")
+		ref := &ClusterRef{Project: defProject}
+		switch len(parts) {
+		case 2:
+			ref.Location, ref.Name = parts[0], parts[1]
+		case 3:
+			ref.Project, ref.Location, ref.Name = parts[0], parts[1], parts[2]
+		case 6:
+			if parts[0] != "projects" || parts[2] != "locations" || parts[4] != "clusters" {
+				return nil, fmt.Errorf("invalid cluster %s", c)
+			}
+			ref.Project, ref.Location, ref.Name = parts[1], parts[3], parts[5]
+		default:
+			return nil, fmt.Errorf("invalid cluster %s", c)
+		}
+		if ref.Project == "" {
+			return nil, fmt.Errorf("missing project for cluster %s", c)
+		}
+		res = append(res, ref)
+	}
+	return res, nil
+}
+
+// ClusterID returns the Istio cluster ID used for GKE clusters.
+func (ref *ClusterRef) ClusterID() string {
+	return fmt.Sprintf("cn-%s-%s-%s", ref.Project, ref.Location, ref.Name)
+}
+
+// initConfigClusters selects the first healthy cluster from the list, and initializes the client.
+func initConfigClusters(ctx context.Context, kc *k8s.K8S, refs []*ClusterRef) error {
+	kr := kc.Mesh
+	timeout, err := time.ParseDuration(kr.Config("CONFIG_CLUSTER_TIMEOUT", "5s"))
+	if err != nil {
+		timeout = 5 * time.Second
+	}
+	var lastErr error
+	for _, ref := range refs {
+		t0 := time.Now()
+		cctx, cf := context.WithTimeout(ctx, timeout)
+		client, err := checkConfigCluster(cctx, kc, ref)
+		cf()
+		if err != nil {
+			log.Println("Config cluster unavailable", "cluster", ref.ClusterID(), "time", time.Since(t0), "err", err)
+			lastErr = err
+			continue
+		}
+		kc.Client = client
+		kr.ProjectId = ref.Project
+		kr.TrustDomain = ref.Project + ".svc.id.goog"
+		kr.ClusterLocation = ref.Location
+		kr.ClusterName = ref.Name
+		kr.ClusterID = ref.ClusterID()
+		log.Println("Selected config cluster", "cluster", kr.ClusterID, "time", time.Since(t0))
+		return nil
+	}
+	if lastErr == nil {
+		lastErr = errors.New("no config clusters")
+	}
+	return lastErr
+}
+
+// checkConfigCluster creates a client for the cluster and verifies the K8S API server and istiod are reachable.
+func checkConfigCluster(ctx context.Context, kc *k8s.K8S, ref *ClusterRef) (*kubernetes.Clientset, error) {
+	kr := kc.Mesh
+	cl, err := gkeClusterOnce(ctx, kr, ref)
+	if err != nil {
+		return nil, err
+	}
+	rc, err := restConfig(kr, clusterKubeConfig(cl, ref.Project, nil))
+	if err != nil {
+		return nil, err
+	}
+	client, err := kubernetes.NewForConfig(rc)
+	if err != nil {
+		return nil, err
+	}
+
+	ck := &k8s.K8S{Mesh: kr, Client: client}
+	menv, err := ck.GetCM(ctx, "istio-system", "mesh-env")
+	if err != nil {
+		return nil, err
+	}
+	if addr := istiodAddr(kr, menv); addr != "" {
+		d := &net.Dialer{}
+		c, err := d.DialContext(ctx, "tcp", addr)
+		if err != nil {
+			return nil, err
+		}
+		c.Close()
+	}
+	return client, nil
+}
+
+// istiodAddr returns the in-cluster control plane address from the cluster mesh-env, or empty if the managed
+// control plane is used. The mesh-env may use an older schema - it is migrated first.
+func istiodAddr(kr *mesh.KRun, menv map[string]string) string {
+	// The map may be shared with the config cache - migrate a copy.
+	d := map[string]string{}
+	for k, v := range menv {
+		d[k] = v
+	}
+	if _, err := mesh.MigrateMeshEnv(d); err != nil {
+		log.Println("Invalid mesh-env in failover cluster", err)
+	}
+	tenant := kr.Config("MESH_TENANT", d["MESH_TENANT"])
+	if tenant != "" && tenant != "-" {
+		return ""
+	}
+	if a := d["XDS_ADDR"]; a != "" {
+		return a
+	}
+	if a := d["MESH_CONNECTOR_INTERNAL_ADDR"]; a != "" {
+		return net.JoinHostPort(a, "15012")
+	}
+	return ""
+}
+
+// gkeClusterOnce is GKECluster without retries - an unavailable cluster should fail over quickly.
+func gkeClusterOnce(ctx context.Context, kr *mesh.KRun, ref *ClusterRef) (*Cluster, error) {
+	opts := []option.ClientOption{}
+	if ref.Project != kr.ProjectId {
+		opts = append(opts, option.WithQuotaProject(ref.Project))
+	}
+	cm, err := container.NewClusterManagerClient(ctx, opts...)
+	if err != nil {
+		return nil, err
+	}
+	defer cm.Close()
+	c, err := cm.GetCluster(ctx, &containerpb.GetClusterRequest{
+		Name: fmt.Sprintf("projects/%s/locations/%s/clusters/%s", ref.Project, ref.Location, ref.Name),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &Cluster{
+		ProjectId:       ref.Project,
+		ClusterLocation: c.Location,
+		ClusterName:     c.Name,
+		GKECluster:      c,
+		KubeConfig:      addClusterConfig(c, ref.Project, ref.Location, ref.Name),
+	}, nil
+}
@@ -0,0 +1,125 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcp
+
+import (
+	"context"
+	"log"
+	"strings"
+
+	"github.com/GoogleCloudPlatform/cloud-run-mesh/pkg/mesh"
+	gkehub "google.golang.org/api/gkehub/v1"
+	"google.golang.org/api/option"
+)
+
+// Fleet (hub) based discovery of the config cluster. Instead of listing the GKE clusters in the config project,
+// the memberships of the fleet are listed - clusters may be in different projects, or not on GKE.
+//
+// Enabled with FLEET_PROJECT or MESH=//gkehub.googleapis.com/projects/FLEET_PROJECT. Memberships are filtered by
+// FLEET_LABEL (default mesh_id), set to empty to use all members.
+//
+// The GSA must have "roles/gkehub.viewer" in the fleet project.
+
+// FleetClusters returns the members of the fleet with the label. Only clusters that are ready are returned.
+// The KubeConfig is not set - GKE members should use GKECluster, other members the Connect Gateway.
+func FleetClusters(ctx context.Context, kr *mesh.KRun, fleetProject string, label string) ([]*Cluster, error) {
+	opts := []option.ClientOption{}
+	if fleetProject != kr.ProjectId {
+		opts = append(opts, option.WithQuotaProject(fleetProject))
+	}
+	hub, err := gkehub.NewService(ctx, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	res := []*Cluster{}
+	err = hub.Projects.Locations.Memberships.List("projects/"+fleetProject+"/locations/-").Pages(ctx,
+		func(mr *gkehub.ListMembershipsResponse) error {
+			for _, m := range mr.Resources {
+				if label != "" && m.Labels[label] == "" {
+					continue
+				}
+				if m.State != nil && m.State.Code != "READY" {
+					continue
+				}
+				if c := membershipCluster(m.Name, m.Endpoint); c != nil {
+					res = append(res, c)
+				}
+			}
+			return nil
+		})
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// membershipCluster converts a membership to a Cluster. For GKE members the project, location and name are extracted
+// from the resource link (//container.googleapis.com/projects/P/locations/L/clusters/C).
+func membershipCluster(name string, ep *gkehub.MembershipEndpoint) *Cluster {
+	fm := ParseMembership(name, "")
+	if fm == nil {
+		return nil
+	}
+	c := &Cluster{
+		ProjectId:       fm.Project,
+		ClusterName:     fm.Name,
+		ClusterLocation: fm.Location,
+		Membership:      fm,
+	}
+	if ep == nil || ep.GkeCluster == nil {
+		return c
+	}
+	parts := strings.Split(ep.GkeCluster.ResourceLink, "/")
+	for i := 0; i+1 < len(parts); i++ {
+		switch parts[i] {
+		case "projects":
+			c.ProjectId = parts[i+1]
+		case "locations", "zones":
+			c.ClusterLocation = parts[i+1]
+		case "clusters":
+			c.ClusterName = parts[i+1]
+			c.GKE = true
+		}
+	}
+	return c
+}
+
+// MembershipAddress returns the identity provider used for fleet workload identity, for members that are not
+// GKE clusters.
+func (m *FleetMembership) MembershipAddress() string {
+	return "https://gkehub.googleapis.com/projects/" + m.Project + "/locations/" + m.Location +
+		"/memberships/" + m.Name
+}
+
+// fleetMemberConfig loads the kube config for a fleet member. GKE clusters are accessed directly if the GKE API can
+// be used and the cluster has a public endpoint, all others use the Connect Gateway.
+func fleetMemberConfig(ctx context.Context, kr *mesh.KRun, cl *Cluster) (*Cluster, *FleetMembership) {
+	if !cl.GKE {
+		if kr.ClusterAddress == "" {
+			kr.ClusterAddress = cl.Membership.MembershipAddress()
+		}
+		cl.ProjectId = cl.Membership.Project
+		return cl, cl.Membership
+	}
+	gc, err := GKECluster(ctx, kr, cl.ProjectId, cl.ClusterLocation, cl.ClusterName)
+	if err != nil {
+		log.Println("Failed to load fleet member from GKE, using Connect Gateway", cl.ClusterName, err)
+		return cl, cl.Membership
+	}
+	gc.Membership = cl.Membership
+	gc.GKE = true
+	return gc, nil
+}
@@ -16,6 +16,7 @@ package gcp
 
 import (
 	"context"
+	"crypto/tls"
 	"encoding/base64"
 	"fmt"
 	"log"
@@ -26,10 +27,14 @@ import (
 
 	"cloud.google.com/go/compute/metadata"
 	"github.com/GoogleCloudPlatform/cloud-run-mesh/pkg/cas"
+	"github.com/GoogleCloudPlatform/cloud-run-mesh/pkg/hbone"
 	"github.com/GoogleCloudPlatform/cloud-run-mesh/pkg/k8s"
 	"github.com/GoogleCloudPlatform/cloud-run-mesh/pkg/sts"
 	"google.golang.org/api/option"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/status"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
 
@@ -65,6 +70,12 @@ type Cluster struct {
 	GKECluster *containerpb.Cluster
 
 	KubeConfig *kubeconfig.Config
+
+	// Membership is set for clusters discovered using the fleet API.
+	Membership *FleetMembership
+
+	// GKE is true if the fleet member is a GKE cluster.
+	GKE bool
 }
 
 var (
@@ -141,6 +152,20 @@ func configFromEnvAndMD(ctx context.Context, kr *mesh.KRun) error {
 		if kr.InstanceID == "" {
 			kr.InstanceID, _ = metadata.InstanceID()
 		}
+		// Locality of the instance - for Cloud Run the zone is region-N.
+		if kr.InstanceRegion == "" {
+			kr.InstanceRegion, _ = RegionFromMetadata()
+		}
+		if kr.InstanceZone == "" {
+			kr.InstanceZone, _ = metadata.Zone()
+		}
+		if kr.Config("MESH_NETWORK", "") == "vpc" && kr.InstanceNetwork == "" {
+			if n, err := metadata.Get("instance/network-interfaces/0/network"); err == nil {
+				kr.InstanceNetwork = n[strings.LastIndex(n, "/")+1:]
+			} else {
+				log.Println("Can't find the VPC network", err)
+			}
+		}
 	}
 
 	// No longer using project lables
@@ -203,6 +228,13 @@ func InitGCP(ctx context.Context, kr *mesh.KRun) error {
 
 	kr.Cfg = kc
 	kr.TokenProvider = kc
+	kr.Metrics = NewMonitoring(kr)
+	// Crashes are already logged as ERROR entries, Error Reporting is opt-in.
+	if kr.Config("MESH_ERROR_REPORTING", "") == "true" {
+		kr.ErrorReporter = NewErrorReporting(kr)
+	}
+	kr.EventPublisher = NewPubSub()
+	kr.ArtifactUploader = NewStorage()
 
 	// After the config was loaded.
 	kr.PostConfigLoad = PostConfigLoad
@@ -223,11 +255,17 @@ func PostConfigLoad(ctx context.Context, kr *mesh.KRun) error {
 
 	var ol []grpc.DialOption
 	ol = append(ol, grpc.WithPerRPCCredentials(tokenProvider))
+	if hbone.FIPS {
+		ol = append(ol, grpc.WithTransportCredentials(credentials.NewTLS(hbone.TLSConfig(&tls.Config{}))))
+	}
 	//ol = append(ol, OTELGRPCClient()...)
 
 	// TODO: only if mesh_env contains a WorkloadCertificateConfig with endpoint starting with //privateca.googleapis.com
 	// Errors results to fallback to pilot-agent and istio.
 	cap := kr.Config("CA_POOL", "")
+	if ca := kr.SelectCA(); cap == "" && ca.Name == "cas" {
+		cap = ca.Pool
+	}
 	if cap != "" {
 		kr.CSRSigner, err = cas.NewCASCertProvider(cap, ol)
 	}
@@ -254,6 +292,26 @@ func initGKE(ctx context.Context, kc *k8s.K8S) error {
 	// (if metadata servere or CR can provide them)
 
 	kr := kc.Mesh
+	if sc := kr.StartupCache; sc != nil && sc.Loaded && len(sc.KubeConfig) > 0 {
+		// Cluster selected by a previous instance of the revision.
+		kConfig, err = clientcmd.Load(sc.KubeConfig)
+		if err == nil {
+			err = checkCachedKubeConfig(kConfig)
+		}
+		if err == nil {
+			var rc *rest.Config
+			rc, err = restConfig(kr, kConfig)
+			if err == nil {
+				kc.Client, err = kubernetes.NewForConfig(rc)
+			}
+		}
+		if err == nil {
+			GCPInitTime = time.Since(t0)
+			return nil
+		}
+		log.Println("Ignoring cached cluster config", err)
+	}
+
 	configProjectID := kr.ProjectId
 	configLocation := kr.ClusterLocation
 	configClusterName := kr.ClusterName
@@ -285,6 +343,36 @@ func initGKE(ctx context.Context, kc *k8s.K8S) error {
 		}
 	}
 
+	// Private config clusters can be reached using the Connect Gateway.
+	fm := ParseMembership(kr.Config("FLEET_MEMBERSHIP", ""), configProjectID)
+	fleetProject := kr.Config("FLEET_PROJECT", "")
+	if kr.MeshAddr != nil && kr.MeshAddr.Host == "gkehub.googleapis.com" {
+		fm = ParseMembership(kr.MeshAddr.Path, configProjectID)
+		if fm != nil && configProjectID == "" {
+			configProjectID = fm.Project
+		}
+		if fm == nil {
+			// Only the fleet project - discover the members.
+			parts := strings.Split(kr.MeshAddr.Path, "/")
+			if len(parts) > 2 && parts[1] == "projects" {
+				fleetProject = parts[2]
+			}
+		}
+	}
+	if fleetProject != "" && configProjectID == "" {
+		configProjectID = fleetProject
+	}
+
+	if list := kr.Config("CONFIG_CLUSTERS", ""); list != "" {
+		refs, err := ParseClusterList(list, configProjectID)
+		if err != nil {
+			return err
+		}
+		err = initConfigClusters(ctx, kc, refs)
+		GCPInitTime = time.Since(t0)
+		return err
+	}
+
 	if configProjectID == "" {
 		// GCP can't be initialized without a project ID
 		return nil
@@ -299,21 +387,42 @@ func initGKE(ctx context.Context, kc *k8s.K8S) error {
 		if myRegion == "" {
 			myRegion = configLocation
 		}
-		if kr.MeshAddr != nil && kr.MeshAddr.Scheme == "gke" {
+		if (kr.MeshAddr != nil && kr.MeshAddr.Scheme == "gke") || fm != nil {
 			// Explicit mesh config clusters, no label selector ( used for ASM clusters in current project )
 			label = ""
 		}
-		log.Println("Selecting a GKE cluster ", kr.ProjectId, configProjectID, myRegion)
-		cll, err := AllClusters(ctx, kr, configProjectID, label, "")
-		if err != nil {
+		var cll []*Cluster
+		if fleetProject != "" && fm == nil {
+			log.Println("Selecting a fleet member ", kr.ProjectId, fleetProject, myRegion)
+			cll, err = FleetClusters(ctx, kr, fleetProject, kr.Config("FLEET_LABEL", "mesh_id"))
+		} else {
+			log.Println("Selecting a GKE cluster ", kr.ProjectId, configProjectID, myRegion)
+			cll, err = AllClusters(ctx, kr, configProjectID, label, "")
+		}
+		if err != nil && fm == nil {
 			return err
 		}
 
-		if len(cll) == 0 {
+		if fm != nil {
+			// The member cluster may be in a different project - only used to find the location.
+			for _, c := range cll {
+				if c.ClusterName == fm.Name {
+					cl = c
+					break
+				}
+			}
+			if cl == nil {
+				cl = &Cluster{ProjectId: configProjectID, ClusterName: fm.Name, ClusterLocation: configLocation}
+			}
+		} else if len(cll) == 0 {
 			return nil // no cluster to use
+		} else {
+			cl = findCluster(kc, cll, myRegion, cl)
+		}
+		if cl.Membership != nil {
+			cl, fm = fleetMemberConfig(ctx, kr, cl)
+			configProjectID = cl.ProjectId
 		}
-
-		cl = findCluster(kc, cll, myRegion, cl)
 		// TODO: connect to cluster, find istiod - and keep trying until a working one is found ( fallback )
 	} else {
 		// Explicit override - user specified the full path to the cluster.
@@ -334,7 +443,7 @@ func initGKE(ctx context.Context, kc *k8s.K8S) error {
 	kr.ProjectId = configProjectID
 
 	kr.TrustDomain = configProjectID + ".svc.id.goog"
-	kConfig = cl.KubeConfig
+	kConfig = clusterKubeConfig(cl, configProjectID, fm)
 	if kr.ClusterName == "" {
 		kr.ClusterName = cl.ClusterName
 	}
@@ -344,7 +453,12 @@ func initGKE(ctx context.Context, kc *k8s.K8S) error {
 
 	GCPInitTime = time.Since(t0)
 
-	rc, err := restConfig(kConfig)
+	if kr.StartupCache != nil {
+		// Saved before use - the auth provider may add the access token to the config.
+		kr.StartupCache.KubeConfig, _ = clientcmd.Write(*kConfig)
+	}
+
+	rc, err := restConfig(kr, kConfig)
 	if err != nil {
 		return err
 	}
@@ -356,9 +470,36 @@ func initGKE(ctx context.Context, kc *k8s.K8S) error {
 	return nil
 }
 
-func restConfig(kc *kubeconfig.Config) (*rest.Config, error) {
+// clusterKubeConfig returns the config for accessing the cluster, using the Connect Gateway if a membership is
+// set or if the cluster only has a private endpoint.
+func clusterKubeConfig(cl *Cluster, project string, fm *FleetMembership) *kubeconfig.Config {
+	if fm == nil && cl.GKECluster != nil && cl.GKECluster.PrivateClusterConfig != nil &&
+		cl.GKECluster.PrivateClusterConfig.EnablePrivateEndpoint {
+		fm = cl.Membership
+		if fm == nil {
+			fm = &FleetMembership{Project: project, Location: "global", Name: cl.ClusterName}
+		}
+	}
+	if fm == nil {
+		return cl.KubeConfig
+	}
+	if _, err := strconv.Atoi(fm.Project); err != nil {
+		if pn := ProjectNumber(fm.Project); pn != "" {
+			fm.Project = pn
+		}
+	}
+	log.Println("Using Connect Gateway", "cluster", cl.ClusterName, "url", fm.ConnectGatewayURL())
+	return connectGatewayConfig(fm)
+}
+
+func restConfig(kr *mesh.KRun, kc *kubeconfig.Config) (*rest.Config, error) {
 	// TODO: set default if not set ?
-	return clientcmd.NewNonInteractiveClientConfig(*kc, "", &clientcmd.ConfigOverrides{}, nil).ClientConfig()
+	rc, err := clientcmd.NewNonInteractiveClientConfig(*kc, "", &clientcmd.ConfigOverrides{}, nil).ClientConfig()
+	if err != nil {
+		return nil, err
+	}
+	rc.Wrap(hbone.WrapTLSPolicy)
+	return rc, impersonateConfig(kr, rc)
 }
 
 func findCluster(kr *k8s.K8S, cll []*Cluster, myRegion string, cl *Cluster) *Cluster {
@@ -429,27 +570,35 @@ func GKECluster(ctx context.Context, kr *mesh.KRun, p, l, clusterName string) (*
 		return nil, err
 	}
 
-	for i := 0; i < 5; i++ {
-		gcr := &containerpb.GetClusterRequest{
-			Name: fmt.Sprintf("projects/%s/locations/%s/cluster/%s", p, l, clusterName),
-		}
-		c, e := cl.GetCluster(ctx, gcr)
-		if e == nil {
-			rc := &Cluster{
-				ProjectId:       p,
-				ClusterLocation: c.Location,
-				ClusterName:     c.Name,
-				GKECluster:      c,
-				KubeConfig:      addClusterConfig(c, p, l, clusterName),
-			}
+	gcr := &containerpb.GetClusterRequest{
+		Name: fmt.Sprintf("projects/%s/locations/%s/cluster/%s", p, l, clusterName),
+	}
+	var c *containerpb.Cluster
+	err = kr.Retry(ctx, "cluster_discovery", func(ctx context.Context) error {
+		var err error
+		c, err = cl.GetCluster(ctx, gcr)
+		return permanentGRPCError(err)
+	})
+	if err != nil {
+		log.Println("Failed GetCluster", p, l, clusterName, err)
+		return nil, err
+	}
+	return &Cluster{
+		ProjectId:       p,
+		ClusterLocation: c.Location,
+		ClusterName:     c.Name,
+		GKECluster:      c,
+		KubeConfig:      addClusterConfig(c, p, l, clusterName),
+	}, nil
+}
 
-			return rc, nil
-		}
-		log.Println("Failed GetCluster, retry", gcr, p, l, clusterName, err)
-		time.Sleep(1 * time.Second)
-		err = e
+// permanentGRPCError marks the errors from the GKE API that are not fixed by retrying.
+func permanentGRPCError(err error) error {
+	switch status.Code(err) {
+	case codes.NotFound, codes.PermissionDenied, codes.Unauthenticated, codes.InvalidArgument:
+		return mesh.Permanent(err)
 	}
-	return nil, err
+	return err
 }
 
 func ProjectLabels(ctx context.Context, p string) (map[string]string, error) {
@@ -509,7 +658,12 @@ func AllClusters(ctx context.Context, kr *mesh.KRun, configProjectId string,
 	clcr := &containerpb.ListClustersRequest{
 		Parent: "projects/" + configProjectId + "/locations/-",
 	}
-	clusters, err := cl.ListClusters(ctx, clcr)
+	var clusters *containerpb.ListClustersResponse
+	err = kr.Retry(ctx, "cluster_discovery", func(ctx context.Context) error {
+		var err error
+		clusters, err = cl.ListClusters(ctx, clcr)
+		return permanentGRPCError(err)
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -537,6 +691,22 @@ func AllClusters(ctx context.Context, kr *mesh.KRun, configProjectId string,
 	return clustersL, nil
 }
 
+// checkCachedKubeConfig verifies a kubeconfig from the startup cache has the form created by addClusterConfig:
+// https server with a CA, and the gcp auth provider without a command. The cache may be on a shared volume.
+func checkCachedKubeConfig(kc *kubeconfig.Config) error {
+	for n, c := range kc.Clusters {
+		if !strings.HasPrefix(c.Server, "https://") || len(c.CertificateAuthorityData) == 0 || c.InsecureSkipTLSVerify {
+			return fmt.Errorf("cluster %s: expecting https server with CA data", n)
+		}
+	}
+	for n, a := range kc.AuthInfos {
+		if a.Exec != nil || a.AuthProvider == nil || a.AuthProvider.Name != "gcp" || len(a.AuthProvider.Config) != 0 {
+			return fmt.Errorf("user %s: expecting gcp auth provider", n)
+		}
+	}
+	return nil
+}
+
 func addClusterConfig(c *containerpb.Cluster, p, l, clusterName string) *kubeconfig.Config {
 	kc := kubeconfig.NewConfig()
 	caCert, err := base64.StdEncoding.DecodeString(c.MasterAuth.ClusterCaCertificate)
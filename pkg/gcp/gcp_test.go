@@ -25,8 +25,11 @@ import (
 
 	"github.com/GoogleCloudPlatform/cloud-run-mesh/pkg/k8s"
 	"github.com/GoogleCloudPlatform/cloud-run-mesh/pkg/mesh"
+	gkehub "google.golang.org/api/gkehub/v1"
+	containerpb "google.golang.org/genproto/googleapis/container/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
+	kubeconfig "k8s.io/client-go/tools/clientcmd/api"
 )
 
 // Requires GOOGLE_APPLICATION_CREDENTIALS or metadata server and PROJECT_ID
@@ -168,3 +171,120 @@ func checkClient(kc *kubernetes.Clientset) error {
 
 	return nil
 }
+
+func TestParseMembership(t *testing.T) {
+	m := ParseMembership("istio", "proj")
+	if m.Project != "proj" || m.Location != "global" || m.Name != "istio" {
+		t.Error("Unexpected short membership", m)
+	}
+	m = ParseMembership("//gkehub.googleapis.com/projects/fleet/locations/us-central1/memberships/istio", "proj")
+	if m.Project != "fleet" || m.Location != "us-central1" || m.Name != "istio" {
+		t.Error("Unexpected membership", m)
+	}
+	if u := m.ConnectGatewayURL(); u != "https://connectgateway.googleapis.com/v1/projects/fleet/locations/us-central1/gkeMemberships/istio" {
+		t.Error("Unexpected URL", u)
+	}
+	if ParseMembership("", "proj") != nil || ParseMembership("projects/fleet", "proj") != nil {
+		t.Error("Expecting nil for missing membership")
+	}
+}
+
+func TestMembershipCluster(t *testing.T) {
+	c := membershipCluster("projects/fleet/locations/global/memberships/istio", &gkehub.MembershipEndpoint{
+		GkeCluster: &gkehub.GkeCluster{ResourceLink: "//container.googleapis.com/projects/cfg/locations/us-central1-c/clusters/asm"},
+	})
+	if !c.GKE || c.ProjectId != "cfg" || c.ClusterLocation != "us-central1-c" || c.ClusterName != "asm" {
+		t.Error("Unexpected GKE member", c)
+	}
+	if c.Membership.Project != "fleet" || c.Membership.Name != "istio" {
+		t.Error("Unexpected membership", c.Membership)
+	}
+	c = membershipCluster("projects/fleet/locations/global/memberships/onprem", nil)
+	if c.GKE || c.ProjectId != "fleet" || c.ClusterName != "onprem" {
+		t.Error("Unexpected member", c)
+	}
+}
+
+func TestParseClusterList(t *testing.T) {
+	refs, err := ParseClusterList("us-central1/istio, dr/us-east1/istio-dr,projects/p3/locations/europe-west1/clusters/c3", "cfg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(refs) != 3 {
+		t.Fatal("Expecting 3 clusters", refs)
+	}
+	if refs[0].ClusterID() != "cn-cfg-us-central1-istio" || refs[1].ClusterID() != "cn-dr-us-east1-istio-dr" ||
+		refs[2].ClusterID() != "cn-p3-europe-west1-c3" {
+		t.Error("Unexpected clusters", refs[0], refs[1], refs[2])
+	}
+	if _, err := ParseClusterList("istio", "cfg"); err == nil {
+		t.Error("Expecting error for missing location")
+	}
+	if _, err := ParseClusterList("us-central1/istio", ""); err == nil {
+		t.Error("Expecting error for missing project")
+	}
+}
+
+func TestParseSecretEnv(t *testing.T) {
+	refs := ParseSecretEnv([]string{
+		"SECRET_DB_PASSWORD=db-pass",
+		"SECRET_TLS_KEY=projects/other/secrets/tls-key/versions/3?file=/etc/certs/key.pem",
+		"SECRET_=ignored",
+		"PROJECT_ID=p",
+	}, "p")
+	if len(refs) != 2 {
+		t.Fatal("Expecting 2 secrets", refs)
+	}
+	if refs[0].Env != "DB_PASSWORD" || refs[0].Resource != "projects/p/secrets/db-pass/versions/latest" || refs[0].File != "" {
+		t.Error("Unexpected env secret", refs[0])
+	}
+	if refs[1].Resource != "projects/other/secrets/tls-key/versions/3" || refs[1].File != "/etc/certs/key.pem" {
+		t.Error("Unexpected file secret", refs[1])
+	}
+}
+
+func TestCheckCachedKubeConfig(t *testing.T) {
+	kc := addClusterConfig(&containerpb.Cluster{
+		Endpoint:   "10.0.0.1",
+		MasterAuth: &containerpb.MasterAuth{ClusterCaCertificate: "Y2E="},
+	}, "p", "us-central1", "c")
+	if err := checkCachedKubeConfig(kc); err != nil {
+		t.Fatal(err)
+	}
+	kc.AuthInfos["gke_p_us-central1_c"].AuthProvider.Config = map[string]string{"cmd-path": "/bin/sh"}
+	if checkCachedKubeConfig(kc) == nil {
+		t.Error("Expecting error for auth provider command")
+	}
+	kc.AuthInfos["gke_p_us-central1_c"] = &kubeconfig.AuthInfo{Exec: &kubeconfig.ExecConfig{Command: "/bin/sh"}}
+	if checkCachedKubeConfig(kc) == nil {
+		t.Error("Expecting error for exec")
+	}
+	kc = addClusterConfig(&containerpb.Cluster{Endpoint: "10.0.0.1", MasterAuth: &containerpb.MasterAuth{}}, "p", "l", "c")
+	if checkCachedKubeConfig(kc) == nil {
+		t.Error("Expecting error for missing CA")
+	}
+}
+
+func TestIstiodAddr(t *testing.T) {
+	kr := mesh.New()
+	v1 := map[string]string{"IMCON_ADDR": "10.1.1.1"}
+	for _, tc := range []struct {
+		name string
+		menv map[string]string
+		addr string
+	}{
+		{"v1", v1, "10.1.1.1:15012"},
+		{"v2", map[string]string{"MESH_ENV_VERSION": "2", "MESH_CONNECTOR_INTERNAL_ADDR": "10.1.1.2"}, "10.1.1.2:15012"},
+		{"explicit", map[string]string{"XDS_ADDR": "istiod:15012", "MESH_CONNECTOR_INTERNAL_ADDR": "10.1.1.2"}, "istiod:15012"},
+		{"managed", map[string]string{"MESH_TENANT": "p1", "MESH_CONNECTOR_INTERNAL_ADDR": "10.1.1.2"}, ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if a := istiodAddr(kr, tc.menv); a != tc.addr {
+				t.Error("Unexpected address", a, tc.addr)
+			}
+		})
+	}
+	if len(v1) != 1 || v1["IMCON_ADDR"] == "" {
+		t.Error("Shared mesh-env modified", v1)
+	}
+}
@@ -0,0 +1,58 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcp
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/GoogleCloudPlatform/cloud-run-mesh/pkg/mesh"
+	"golang.org/x/oauth2"
+	"google.golang.org/api/impersonate"
+	"k8s.io/client-go/rest"
+)
+
+// IMPERSONATE_GSA allows one runtime service account to be used for many services, while the mesh identity maps
+// to a per-service GSA. The K8S API server - including the TokenRequest for the CA and XDS audiences and the
+// mesh-env - is called with access tokens for the impersonated GSA, so RBAC bindings use the target GSA.
+//
+// The runtime GSA must have "roles/iam.serviceAccountTokenCreator" on the target GSA.
+
+const cloudPlatformScope = "https://www.googleapis.com/auth/cloud-platform"
+
+// impersonateTokenSource returns the tokens for the target GSA, replaced in tests.
+var impersonateTokenSource = impersonate.CredentialsTokenSource
+
+// impersonateConfig replaces the 'gcp' auth provider with tokens for the impersonated GSA, if IMPERSONATE_GSA is set.
+func impersonateConfig(kr *mesh.KRun, rc *rest.Config) error {
+	gsa := kr.Config("IMPERSONATE_GSA", "")
+	if gsa == "" {
+		return nil
+	}
+	// The token source is used for the lifetime of the client - not bound to the request context.
+	ts, err := impersonateTokenSource(context.Background(), impersonate.CredentialsConfig{
+		TargetPrincipal: gsa,
+		Scopes:          []string{cloudPlatformScope},
+	})
+	if err != nil {
+		return err
+	}
+	ts = oauth2.ReuseTokenSource(nil, ts)
+	rc.AuthProvider = nil
+	rc.WrapTransport = func(rt http.RoundTripper) http.RoundTripper {
+		return &oauth2.Transport{Source: ts, Base: rt}
+	}
+	return nil
+}
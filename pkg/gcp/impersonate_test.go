@@ -0,0 +1,76 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcp
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/cloud-run-mesh/pkg/mesh"
+	"golang.org/x/oauth2"
+	"google.golang.org/api/impersonate"
+	"google.golang.org/api/option"
+	"k8s.io/client-go/rest"
+	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
+)
+
+func TestImpersonateConfig(t *testing.T) {
+	var cfg impersonate.CredentialsConfig
+	defer func(f func(context.Context, impersonate.CredentialsConfig, ...option.ClientOption) (oauth2.TokenSource, error)) {
+		impersonateTokenSource = f
+	}(impersonateTokenSource)
+	impersonateTokenSource = func(ctx context.Context, c impersonate.CredentialsConfig, opts ...option.ClientOption) (oauth2.TokenSource, error) {
+		cfg = c
+		return oauth2.StaticTokenSource(&oauth2.Token{AccessToken: "impersonated"}), nil
+	}
+	gcpAuth := &clientcmdapi.AuthProviderConfig{Name: "gcp"}
+
+	// Not set - the config is not changed.
+	kr := mesh.New()
+	rc := &rest.Config{AuthProvider: gcpAuth}
+	if err := impersonateConfig(kr, rc); err != nil || rc.AuthProvider != gcpAuth || rc.WrapTransport != nil {
+		t.Fatal("Unexpected config change", rc, err)
+	}
+
+	os.Setenv("IMPERSONATE_GSA", "k8s-fortio@p1.iam.gserviceaccount.com")
+	defer os.Unsetenv("IMPERSONATE_GSA")
+	if err := impersonateConfig(kr, rc); err != nil {
+		t.Fatal(err)
+	}
+	if rc.AuthProvider != nil || rc.WrapTransport == nil {
+		t.Fatal("Expecting the gcp auth provider to be replaced", rc)
+	}
+	if cfg.TargetPrincipal != "k8s-fortio@p1.iam.gserviceaccount.com" || len(cfg.Scopes) != 1 || cfg.Scopes[0] != cloudPlatformScope {
+		t.Error("Unexpected impersonation config", cfg)
+	}
+
+	// The API server requests use the impersonated tokens.
+	auth := ""
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth = r.Header.Get("Authorization")
+	}))
+	defer srv.Close()
+	res, err := (&http.Client{Transport: rc.WrapTransport(http.DefaultTransport)}).Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if auth != "Bearer impersonated" {
+		t.Error("Unexpected Authorization", auth)
+	}
+}
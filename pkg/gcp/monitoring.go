@@ -0,0 +1,160 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcp
+
+import (
+	"context"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/GoogleCloudPlatform/cloud-run-mesh/pkg/mesh"
+	monitoring "google.golang.org/api/monitoring/v3"
+)
+
+// Monitoring exports krun metrics as Cloud Monitoring custom metrics.
+//
+// CloudRun instances don't have a dedicated monitored resource for custom metrics, generic_task is used with
+// the service as namespace, revision as job and the instance ID as task_id.
+type Monitoring struct {
+	kr *mesh.KRun
+
+	// Prefix added to the metric names. Default is custom.googleapis.com/
+	Prefix string
+
+	m   sync.Mutex
+	svc *monitoring.Service
+
+	// The resource labels don't change - the region is looked up once.
+	resOnce sync.Once
+	res     *monitoring.MonitoredResource
+}
+
+// Cloud Monitoring accepts at most 200 time series in a request.
+const maxTimeSeries = 200
+
+func NewMonitoring(kr *mesh.KRun) *Monitoring {
+	return &Monitoring{kr: kr, Prefix: "custom.googleapis.com/"}
+}
+
+func (m *Monitoring) service(ctx context.Context) (*monitoring.Service, error) {
+	m.m.Lock()
+	defer m.m.Unlock()
+	if m.svc != nil {
+		return m.svc, nil
+	}
+	svc, err := monitoring.NewService(ctx)
+	if err != nil {
+		return nil, err
+	}
+	m.svc = svc
+	return svc, nil
+}
+
+func (m *Monitoring) resource() *monitoring.MonitoredResource {
+	m.resOnce.Do(func() {
+		m.res = m.newResource()
+	})
+	return m.res
+}
+
+func (m *Monitoring) newResource() *monitoring.MonitoredResource {
+	kr := m.kr
+	location, err := RegionFromMetadata()
+	if err != nil {
+		location = kr.Region()
+	}
+	svc := os.Getenv("K_SERVICE")
+	if svc == "" {
+		svc = kr.Name
+	}
+	job := os.Getenv("K_REVISION")
+	if job == "" {
+		job = svc
+	}
+	return &monitoring.MonitoredResource{
+		Type: "generic_task",
+		Labels: map[string]string{
+			"project_id": kr.ProjectId,
+			"location":   location,
+			"namespace":  svc,
+			"job":        job,
+			"task_id":    kr.InstanceID,
+		},
+	}
+}
+
+// WriteMetrics implements mesh.MetricWriter.
+func (m *Monitoring) WriteMetrics(ctx context.Context, metrics []mesh.Metric) error {
+	svc, err := m.service(ctx)
+	if err != nil {
+		return err
+	}
+	res := m.resource()
+	start := m.kr.StartTime.UTC().Format(time.RFC3339Nano)
+	now := time.Now()
+
+	tsl := []*monitoring.TimeSeries{}
+	for _, mt := range metrics {
+		t := mt.Time
+		if t.IsZero() {
+			t = now
+		}
+		v := mt.Value
+		ts := &monitoring.TimeSeries{
+			Metric: &monitoring.Metric{
+				Type:   m.metricType(mt.Name),
+				Labels: mt.Labels,
+			},
+			Resource:   res,
+			MetricKind: "GAUGE",
+			ValueType:  "DOUBLE",
+			Points: []*monitoring.Point{{
+				Interval: &monitoring.TimeInterval{EndTime: t.UTC().Format(time.RFC3339Nano)},
+				Value:    &monitoring.TypedValue{DoubleValue: &v},
+			}},
+		}
+		if mt.Counter {
+			ts.MetricKind = "CUMULATIVE"
+			ts.Points[0].Interval.StartTime = start
+			if !mt.Start.IsZero() {
+				ts.Points[0].Interval.StartTime = mt.Start.UTC().Format(time.RFC3339Nano)
+			}
+		}
+		tsl = append(tsl, ts)
+	}
+
+	for len(tsl) > 0 {
+		n := len(tsl)
+		if n > maxTimeSeries {
+			n = maxTimeSeries
+		}
+		_, err := svc.Projects.TimeSeries.Create("projects/"+m.kr.ProjectId,
+			&monitoring.CreateTimeSeriesRequest{TimeSeries: tsl[0:n]}).Context(ctx).Do()
+		if err != nil {
+			return err
+		}
+		tsl = tsl[n:]
+	}
+	return nil
+}
+
+func (m *Monitoring) metricType(name string) string {
+	if strings.Contains(name, ".googleapis.com/") {
+		return name
+	}
+	return m.Prefix + name
+}
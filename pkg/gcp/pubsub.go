@@ -0,0 +1,63 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcp
+
+import (
+	"context"
+	"encoding/base64"
+	"sync"
+
+	pubsub "google.golang.org/api/pubsub/v1"
+)
+
+// PubSub publishes krun lifecycle events to Cloud Pub/Sub.
+type PubSub struct {
+	m   sync.Mutex
+	svc *pubsub.Service
+}
+
+func NewPubSub() *PubSub {
+	return &PubSub{}
+}
+
+func (p *PubSub) service() (*pubsub.Service, error) {
+	p.m.Lock()
+	defer p.m.Unlock()
+	if p.svc != nil {
+		return p.svc, nil
+	}
+	// The token source keeps the context - the service outlives the request.
+	svc, err := pubsub.NewService(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	p.svc = svc
+	return svc, nil
+}
+
+// PublishEvent implements mesh.EventPublisher.
+func (p *PubSub) PublishEvent(ctx context.Context, topic string, data []byte, attrs map[string]string) error {
+	svc, err := p.service()
+	if err != nil {
+		return err
+	}
+	_, err = svc.Projects.Topics.Publish(topic, &pubsub.PublishRequest{
+		Messages: []*pubsub.PubsubMessage{{
+			Data:       base64.StdEncoding.EncodeToString(data),
+			Attributes: attrs,
+		}},
+	}).Context(ctx).Do()
+	return err
+}
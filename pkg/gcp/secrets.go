@@ -0,0 +1,161 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcp
+
+import (
+	"context"
+	"encoding/base64"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/GoogleCloudPlatform/cloud-run-mesh/pkg/mesh"
+	secretmanager "google.golang.org/api/secretmanager/v1"
+)
+
+// Secret Manager integration - secrets are fetched at startup using the identity of the CloudRun service, before
+// the app is started.
+//
+// SECRET_NAME=projects/PROJECT/secrets/SECRET[/versions/VERSION] sets the env variable NAME for the app. A short
+// SECRET or SECRET/versions/VERSION uses the current project, the default version is 'latest'.
+//
+// Adding ?file=/path/to/file writes the secret to the file instead - for certificates and keys. File secrets are
+// refreshed every MESH_SECRETS_REFRESH, if set (for example 10m).
+//
+// The GSA must have "roles/secretmanager.secretAccessor".
+
+// SecretRef is a secret declared in the environment.
+type SecretRef struct {
+	// Env is the env variable set for the app, if File is not set.
+	Env string
+
+	// Resource is the name of the secret version.
+	Resource string
+
+	File string
+}
+
+// ParseSecretEnv returns the secrets declared in the environment.
+func ParseSecretEnv(environ []string, defProject string) []*SecretRef {
+	res := []*SecretRef{}
+	for _, e := range environ {
+		if !strings.HasPrefix(e, "SECRET_") {
+			continue
+		}
+		kv := strings.SplitN(e[len("SECRET_"):], "=", 2)
+		if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+			continue
+		}
+		ref := &SecretRef{Env: kv[0]}
+		res = append(res, ref)
+
+		v := kv[1]
+		if i := strings.Index(v, "?"); i >= 0 {
+			q, _ := url.ParseQuery(v[i+1:])
+			ref.File = q.Get("file")
+			v = v[0:i]
+		}
+		v = strings.Trim(v, "/")
+		if !strings.HasPrefix(v, "projects/") {
+			v = "projects/" + defProject + "/secrets/" + v
+		}
+		if !strings.Contains(v, "/versions/") {
+			v = v + "/versions/latest"
+		}
+		ref.Resource = v
+	}
+	return res
+}
+
+// LoadSecrets fetches the declared secrets, and starts the refresh of file secrets.
+// Must be called before the app is started.
+func LoadSecrets(ctx context.Context, kr *mesh.KRun) error {
+	refs := ParseSecretEnv(os.Environ(), kr.ProjectId)
+	if len(refs) == 0 {
+		return nil
+	}
+	// The service is also used for the refresh, after the startup ctx is done.
+	sm, err := secretmanager.NewService(context.Background())
+	if err != nil {
+		return err
+	}
+	t0 := time.Now()
+	files := []*SecretRef{}
+	for _, ref := range refs {
+		if err := loadSecret(ctx, sm, ref); err != nil {
+			return err
+		}
+		if ref.File != "" {
+			files = append(files, ref)
+		}
+	}
+	log.Println("Loaded secrets", "count", len(refs), "time", time.Since(t0))
+
+	refresh, _ := time.ParseDuration(kr.Config("MESH_SECRETS_REFRESH", ""))
+	if refresh > 0 && len(files) > 0 {
+		go func() {
+			for {
+				time.Sleep(refresh)
+				for _, ref := range files {
+					ctx, cf := context.WithTimeout(context.Background(), 10*time.Second)
+					if err := loadSecret(ctx, sm, ref); err != nil {
+						log.Println("Failed to refresh secret", ref.Resource, err)
+					}
+					cf()
+				}
+			}
+		}()
+	}
+	return nil
+}
+
+func loadSecret(ctx context.Context, sm *secretmanager.Service, ref *SecretRef) error {
+	res, err := sm.Projects.Secrets.Versions.Access(ref.Resource).Context(ctx).Do()
+	if err != nil {
+		return err
+	}
+	data, err := base64.StdEncoding.DecodeString(res.Payload.Data)
+	if err != nil {
+		return err
+	}
+	if ref.File == "" {
+		return os.Setenv(ref.Env, string(data))
+	}
+	return writeSecretFile(ref.File, data)
+}
+
+// writeSecretFile atomically replaces the file, owned by the app user (K8S_UID) when running as root.
+func writeSecretFile(file string, data []byte) error {
+	old, err := ioutil.ReadFile(file)
+	if err == nil && string(old) == string(data) {
+		return nil
+	}
+	os.MkdirAll(filepath.Dir(file), 0755)
+	tmp := file + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	if os.Getuid() == 0 {
+		if uid, err := strconv.Atoi(os.Getenv("K8S_UID")); err == nil {
+			os.Chown(tmp, uid, -1)
+		}
+	}
+	return os.Rename(tmp, file)
+}
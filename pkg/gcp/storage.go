@@ -0,0 +1,61 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gcp
+
+import (
+	"context"
+	"io"
+	"sync"
+
+	storage "google.golang.org/api/storage/v1"
+)
+
+// Storage uploads krun crash artifacts to GCS.
+type Storage struct {
+	m   sync.Mutex
+	svc *storage.Service
+}
+
+func NewStorage() *Storage {
+	return &Storage{}
+}
+
+func (s *Storage) service() (*storage.Service, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if s.svc != nil {
+		return s.svc, nil
+	}
+	// The token source keeps the context - the service outlives the request.
+	svc, err := storage.NewService(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	s.svc = svc
+	return svc, nil
+}
+
+// UploadArtifact implements mesh.ArtifactUploader.
+func (s *Storage) UploadArtifact(ctx context.Context, bucket, name string, r io.Reader) error {
+	svc, err := s.service()
+	if err != nil {
+		return err
+	}
+	_, err = svc.Objects.Insert(bucket, &storage.Object{
+		Name:        name,
+		ContentType: "application/gzip",
+	}).Media(r).Context(ctx).Do()
+	return err
+}
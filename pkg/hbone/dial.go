@@ -0,0 +1,449 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hbone
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+// Dial opens a TCP stream to podIP:port, tunneled over HBONE (CONNECT over mTLS HTTP/2 on port 15008).
+//
+// Streams to the same pod are multiplexed over a pooled connection, using the workload certificate in Cert and
+// verifying the peer with MeshRoots. This allows apps using krun as a library to reach pods in the mesh (with a
+// ztunnel or ambient krun) without Envoy. ctx only applies to establishing the stream - use Close or the deadlines
+// of the returned conn afterwards.
+func (hb *HBone) Dial(ctx context.Context, podIP string, port int) (net.Conn, error) {
+	return hb.dialHBONE(ctx, net.JoinHostPort(podIP, HBONEPort), net.JoinHostPort(podIP, strconv.Itoa(port)))
+}
+
+// DialContext has the same signature as net.Dialer.DialContext, and can be used in a http.Transport.
+// Only tcp is supported - addr must be a pod IP and port.
+func (hb *HBone) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	if network != "tcp" && network != "tcp4" && network != "tcp6" {
+		return nil, errors.New("HBONE: unsupported network " + network)
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	return hb.dialHBONE(ctx, net.JoinHostPort(host, HBONEPort), addr)
+}
+
+// DialVia opens a TCP stream to dest (host:port), tunneled over the HBONE server at hboneAddr - typically
+// the east-west gateway, which resolves mesh service names. Used when the destination pod is not reachable
+// directly, for example from CloudRun without a VPC connector to the pod network.
+func (hb *HBone) DialVia(ctx context.Context, hboneAddr, dest string) (net.Conn, error) {
+	if !strings.Contains(hboneAddr, ":") {
+		hboneAddr = net.JoinHostPort(hboneAddr, HBONEPort)
+	}
+	return hb.dialHBONE(ctx, hboneAddr, dest)
+}
+
+// dialHBONE sends a CONNECT for dest to the HBONE server at hboneAddr.
+func (hb *HBone) dialHBONE(ctx context.Context, hboneAddr, dest string) (net.Conn, error) {
+	res, o, err := hb.openStream(ctx, hboneAddr, "CONNECT", "https://"+dest, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &hboneConn{r: res.Body, w: o, local: hboneAddress(hboneAddr), remote: hboneAddress(dest)}, nil
+}
+
+// openStream sends a streaming request to the HBONE server at hboneAddr, using a pooled connection. The returned
+// writer is the request body.
+//
+// ctx only applies until the stream is established - the stream is closed when the response body is closed.
+func (hb *HBone) openStream(ctx context.Context, hboneAddr, method, url string, h http.Header) (*http.Response, *io.PipeWriter, error) {
+	cc, err := hb.pooledConn(ctx, hboneAddr)
+	if err != nil {
+		return nil, nil, err
+	}
+	sctx, cancel := context.WithCancel(context.Background())
+	var m sync.Mutex
+	established := false
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			m.Lock()
+			if !established {
+				cancel()
+			}
+			m.Unlock()
+		case <-done:
+		}
+	}()
+	res, o, err := roundTripStream(sctx, cc, method, url, h)
+	m.Lock()
+	established = true
+	m.Unlock()
+	close(done)
+	if err != nil {
+		cancel()
+		if res == nil {
+			hb.evictHBONE(hboneAddr, cc)
+		}
+		return res, o, err
+	}
+	res.Body = &cancelBody{ReadCloser: res.Body, cancel: cancel}
+	return res, o, nil
+}
+
+// cancelBody cancels the stream context when the response body is closed.
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (cb *cancelBody) Close() error {
+	err := cb.ReadCloser.Close()
+	cb.cancel()
+	return err
+}
+
+// roundTripStream sends a request with a streaming body. A non-200 response is returned as an error, with a
+// non-nil but closed response.
+func roundTripStream(ctx context.Context, rt http.RoundTripper, method, url string, h http.Header) (*http.Response, *io.PipeWriter, error) {
+	i, o := io.Pipe()
+	r, err := http.NewRequestWithContext(ctx, method, url, i)
+	if err != nil {
+		return nil, nil, err
+	}
+	for k, v := range h {
+		r.Header[k] = v
+	}
+	// The transport waits for the request body writer before returning an error status - unblock it if the
+	// response doesn't arrive before ctx is done.
+	established := make(chan struct{})
+	defer close(established)
+	go func() {
+		select {
+		case <-ctx.Done():
+			i.CloseWithError(ctx.Err())
+		case <-established:
+		}
+	}()
+	res, err := rt.RoundTrip(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	if res.StatusCode != 200 {
+		res.Body.Close()
+		return res, nil, errors.New("HBONE " + method + " failed " + res.Status)
+	}
+	return res, o, nil
+}
+
+// pendingDial is a connection being created, shared by the streams waiting for it.
+type pendingDial struct {
+	done chan struct{}
+	cc   *http2.ClientConn
+	err  error
+}
+
+// pooledConn returns a pooled connection to the HBONE server, creating a new one if none can take new streams.
+// Concurrent streams to the same server wait for a single new connection.
+func (hb *HBone) pooledConn(ctx context.Context, hboneAddr string) (*http2.ClientConn, error) {
+	hb.m.Lock()
+	cc := hb.hbonePool[hboneAddr]
+	if cc != nil && cc.CanTakeNewRequest() {
+		hb.m.Unlock()
+		return cc, nil
+	}
+	pd := hb.hboneDials[hboneAddr]
+	if pd == nil {
+		pd = &pendingDial{done: make(chan struct{})}
+		if hb.hboneDials == nil {
+			hb.hboneDials = map[string]*pendingDial{}
+		}
+		hb.hboneDials[hboneAddr] = pd
+		go hb.dialPooled(hboneAddr, pd)
+	}
+	hb.m.Unlock()
+
+	select {
+	case <-pd.done:
+		return pd.cc, pd.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// dialPooled creates a connection to the HBONE server and adds it to the pool. The connection outlives the
+// stream that created it - the dial is not tied to the context of the stream.
+func (hb *HBone) dialPooled(hboneAddr string, pd *pendingDial) {
+	pd.cc, pd.err = hb.dialH2(hboneAddr)
+	hb.m.Lock()
+	if pd.err == nil {
+		hb.hbonePool[hboneAddr] = pd.cc
+	}
+	delete(hb.hboneDials, hboneAddr)
+	hb.m.Unlock()
+	close(pd.done)
+}
+
+func (hb *HBone) dialH2(hboneAddr string) (*http2.ClientConn, error) {
+	if hb.Cert == nil {
+		return nil, errors.New("missing workload certificate")
+	}
+	d := tls.Dialer{NetDialer: hb.netDialer(), Config: hb.clientTLSConfig()}
+	dctx, cf := context.WithTimeout(context.Background(), hb.handshakeTimeout())
+	defer cf()
+	nConn, err := d.DialContext(dctx, "tcp", hboneAddr)
+	if err != nil {
+		return nil, err
+	}
+	cc, err := hb.h2t.NewClientConn(nConn)
+	if err != nil {
+		nConn.Close()
+		return nil, err
+	}
+	return cc, nil
+}
+
+// clientTLSConfig returns the mTLS config for HBONE clients, using the workload certificate.
+func (hb *HBone) clientTLSConfig() *tls.Config {
+	return TLSConfig(&tls.Config{
+		Certificates:       []tls.Certificate{*hb.Cert},
+		NextProtos:         []string{"h2"},
+		MinVersion:         tls.VersionTLS12,
+		InsecureSkipVerify: true, // verified using the mesh roots
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			_, err := hb.verifyPeer(rawCerts)
+			return err
+		},
+	})
+}
+
+func (hb *HBone) evictHBONE(hboneAddr string, cc *http2.ClientConn) {
+	hb.m.Lock()
+	if hb.hbonePool[hboneAddr] == cc {
+		delete(hb.hbonePool, hboneAddr)
+	}
+	hb.m.Unlock()
+}
+
+func (hb *HBone) handshakeTimeout() time.Duration {
+	if hb.HandsahakeTimeout == 0 {
+		return 3 * time.Second
+	}
+	return hb.HandsahakeTimeout
+}
+
+type hboneAddress string
+
+func (a hboneAddress) Network() string { return "hbone" }
+func (a hboneAddress) String() string  { return string(a) }
+
+// hboneConn is a net.Conn for a CONNECT stream.
+//
+// Reads use a goroutine, so a read deadline interrupts a blocked Read without losing data. A write deadline that
+// expires while a Write is blocked waiting for flow control aborts the stream - the peer may have received part
+// of the data.
+type hboneConn struct {
+	r      io.ReadCloser
+	w      *io.PipeWriter
+	local  net.Addr
+	remote net.Addr
+
+	rd, wd connDeadline
+
+	rm      sync.Mutex
+	rch     chan readResult
+	pending []byte
+	rerr    error
+
+	cm   sync.Mutex
+	done chan struct{}
+}
+
+type readResult struct {
+	data []byte
+	err  error
+}
+
+func (hc *hboneConn) Read(b []byte) (int, error) {
+	hc.rm.Lock()
+	defer hc.rm.Unlock()
+	if len(hc.pending) == 0 {
+		if hc.rerr != nil {
+			return 0, hc.rerr
+		}
+		if hc.rch == nil {
+			hc.rch = make(chan readResult)
+			go hc.readLoop(hc.closed())
+		}
+		select {
+		case rr := <-hc.rch:
+			hc.pending, hc.rerr = rr.data, rr.err
+		case <-hc.rd.wait():
+			return 0, os.ErrDeadlineExceeded
+		}
+		if len(hc.pending) == 0 {
+			return 0, hc.rerr
+		}
+	}
+	n := copy(b, hc.pending)
+	hc.pending = hc.pending[n:]
+	return n, nil
+}
+
+// readLoop reads from the stream until an error, or until the conn is closed.
+func (hc *hboneConn) readLoop(done chan struct{}) {
+	for {
+		buf := make([]byte, 32*1024)
+		n, err := hc.r.Read(buf)
+		select {
+		case hc.rch <- readResult{buf[0:n], err}:
+		case <-done:
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (hc *hboneConn) Write(b []byte) (int, error) {
+	wd := hc.wd.wait()
+	if wd == nil {
+		return hc.w.Write(b)
+	}
+	select {
+	case <-wd:
+		return 0, os.ErrDeadlineExceeded
+	default:
+	}
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-wd:
+			hc.w.CloseWithError(os.ErrDeadlineExceeded)
+		case <-stop:
+		}
+	}()
+	return hc.w.Write(b)
+}
+
+// CloseWrite sends an END_STREAM to the peer, which will close the write side of the TCP connection.
+func (hc *hboneConn) CloseWrite() error {
+	return hc.w.Close()
+}
+
+func (hc *hboneConn) Close() error {
+	hc.cm.Lock()
+	if hc.done == nil {
+		hc.done = make(chan struct{})
+	}
+	if !isClosed(hc.done) {
+		close(hc.done)
+	}
+	hc.cm.Unlock()
+	hc.w.Close()
+	return hc.r.Close()
+}
+
+func (hc *hboneConn) closed() chan struct{} {
+	hc.cm.Lock()
+	defer hc.cm.Unlock()
+	if hc.done == nil {
+		hc.done = make(chan struct{})
+	}
+	return hc.done
+}
+
+func (hc *hboneConn) LocalAddr() net.Addr {
+	return hc.local
+}
+
+func (hc *hboneConn) RemoteAddr() net.Addr {
+	return hc.remote
+}
+
+func (hc *hboneConn) SetDeadline(t time.Time) error {
+	hc.rd.set(t)
+	hc.wd.set(t)
+	return nil
+}
+
+func (hc *hboneConn) SetReadDeadline(t time.Time) error {
+	hc.rd.set(t)
+	return nil
+}
+
+func (hc *hboneConn) SetWriteDeadline(t time.Time) error {
+	hc.wd.set(t)
+	return nil
+}
+
+// connDeadline is a deadline that can be changed while a Read or Write is blocked. The channel returned by wait is
+// closed when the deadline expires, and is nil if no deadline was ever set.
+type connDeadline struct {
+	m      sync.Mutex
+	timer  *time.Timer
+	cancel chan struct{}
+}
+
+func (d *connDeadline) set(t time.Time) {
+	d.m.Lock()
+	defer d.m.Unlock()
+	if d.timer != nil && !d.timer.Stop() {
+		// The timer fired - wait for the channel to be closed.
+		<-d.cancel
+	}
+	d.timer = nil
+	if d.cancel == nil || isClosed(d.cancel) {
+		d.cancel = make(chan struct{})
+	}
+	if t.IsZero() {
+		return
+	}
+	if dur := time.Until(t); dur > 0 {
+		cancel := d.cancel
+		d.timer = time.AfterFunc(dur, func() {
+			close(cancel)
+		})
+		return
+	}
+	close(d.cancel)
+}
+
+func (d *connDeadline) wait() chan struct{} {
+	d.m.Lock()
+	defer d.m.Unlock()
+	return d.cancel
+}
+
+func isClosed(c chan struct{}) bool {
+	select {
+	case <-c:
+		return true
+	default:
+		return false
+	}
+}
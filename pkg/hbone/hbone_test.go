@@ -15,9 +15,25 @@
 package hbone
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"errors"
 	"io"
 	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -80,3 +96,613 @@ func EchoClient(t *testing.T, lout *io.PipeWriter, lin *io.PipeReader) {
 	}
 	timer.Stop()
 }
+
+func TestHBONELocalTarget(t *testing.T) {
+	hb := New()
+	hb.Ports["http"] = "8080"
+	hb.Ports["grpc"] = "127.0.0.1:9090"
+	if d := hb.localTarget("10.1.1.1:8080"); d != "127.0.0.1:8080" {
+		t.Error("Unexpected target", d)
+	}
+	if d := hb.localTarget("10.1.1.1:9090"); d != "127.0.0.1:9090" {
+		t.Error("Unexpected target", d)
+	}
+	if d := hb.localTarget("10.1.1.1:22"); d != "" {
+		t.Error("Undeclared port allowed", d)
+	}
+	hb.Ports["*"] = "*"
+	if d := hb.localTarget("10.1.1.1:22"); d != "" {
+		t.Error("Wildcard allowed", d)
+	}
+}
+
+func TestSNIAuthority(t *testing.T) {
+	if a := SNIAuthority("outbound_.9090_._.prometheus.mon.svc.cluster.local", "443"); a != "prometheus.mon.svc.cluster.local:9090" {
+		t.Error("Unexpected authority", a)
+	}
+	if a := SNIAuthority("fortio.example.com", "443"); a != "fortio.example.com:443" {
+		t.Error("Unexpected authority", a)
+	}
+}
+
+// testCert returns a self-signed certificate with a spiffe SAN, and a pool with the cert as root.
+func testCert(t *testing.T) (*tls.Certificate, *x509.CertPool) {
+	roots := x509.NewCertPool()
+	return testCertID(t, "spiffe://cluster.local/ns/test/sa/default", roots), roots
+}
+
+// testCertID returns a self-signed certificate for the spiffe id, added to roots.
+func testCertID(t *testing.T, id string, roots *x509.CertPool) *tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, _ := url.Parse(id)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{Organization: []string{"test"}},
+		NotBefore:             time.Now().Add(-1 * time.Hour),
+		NotAfter:              time.Now().Add(1 * time.Hour),
+		URIs:                  []*url.URL{u},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	x, _ := x509.ParseCertificate(der)
+	roots.AddCert(x)
+	return &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: x}
+}
+
+// echoListener returns a TCP listener that echoes the data received.
+func echoListener(t *testing.T) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(c, c)
+				c.Close()
+			}()
+		}
+	}()
+	return l
+}
+
+func TestHBONEDial(t *testing.T) {
+	cert, roots := testCert(t)
+	echoL := echoListener(t)
+	defer echoL.Close()
+
+	server := New()
+	server.Cert = cert
+	server.MeshRoots = roots
+	server.Ports["echo"] = echoL.Addr().String()
+	hl, err := ListenAndServeTCP("127.0.0.1:0", server.HandleAcceptedHBONE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hl.Close()
+
+	client := New()
+	client.Cert = cert
+	client.MeshRoots = roots
+	ctx, cf := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cf()
+
+	for i := 0; i < 2; i++ {
+		c, err := client.dialHBONE(ctx, hl.Addr().String(), echoL.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.Write([]byte("hello"))
+		buf := make([]byte, 5)
+		if _, err := io.ReadFull(c, buf); err != nil || string(buf) != "hello" {
+			t.Fatal("Unexpected echo", string(buf), err)
+		}
+		c.Close()
+	}
+	if len(client.hbonePool) != 1 {
+		t.Error("Expecting a single pooled connection", len(client.hbonePool))
+	}
+
+	// Only the declared ports, and only for allowed peers.
+	if !dialForbidden(client, hl.Addr().String(), "127.0.0.1:22") {
+		t.Error("Undeclared port allowed")
+	}
+	server.AllowedPeers = []string{"spiffe://cluster.local/ns/other/"}
+	if !dialForbidden(client, hl.Addr().String(), echoL.Addr().String()) {
+		t.Error("Peer not in AllowedPeers accepted")
+	}
+	other := New()
+	other.Cert = testCertID(t, "spiffe://other.domain/ns/test/sa/default", roots)
+	other.MeshRoots = roots
+	server.AllowedPeers = nil
+	if !dialForbidden(other, hl.Addr().String(), echoL.Addr().String()) {
+		t.Error("Peer from a different trust domain accepted")
+	}
+}
+
+// dialForbidden returns true if the HBONE server rejects the stream with 403.
+func TestHBONEDialConn(t *testing.T) {
+	cert, roots := testCert(t)
+	echoL := echoListener(t)
+	defer echoL.Close()
+
+	server := New()
+	server.Cert = cert
+	server.MeshRoots = roots
+	server.Ports["echo"] = echoL.Addr().String()
+	var accepted int32
+	hl, err := ListenAndServeTCP("127.0.0.1:0", func(c net.Conn) {
+		atomic.AddInt32(&accepted, 1)
+		server.HandleAcceptedHBONE(c)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hl.Close()
+
+	client := New()
+	client.Cert = cert
+	client.MeshRoots = roots
+
+	// Concurrent streams share a single new connection.
+	conns := make(chan net.Conn, 10)
+	for i := 0; i < 10; i++ {
+		go func() {
+			ctx, cf := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cf()
+			c, err := client.dialHBONE(ctx, hl.Addr().String(), echoL.Addr().String())
+			if err != nil {
+				t.Error(err)
+			}
+			conns <- c
+		}()
+	}
+	for i := 0; i < 10; i++ {
+		if c := <-conns; c != nil {
+			c.Close()
+		}
+	}
+	if n := atomic.LoadInt32(&accepted); n != 1 {
+		t.Error("Expecting a single connection", n)
+	}
+
+	// The dial context only applies to establishing the stream.
+	ctx, cf := context.WithTimeout(context.Background(), 5*time.Second)
+	c, err := client.dialHBONE(ctx, hl.Addr().String(), echoL.Addr().String())
+	cf()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// Read deadline interrupts the read, without losing data.
+	c.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	buf := make([]byte, 5)
+	if _, err := c.Read(buf); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatal("Expecting deadline exceeded", err)
+	}
+	c.SetReadDeadline(time.Time{})
+	c.Write([]byte("hello"))
+	if _, err := io.ReadFull(c, buf); err != nil || string(buf) != "hello" {
+		t.Fatal("Unexpected echo after cancel", string(buf), err)
+	}
+
+	c.SetWriteDeadline(time.Now().Add(-time.Second))
+	if _, err := c.Write([]byte("hello")); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Error("Expecting write deadline exceeded", err)
+	}
+}
+
+func dialForbidden(hb *HBone, hboneAddr, dest string) bool {
+	ctx, cf := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cf()
+	_, err := hb.dialHBONE(ctx, hboneAddr, dest)
+	return err != nil && strings.Contains(err.Error(), "403")
+}
+
+// Mesh clients reach a CloudRun instance using mTLS tunneled over the serving port (h2c on 15009).
+func TestHBONEServingPort(t *testing.T) {
+	cert, roots := testCert(t)
+	echoL := echoListener(t)
+	defer echoL.Close()
+
+	server := New()
+	server.Cert = cert
+	server.MeshRoots = roots
+	server.Ports["echo"] = echoL.Addr().String()
+	hl, err := ListenAndServeTCP("127.0.0.1:0", server.HandleAcceptedH2C)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hl.Close()
+
+	client := New()
+	ctx, cf := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cf()
+
+	// Outer request - in CloudRun, TLS and JWT auth are handled by the frontend.
+	nc, err := net.Dial("tcp", hl.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nc.Close()
+	h2c, err := client.h2t.NewClientConn(nc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	i, o := io.Pipe()
+	r, _ := http.NewRequestWithContext(ctx, "POST", "http://krun/_hbone/mtls", i)
+	res, err := h2c.RoundTrip(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tunnel := &hboneConn{r: res.Body, w: o}
+
+	tlsc := tls.Client(tunnel, &tls.Config{
+		Certificates:       []tls.Certificate{*cert},
+		NextProtos:         []string{"h2"},
+		InsecureSkipVerify: true,
+	})
+	if err := tlsc.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	mtls, err := client.h2t.NewClientConn(tlsc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ci, co := io.Pipe()
+	r, _ = http.NewRequestWithContext(ctx, "CONNECT", "https://"+echoL.Addr().String(), ci)
+	res, err = mtls.RoundTrip(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != 200 {
+		t.Fatal("Unexpected status", res.Status)
+	}
+	co.Write([]byte("hello"))
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(res.Body, buf); err != nil || string(buf) != "hello" {
+		t.Fatal("Unexpected echo", string(buf), err)
+	}
+	co.Close()
+}
+
+// h2cStatus sends a plain text request on the serving port, returning the status.
+func h2cStatus(t *testing.T, addr, method, url string) int {
+	nc, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nc.Close()
+	h2c, err := New().h2t.NewClientConn(nc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cf := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cf()
+	r, _ := http.NewRequestWithContext(ctx, method, url, nil)
+	res, err := h2c.RoundTrip(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	return res.StatusCode
+}
+
+// Plain text CONNECT on the serving port requires InboundAuth, and can't be relayed by the gateway.
+func TestHBONEUnauthenticatedConnect(t *testing.T) {
+	echoL := echoListener(t)
+	defer echoL.Close()
+	_, echoPort, _ := net.SplitHostPort(echoL.Addr().String())
+
+	server := New()
+	server.Ports["echo"] = echoPort
+	server.HBONEResolver = func(authority string) *Endpoint {
+		return server.NewEndpoint("http://" + echoL.Addr().String())
+	}
+	hl, err := ListenAndServeTCP("127.0.0.1:0", server.HandleAcceptedH2C)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hl.Close()
+
+	if s := h2cStatus(t, hl.Addr().String(), "CONNECT", "https://10.1.1.1:"+echoPort); s != 401 {
+		t.Error("CONNECT accepted without InboundAuth", s)
+	}
+
+	server.InboundAuth = func(r *http.Request) error {
+		return errors.New("missing JWT")
+	}
+	if s := h2cStatus(t, hl.Addr().String(), "CONNECT", "https://10.1.1.1:"+echoPort); s != 401 {
+		t.Error("CONNECT accepted with failed InboundAuth", s)
+	}
+
+	server.InboundAuth = func(r *http.Request) error {
+		return nil
+	}
+	if s := h2cStatus(t, hl.Addr().String(), "CONNECT", "https://10.1.1.1:"+echoPort); s != 200 {
+		t.Error("Authenticated CONNECT to app port rejected", s)
+	}
+	if s := h2cStatus(t, hl.Addr().String(), "CONNECT", "https://fortio.fortio.svc.cluster.local:8080"); s != 403 {
+		t.Error("Gateway relay without mTLS", s)
+	}
+}
+
+func TestCapsules(t *testing.T) {
+	for _, v := range []uint64{0, 63, 64, 16383, 16384, 1 << 30} {
+		b := appendVarint(nil, v)
+		if d, n := parseVarint(b); d != v || n != len(b) {
+			t.Error("Varint mismatch", v, d, n)
+		}
+	}
+	buf := &bytes.Buffer{}
+	writeCapsule(buf, []byte("hello"))
+	buf.Write([]byte{0x21, 1, 0}) // unknown capsule type, skipped
+	writeCapsule(buf, make([]byte, 1000))
+	br := bufio.NewReader(buf)
+	if d, err := readCapsule(br); err != nil || string(d) != "hello" {
+		t.Error("Unexpected datagram", d, err)
+	}
+	if d, err := readCapsule(br); err != nil || d != nil {
+		t.Error("Unknown capsule not skipped", d, err)
+	}
+	if d, err := readCapsule(br); err != nil || len(d) != 1000 {
+		t.Error("Unexpected datagram", len(d), err)
+	}
+	if a, ok := parseUDPPath(UDPPath("10.1.1.1", "53")); !ok || a != "10.1.1.1:53" {
+		t.Error("Unexpected target", a)
+	}
+	if _, ok := parseUDPPath(masquePrefix + "10.1.1.1/x/"); ok {
+		t.Error("Invalid port accepted")
+	}
+}
+
+func TestConnectUDP(t *testing.T) {
+	cert, roots := testCert(t)
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if string(buf[0:n]) == "flood" {
+				// Keeps sending after the client closes the stream.
+				go func() {
+					for i := 0; i < 2000; i++ {
+						pc.WriteTo([]byte("flood"), addr)
+					}
+				}()
+				continue
+			}
+			pc.WriteTo(buf[0:n], addr)
+		}
+	}()
+
+	server := New()
+	server.Cert = cert
+	server.MeshRoots = roots
+	server.Ports["udp"] = pc.LocalAddr().String()
+	hl, err := ListenAndServeTCP("127.0.0.1:0", server.HandleAcceptedHBONE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hl.Close()
+
+	client := New()
+	client.Cert = cert
+	client.MeshRoots = roots
+	ctx, cf := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cf()
+	_, port, _ := net.SplitHostPort(pc.LocalAddr().String())
+	c, err := client.dialUDP(ctx, hl.Addr().String(), "10.1.1.1", port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	for _, m := range []string{"one", "two"} {
+		c.Write([]byte(m))
+		buf := make([]byte, 1500)
+		n, err := c.Read(buf)
+		if err != nil || string(buf[0:n]) != m {
+			t.Fatal("Unexpected datagram", string(buf[0:n]), err)
+		}
+	}
+
+	// Datagrams from the target after the stream is closed must not be written to the finished response.
+	c.Write([]byte("flood"))
+	c.Read(make([]byte, 1500))
+	c.Close()
+	time.Sleep(100 * time.Millisecond)
+}
+
+// CONNECT-UDP egress is only allowed for mTLS clients, to mesh services.
+func TestConnectUDPEgress(t *testing.T) {
+	cert, roots := testCert(t)
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			pc.WriteTo(buf[0:n], addr)
+		}
+	}()
+	_, port, _ := net.SplitHostPort(pc.LocalAddr().String())
+
+	gw := New()
+	gw.Cert = cert
+	gw.MeshRoots = roots
+	gw.UDPEgress = true
+	gw.MeshDomain = "localhost"
+	gl, err := ListenAndServeTCP("127.0.0.1:0", gw.HandleAcceptedHBONE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer gl.Close()
+	hl, err := ListenAndServeTCP("127.0.0.1:0", gw.HandleAcceptedH2C)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hl.Close()
+
+	client := New()
+	client.Cert = cert
+	client.MeshRoots = roots
+	ctx, cf := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cf()
+	rctx, rcf := context.WithTimeout(ctx, 500*time.Millisecond)
+	_, err = client.dialUDP(rctx, gl.Addr().String(), "127.0.0.1", port)
+	rcf()
+	if err == nil || !strings.Contains(err.Error(), "403") {
+		t.Error("Egress to IP allowed", err)
+	}
+	c, err := client.dialUDP(ctx, gl.Addr().String(), "localhost", port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.Write([]byte("one"))
+	buf := make([]byte, 1500)
+	if n, err := c.Read(buf); err != nil || string(buf[0:n]) != "one" {
+		t.Fatal("Unexpected datagram", string(buf[0:n]), err)
+	}
+
+	if s := h2cStatus(t, hl.Addr().String(), "POST", "http://"+hl.Addr().String()+UDPPath("localhost", port)); s != 401 {
+		t.Error("Plain text CONNECT-UDP without InboundAuth", s)
+	}
+	gw.InboundAuth = func(r *http.Request) error {
+		return nil
+	}
+	if s := h2cStatus(t, hl.Addr().String(), "POST", "http://"+hl.Addr().String()+UDPPath("localhost", port)); s != 403 {
+		t.Error("Plain text CONNECT-UDP egress", s)
+	}
+}
+
+func TestReverseTunnel(t *testing.T) {
+	cert, roots := testCert(t)
+	echoL := echoListener(t)
+	defer echoL.Close()
+	_, echoPort, _ := net.SplitHostPort(echoL.Addr().String())
+
+	gw := New()
+	gw.Cert = cert
+	gw.MeshRoots = roots
+	gw.AcceptReverse = true
+	gl, err := ListenAndServeTCP("127.0.0.1:0", gw.HandleAcceptedHBONE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer gl.Close()
+
+	ctx, cf := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cf()
+
+	instance := New()
+	instance.Cert = testCertID(t, "spiffe://cluster.local/ns/test/sa/fortio-cr", roots)
+	instance.MeshRoots = roots
+	instance.Ports["echo"] = echoL.Addr().String()
+	go instance.ReverseTunnel(ctx, gl.Addr().String(), &Registration{
+		Name: "fortio-cr", InstanceID: "inst-1", Labels: map[string]string{"app": "fortio"}})
+
+	for len(gw.Registrations()) == 0 {
+		if ctx.Err() != nil {
+			t.Fatal("Instance not registered")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if reg := gw.Registrations()[0]; reg.Name != "fortio-cr" || reg.Labels["app"] != "fortio" {
+		t.Error("Unexpected registration", reg)
+	}
+
+	client := New()
+	client.Cert = cert
+	client.MeshRoots = roots
+	for _, host := range []string{"inst-1", "fortio-cr"} {
+		c, err := client.dialHBONE(ctx, gl.Addr().String(), net.JoinHostPort(host, echoPort))
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.Write([]byte("hello"))
+		buf := make([]byte, 5)
+		if _, err := io.ReadFull(c, buf); err != nil || string(buf) != "hello" {
+			t.Fatal("Unexpected echo", host, string(buf), err)
+		}
+		c.Close()
+	}
+
+	// The registration must match the identity, and can't replace an instance registered by a different identity.
+	other := New()
+	other.Cert = testCertID(t, "spiffe://cluster.local/ns/test/sa/other", roots)
+	other.MeshRoots = roots
+	for status, reg := range map[string]*Registration{
+		"403": {Name: "fortio-cr", InstanceID: "inst-2"},
+		"409": {Name: "other", InstanceID: "inst-1"},
+	} {
+		rctx, rcf := context.WithTimeout(ctx, 500*time.Millisecond)
+		err := other.serveReverse(rctx, gl.Addr().String(), reg)
+		rcf()
+		if err == nil || !strings.Contains(err.Error(), status) {
+			t.Error("Registration accepted", reg.Name, reg.InstanceID, err)
+		}
+	}
+	if regs := gw.Registrations(); len(regs) != 1 || regs[0].Identity != "spiffe://cluster.local/ns/test/sa/fortio-cr" {
+		t.Error("Unexpected registrations", regs)
+	}
+}
+
+func TestWebSocketTunnel(t *testing.T) {
+	echoL := echoListener(t)
+	defer echoL.Close()
+
+	server := New()
+	server.Ports["echo"] = echoL.Addr().String()
+	hl, err := ListenAndServeTCP("127.0.0.1:0", server.HandleAcceptedH2C)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hl.Close()
+
+	client := New()
+	ep := client.NewEndpoint("http://" + hl.Addr().String() + "/_hbone/echo")
+	ep.WebSocket = true
+
+	ctx, cf := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cf()
+	in, inw := io.Pipe()
+	outr, out := io.Pipe()
+	go ep.Proxy(ctx, in, out)
+
+	// Larger than the 16 bit frame length.
+	data := make([]byte, 100000)
+	rand.Read(data)
+	go inw.Write(data)
+	buf := make([]byte, len(data))
+	if _, err := io.ReadFull(outr, buf); err != nil || !bytes.Equal(buf, data) {
+		t.Fatal("Unexpected echo", err)
+	}
+	inw.Close()
+}
@@ -61,6 +61,14 @@ type Endpoint struct {
 	// similar with an egress gateway.
 	H2Gate string
 
+	// HBONEAddr is the address of an ambient HBONE peer (ztunnel, waypoint). If set, URL is the destination ip:port
+	// and the stream uses mTLS and CONNECT.
+	HBONEAddr string
+
+	// WebSocket is set if the endpoint should use a WebSocket tunnel instead of HTTP/2. Set automatically if
+	// a HTTP/2 connection can't be established and WebSocketFallback is enabled.
+	WebSocket bool
+
 	tlsCon net.Conn
 	rt     *http2.ClientConn // http.RoundTripper
 }
@@ -104,6 +112,12 @@ func (hc *Endpoint) Proxy(ctx context.Context, stdin io.Reader, stdout io.WriteC
 	if hc.SNIGate != "" {
 		return hc.sniProxy(ctx, stdin, stdout)
 	}
+	if hc.HBONEAddr != "" {
+		return hc.hboneProxy(ctx, stdin, stdout)
+	}
+	if hc.WebSocket {
+		return hc.wsProxy(ctx, stdin, stdout)
+	}
 
 	t0 := time.Now()
 	// It is usually possible to pass stdin directly to NewRequest.
@@ -157,7 +171,7 @@ func (hc *Endpoint) Proxy(ctx context.Context, stdin io.Reader, stdout io.WriteC
 		host, port, _ := net.SplitHostPort(h)
 
 		if r.URL.Scheme == "http" {
-			d := &net.Dialer{}
+			d := hc.hb.netDialer()
 
 			dialHost := r.URL.Host
 			if port == "" {
@@ -173,10 +187,10 @@ func (hc *Endpoint) Proxy(ctx context.Context, stdin io.Reader, stdout io.WriteC
 		} else {
 		// Expect system certificates.
 			d := tls.Dialer{
-				Config: &tls.Config{
+				Config: TLSConfig(&tls.Config{
 					NextProtos: []string{"h2"},
-				},
-				NetDialer: &net.Dialer{},
+				}),
+				NetDialer: hc.hb.netDialer(),
 			}
 			dialHost := r.URL.Host
 			if port == "" {
@@ -187,7 +201,7 @@ func (hc *Endpoint) Proxy(ctx context.Context, stdin io.Reader, stdout io.WriteC
 			}
 			nConn, err := d.DialContext(ctx, "tcp", dialHost)
 			if err != nil {
-				return err
+				return hc.wsFallback(ctx, stdin, stdout, err)
 			}
 			tlsCon := nConn.(*tls.Conn)
 
@@ -198,7 +212,8 @@ func (hc *Endpoint) Proxy(ctx context.Context, stdin io.Reader, stdout io.WriteC
 			}
 			if tlsCon.ConnectionState().NegotiatedProtocol != "h2" {
 				log.Println("Failed to negotiate h2", tlsCon.ConnectionState().NegotiatedProtocol)
-				return errors.New("invalid ALPN protocol")
+				tlsCon.Close()
+				return hc.wsFallback(ctx, stdin, stdout, errors.New("invalid ALPN protocol"))
 			}
 
 			hc.tlsCon = tlsCon
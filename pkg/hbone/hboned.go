@@ -15,8 +15,10 @@
 package hbone
 
 import (
+	"bufio"
 	"context"
 	"crypto/tls"
+	"crypto/x509"
 	"io"
 	"log"
 	"net"
@@ -30,6 +32,12 @@ import (
 	"golang.org/x/net/http2"
 )
 
+// HealthPath is checked with Health, on the H2C and HTTP/1.1 port.
+const HealthPath = "/_krun/healthz"
+
+// AppProbePrefix is the prefix of the rewritten app probes, checked with AppProbe.
+const AppProbePrefix = "/app-health/"
+
 // HBone represents a node using a HTTP/2 or HTTP/3 based overlay network environment.
 //
 // Each HBone node has a Istio (spiffee) certificate.
@@ -58,12 +66,15 @@ type HBone struct {
 
 	// Ports is the equivalent of container ports in k8s.
 	// Name follows the same conventions as Istio and should match the port name in the Service.
-	// Port "*" means 'any' port - if set, allows connections to any port by number.
+	// HBONE streams are only forwarded to the declared ports - there is no wildcard.
 	// Currently this is loaded from env variables named PORT_name=value, with the default PORT_http=8080
-	// TODO: refine the 'wildcard' to indicate http1/2 protocol
 	// TODO: this can be populated from a WorkloadGroup object, loaded from XDS or mesh env.
 	Ports map[string]string
 
+	// AllowedPeers are the SPIFFE ID prefixes of mTLS peers allowed to open streams to the local ports. If empty,
+	// peers in the trust domain of Cert are allowed.
+	AllowedPeers []string
+
 	TokenCallback func(ctx context.Context, host string) (string, error)
 	Mux           http.ServeMux
 
@@ -72,9 +83,62 @@ type HBone struct {
 
 	EndpointResolver func(sni string) *Endpoint
 
+	// MeshRoots are used to verify peer certificates for mTLS HBONE (ambient mode).
+	MeshRoots *x509.CertPool
+
+	// HBONEResolver returns the endpoint for a CONNECT authority that is not a local port (gateway mode).
+	HBONEResolver func(authority string) *Endpoint
+
+	// AcceptReverse allows CloudRun instances to register reverse tunnels (east-west gateway).
+	AcceptReverse bool
+
+	// ReverseAuth authorizes a reverse tunnel registration, with the Identity of the mTLS peer set. If nil, the
+	// service account in the identity must match the workload name.
+	ReverseAuth func(reg *Registration) error
+
+	// Reverse holds the instances connected with a reverse tunnel, keyed by instance ID.
+	Reverse map[string]*Registration
+
+	// WebSocketFallback enables WebSocket tunnels if HTTP/2 to the endpoint fails - for example with proxies
+	// that only allow HTTP/1.1. Enabled by default.
+	WebSocketFallback bool
+
+	// UDPEgress allows CONNECT-UDP from mTLS mesh clients to mesh services - hostnames in MeshDomain (gateway mode).
+	UDPEgress bool
+
+	// MeshDomain is the DNS suffix of mesh services, default "svc.cluster.local".
+	MeshDomain string
+
+	// InboundAuth, if set, authenticates requests that are not protected by mTLS - regular requests, CONNECT,
+	// CONNECT-UDP and tunnels to plain text ports. It may add identity headers to the request. Requests are
+	// rejected if it returns an error. CONNECT and CONNECT-UDP on the serving port are rejected if it is not set.
+	InboundAuth func(r *http.Request) error
+
+	// Health, if set, is checked by requests for HealthPath - used as a Cloud Run liveness probe.
+	Health func() error
+
+	// AppProbe, if set, handles requests for AppProbePrefix without authentication, returning the status code.
+	// Used to forward the platform probes to the app, like the rewritten probes in the injected sidecar.
+	AppProbe func(ctx context.Context, path string) int
+
+	// RateLimit, if set, limits the regular requests - rejected requests get a 429.
+	RateLimit *RateLimiter
+
+	// Mirror, if set, sends a copy of a percentage of the regular requests to a secondary destination.
+	Mirror *Mirror
+
+	// keepAlive holds the probe settings for long-lived connections, see SetKeepAlive.
+	keepAlive KeepAlive
+
 	m           sync.RWMutex
 	H2RConn     map[*http2.ClientConn]string
 	H2RCallback func(string, *http2.ClientConn)
+
+	// hbonePool holds mTLS HBONE connections, keyed by the address of the ztunnel or ambient krun.
+	hbonePool map[string]*http2.ClientConn
+
+	// hboneDials are the pooled connections being created.
+	hboneDials map[string]*pendingDial
 }
 
 // New creates a new HBone node. It requires a workload identity, including mTLS certificates.
@@ -91,6 +155,8 @@ func New() *HBone {
 		Endpoints: map[string]*Endpoint{},
 		H2R:       map[string]http.RoundTripper{},
 		H2RConn:   map[*http2.ClientConn]string{},
+		hbonePool: map[string]*http2.ClientConn{},
+		Reverse:   map[string]*Registration{},
 		h2t:       h2,
 		Ports: 		 map[string]string{},
 		//&http2.Transport{
@@ -99,7 +165,9 @@ func New() *HBone {
 		//	AllowHTTP: true,
 		//},
 
-		HTTPClientSystem: http.DefaultClient,
+		HTTPClientSystem:  http.DefaultClient,
+		WebSocketFallback: true,
+		MeshDomain:        "svc.cluster.local",
 	}
 	//hb.h2t.ConnPool = hb
 	hb.h2Server = &http2.Server{}
@@ -120,7 +188,8 @@ type HBoneAcceptedConn struct {
 //
 // Incoming streams for /_hbone/mtls will be treated as a mTLS connection,
 // using the Istio certificates and root. After handling mTLS, the clear text
-// connection will be forwarded to localhost:8080 ( TODO: custom port ).
+// connection is a HTTP/2 connection carrying HBONE CONNECT streams, forwarded
+// to the local ports declared in Ports. Requires Cert and MeshRoots.
 //
 // TODO: setting for app protocol=h2, http, tcp - initial impl uses tcp
 //
@@ -144,24 +213,56 @@ func (hac *HBoneAcceptedConn) ServeHTTP(w http.ResponseWriter, r *http.Request)
 
 	// TODO: parse Envoy / hbone headers.
 
+	if strings.HasPrefix(r.URL.Path, masquePrefix) {
+		// Like plain text CONNECT: InboundAuth is required, and only local ports are reachable.
+		if proxyErr = hac.hb.authorizeStream(r); proxyErr != nil {
+			w.WriteHeader(401)
+			return
+		}
+		hac.hb.serveConnectUDP(w, r)
+		return
+	}
+
+	if r.URL.Path == HealthPath && hac.hb.Health != nil {
+		proxyErr = hac.hb.Health()
+		if proxyErr != nil {
+			http.Error(w, proxyErr.Error(), 503)
+		}
+		return
+	}
+
+	if strings.HasPrefix(r.URL.Path, AppProbePrefix) && hac.hb.AppProbe != nil {
+		w.WriteHeader(hac.hb.AppProbe(r.Context(), r.URL.Path))
+		return
+	}
+
+	if r.Method == "CONNECT" {
+		// Plain text HBONE, forwarded by the CloudRun frontend. There is no peer certificate: InboundAuth is
+		// required, and only local ports are reachable. Mesh clients should use mTLS - /_hbone/mtls or 15008.
+		if proxyErr = hac.hb.authorizeStream(r); proxyErr != nil {
+			w.WriteHeader(401)
+			return
+		}
+		hac.hb.serveHBONE(w, r)
+		return
+	}
+
 	if strings.HasPrefix(r.RequestURI, "/_hbone/") {
 		// Force the headers to be sent.
 		w.(http.Flusher).Flush()
 		portName := r.RequestURI[8:]
-		switch portName {
-		case "15003":
-			// Default mTLS port.
-			proxyErr = hac.hb.HandleTCPProxy(w, r.Body, "127.0.0.1:15003")
-			return
-
-		case "22":
-			// TCP proxy for SSH ( no mTLS, SSH has its own equivalent)
-			proxyErr = hac.hb.HandleTCPProxy(w, r.Body, "127.0.0.1:15022")
+		if portName == "mtls" {
+			// mTLS terminated by krun, with HBONE CONNECT streams inside - no Envoy required.
+			hac.hb.HandleAcceptedHBONE(&HTTPConn{r: r.Body, w: w, acceptedConn: hac.conn})
 			return
 		}
 
-		val := hac.hb.Ports[portName]
+		val := hac.hb.tunnelTarget(portName)
 		if val != "" {
+			if proxyErr = hac.hb.authorizeTunnel(portName, r); proxyErr != nil {
+				w.WriteHeader(401)
+				return
+			}
 			proxyErr = hac.hb.HandleTCPProxy(w, r.Body, val)
 			return
 		}
@@ -171,12 +272,40 @@ func (hac *HBoneAcceptedConn) ServeHTTP(w http.ResponseWriter, r *http.Request)
 
 	// This is not a tunnel, but regular request.
 
+	if hac.hb.RateLimit != nil && !hac.hb.RateLimit.Allow(r) {
+		w.Header().Set("retry-after", "1")
+		http.Error(w, "Too Many Requests", http.StatusTooManyRequests)
+		proxyErr = errRateLimited
+		return
+	}
+
 	// Make sure xfcc header is removed
 	r.Header.Del("x-forwarded-client-cert")
+	if hac.hb.InboundAuth != nil {
+		if proxyErr = hac.hb.InboundAuth(r); proxyErr != nil {
+			http.Error(w, "Unauthorized", 401)
+			return
+		}
+	}
+	if m := hac.hb.Mirror; m != nil && m.sample(r) {
+		m.serve(w, r, hac.hb.rp)
+		return
+	}
 	hac.hb.rp.ServeHTTP(w, r)
 }
 
 func (hb *HBone) HandleAcceptedH2C(conn net.Conn) {
+	// HTTP/1.1 connections are only used for WebSocket tunnels - h2c starts with the "PRI" preface.
+	br := bufio.NewReader(conn)
+	if p, err := br.Peek(3); err != nil || string(p) != "PRI" {
+		if err == nil {
+			hb.handleH1(conn, br)
+		} else {
+			conn.Close()
+		}
+		return
+	}
+	conn = &bufferedConn{Conn: conn, br: br}
 	hc := &HBoneAcceptedConn{hb: hb, conn: conn}
 	hb.h2Server.ServeConn(
 		conn,
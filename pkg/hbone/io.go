@@ -231,10 +231,16 @@ func (hc *HTTPConn) Close() error {
 }
 
 func (hc *HTTPConn) LocalAddr() net.Addr {
+	if hc.acceptedConn == nil {
+		return hboneAddress("")
+	}
 	return hc.acceptedConn.LocalAddr()
 }
 
 func (hc *HTTPConn) RemoteAddr() net.Addr {
+	if hc.acceptedConn == nil {
+		return hboneAddress("")
+	}
 	return hc.acceptedConn.RemoteAddr()
 }
 
@@ -0,0 +1,63 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hbone
+
+import (
+	"math/rand"
+	"net"
+	"time"
+)
+
+// KeepAlive holds the probe settings for long-lived connections - HBONE tunnels, the pooled mTLS connections
+// and reverse tunnels. Cloud Run egress goes through a NAT that drops idle connections without notice: without
+// probes the failure is only detected on the next write, and all instances reconnect at the same time.
+type KeepAlive struct {
+	// TCP is the keepalive period for dialed connections. 0 uses the Go default (15s), negative disables it.
+	TCP time.Duration
+
+	// Ping is the interval without received frames after which a HTTP/2 ping is sent. 0 keeps the default.
+	Ping time.Duration
+
+	// PingTimeout is the time to wait for the ping response before closing the connection. 0 keeps the default.
+	PingTimeout time.Duration
+
+	// Jitter is the maximum random delay added to the reverse tunnel reconnect backoff, spreading the reconnects
+	// when a gateway or NAT drops all tunnels at once.
+	Jitter time.Duration
+}
+
+// SetKeepAlive applies the keepalive settings to the connections created after the call.
+func (hb *HBone) SetKeepAlive(ka KeepAlive) {
+	hb.keepAlive = ka
+	if ka.Ping != 0 {
+		hb.h2t.ReadIdleTimeout = ka.Ping
+	}
+	if ka.PingTimeout != 0 {
+		hb.h2t.PingTimeout = ka.PingTimeout
+	}
+}
+
+// netDialer returns a dialer using the TCP keepalive setting.
+func (hb *HBone) netDialer() *net.Dialer {
+	return &net.Dialer{KeepAlive: hb.keepAlive.TCP}
+}
+
+// reconnectDelay returns the backoff, with the configured jitter added.
+func (hb *HBone) reconnectDelay(backoff time.Duration) time.Duration {
+	if hb.keepAlive.Jitter <= 0 {
+		return backoff
+	}
+	return backoff + time.Duration(rand.Int63n(int64(hb.keepAlive.Jitter)))
+}
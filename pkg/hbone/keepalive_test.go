@@ -0,0 +1,47 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hbone
+
+import (
+	"testing"
+	"time"
+)
+
+func TestKeepAlive(t *testing.T) {
+	hb := New()
+	hb.SetKeepAlive(KeepAlive{TCP: -1, Ping: 30 * time.Second, Jitter: time.Second})
+	if hb.h2t.ReadIdleTimeout != 30*time.Second {
+		t.Error("Ping not applied", hb.h2t.ReadIdleTimeout)
+	}
+	if hb.netDialer().KeepAlive != -1 {
+		t.Error("TCP keepalive not applied")
+	}
+	for i := 0; i < 10; i++ {
+		d := hb.reconnectDelay(2 * time.Second)
+		if d < 2*time.Second || d >= 3*time.Second {
+			t.Error("Unexpected reconnect delay", d)
+		}
+	}
+
+	// Zero values keep the defaults.
+	hb = New()
+	hb.SetKeepAlive(KeepAlive{})
+	if hb.h2t.ReadIdleTimeout != 10*time.Minute {
+		t.Error("Default ping changed", hb.h2t.ReadIdleTimeout)
+	}
+	if hb.reconnectDelay(time.Second) != time.Second {
+		t.Error("Unexpected jitter")
+	}
+}
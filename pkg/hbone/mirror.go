@@ -0,0 +1,211 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hbone
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"hash"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Mirror sends a copy of a percentage of the regular requests to a secondary destination, and compares the
+// responses. Used to validate a migration - for example the GKE version of the service. The mirrored response
+// is discarded, the client only gets the response from the app.
+type Mirror struct {
+	// URL is the base URL of the secondary destination - the request path and query are appended.
+	URL *url.URL
+
+	// Percent of the requests that are mirrored, 0 to 100.
+	Percent float64
+
+	// Methods that are mirrored - default GET and HEAD, to avoid duplicating side effects.
+	Methods []string
+
+	// MaxBody is the largest request body that is mirrored, default 1M.
+	MaxBody int64
+
+	Client *http.Client
+
+	// OnResult is called with the comparison, after both responses are received.
+	OnResult func(*MirrorResult)
+}
+
+// MirrorResult is the comparison of the app and mirror responses. Bodies are compared using a hash, headers are
+// not compared.
+type MirrorResult struct {
+	Method string `json:"method"`
+	Path   string `json:"path"`
+
+	Status       int  `json:"status"`
+	MirrorStatus int  `json:"mirrorStatus,omitempty"`
+	BodyMatch    bool `json:"bodyMatch"`
+
+	Latency       time.Duration `json:"latency"`
+	MirrorLatency time.Duration `json:"mirrorLatency,omitempty"`
+
+	// Error is set if the mirror request failed.
+	Error string `json:"error,omitempty"`
+}
+
+// Match returns true if the mirror returned the same status and body.
+func (mr *MirrorResult) Match() bool {
+	return mr.Error == "" && mr.Status == mr.MirrorStatus && mr.BodyMatch
+}
+
+// NewMirror creates a mirror for the destination URL.
+func NewMirror(dest string, percent float64) (*Mirror, error) {
+	u, err := url.Parse(dest)
+	if err != nil {
+		return nil, err
+	}
+	return &Mirror{
+		URL:     u,
+		Percent: percent,
+		Methods: []string{"GET", "HEAD"},
+		MaxBody: 1 << 20,
+		Client:  &http.Client{Timeout: 30 * time.Second},
+	}, nil
+}
+
+func (m *Mirror) sample(r *http.Request) bool {
+	if m.Percent <= 0 || rand.Float64()*100 >= m.Percent {
+		return false
+	}
+	for _, mt := range m.Methods {
+		if strings.EqualFold(mt, r.Method) {
+			return true
+		}
+	}
+	return false
+}
+
+type mirrorResponse struct {
+	status  int
+	sum     []byte
+	latency time.Duration
+	err     error
+}
+
+// serve forwards the request to next, and a copy to the mirror.
+func (m *Mirror) serve(w http.ResponseWriter, r *http.Request, next http.Handler) {
+	var body []byte
+	if r.Body != nil && r.Body != http.NoBody {
+		b, err := ioutil.ReadAll(io.LimitReader(r.Body, m.MaxBody+1))
+		if err != nil {
+			http.Error(w, "Bad Request", http.StatusBadRequest)
+			return
+		}
+		r.Body = ioutil.NopCloser(io.MultiReader(bytes.NewReader(b), r.Body))
+		if int64(len(b)) > m.MaxBody {
+			next.ServeHTTP(w, r)
+			return
+		}
+		body = b
+	}
+	mreq, err := m.mirrorRequest(r, body)
+	if err != nil {
+		next.ServeHTTP(w, r)
+		return
+	}
+	mch := make(chan *mirrorResponse, 1)
+	go func() {
+		mch <- m.send(mreq)
+	}()
+
+	t0 := time.Now()
+	cw := &captureWriter{ResponseWriter: w, h: sha256.New()}
+	next.ServeHTTP(cw, r)
+	if cw.status == 0 {
+		cw.status = 200
+	}
+	res := &MirrorResult{Method: r.Method, Path: r.URL.Path, Status: cw.status, Latency: time.Since(t0)}
+	sum := cw.h.Sum(nil)
+
+	go func() {
+		mr := <-mch
+		res.MirrorStatus = mr.status
+		res.MirrorLatency = mr.latency
+		if mr.err != nil {
+			res.Error = mr.err.Error()
+		} else {
+			res.BodyMatch = bytes.Equal(sum, mr.sum)
+		}
+		if m.OnResult != nil {
+			m.OnResult(res)
+		}
+	}()
+}
+
+func (m *Mirror) mirrorRequest(r *http.Request, body []byte) (*http.Request, error) {
+	u := *m.URL
+	u.Path = strings.TrimSuffix(u.Path, "/") + r.URL.Path
+	u.RawQuery = r.URL.RawQuery
+	mreq, err := http.NewRequest(r.Method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range r.Header {
+		mreq.Header[k] = v
+	}
+	mreq.Header.Set("x-krun-mirror", "true")
+	return mreq, nil
+}
+
+func (m *Mirror) send(req *http.Request) *mirrorResponse {
+	t0 := time.Now()
+	res, err := m.Client.Do(req)
+	if err != nil {
+		return &mirrorResponse{err: err, latency: time.Since(t0)}
+	}
+	defer res.Body.Close()
+	h := sha256.New()
+	_, err = io.Copy(h, res.Body)
+	return &mirrorResponse{status: res.StatusCode, sum: h.Sum(nil), latency: time.Since(t0), err: err}
+}
+
+// captureWriter records the status and a hash of the body written to the client.
+type captureWriter struct {
+	http.ResponseWriter
+	status int
+	h      hash.Hash
+}
+
+func (c *captureWriter) WriteHeader(status int) {
+	if c.status == 0 {
+		c.status = status
+	}
+	c.ResponseWriter.WriteHeader(status)
+}
+
+func (c *captureWriter) Write(b []byte) (int, error) {
+	if c.status == 0 {
+		c.status = 200
+	}
+	c.h.Write(b)
+	return c.ResponseWriter.Write(b)
+}
+
+func (c *captureWriter) Flush() {
+	if f, ok := c.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
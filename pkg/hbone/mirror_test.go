@@ -0,0 +1,73 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hbone
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestMirror(t *testing.T) {
+	mirrored := make(chan *http.Request, 2)
+	ms := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mirrored <- r
+		if r.URL.Path == "/base/diff" {
+			w.WriteHeader(500)
+		}
+		w.Write([]byte("hello"))
+	}))
+	defer ms.Close()
+
+	m, err := NewMirror(ms.URL+"/base", 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	results := make(chan *MirrorResult, 2)
+	m.OnResult = func(r *MirrorResult) {
+		results <- r
+	}
+	app := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello"))
+	})
+
+	for path, match := range map[string]bool{"/same": true, "/diff": false} {
+		r := httptest.NewRequest("GET", path+"?q=1", nil)
+		if !m.sample(r) {
+			t.Fatal("Expecting GET to be sampled")
+		}
+		w := httptest.NewRecorder()
+		m.serve(w, r, app)
+		if w.Body.String() != "hello" {
+			t.Error("Unexpected app response", w.Body.String())
+		}
+		select {
+		case res := <-results:
+			if res.Match() != match || res.Status != 200 {
+				t.Error("Unexpected result", path, res)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Timeout waiting for the mirror")
+		}
+		mr := <-mirrored
+		if mr.URL.Path != "/base"+path || mr.URL.RawQuery != "q=1" || mr.Header.Get("x-krun-mirror") != "true" {
+			t.Error("Unexpected mirrored request", mr.URL, mr.Header)
+		}
+	}
+	if m.sample(httptest.NewRequest("POST", "/", nil)) {
+		t.Error("POST should not be mirrored by default")
+	}
+}
@@ -0,0 +1,113 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hbone
+
+import (
+	"container/list"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RateLimiter is a token bucket limiter for the requests received on the serving port, protecting the app from
+// retry storms. With PerClient, each client IP has its own bucket - the last X-Forwarded-For address, appended by
+// the CloudRun frontend, or the remote address. Earlier entries are set by the client and can't be trusted.
+//
+// At most maxRateLimitClients buckets are kept - the least recently used bucket is dropped when a new client
+// arrives.
+type RateLimiter struct {
+	// RPS is the sustained rate, Burst the bucket size.
+	RPS       float64
+	Burst     int
+	PerClient bool
+
+	m       sync.Mutex
+	buckets map[string]*list.Element
+
+	// lru holds the buckets, most recently used first.
+	lru *list.List
+}
+
+type tokenBucket struct {
+	key    string
+	tokens float64
+	last   time.Time
+}
+
+var errRateLimited = errors.New("rate limited")
+
+// maxRateLimitClients is the number of client buckets kept.
+const maxRateLimitClients = 10000
+
+// NewRateLimiter creates a limiter. Burst defaults to the RPS, rounded up.
+func NewRateLimiter(rps float64, burst int, perClient bool) *RateLimiter {
+	if burst <= 0 {
+		burst = int(rps)
+		if float64(burst) < rps {
+			burst++
+		}
+	}
+	return &RateLimiter{RPS: rps, Burst: burst, PerClient: perClient, buckets: map[string]*list.Element{},
+		lru: list.New()}
+}
+
+// Allow returns true if the request is within the limit, consuming a token.
+func (rl *RateLimiter) Allow(r *http.Request) bool {
+	key := ""
+	if rl.PerClient {
+		key = clientIP(r)
+	}
+	now := time.Now()
+	rl.m.Lock()
+	defer rl.m.Unlock()
+	var b *tokenBucket
+	if e := rl.buckets[key]; e != nil {
+		rl.lru.MoveToFront(e)
+		b = e.Value.(*tokenBucket)
+	} else {
+		if rl.lru.Len() >= maxRateLimitClients {
+			old := rl.lru.Back()
+			rl.lru.Remove(old)
+			delete(rl.buckets, old.Value.(*tokenBucket).key)
+		}
+		b = &tokenBucket{key: key, tokens: float64(rl.Burst), last: now}
+		rl.buckets[key] = rl.lru.PushFront(b)
+	}
+	b.tokens += now.Sub(b.last).Seconds() * rl.RPS
+	if b.tokens > float64(rl.Burst) {
+		b.tokens = float64(rl.Burst)
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+func clientIP(r *http.Request) string {
+	if xff := r.Header.Get("x-forwarded-for"); xff != "" {
+		hops := strings.Split(xff, ",")
+		return strings.TrimSpace(hops[len(hops)-1])
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
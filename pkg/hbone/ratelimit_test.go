@@ -0,0 +1,65 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hbone
+
+import (
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+func TestRateLimiter(t *testing.T) {
+	rl := NewRateLimiter(0.5, 0, true)
+	if rl.Burst != 1 {
+		t.Error("Unexpected default burst", rl.Burst)
+	}
+	r1 := httptest.NewRequest("GET", "/", nil)
+	r1.Header.Set("x-forwarded-for", "1.2.3.4, 10.0.0.1")
+	r2 := httptest.NewRequest("GET", "/", nil)
+	if !rl.Allow(r1) || !rl.Allow(r2) {
+		t.Error("First request per client should be allowed")
+	}
+	if rl.Allow(r1) {
+		t.Error("Burst exceeded, expecting rejection")
+	}
+	// The client can't pick its bucket - only the last hop, added by the frontend, is used.
+	r1.Header.Set("x-forwarded-for", "5.6.7.8, 10.0.0.1")
+	if rl.Allow(r1) {
+		t.Error("Spoofed X-Forwarded-For should use the same bucket")
+	}
+
+	// The number of buckets is capped, the least recently used is dropped.
+	for i := 0; i < maxRateLimitClients+10; i++ {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("x-forwarded-for", "10.1."+strconv.Itoa(i/256)+"."+strconv.Itoa(i%256))
+		rl.Allow(r)
+	}
+	if len(rl.buckets) != maxRateLimitClients || rl.lru.Len() != maxRateLimitClients {
+		t.Error("Unexpected buckets", len(rl.buckets), rl.lru.Len())
+	}
+	if _, f := rl.buckets["10.0.0.1"]; f {
+		t.Error("Expecting least recently used bucket to be removed")
+	}
+
+	hb := New()
+	hb.RateLimit = NewRateLimiter(1, 1, false)
+	hac := &HBoneAcceptedConn{hb: hb}
+	w := httptest.NewRecorder()
+	hb.RateLimit.Allow(r2)
+	hac.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if w.Code != 429 || w.Header().Get("retry-after") == "" {
+		t.Error("Unexpected response", w.Code)
+	}
+}
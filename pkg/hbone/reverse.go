@@ -0,0 +1,306 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hbone
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+// Reverse tunnels allow a CloudRun instance to receive mesh traffic without accepting connections.
+//
+// The instance dials the east-west gateway using mTLS HBONE, and sends a POST to ReversePath with the registration
+// headers. The stream is then used in reverse: the gateway is the HTTP/2 client, sending CONNECT streams for
+// the instance, and krun serves them like any other HBONE stream - forwarding to the local app ports.
+//
+// Clients in the mesh address a specific instance with the instance ID as host (INSTANCE_ID:port), or any
+// instance of the workload using the workload name.
+//
+// Registrations require an mTLS peer, and are bound to its identity: by default the service account must match the
+// workload name, and an instance ID registered by a different identity can't be taken over.
+
+// ReversePath is the path used to register a reverse tunnel.
+const ReversePath = "/_hbone/reverse"
+
+const (
+	headerName     = "x-hbone-name"
+	headerInstance = "x-hbone-instance"
+	headerLabels   = "x-hbone-labels"
+)
+
+// Registration describes an instance connected using a reverse tunnel.
+type Registration struct {
+	Name       string
+	InstanceID string
+	Labels     map[string]string
+
+	// Identity is the spiffe ID from the mTLS certificate. Set by the gateway.
+	Identity  string
+	Connected time.Time
+
+	cc *http2.ClientConn
+}
+
+// ReverseTunnel keeps a reverse tunnel to the gateway at gwAddr, reconnecting if it is closed. Blocks until
+// ctx is done.
+func (hb *HBone) ReverseTunnel(ctx context.Context, gwAddr string, reg *Registration) {
+	backoff := 1 * time.Second
+	for ctx.Err() == nil {
+		t0 := time.Now()
+		err := hb.serveReverse(ctx, gwAddr, reg)
+		log.Println("hbone-reverse", "gw", gwAddr, "dur", time.Since(t0), "err", err)
+		if time.Since(t0) > time.Minute {
+			backoff = 1 * time.Second
+		}
+		select {
+		case <-ctx.Done():
+		case <-time.After(hb.reconnectDelay(backoff)):
+		}
+		if backoff < 30*time.Second {
+			backoff = backoff * 2
+		}
+	}
+}
+
+// serveReverse registers with the gateway and serves the streams it sends, until the tunnel is closed.
+func (hb *HBone) serveReverse(ctx context.Context, gwAddr string, reg *Registration) error {
+	h := http.Header{}
+	h.Set(headerName, reg.Name)
+	h.Set(headerInstance, reg.InstanceID)
+	if len(reg.Labels) > 0 {
+		h.Set(headerLabels, encodeLabels(reg.Labels))
+	}
+	res, o, err := hb.openStream(ctx, gwAddr, "POST", "https://"+gwAddr+ReversePath, h)
+	if err != nil {
+		return err
+	}
+	log.Println("hbone-reverse", "registered", gwAddr, "instance", reg.InstanceID)
+	conn := &hboneConn{r: res.Body, w: o, local: hboneAddress(reg.InstanceID), remote: hboneAddress(gwAddr)}
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-stop:
+		}
+	}()
+	// The gateway was verified using the mesh roots when dialing - it authenticates the clients it forwards.
+	hb.h2Server.ServeConn(conn, &http2.ServeConnOpts{
+		Handler: http.HandlerFunc(hb.serveHBONE),
+		Context: context.WithValue(ctx, peerKey{}, reversePeer+gwAddr),
+	})
+	conn.Close()
+	return ctx.Err()
+}
+
+// acceptReverse handles a registration on the gateway. The handler blocks while the tunnel is connected.
+func (hb *HBone) acceptReverse(w http.ResponseWriter, r *http.Request) {
+	reg := &Registration{
+		Name:       r.Header.Get(headerName),
+		InstanceID: r.Header.Get(headerInstance),
+		Labels:     decodeLabels(r.Header.Get(headerLabels)),
+		Connected:  time.Now(),
+	}
+	if id := peerIdentity(r); strings.HasPrefix(id, "spiffe://") {
+		reg.Identity = id
+	}
+	if !hb.AcceptReverse || reg.InstanceID == "" || reg.Name == "" {
+		w.WriteHeader(403)
+		return
+	}
+	if err := hb.authorizeReverse(reg); err != nil {
+		log.Println("hbone-reverse", "rejected", reg.InstanceID, "name", reg.Name, "id", reg.Identity, "err", err)
+		w.WriteHeader(403)
+		return
+	}
+	hb.m.RLock()
+	old := hb.Reverse[reg.InstanceID]
+	hb.m.RUnlock()
+	if old != nil && old.Identity != reg.Identity {
+		log.Println("hbone-reverse", "rejected", reg.InstanceID, "id", reg.Identity, "registered", old.Identity)
+		w.WriteHeader(409)
+		return
+	}
+	w.WriteHeader(200)
+	w.(http.Flusher).Flush()
+
+	tw := &tunnelWriter{w: w}
+	defer tw.CloseWrite()
+	cc, err := hb.h2t.NewClientConn(&HTTPConn{r: r.Body, w: tw})
+	if err != nil {
+		log.Println("hbone-reverse: failed to start client", reg.InstanceID, err)
+		return
+	}
+	reg.cc = cc
+
+	hb.m.Lock()
+	old = hb.Reverse[reg.InstanceID]
+	if old != nil && old.Identity != reg.Identity {
+		// Registered by a different identity since the check.
+		hb.m.Unlock()
+		cc.Close()
+		return
+	}
+	hb.Reverse[reg.InstanceID] = reg
+	hb.H2RConn[cc] = reg.InstanceID
+	hb.m.Unlock()
+	if old != nil {
+		// Reconnect of the same instance - the old tunnel is stale.
+		old.cc.Close()
+	}
+	if hb.H2RCallback != nil {
+		hb.H2RCallback(reg.InstanceID, cc)
+	}
+	log.Println("hbone-reverse", "connected", reg.InstanceID, "name", reg.Name, "id", reg.Identity, "labels", reg.Labels)
+
+	<-r.Context().Done()
+
+	hb.m.Lock()
+	if hb.Reverse[reg.InstanceID] == reg {
+		delete(hb.Reverse, reg.InstanceID)
+	}
+	delete(hb.H2RConn, cc)
+	hb.m.Unlock()
+	cc.Close()
+	log.Println("hbone-reverse", "disconnected", reg.InstanceID, "dur", time.Since(reg.Connected))
+}
+
+// authorizeReverse checks that the mTLS peer is allowed to register as reg.
+func (hb *HBone) authorizeReverse(reg *Registration) error {
+	if reg.Identity == "" {
+		return errMTLSRequired
+	}
+	if hb.ReverseAuth != nil {
+		return hb.ReverseAuth(reg)
+	}
+	if spiffeSA(reg.Identity) != reg.Name {
+		return errors.New("identity doesn't match workload " + reg.Name)
+	}
+	return nil
+}
+
+// spiffeSA returns the service account from a spiffe://TRUST_DOMAIN/ns/NAMESPACE/sa/SA identity.
+func spiffeSA(id string) string {
+	i := strings.LastIndex(id, "/sa/")
+	if i < 0 {
+		return ""
+	}
+	return id[i+4:]
+}
+
+// tunnelWriter wraps the response of a reverse tunnel. The HTTP/2 client may attempt to write after the handler
+// returned (for example stream resets when closing) - which is not allowed for a ResponseWriter.
+type tunnelWriter struct {
+	m      sync.Mutex
+	w      http.ResponseWriter
+	closed bool
+}
+
+func (tw *tunnelWriter) Write(b []byte) (int, error) {
+	tw.m.Lock()
+	defer tw.m.Unlock()
+	if tw.closed {
+		return 0, io.ErrClosedPipe
+	}
+	n, err := tw.w.Write(b)
+	tw.w.(http.Flusher).Flush()
+	return n, err
+}
+
+func (tw *tunnelWriter) CloseWrite() error {
+	tw.m.Lock()
+	tw.closed = true
+	tw.m.Unlock()
+	return nil
+}
+
+// reverseRoute returns the reverse tunnel for a CONNECT authority - using the instance ID or workload name.
+func (hb *HBone) reverseRoute(authority string) *Registration {
+	host := authority
+	if i := strings.LastIndex(authority, ":"); i > 0 {
+		host = authority[0:i]
+	}
+	hb.m.RLock()
+	defer hb.m.RUnlock()
+	if reg := hb.Reverse[host]; reg != nil {
+		return reg
+	}
+	var res *Registration
+	for _, reg := range hb.Reverse {
+		if reg.Name == host && (res == nil || reg.Connected.After(res.Connected)) {
+			res = reg
+		}
+	}
+	return res
+}
+
+// forwardReverse sends a CONNECT stream to an instance over its reverse tunnel.
+func (hb *HBone) forwardReverse(w http.ResponseWriter, r *http.Request, reg *Registration) error {
+	h := http.Header{}
+	h.Set(headerPeer, peerIdentity(r))
+	res, o, err := roundTripStream(r.Context(), reg.cc, "CONNECT", "https://"+r.Host, h)
+	if err != nil {
+		if res != nil {
+			w.WriteHeader(res.StatusCode)
+		} else {
+			w.WriteHeader(503)
+		}
+		return err
+	}
+	w.WriteHeader(200)
+	w.(http.Flusher).Flush()
+	return proxy(r.Context(), r.Body, responseCloser{w}, res.Body, o)
+}
+
+// Registrations returns the instances currently connected using reverse tunnels.
+func (hb *HBone) Registrations() []*Registration {
+	hb.m.RLock()
+	defer hb.m.RUnlock()
+	res := []*Registration{}
+	for _, reg := range hb.Reverse {
+		res = append(res, reg)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].InstanceID < res[j].InstanceID })
+	return res
+}
+
+func encodeLabels(labels map[string]string) string {
+	kv := []string{}
+	for k, v := range labels {
+		kv = append(kv, k+"="+v)
+	}
+	sort.Strings(kv)
+	return strings.Join(kv, ",")
+}
+
+func decodeLabels(s string) map[string]string {
+	res := map[string]string{}
+	for _, kv := range strings.Split(s, ",") {
+		if i := strings.Index(kv, "="); i > 0 {
+			res[kv[0:i]] = kv[i+1:]
+		}
+	}
+	return res
+}
@@ -42,7 +42,7 @@ func (hc *Endpoint) sniProxy(ctx context.Context, stdin io.Reader, stdout io.Wri
 	}
 
 	// Using the low-level interface, to keep control over TLS.
-	conf := &tls.Config{}
+	conf := TLSConfig(&tls.Config{})
 	conf.ServerName = hc.SNI
 
 	defer conn.Close()
@@ -89,6 +89,18 @@ func (hb *HBone) HandleSNIConn(conn net.Conn) {
 	}
 }
 
+// SNIAuthority converts an Istio SNI to the host:port of the destination service.
+//
+// Istio uses outbound_.PORT_.SUBSET_.HOST, for example outbound_.9090_._.prometheus.mon.svc.cluster.local
+// Other names are returned unchanged, with the default port.
+func SNIAuthority(sni string, defPort string) string {
+	parts := strings.SplitN(sni, ".", 4)
+	if len(parts) == 4 && parts[0] == "outbound_" && strings.HasSuffix(parts[1], "_") {
+		return net.JoinHostPort(parts[3], strings.TrimSuffix(parts[1], "_"))
+	}
+	return net.JoinHostPort(sni, defPort)
+}
+
 var sniErr = errors.New("Invalid TLS")
 
 type ClientHelloMsg struct { // 22
@@ -148,7 +160,7 @@ func ParseTLS(acc *BufferReader) (string, error) {
 	clientHello := buf[5:end]
 	chLen := end - 5
 
-	if chLen < 38 {
+	if chLen < 39 {
 		log.Println("chLen ", chLen)
 		return "", sniErr
 	}
@@ -165,6 +177,9 @@ func ParseTLS(acc *BufferReader) (string, error) {
 	}
 	m.sessionId = clientHello[39 : 39+sessionIdLen]
 	off = 39 + sessionIdLen
+	if off+2 > chLen {
+		return "", sniErr
+	}
 
 	// cipherSuiteLen is the number of bytes of cipher suite numbers. Since
 	// they are uint16s, the number must be even.
@@ -200,12 +215,16 @@ func ParseTLS(acc *BufferReader) (string, error) {
 		return "", sniErr
 	}
 
+	// All lengths are untrusted - each read is checked against chLen.
 	for off < chLen {
+		if off+4 > chLen {
+			return "", sniErr
+		}
 		extension := uint16(clientHello[off])<<8 | uint16(clientHello[off+1])
 		off += 2
 		length := int(clientHello[off])<<8 | int(clientHello[off+1])
 		off += 2
-		if off >= end {
+		if off+length > chLen {
 			return "", sniErr
 		}
 
@@ -0,0 +1,78 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hbone
+
+import (
+	"bytes"
+	"crypto/tls"
+	"io"
+	"net"
+	"testing"
+)
+
+// clientHello returns the first record sent by a TLS client for the server name.
+func clientHello(t *testing.T, sni string) []byte {
+	c, s := net.Pipe()
+	go func() {
+		tls.Client(c, &tls.Config{ServerName: sni}).Handshake()
+		c.Close()
+	}()
+	defer s.Close()
+	hdr := make([]byte, 5)
+	if _, err := io.ReadFull(s, hdr); err != nil {
+		t.Fatal(err)
+	}
+	body := make([]byte, int(hdr[3])<<8|int(hdr[4]))
+	if _, err := io.ReadFull(s, body); err != nil {
+		t.Fatal(err)
+	}
+	return append(hdr, body...)
+}
+
+func parseSNI(rec []byte) (string, error) {
+	return ParseTLS(NewBufferReader(bytes.NewReader(rec)))
+}
+
+func TestParseTLS(t *testing.T) {
+	rec := clientHello(t, "fortio.example.com")
+	if sni, err := parseSNI(rec); err != nil || sni != "fortio.example.com" {
+		t.Fatal("Unexpected SNI", sni, err)
+	}
+
+	// Record with a 1-byte extensions block, past the end of the ClientHello.
+	short := make([]byte, 5+48)
+	copy(short, []byte{0x16, 3, 1, 0, 48, 1, 0, 0, 44, 3, 3})
+	short[5+38] = 0
+	short[5+39], short[5+40] = 0, 2
+	short[5+43] = 1
+	short[5+45], short[5+46] = 0, 1
+	if _, err := parseSNI(short); err == nil {
+		t.Error("Expecting error for truncated extensions")
+	}
+
+	// Truncated records and corrupted lengths must return an error, not panic.
+	for n := 5; n < len(rec); n++ {
+		trunc := append([]byte{}, rec[:n]...)
+		trunc[3], trunc[4] = byte((n-5)>>8), byte(n-5)
+		parseSNI(trunc)
+	}
+	for i := 5; i < len(rec); i++ {
+		for _, v := range []byte{0, 1, 0x7f, 0xff} {
+			m := append([]byte{}, rec...)
+			m[i] = v
+			parseSNI(m)
+		}
+	}
+}
@@ -0,0 +1,71 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hbone
+
+import (
+	"crypto/tls"
+	"net/http"
+)
+
+// FIPS restricts the TLS settings used by krun clients and servers - K8S, STS, CA, HBONE - to a FIPS 140-2
+// approved set: TLS 1.2, ECDHE key exchange with AES-GCM, P-256 and P-384 curves.
+//
+// Set by SetFIPS (MESH_TLS_POLICY=fips), or when building with the boringcrypto toolchain - in which case
+// crypto/tls/fipsonly also restricts all other TLS connections in the binary.
+//
+// TLS 1.3 is not used: Go doesn't allow configuring the 1.3 cipher suites.
+var FIPS bool
+
+var fipsCipherSuites = []uint16{
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+}
+
+var fipsCurves = []tls.CurveID{tls.CurveP256, tls.CurveP384}
+
+// SetFIPS enables the FIPS policy, including for http.DefaultTransport.
+func SetFIPS() {
+	FIPS = true
+	WrapTLSPolicy(http.DefaultTransport)
+}
+
+// TLSConfig applies the policy to c. Returns c, for use in struct literals.
+func TLSConfig(c *tls.Config) *tls.Config {
+	if !FIPS {
+		return c
+	}
+	c.MinVersion = tls.VersionTLS12
+	c.MaxVersion = tls.VersionTLS12
+	c.CipherSuites = fipsCipherSuites
+	c.CurvePreferences = fipsCurves
+	return c
+}
+
+// WrapTLSPolicy applies the policy to the TLS config of a http.Transport - for clients created by other
+// libraries, like the K8S client. Can be used with rest.Config.Wrap.
+func WrapTLSPolicy(rt http.RoundTripper) http.RoundTripper {
+	if !FIPS {
+		return rt
+	}
+	if t, ok := rt.(*http.Transport); ok {
+		if t.TLSClientConfig == nil {
+			t.TLSClientConfig = &tls.Config{}
+		}
+		TLSConfig(t.TLSClientConfig)
+	}
+	return rt
+}
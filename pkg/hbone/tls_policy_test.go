@@ -0,0 +1,47 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hbone
+
+import (
+	"crypto/tls"
+	"net/http"
+	"testing"
+)
+
+func TestTLSPolicy(t *testing.T) {
+	c := TLSConfig(&tls.Config{})
+	if c.MaxVersion != 0 || c.CipherSuites != nil {
+		t.Error("Default policy should not change the config", c)
+	}
+
+	FIPS = true
+	defer func() { FIPS = false }()
+
+	c = TLSConfig(&tls.Config{ServerName: "example.com"})
+	if c.MinVersion != tls.VersionTLS12 || c.MaxVersion != tls.VersionTLS12 || len(c.CipherSuites) != 4 ||
+		c.ServerName != "example.com" {
+		t.Error("Unexpected FIPS config", c)
+	}
+	for _, cs := range c.CipherSuites {
+		if tls.CipherSuiteName(cs) == "" {
+			t.Error("Unknown cipher suite", cs)
+		}
+	}
+
+	tr := WrapTLSPolicy(&http.Transport{}).(*http.Transport)
+	if tr.TLSClientConfig == nil || tr.TLSClientConfig.MaxVersion != tls.VersionTLS12 {
+		t.Error("Transport not updated", tr.TLSClientConfig)
+	}
+}
@@ -0,0 +1,284 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hbone
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CONNECT-UDP (RFC 9298) proxies UDP datagrams over a HBONE stream, for DNS, syslog or QUIC based apps.
+//
+// The target is encoded in the path, using the default URI template: /.well-known/masque/udp/{host}/{port}/
+// Datagrams are sent as DATAGRAM capsules (RFC 9297) in the request and response body, with context ID 0.
+//
+// The vendored HTTP/2 stack doesn't support extended CONNECT (RFC 8441) - clients use POST with the same path
+// and the Capsule-Protocol header.
+
+const masquePrefix = "/.well-known/masque/udp/"
+
+// Capsule type for HTTP datagrams (RFC 9297).
+const capsuleDatagram = 0
+
+// Max UDP payload - larger capsules are rejected.
+const maxDatagram = 65527
+
+// UDPPath returns the CONNECT-UDP path for a target.
+func UDPPath(host string, port string) string {
+	return masquePrefix + url.PathEscape(host) + "/" + port + "/"
+}
+
+// parseUDPPath returns the target host:port from a CONNECT-UDP path.
+func parseUDPPath(path string) (string, bool) {
+	if !strings.HasPrefix(path, masquePrefix) {
+		return "", false
+	}
+	parts := strings.Split(strings.TrimSuffix(path[len(masquePrefix):], "/"), "/")
+	if len(parts) != 2 || parts[0] == "" {
+		return "", false
+	}
+	host, err := url.PathUnescape(parts[0])
+	if err != nil {
+		return "", false
+	}
+	if p, err := strconv.Atoi(parts[1]); err != nil || p <= 0 || p > 65535 {
+		return "", false
+	}
+	return net.JoinHostPort(host, parts[1]), true
+}
+
+// serveConnectUDP handles a CONNECT-UDP request. Local ports are allowed using the same rules as TCP, mesh
+// services only if UDPEgress is set.
+func (hb *HBone) serveConnectUDP(w http.ResponseWriter, r *http.Request) {
+	t0 := time.Now()
+	target, ok := parseUDPPath(r.URL.Path)
+	if !ok {
+		w.WriteHeader(400)
+		return
+	}
+	dst := hb.udpTarget(r, target)
+	if dst == "" || !hb.peerAllowed(r) {
+		log.Println("CONNECT-UDP: target not allowed", target, "src", peerIdentity(r))
+		w.WriteHeader(403)
+		return
+	}
+	uc, err := net.Dial("udp", dst)
+	if err != nil {
+		w.WriteHeader(502)
+		return
+	}
+	w.Header().Set("Capsule-Protocol", "?1")
+	w.WriteHeader(200)
+	w.(http.Flusher).Flush()
+
+	// Datagrams from the target, until the client closes the stream. The response can't be used after the
+	// handler returns - the handler closes uc and waits for this goroutine.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		buf := make([]byte, maxDatagram)
+		for {
+			n, err := uc.Read(buf)
+			if err != nil {
+				return
+			}
+			if err = writeCapsule(w, buf[0:n]); err != nil {
+				return
+			}
+			w.(http.Flusher).Flush()
+		}
+	}()
+
+	br := bufio.NewReader(r.Body)
+	for {
+		d, err := readCapsule(br)
+		if err != nil {
+			break
+		}
+		if d != nil {
+			uc.Write(d)
+		}
+	}
+	uc.Close()
+	<-done
+	log.Println("hbone-udp", "target", target, "dst", dst, "dur", time.Since(t0))
+}
+
+// udpTarget returns the address to dial for a CONNECT-UDP target, or "" if it is not allowed. Egress is only
+// allowed for clients authenticated with mTLS, and to mesh hostnames - not arbitrary IPs.
+func (hb *HBone) udpTarget(r *http.Request, target string) string {
+	if dst := hb.localTarget(target); dst != "" {
+		return dst
+	}
+	if !hb.UDPEgress || peerIdentity(r) == "" || hb.MeshDomain == "" {
+		return ""
+	}
+	host, _, _ := net.SplitHostPort(target)
+	if host == hb.MeshDomain || strings.HasSuffix(host, "."+hb.MeshDomain) {
+		return target
+	}
+	return ""
+}
+
+// DialUDP returns a datagram connection to podIP:port, proxied by the HBONE server of the pod using CONNECT-UDP.
+// Each Write sends one datagram, each Read returns one datagram.
+func (hb *HBone) DialUDP(ctx context.Context, podIP string, port int) (net.Conn, error) {
+	return hb.dialUDP(ctx, net.JoinHostPort(podIP, HBONEPort), podIP, strconv.Itoa(port))
+}
+
+func (hb *HBone) dialUDP(ctx context.Context, hboneAddr, host, port string) (net.Conn, error) {
+	h := http.Header{}
+	h.Set("Capsule-Protocol", "?1")
+	res, o, err := hb.openStream(ctx, hboneAddr, "POST", "https://"+hboneAddr+UDPPath(host, port), h)
+	if err != nil {
+		return nil, err
+	}
+	uc := &udpConn{
+		hboneConn: hboneConn{r: res.Body, w: o, local: hboneAddress(hboneAddr),
+			remote: hboneAddress(net.JoinHostPort(host, port))},
+	}
+	// Read through the stream conn, to apply the read deadline.
+	uc.br = bufio.NewReader(&uc.hboneConn)
+	return uc, nil
+}
+
+// udpConn wraps a CONNECT-UDP stream, preserving datagram boundaries.
+type udpConn struct {
+	hboneConn
+	br *bufio.Reader
+	wm sync.Mutex
+}
+
+// Read returns the next datagram. If b is smaller than the datagram the rest is discarded, like a UDP socket.
+func (uc *udpConn) Read(b []byte) (int, error) {
+	for {
+		d, err := readCapsule(uc.br)
+		if err != nil {
+			return 0, err
+		}
+		if d != nil {
+			return copy(b, d), nil
+		}
+	}
+}
+
+func (uc *udpConn) Write(b []byte) (int, error) {
+	uc.wm.Lock()
+	defer uc.wm.Unlock()
+	if err := writeCapsule(&uc.hboneConn, b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// writeCapsule writes a DATAGRAM capsule with context ID 0.
+func writeCapsule(w io.Writer, payload []byte) error {
+	if len(payload) > maxDatagram {
+		return errors.New("datagram too large")
+	}
+	b := make([]byte, 0, len(payload)+10)
+	b = appendVarint(b, capsuleDatagram)
+	b = appendVarint(b, uint64(len(payload)+1))
+	b = appendVarint(b, 0)
+	b = append(b, payload...)
+	_, err := w.Write(b)
+	return err
+}
+
+// readCapsule returns the UDP payload of the next capsule. Unknown capsule types and datagrams with a non-zero
+// context ID are skipped, returning a nil payload.
+func readCapsule(br *bufio.Reader) ([]byte, error) {
+	t, err := readVarint(br)
+	if err != nil {
+		return nil, err
+	}
+	l, err := readVarint(br)
+	if err != nil {
+		return nil, err
+	}
+	if l > maxDatagram+8 {
+		return nil, errors.New("capsule too large")
+	}
+	data := make([]byte, l)
+	if _, err = io.ReadFull(br, data); err != nil {
+		return nil, err
+	}
+	if t != capsuleDatagram {
+		return nil, nil
+	}
+	ctxID, n := parseVarint(data)
+	if n <= 0 || ctxID != 0 {
+		return nil, nil
+	}
+	return data[n:], nil
+}
+
+// QUIC variable length integers (RFC 9000 section 16), used by the capsule protocol.
+func appendVarint(b []byte, v uint64) []byte {
+	switch {
+	case v < 1<<6:
+		return append(b, byte(v))
+	case v < 1<<14:
+		return append(b, 0x40|byte(v>>8), byte(v))
+	case v < 1<<30:
+		return append(b, 0x80|byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+	default:
+		return append(b, 0xc0|byte(v>>56), byte(v>>48), byte(v>>40), byte(v>>32),
+			byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+	}
+}
+
+func readVarint(br *bufio.Reader) (uint64, error) {
+	first, err := br.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	l := 1 << (first >> 6)
+	v := uint64(first & 0x3f)
+	for i := 1; i < l; i++ {
+		c, err := br.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		v = v<<8 | uint64(c)
+	}
+	return v, nil
+}
+
+// parseVarint decodes a varint from b, returning the value and the number of bytes used, or 0 if b is too short.
+func parseVarint(b []byte) (uint64, int) {
+	if len(b) == 0 {
+		return 0, 0
+	}
+	l := 1 << (b[0] >> 6)
+	if len(b) < l {
+		return 0, 0
+	}
+	v := uint64(b[0] & 0x3f)
+	for i := 1; i < l; i++ {
+		v = v<<8 | uint64(b[i])
+	}
+	return v, l
+}
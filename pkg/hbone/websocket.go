@@ -0,0 +1,438 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hbone
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// WebSocket tunnels are a fallback for environments where HTTP/2 to the CloudRun frontend is not possible - for
+// example egress through a corporate proxy that only allows HTTP/1.1, or that terminates TLS.
+//
+// The client sends a regular WebSocket upgrade for the same /_hbone/PORT path, honoring HTTPS_PROXY, and each
+// binary message carries part of the tunneled stream. The server side accepts the upgrade on the same port as
+// h2c - the connection preface is used to detect HTTP/1.1.
+
+const wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// WebSocket opcodes (RFC 6455)
+const (
+	wsContinuation = 0
+	wsText         = 1
+	wsBinary       = 2
+	wsClose        = 8
+	wsPing         = 9
+	wsPong         = 10
+)
+
+func wsAccept(key string) string {
+	h := sha1.Sum([]byte(key + wsGUID))
+	return base64.StdEncoding.EncodeToString(h[:])
+}
+
+func isWebSocket(r *http.Request) bool {
+	return strings.EqualFold(r.Header.Get("Upgrade"), "websocket") &&
+		strings.Contains(strings.ToLower(r.Header.Get("Connection")), "upgrade")
+}
+
+// wsConn is a byte stream over WebSocket binary messages. Clients mask the frames they send.
+type wsConn struct {
+	c      io.ReadWriteCloser
+	br     *bufio.Reader
+	client bool
+
+	// Remaining payload in the current frame, and mask for the received frame.
+	rem     uint64
+	mask    [4]byte
+	masked  bool
+	maskPos int
+
+	wm     sync.Mutex
+	closed bool
+}
+
+func newWSConn(c io.ReadWriteCloser, br *bufio.Reader, client bool) *wsConn {
+	return &wsConn{c: c, br: br, client: client}
+}
+
+func (ws *wsConn) Read(b []byte) (int, error) {
+	for ws.rem == 0 {
+		op, err := ws.readHeader()
+		if err != nil {
+			return 0, err
+		}
+		switch op {
+		case wsContinuation, wsText, wsBinary:
+		case wsClose:
+			ws.CloseWrite()
+			return 0, io.EOF
+		default:
+			// Control frames: payload is small, must be consumed. Pings are answered.
+			p := make([]byte, ws.rem)
+			if _, err := io.ReadFull(ws.br, p); err != nil {
+				return 0, err
+			}
+			ws.unmask(p)
+			ws.rem = 0
+			if op == wsPing {
+				ws.writeFrame(wsPong, p)
+			}
+		}
+	}
+	if uint64(len(b)) > ws.rem {
+		b = b[0:ws.rem]
+	}
+	n, err := ws.br.Read(b)
+	ws.unmask(b[0:n])
+	ws.rem -= uint64(n)
+	return n, err
+}
+
+func (ws *wsConn) readHeader() (byte, error) {
+	var h [2]byte
+	if _, err := io.ReadFull(ws.br, h[:]); err != nil {
+		return 0, err
+	}
+	op := h[0] & 0x0f
+	ws.masked = h[1]&0x80 != 0
+	l := uint64(h[1] & 0x7f)
+	switch l {
+	case 126:
+		var e [2]byte
+		if _, err := io.ReadFull(ws.br, e[:]); err != nil {
+			return 0, err
+		}
+		l = uint64(binary.BigEndian.Uint16(e[:]))
+	case 127:
+		var e [8]byte
+		if _, err := io.ReadFull(ws.br, e[:]); err != nil {
+			return 0, err
+		}
+		l = binary.BigEndian.Uint64(e[:])
+	}
+	if ws.masked {
+		if _, err := io.ReadFull(ws.br, ws.mask[:]); err != nil {
+			return 0, err
+		}
+	}
+	ws.rem = l
+	ws.maskPos = 0
+	return op, nil
+}
+
+func (ws *wsConn) unmask(b []byte) {
+	if !ws.masked {
+		return
+	}
+	for i := range b {
+		b[i] ^= ws.mask[ws.maskPos&3]
+		ws.maskPos++
+	}
+}
+
+func (ws *wsConn) Write(b []byte) (int, error) {
+	if err := ws.writeFrame(wsBinary, b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (ws *wsConn) writeFrame(op byte, b []byte) error {
+	ws.wm.Lock()
+	defer ws.wm.Unlock()
+	if ws.closed {
+		return io.ErrClosedPipe
+	}
+	f := make([]byte, 0, len(b)+14)
+	f = append(f, 0x80|op)
+	var mbit byte
+	if ws.client {
+		mbit = 0x80
+	}
+	switch {
+	case len(b) < 126:
+		f = append(f, mbit|byte(len(b)))
+	case len(b) < 1<<16:
+		f = append(f, mbit|126, byte(len(b)>>8), byte(len(b)))
+	default:
+		var e [8]byte
+		binary.BigEndian.PutUint64(e[:], uint64(len(b)))
+		f = append(f, mbit|127)
+		f = append(f, e[:]...)
+	}
+	if ws.client {
+		var m [4]byte
+		rand.Read(m[:])
+		f = append(f, m[:]...)
+		for i, c := range b {
+			f = append(f, c^m[i&3])
+		}
+	} else {
+		f = append(f, b...)
+	}
+	_, err := ws.c.Write(f)
+	if op == wsClose {
+		ws.closed = true
+	}
+	return err
+}
+
+// CloseWrite sends a close message - the peer will see an EOF.
+func (ws *wsConn) CloseWrite() error {
+	return ws.writeFrame(wsClose, nil)
+}
+
+func (ws *wsConn) Close() error {
+	ws.CloseWrite()
+	return ws.c.Close()
+}
+
+// wsFallback switches the endpoint to a WebSocket tunnel after a failure to connect using HTTP/2.
+func (hc *Endpoint) wsFallback(ctx context.Context, stdin io.Reader, stdout io.WriteCloser, err error) error {
+	if !hc.hb.WebSocketFallback || !strings.HasPrefix(hc.URL, "https://") {
+		return err
+	}
+	log.Println("HBONE: h2 connection failed, using WebSocket", hc.URL, err)
+	hc.WebSocket = true
+	return hc.wsProxy(ctx, stdin, stdout)
+}
+
+// tunnelTarget returns the local address for a /_hbone/PORT tunnel, or "" if the port is not allowed.
+func (hb *HBone) tunnelTarget(portName string) string {
+	switch portName {
+	case "15003":
+		// Default mTLS port.
+		return "127.0.0.1:15003"
+	case "22":
+		// TCP proxy for SSH ( no mTLS, SSH has its own equivalent)
+		return "127.0.0.1:15022"
+	}
+	return hb.Ports[portName]
+}
+
+// authorizeTunnel applies InboundAuth to tunnels that are not carrying mTLS. The Envoy port terminates mTLS.
+func (hb *HBone) authorizeTunnel(portName string, r *http.Request) error {
+	if hb.InboundAuth == nil || portName == "15003" {
+		return nil
+	}
+	return hb.InboundAuth(r)
+}
+
+// authorizeStream authenticates plain text CONNECT and CONNECT-UDP streams, which require InboundAuth.
+func (hb *HBone) authorizeStream(r *http.Request) error {
+	if hb.InboundAuth == nil {
+		return errMTLSRequired
+	}
+	return hb.InboundAuth(r)
+}
+
+// bufferedConn is a connection with data already read in a buffer.
+type bufferedConn struct {
+	net.Conn
+	br *bufio.Reader
+}
+
+func (bc *bufferedConn) Read(b []byte) (int, error) {
+	return bc.br.Read(b)
+}
+
+// handleH1 handles a HTTP/1.1 connection on the h2c port. Only WebSocket tunnels are supported.
+func (hb *HBone) handleH1(conn net.Conn, br *bufio.Reader) {
+	defer conn.Close()
+	t0 := time.Now()
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	r, err := http.ReadRequest(br)
+	if err != nil {
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+	if r.URL.Path == HealthPath && hb.Health != nil {
+		if err := hb.Health(); err != nil {
+			conn.Write([]byte("HTTP/1.1 503 Service Unavailable\r\nConnection: close\r\nContent-Length: 0\r\n\r\n"))
+			return
+		}
+		conn.Write([]byte("HTTP/1.1 200 OK\r\nConnection: close\r\nContent-Length: 0\r\n\r\n"))
+		return
+	}
+	if strings.HasPrefix(r.URL.Path, AppProbePrefix) && hb.AppProbe != nil {
+		code := hb.AppProbe(r.Context(), r.URL.Path)
+		conn.Write([]byte(fmt.Sprintf("HTTP/1.1 %d %s\r\nConnection: close\r\nContent-Length: 0\r\n\r\n",
+			code, http.StatusText(code))))
+		return
+	}
+	dst := ""
+	if strings.HasPrefix(r.URL.Path, "/_hbone/") {
+		dst = hb.tunnelTarget(r.URL.Path[8:])
+	}
+	if !isWebSocket(r) || dst == "" {
+		conn.Write([]byte("HTTP/1.1 400 Bad Request\r\nConnection: close\r\nContent-Length: 0\r\n\r\n"))
+		return
+	}
+	if err := hb.authorizeTunnel(r.URL.Path[8:], r); err != nil {
+		conn.Write([]byte("HTTP/1.1 401 Unauthorized\r\nConnection: close\r\nContent-Length: 0\r\n\r\n"))
+		log.Println("hbone-ws", "url", r.URL, "remote", conn.RemoteAddr(), "err", err)
+		return
+	}
+	conn.Write([]byte("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + wsAccept(r.Header.Get("Sec-WebSocket-Key")) + "\r\n\r\n"))
+	ws := newWSConn(conn, br, false)
+	err = hb.HandleTCPProxy(ws, ws, dst)
+	log.Println("hbone-ws", "url", r.URL, "remote", conn.RemoteAddr(), "dst", dst, "dur", time.Since(t0), "err", err)
+}
+
+// wsProxy tunnels the stream using a WebSocket to the endpoint URL, using HTTPS_PROXY if set.
+func (hc *Endpoint) wsProxy(ctx context.Context, stdin io.Reader, stdout io.WriteCloser) error {
+	t0 := time.Now()
+	u, err := url.Parse(hc.URL)
+	if err != nil {
+		return err
+	}
+	conn, err := hc.hb.wsDial(ctx, u)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	key := make([]byte, 16)
+	rand.Read(key)
+	wsKey := base64.StdEncoding.EncodeToString(key)
+	r, _ := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
+	r.Header.Set("Upgrade", "websocket")
+	r.Header.Set("Connection", "Upgrade")
+	r.Header.Set("Sec-WebSocket-Key", wsKey)
+	r.Header.Set("Sec-WebSocket-Version", "13")
+	if hc.hb.TokenCallback != nil {
+		t, err := hc.hb.TokenCallback(ctx, "https://"+u.Hostname())
+		if err != nil {
+			log.Println("Failed to get token, attempt unauthenticated", err)
+		} else {
+			r.Header.Set("Authorization", "Bearer "+t)
+		}
+	}
+	if err = r.Write(conn); err != nil {
+		return err
+	}
+	br := bufio.NewReader(conn)
+	res, err := http.ReadResponse(br, r)
+	if err != nil {
+		return err
+	}
+	if res.StatusCode != 101 || res.Header.Get("Sec-WebSocket-Accept") != wsAccept(wsKey) {
+		return errors.New("WebSocket upgrade failed " + res.Status)
+	}
+	ws := newWSConn(conn, br, true)
+	err = proxy(ctx, stdin, stdout, ws, ws)
+	log.Println("HBoneC-ws-done", "url", u, "dur", time.Since(t0), "err", err)
+	return err
+}
+
+// wsDial opens a TLS connection for HTTP/1.1, tunneling through the proxy from the environment if set.
+func (hb *HBone) wsDial(ctx context.Context, u *url.URL) (net.Conn, error) {
+	addr := u.Host
+	if u.Port() == "" {
+		port := "443"
+		if u.Scheme == "http" {
+			port = "80"
+		}
+		addr = net.JoinHostPort(u.Hostname(), port)
+	}
+	d := hb.netDialer()
+	pr, _ := http.NewRequest("GET", u.String(), nil)
+	proxyURL, err := http.ProxyFromEnvironment(pr)
+	if err != nil {
+		return nil, err
+	}
+	var conn net.Conn
+	if proxyURL != nil {
+		conn, err = proxyConnect(ctx, d, proxyURL, addr)
+	} else {
+		conn, err = d.DialContext(ctx, "tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme == "http" {
+		return conn, nil
+	}
+	tlsCon := tls.Client(conn, TLSConfig(&tls.Config{
+		ServerName: u.Hostname(),
+		NextProtos: []string{"http/1.1"},
+	}))
+	if err := HandshakeTimeout(tlsCon, hb.HandsahakeTimeout, conn); err != nil {
+		return nil, err
+	}
+	return tlsCon, nil
+}
+
+// proxyConnect opens a tunnel to addr using a HTTP CONNECT proxy.
+func proxyConnect(ctx context.Context, d *net.Dialer, proxyURL *url.URL, addr string) (net.Conn, error) {
+	paddr := proxyURL.Host
+	if proxyURL.Port() == "" {
+		paddr = net.JoinHostPort(proxyURL.Hostname(), "3128")
+	}
+	conn, err := d.DialContext(ctx, "tcp", paddr)
+	if err != nil {
+		return nil, err
+	}
+	if proxyURL.Scheme == "https" {
+		tlsCon := tls.Client(conn, TLSConfig(&tls.Config{ServerName: proxyURL.Hostname()}))
+		if err := HandshakeTimeout(tlsCon, 0, conn); err != nil {
+			return nil, err
+		}
+		conn = tlsCon
+	}
+	r := &http.Request{
+		Method: "CONNECT",
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: http.Header{},
+	}
+	if proxyURL.User != nil {
+		p, _ := proxyURL.User.Password()
+		r.Header.Set("Proxy-Authorization", "Basic "+
+			base64.StdEncoding.EncodeToString([]byte(proxyURL.User.Username()+":"+p)))
+	}
+	if err := r.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	// The proxy must not send data before the client - no need to keep the buffered reader.
+	res, err := http.ReadResponse(bufio.NewReaderSize(conn, 1), r)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if res.StatusCode != 200 {
+		conn.Close()
+		return nil, errors.New("proxy CONNECT failed " + res.Status)
+	}
+	return conn, nil
+}
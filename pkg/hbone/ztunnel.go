@@ -0,0 +1,289 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hbone
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+// ZTunnel-compatible HBONE, as used by Istio ambient mesh.
+//
+// Unlike the CloudRun tunnel on 15009 (H2C, TLS terminated by the CloudRun frontend, mTLS to Envoy inside the
+// stream), ambient HBONE is mTLS on the TCP connection (port 15008), using the workload certificates, and
+// HTTP/2 CONNECT streams where the :authority is the destination ip:port.
+//
+// In ambient mode krun acts as the node proxy for the instance - there is no Envoy or L7 processing,
+// streams are forwarded to the app ports on localhost.
+
+// HBONEPort is the port used by ztunnel and waypoints for HBONE.
+const HBONEPort = "15008"
+
+var errMTLSRequired = errors.New("mTLS required")
+
+// peerKey is the context key holding the identity of the peer of an authenticated connection. The h2 server
+// only sets r.TLS for requests with an https scheme - CONNECT requests don't have one.
+type peerKey struct{}
+
+// reversePeer is the peer of streams received over a reverse tunnel. The gateway authenticated the client, and
+// forwards its identity in the headerPeer header.
+const reversePeer = "reverse:"
+
+const headerPeer = "x-hbone-peer"
+
+// peerIdentity returns the SPIFFE ID of the mTLS peer, or "" if the stream is not authenticated with mTLS.
+func peerIdentity(r *http.Request) string {
+	if id, ok := r.Context().Value(peerKey{}).(string); ok {
+		return id
+	}
+	if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+		return spiffeID(r.TLS.PeerCertificates[0])
+	}
+	return ""
+}
+
+// HandleAcceptedHBONE handles a connection accepted on the HBONE port. Requires Cert and MeshRoots to be set.
+func (hb *HBone) HandleAcceptedHBONE(conn net.Conn) {
+	if hb.Cert == nil {
+		log.Println("HBONE: missing workload certificate")
+		conn.Close()
+		return
+	}
+	tlsCon := tls.Server(conn, hb.serverTLSConfig())
+	err := HandshakeTimeout(tlsCon, hb.HandsahakeTimeout, conn)
+	if err != nil {
+		log.Println("HBONE: handshake error", conn.RemoteAddr(), err)
+		return
+	}
+	var id string
+	if cs := tlsCon.ConnectionState(); len(cs.PeerCertificates) > 0 {
+		id = spiffeID(cs.PeerCertificates[0])
+	}
+	ctx := context.WithValue(context.Background(), peerKey{}, id)
+	hb.h2Server.ServeConn(tlsCon, &http2.ServeConnOpts{
+		Handler: http.HandlerFunc(hb.serveHBONE),
+		Context: ctx,
+	})
+}
+
+// serverTLSConfig returns the mTLS config for accepting HBONE connections, requiring a client cert signed by
+// the mesh roots.
+func (hb *HBone) serverTLSConfig() *tls.Config {
+	return TLSConfig(&tls.Config{
+		Certificates: []tls.Certificate{*hb.Cert},
+		ClientAuth:   tls.RequireAnyClientCert,
+		NextProtos:   []string{"h2"},
+		MinVersion:   tls.VersionTLS12,
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			_, err := hb.verifyPeer(rawCerts)
+			return err
+		},
+	})
+}
+
+func (hb *HBone) serveHBONE(w http.ResponseWriter, r *http.Request) {
+	t0 := time.Now()
+	src := peerIdentity(r)
+	if strings.HasPrefix(r.URL.Path, masquePrefix) {
+		hb.serveConnectUDP(w, r)
+		return
+	}
+	if r.URL.Path == ReversePath {
+		hb.acceptReverse(w, r)
+		return
+	}
+	if r.Method != "CONNECT" {
+		w.WriteHeader(405)
+		return
+	}
+	// Relaying to other instances or services is only allowed for mesh clients, authenticated with mTLS.
+	if reg := hb.reverseRoute(r.Host); reg != nil && src != "" {
+		err := hb.forwardReverse(w, r, reg)
+		log.Println("hbone-reverse", "src", src, "authority", r.Host, "instance", reg.InstanceID, "dur", time.Since(t0), "err", err)
+		return
+	}
+	dst := hb.localTarget(r.Host)
+	if dst == "" && src != "" && hb.HBONEResolver != nil {
+		if ep := hb.HBONEResolver(r.Host); ep != nil {
+			w.WriteHeader(200)
+			w.(http.Flusher).Flush()
+			err := ep.Proxy(r.Context(), r.Body, responseCloser{w})
+			log.Println("hbone-gw", "src", src, "authority", r.Host, "dst", ep.URL, "dur", time.Since(t0), "err", err)
+			return
+		}
+	}
+	if dst == "" {
+		log.Println("HBONE: port not allowed", "src", src, "authority", r.Host)
+		w.WriteHeader(403)
+		return
+	}
+	if !hb.peerAllowed(r) {
+		log.Println("HBONE: peer not allowed", "src", src, "peer", r.Header.Get(headerPeer), "authority", r.Host)
+		w.WriteHeader(403)
+		return
+	}
+	w.WriteHeader(200)
+	w.(http.Flusher).Flush()
+	err := hb.HandleTCPProxy(w, r.Body, dst)
+	log.Println("hbone", "src", src, "authority", r.Host, "dst", dst, "dur", time.Since(t0), "err", err)
+}
+
+// responseCloser allows a server response to be used as the output of a proxied stream.
+type responseCloser struct {
+	http.ResponseWriter
+}
+
+func (rc responseCloser) Close() error {
+	return closeWriter(rc.ResponseWriter)
+}
+
+func (rc responseCloser) Flush() {
+	rc.ResponseWriter.(http.Flusher).Flush()
+}
+
+// localTarget maps the CONNECT authority to a local address. Only ports declared in Ports are allowed.
+func (hb *HBone) localTarget(authority string) string {
+	_, port, err := net.SplitHostPort(authority)
+	if err != nil {
+		return ""
+	}
+	for _, v := range hb.Ports {
+		if v == port {
+			return net.JoinHostPort("127.0.0.1", port)
+		}
+		if _, p, err := net.SplitHostPort(v); err == nil && p == port {
+			return v
+		}
+	}
+	return ""
+}
+
+// verifyPeer checks the peer chain against the mesh roots. Mesh certificates only have a spiffe URI SAN,
+// hostname verification does not apply.
+func (hb *HBone) verifyPeer(rawCerts [][]byte) (*x509.Certificate, error) {
+	if hb.MeshRoots == nil {
+		return nil, errors.New("missing mesh roots")
+	}
+	if len(rawCerts) == 0 {
+		return nil, errors.New("missing peer certificate")
+	}
+	chain := []*x509.Certificate{}
+	for _, c := range rawCerts {
+		x, err := x509.ParseCertificate(c)
+		if err != nil {
+			return nil, err
+		}
+		chain = append(chain, x)
+	}
+	inter := x509.NewCertPool()
+	for _, c := range chain[1:] {
+		inter.AddCert(c)
+	}
+	_, err := chain[0].Verify(x509.VerifyOptions{
+		Roots:         hb.MeshRoots,
+		Intermediates: inter,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return chain[0], nil
+}
+
+// peerAllowed authorizes a stream to the local ports. mTLS peers must match AllowedPeers, or be in the same trust
+// domain. Streams without a peer - plain text on the serving port - are authorized by InboundAuth.
+func (hb *HBone) peerAllowed(r *http.Request) bool {
+	id, ok := r.Context().Value(peerKey{}).(string)
+	if !ok {
+		return true
+	}
+	if strings.HasPrefix(id, reversePeer) {
+		id = r.Header.Get(headerPeer)
+	}
+	if id == "" {
+		return false
+	}
+	allowed := hb.AllowedPeers
+	if len(allowed) == 0 {
+		td := hb.trustDomain()
+		if td == "" {
+			return false
+		}
+		allowed = []string{"spiffe://" + td + "/"}
+	}
+	for _, p := range allowed {
+		if strings.HasPrefix(id, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// trustDomain returns the trust domain of the workload certificate.
+func (hb *HBone) trustDomain() string {
+	if hb.Cert == nil || len(hb.Cert.Certificate) == 0 {
+		return ""
+	}
+	leaf := hb.Cert.Leaf
+	if leaf == nil {
+		var err error
+		if leaf, err = x509.ParseCertificate(hb.Cert.Certificate[0]); err != nil {
+			return ""
+		}
+	}
+	for _, u := range leaf.URIs {
+		if u.Scheme == "spiffe" {
+			return u.Host
+		}
+	}
+	return ""
+}
+
+func spiffeID(c *x509.Certificate) string {
+	for _, u := range c.URIs {
+		if u.Scheme == "spiffe" {
+			return u.String()
+		}
+	}
+	return ""
+}
+
+// NewHBONEEndpoint creates a client for dest (ip:port), using a ztunnel, waypoint or ambient krun listening on
+// hboneAddr.
+func (hb *HBone) NewHBONEEndpoint(hboneAddr, dest string) *Endpoint {
+	if !strings.Contains(hboneAddr, ":") {
+		hboneAddr = net.JoinHostPort(hboneAddr, HBONEPort)
+	}
+	return &Endpoint{hb: hb, URL: dest, HBONEAddr: hboneAddr}
+}
+
+func (hc *Endpoint) hboneProxy(ctx context.Context, stdin io.Reader, stdout io.WriteCloser) error {
+	c, err := hc.hb.dialHBONE(ctx, hc.HBONEAddr, hc.URL)
+	if err != nil {
+		return err
+	}
+	hbc := c.(*hboneConn)
+	return proxy(ctx, stdin, stdout, hbc.r, hbc.w)
+}
@@ -16,13 +16,18 @@ package k8s
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"flag"
 	"log"
 	"os"
 	"strings"
+	"time"
 
+	"github.com/GoogleCloudPlatform/cloud-run-mesh/pkg/hbone"
 	"github.com/GoogleCloudPlatform/cloud-run-mesh/pkg/mesh"
 	authenticationv1 "k8s.io/api/authentication/v1"
+	corev1 "k8s.io/api/core/v1"
 	k8serrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
@@ -90,6 +95,7 @@ func (kr *K8S) initUsingKubeConfig() error {
 		if err != nil {
 			return err
 		}
+		config.Wrap(hbone.WrapTLSPolicy)
 		kr.Client, err = kubernetes.NewForConfig(config)
 		if err != nil {
 			return err
@@ -115,6 +121,7 @@ func (kr *K8S) initInCluster() error {
 	if err != nil {
 		return err
 	}
+	config.Wrap(hbone.WrapTLSPolicy)
 	kr.Client, err = kubernetes.NewForConfig(config)
 	if err != nil {
 		return err
@@ -159,8 +166,19 @@ func (kr *K8S) K8SClient(ctx context.Context) error {
 
 // Read with Secrets and ConfigMaps
 
+// errNoClient is returned if no cluster was found - the config can't be loaded.
+var errNoClient = errors.New("k8s client not initialized, missing cluster config")
+
 func (kr *K8S) GetCM(ctx context.Context, ns string, name string) (map[string]string, error) {
-	s, err := kr.Client.CoreV1().ConfigMaps(ns).Get(ctx, name, metav1.GetOptions{})
+	if kr.Client == nil {
+		return nil, errNoClient
+	}
+	var s *corev1.ConfigMap
+	err := kr.Mesh.Retry(ctx, "configmap", func(ctx context.Context) error {
+		var err error
+		s, err = kr.Client.CoreV1().ConfigMaps(ns).Get(ctx, name, metav1.GetOptions{})
+		return permanentK8SError(err)
+	})
 	if err != nil {
 		if Is404(err) {
 			err = nil
@@ -171,7 +189,123 @@ func (kr *K8S) GetCM(ctx context.Context, ns string, name string) (map[string]st
 	return s.Data, nil
 }
 
+// UpdateCM merges the keys into a config map, creating it if it doesn't exist.
+// Keys with empty values are removed.
+func (kr *K8S) UpdateCM(ctx context.Context, ns string, name string, data map[string]string) error {
+	if kr.Client == nil {
+		return errNoClient
+	}
+	cmAPI := kr.Client.CoreV1().ConfigMaps(ns)
+	cm, err := cmAPI.Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		if !Is404(err) {
+			return err
+		}
+		cm = &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      name,
+				Namespace: ns,
+			},
+			Data: map[string]string{},
+		}
+		mergeData(cm.Data, data)
+		_, err = cmAPI.Create(ctx, cm, metav1.CreateOptions{})
+		return err
+	}
+	if cm.Data == nil {
+		cm.Data = map[string]string{}
+	}
+	if !mergeData(cm.Data, data) {
+		return nil
+	}
+	_, err = cmAPI.Update(ctx, cm, metav1.UpdateOptions{})
+	return err
+}
+
+// ApplyResource creates or replaces a namespaced object of any type, for example Istio CRDs that don't have
+// a typed client. api is the group path ("/apis/networking.istio.io/v1beta1"), resource the plural name.
+// If the object has a status, it is also written using the status subresource.
+func (kr *K8S) ApplyResource(ctx context.Context, api, resource, ns, name string, obj map[string]interface{}) error {
+	if kr.Client == nil {
+		return errNoClient
+	}
+	rc := kr.Client.DiscoveryClient.RESTClient()
+	base := api + "/namespaces/" + ns + "/" + resource
+	meta, _ := obj["metadata"].(map[string]interface{})
+	if meta == nil {
+		meta = map[string]interface{}{}
+		obj["metadata"] = meta
+	}
+	meta["name"] = name
+	meta["namespace"] = ns
+
+	data, err := rc.Get().AbsPath(base, name).DoRaw(ctx)
+	if err != nil && !Is404(err) {
+		return err
+	}
+	if err != nil {
+		data, err = rc.Post().AbsPath(base).Body(jsonBody(obj)).DoRaw(ctx)
+	} else {
+		meta["resourceVersion"] = resourceVersion(data)
+		data, err = rc.Put().AbsPath(base, name).Body(jsonBody(obj)).DoRaw(ctx)
+	}
+	if err != nil {
+		return err
+	}
+	if _, f := obj["status"]; !f {
+		return nil
+	}
+	meta["resourceVersion"] = resourceVersion(data)
+	_, err = rc.Put().AbsPath(base, name, "status").Body(jsonBody(obj)).DoRaw(ctx)
+	return err
+}
+
+// DeleteResource deletes an object created with ApplyResource. Missing objects are ignored.
+func (kr *K8S) DeleteResource(ctx context.Context, api, resource, ns, name string) error {
+	if kr.Client == nil {
+		return errNoClient
+	}
+	err := kr.Client.DiscoveryClient.RESTClient().Delete().
+		AbsPath(api, "namespaces", ns, resource, name).Do(ctx).Error()
+	if Is404(err) {
+		return nil
+	}
+	return err
+}
+
+func resourceVersion(data []byte) string {
+	o := &metav1.PartialObjectMetadata{}
+	json.Unmarshal(data, o)
+	return o.ResourceVersion
+}
+
+func jsonBody(obj map[string]interface{}) []byte {
+	data, _ := json.Marshal(obj)
+	return data
+}
+
+func mergeData(dst, src map[string]string) bool {
+	changed := false
+	for k, v := range src {
+		if v == "" {
+			if _, f := dst[k]; f {
+				delete(dst, k)
+				changed = true
+			}
+			continue
+		}
+		if dst[k] != v {
+			dst[k] = v
+			changed = true
+		}
+	}
+	return changed
+}
+
 func (kr *K8S) GetSecret(ctx context.Context, ns string, name string) (map[string][]byte, error) {
+	if kr.Client == nil {
+		return nil, errNoClient
+	}
 	s, err := kr.Client.CoreV1().Secrets(ns).Get(ctx, name, metav1.GetOptions{})
 	if err != nil {
 		if Is404(err) {
@@ -192,16 +326,43 @@ func Is404(err error) bool {
 	return false
 }
 
+// permanentK8SError marks the errors that are not fixed by retrying - missing objects and permissions.
+func permanentK8SError(err error) error {
+	if k8serrors.IsNotFound(err) || k8serrors.IsForbidden(err) || k8serrors.IsUnauthorized(err) ||
+		k8serrors.IsBadRequest(err) || k8serrors.IsInvalid(err) {
+		return mesh.Permanent(err)
+	}
+	return err
+}
+
 // GetToken returns a token with the given audience for the current KSA, using CreateToken request.
 // Used by the STS token exchanger.
 func (kr *K8S) GetToken(ctx context.Context, aud string) (string, error) {
+	return kr.GetTokenTTL(ctx, aud, 0)
+}
+
+// GetTokenTTL returns a token with the given audience and lifetime - 0 for the server default.
+// Used for the bootstrap bundle.
+func (kr *K8S) GetTokenTTL(ctx context.Context, aud string, ttl time.Duration) (string, error) {
+	if kr.Client == nil {
+		return "", errNoClient
+	}
 	treq := &authenticationv1.TokenRequest{
 		Spec: authenticationv1.TokenRequestSpec{
 			Audiences: []string{aud},
 		},
 	}
-	ts, err := kr.Client.CoreV1().ServiceAccounts(kr.Mesh.Namespace).CreateToken(ctx,
-		kr.Mesh.KSA, treq, metav1.CreateOptions{})
+	if ttl > 0 {
+		exp := int64(ttl / time.Second)
+		treq.Spec.ExpirationSeconds = &exp
+	}
+	var ts *authenticationv1.TokenRequest
+	err := kr.Mesh.Retry(ctx, "token", func(ctx context.Context) error {
+		var err error
+		ts, err = kr.Client.CoreV1().ServiceAccounts(kr.Mesh.Namespace).CreateToken(ctx,
+			kr.Mesh.KSA, treq, metav1.CreateOptions{})
+		return permanentK8SError(err)
+	})
 	if err != nil {
 		return "", err
 	}
@@ -0,0 +1,121 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package k8s
+
+import (
+	"context"
+	"time"
+
+	coordinationv1 "k8s.io/api/coordination/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// LeaseLabel marks the leases created by krun for registered instances. The value is the kind of the object
+// owned by the lease.
+const LeaseLabel = "krun.cloud.google.com/lease"
+
+// RenewLease creates or renews a coordination.k8s.io Lease held by holder. Returns the UID of the lease, for use
+// in owner references.
+func (kr *K8S) RenewLease(ctx context.Context, ns, name, holder string, duration time.Duration) (string, error) {
+	if kr.Client == nil {
+		return "", errNoClient
+	}
+	api := kr.Client.CoordinationV1().Leases(ns)
+	now := metav1.NewMicroTime(time.Now())
+	secs := int32(duration / time.Second)
+	l, err := api.Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		if !Is404(err) {
+			return "", err
+		}
+		l = &coordinationv1.Lease{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      name,
+				Namespace: ns,
+				Labels:    map[string]string{LeaseLabel: "workloadentry"},
+			},
+			Spec: coordinationv1.LeaseSpec{
+				HolderIdentity:       &holder,
+				LeaseDurationSeconds: &secs,
+				AcquireTime:          &now,
+				RenewTime:            &now,
+			},
+		}
+		l, err = api.Create(ctx, l, metav1.CreateOptions{})
+		if err != nil {
+			return "", err
+		}
+		return string(l.UID), nil
+	}
+	l.Spec.HolderIdentity = &holder
+	l.Spec.LeaseDurationSeconds = &secs
+	l.Spec.RenewTime = &now
+	l, err = api.Update(ctx, l, metav1.UpdateOptions{})
+	if err != nil {
+		return "", err
+	}
+	return string(l.UID), nil
+}
+
+// DeleteLease removes a lease, missing leases are ignored.
+func (kr *K8S) DeleteLease(ctx context.Context, ns, name string) error {
+	if kr.Client == nil {
+		return errNoClient
+	}
+	err := kr.Client.CoordinationV1().Leases(ns).Delete(ctx, name, metav1.DeleteOptions{})
+	if Is404(err) {
+		return nil
+	}
+	return err
+}
+
+// ExpiredLeases returns the krun leases that were not renewed for their duration plus grace.
+func ExpiredLeases(ctx context.Context, client kubernetes.Interface, grace time.Duration) ([]coordinationv1.Lease, error) {
+	ll, err := client.CoordinationV1().Leases("").List(ctx, metav1.ListOptions{LabelSelector: LeaseLabel})
+	if err != nil {
+		return nil, err
+	}
+	res := []coordinationv1.Lease{}
+	for _, l := range ll.Items {
+		if LeaseExpired(&l, grace, time.Now()) {
+			res = append(res, l)
+		}
+	}
+	return res, nil
+}
+
+// DeleteExpiredLease deletes a lease returned by ExpiredLeases, unless it was renewed or recreated since it was
+// listed - the delete fails with a conflict in that case.
+func DeleteExpiredLease(ctx context.Context, client kubernetes.Interface, l *coordinationv1.Lease) error {
+	uid := l.UID
+	rv := l.ResourceVersion
+	err := client.CoordinationV1().Leases(l.Namespace).Delete(ctx, l.Name, metav1.DeleteOptions{
+		Preconditions: &metav1.Preconditions{UID: &uid, ResourceVersion: &rv},
+	})
+	if Is404(err) {
+		return nil
+	}
+	return err
+}
+
+// LeaseExpired returns true if the lease was not renewed in time.
+func LeaseExpired(l *coordinationv1.Lease, grace time.Duration, now time.Time) bool {
+	if l.Spec.RenewTime == nil || l.Spec.LeaseDurationSeconds == nil {
+		return false
+	}
+	d := time.Duration(*l.Spec.LeaseDurationSeconds) * time.Second
+	return now.After(l.Spec.RenewTime.Add(d + grace))
+}
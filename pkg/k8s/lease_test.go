@@ -0,0 +1,91 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package k8s
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	coordinationv1 "k8s.io/api/coordination/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func testLease(ns, name string, renew time.Time, labeled bool) *coordinationv1.Lease {
+	secs := int32(60)
+	rt := metav1.NewMicroTime(renew)
+	l := &coordinationv1.Lease{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: ns, UID: types.UID("uid-" + name), ResourceVersion: "1"},
+		Spec:       coordinationv1.LeaseSpec{LeaseDurationSeconds: &secs, RenewTime: &rt},
+	}
+	if labeled {
+		l.Labels = map[string]string{LeaseLabel: "workloadentry"}
+	}
+	return l
+}
+
+func TestLeaseExpired(t *testing.T) {
+	now := time.Now()
+	secs := int32(60)
+	for _, tc := range []struct {
+		name    string
+		lease   *coordinationv1.Lease
+		expired bool
+	}{
+		{"renewed", testLease("ns", "a", now.Add(-30*time.Second), true), false},
+		{"in grace", testLease("ns", "a", now.Add(-70*time.Second), true), false},
+		{"expired", testLease("ns", "a", now.Add(-2*time.Minute), true), true},
+		{"no renew time", &coordinationv1.Lease{Spec: coordinationv1.LeaseSpec{LeaseDurationSeconds: &secs}}, false},
+		{"no duration", &coordinationv1.Lease{}, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := LeaseExpired(tc.lease, 20*time.Second, now); got != tc.expired {
+				t.Error("LeaseExpired", got, tc.expired)
+			}
+		})
+	}
+}
+
+func TestExpiredLeases(t *testing.T) {
+	ctx := context.Background()
+	old := time.Now().Add(-time.Hour)
+	client := fake.NewSimpleClientset(
+		testLease("ns1", "expired", old, true),
+		testLease("ns2", "live", time.Now(), true),
+		// Leases not created by krun are never collected.
+		testLease("ns1", "other", old, false),
+	)
+	expired, err := ExpiredLeases(ctx, client, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(expired) != 1 || expired[0].Name != "expired" {
+		t.Fatal("Unexpected expired leases", expired)
+	}
+
+	if err := DeleteExpiredLease(ctx, client, &expired[0]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.CoordinationV1().Leases("ns1").Get(ctx, "expired", metav1.GetOptions{}); !Is404(err) {
+		t.Error("Lease not deleted", err)
+	}
+
+	// Already deleted leases are ignored.
+	if err := DeleteExpiredLease(ctx, client, &expired[0]); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,179 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package k8s
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/kubernetes"
+)
+
+const managedBy = "krun.cloud.google.com"
+
+const managedByLabel = "app.kubernetes.io/managed-by"
+
+// PublishService creates or updates a Service for a workload running outside the cluster.
+//
+// If addrs is set, the Service has no selector and an EndpointSlice with the same name holds the addresses.
+// Otherwise an ExternalName Service is created, using externalName.
+//
+// Existing Services and EndpointSlices are only modified if they were created by krun - a Service with the same
+// name that is not labeled app.kubernetes.io/managed-by: krun.cloud.google.com is an error.
+func (kr *K8S) PublishService(ctx context.Context, ns, name string, ports map[string]int32, addrs []string, externalName string) error {
+	if kr.Client == nil {
+		return errNoClient
+	}
+	return publishService(ctx, kr.Client, ns, name, ports, addrs, externalName)
+}
+
+func publishService(ctx context.Context, client kubernetes.Interface, ns, name string, ports map[string]int32, addrs []string, externalName string) error {
+	labels := map[string]string{managedByLabel: managedBy}
+	svc := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: ns, Labels: labels},
+	}
+	epPorts := []discoveryv1.EndpointPort{}
+	for pn, p := range ports {
+		pn, p := pn, p
+		svc.Spec.Ports = append(svc.Spec.Ports, corev1.ServicePort{
+			Name:       pn,
+			Port:       p,
+			TargetPort: intstr.FromInt(int(p)),
+		})
+		epPorts = append(epPorts, discoveryv1.EndpointPort{Name: &pn, Port: &p})
+	}
+	if len(addrs) == 0 {
+		svc.Spec.Type = corev1.ServiceTypeExternalName
+		svc.Spec.ExternalName = externalName
+	} else {
+		svc.Spec.Type = corev1.ServiceTypeClusterIP
+	}
+	if err := applyService(ctx, client, svc); err != nil {
+		return err
+	}
+	if len(addrs) == 0 {
+		return nil
+	}
+
+	ready := true
+	es := &discoveryv1.EndpointSlice{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: ns,
+			Labels: map[string]string{
+				discoveryv1.LabelServiceName: name,
+				discoveryv1.LabelManagedBy:   managedBy,
+			},
+		},
+		AddressType: discoveryv1.AddressTypeIPv4,
+		Endpoints: []discoveryv1.Endpoint{{
+			Addresses:  addrs,
+			Conditions: discoveryv1.EndpointConditions{Ready: &ready},
+		}},
+		Ports: epPorts,
+	}
+	api := client.DiscoveryV1().EndpointSlices(ns)
+	old, err := api.Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		if !Is404(err) {
+			return err
+		}
+		_, err = api.Create(ctx, es, metav1.CreateOptions{})
+		return err
+	}
+	if old.Labels[discoveryv1.LabelManagedBy] != managedBy {
+		return fmt.Errorf("endpoint slice %s/%s is not managed by krun", ns, name)
+	}
+	if len(old.Endpoints) == 1 && reflect.DeepEqual(old.Endpoints[0].Addresses, addrs) &&
+		sameEndpointPorts(old.Ports, es.Ports) {
+		return nil
+	}
+	old.Endpoints = es.Endpoints
+	old.Ports = es.Ports
+	old.Labels = es.Labels
+	_, err = api.Update(ctx, old, metav1.UpdateOptions{})
+	return err
+}
+
+// applyService creates the Service, or updates it in place if it exists and is managed by krun.
+func applyService(ctx context.Context, client kubernetes.Interface, svc *corev1.Service) error {
+	api := client.CoreV1().Services(svc.Namespace)
+	old, err := api.Get(ctx, svc.Name, metav1.GetOptions{})
+	if err != nil {
+		if !Is404(err) {
+			return err
+		}
+		_, err = api.Create(ctx, svc, metav1.CreateOptions{})
+		return err
+	}
+	if old.Labels[managedByLabel] != managedBy {
+		return fmt.Errorf("service %s/%s is not managed by krun", svc.Namespace, svc.Name)
+	}
+	if old.Spec.Type == svc.Spec.Type && old.Spec.ExternalName == svc.Spec.ExternalName &&
+		sameServicePorts(old.Spec.Ports, svc.Spec.Ports) {
+		return nil
+	}
+	if svc.Spec.Type == corev1.ServiceTypeExternalName {
+		// The allocated cluster IPs must be released when switching to ExternalName.
+		old.Spec.ClusterIP = ""
+		old.Spec.ClusterIPs = nil
+		old.Spec.IPFamilies = nil
+		old.Spec.IPFamilyPolicy = nil
+	}
+	old.Spec.Type = svc.Spec.Type
+	old.Spec.Ports = svc.Spec.Ports
+	old.Spec.ExternalName = svc.Spec.ExternalName
+	_, err = api.Update(ctx, old, metav1.UpdateOptions{})
+	return err
+}
+
+func sameServicePorts(a, b []corev1.ServicePort) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	m := map[string]int32{}
+	for _, p := range a {
+		m[p.Name] = p.Port
+	}
+	for _, p := range b {
+		if v, f := m[p.Name]; !f || v != p.Port {
+			return false
+		}
+	}
+	return true
+}
+
+func sameEndpointPorts(a, b []discoveryv1.EndpointPort) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	m := map[string]int32{}
+	for _, p := range a {
+		if p.Name != nil && p.Port != nil {
+			m[*p.Name] = *p.Port
+		}
+	}
+	for _, p := range b {
+		if v, f := m[*p.Name]; !f || v != *p.Port {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,81 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package k8s
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestPublishService(t *testing.T) {
+	ctx := context.Background()
+	client := fake.NewSimpleClientset(&corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "user", Namespace: "test"},
+		Spec:       corev1.ServiceSpec{Type: corev1.ServiceTypeClusterIP, ClusterIP: "10.0.0.1"},
+	})
+	ports := map[string]int32{"http": 8080}
+
+	// Services not created by krun are not modified.
+	err := publishService(ctx, client, "test", "user", ports, nil, "user.a.run.app")
+	if err == nil || !strings.Contains(err.Error(), "not managed by krun") {
+		t.Error("Expecting error for unmanaged service", err)
+	}
+
+	if err := publishService(ctx, client, "test", "fortio", ports, []string{"10.1.1.1"}, ""); err != nil {
+		t.Fatal(err)
+	}
+	svc, err := client.CoreV1().Services("test").Get(ctx, "fortio", metav1.GetOptions{})
+	if err != nil || svc.Spec.Type != corev1.ServiceTypeClusterIP || svc.Labels[managedByLabel] != managedBy {
+		t.Fatal("Unexpected service", svc, err)
+	}
+	es, err := client.DiscoveryV1().EndpointSlices("test").Get(ctx, "fortio", metav1.GetOptions{})
+	if err != nil || es.Endpoints[0].Addresses[0] != "10.1.1.1" {
+		t.Fatal("Unexpected endpoint slice", es, err)
+	}
+
+	// Switching to ExternalName updates the service in place - it is never deleted.
+	client.ClearActions()
+	svc.Spec.ClusterIP = "10.0.0.2"
+	client.CoreV1().Services("test").Update(ctx, svc, metav1.UpdateOptions{})
+	if err := publishService(ctx, client, "test", "fortio", ports, nil, "fortio.a.run.app"); err != nil {
+		t.Fatal(err)
+	}
+	svc, _ = client.CoreV1().Services("test").Get(ctx, "fortio", metav1.GetOptions{})
+	if svc.Spec.Type != corev1.ServiceTypeExternalName || svc.Spec.ExternalName != "fortio.a.run.app" ||
+		svc.Spec.ClusterIP != "" {
+		t.Error("Unexpected service", svc.Spec)
+	}
+	for _, a := range client.Actions() {
+		if a.GetVerb() == "delete" {
+			t.Error("Unexpected delete", a)
+		}
+	}
+
+	// No change - no update.
+	client.ClearActions()
+	if err := publishService(ctx, client, "test", "fortio", ports, nil, "fortio.a.run.app"); err != nil {
+		t.Fatal(err)
+	}
+	for _, a := range client.Actions() {
+		if a.GetVerb() != "get" {
+			t.Error("Unexpected action", a)
+		}
+	}
+}
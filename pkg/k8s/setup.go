@@ -0,0 +1,284 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package k8s
+
+import (
+	"context"
+	"log"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// NamespaceSetup holds the settings for onboarding a namespace - equivalent with
+// manifests/google-service-account-template.yaml, with the additional permissions of the optional krun features.
+type NamespaceSetup struct {
+	Namespace string
+
+	// KSA is the K8S service account used by the CloudRun service. Default is 'default'.
+	KSA string
+
+	// GSA is the email of the Google service account running the CloudRun service.
+	GSA string
+
+	// Labels to add to the namespace - for example istio.io/rev
+	Labels map[string]string
+
+	// Workloads are the names of the CloudRun services using the namespace. If set, access to the per-workload
+	// config maps (mesh-env-NAME, krun-status-NAME) is limited to these names, otherwise all config maps in the
+	// namespace can be read and updated.
+	Workloads []string
+}
+
+// SetupNamespace creates the namespace and KSA, and grants the GSA permission to get tokens for the KSA and the
+// namespace resources used by krun. Existing objects are updated. Requires admin permissions in the cluster.
+func (kr *K8S) SetupNamespace(ctx context.Context, s *NamespaceSetup) error {
+	if kr.Client == nil {
+		return errNoClient
+	}
+	if s.KSA == "" {
+		s.KSA = "default"
+	}
+	if err := kr.setupNamespace(ctx, s); err != nil {
+		return err
+	}
+	if err := kr.setupKSA(ctx, s); err != nil {
+		return err
+	}
+	if err := setupRBAC(ctx, kr.Client, s); err != nil {
+		return err
+	}
+
+	// The WorkloadGroup is only used with Istio - missing CRDs are not an error.
+	err := kr.ApplyResource(ctx, "/apis/networking.istio.io/v1alpha3", "workloadgroups", s.Namespace,
+		gsaResourceName(s.GSA), map[string]interface{}{
+			"apiVersion": "networking.istio.io/v1alpha3",
+			"kind":       "WorkloadGroup",
+			"spec": map[string]interface{}{
+				"metadata": map[string]interface{}{
+					"labels": map[string]interface{}{
+						"cr-google-service-account": strings.ReplaceAll(s.GSA, "@", "."),
+					},
+					"annotations": map[string]interface{}{
+						"security.cloud.google.com/IdentityProvider": "google",
+					},
+				},
+				"template": map[string]interface{}{
+					"serviceAccount": s.GSA,
+				},
+			},
+		})
+	if err != nil {
+		log.Println("Skipping WorkloadGroup", s.Namespace, err)
+	}
+	return nil
+}
+
+func (kr *K8S) setupNamespace(ctx context.Context, s *NamespaceSetup) error {
+	nsAPI := kr.Client.CoreV1().Namespaces()
+	ns, err := nsAPI.Get(ctx, s.Namespace, metav1.GetOptions{})
+	if Is404(err) {
+		_, err = nsAPI.Create(ctx, &corev1.Namespace{
+			ObjectMeta: metav1.ObjectMeta{Name: s.Namespace, Labels: s.Labels},
+		}, metav1.CreateOptions{})
+		if err == nil {
+			log.Println("Created namespace", s.Namespace)
+		}
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	if ns.Labels == nil {
+		ns.Labels = map[string]string{}
+	}
+	if !mergeData(ns.Labels, s.Labels) {
+		return nil
+	}
+	_, err = nsAPI.Update(ctx, ns, metav1.UpdateOptions{})
+	return err
+}
+
+// setupKSA creates the KSA, with the workload identity annotation binding it to the GSA.
+func (kr *K8S) setupKSA(ctx context.Context, s *NamespaceSetup) error {
+	ann := map[string]string{"iam.gke.io/gcp-service-account": s.GSA}
+	saAPI := kr.Client.CoreV1().ServiceAccounts(s.Namespace)
+	sa, err := saAPI.Get(ctx, s.KSA, metav1.GetOptions{})
+	if Is404(err) {
+		_, err = saAPI.Create(ctx, &corev1.ServiceAccount{
+			ObjectMeta: metav1.ObjectMeta{Name: s.KSA, Namespace: s.Namespace, Annotations: ann},
+		}, metav1.CreateOptions{})
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	if sa.Annotations == nil {
+		sa.Annotations = map[string]string{}
+	}
+	if !mergeData(sa.Annotations, ann) {
+		return nil
+	}
+	_, err = saAPI.Update(ctx, sa, metav1.UpdateOptions{})
+	return err
+}
+
+// setupRBAC grants the GSA the permissions used by krun in the namespace, see roleRules.
+func setupRBAC(ctx context.Context, client kubernetes.Interface, s *NamespaceSetup) error {
+	name := gsaResourceName(s.GSA)
+	role := &rbacv1.Role{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: s.Namespace},
+		Rules:      roleRules(s),
+	}
+	rb := &rbacv1.RoleBinding{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: s.Namespace},
+		RoleRef: rbacv1.RoleRef{
+			APIGroup: "rbac.authorization.k8s.io",
+			Kind:     "Role",
+			Name:     name,
+		},
+		Subjects: []rbacv1.Subject{
+			{Kind: "User", Name: s.GSA},
+		},
+	}
+
+	roleAPI := client.RbacV1().Roles(s.Namespace)
+	old, err := roleAPI.Get(ctx, name, metav1.GetOptions{})
+	if Is404(err) {
+		_, err = roleAPI.Create(ctx, role, metav1.CreateOptions{})
+	} else if err == nil {
+		old.Rules = role.Rules
+		_, err = roleAPI.Update(ctx, old, metav1.UpdateOptions{})
+	}
+	if err != nil {
+		return err
+	}
+
+	rbAPI := client.RbacV1().RoleBindings(s.Namespace)
+	oldRB, err := rbAPI.Get(ctx, name, metav1.GetOptions{})
+	if Is404(err) {
+		_, err = rbAPI.Create(ctx, rb, metav1.CreateOptions{})
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	if oldRB.RoleRef != rb.RoleRef {
+		// RoleRef is immutable
+		if err = rbAPI.Delete(ctx, name, metav1.DeleteOptions{}); err != nil {
+			return err
+		}
+		_, err = rbAPI.Create(ctx, rb, metav1.CreateOptions{})
+		return err
+	}
+	oldRB.Subjects = rb.Subjects
+	_, err = rbAPI.Update(ctx, oldRB, metav1.UpdateOptions{})
+	return err
+}
+
+// roleRules returns the permissions of the workload GSA:
+// - create tokens for the KSA (TokenRequest)
+// - read the namespace mesh-env, the per-workload mesh-env-NAME overrides and the debug secret
+// - write the krun-status-NAME config map
+// - register WorkloadEntries, with the Leases owning them
+// - publish the Service and EndpointSlice for the workload
+// - apply the EnvoyFilter and WasmPlugin resources for the proxy filters
+//
+// K8S can't restrict create by name, and the names of the entries, leases and services are not known in advance -
+// only the reads and updates of the config maps are restricted, if the workload names are known.
+func roleRules(s *NamespaceSetup) []rbacv1.PolicyRule {
+	readCM := []string{"mesh-env"}
+	var writeCM []string
+	for _, w := range s.Workloads {
+		readCM = append(readCM, "mesh-env-"+w, "krun-status-"+w)
+		writeCM = append(writeCM, "krun-status-"+w)
+	}
+	if len(s.Workloads) == 0 {
+		readCM = nil
+	}
+	return []rbacv1.PolicyRule{
+		{
+			APIGroups:     []string{""},
+			Resources:     []string{"serviceaccounts/token"},
+			ResourceNames: []string{s.KSA},
+			Verbs:         []string{"create", "get"},
+		},
+		{
+			APIGroups:     []string{""},
+			Resources:     []string{"configmaps"},
+			ResourceNames: readCM,
+			Verbs:         []string{"get"},
+		},
+		{
+			APIGroups:     []string{""},
+			Resources:     []string{"configmaps"},
+			ResourceNames: writeCM,
+			Verbs:         []string{"update"},
+		},
+		{
+			APIGroups: []string{""},
+			Resources: []string{"configmaps"},
+			Verbs:     []string{"create"},
+		},
+		{
+			APIGroups:     []string{""},
+			Resources:     []string{"secrets"},
+			ResourceNames: []string{"sshdebug"},
+			Verbs:         []string{"get"},
+		},
+		{
+			APIGroups: []string{"networking.istio.io"},
+			Resources: []string{"workloadentries", "workloadentries/status"},
+			Verbs:     []string{"get", "create", "update", "delete"},
+		},
+		{
+			APIGroups: []string{"coordination.k8s.io"},
+			Resources: []string{"leases"},
+			Verbs:     []string{"get", "create", "update", "delete"},
+		},
+		{
+			APIGroups: []string{""},
+			Resources: []string{"services"},
+			Verbs:     []string{"get", "create", "update"},
+		},
+		{
+			APIGroups: []string{"discovery.k8s.io"},
+			Resources: []string{"endpointslices"},
+			Verbs:     []string{"get", "create", "update"},
+		},
+		{
+			APIGroups: []string{"networking.istio.io"},
+			Resources: []string{"envoyfilters"},
+			Verbs:     []string{"get", "create", "update"},
+		},
+		{
+			APIGroups: []string{"extensions.istio.io"},
+			Resources: []string{"wasmplugins"},
+			Verbs:     []string{"get", "create", "update"},
+		},
+	}
+}
+
+// gsaResourceName returns the name of the objects created for a GSA - gsa-PROJECT_ID, as in the manifest template.
+func gsaResourceName(gsa string) string {
+	parts := strings.SplitN(gsa, "@", 2)
+	if len(parts) != 2 {
+		return "gsa-" + parts[0]
+	}
+	return "gsa-" + strings.TrimSuffix(parts[1], ".iam.gserviceaccount.com")
+}
@@ -0,0 +1,134 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package k8s
+
+import (
+	"context"
+	"testing"
+
+	rbacv1 "k8s.io/api/rbac/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// allows returns true if the rules allow the verb on the named resource.
+func allows(rules []rbacv1.PolicyRule, group, resource, name, verb string) bool {
+	for _, r := range rules {
+		if contains(r.APIGroups, group) && contains(r.Resources, resource) && contains(r.Verbs, verb) &&
+			(len(r.ResourceNames) == 0 || contains(r.ResourceNames, name)) {
+			return true
+		}
+	}
+	return false
+}
+
+func contains(l []string, s string) bool {
+	for _, v := range l {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func TestRoleRules(t *testing.T) {
+	s := &NamespaceSetup{Namespace: "fortio", KSA: "default", GSA: "k8s-fortio@p1.iam.gserviceaccount.com",
+		Workloads: []string{"fortio"}}
+	rules := roleRules(s)
+	for _, tc := range []struct {
+		group, resource, name, verb string
+		allowed                     bool
+	}{
+		{"", "serviceaccounts/token", "default", "create", true},
+		{"", "serviceaccounts/token", "other", "create", false},
+		{"", "configmaps", "mesh-env", "get", true},
+		{"", "configmaps", "mesh-env-fortio", "get", true},
+		{"", "configmaps", "mesh-env-other", "get", false},
+		{"", "configmaps", "krun-status-fortio", "update", true},
+		{"", "configmaps", "mesh-env", "update", false},
+		{"", "secrets", "sshdebug", "get", true},
+		{"", "secrets", "other", "get", false},
+		{"networking.istio.io", "workloadentries", "fortio-1234", "create", true},
+		{"networking.istio.io", "workloadentries/status", "fortio-1234", "update", true},
+		{"coordination.k8s.io", "leases", "fortio-1234", "delete", true},
+		{"", "services", "fortio", "update", true},
+		{"discovery.k8s.io", "endpointslices", "fortio", "create", true},
+	} {
+		if got := allows(rules, tc.group, tc.resource, tc.name, tc.verb); got != tc.allowed {
+			t.Error("Unexpected permission", tc.resource, tc.name, tc.verb, got)
+		}
+	}
+
+	// Without workload names the per-workload config maps can't be restricted.
+	rules = roleRules(&NamespaceSetup{Namespace: "fortio", KSA: "default"})
+	if !allows(rules, "", "configmaps", "mesh-env-any", "get") || !allows(rules, "", "configmaps", "krun-status-any", "update") {
+		t.Error("Missing config map permissions", rules)
+	}
+}
+
+func TestSetupRBAC(t *testing.T) {
+	ctx := context.Background()
+	s := &NamespaceSetup{Namespace: "fortio", KSA: "default", GSA: "k8s-fortio@p1.iam.gserviceaccount.com"}
+	name := gsaResourceName(s.GSA)
+	client := fake.NewSimpleClientset()
+
+	// Create.
+	if err := setupRBAC(ctx, client, s); err != nil {
+		t.Fatal(err)
+	}
+	role, err := client.RbacV1().Roles("fortio").Get(ctx, name, metav1.GetOptions{})
+	if err != nil || len(role.Rules) != len(roleRules(s)) {
+		t.Fatal("Unexpected role", role, err)
+	}
+	rb, err := client.RbacV1().RoleBindings("fortio").Get(ctx, name, metav1.GetOptions{})
+	if err != nil || rb.RoleRef.Name != name || rb.Subjects[0].Name != s.GSA {
+		t.Fatal("Unexpected binding", rb, err)
+	}
+
+	// Update - the rules and subjects are replaced.
+	role.Rules = nil
+	client.RbacV1().Roles("fortio").Update(ctx, role, metav1.UpdateOptions{})
+	rb.Subjects = []rbacv1.Subject{{Kind: "User", Name: "old@p1.iam.gserviceaccount.com"}}
+	client.RbacV1().RoleBindings("fortio").Update(ctx, rb, metav1.UpdateOptions{})
+	if err := setupRBAC(ctx, client, s); err != nil {
+		t.Fatal(err)
+	}
+	role, _ = client.RbacV1().Roles("fortio").Get(ctx, name, metav1.GetOptions{})
+	rb, _ = client.RbacV1().RoleBindings("fortio").Get(ctx, name, metav1.GetOptions{})
+	if len(role.Rules) != len(roleRules(s)) || len(rb.Subjects) != 1 || rb.Subjects[0].Name != s.GSA {
+		t.Fatal("Role or binding not updated", role.Rules, rb.Subjects)
+	}
+
+	// RoleRef is immutable - the binding is recreated.
+	rb.RoleRef.Kind = "ClusterRole"
+	client.RbacV1().RoleBindings("fortio").Update(ctx, rb, metav1.UpdateOptions{})
+	client.ClearActions()
+	if err := setupRBAC(ctx, client, s); err != nil {
+		t.Fatal(err)
+	}
+	rb, _ = client.RbacV1().RoleBindings("fortio").Get(ctx, name, metav1.GetOptions{})
+	if rb.RoleRef.Kind != "Role" {
+		t.Error("RoleRef not updated", rb.RoleRef)
+	}
+	deleted := false
+	for _, a := range client.Actions() {
+		if a.GetVerb() == "delete" && a.GetResource().Resource == "rolebindings" {
+			deleted = true
+		}
+	}
+	if !deleted {
+		t.Error("Binding not recreated", client.Actions())
+	}
+}
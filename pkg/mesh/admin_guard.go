@@ -0,0 +1,184 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mesh
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Envoy admin guardrails.
+//
+// The Envoy admin port (15000) is not captured by iptables - any process in the instance, including the app, can
+// use it to stop Envoy (/quitquitquit), fail the health checks or change the runtime config.
+//
+// krun exposes a read-only subset on the debug port, under /debug/envoy/ - clusters, stats, listeners, certs, server
+// info - plus POST /debug/envoy/logging to change log levels. Requests require 'Authorization: Bearer TOKEN', where
+// TOKEN is MESH_ADMIN_TOKEN or a random token saved to MESH_ADMIN_TOKEN_FILE, readable only by root.
+//
+// When running as root, direct connections to 15000 are rejected except for the proxy (uid or gid 1337) and krun.
+// The app usually runs as root too, so krun is not matched by uid: its admin connections use http.DefaultTransport,
+// which is changed to set the 1337 mark on them. An app keeping CAP_NET_ADMIN can set the same mark - or change
+// the rules - see MESH_DROP_CAPS. MESH_ADMIN_LOCKDOWN=false keeps the port open.
+
+var envoyAdminReadPaths = []string{"/clusters", "/stats", "/stats/prometheus", "/listeners", "/certs", "/server_info",
+	"/ready", "/memory"}
+
+var envoyLogLevels = []string{"trace", "debug", "info", "warning", "warn", "error", "critical", "off"}
+
+// adminToken returns the token for the Envoy admin subset, generating and saving one if not configured.
+func (kr *KRun) adminToken() (string, error) {
+	if t := kr.Config("MESH_ADMIN_TOKEN", ""); t != "" {
+		return t, nil
+	}
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	t := hex.EncodeToString(b)
+	f := kr.Config("MESH_ADMIN_TOKEN_FILE", filepath.Join(kr.BaseDir, "/var/run/krun/admin-token"))
+	if err := os.MkdirAll(filepath.Dir(f), 0700); err != nil {
+		return "", err
+	}
+	if err := ioutil.WriteFile(f, []byte(t), 0600); err != nil {
+		return "", err
+	}
+	return t, nil
+}
+
+// envoyAdminProxy returns the handler for /debug/envoy/, forwarding the allowed requests to the admin address.
+func envoyAdminProxy(admin string, token string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !adminAuthorized(r, token) {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		path := strings.TrimPrefix(r.URL.Path, "/debug/envoy")
+		if err := envoyAdminAllowed(r.Method, path, r.URL.Query()); err != nil {
+			log.Println("Envoy admin request denied", "method", r.Method, "path", path, "err", err)
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+		req, _ := http.NewRequestWithContext(r.Context(), r.Method, "http://"+admin+path+"?"+r.URL.RawQuery, nil)
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		defer res.Body.Close()
+		if ct := res.Header.Get("Content-Type"); ct != "" {
+			w.Header().Set("Content-Type", ct)
+		}
+		w.WriteHeader(res.StatusCode)
+		io.Copy(w, res.Body)
+	})
+}
+
+// adminAuthorized checks the bearer token of a debug request.
+func adminAuthorized(r *http.Request, token string) bool {
+	auth := r.Header.Get("Authorization")
+	return strings.HasPrefix(auth, "Bearer ") &&
+		subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(auth, "Bearer ")), []byte(token)) == 1
+}
+
+// envoyAdminAllowed checks a request against the allowed subset: GET for the read-only paths, and POST /logging
+// with valid levels.
+func envoyAdminAllowed(method, path string, q map[string][]string) error {
+	if path == "/logging" {
+		if method != "POST" {
+			return errors.New("logging requires POST")
+		}
+		if len(q) == 0 {
+			return errors.New("missing log level")
+		}
+		for k, v := range q {
+			if k == "paths" {
+				return errors.New("fine grain logging not allowed")
+			}
+			for _, l := range v {
+				if !contains(envoyLogLevels, l) {
+					return errors.New("invalid log level " + l)
+				}
+			}
+		}
+		return nil
+	}
+	if !contains(envoyAdminReadPaths, path) {
+		return errors.New("path not allowed")
+	}
+	if method != "GET" {
+		return errors.New("method not allowed")
+	}
+	return nil
+}
+
+// LockEnvoyAdmin rejects connections to the Envoy admin port from the app. Requires root.
+func (kr *KRun) LockEnvoyAdmin() error {
+	if os.Getuid() != 0 || kr.Config("MESH_ADMIN_LOCKDOWN", "true") != "true" {
+		return nil
+	}
+	markAdminConns()
+	if err := adminLockChain().install(); err != nil {
+		return err
+	}
+	log.Println("Envoy admin port restricted to the proxy")
+	return nil
+}
+
+func adminLockChain() *iptablesChain {
+	return &iptablesChain{
+		Cmd:    "iptables",
+		Table:  "filter",
+		Name:   "KRUN_ADMIN",
+		Parent: "OUTPUT",
+		Match:  []string{"-o", "lo", "-p", "tcp", "--dport", "15000"},
+		Rules: [][]string{
+			{"-m", "mark", "--mark", strconv.Itoa(egressMark), "-j", "RETURN"},
+			{"-m", "owner", "--uid-owner", "1337", "-j", "RETURN"},
+			{"-m", "owner", "--gid-owner", "1337", "-j", "RETURN"},
+			{"-p", "tcp", "-j", "REJECT", "--reject-with", "tcp-reset"},
+		},
+	}
+}
+
+// markAdminConns sets the mark on the connections to the Envoy admin port opened using http.DefaultTransport.
+func markAdminConns() {
+	t, ok := http.DefaultTransport.(*http.Transport)
+	if !ok || t.DialContext == nil {
+		return
+	}
+	dial := t.DialContext
+	marked := markedDialer(egressMark).DialContext
+	t.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if addr == envoyAdmin {
+			return marked(ctx, network, addr)
+		}
+		return dial(ctx, network, addr)
+	}
+	// Connections opened before are not marked.
+	t.CloseIdleConnections()
+}
@@ -0,0 +1,119 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mesh
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestEnvoyAdminProxy(t *testing.T) {
+	admin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Method + " " + r.URL.Path + " " + r.URL.RawQuery))
+	}))
+	defer admin.Close()
+	h := envoyAdminProxy(strings.TrimPrefix(admin.URL, "http://"), "secret")
+
+	cases := []struct {
+		method, url, token string
+		code               int
+	}{
+		{"GET", "/debug/envoy/clusters", "secret", 200},
+		{"GET", "/debug/envoy/stats?filter=cluster", "secret", 200},
+		{"POST", "/debug/envoy/logging?level=debug", "secret", 200},
+		{"POST", "/debug/envoy/logging?http=verbose", "secret", 403},
+		{"GET", "/debug/envoy/logging?level=debug", "secret", 403},
+		{"POST", "/debug/envoy/quitquitquit", "secret", 403},
+		{"POST", "/debug/envoy/runtime_modify?a=b", "secret", 403},
+		{"POST", "/debug/envoy/clusters", "secret", 403},
+		{"GET", "/debug/envoy/clusters", "other", 401},
+		{"GET", "/debug/envoy/clusters", "", 401},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest(c.method, c.url, nil)
+		if c.token != "" {
+			r.Header.Set("Authorization", "Bearer "+c.token)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != c.code {
+			t.Error("Unexpected status", c.method, c.url, w.Code, w.Body.String())
+		}
+	}
+
+	r := httptest.NewRequest("GET", "/debug/envoy/stats?filter=cluster", nil)
+	r.Header.Set("Authorization", "Bearer secret")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Body.String() != "GET /stats filter=cluster" {
+		t.Error("Unexpected forwarded request", w.Body.String())
+	}
+}
+
+func TestAdminToken(t *testing.T) {
+	kr := New()
+	kr.BaseDir = t.TempDir()
+	tok, err := kr.adminToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := filepath.Join(kr.BaseDir, "/var/run/krun/admin-token")
+	data, err := ioutil.ReadFile(f)
+	if err != nil || string(data) != tok || len(tok) != 32 {
+		t.Error("Unexpected token file", tok, string(data), err)
+	}
+	if st, _ := os.Stat(f); st.Mode().Perm() != 0600 {
+		t.Error("Token file readable by others", st.Mode())
+	}
+
+	os.Setenv("MESH_ADMIN_TOKEN", "configured")
+	defer os.Unsetenv("MESH_ADMIN_TOKEN")
+	if tok, _ := kr.adminToken(); tok != "configured" {
+		t.Error("Expecting configured token", tok)
+	}
+	for _, e := range kr.filterAppEnv(os.Environ()) {
+		if strings.HasPrefix(e, "MESH_ADMIN_TOKEN=") {
+			t.Error("Admin token passed to the app")
+		}
+	}
+}
+
+func TestAdminLockChain(t *testing.T) {
+	defer func(f func(string, ...string) ([]byte, error)) { iptablesRun = f }(iptablesRun)
+	var cmds []string
+	iptablesRun = func(cmd string, args ...string) ([]byte, error) {
+		cmds = append(cmds, cmd+" "+strings.Join(args, " "))
+		return nil, nil
+	}
+	// Chain and jump exist - restarted krun.
+	if err := adminLockChain().install(); err != nil {
+		t.Fatal(err)
+	}
+	all := strings.Join(cmds, "\n")
+	if strings.Contains(all, "--uid-owner 0") {
+		t.Error("root must not bypass the lockdown", all)
+	}
+	if !strings.Contains(all, "-A KRUN_ADMIN -m mark --mark 1337 -j RETURN") {
+		t.Error("Missing krun mark rule", all)
+	}
+	if strings.Contains(all, "-N KRUN_ADMIN") || strings.Contains(all, "-I OUTPUT") {
+		t.Error("Existing chain should be reused", all)
+	}
+}
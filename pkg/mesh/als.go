@@ -0,0 +1,334 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mesh
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Envoy access log service (ALS) receiver.
+//
+// With MESH_ACCESS_LOG=als krun listens on MESH_ALS_ADDR (default 127.0.0.1:15050) for the Envoy gRPC ALS
+// streaming API, and writes each HTTP access log as a Cloud Logging structured entry with the httpRequest
+// field populated - the logs viewer shows them as requests, without Stackdriver filters in Envoy.
+//
+// Envoy must be configured to send the logs, using an envoyHttpAls extension provider in the mesh config and
+// a Telemetry resource:
+//
+//   extensionProviders:
+//   - name: krun-als
+//     envoyHttpAls:
+//       service: localhost
+//       port: 15050
+//
+// To avoid a dependency on the large generated Envoy API, the messages are decoded directly from the wire format -
+// only the fields used in the log entry are extracted.
+
+// httpRequest is the Cloud Logging HttpRequest, in JSON form.
+type httpRequest struct {
+	RequestMethod string `json:"requestMethod,omitempty"`
+	RequestURL    string `json:"requestUrl,omitempty"`
+	Status        int    `json:"status,omitempty"`
+	RequestSize   string `json:"requestSize,omitempty"`
+	ResponseSize  string `json:"responseSize,omitempty"`
+	UserAgent     string `json:"userAgent,omitempty"`
+	RemoteIP      string `json:"remoteIp,omitempty"`
+	ServerIP      string `json:"serverIp,omitempty"`
+	Referer       string `json:"referer,omitempty"`
+	Latency       string `json:"latency,omitempty"`
+	Protocol      string `json:"protocol,omitempty"`
+}
+
+type accessLogEntry struct {
+	Severity    string            `json:"severity"`
+	Message     string            `json:"message"`
+	HTTPRequest *httpRequest      `json:"httpRequest"`
+	Labels      map[string]string `json:"logging.googleapis.com/labels,omitempty"`
+
+	RequestID       string `json:"requestId,omitempty"`
+	UpstreamCluster string `json:"upstreamCluster,omitempty"`
+	RouteName       string `json:"routeName,omitempty"`
+	ResponseDetails string `json:"responseCodeDetails,omitempty"`
+}
+
+// StartALS starts the access log receiver, if enabled.
+func (kr *KRun) StartALS() error {
+	if kr.Config("MESH_ACCESS_LOG", "") != "als" {
+		return nil
+	}
+	addr := kr.Config("MESH_ALS_ADDR", "127.0.0.1:15050")
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	gs := grpc.NewServer(grpc.ForceServerCodec(rawCodec{}))
+	gs.RegisterService(&grpc.ServiceDesc{
+		ServiceName: "envoy.service.accesslog.v3.AccessLogService",
+		HandlerType: (*interface{})(nil),
+		Streams: []grpc.StreamDesc{{
+			StreamName:    "StreamAccessLogs",
+			Handler:       kr.streamAccessLogs,
+			ClientStreams: true,
+		}},
+		Metadata: "envoy/service/accesslog/v3/als.proto",
+	}, kr)
+	go gs.Serve(l)
+	log.Println("Envoy ALS receiver started", "addr", addr)
+	return nil
+}
+
+func (kr *KRun) streamAccessLogs(srv interface{}, stream grpc.ServerStream) error {
+	labels := map[string]string{"source": "envoy-als"}
+	if kr.InstanceID != "" {
+		labels["instanceId"] = kr.InstanceID
+	}
+	for {
+		var msg []byte
+		if err := stream.RecvMsg(&msg); err != nil {
+			// Envoy doesn't expect a response - the stream is closed on error or shutdown.
+			return nil
+		}
+		entries, err := parseALSMessage(msg)
+		if err != nil {
+			log.Println("Invalid ALS message", err)
+			continue
+		}
+		for _, e := range entries {
+			e.Labels = labels
+			data, _ := json.Marshal(e)
+			logMutex.Lock()
+			os.Stdout.Write(append(data, '\n'))
+			logMutex.Unlock()
+		}
+	}
+}
+
+// rawCodec passes the messages as bytes.
+type rawCodec struct{}
+
+func (rawCodec) Marshal(v interface{}) ([]byte, error) {
+	switch m := v.(type) {
+	case []byte:
+		return m, nil
+	case *[]byte:
+		return *m, nil
+	}
+	return nil, fmt.Errorf("unexpected message type %T", v)
+}
+
+func (rawCodec) Unmarshal(data []byte, v interface{}) error {
+	b, ok := v.(*[]byte)
+	if !ok {
+		return fmt.Errorf("unexpected message type %T", v)
+	}
+	*b = append((*b)[:0], data...)
+	return nil
+}
+
+func (rawCodec) Name() string {
+	return "proto"
+}
+
+var requestMethods = []string{"", "GET", "HEAD", "POST", "PUT", "DELETE", "CONNECT", "OPTIONS", "TRACE", "PATCH"}
+
+var httpProtocols = []string{"", "HTTP/1.0", "HTTP/1.1", "HTTP/2", "HTTP/3"}
+
+// parseALSMessage extracts the HTTP entries from a StreamAccessLogsMessage. TCP logs are ignored.
+func parseALSMessage(b []byte) ([]*accessLogEntry, error) {
+	res := []*accessLogEntry{}
+	err := protoFields(b, func(num protowire.Number, v []byte, _ uint64) error {
+		if num != 2 { // http_logs
+			return nil
+		}
+		return protoFields(v, func(num protowire.Number, v []byte, _ uint64) error {
+			if num != 1 { // log_entry
+				return nil
+			}
+			e, err := parseHTTPAccessLogEntry(v)
+			if err != nil {
+				return err
+			}
+			res = append(res, e)
+			return nil
+		})
+	})
+	return res, err
+}
+
+func parseHTTPAccessLogEntry(b []byte) (*accessLogEntry, error) {
+	hr := &httpRequest{}
+	e := &accessLogEntry{Severity: "INFO", HTTPRequest: hr}
+	var scheme, authority, path string
+	var reqHeaders, reqBody, resHeaders, resBody uint64
+	err := protoFields(b, func(num protowire.Number, v []byte, n uint64) error {
+		switch num {
+		case 1: // common_properties
+			return protoFields(v, func(num protowire.Number, v []byte, n uint64) error {
+				switch num {
+				case 2: // downstream_remote_address
+					hr.RemoteIP = parseAddress(v)
+				case 3: // downstream_local_address
+					hr.ServerIP = parseAddress(v)
+				case 12: // time_to_last_downstream_tx_byte
+					hr.Latency = parseDuration(v)
+				case 15:
+					e.UpstreamCluster = string(v)
+				case 19:
+					e.RouteName = string(v)
+				}
+				return nil
+			})
+		case 2: // protocol_version
+			if int(n) < len(httpProtocols) {
+				hr.Protocol = httpProtocols[n]
+			}
+		case 3: // request
+			return protoFields(v, func(num protowire.Number, v []byte, n uint64) error {
+				switch num {
+				case 1:
+					if int(n) < len(requestMethods) {
+						hr.RequestMethod = requestMethods[n]
+					}
+				case 2:
+					scheme = string(v)
+				case 3:
+					authority = string(v)
+				case 5:
+					path = string(v)
+				case 6:
+					hr.UserAgent = string(v)
+				case 7:
+					hr.Referer = string(v)
+				case 9:
+					e.RequestID = string(v)
+				case 11:
+					reqHeaders = n
+				case 12:
+					reqBody = n
+				}
+				return nil
+			})
+		case 4: // response
+			return protoFields(v, func(num protowire.Number, v []byte, n uint64) error {
+				switch num {
+				case 1: // UInt32Value
+					protoFields(v, func(_ protowire.Number, _ []byte, n uint64) error {
+						hr.Status = int(n)
+						return nil
+					})
+				case 2:
+					resHeaders = n
+				case 3:
+					resBody = n
+				case 6:
+					e.ResponseDetails = string(v)
+				}
+				return nil
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if scheme == "" {
+		scheme = "http"
+	}
+	hr.RequestURL = scheme + "://" + authority + path
+	hr.RequestSize = strconv.FormatUint(reqHeaders+reqBody, 10)
+	hr.ResponseSize = strconv.FormatUint(resHeaders+resBody, 10)
+	if hr.Status >= 500 {
+		e.Severity = "ERROR"
+	}
+	e.Message = fmt.Sprintf("%s %s %d", hr.RequestMethod, hr.RequestURL, hr.Status)
+	return e, nil
+}
+
+// parseAddress returns the IP of an envoy Address with a socket_address.
+func parseAddress(b []byte) string {
+	ip := ""
+	protoFields(b, func(num protowire.Number, v []byte, _ uint64) error {
+		if num == 1 {
+			protoFields(v, func(num protowire.Number, v []byte, _ uint64) error {
+				if num == 2 {
+					ip = string(v)
+				}
+				return nil
+			})
+		}
+		return nil
+	})
+	return ip
+}
+
+// parseDuration converts a google.protobuf.Duration to the JSON form ("1.5s").
+func parseDuration(b []byte) string {
+	var s, ns uint64
+	protoFields(b, func(num protowire.Number, _ []byte, n uint64) error {
+		switch num {
+		case 1:
+			s = n
+		case 2:
+			ns = n
+		}
+		return nil
+	})
+	return strconv.FormatFloat((time.Duration(s)*time.Second+time.Duration(ns)).Seconds(), 'f', -1, 64) + "s"
+}
+
+// protoFields calls f for each field in a message. Length delimited fields are passed as bytes, varint and
+// fixed fields as n.
+func protoFields(b []byte, f func(num protowire.Number, v []byte, n uint64) error) error {
+	for len(b) > 0 {
+		num, typ, l := protowire.ConsumeTag(b)
+		if l < 0 {
+			return protowire.ParseError(l)
+		}
+		b = b[l:]
+		var v []byte
+		var n uint64
+		switch typ {
+		case protowire.VarintType:
+			n, l = protowire.ConsumeVarint(b)
+		case protowire.BytesType:
+			v, l = protowire.ConsumeBytes(b)
+		case protowire.Fixed32Type:
+			var n32 uint32
+			n32, l = protowire.ConsumeFixed32(b)
+			n = uint64(n32)
+		case protowire.Fixed64Type:
+			n, l = protowire.ConsumeFixed64(b)
+		default:
+			l = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if l < 0 {
+			return protowire.ParseError(l)
+		}
+		b = b[l:]
+		if err := f(num, v, n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
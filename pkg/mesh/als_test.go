@@ -0,0 +1,72 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mesh
+
+import (
+	"testing"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+func protoMsg(num protowire.Number, v []byte) []byte {
+	b := protowire.AppendTag(nil, num, protowire.BytesType)
+	return protowire.AppendBytes(b, v)
+}
+
+func protoVarint(num protowire.Number, n uint64) []byte {
+	b := protowire.AppendTag(nil, num, protowire.VarintType)
+	return protowire.AppendVarint(b, n)
+}
+
+func TestParseALS(t *testing.T) {
+	addr := protoMsg(1, protoMsg(2, []byte("10.1.2.3")))
+	latency := append(protoVarint(1, 1), protoVarint(2, 500000000)...)
+	common := append(protoMsg(2, addr), protoMsg(12, latency)...)
+	common = append(common, protoMsg(15, []byte("inbound|8080||"))...)
+
+	req := protoVarint(1, 1) // GET
+	req = append(req, protoMsg(2, []byte("https"))...)
+	req = append(req, protoMsg(3, []byte("fortio.example.com"))...)
+	req = append(req, protoMsg(5, []byte("/echo"))...)
+	req = append(req, protoVarint(11, 100)...)
+
+	res := protoMsg(1, protoVarint(1, 503))
+	res = append(res, protoVarint(3, 20)...)
+
+	entry := protoMsg(1, common)
+	entry = append(entry, protoVarint(2, 3)...)
+	entry = append(entry, protoMsg(3, req)...)
+	entry = append(entry, protoMsg(4, res)...)
+
+	msg := protoMsg(2, protoMsg(1, entry))
+
+	el, err := parseALSMessage(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(el) != 1 {
+		t.Fatal("Expecting one entry", el)
+	}
+	hr := el[0].HTTPRequest
+	if hr.RequestMethod != "GET" || hr.RequestURL != "https://fortio.example.com/echo" || hr.Status != 503 {
+		t.Error("Unexpected request", hr)
+	}
+	if hr.RemoteIP != "10.1.2.3" || hr.Latency != "1.5s" || hr.Protocol != "HTTP/2" || hr.RequestSize != "100" {
+		t.Error("Unexpected request", hr)
+	}
+	if el[0].Severity != "ERROR" || el[0].UpstreamCluster != "inbound|8080||" {
+		t.Error("Unexpected entry", el[0])
+	}
+}
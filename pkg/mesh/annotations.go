@@ -0,0 +1,132 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mesh
+
+import (
+	"io/ioutil"
+	"log"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Annotations affecting the agent and iptables, with the same meaning as in the injection template.
+const (
+	annoLogLevel              = "sidecar.istio.io/logLevel"
+	annoComponentLogLevel     = "sidecar.istio.io/componentLogLevel"
+	annoAgentLogLevel         = "sidecar.istio.io/agentLogLevel"
+	annoProxyCPU              = "sidecar.istio.io/proxyCPU"
+	annoInterceptionMode      = "sidecar.istio.io/interceptionMode"
+	annoIncludeOutboundRanges = "traffic.sidecar.istio.io/includeOutboundIPRanges"
+	annoExcludeOutboundRanges = "traffic.sidecar.istio.io/excludeOutboundIPRanges"
+	annoExcludeOutboundPorts  = "traffic.sidecar.istio.io/excludeOutboundPorts"
+)
+
+// PodAnnotations returns the equivalent of the k8s pod annotations, written to /etc/istio/pod/annotations.
+//
+// Annotations are set in krun.yaml ('annotations'), or in MESH_ANNOTATIONS as a list of key=value. Values may
+// contain commas - "traffic.sidecar.istio.io/excludeOutboundPorts=5432,6379,sidecar.istio.io/logLevel=debug".
+//
+// Settings that have an annotation equivalent are reported as annotations if set in config, so the file
+// reflects the effective settings. Explicit annotations take precedence, like in the injector.
+func (kr *KRun) PodAnnotations() map[string]string {
+	res := map[string]string{}
+	if v := os.Getenv("ENVOY_LOG_LEVEL"); v != "" {
+		res[annoLogLevel] = v
+	}
+	if kr.AgentDebug != "" {
+		res[annoAgentLogLevel] = kr.AgentDebug
+	}
+	if v := kr.Config("ISTIO_META_INTERCEPTION_MODE", ""); v != "" {
+		res[annoInterceptionMode] = v
+	}
+	if v := kr.Config("OUTBOUND_IP_RANGES_INCLUDE", ""); v != "" {
+		res[annoIncludeOutboundRanges] = v
+	}
+	if v := kr.Config("OUTBOUND_PORTS_EXCLUDE", ""); v != "" {
+		res[annoExcludeOutboundPorts] = v
+	}
+	for k, v := range kr.Annotations {
+		res[k] = v
+	}
+	for k, v := range parseAnnotations(kr.Config("MESH_ANNOTATIONS", "")) {
+		res[k] = v
+	}
+	return res
+}
+
+// annotation returns the value of an explicitly set annotation, or def.
+func (kr *KRun) annotation(name, def string) string {
+	if v := parseAnnotations(kr.Config("MESH_ANNOTATIONS", ""))[name]; v != "" {
+		return v
+	}
+	if v := kr.Annotations[name]; v != "" {
+		return v
+	}
+	return def
+}
+
+// parseAnnotations parses a list of key=value. An element without '=' is part of the previous value.
+func parseAnnotations(s string) map[string]string {
+	res := map[string]string{}
+	last := ""
+	for _, kv := range splitList(s) {
+		p := strings.SplitN(kv, "=", 2)
+		if len(p) == 2 && p[0] != "" {
+			last = strings.TrimSpace(p[0])
+			res[last] = strings.TrimSpace(p[1])
+			continue
+		}
+		if last == "" {
+			log.Println("Invalid annotation, expecting key=value", kv)
+			continue
+		}
+		res[last] = res[last] + "," + kv
+	}
+	return res
+}
+
+// proxyCPUConcurrency returns the Envoy concurrency for a proxyCPU value ("500m", "2") - the number of
+// cores rounded up, as the injector does. Returns 0 if the value is invalid.
+func proxyCPUConcurrency(cpu string) int {
+	cpu = strings.TrimSpace(cpu)
+	cores := 0.0
+	if strings.HasSuffix(cpu, "m") {
+		m, err := strconv.ParseFloat(strings.TrimSuffix(cpu, "m"), 64)
+		if err != nil {
+			return 0
+		}
+		cores = m / 1000
+	} else {
+		c, err := strconv.ParseFloat(cpu, 64)
+		if err != nil {
+			return 0
+		}
+		cores = c
+	}
+	if cores <= 0 {
+		return 0
+	}
+	return int(math.Ceil(cores))
+}
+
+func (kr *KRun) initAnnotationsFile(annotations map[string]string) {
+	os.MkdirAll("./etc/istio/pod", 755)
+	err := ioutil.WriteFile("./etc/istio/pod/annotations", []byte(formatLabels(annotations)), 0777)
+	if err != nil {
+		log.Println("Error writing annotations", err)
+	}
+}
@@ -0,0 +1,55 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mesh
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestParseAnnotations(t *testing.T) {
+	a := parseAnnotations("traffic.sidecar.istio.io/excludeOutboundPorts=5432,6379, sidecar.istio.io/logLevel=debug")
+	if a[annoExcludeOutboundPorts] != "5432,6379" || a[annoLogLevel] != "debug" {
+		t.Error("Unexpected annotations", a)
+	}
+	for cpu, c := range map[string]int{"500m": 1, "2": 2, "1500m": 2, "x": 0, "0": 0} {
+		if got := proxyCPUConcurrency(cpu); got != c {
+			t.Error("Unexpected concurrency", cpu, got)
+		}
+	}
+}
+
+func TestAnnotationsAgent(t *testing.T) {
+	os.Setenv("MESH_ANNOTATIONS", "sidecar.istio.io/logLevel=debug,sidecar.istio.io/proxyCPU=1500m,"+
+		"traffic.sidecar.istio.io/excludeOutboundPorts=5432,6379")
+	defer os.Unsetenv("MESH_ANNOTATIONS")
+	kr := New()
+	kr.Annotations[annoComponentLogLevel] = "misc:error"
+
+	args := strings.Join(kr.agentCommand().Args, " ")
+	for _, a := range []string{"--proxyLogLevel=debug", "--proxyComponentLogLevel=misc:error", "--concurrency 2"} {
+		if !strings.Contains(args, a) {
+			t.Error("Missing", a, args)
+		}
+	}
+	args = strings.Join(kr.istioIptablesCommand(nil).Args, " ")
+	if !strings.Contains(args, "-o 5432,6379,15008,15009") {
+		t.Error("Annotation not applied to iptables", args)
+	}
+	if a := kr.PodAnnotations(); a[annoComponentLogLevel] != "misc:error" || a[annoLogLevel] != "debug" {
+		t.Error("Unexpected annotations", a)
+	}
+}
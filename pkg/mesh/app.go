@@ -15,8 +15,10 @@
 package mesh
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"net"
@@ -36,58 +38,59 @@ const (
 	listenerCheckRegex    = "^listener_manager.workers_started"
 )
 
-// StartApp uses the reminder of the command line to exec an app, using K8S_UID as UID, if present.
+// appCommand returns the AppCommand, the remainder of the command line or APP_CMD.
+func (kr *KRun) appCommand() []string {
+	if len(kr.AppCommand) > 0 {
+		return kr.AppCommand
+	}
+	if len(os.Args) > 1 {
+		return os.Args[1:]
+	}
+	return kr.appCommandFromConfig()
+}
+
+// StartApp execs the app - AppCommand or the remainder of the command line - using MESH_USER_APP or K8S_UID as
+// user, if present.
 func (kr *KRun) StartApp() {
-	var cmd *exec.Cmd
-	if len(os.Args) == 1 {
+	kr.StartApps()
+	args := kr.appCommand()
+	if len(args) == 0 {
 		return
-	} else if len(os.Args) == 2 {
-		cmd = exec.Command(os.Args[1])
-	} else {
-		cmd = exec.Command(os.Args[1], os.Args[2:]...)
-	}
-	if os.Getuid() == 0 {
-		uid := os.Getenv("K8S_UID")
-		if uid != "" {
-			uidi, err := strconv.Atoi(uid)
-			if err == nil {
-				cmd.SysProcAttr = &syscall.SysProcAttr{}
-				cmd.SysProcAttr.Credential = &syscall.Credential{Uid: uint32(uidi)}
-			}
-		}
 	}
-	cmd.Stdin = os.Stdin
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-
-	// Set port to 8080 - some apps use the PORT from knative to start.a
-	cmd.Env = []string{"PORT=8080"}
-	for _, e := range os.Environ() {
-		if strings.HasPrefix(e, "PORT=") {
-			continue
-		}
-		cmd.Env = append(cmd.Env, e)
+	args = kr.expandAppCommand(args)
+	if kr.DryRun {
+		fmt.Printf("\n# app\n%s\n", shellCommand(args))
+		return
 	}
-	if os.Getenv("GRPC_XDS_BOOTSTRAP") == "" {
-		cmd.Env = append(cmd.Env, "GRPC_XDS_BOOTSTRAP=/etc/istio/proxy/grpc_bootstrap.json")
-		// This is set by injector
-		cmd.Env = append(cmd.Env, "GRPC_XDS_EXPERIMENTAL_RBAC=true")
-		cmd.Env = append(cmd.Env, "GRPC_XDS_EXPERIMENTAL_SECURITY_SUPPORT=true")
+	cmd := exec.Command(args[0], args[1:]...)
+	cred, err := kr.childCredential("app", os.Getenv("K8S_UID"))
+	if err != nil {
+		log.Println("Invalid app user", err)
+		kr.Exit(1)
+		return
 	}
-	if kr.WhiteboxMode {
-		cmd.Env = append(cmd.Env, "HTTP_PROXY=127.0.0.1:15007")
-		cmd.Env = append(cmd.Env, "http_proxy=127.0.0.1:15007")
+	if cred != nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{Credential: cred}
 	}
+	cmd.Stdin = os.Stdin
+	// App output is not modified - only a copy is kept for crash reports.
+	cmd.Stdout = io.MultiWriter(os.Stdout, kr.OutputBuffer("app"))
+	cmd.Stderr = io.MultiWriter(os.Stderr, kr.OutputBuffer("app"))
 
+	cmd.Env = kr.appEnv()
+
+	appDone := kr.appStarted()
 	go func() {
-		err := cmd.Start()
+		err := kr.startChild(cmd)
 		if err != nil {
 			log.Println("Failed to start ", cmd, err)
 		}
 		kr.appCmd = cmd
 		err = cmd.Wait()
+		close(appDone)
 		if err != nil {
 			log.Println("Application err exit ", err, cmd.ProcessState.ExitCode(), time.Since(kr.StartTime))
+			kr.ReportExit("app", cmd, err)
 		} else {
 			log.Println("Application clean exit ", err, cmd.ProcessState.ExitCode(), time.Since(kr.StartTime))
 		}
@@ -97,6 +100,36 @@ func (kr *KRun) StartApp() {
 	kr.Signals()
 }
 
+// appEnv returns the environment for the app processes.
+func (kr *KRun) appEnv() []string {
+	// Set port to 8080 - some apps use the PORT from knative to start.a
+	env := []string{"PORT=8080"}
+	for _, e := range kr.filterAppEnv(os.Environ()) {
+		if strings.HasPrefix(e, "PORT=") {
+			continue
+		}
+		env = append(env, e)
+	}
+	if os.Getenv("GRPC_XDS_BOOTSTRAP") == "" {
+		env = append(env, "GRPC_XDS_BOOTSTRAP="+kr.GRPCBootstrapPath())
+		// This is set by injector
+		env = append(env, "GRPC_XDS_EXPERIMENTAL_RBAC=true")
+		env = append(env, "GRPC_XDS_EXPERIMENTAL_SECURITY_SUPPORT=true")
+	}
+	if kr.metadataAddr != "" {
+		env = append(env, "GCE_METADATA_HOST="+kr.metadataAddr)
+	}
+	if kr.WhiteboxMode {
+		env = append(env, "HTTP_PROXY=127.0.0.1:15007")
+		env = append(env, "http_proxy=127.0.0.1:15007")
+	}
+	env = append(env, kr.rootlessEnv...)
+	env = append(env, kr.meshInfoEnv()...)
+	env = append(env, kr.workloadAPIEnv()...)
+	env = append(env, kr.appEnvAdditions()...)
+	return env
+}
+
 // WaitTCPReady uses the same detection as CloudRun, i.e. TCP connect.
 func (kr *KRun) WaitTCPReady(addr string, max time.Duration) error {
 	t0 := time.Now()
@@ -128,9 +161,13 @@ func (kr *KRun) WaitTCPReady(addr string, max time.Duration) error {
 // WaitAppStartup waits for app to be ready to accept requests.
 // - default is KNative 'listen on the app port' ( 8080 default, PORT_http overrides )
 // - startupProbe.tcp and startupProbe.http can define alternate port and using http ready.
-func (kr *KRun) WaitAppStartup() error {
+// The timeout is the deadline of ctx - see PhaseAppReady - or MESH_TIMEOUT_APP_READY.
+func (kr *KRun) WaitAppStartup(ctx context.Context) error {
 	var err error
-	startupTimeout := 10 * time.Second // TODO: make customizable
+	startupTimeout, _ := kr.PhaseTimeout(PhaseAppReady)
+	if d, ok := ctx.Deadline(); ok {
+		startupTimeout = time.Until(d)
+	}
 	// PORT_http is used as an alternative to PORT - which is taken over by the tunnel.
 	appPort := kr.Config("PORT_http", "8080")
 	// Wait for app to be ready
@@ -140,9 +177,22 @@ func (kr *KRun) WaitAppStartup() error {
 		err = kr.WaitHTTPReady(startupProbeHttp, startupTimeout)
 	} else if startupProbeTcp != "" {
 		err = kr.WaitTCPReady(startupProbeTcp, startupTimeout)
-	} else if appPort != "-" && len(os.Args) > 1 {
+	} else if kr.Config("APP_PORTS", "") != "" && len(kr.appCommand()) > 0 {
+		// All declared ports must be ready.
+		for _, p := range kr.AppPorts() {
+			if err = kr.WaitTCPReady("127.0.0.1:"+strconv.Itoa(p.ContainerPort), startupTimeout); err != nil {
+				break
+			}
+		}
+	} else if appPort != "-" && len(kr.appCommand()) > 0 {
 		err = kr.WaitTCPReady("127.0.0.1:" + appPort, startupTimeout)
 	}
+	if err == nil {
+		err = kr.WaitAppsReady(startupTimeout)
+	}
+	if err == nil {
+		kr.setAppReady(time.Now())
+	}
 	return err
 }
 
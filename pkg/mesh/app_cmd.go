@@ -0,0 +1,128 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mesh
+
+import (
+	"errors"
+	"log"
+	"os"
+	"strings"
+)
+
+// The app command is, in order:
+// - AppCommand, from krun.yaml or set by the caller
+// - the krun command line arguments
+// - APP_CMD, a command line with shell-style quoting (no other shell features).
+//
+// The arguments may use ${NAME} placeholders for values computed by krun - so apps that need them as flags don't
+// require a wrapper shell script. See appVars for the supported names - other names are replaced with the env
+// variable, or an empty string.
+
+// appVars returns the krun-computed values available for the app command.
+func (kr *KRun) appVars() map[string]string {
+	return map[string]string{
+		"POD_NAME":        kr.PodName(),
+		"POD_NAMESPACE":   kr.Namespace,
+		"INSTANCE_IP":     kr.InstanceIP(),
+		"OUTPUT_CERTS":    kr.OutputCerts(),
+		"SERVICE_ACCOUNT": kr.KSA,
+		"WORKLOAD_NAME":   kr.Name,
+		"TRUST_DOMAIN":    kr.TrustDomain,
+	}
+}
+
+// OutputCerts returns the directory where the agent saves the workload certificates, OUTPUT_CERTS.
+func (kr *KRun) OutputCerts() string {
+	def := "./var/run/secrets/istio.io/"
+	if os.Getuid() == 0 {
+		def = "/var/run/secrets/istio.io/"
+	}
+	return kr.Config("OUTPUT_CERTS", def)
+}
+
+// expandAppCommand replaces the ${NAME} placeholders in the app arguments.
+func (kr *KRun) expandAppCommand(args []string) []string {
+	var vars map[string]string
+	res := make([]string, len(args))
+	for i, a := range args {
+		if !strings.Contains(a, "${") {
+			res[i] = a
+			continue
+		}
+		if vars == nil {
+			vars = kr.appVars()
+		}
+		res[i] = string(expandBootstrap([]byte(a), vars))
+	}
+	return res
+}
+
+// appCommandFromConfig returns the APP_CMD, split in arguments.
+func (kr *KRun) appCommandFromConfig() []string {
+	c := kr.Config("APP_CMD", "")
+	if c == "" {
+		return nil
+	}
+	args, err := splitCommand(c)
+	if err != nil {
+		log.Println("Invalid APP_CMD", c, err)
+		return nil
+	}
+	return args
+}
+
+// splitCommand splits a command line in arguments, handling single and double quotes and backslash escapes.
+func splitCommand(s string) ([]string, error) {
+	res := []string{}
+	cur := &strings.Builder{}
+	inArg := false
+	var quote rune
+	escaped := false
+	for _, c := range s {
+		switch {
+		case escaped:
+			cur.WriteRune(c)
+			escaped = false
+		case c == '\\' && quote != '\'':
+			escaped = true
+			inArg = true
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			} else {
+				cur.WriteRune(c)
+			}
+		case c == '\'' || c == '"':
+			quote = c
+			inArg = true
+		case c == ' ' || c == '\t' || c == '\n':
+			if inArg {
+				res = append(res, cur.String())
+				cur.Reset()
+				inArg = false
+			}
+		default:
+			cur.WriteRune(c)
+			inArg = true
+		}
+	}
+	if quote != 0 || escaped {
+		return nil, errors.New("unterminated quote or escape")
+	}
+	if inArg {
+		res = append(res, cur.String())
+	}
+	return res, nil
+}
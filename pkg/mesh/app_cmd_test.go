@@ -0,0 +1,47 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mesh
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSplitCommand(t *testing.T) {
+	args, err := splitCommand(`/app/server --name "a b" --label='x "y"' c\ d`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := []string{"/app/server", "--name", "a b", `--label=x "y"`, "c d"}
+	if !reflect.DeepEqual(args, exp) {
+		t.Error("Unexpected args", args)
+	}
+	if _, err := splitCommand(`/app/server "a`); err == nil {
+		t.Error("Expecting error for unterminated quote")
+	}
+}
+
+func TestExpandAppCommand(t *testing.T) {
+	kr := New()
+	kr.Namespace = "fortio"
+	kr.podName = "fortio-cr-00011-duq-1234"
+	kr.podNameOnce.Do(func() {})
+	args := kr.expandAppCommand([]string{"/app/server", "--id=${POD_NAME}.${POD_NAMESPACE}",
+		"--certs=${OUTPUT_CERTS}", "--other=${KRUN_TEST_UNSET}"})
+	if args[1] != "--id=fortio-cr-00011-duq-1234.fortio" || args[2] != "--certs="+kr.OutputCerts() ||
+		args[3] != "--other=" {
+		t.Error("Unexpected expansion", args)
+	}
+}
@@ -0,0 +1,106 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mesh
+
+import (
+	"os"
+	"sort"
+	"strings"
+)
+
+// By default the app gets the krun environment. The env can be restricted, so secrets and control plane settings
+// are not visible to the app:
+//
+// - APP_ENV_ALLOW - list of names passed to the app. A trailing '*' matches a prefix - "DB_*,LOG_LEVEL".
+// - APP_ENV_DENY - list of names removed from the app env, same format. 'mesh' removes the krun and mesh settings.
+// - APP_ENV_NAME=value - sets NAME for the app, after filtering. Can be set in mesh-env too.
+//
+// Variables set by krun for the app (PORT, GRPC_XDS_BOOTSTRAP, proxy settings) are not filtered.
+
+// meshEnvPrefixes are the krun settings, removed with APP_ENV_DENY=mesh.
+var meshEnvPrefixes = []string{"MESH_", "XDS_", "CA_", "ISTIO_", "GATEWAY_", "HBONE_", "DNS_UPSTREAM", "OUTBOUND_",
+	"CLOUDSQL_", "SECRET_", "METADATA_", "FLEET_", "CONFIG_CLUSTER", "IMPERSONATE_GSA", "TRUST_DOMAIN", "PROXY_CONFIG",
+	"APP_CMD", "APP_PORTS", "KRUN_"}
+
+const appEnvPrefix = "APP_ENV_"
+
+// filterAppEnv applies APP_ENV_ALLOW and APP_ENV_DENY to a KEY=VALUE list. The APP_ENV_ settings and the admin token
+// are always removed.
+func (kr *KRun) filterAppEnv(env []string) []string {
+	allow := splitList(kr.Config("APP_ENV_ALLOW", ""))
+	deny := []string{}
+	for _, d := range splitList(kr.Config("APP_ENV_DENY", "")) {
+		if d == "mesh" {
+			for _, p := range meshEnvPrefixes {
+				deny = append(deny, p+"*")
+			}
+			continue
+		}
+		deny = append(deny, d)
+	}
+	res := []string{}
+	for _, e := range env {
+		k := strings.SplitN(e, "=", 2)[0]
+		if strings.HasPrefix(k, appEnvPrefix) || k == "MESH_ADMIN_TOKEN" {
+			continue
+		}
+		if len(allow) > 0 && !matchEnvName(k, allow) {
+			continue
+		}
+		if matchEnvName(k, deny) {
+			continue
+		}
+		res = append(res, e)
+	}
+	return res
+}
+
+// appEnvAdditions returns the APP_ENV_NAME settings from env and mesh-env, as NAME=value.
+func (kr *KRun) appEnvAdditions() []string {
+	vals := map[string]string{}
+	for k, v := range kr.MeshEnv {
+		if strings.HasPrefix(k, appEnvPrefix) {
+			vals[k] = v
+		}
+	}
+	for _, e := range os.Environ() {
+		kv := strings.SplitN(e, "=", 2)
+		if len(kv) == 2 && strings.HasPrefix(kv[0], appEnvPrefix) {
+			vals[kv[0]] = kv[1]
+		}
+	}
+	res := []string{}
+	for k, v := range vals {
+		if k == "APP_ENV_ALLOW" || k == "APP_ENV_DENY" || len(k) == len(appEnvPrefix) {
+			continue
+		}
+		res = append(res, k[len(appEnvPrefix):]+"="+v)
+	}
+	sort.Strings(res)
+	return res
+}
+
+func matchEnvName(name string, patterns []string) bool {
+	for _, p := range patterns {
+		if strings.HasSuffix(p, "*") {
+			if strings.HasPrefix(name, p[0:len(p)-1]) {
+				return true
+			}
+		} else if name == p {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,55 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mesh
+
+import (
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestFilterAppEnv(t *testing.T) {
+	env := []string{"HOME=/root", "DB_USER=u", "DB_PASS=p", "XDS_ADDR=x:443", "MESH_TENANT=t", "APP_ENV_FOO=bar"}
+	kr := New()
+	if got := kr.filterAppEnv(env); len(got) != 5 {
+		t.Error("Expecting all but APP_ENV_", got)
+	}
+
+	os.Setenv("APP_ENV_DENY", "mesh,DB_PASS")
+	defer os.Unsetenv("APP_ENV_DENY")
+	if got := kr.filterAppEnv(env); !reflect.DeepEqual(got, []string{"HOME=/root", "DB_USER=u"}) {
+		t.Error("Unexpected deny result", got)
+	}
+
+	os.Setenv("APP_ENV_ALLOW", "DB_*")
+	defer os.Unsetenv("APP_ENV_ALLOW")
+	if got := kr.filterAppEnv(env); !reflect.DeepEqual(got, []string{"DB_USER=u"}) {
+		t.Error("Unexpected allow result", got)
+	}
+
+	os.Setenv("APP_ENV_LOG_LEVEL", "debug")
+	defer os.Unsetenv("APP_ENV_LOG_LEVEL")
+	kr.MeshEnv["APP_ENV_REGION"] = "us-central1"
+	add := kr.appEnvAdditions()
+	if !reflect.DeepEqual(add, []string{"LOG_LEVEL=debug", "REGION=us-central1"}) {
+		t.Error("Unexpected additions", add)
+	}
+	appEnv := strings.Join(kr.appEnv(), " ")
+	if !strings.Contains(appEnv, "PORT=8080") || !strings.Contains(appEnv, "LOG_LEVEL=debug") ||
+		strings.Contains(appEnv, "HOME=") {
+		t.Error("Unexpected app env", appEnv)
+	}
+}
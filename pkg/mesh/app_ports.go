@@ -0,0 +1,106 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mesh
+
+import (
+	"encoding/json"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// AppPort is a port declared by the app, equivalent to a k8s containerPort.
+type AppPort struct {
+	Name          string `json:"name,omitempty"`
+	ContainerPort int    `json:"containerPort"`
+	Protocol      string `json:"protocol,omitempty"`
+}
+
+// AppPorts returns the ports declared with APP_PORTS and PORT_name, sorted by port.
+//
+// APP_PORTS is a list of name=port or port, for example "http=8080,grpc=9090,9091". A port without name gets
+// a 'tcp-' name, so Istio will not treat it as HTTP. If no port is declared, PORT_http (default 8080) is returned.
+func (kr *KRun) AppPorts() []AppPort {
+	byPort := map[int]AppPort{}
+	for _, p := range parseAppPorts(kr.Config("APP_PORTS", "")) {
+		byPort[p.ContainerPort] = p
+	}
+	for k, v := range kr.MeshEnv {
+		if !strings.HasPrefix(k, "PORT_") || len(k) <= 5 {
+			continue
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			continue
+		}
+		if _, f := byPort[n]; !f {
+			byPort[n] = AppPort{Name: k[5:], ContainerPort: n, Protocol: "TCP"}
+		}
+	}
+	if len(byPort) == 0 {
+		if n, err := strconv.Atoi(kr.Config("PORT_http", "8080")); err == nil {
+			byPort[n] = AppPort{Name: "http", ContainerPort: n, Protocol: "TCP"}
+		}
+	}
+	res := []AppPort{}
+	for _, p := range byPort {
+		res = append(res, p)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].ContainerPort < res[j].ContainerPort
+	})
+	return res
+}
+
+func parseAppPorts(s string) []AppPort {
+	res := []AppPort{}
+	for _, e := range splitList(s) {
+		name := ""
+		if i := strings.Index(e, "="); i >= 0 {
+			name = e[0:i]
+			e = e[i+1:]
+		}
+		n, err := strconv.Atoi(e)
+		if err != nil || n <= 0 || n > 65535 {
+			log.Println("Invalid APP_PORTS entry, expecting name=port", e)
+			continue
+		}
+		if name == "" {
+			name = "tcp-" + e
+		}
+		res = append(res, AppPort{Name: name, ContainerPort: n, Protocol: "TCP"})
+	}
+	return res
+}
+
+// inboundCapturePorts returns the ports for inbound capture (istio-iptables -b), or "" if inbound capture is
+// disabled. Only explicitly declared APP_PORTS are captured - CloudRun traffic on other ports goes directly to the app.
+// Without Direct VPC egress there are no VPC clients, and only the annotation enables the capture.
+func (kr *KRun) inboundCapturePorts() string {
+	ports := []string{}
+	if kr.Config("APP_PORTS", "") != "" && kr.VPCMode() == VPCDirect {
+		for _, p := range kr.AppPorts() {
+			ports = append(ports, strconv.Itoa(p.ContainerPort))
+		}
+	}
+	return kr.annotation("traffic.sidecar.istio.io/includeInboundPorts", strings.Join(ports, ","))
+}
+
+// podPortsJSON returns the ports in the ISTIO_META_POD_PORTS format.
+func podPortsJSON(ports []AppPort) string {
+	data, _ := json.Marshal(ports)
+	return string(data)
+}
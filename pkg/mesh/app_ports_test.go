@@ -0,0 +1,46 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mesh
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestAppPorts(t *testing.T) {
+	kr := New()
+	if p := kr.AppPorts(); len(p) != 1 || p[0].ContainerPort != 8080 || p[0].Name != "http" {
+		t.Error("Expecting default port", p)
+	}
+	if b := kr.inboundCapturePorts(); b != "" {
+		t.Error("Inbound capture should be disabled by default", b)
+	}
+
+	os.Setenv("APP_PORTS", "grpc=9090, 8080,bad=x")
+	defer os.Unsetenv("APP_PORTS")
+	kr.MeshEnv["PORT_metrics"] = "9091"
+	p := kr.AppPorts()
+	if len(p) != 3 || p[0].Name != "tcp-8080" || p[1].Name != "grpc" || p[2].Name != "metrics" {
+		t.Error("Unexpected ports", p)
+	}
+	if j := podPortsJSON(p); !strings.Contains(j, `{"name":"grpc","containerPort":9090,"protocol":"TCP"}`) {
+		t.Error("Unexpected POD_PORTS", j)
+	}
+	args := strings.Join(kr.istioIptablesCommand(nil).Args, " ")
+	if !strings.Contains(args, "-b 8080,9090,9091") {
+		t.Error("Expecting inbound capture for declared ports", args)
+	}
+}
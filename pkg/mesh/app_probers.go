@@ -0,0 +1,197 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mesh
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// App probe rewriting.
+//
+// The injected sidecar rewrites the pod probes to /app-health/<container>/<probe> on the agent, which forwards
+// them to the real app port - so probes work with STRICT mTLS. ISTIO_KUBE_APP_PROBERS uses the same JSON
+// format, for example:
+//
+//   {"/app-health/app/livez": {"httpGet": {"path": "/healthz", "port": 8080}, "timeoutSeconds": 1}}
+//
+// The CloudRun startup and liveness probes can then use the same paths on the container port, which is served
+// by krun - probe requests are not authenticated and don't reach Envoy.
+
+// AppProber is the probe for one path - one of HTTPGet, TCPSocket or GRPC must be set.
+type AppProber struct {
+	HTTPGet        *HTTPGetProbe   `json:"httpGet,omitempty"`
+	TCPSocket      *TCPSocketProbe `json:"tcpSocket,omitempty"`
+	GRPC           *GRPCProbe      `json:"grpc,omitempty"`
+	TimeoutSeconds int             `json:"timeoutSeconds,omitempty"`
+}
+
+type HTTPGetProbe struct {
+	Path   string    `json:"path,omitempty"`
+	Port   probePort `json:"port"`
+	Host   string    `json:"host,omitempty"`
+	Scheme string    `json:"scheme,omitempty"`
+
+	HTTPHeaders []struct {
+		Name  string `json:"name"`
+		Value string `json:"value"`
+	} `json:"httpHeaders,omitempty"`
+}
+
+type TCPSocketProbe struct {
+	Port probePort `json:"port"`
+	Host string    `json:"host,omitempty"`
+}
+
+type GRPCProbe struct {
+	Port    probePort `json:"port"`
+	Service string    `json:"service,omitempty"`
+}
+
+// probePort is a port number. Like the k8s IntOrString, it may be quoted - named ports are not supported.
+type probePort int
+
+func (p *probePort) UnmarshalJSON(b []byte) error {
+	n, err := strconv.Atoi(strings.Trim(string(b), `"`))
+	if err != nil {
+		return err
+	}
+	*p = probePort(n)
+	return nil
+}
+
+// probeClient doesn't follow redirects - 3xx is a success, as in k8s - and doesn't verify the app certificate.
+var probeClient = &http.Client{
+	Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}},
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+// AppProbers returns the probes from ISTIO_KUBE_APP_PROBERS, keyed by path.
+func (kr *KRun) AppProbers() map[string]*AppProber {
+	kr.appProbersOnce.Do(func() {
+		kr.appProbers = map[string]*AppProber{}
+		cfg := kr.Config("ISTIO_KUBE_APP_PROBERS", "")
+		if cfg == "" {
+			return
+		}
+		if err := json.Unmarshal([]byte(cfg), &kr.appProbers); err != nil {
+			log.Println("Invalid ISTIO_KUBE_APP_PROBERS", err)
+		}
+	})
+	return kr.appProbers
+}
+
+// AppProbe runs the probe for path, returning the status code - 404 if the path is not configured, 503 if the
+// app is not reachable. Used as the hbone AppProbe.
+func (kr *KRun) AppProbe(ctx context.Context, path string) int {
+	p := kr.AppProbers()[path]
+	if p == nil {
+		return 404
+	}
+	timeout := time.Duration(p.TimeoutSeconds) * time.Second
+	if timeout <= 0 {
+		timeout = time.Second
+	}
+	ctx, cf := context.WithTimeout(ctx, timeout)
+	defer cf()
+
+	code, err := p.probe(ctx)
+	if err != nil {
+		log.Println("App probe failed", "path", path, "err", err)
+		return 503
+	}
+	return code
+}
+
+func (p *AppProber) probe(ctx context.Context) (int, error) {
+	switch {
+	case p.HTTPGet != nil:
+		return p.HTTPGet.probe(ctx)
+	case p.TCPSocket != nil:
+		d := net.Dialer{}
+		c, err := d.DialContext(ctx, "tcp", probeHostPort(p.TCPSocket.Host, p.TCPSocket.Port))
+		if err != nil {
+			return 0, err
+		}
+		c.Close()
+		return 200, nil
+	case p.GRPC != nil:
+		return p.GRPC.probe(ctx)
+	}
+	return 404, nil
+}
+
+func (h *HTTPGetProbe) probe(ctx context.Context) (int, error) {
+	scheme := "http"
+	if strings.EqualFold(h.Scheme, "https") {
+		scheme = "https"
+	}
+	path := h.Path
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", scheme+"://"+probeHostPort(h.Host, h.Port)+path, nil)
+	if err != nil {
+		return 0, err
+	}
+	for _, hh := range h.HTTPHeaders {
+		if strings.EqualFold(hh.Name, "host") {
+			req.Host = hh.Value
+			continue
+		}
+		req.Header.Add(hh.Name, hh.Value)
+	}
+	res, err := probeClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	res.Body.Close()
+	return res.StatusCode, nil
+}
+
+func (g *GRPCProbe) probe(ctx context.Context) (int, error) {
+	conn, err := grpc.DialContext(ctx, probeHostPort("", g.Port), grpc.WithInsecure(), grpc.WithBlock())
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	res, err := grpc_health_v1.NewHealthClient(conn).Check(ctx, &grpc_health_v1.HealthCheckRequest{Service: g.Service})
+	if err != nil {
+		return 0, err
+	}
+	if res.Status != grpc_health_v1.HealthCheckResponse_SERVING {
+		return 503, nil
+	}
+	return 200, nil
+}
+
+func probeHostPort(host string, port probePort) string {
+	if host == "" {
+		host = "127.0.0.1"
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(port)))
+}
@@ -0,0 +1,59 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mesh
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func TestAppProbe(t *testing.T) {
+	app := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/healthz" || r.Header.Get("x-probe") != "1" {
+			w.WriteHeader(500)
+		}
+	}))
+	defer app.Close()
+	_, port, _ := net.SplitHostPort(app.Listener.Addr().String())
+
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	closed := l.Addr().String()
+	l.Close()
+	_, closedPort, _ := net.SplitHostPort(closed)
+
+	os.Setenv("ISTIO_KUBE_APP_PROBERS", fmt.Sprintf(`{
+"/app-health/app/livez": {"httpGet": {"path": "/healthz", "port": %s, "httpHeaders": [{"name": "x-probe", "value": "1"}]}},
+"/app-health/app/readyz": {"tcpSocket": {"port": "%s"}},
+"/app-health/app/startupz": {"tcpSocket": {"port": %s}}}`, port, port, closedPort))
+	defer os.Unsetenv("ISTIO_KUBE_APP_PROBERS")
+
+	kr := New()
+	ctx := context.Background()
+	for path, exp := range map[string]int{
+		"/app-health/app/livez":    200,
+		"/app-health/app/readyz":   200,
+		"/app-health/app/startupz": 503,
+		"/app-health/other/livez":  404,
+	} {
+		if code := kr.AppProbe(ctx, path); code != exp {
+			t.Error("Unexpected probe result", path, code, exp)
+		}
+	}
+}
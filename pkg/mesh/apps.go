@@ -0,0 +1,260 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mesh
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// AppProcess is an additional application process, supervised by krun like the main app.
+//
+// Declared in krun.yaml:
+//
+//	apps:
+//	- name: worker
+//	  command: ["/app/worker", "--id=${POD_NAME}"]
+//	  env:
+//	    QUEUE: jobs
+//	  dir: /app
+//	  user: "1000:1000"
+//	  ready: 127.0.0.1:9000
+//	  restart: true
+//	  stopOrder: 1
+//
+// or with env variables, N from 1 to 9: APP_N_CMD (required), APP_N_NAME, APP_N_ENV (key=value list), APP_N_DIR,
+// APP_N_USER, APP_N_READY, APP_N_RESTART, APP_N_STOP_ORDER.
+type AppProcess struct {
+	Name    string            `yaml:"name,omitempty"`
+	Command []string          `yaml:"command"`
+	Env     map[string]string `yaml:"env,omitempty"`
+	Dir     string            `yaml:"dir,omitempty"`
+
+	// User is the uid or uid:gid, or a user name. Only used if krun runs as root.
+	User string `yaml:"user,omitempty"`
+
+	// Ready is a host:port or http:// URL that must be ready before the app is considered started.
+	Ready string `yaml:"ready,omitempty"`
+
+	// Restart the process if it exits. By default krun exits when any app process exits, like for the main app.
+	Restart bool `yaml:"restart,omitempty"`
+
+	// StopOrder controls the shutdown: processes with a lower order are stopped first, and krun waits for them
+	// to exit (up to MESH_APP_STOP_TIMEOUT, default 5s) before stopping the next group.
+	StopOrder int `yaml:"stopOrder,omitempty"`
+
+	m    sync.Mutex
+	cmd  *exec.Cmd
+	done chan struct{}
+}
+
+// maxEnvApps is the max N for APP_N_CMD.
+const maxEnvApps = 9
+
+// appProcesses returns the processes from krun.yaml and the APP_N_ env variables.
+func (kr *KRun) appProcesses() []*AppProcess {
+	res := append([]*AppProcess{}, kr.Apps...)
+	for i := 1; i <= maxEnvApps; i++ {
+		p := "APP_" + strconv.Itoa(i) + "_"
+		c := kr.Config(p+"CMD", "")
+		if c == "" {
+			continue
+		}
+		args, err := splitCommand(c)
+		if err != nil || len(args) == 0 {
+			log.Println("Invalid", p+"CMD", c, err)
+			continue
+		}
+		ap := &AppProcess{
+			Name:    kr.Config(p+"NAME", "app-"+strconv.Itoa(i)),
+			Command: args,
+			Env:     parseAnnotations(kr.Config(p+"ENV", "")),
+			Dir:     kr.Config(p+"DIR", ""),
+			User:    kr.Config(p+"USER", ""),
+			Ready:   kr.Config(p+"READY", ""),
+			Restart: kr.Config(p+"RESTART", "") == "true",
+		}
+		ap.StopOrder, _ = strconv.Atoi(kr.Config(p+"STOP_ORDER", "0"))
+		res = append(res, ap)
+	}
+	return res
+}
+
+// StartApps starts the additional app processes. Called by StartApp, before the main app.
+func (kr *KRun) StartApps() {
+	kr.appsOnce.Do(func() {
+		kr.Apps = kr.appProcesses()
+	})
+	for _, ap := range kr.Apps {
+		args := kr.expandAppCommand(ap.Command)
+		if kr.DryRun {
+			fmt.Printf("\n# app %s\n%s\n", ap.Name, shellCommand(args))
+			continue
+		}
+		ap.done = make(chan struct{})
+		go kr.superviseApp(ap, args)
+	}
+	if len(kr.Apps) > 0 && !kr.DryRun {
+		kr.Signals()
+	}
+}
+
+func (kr *KRun) superviseApp(ap *AppProcess, args []string) {
+	backoff := 1 * time.Second
+	for {
+		cmd, err := kr.appProcessCommand(ap, args)
+		t0 := time.Now()
+		if err == nil {
+			err = kr.startChild(cmd)
+		}
+		if err != nil {
+			log.Println("Failed to start", ap.Name, err)
+			kr.Exit(1)
+			return
+		}
+		ap.m.Lock()
+		ap.cmd = cmd
+		ap.m.Unlock()
+		err = cmd.Wait()
+		code := cmd.ProcessState.ExitCode()
+		if !ap.Restart || kr.stopping() {
+			close(ap.done)
+			log.Println("Application exit", "name", ap.Name, "err", err, "code", code, "uptime", time.Since(t0))
+			if err != nil {
+				kr.ReportExit(ap.Name, cmd, err)
+			}
+			kr.Exit(code)
+			return
+		}
+		log.Println("Application exited, restarting", "name", ap.Name, "err", err, "uptime", time.Since(t0))
+		if time.Since(t0) > time.Minute {
+			backoff = 1 * time.Second
+		}
+		time.Sleep(backoff)
+		if backoff < 30*time.Second {
+			backoff = backoff * 2
+		}
+	}
+}
+
+func (kr *KRun) appProcessCommand(ap *AppProcess, args []string) (*exec.Cmd, error) {
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Dir = ap.Dir
+	cmd.Env = kr.appEnv()
+	keys := []string{}
+	for k := range ap.Env {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		cmd.Env = append(cmd.Env, k+"="+ap.Env[k])
+	}
+	if ap.User != "" && os.Getuid() == 0 {
+		cred, err := parseCredential(ap.User)
+		if err != nil {
+			return nil, err
+		}
+		cmd.SysProcAttr = &syscall.SysProcAttr{Credential: cred}
+	}
+	cmd.Stdout = io.MultiWriter(os.Stdout, kr.OutputBuffer(ap.Name))
+	cmd.Stderr = io.MultiWriter(os.Stderr, kr.OutputBuffer(ap.Name))
+	return cmd, nil
+}
+
+// WaitAppsReady waits for the Ready address of each app process.
+func (kr *KRun) WaitAppsReady(max time.Duration) error {
+	for _, ap := range kr.Apps {
+		if ap.Ready == "" {
+			continue
+		}
+		var err error
+		if strings.HasPrefix(ap.Ready, "http://") {
+			err = kr.WaitHTTPReady(ap.Ready, max)
+		} else {
+			err = kr.WaitTCPReady(ap.Ready, max)
+		}
+		if err != nil {
+			return fmt.Errorf("%s not ready: %v", ap.Name, err)
+		}
+	}
+	return nil
+}
+
+// stopApps signals the app processes in StopOrder, waiting for each group to exit before the next. If a group
+// doesn't exit within MESH_APP_STOP_TIMEOUT the next group is signaled anyway - the remaining processes are
+// killed by killApps.
+func (kr *KRun) stopApps(s os.Signal) {
+	timeout, err := time.ParseDuration(kr.Config("MESH_APP_STOP_TIMEOUT", "5s"))
+	if err != nil {
+		timeout = 5 * time.Second
+	}
+	byOrder := map[int][]*AppProcess{}
+	orders := []int{}
+	for _, ap := range kr.Apps {
+		if _, f := byOrder[ap.StopOrder]; !f {
+			orders = append(orders, ap.StopOrder)
+		}
+		byOrder[ap.StopOrder] = append(byOrder[ap.StopOrder], ap)
+	}
+	sort.Ints(orders)
+	for _, o := range orders {
+		group := byOrder[o]
+		for _, ap := range group {
+			ap.m.Lock()
+			if ap.cmd != nil && ap.cmd.Process != nil {
+				ap.cmd.Process.Signal(s)
+			}
+			ap.m.Unlock()
+		}
+		deadline := time.After(timeout)
+	wait:
+		for _, ap := range group {
+			if ap.done == nil {
+				continue
+			}
+			select {
+			case <-ap.done:
+			case <-deadline:
+				log.Println("Timeout stopping apps", "stop_order", o, "app", ap.Name)
+				break wait
+			}
+		}
+	}
+}
+
+func (kr *KRun) stopping() bool {
+	return atomic.LoadInt32(&kr.shuttingDown) == 1
+}
+
+// killApps kills the app processes that are still running.
+func (kr *KRun) killApps() {
+	for _, ap := range kr.Apps {
+		ap.m.Lock()
+		if ap.cmd != nil && ap.cmd.Process != nil {
+			ap.cmd.Process.Kill()
+		}
+		ap.m.Unlock()
+	}
+}
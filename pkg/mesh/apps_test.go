@@ -0,0 +1,107 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mesh
+
+import (
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestAppProcesses(t *testing.T) {
+	os.Setenv("APP_2_CMD", `/bin/sleep "10"`)
+	os.Setenv("APP_2_ENV", "A=1,B=2,3")
+	os.Setenv("APP_2_STOP_ORDER", "2")
+	defer os.Unsetenv("APP_2_CMD")
+	defer os.Unsetenv("APP_2_ENV")
+	defer os.Unsetenv("APP_2_STOP_ORDER")
+
+	kr := New()
+	kr.Apps = []*AppProcess{{Name: "worker", Command: []string{"/bin/sleep", "10"}, Dir: "/tmp"}}
+	aps := kr.appProcesses()
+	if len(aps) != 2 {
+		t.Fatal("Expecting 2 apps", aps)
+	}
+	ap := aps[1]
+	if ap.Name != "app-2" || ap.StopOrder != 2 || ap.Env["B"] != "2,3" || ap.Command[1] != "10" {
+		t.Error("Unexpected app", ap)
+	}
+	cmd, err := kr.appProcessCommand(ap, ap.Command)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if env := strings.Join(cmd.Env, " "); !strings.Contains(env, "A=1") || !strings.Contains(env, "PORT=8080") {
+		t.Error("Unexpected env", env)
+	}
+}
+
+func TestStopApps(t *testing.T) {
+	kr := New()
+	for i, o := range []int{1, 0} {
+		cmd := exec.Command("/bin/sleep", "10")
+		if err := cmd.Start(); err != nil {
+			t.Skip("sleep not available", err)
+		}
+		ap := &AppProcess{Name: "app-" + string(rune('a'+i)), StopOrder: o, cmd: cmd, done: make(chan struct{})}
+		go func() {
+			cmd.Wait()
+			close(ap.done)
+		}()
+		kr.Apps = append(kr.Apps, ap)
+	}
+	t0 := time.Now()
+	kr.stopApps(syscall.SIGTERM)
+	for _, ap := range kr.Apps {
+		select {
+		case <-ap.done:
+		default:
+			t.Error("App not stopped", ap.Name)
+		}
+	}
+	if time.Since(t0) > 4*time.Second {
+		t.Error("Stop took too long", time.Since(t0))
+	}
+}
+
+func TestStopAppsTimeout(t *testing.T) {
+	os.Setenv("MESH_APP_STOP_TIMEOUT", "200ms")
+	defer os.Unsetenv("MESH_APP_STOP_TIMEOUT")
+	kr := New()
+	// The first group ignores the signal - the second group must still be stopped.
+	for i, c := range [][]string{{"/bin/sh", "-c", "trap '' TERM; sleep 10 & wait"}, {"/bin/sleep", "10"}} {
+		cmd := exec.Command(c[0], c[1:]...)
+		if err := cmd.Start(); err != nil {
+			t.Skip("sh not available", err)
+		}
+		ap := &AppProcess{Name: c[0], StopOrder: i, cmd: cmd, done: make(chan struct{})}
+		go func() {
+			cmd.Wait()
+			close(ap.done)
+		}()
+		kr.Apps = append(kr.Apps, ap)
+	}
+	defer kr.killApps()
+	// Let the shell install the trap.
+	time.Sleep(100 * time.Millisecond)
+	kr.stopApps(syscall.SIGTERM)
+	select {
+	case <-kr.Apps[1].done:
+	case <-time.After(2 * time.Second):
+		t.Error("Second group not stopped after the first timed out")
+	}
+}
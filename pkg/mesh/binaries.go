@@ -0,0 +1,86 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mesh
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+)
+
+// Location of the envoy and pilot-agent binaries.
+//
+// The Istio images use /usr/local/bin. Custom and multi-arch images may use a different layout, or an
+// arch suffix (envoy-arm64, envoy-aarch64). ENVOY_BINARY and PILOT_AGENT_BINARY override the discovery.
+
+const (
+	defaultEnvoyPath = "/usr/local/bin/envoy"
+	defaultAgentPath = "/usr/local/bin/pilot-agent"
+)
+
+// Directories searched before PATH - distroless images typically don't set PATH for the entrypoint.
+var binaryDirs = []string{"/usr/local/bin", "/usr/bin", "/bin", "/"}
+
+// EnvoyPath returns the envoy binary, or "" if not found.
+func (kr *KRun) EnvoyPath() string {
+	return findBinary(kr.Config("ENVOY_BINARY", ""), "envoy", binaryDirs)
+}
+
+// AgentPath returns the pilot-agent binary, or "" if not found.
+func (kr *KRun) AgentPath() string {
+	return findBinary(kr.Config("PILOT_AGENT_BINARY", ""), "pilot-agent", binaryDirs)
+}
+
+// binaryNames returns the names to try for the current architecture - the plain name first.
+func binaryNames(name string) []string {
+	res := []string{name, name + "-" + runtime.GOARCH}
+	switch runtime.GOARCH {
+	case "amd64":
+		res = append(res, name+"-x86_64")
+	case "arm64":
+		res = append(res, name+"-aarch64")
+	}
+	return res
+}
+
+func findBinary(override, name string, dirs []string) string {
+	if override != "" {
+		if isExecutable(override) {
+			return override
+		}
+		return ""
+	}
+	names := binaryNames(name)
+	for _, d := range dirs {
+		for _, n := range names {
+			p := filepath.Join(d, n)
+			if isExecutable(p) {
+				return p
+			}
+		}
+	}
+	for _, n := range names {
+		if p, err := exec.LookPath(n); err == nil {
+			return p
+		}
+	}
+	return ""
+}
+
+func isExecutable(p string) bool {
+	st, err := os.Stat(p)
+	return err == nil && !st.IsDir() && st.Mode()&0111 != 0
+}
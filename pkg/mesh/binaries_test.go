@@ -0,0 +1,43 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mesh
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestFindBinary(t *testing.T) {
+	d1 := t.TempDir()
+	d2 := t.TempDir()
+	arch := filepath.Join(d2, "envoy-"+runtime.GOARCH)
+	ioutil.WriteFile(arch, []byte("#!/bin/sh\n"), 0755)
+	ioutil.WriteFile(filepath.Join(d1, "envoy"), []byte("not executable"), 0644)
+	defer os.Setenv("PATH", os.Getenv("PATH"))
+	os.Setenv("PATH", "")
+
+	if p := findBinary("", "envoy", []string{d1, d2}); p != arch {
+		t.Error("Expecting arch-specific binary", p)
+	}
+	if p := findBinary(filepath.Join(d1, "envoy"), "envoy", []string{d2}); p != "" {
+		t.Error("Override must be executable", p)
+	}
+	if p := findBinary("", "pilot-agent", []string{d1, d2}); p != "" {
+		t.Error("Unexpected agent", p)
+	}
+}
@@ -0,0 +1,157 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mesh
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// The Envoy and gRPC bootstrap files can be generated when building the image, with 'krun gen-bootstrap', instead
+// of templating them at each start. Users can also vendor a customized bootstrap.
+//
+// Values only known at runtime are ${NAME} placeholders, expanded by ExpandBootstrap using the discovered settings,
+// with env variables as fallback. Set MESH_ENVOY_BOOTSTRAP (Traffic Director mode) or MESH_GRPC_BOOTSTRAP to the
+// generated files to use them.
+
+// Words in the TD bootstrap template (scripts/bootstrap_template.yaml) that are replaced at runtime.
+var tdBootstrapKeys = []string{"ENVOY_NODE_ID", "ENVOY_ZONE", "VPC_NETWORK_NAME", "CONFIG_PROJECT_NUMBER",
+	"ENVOY_ADMIN_PORT", "ENVOY_PORT", "XDS_SERVER_CERT", "TRACING_ENABLED"}
+
+var bootstrapVarRE = regexp.MustCompile(`\$\{([A-Za-z0-9_]+)\}`)
+
+// GenEnvoyBootstrap converts the TD bootstrap template to JSON, with placeholders for the runtime values.
+func GenEnvoyBootstrap(template []byte) ([]byte, error) {
+	repl := []string{"ACCESSLOG_PATH", "", "BACKEND_INBOUND_PORTS", ""}
+	for _, k := range tdBootstrapKeys {
+		repl = append(repl, k, "${"+k+"}")
+	}
+	data := strings.NewReplacer(repl...).Replace(string(template))
+
+	var y interface{}
+	if err := yaml.Unmarshal([]byte(data), &y); err != nil {
+		return nil, err
+	}
+	j, err := yamlToJSON(y)
+	if err != nil {
+		return nil, err
+	}
+	return json.MarshalIndent(j, "", "  ")
+}
+
+// GenGRPCBootstrap returns a gRPC bootstrap using the agent XDS proxy, with placeholders for the pod values.
+// The placeholders are expanded using the agent env.
+func GenGRPCBootstrap() ([]byte, error) {
+	b, err := GenerateBootstrap(GenerateBootstrapOptions{
+		Node: &Node{
+			Id: "sidecar~${INSTANCE_IP}~${POD_NAME}.${POD_NAMESPACE}~${POD_NAMESPACE}.svc.cluster.local",
+		},
+		XdsUdsPath: "./etc/istio/proxy/XDS",
+		CertDir:    "${OUTPUT_CERTS}",
+	}, map[string]string{
+		"GENERATOR":       "grpc",
+		"NAMESPACE":       "${POD_NAMESPACE}",
+		"INSTANCE_IPS":    "${INSTANCE_IP}",
+		"SERVICE_ACCOUNT": "${SERVICE_ACCOUNT}",
+		"CLUSTER_ID":      "${ISTIO_META_CLUSTER_ID}",
+	})
+	if err != nil {
+		return nil, err
+	}
+	return json.MarshalIndent(b, "", "  ")
+}
+
+// yaml.v2 decodes maps with interface{} keys, which can't be marshaled to JSON.
+func yamlToJSON(y interface{}) (interface{}, error) {
+	switch v := y.(type) {
+	case map[interface{}]interface{}:
+		m := map[string]interface{}{}
+		for k, e := range v {
+			ks, ok := k.(string)
+			if !ok {
+				return nil, fmt.Errorf("unsupported key %v", k)
+			}
+			c, err := yamlToJSON(e)
+			if err != nil {
+				return nil, err
+			}
+			m[ks] = c
+		}
+		return m, nil
+	case []interface{}:
+		for i, e := range v {
+			c, err := yamlToJSON(e)
+			if err != nil {
+				return nil, err
+			}
+			v[i] = c
+		}
+	}
+	return y, nil
+}
+
+// ExpandBootstrap replaces the ${NAME} placeholders in src using vars, then env variables, and writes the
+// result to dst. Unknown placeholders are replaced with an empty string.
+func ExpandBootstrap(src, dst string, vars map[string]string) error {
+	data, err := ioutil.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(dst, expandBootstrap(data, vars), 0644)
+}
+
+func expandBootstrap(data []byte, vars map[string]string) []byte {
+	return bootstrapVarRE.ReplaceAllFunc(data, func(m []byte) []byte {
+		k := string(m[2 : len(m)-1])
+		if v, f := vars[k]; f {
+			return []byte(v)
+		}
+		return []byte(os.Getenv(k))
+	})
+}
+
+// envVars converts a KEY=VALUE list to a map. Later entries override earlier ones.
+func envVars(env []string) map[string]string {
+	res := map[string]string{}
+	for _, e := range env {
+		kv := strings.SplitN(e, "=", 2)
+		if len(kv) == 2 {
+			res[kv[0]] = kv[1]
+		}
+	}
+	return res
+}
+
+// tdBootstrapVars returns the runtime values for the TD bootstrap.
+func (kr *KRun) tdBootstrapVars() map[string]string {
+	td := kr.TdSidecarEnv
+	return map[string]string{
+		"ENVOY_NODE_ID":         td.NodeID,
+		"ENVOY_ZONE":            td.EnvoyZone,
+		"VPC_NETWORK_NAME":      fmt.Sprintf("mesh:%s", td.MeshName),
+		"CONFIG_PROJECT_NUMBER": kr.ProjectNumber,
+		"ENVOY_PORT":            td.EnvoyPort,
+		"ENVOY_ADMIN_PORT":      td.EnvoyAdminPort,
+		"XDS_SERVER_CERT":       td.XdsServerCert,
+		"TRACING_ENABLED":       strconv.FormatBool(td.TracingEnabled),
+	}
+}
@@ -0,0 +1,67 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mesh
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestGenEnvoyBootstrap(t *testing.T) {
+	tmpl, err := ioutil.ReadFile("../../scripts/bootstrap_template.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := GenEnvoyBootstrap(tmpl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !json.Valid(data) {
+		t.Fatal("Invalid JSON", string(data))
+	}
+	if !strings.Contains(string(data), `"projects/${CONFIG_PROJECT_NUMBER}/networks/${VPC_NETWORK_NAME}/nodes/${ENVOY_NODE_ID}"`) {
+		t.Error("Missing node placeholders", string(data))
+	}
+
+	kr := New()
+	kr.ProjectNumber = "1234"
+	kr.TdSidecarEnv.NodeID = "node-1"
+	kr.TdSidecarEnv.MeshName = "mesh1"
+	res := string(expandBootstrap(data, kr.tdBootstrapVars()))
+	if !strings.Contains(res, `"projects/1234/networks/mesh:mesh1/nodes/node-1"`) || strings.Contains(res, "${") {
+		t.Error("Unexpected expansion", res)
+	}
+}
+
+func TestGenGRPCBootstrap(t *testing.T) {
+	data, err := GenGRPCBootstrap()
+	if err != nil {
+		t.Fatal(err)
+	}
+	res := expandBootstrap(data, envVars([]string{"POD_NAME=fortio-1", "POD_NAMESPACE=fortio", "INSTANCE_IP=10.1.1.1",
+		"OUTPUT_CERTS=/var/run/secrets/istio.io"}))
+	b := &Bootstrap{}
+	if err := json.Unmarshal(res, b); err != nil {
+		t.Fatal(err)
+	}
+	if b.Node.Id != "sidecar~10.1.1.1~fortio-1.fortio~fortio.svc.cluster.local" {
+		t.Error("Unexpected node", b.Node.Id)
+	}
+	if !strings.Contains(string(res), `"/var/run/secrets/istio.io/cert-chain.pem"`) {
+		t.Error("Unexpected cert dir", string(res))
+	}
+}
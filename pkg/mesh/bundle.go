@@ -0,0 +1,362 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mesh
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Offline bootstrap bundle.
+//
+// A bundle holds what a cold start normally reads from the config cluster - the merged mesh-env, the roots and
+// pre-minted K8S tokens for the CA and STS audiences - in a tarball signed with an ed25519 key. It can be baked into
+// the image or mounted as a secret, so instances can start when the K8S API is unreachable.
+//
+// - 'krun bundle keygen' creates the signing key and prints the public key.
+// - 'krun bundle create' runs the normal discovery and writes the bundle. Tokens are valid for -ttl (default 24h).
+// - 'krun bundle use' verifies a bundle and installs it in the default location.
+//
+// At startup the bundle is loaded from MESH_BUNDLE (default /var/lib/krun/bundle.tgz) if MESH_BUNDLE_KEY - the
+// PEM public key or a file holding it - is set. Bundles with an invalid signature are rejected. The bundle is only
+// used if the platform init or the mesh-env read fails, or with MESH_BUNDLE_MODE=offline. Expired tokens are not
+// used, the mesh-env and roots are.
+
+const (
+	bundleFile    = "bundle.json"
+	bundleSigFile = "bundle.sig"
+)
+
+// Bundle is the content of an offline bootstrap bundle.
+type Bundle struct {
+	Created time.Time `json:"created"`
+
+	// Expires is the expiration of the tokens.
+	Expires time.Time `json:"expires"`
+
+	ProjectId       string `json:"projectId,omitempty"`
+	ProjectNumber   string `json:"projectNumber,omitempty"`
+	ClusterName     string `json:"clusterName,omitempty"`
+	ClusterLocation string `json:"clusterLocation,omitempty"`
+	Namespace       string `json:"namespace,omitempty"`
+	Name            string `json:"name,omitempty"`
+	KSA             string `json:"ksa,omitempty"`
+	TrustDomain     string `json:"trustDomain,omitempty"`
+	MeshTenant      string `json:"meshTenant,omitempty"`
+
+	MeshEnv map[string]string `json:"meshEnv,omitempty"`
+
+	// Roots are the PEM roots of the mesh.
+	Roots []string `json:"roots,omitempty"`
+
+	// Tokens are K8S tokens for the KSA, by audience.
+	Tokens map[string]string `json:"tokens,omitempty"`
+}
+
+// TokenTTLProvider is optionally implemented by the TokenProvider, to create tokens with a longer lifetime.
+type TokenTTLProvider interface {
+	GetTokenTTL(ctx context.Context, aud string, ttl time.Duration) (string, error)
+}
+
+// NewBundle creates a bundle from the loaded config, with tokens for the audiences needed at startup and auds.
+func (kr *KRun) NewBundle(ctx context.Context, auds []string, ttl time.Duration) (*Bundle, error) {
+	if kr.TokenProvider == nil {
+		return nil, errors.New("no token provider")
+	}
+	b := &Bundle{
+		Created:         time.Now(),
+		Expires:         time.Now().Add(ttl),
+		ProjectId:       kr.ProjectId,
+		ProjectNumber:   kr.ProjectNumber,
+		ClusterName:     kr.ClusterName,
+		ClusterLocation: kr.ClusterLocation,
+		Namespace:       kr.Namespace,
+		Name:            kr.Name,
+		KSA:             kr.KSA,
+		TrustDomain:     kr.TrustDomain,
+		MeshTenant:      kr.MeshTenant,
+		MeshEnv:         kr.MeshEnv,
+		Roots:           kr.CARoots,
+		Tokens:          map[string]string{},
+	}
+	all := append([]string{kr.TrustDomain, kr.SelectCA().Audience}, auds...)
+	for a := range kr.Aud2File {
+		all = append(all, a)
+	}
+	for _, a := range all {
+		if a == "" || b.Tokens[a] != "" {
+			continue
+		}
+		var t string
+		var err error
+		if tp, ok := kr.TokenProvider.(TokenTTLProvider); ok {
+			t, err = tp.GetTokenTTL(ctx, a, ttl)
+		} else {
+			t, err = kr.TokenProvider.GetToken(ctx, a)
+		}
+		if err != nil {
+			return nil, errors.New("token for " + a + ": " + err.Error())
+		}
+		b.Tokens[a] = t
+	}
+	return b, nil
+}
+
+// WriteBundle writes the signed bundle as a gzip tarball.
+func WriteBundle(w io.Writer, b *Bundle, key ed25519.PrivateKey) error {
+	data, err := json.MarshalIndent(b, "", "  ")
+	if err != nil {
+		return err
+	}
+	sig := ed25519.Sign(key, data)
+	gw := gzip.NewWriter(w)
+	tw := tar.NewWriter(gw)
+	for _, f := range []struct {
+		name string
+		data []byte
+	}{{bundleFile, data}, {bundleSigFile, sig}} {
+		err := tw.WriteHeader(&tar.Header{Name: f.name, Mode: 0600, Size: int64(len(f.data)), ModTime: b.Created})
+		if err != nil {
+			return err
+		}
+		if _, err := tw.Write(f.data); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gw.Close()
+}
+
+// ReadBundle reads a bundle and verifies the signature.
+func ReadBundle(r io.Reader, pub ed25519.PublicKey) (*Bundle, error) {
+	gr, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	tr := tar.NewReader(gr)
+	var data, sig []byte
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		c, err := ioutil.ReadAll(io.LimitReader(tr, 1<<20))
+		if err != nil {
+			return nil, err
+		}
+		switch h.Name {
+		case bundleFile:
+			data = c
+		case bundleSigFile:
+			sig = c
+		}
+	}
+	if data == nil || sig == nil {
+		return nil, errors.New("invalid bundle, missing " + bundleFile + " or " + bundleSigFile)
+	}
+	if !ed25519.Verify(pub, data, sig) {
+		return nil, errors.New("invalid bundle signature")
+	}
+	b := &Bundle{}
+	if err := json.Unmarshal(data, b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// GenerateBundleKey returns a new signing key, and the public key - both PEM encoded.
+func GenerateBundleKey() ([]byte, []byte, error) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	pk, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		return nil, nil, err
+	}
+	pubk, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return nil, nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: pk}),
+		pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pubk}), nil
+}
+
+// ParseBundleKey parses a PEM ed25519 private key.
+func ParseBundleKey(data []byte) (ed25519.PrivateKey, error) {
+	blk, _ := pem.Decode(data)
+	if blk == nil {
+		return nil, errors.New("invalid PEM key")
+	}
+	k, err := x509.ParsePKCS8PrivateKey(blk.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	ek, ok := k.(ed25519.PrivateKey)
+	if !ok {
+		return nil, errors.New("expecting an ed25519 key")
+	}
+	return ek, nil
+}
+
+// ParseBundlePublicKey parses a PEM ed25519 public key.
+func ParseBundlePublicKey(data []byte) (ed25519.PublicKey, error) {
+	blk, _ := pem.Decode(data)
+	if blk == nil {
+		return nil, errors.New("invalid PEM public key")
+	}
+	k, err := x509.ParsePKIXPublicKey(blk.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	ek, ok := k.(ed25519.PublicKey)
+	if !ok {
+		return nil, errors.New("expecting an ed25519 public key")
+	}
+	return ek, nil
+}
+
+// BundlePath returns the location of the bundle.
+func (kr *KRun) BundlePath() string {
+	return kr.Config("MESH_BUNDLE", filepath.Join(kr.BaseDir, "/var/lib/krun/bundle.tgz"))
+}
+
+// BundlePublicKey returns the key from MESH_BUNDLE_KEY - PEM content or a file.
+func (kr *KRun) BundlePublicKey() (ed25519.PublicKey, error) {
+	k := kr.Config("MESH_BUNDLE_KEY", "")
+	if k == "" {
+		return nil, errors.New("MESH_BUNDLE_KEY not set")
+	}
+	data := []byte(k)
+	if !strings.Contains(k, "-----BEGIN") {
+		var err error
+		if data, err = ioutil.ReadFile(k); err != nil {
+			return nil, err
+		}
+	}
+	return ParseBundlePublicKey(data)
+}
+
+// LoadBundle reads and verifies the bundle, if present, and sets kr.Bundle. With MESH_BUNDLE_MODE=offline the
+// bundle is used right away.
+func (kr *KRun) LoadBundle() error {
+	f := kr.BundlePath()
+	data, err := ioutil.ReadFile(f)
+	if os.IsNotExist(err) && kr.Config("MESH_BUNDLE", "") == "" {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	pub, err := kr.BundlePublicKey()
+	if err != nil {
+		return err
+	}
+	b, err := ReadBundle(bytes.NewReader(data), pub)
+	if err != nil {
+		return errors.New(f + ": " + err.Error())
+	}
+	kr.Bundle = b
+	log.Println("Loaded bootstrap bundle", "file", f, "created", b.Created, "expires", b.Expires)
+	if kr.Config("MESH_BUNDLE_MODE", "") == "offline" {
+		kr.UseBundle()
+	}
+	return nil
+}
+
+// UseBundle applies the bundle values that are not set explicitly, and uses the bundle tokens if there is no token
+// provider. Returns false if no bundle was loaded.
+func (kr *KRun) UseBundle() bool {
+	b := kr.Bundle
+	if b == nil {
+		return false
+	}
+	if kr.bundleActive {
+		return true
+	}
+	kr.bundleActive = true
+	for dst, v := range map[*string]string{
+		&kr.ProjectId:       b.ProjectId,
+		&kr.ProjectNumber:   b.ProjectNumber,
+		&kr.ClusterName:     b.ClusterName,
+		&kr.ClusterLocation: b.ClusterLocation,
+		&kr.Namespace:       b.Namespace,
+		&kr.Name:            b.Name,
+		&kr.KSA:             b.KSA,
+		&kr.TrustDomain:     b.TrustDomain,
+		&kr.MeshTenant:      b.MeshTenant,
+	} {
+		if *dst == "" {
+			*dst = v
+		}
+	}
+	for _, r := range b.Roots {
+		if !contains(kr.CARoots, r) {
+			kr.CARoots = append(kr.CARoots, r)
+		}
+	}
+	if kr.TokenProvider == nil {
+		if time.Now().After(b.Expires) {
+			log.Println("Bootstrap bundle tokens expired", "expires", b.Expires)
+		} else {
+			kr.TokenProvider = b
+		}
+	}
+	log.Println("Using bootstrap bundle", "created", b.Created)
+	return true
+}
+
+// bundleMeshEnv applies the mesh-env from the bundle, if it is in use.
+func (kr *KRun) bundleMeshEnv() bool {
+	if !kr.bundleActive || len(kr.Bundle.MeshEnv) == 0 {
+		return false
+	}
+	d := map[string]string{}
+	for k, v := range kr.Bundle.MeshEnv {
+		d[k] = v
+	}
+	return kr.initFromMeshEnv(d) == nil
+}
+
+// GetToken returns the pre-minted token for the audience, until the bundle expires.
+func (b *Bundle) GetToken(ctx context.Context, aud string) (string, error) {
+	if time.Now().After(b.Expires) {
+		return "", errors.New("bootstrap bundle expired")
+	}
+	t := b.Tokens[aud]
+	if t == "" {
+		return "", errors.New("no bundle token for " + aud)
+	}
+	return t, nil
+}
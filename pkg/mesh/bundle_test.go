@@ -0,0 +1,109 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mesh
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestBundle(t *testing.T) {
+	privPEM, pubPEM, err := GenerateBundleKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	priv, err := ParseBundleKey(privPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, err := ParseBundlePublicKey(pubPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &Bundle{
+		Created:   time.Now(),
+		Expires:   time.Now().Add(time.Hour),
+		Namespace: "test",
+		MeshEnv:   map[string]string{"CLUSTER_NAME": "c1"},
+		Roots:     []string{"root"},
+		Tokens:    map[string]string{"aud": "token"},
+	}
+	buf := &bytes.Buffer{}
+	if err := WriteBundle(buf, b, priv); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+
+	b1, err := ReadBundle(bytes.NewReader(data), pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b1.Namespace != "test" || b1.Tokens["aud"] != "token" {
+		t.Error("Unexpected bundle", b1)
+	}
+
+	_, otherPub, _ := GenerateBundleKey()
+	other, _ := ParseBundlePublicKey(otherPub)
+	if _, err := ReadBundle(bytes.NewReader(data), other); err == nil {
+		t.Error("Expecting signature error with a different key")
+	}
+
+	t.Run("use", func(t *testing.T) {
+		dir := t.TempDir()
+		f := filepath.Join(dir, "bundle.tgz")
+		ioutil.WriteFile(f, data, 0600)
+		os.Setenv("MESH_BUNDLE", f)
+		defer os.Unsetenv("MESH_BUNDLE")
+		os.Setenv("MESH_BUNDLE_KEY", string(pubPEM))
+		defer os.Unsetenv("MESH_BUNDLE_KEY")
+
+		kr := New()
+		kr.Namespace = ""
+		if err := kr.LoadBundle(); err != nil {
+			t.Fatal(err)
+		}
+		if !kr.UseBundle() {
+			t.Fatal("Bundle not used")
+		}
+		if kr.Namespace != "test" || len(kr.CARoots) == 0 {
+			t.Error("Bundle not applied", kr.Namespace, kr.CARoots)
+		}
+		if !kr.bundleMeshEnv() || kr.ClusterName != "c1" {
+			t.Error("Bundle mesh-env not applied", kr.ClusterName)
+		}
+		tok, err := kr.TokenProvider.GetToken(context.Background(), "aud")
+		if err != nil || tok != "token" {
+			t.Error("Unexpected token", tok, err)
+		}
+	})
+
+	t.Run("expired", func(t *testing.T) {
+		b.Expires = time.Now().Add(-time.Minute)
+		if _, err := b.GetToken(context.Background(), "aud"); err == nil {
+			t.Error("Expecting error for expired bundle")
+		}
+		kr := New()
+		kr.Bundle = b
+		kr.UseBundle()
+		if kr.TokenProvider != nil {
+			t.Error("Expired bundle used as token provider")
+		}
+	})
+}
@@ -0,0 +1,77 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mesh
+
+import (
+	"strings"
+)
+
+// CA selection for the workload certificates, from mesh-env or env.
+//
+// MESH_CA selects the CA:
+// - meshca - meshca.googleapis.com, using the trust domain as token audience. Default if MESH_TENANT is set.
+// - istiod - the in-cluster Citadel, using the XDS address. Default without MESH_TENANT.
+// - //privateca.googleapis.com/projects/PROJECT/locations/LOCATION/caPools/POOL - CAS pool, certificates are
+//   signed by krun (same as CA_POOL) and loaded by the agent from files.
+// - HOST:PORT - an Istio-compatible CA at the address.
+//
+// MESH_CA_AUDIENCE overrides the audience of the token used to authenticate with the CA. OSS Istio
+// (OSS_ISTIO set) defaults to 'istio-ca', all others to the trust domain.
+
+// CASelection is the CA used by the agent.
+type CASelection struct {
+	// Name is meshca, istiod, cas or custom.
+	Name string
+
+	// Addr is set as CA_ADDR, if not empty.
+	Addr string
+
+	// Provider is set as CA_PROVIDER, if not empty.
+	Provider string
+
+	// Pool is the CAS pool, for the cas CA.
+	Pool string
+
+	// Audience of the token sent to the CA.
+	Audience string
+}
+
+// SelectCA returns the CA to use, based on the mesh-env settings.
+func (kr *KRun) SelectCA() *CASelection {
+	def := "istiod"
+	if kr.MeshTenant != "" && kr.MeshTenant != "-" {
+		def = "meshca"
+	}
+	ca := parseCASelection(kr.Config("MESH_CA", def))
+	ca.Audience = kr.TrustDomain
+	if ca.Name == "istiod" && kr.Config("OSS_ISTIO", "") != "" {
+		ca.Audience = "istio-ca"
+	}
+	ca.Audience = kr.Config("MESH_CA_AUDIENCE", ca.Audience)
+	return ca
+}
+
+func parseCASelection(s string) *CASelection {
+	switch {
+	case s == "meshca":
+		return &CASelection{Name: s, Addr: "meshca.googleapis.com:443", Provider: "GoogleCA"}
+	case s == "istiod" || s == "citadel":
+		return &CASelection{Name: "istiod"}
+	case strings.HasPrefix(s, "//privateca.googleapis.com/"):
+		return &CASelection{Name: "cas", Pool: s, Provider: "GoogleGkeWorkloadCertificate"}
+	default:
+		return &CASelection{Name: "custom", Addr: s}
+	}
+}
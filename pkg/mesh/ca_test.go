@@ -0,0 +1,50 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mesh
+
+import (
+	"testing"
+)
+
+func TestSelectCA(t *testing.T) {
+	kr := New()
+	kr.TrustDomain = "p.svc.id.goog"
+	kr.MeshTenant = "p-tenant"
+	ca := kr.SelectCA()
+	if ca.Name != "meshca" || ca.Addr != "meshca.googleapis.com:443" || ca.Audience != "p.svc.id.goog" {
+		t.Error("Expecting meshca with MESH_TENANT", ca)
+	}
+
+	kr.MeshTenant = "-"
+	kr.MeshEnv = map[string]string{"OSS_ISTIO": "1"}
+	ca = kr.SelectCA()
+	if ca.Name != "istiod" || ca.Addr != "" || ca.Audience != "istio-ca" {
+		t.Error("Expecting istiod with istio-ca audience", ca)
+	}
+
+	kr.MeshEnv = map[string]string{
+		"MESH_CA":          "//privateca.googleapis.com/projects/p/locations/us-central1/caPools/mesh",
+		"MESH_CA_AUDIENCE": "custom-aud",
+	}
+	ca = kr.SelectCA()
+	if ca.Name != "cas" || ca.Pool != "//privateca.googleapis.com/projects/p/locations/us-central1/caPools/mesh" ||
+		ca.Audience != "custom-aud" {
+		t.Error("Expecting CAS pool", ca)
+	}
+
+	if ca = parseCASelection("ca.example.com:15012"); ca.Name != "custom" || ca.Addr != "ca.example.com:15012" {
+		t.Error("Expecting custom CA", ca)
+	}
+}
@@ -0,0 +1,214 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mesh
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Capture diagnostics - answers "is the traffic going through the mesh ?".
+//
+// The connection tracking table is summarized by original destination and verdict:
+// - envoy - redirected to the Envoy outbound port (15001).
+// - policy - redirected to the egress policy proxy (EGRESS_PORT).
+// - direct - not redirected: excluded ranges or ports, and the upstream connections of Envoy itself.
+// - unreplied - no packets received from the destination: blocked by a firewall, unreachable or still connecting.
+//
+// The counters of the nat and filter rules in the ISTIO_ and KRUN_ chains show if the capture rules are installed
+// and used. Requires root and the 2nd gen execution environment - gVisor doesn't expose connection tracking.
+//
+// Available as 'krun diag capture' and on the debug port as /debug/capture.
+
+// conntrackFile is the kernel connection tracking table. If missing, 'conntrack -L' is used.
+var conntrackFile = "/proc/net/nf_conntrack"
+
+// CaptureDest is a summary of the connections to one destination.
+type CaptureDest struct {
+	Proto   string `json:"proto"`
+	Dst     string `json:"dst"`
+	Verdict string `json:"verdict"`
+	Count   int    `json:"count"`
+}
+
+// CaptureReport is the result of the capture diagnostics.
+type CaptureReport struct {
+	Time  time.Time      `json:"time"`
+	Dests []*CaptureDest `json:"dests,omitempty"`
+
+	// Rules are the iptables rules for the capture, with the packet and byte counters.
+	Rules []string `json:"rules,omitempty"`
+
+	Errors []string `json:"errors,omitempty"`
+}
+
+// CaptureReport summarizes the outbound connections of the instance.
+func (kr *KRun) CaptureReport() *CaptureReport {
+	res := &CaptureReport{Time: time.Now()}
+	ct, err := readConntrack()
+	if err != nil {
+		res.Errors = append(res.Errors, "conntrack: "+err.Error())
+	} else {
+		res.Dests = summarizeConntrack(bytes.NewReader(ct), localAddrs(), "15001", kr.Config("EGRESS_PORT", "15081"))
+	}
+	for _, t := range []string{"nat", "filter"} {
+		out, err := exec.Command("iptables-save", "-c", "-t", t).CombinedOutput()
+		if err != nil {
+			res.Errors = append(res.Errors, "iptables "+t+": "+strings.TrimSpace(string(out))+" "+err.Error())
+			continue
+		}
+		res.Rules = append(res.Rules, captureRules(bytes.NewReader(out))...)
+	}
+	return res
+}
+
+func (kr *KRun) handleCapture(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("content-type", "application/json")
+	e := json.NewEncoder(w)
+	e.SetIndent("", "  ")
+	e.Encode(kr.CaptureReport())
+}
+
+func readConntrack() ([]byte, error) {
+	if data, err := os.ReadFile(conntrackFile); err == nil {
+		return data, nil
+	}
+	out, err := exec.Command("conntrack", "-L").Output()
+	if err != nil {
+		return nil, errors.New("connection tracking not available, " + conntrackFile + " and conntrack -L failed: " + err.Error())
+	}
+	return out, nil
+}
+
+// localAddrs returns the addresses of the instance - connections to them are inbound.
+func localAddrs() map[string]bool {
+	res := map[string]bool{}
+	addrs, _ := net.InterfaceAddrs()
+	for _, a := range addrs {
+		if ipn, ok := a.(*net.IPNet); ok {
+			res[ipn.IP.String()] = true
+		}
+	}
+	return res
+}
+
+// summarizeConntrack parses the conntrack table - /proc/net/nf_conntrack or 'conntrack -L' format - and counts the
+// outbound connections by destination and verdict. The first src/dst pair of a line is the original direction, the
+// second is the expected reply - for redirected connections the reply comes from the redirect port.
+func summarizeConntrack(r io.Reader, local map[string]bool, envoyPort, egressPort string) []*CaptureDest {
+	byKey := map[string]*CaptureDest{}
+	s := bufio.NewScanner(r)
+	s.Buffer(make([]byte, 64*1024), 1024*1024)
+	for s.Scan() {
+		f := strings.Fields(s.Text())
+		proto := ""
+		var orig, reply map[string]string
+		unreplied := false
+		for _, t := range f {
+			switch t {
+			case "tcp", "udp", "icmp", "sctp":
+				if proto == "" {
+					proto = t
+				}
+				continue
+			case "[UNREPLIED]":
+				unreplied = true
+				continue
+			}
+			kv := strings.SplitN(t, "=", 2)
+			if len(kv) != 2 {
+				continue
+			}
+			if kv[0] == "src" {
+				if orig == nil {
+					orig = map[string]string{}
+				} else if reply == nil {
+					reply = map[string]string{}
+				}
+			}
+			cur := reply
+			if cur == nil {
+				cur = orig
+			}
+			if cur != nil {
+				if _, f := cur[kv[0]]; !f {
+					cur[kv[0]] = kv[1]
+				}
+			}
+		}
+		if proto == "" || orig == nil || reply == nil {
+			continue
+		}
+		dst := orig["dst"]
+		if local[dst] || strings.HasPrefix(dst, "127.") || dst == "::1" {
+			continue
+		}
+		verdict := "direct"
+		switch {
+		case unreplied:
+			verdict = "unreplied"
+		case reply["sport"] == envoyPort && reply["src"] != dst:
+			verdict = "envoy"
+		case reply["sport"] == egressPort && reply["src"] != dst:
+			verdict = "policy"
+		}
+		if p := orig["dport"]; p != "" {
+			dst = net.JoinHostPort(dst, p)
+		}
+		k := proto + " " + dst + " " + verdict
+		d := byKey[k]
+		if d == nil {
+			d = &CaptureDest{Proto: proto, Dst: dst, Verdict: verdict}
+			byKey[k] = d
+		}
+		d.Count++
+	}
+	res := []*CaptureDest{}
+	for _, d := range byKey {
+		res = append(res, d)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].Count != res[j].Count {
+			return res[i].Count > res[j].Count
+		}
+		return res[i].Dst+res[i].Verdict < res[j].Dst+res[j].Verdict
+	})
+	return res
+}
+
+// captureRules returns the rules in the ISTIO_ and KRUN_ chains - and the jumps to them - from iptables-save -c.
+func captureRules(r io.Reader) []string {
+	res := []string{}
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		l := s.Text()
+		if strings.Contains(l, "ISTIO_") || strings.Contains(l, "KRUN_") {
+			if strings.HasPrefix(l, "[") {
+				res = append(res, l)
+			}
+		}
+	}
+	return res
+}
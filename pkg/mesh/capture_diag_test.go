@@ -0,0 +1,67 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mesh
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSummarizeConntrack(t *testing.T) {
+	ct := `ipv4     2 tcp      6 431999 ESTABLISHED src=10.8.0.2 dst=10.1.2.3 sport=40000 dport=80 src=127.0.0.1 dst=10.8.0.2 sport=15001 dport=40000 [ASSURED] mark=0 zone=0 use=2
+ipv4     2 tcp      6 431999 ESTABLISHED src=10.8.0.2 dst=10.1.2.3 sport=40001 dport=80 src=127.0.0.1 dst=10.8.0.2 sport=15001 dport=40001 [ASSURED] mark=0 zone=0 use=2
+ipv4     2 tcp      6 431999 ESTABLISHED src=10.8.0.2 dst=142.250.1.1 sport=40002 dport=443 src=142.250.1.1 dst=10.8.0.2 sport=443 dport=40002 [ASSURED] mark=0 zone=0 use=2
+ipv4     2 tcp      6 119 SYN_SENT src=10.8.0.2 dst=10.9.0.1 sport=40003 dport=5432 [UNREPLIED] src=10.9.0.1 dst=10.8.0.2 sport=5432 dport=40003 mark=0 zone=0 use=2
+tcp      6 431999 ESTABLISHED src=10.8.0.2 dst=93.184.216.34 sport=40004 dport=443 src=127.0.0.1 dst=10.8.0.2 sport=15081 dport=40004 [ASSURED] mark=0 use=1
+ipv4     2 tcp      6 431999 ESTABLISHED src=10.0.0.5 dst=10.8.0.2 sport=50000 dport=8080 src=10.8.0.2 dst=10.0.0.5 sport=8080 dport=50000 [ASSURED] mark=0 zone=0 use=2
+ipv4     2 tcp      6 431999 ESTABLISHED src=127.0.0.1 dst=127.0.0.1 sport=50001 dport=15000 src=127.0.0.1 dst=127.0.0.1 sport=15000 dport=50001 [ASSURED] mark=0 zone=0 use=2
+`
+	res := summarizeConntrack(strings.NewReader(ct), map[string]bool{"10.8.0.2": true}, "15001", "15081")
+	got := map[string]*CaptureDest{}
+	for _, d := range res {
+		got[d.Dst] = d
+	}
+	if len(res) != 4 {
+		t.Fatal("Unexpected destinations", len(res), got)
+	}
+	if d := got["10.1.2.3:80"]; d == nil || d.Verdict != "envoy" || d.Count != 2 || res[0] != d {
+		t.Error("Expecting envoy", d)
+	}
+	if d := got["142.250.1.1:443"]; d == nil || d.Verdict != "direct" {
+		t.Error("Expecting direct", d)
+	}
+	if d := got["10.9.0.1:5432"]; d == nil || d.Verdict != "unreplied" {
+		t.Error("Expecting unreplied", d)
+	}
+	if d := got["93.184.216.34:443"]; d == nil || d.Verdict != "policy" {
+		t.Error("Expecting policy", d)
+	}
+}
+
+func TestCaptureRules(t *testing.T) {
+	save := `# Generated by iptables-save
+*nat
+:PREROUTING ACCEPT [10:600]
+:ISTIO_OUTPUT - [0:0]
+[12:720] -A OUTPUT -p tcp -j ISTIO_OUTPUT
+[3:180] -A ISTIO_OUTPUT -d 10.0.0.0/8 -j ISTIO_REDIRECT
+[0:0] -A DOCKER -j RETURN
+COMMIT
+`
+	r := captureRules(strings.NewReader(save))
+	if len(r) != 2 || !strings.HasPrefix(r[1], "[3:180]") {
+		t.Error("Unexpected rules", r)
+	}
+}
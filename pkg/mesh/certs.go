@@ -1,6 +1,7 @@
 package mesh
 
 import (
+	"bytes"
 	"context"
 	"crypto"
 	"crypto/ecdsa"
@@ -55,7 +56,7 @@ func (kr *KRun) InitCertificates(ctx context.Context, outDir string) error {
 
 			exp := kp.Leaf.NotAfter.Sub(time.Now())
 			if exp > -5*time.Minute {
-				kr.X509KeyPair = &kp
+				kr.setWorkloadCertificate(&kp)
 				log.Println("Existing Cert", "expires", exp)
 				return nil
 			}
@@ -76,8 +77,6 @@ func (kr *KRun) InitCertificates(ctx context.Context, outDir string) error {
 	certChain := strings.Join(chain, "\n")
 
 	kp, err := tls.X509KeyPair([]byte(certChain), privPEM)
-	kr.X509KeyPair = &kp
-
 	if err == nil && len(kp.Certificate) > 0 {
 		kp.Leaf, _ = x509.ParseCertificate(kp.Certificate[0])
 
@@ -86,6 +85,8 @@ func (kr *KRun) InitCertificates(ctx context.Context, outDir string) error {
 			log.Println("New Cert", "expires", kp.Leaf.NotAfter, "signer", r.Subject)
 		}
 	}
+	// Published after the leaf is parsed - the certificate is not modified once set.
+	kr.setWorkloadCertificate(&kp)
 	if !kr.SkipSaveCerts && outDir != "" {
 		os.MkdirAll(outDir, 0755)
 		err = ioutil.WriteFile(keyFile, privPEM, 0660)
@@ -108,6 +109,28 @@ func (kr *KRun) InitCertificates(ctx context.Context, outDir string) error {
 	return err
 }
 
+// WorkloadCertificate returns the current workload certificate. Safe to call while the certificate is renewed.
+func (kr *KRun) WorkloadCertificate() *tls.Certificate {
+	kr.certM.RLock()
+	defer kr.certM.RUnlock()
+	return kr.X509KeyPair
+}
+
+func (kr *KRun) setWorkloadCertificate(kp *tls.Certificate) {
+	kr.certM.Lock()
+	kr.X509KeyPair = kp
+	kr.certM.Unlock()
+}
+
+// sameCertificate returns true if the leaf certificates are the same - the pointers change each time the
+// certificate is loaded.
+func sameCertificate(a, b *tls.Certificate) bool {
+	if a == nil || b == nil || len(a.Certificate) == 0 || len(b.Certificate) == 0 {
+		return a == b
+	}
+	return bytes.Equal(a.Certificate[0], b.Certificate[0])
+}
+
 //func (kr *KRun) SaveCerts(outDir string) error {
 //	if kr.X509KeyPair == nil {
 //		return nil
@@ -0,0 +1,177 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mesh
+
+import (
+	"errors"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Cloud SQL Auth Proxy support.
+//
+// CLOUDSQL_INSTANCES is a comma separated list of instances, in the proxy -instances format:
+// PROJECT:REGION:INSTANCE=tcp:PORT listens on 127.0.0.1:PORT, PROJECT:REGION:INSTANCE uses a unix socket in
+// CLOUDSQL_DIR (default /cloudsql).
+//
+// The proxy (CLOUDSQL_PROXY, default /usr/local/bin/cloud_sql_proxy) is started before the app and restarted if it
+// exits. The app is started only after all listeners are ready, or CLOUDSQL_STARTUP_TIMEOUT (default 30s) expires.
+//
+// When running as root the proxy runs as uid 1337, so its connections to the instances (port 3307) and to the
+// SQL Admin API are not captured by Envoy.
+
+// CloudSQLInstance is an instance from CLOUDSQL_INSTANCES.
+type CloudSQLInstance struct {
+	Name string
+
+	// Addr is the TCP listener, or empty if a unix socket is used.
+	Addr string
+}
+
+// ParseCloudSQLInstances parses the CLOUDSQL_INSTANCES value.
+func ParseCloudSQLInstances(s string) []*CloudSQLInstance {
+	res := []*CloudSQLInstance{}
+	for _, i := range splitList(s) {
+		inst := &CloudSQLInstance{Name: i}
+		if p := strings.Index(i, "="); p > 0 {
+			inst.Name = i[0:p]
+			opt := i[p+1:]
+			if strings.HasPrefix(opt, "tcp:") {
+				inst.Addr = opt[4:]
+				if !strings.Contains(inst.Addr, ":") {
+					inst.Addr = "127.0.0.1:" + inst.Addr
+				}
+			}
+		}
+		res = append(res, inst)
+	}
+	return res
+}
+
+// StartCloudSQLProxy starts the proxy if CLOUDSQL_INSTANCES is set, and waits for it to be ready.
+func (kr *KRun) StartCloudSQLProxy() error {
+	instances := kr.Config("CLOUDSQL_INSTANCES", "")
+	if instances == "" {
+		return nil
+	}
+	insts := ParseCloudSQLInstances(instances)
+	bin := kr.Config("CLOUDSQL_PROXY", "/usr/local/bin/cloud_sql_proxy")
+	dir := kr.Config("CLOUDSQL_DIR", "/cloudsql")
+	args := []string{"-instances=" + strings.Join(splitList(instances), ",")}
+	for _, i := range insts {
+		if i.Addr == "" {
+			os.MkdirAll(dir, 0777)
+			args = append(args, "-dir="+dir)
+			break
+		}
+	}
+	if _, err := os.Stat(bin); err != nil {
+		return err
+	}
+
+	t0 := time.Now()
+	go kr.superviseCloudSQLProxy(bin, args)
+
+	timeout, err := time.ParseDuration(kr.Config("CLOUDSQL_STARTUP_TIMEOUT", "30s"))
+	if err != nil {
+		timeout = 30 * time.Second
+	}
+	deadline := t0.Add(timeout)
+	for _, i := range insts {
+		if i.Addr != "" {
+			err = waitTCP(i.Addr, deadline)
+		} else {
+			err = waitFile(filepath.Join(dir, i.Name), deadline)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	log.Println("Cloud SQL proxy ready", "instances", len(insts), "time", time.Since(t0))
+	return nil
+}
+
+// superviseCloudSQLProxy runs the proxy, restarting it with a backoff if it exits.
+func (kr *KRun) superviseCloudSQLProxy(bin string, args []string) {
+	backoff := 1 * time.Second
+	idx := -1
+	for {
+		cmd := exec.Command(bin, args...)
+		cmd.Env = os.Environ()
+		cmd.Stdout = kr.LogWriter("cloudsql", os.Stdout)
+		cmd.Stderr = kr.LogWriter("cloudsql", os.Stderr)
+		cred, err := kr.childCredential("cloudsql", "1337:1337")
+		if err != nil {
+			log.Println("Invalid Cloud SQL proxy user", err)
+			closeLogWriters(cmd)
+			return
+		}
+		if cred != nil {
+			cmd.SysProcAttr = &syscall.SysProcAttr{Credential: cred}
+		}
+		t0 := time.Now()
+		err = kr.startChild(cmd)
+		if err == nil {
+			if idx < 0 {
+				idx = len(kr.Children)
+				kr.Children = append(kr.Children, cmd)
+			} else {
+				kr.Children[idx] = cmd
+			}
+			err = cmd.Wait()
+		}
+		closeLogWriters(cmd)
+		log.Println("Cloud SQL proxy exited", "err", err, "uptime", time.Since(t0))
+		if time.Since(t0) > time.Minute {
+			backoff = 1 * time.Second
+		}
+		time.Sleep(backoff)
+		if backoff < 30*time.Second {
+			backoff = backoff * 2
+		}
+	}
+}
+
+func waitTCP(addr string, deadline time.Time) error {
+	for {
+		c, err := net.DialTimeout("tcp", addr, time.Second)
+		if err == nil {
+			c.Close()
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return err
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func waitFile(name string, deadline time.Time) error {
+	for {
+		if _, err := os.Stat(name); err == nil {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return errors.New("timeout waiting for " + name)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
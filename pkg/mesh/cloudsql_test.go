@@ -0,0 +1,35 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mesh
+
+import (
+	"testing"
+)
+
+func TestParseCloudSQLInstances(t *testing.T) {
+	insts := ParseCloudSQLInstances("p:us-central1:db=tcp:5432, p:us-central1:db2=tcp:0.0.0.0:3306,p:us-east1:db3")
+	if len(insts) != 3 {
+		t.Fatal("Expecting 3 instances", insts)
+	}
+	if insts[0].Name != "p:us-central1:db" || insts[0].Addr != "127.0.0.1:5432" {
+		t.Error("Unexpected instance", insts[0])
+	}
+	if insts[1].Addr != "0.0.0.0:3306" {
+		t.Error("Unexpected instance", insts[1])
+	}
+	if insts[2].Name != "p:us-east1:db3" || insts[2].Addr != "" {
+		t.Error("Expecting unix socket", insts[2])
+	}
+}
@@ -0,0 +1,81 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mesh
+
+import (
+	"io/ioutil"
+	"math"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// cgroupRoot is the mount point of the cgroup filesystem.
+var cgroupRoot = "/sys/fs/cgroup"
+
+// EstimatedConcurrency returns the number of Envoy worker threads, passed to pilot-agent as --concurrency.
+// Like the injection template, it is derived from the proxy CPU allocation:
+// - the sidecar.istio.io/proxyCPU annotation
+// - PROXY_CONCURRENCY, if set explicitly
+// - the CPU limit of the container, from the cgroup (CloudRun CPU allocation), rounded up.
+//
+// Returns 0 if the allocation is not known - Envoy will use the number of cores on the host, which may be far
+// larger than the instance allocation.
+func (kr *KRun) EstimatedConcurrency() int {
+	if c := proxyCPUConcurrency(kr.annotation(annoProxyCPU, "")); c > 0 {
+		return c
+	}
+	if c, err := strconv.Atoi(kr.Config("PROXY_CONCURRENCY", "")); err == nil && c > 0 {
+		return c
+	}
+	if cpu := cgroupCPULimit(cgroupRoot); cpu > 0 {
+		return int(math.Ceil(cpu))
+	}
+	return 0
+}
+
+// cgroupCPULimit returns the CPU quota in cores, or 0 if there is no limit.
+// Supports cgroup v2 (cpu.max) and v1 (cpu.cfs_quota_us and cpu.cfs_period_us).
+func cgroupCPULimit(root string) float64 {
+	if data, err := ioutil.ReadFile(filepath.Join(root, "cpu.max")); err == nil {
+		// "max 100000" or "200000 100000"
+		f := strings.Fields(string(data))
+		if len(f) != 2 || f[0] == "max" {
+			return 0
+		}
+		return cpuQuota(f[0], f[1])
+	}
+	quota, err := ioutil.ReadFile(filepath.Join(root, "cpu", "cpu.cfs_quota_us"))
+	if err != nil {
+		return 0
+	}
+	period, err := ioutil.ReadFile(filepath.Join(root, "cpu", "cpu.cfs_period_us"))
+	if err != nil {
+		return 0
+	}
+	return cpuQuota(strings.TrimSpace(string(quota)), strings.TrimSpace(string(period)))
+}
+
+func cpuQuota(quota, period string) float64 {
+	q, err := strconv.ParseFloat(quota, 64)
+	if err != nil || q <= 0 { // -1 is 'no limit' in v1
+		return 0
+	}
+	p, err := strconv.ParseFloat(period, 64)
+	if err != nil || p <= 0 {
+		return 0
+	}
+	return q / p
+}
@@ -0,0 +1,68 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mesh
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCgroupCPULimit(t *testing.T) {
+	v2 := t.TempDir()
+	ioutil.WriteFile(filepath.Join(v2, "cpu.max"), []byte("150000 100000\n"), 0644)
+	if c := cgroupCPULimit(v2); c != 1.5 {
+		t.Error("Unexpected v2 limit", c)
+	}
+	ioutil.WriteFile(filepath.Join(v2, "cpu.max"), []byte("max 100000\n"), 0644)
+	if c := cgroupCPULimit(v2); c != 0 {
+		t.Error("Expecting no limit", c)
+	}
+
+	v1 := t.TempDir()
+	os.MkdirAll(filepath.Join(v1, "cpu"), 0755)
+	ioutil.WriteFile(filepath.Join(v1, "cpu", "cpu.cfs_quota_us"), []byte("200000\n"), 0644)
+	ioutil.WriteFile(filepath.Join(v1, "cpu", "cpu.cfs_period_us"), []byte("100000\n"), 0644)
+	if c := cgroupCPULimit(v1); c != 2 {
+		t.Error("Unexpected v1 limit", c)
+	}
+	ioutil.WriteFile(filepath.Join(v1, "cpu", "cpu.cfs_quota_us"), []byte("-1\n"), 0644)
+	if c := cgroupCPULimit(v1); c != 0 {
+		t.Error("Expecting no limit", c)
+	}
+}
+
+func TestEstimatedConcurrency(t *testing.T) {
+	root := t.TempDir()
+	ioutil.WriteFile(filepath.Join(root, "cpu.max"), []byte("100000 100000\n"), 0644)
+	old := cgroupRoot
+	cgroupRoot = root
+	defer func() { cgroupRoot = old }()
+
+	kr := New()
+	if c := kr.EstimatedConcurrency(); c != 1 {
+		t.Error("Expecting concurrency from cgroup", c)
+	}
+	os.Setenv("PROXY_CONCURRENCY", "3")
+	defer os.Unsetenv("PROXY_CONCURRENCY")
+	if c := kr.EstimatedConcurrency(); c != 3 {
+		t.Error("Expecting PROXY_CONCURRENCY", c)
+	}
+	kr.Annotations[annoProxyCPU] = "4"
+	if c := kr.EstimatedConcurrency(); c != 4 {
+		t.Error("Expecting proxyCPU annotation", c)
+	}
+}
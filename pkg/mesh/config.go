@@ -0,0 +1,457 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mesh
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Settings are resolved by Config, using the first source with a non-empty value:
+//
+// - flag - set with SetFlagConfig, from the command line.
+// - env  - environment variables of the krun process.
+// - mesh-env - the config map loaded from the config cluster (or the mesh URL).
+// - file - settings loaded from a local config file, with SetFileConfig.
+//
+// Local keys are not read from mesh-env: the binaries, commands, users and digests krun runs with must come from the
+// deployment, not from a config map that namespace users may edit. The APP_N_ and MESH_USER_ settings are always
+// local.
+//
+// Keys are declared in ConfigKeys, with the type and default - ValidateConfig checks the effective values at startup,
+// and /debug/config returns the effective config and the source of each value.
+
+// Source names, as reported by ConfigSource.
+const (
+	SourceFlag    = "flag"
+	SourceEnv     = "env"
+	SourceMeshEnv = "mesh-env"
+	SourceFile    = "file"
+	SourceDefault = "default"
+)
+
+// Config types, used for validation.
+const (
+	TypeString   = ""
+	TypeBool     = "bool"
+	TypeInt      = "int"
+	TypeDuration = "duration"
+	TypeURL      = "url"
+	TypeHostPort = "hostport"
+)
+
+// ConfigKey declares a setting.
+type ConfigKey struct {
+	Name    string
+	Type    string
+	Default string
+
+	// Values is the list of allowed values, if not empty. The empty string is always allowed.
+	Values []string
+
+	// Local settings are ignored in mesh-env.
+	Local bool
+
+	Doc string
+}
+
+// ConfigKeys are the declared settings. Undeclared keys can still be used with Config, they are not validated.
+var ConfigKeys = map[string]*ConfigKey{}
+
+// DeclareConfig adds settings to ConfigKeys.
+func DeclareConfig(keys ...*ConfigKey) {
+	for _, k := range keys {
+		ConfigKeys[k.Name] = k
+	}
+}
+
+func init() {
+	DeclareConfig(
+		&ConfigKey{Name: "MESH", Type: TypeURL, Doc: "Location of the mesh config"},
+		&ConfigKey{Name: "XDS_ADDR", Type: TypeHostPort, Doc: "XDS server address, skips discovery"},
+		&ConfigKey{Name: "MESH_DEBUG", Type: TypeBool},
+		&ConfigKey{Name: "MESH_DEBUG_ADDR", Default: "127.0.0.1:15030", Doc: "Debug server address, '-' to disable"},
+		&ConfigKey{Name: "MESH_MODE", Values: []string{"ambient"}},
+		&ConfigKey{Name: "MESH_LOCAL", Type: TypeBool},
+		&ConfigKey{Name: "MESH_DRY_RUN", Type: TypeBool},
+		&ConfigKey{Name: "MESH_LAZY_PROXY", Type: TypeBool, Doc: "Start the app without waiting for the proxy"},
+		&ConfigKey{Name: "MESH_KNATIVE", Type: TypeBool},
+		&ConfigKey{Name: "MESH_DROP_PRIVS", Local: true, Type: TypeBool, Doc: "Drop capabilities, set no_new_privs and seccomp for children"},
+		&ConfigKey{Name: "MESH_DROP_CAPS", Local: true, Default: defaultDropCaps},
+		&ConfigKey{Name: "MESH_SECCOMP", Local: true, Values: []string{"default", "off"}, Default: "default"},
+		&ConfigKey{Name: "MESH_TLS_POLICY", Values: []string{"fips"}, Doc: "Restrict krun TLS to FIPS approved versions and ciphers"},
+		&ConfigKey{Name: "PROXY_CONCURRENCY", Type: TypeInt, Doc: "Envoy worker threads, default is the CPU allocation"},
+		&ConfigKey{Name: "APP_CMD", Local: true, Doc: "App command, if not set on the command line. Supports ${POD_NAME}, ${INSTANCE_IP}, ${OUTPUT_CERTS}"},
+		&ConfigKey{Name: "APP_ENV_ALLOW", Doc: "Env variables passed to the app, '*' suffix for prefixes"},
+		&ConfigKey{Name: "APP_ENV_DENY", Doc: "Env variables removed from the app env, 'mesh' for the krun settings"},
+		&ConfigKey{Name: "MESH_USER_APP", Local: true, Doc: "User for the app, as uid, uid:gid or name"},
+		&ConfigKey{Name: "MESH_USER_HOOKS", Local: true, Doc: "User for the preStart and postStart hooks"},
+		&ConfigKey{Name: "MESH_USER_CLOUDSQL", Local: true, Default: "1337:1337"},
+		&ConfigKey{Name: "MESH_USER_AGENT", Local: true, Default: "0:1337"},
+		&ConfigKey{Name: "MESH_USER_ENVOY", Local: true, Default: "1337:1337"},
+		&ConfigKey{Name: "MESH_PROXY_DRAIN_TIMEOUT", Type: TypeDuration, Default: "8s", Doc: "Max time to keep the whitebox proxy after SIGTERM"},
+		&ConfigKey{Name: "MESH_APP_STOP_TIMEOUT", Type: TypeDuration, Default: "5s", Doc: "Wait for each app stop group on shutdown"},
+		&ConfigKey{Name: "APP_PORTS", Doc: "App ports, as name=port list - used for inbound capture and readiness"},
+		&ConfigKey{Name: "MESH_LABELS", Doc: "Extra pod labels, as key=value list"},
+		&ConfigKey{Name: "MESH_ANNOTATIONS", Doc: "Pod annotations, as key=value list"},
+		&ConfigKey{Name: "MESH_LOCALITY", Doc: "Locality of the instance, as region/zone/subzone - default from the metadata server"},
+		&ConfigKey{Name: "MESH_NETWORK", Doc: "ISTIO_META_NETWORK - 'vpc' for the VPC network name, default NETWORK from mesh-env"},
+		&ConfigKey{Name: "MESH_BUNDLE", Doc: "Offline bootstrap bundle, default /var/lib/krun/bundle.tgz"},
+		&ConfigKey{Name: "MESH_BUNDLE_KEY", Doc: "PEM public key verifying the bootstrap bundle, or a file holding it"},
+		&ConfigKey{Name: "MESH_BUNDLE_MODE", Values: []string{"fallback", "offline"}, Default: "fallback", Doc: "Use the bootstrap bundle only if the config cluster is unreachable, or always"},
+		&ConfigKey{Name: "MESH_RETRY_DEADLINE", Type: TypeDuration, Default: "20s", Doc: "Total time for retrying a control plane call"},
+		&ConfigKey{Name: "MESH_RETRY_ATTEMPT_TIMEOUT", Type: TypeDuration, Default: "5s", Doc: "Timeout for each attempt of a control plane call"},
+		&ConfigKey{Name: "MESH_RETRY_BACKOFF", Type: TypeDuration, Default: "250ms", Doc: "Initial retry delay, doubled after each attempt"},
+		&ConfigKey{Name: "MESH_RETRY_MAX_BACKOFF", Type: TypeDuration, Default: "4s", Doc: "Max retry delay"},
+		&ConfigKey{Name: "MESH_ENV_STRICT", Type: TypeBool, Doc: "Fail if the mesh-env has unknown or missing keys"},
+		&ConfigKey{Name: "MESH_XDS_RESOLVERS", Default: defaultXDSResolvers, Doc: "Order of the XDS address resolvers"},
+		&ConfigKey{Name: "MESH_XDS_WEBHOOK", Doc: "URL returning the XDS address for the workload"},
+		&ConfigKey{Name: "MESH_XDS_DNS", Doc: "XDS hostname, used if it resolves"},
+		&ConfigKey{Name: "MESH_VPC", Values: []string{VPCDirect, VPCConnector, VPCNone}, Doc: "VPC access of the instance, detected by default"},
+		&ConfigKey{Name: "MESH_VPC_PROBE_TIMEOUT", Type: TypeDuration, Default: "1s", Doc: "Timeout for detecting the VPC connector"},
+		&ConfigKey{Name: "MESH_INTERFACE", Doc: "Network interface on the VPC, default is the interface with a route to the cluster CIDR"},
+		&ConfigKey{Name: "MESH_CLUSTER_CIDR", Doc: "Cluster address range, for finding the VPC interface - default first OUTBOUND_IP_RANGES_INCLUDE"},
+		&ConfigKey{Name: "MESH_NETWORK_GATEWAYS", Doc: "East-west gateway for each network, as network=address[:port] list - default NETWORK_GATEWAYS from mesh-env"},
+		&ConfigKey{Name: "MESH_NETWORK_GATEWAYS_PUBLISH", Type: TypeBool, Doc: "Create a Service in istio-system for each network gateway"},
+		&ConfigKey{Name: "MESH_METADATA", Doc: "Proxy metadata, as NAME=value list - JSON values set ISTIO_METAJSON_NAME"},
+		&ConfigKey{Name: "CANONICAL_SERVICE", Doc: "Canonical service label, default is the workload name"},
+		&ConfigKey{Name: "CANONICAL_REVISION", Doc: "Canonical revision label, default is the revision"},
+		&ConfigKey{Name: "MESH_BINARY_SHA256", Local: true, Doc: "Expected digests of the proxy binaries, as pilot-agent=sha256,envoy=sha256"},
+		&ConfigKey{Name: "MESH_INBOUND_AUTH", Values: []string{"jwt", "mtls"}, Doc: "Authentication for requests without mTLS"},
+		&ConfigKey{Name: "MESH_INBOUND_ISSUERS", Doc: "Trusted JWT issuers, default is the config cluster and accounts.google.com"},
+		&ConfigKey{Name: "MESH_INBOUND_AUDIENCES", Doc: "Accepted JWT audiences, default is the gateway URL"},
+		&ConfigKey{Name: "MESH_REQUIRED", Values: []string{"strict"}, Doc: "Don't start the app without certs, tokens and XDS"},
+		&ConfigKey{Name: "MESH_REQUIRED_TIMEOUT", Type: TypeDuration, Default: "60s"},
+		&ConfigKey{Name: "MESH_ROOTLESS", Type: TypeBool, Doc: "HTTP proxy and local forwarders instead of iptables"},
+		&ConfigKey{Name: "MESH_ROOTLESS_GATEWAY", Doc: "HBONE gateway for rootless mode, default HBONE_REVERSE_GATEWAY"},
+		&ConfigKey{Name: "MESH_ROOTLESS_PROXY_ADDR", Type: TypeHostPort, Default: "127.0.0.1:15084"},
+		&ConfigKey{Name: "MESH_UPSTREAMS", Doc: "Mesh destinations for rootless mode - host:port or localPort=host:port"},
+		&ConfigKey{Name: "MESH_STRUCTURED_LOGS", Type: TypeBool},
+		&ConfigKey{Name: "MESH_LOG_BUFFER_LINES", Type: TypeInt, Default: "200"},
+		&ConfigKey{Name: "MESH_LOG_QUEUE", Type: TypeInt, Default: "1000"},
+		&ConfigKey{Name: "MESH_STDOUT", Values: []string{"pipe", "pty"}, Default: "pipe",
+			Doc: "Stdout of the proxy, when running as root"},
+		&ConfigKey{Name: "MESH_CRASH_LINES", Type: TypeInt, Default: "50"},
+		&ConfigKey{Name: "MESH_STARTUP_BUDGET", Type: TypeDuration},
+		&ConfigKey{Name: "MESH_WORKLOAD_API", Type: TypeBool, Doc: "Serve the SPIFFE Workload API and SDS on a UDS socket"},
+		&ConfigKey{Name: "MESH_WORKLOAD_API_SOCKET", Doc: "Socket for the Workload API, default /var/run/secrets/workload-spiffe-uds/socket"},
+		&ConfigKey{Name: "MESH_OUTBOUND_MAX_CONNECTIONS", Type: TypeInt, Doc: "Default circuit breaker for outbound clusters, usually set in mesh-env"},
+		&ConfigKey{Name: "MESH_OUTBOUND_MAX_PENDING_REQUESTS", Type: TypeInt},
+		&ConfigKey{Name: "MESH_OUTBOUND_MAX_REQUESTS", Type: TypeInt},
+		&ConfigKey{Name: "MESH_OUTBOUND_MAX_RETRIES", Type: TypeInt},
+		&ConfigKey{Name: "MESH_OUTBOUND_RETRY_BACKOFF", Type: TypeDuration, Doc: "Base interval of the Envoy retry back-off"},
+		&ConfigKey{Name: "MESH_OUTBOUND_CONNECT_TIMEOUT", Type: TypeDuration, Default: "10s", Doc: "Dial timeout for streams proxied by krun"},
+		&ConfigKey{Name: "MESH_VERSION_MAX_SKEW", Type: TypeInt, Default: "1", Doc: "Max minor versions between the proxy and istiod"},
+		&ConfigKey{Name: "MESH_KRUN_MIN_VERSION", Doc: "Warn if krun is older - set in mesh-env when krun should be updated"},
+		&ConfigKey{Name: "MESH_ERROR_REPORTING", Type: TypeBool, Doc: "Report child crashes to the vendor error reporting, set in the env - read before mesh-env"},
+		&ConfigKey{Name: "MESH_CRASH_BUCKET", Doc: "GCS bucket (and optional prefix) for core files and crash logs"},
+		&ConfigKey{Name: "MESH_CORE_MAX_MB", Type: TypeInt, Default: "256", Doc: "Max size of the uploaded core file"},
+		&ConfigKey{Name: "MESH_CORE_DIR", Doc: "Additional directory to search for core files"},
+		&ConfigKey{Name: "MESH_CRASH_UPLOAD_TIMEOUT", Type: TypeDuration, Default: "1m", Doc: "Max time to upload crash artifacts"},
+		&ConfigKey{Name: "MESH_EVENTS_TOPIC", Doc: "Pub/Sub topic for lifecycle events, name or projects/P/topics/T"},
+		&ConfigKey{Name: "MESH_TCP_KEEPALIVE", Type: TypeDuration, Default: "30s", Doc: "TCP keepalive period for persistent connections, -1s disables"},
+		&ConfigKey{Name: "MESH_H2_PING", Type: TypeDuration, Default: "60s", Doc: "HTTP/2 and gRPC ping interval on idle connections"},
+		&ConfigKey{Name: "MESH_H2_PING_TIMEOUT", Type: TypeDuration, Default: "15s", Doc: "Close the connection if a ping is not answered"},
+		&ConfigKey{Name: "MESH_RECONNECT_JITTER", Type: TypeDuration, Default: "5s", Doc: "Random delay added to reverse tunnel reconnects"},
+		&ConfigKey{Name: "MESH_HEDGE", Type: TypeBool, Default: "true", Doc: "Race connections to the resolved XDS addresses"},
+		&ConfigKey{Name: "MESH_HEDGE_DELAY", Type: TypeDuration, Default: "250ms", Doc: "Delay before dialing the next address"},
+		&ConfigKey{Name: "MESH_HEDGE_PIN", Type: TypeBool, Doc: "Add the fastest XDS and CA addresses to /etc/hosts until the proxy is ready"},
+		&ConfigKey{Name: "MESH_MIRROR_URL", Doc: "Secondary destination for mirrored requests, for example the GKE service"},
+		&ConfigKey{Name: "MESH_MIRROR_PERCENT", Default: "10", Doc: "Percentage of requests mirrored"},
+		&ConfigKey{Name: "MESH_MIRROR_METHODS", Default: "GET,HEAD", Doc: "Methods that are mirrored"},
+		&ConfigKey{Name: "MESH_RATE_LIMIT", Doc: "Requests per second accepted on the serving port"},
+		&ConfigKey{Name: "MESH_RATE_LIMIT_BURST", Type: TypeInt, Doc: "Rate limit bucket size, default is the rate"},
+		&ConfigKey{Name: "MESH_RATE_LIMIT_PER_CLIENT", Type: TypeBool, Doc: "Separate rate limit for each client IP"},
+		&ConfigKey{Name: "MESH_OUTBOUND_POLICY", Values: []string{OutboundAllowAny, OutboundRegistryOnly},
+			Doc: "Enforce the Sidecar egress scope in the rootless proxy, requires MESH_XDS_CLIENT"},
+		&ConfigKey{Name: "MESH_TRACING", Values: []string{TracingCloudTrace, "stackdriver", TracingZipkin, TracingOpenCensus, TracingOTLP, TracingNone},
+			Doc: "Tracing provider for the generated PROXY_CONFIG"},
+		&ConfigKey{Name: "MESH_TRACING_ADDR", Type: TypeHostPort, Doc: "Collector address for zipkin, opencensus and otlp"},
+		&ConfigKey{Name: "MESH_TRACING_SAMPLING", Doc: "Percentage of requests traced, 0 to 100"},
+		&ConfigKey{Name: "ISTIO_KUBE_APP_PROBERS", Doc: "App probes served on the container port as /app-health/..., JSON as in the injected sidecar"},
+		&ConfigKey{Name: "MESH_METRICS_MERGE", Type: TypeBool, Doc: "Serve the Envoy, app and krun metrics on :15020/stats/prometheus"},
+		&ConfigKey{Name: "MESH_METRICS_ADDR", Type: TypeHostPort, Default: ":15020", Doc: "Address for the merged metrics"},
+		&ConfigKey{Name: "MESH_APP_METRICS", Doc: "URL of the app metrics, default from the prometheus.io annotations"},
+		&ConfigKey{Name: "MESH_INFO_FILE", Doc: "Mesh info for the app, default /var/run/secrets/mesh/info.json, '-' to disable"},
+		&ConfigKey{Name: "MESH_INFO_ADDR", Type: TypeHostPort, Doc: "Local address serving the mesh info as /krun/info"},
+		&ConfigKey{Name: "MESH_WATCHDOG", Values: []string{WatchdogRestart, WatchdogUnhealthy, WatchdogExit}, Doc: "Action if the proxy stays unhealthy"},
+		&ConfigKey{Name: "MESH_WATCHDOG_INTERVAL", Type: TypeDuration, Default: "10s"},
+		&ConfigKey{Name: "MESH_WATCHDOG_WINDOW", Type: TypeDuration, Default: "60s", Doc: "Time the proxy can be unhealthy before the watchdog acts"},
+		&ConfigKey{Name: "MESH_WATCHDOG_MAX_RESTARTS", Type: TypeInt, Default: "3", Doc: "Restarts before marking the instance unhealthy"},
+		&ConfigKey{Name: "MESH_STARTUP_TIMEOUT", Type: TypeDuration, Default: "4m", Doc: "Max time for all startup phases"},
+		&ConfigKey{Name: "MESH_TIMEOUT_PLATFORM", Type: TypeDuration, Default: "30s", Doc: "Timeout for the metadata server and cluster discovery"},
+		&ConfigKey{Name: "MESH_TIMEOUT_MESH_ENV", Type: TypeDuration, Default: "60s", Doc: "Timeout for loading the mesh-env, certificates and roots"},
+		&ConfigKey{Name: "MESH_TIMEOUT_PROXY_START", Type: TypeDuration, Default: "30s", Doc: "Timeout for XDS discovery, tokens and starting the agent"},
+		&ConfigKey{Name: "MESH_TIMEOUT_PROXY_READY", Type: TypeDuration, Default: "10s", Doc: "Timeout for the proxy to be ready, MESH_REQUIRED_TIMEOUT in strict mode"},
+		&ConfigKey{Name: "MESH_TIMEOUT_SECRETS", Type: TypeDuration, Default: "30s", Doc: "Timeout for loading the secrets"},
+		&ConfigKey{Name: "MESH_TIMEOUT_APP_READY", Type: TypeDuration, Default: "10s", Doc: "Timeout for the app to be ready"},
+		&ConfigKey{Name: "MESH_ENVOY_BOOTSTRAP", Doc: "Envoy bootstrap generated by gen-bootstrap, for Traffic Director"},
+		&ConfigKey{Name: "MESH_GRPC_BOOTSTRAP", Doc: "gRPC bootstrap generated by gen-bootstrap"},
+		&ConfigKey{Name: "MESH_GRPC_XDS_SERVER", Doc: "Discovery address for proxyless gRPC without pilot-agent"},
+		&ConfigKey{Name: "MESH_GRPC_XDS_CREDS", Values: []string{"google_default", "insecure", "tls"},
+			Doc: "Channel credentials for MESH_GRPC_XDS_SERVER, default google_default for port 443"},
+		&ConfigKey{Name: "MESH_GRPC_XDS_AUTHORITIES", Doc: "Federated xDS authorities, as name or name=serverURI"},
+		&ConfigKey{Name: "MESH_XDS_CLIENT", Type: TypeBool, Doc: "In-process ADS client for NDS and LDS, for DISABLE_ENVOY mode"},
+		&ConfigKey{Name: "MESH_XDS_CLIENT_CREDS", Values: []string{"google_default", "tls", "insecure"},
+			Doc: "Credentials for the XDS client, default google_default for port 443 and tls for 15012"},
+		&ConfigKey{Name: "MESH_XDS_CLIENT_SAN", Default: "istiod.istio-system.svc"},
+		&ConfigKey{Name: "MESH_ADMIN_TOKEN", Doc: "Token for the Envoy admin subset on the debug port, generated if not set"},
+		&ConfigKey{Name: "MESH_ADMIN_TOKEN_FILE", Doc: "File for the generated admin token, default /var/run/krun/admin-token"},
+		&ConfigKey{Name: "MESH_ADMIN_LOCKDOWN", Type: TypeBool, Default: "true",
+			Doc: "Reject connections to the Envoy admin port from the app, when running as root"},
+		&ConfigKey{Name: "PILOT_AGENT_BINARY", Local: true, Doc: "Path to pilot-agent, default is a lookup in the binary dirs"},
+		&ConfigKey{Name: "ENVOY_BINARY", Local: true, Doc: "Path to envoy, default is a lookup in the binary dirs"},
+		&ConfigKey{Name: "CLOUDSQL_PROXY", Local: true, Default: "/usr/local/bin/cloud_sql_proxy"},
+		&ConfigKey{Name: "MESH_PROXY_URL", Local: true, Doc: "Download the proxy binaries - gs://, oci:// or https:// URL, with ${NAME} and ${VERSION}"},
+		&ConfigKey{Name: "MESH_PROXY_VERSION", Local: true, Doc: "Proxy version, for the MESH_PROXY_URL template"},
+		&ConfigKey{Name: "MESH_PROXY_BINARIES", Local: true, Default: "pilot-agent,envoy"},
+		&ConfigKey{Name: "MESH_PROXY_CACHE_DIR", Local: true, Doc: "Directory for the downloaded and upgraded binaries, default /var/lib/krun/bin"},
+		&ConfigKey{Name: "MESH_PROXY_UPGRADE", Local: true, Type: TypeBool, Doc: "Upgrade the proxy when new binaries are available"},
+		&ConfigKey{Name: "MESH_PROXY_UPGRADE_DIR", Local: true, Doc: "New proxy binaries and SHA256SUMS, default /var/lib/krun/upgrade"},
+		&ConfigKey{Name: "MESH_PROXY_UPGRADE_INTERVAL", Type: TypeDuration, Default: "60s"},
+		&ConfigKey{Name: "MESH_PROXY_UPGRADE_DRAIN", Type: TypeDuration, Default: "5s"},
+		&ConfigKey{Name: "MESH_STARTUP_CACHE", Doc: "Directory for the startup cache, shared by the instances of a revision"},
+		&ConfigKey{Name: "MESH_STARTUP_CACHE_TTL", Type: TypeDuration, Default: "10m"},
+		&ConfigKey{Name: "MESH_STARTUP_CACHE_KEY", Local: true, Doc: "HMAC key signing the startup cache, from a secret"},
+		&ConfigKey{Name: "MESH_REVISION_ID", Doc: "Revision key for the startup cache, if K_REVISION is not set"},
+		&ConfigKey{Name: "MESH_ENDPOINT_CACHE", Type: TypeBool},
+		&ConfigKey{Name: "MESH_ENDPOINT_CACHE_INTERVAL", Type: TypeDuration, Default: "30s"},
+		&ConfigKey{Name: "MESH_ENDPOINT_CACHE_DNS", Type: TypeHostPort, Default: "127.0.0.3:53", Doc: "Nameserver for the agent DNS proxy, answering the cached mesh names"},
+		&ConfigKey{Name: "MESH_STATS_INTERVAL", Type: TypeDuration, Default: "60s"},
+		&ConfigKey{Name: "MESH_STATUS", Type: TypeBool},
+		&ConfigKey{Name: "MESH_STATUS_INTERVAL", Type: TypeDuration, Default: "60s"},
+		&ConfigKey{Name: "MESH_WORKLOAD_ENTRY", Type: TypeBool},
+		&ConfigKey{Name: "MESH_WORKLOAD_LEASE", Type: TypeBool, Default: "true"},
+		&ConfigKey{Name: "MESH_WORKLOAD_LEASE_DURATION", Type: TypeDuration, Default: "60s"},
+		&ConfigKey{Name: "MESH_PUBLISH_SERVICE", Type: TypeBool},
+		&ConfigKey{Name: "MESH_ACCESS_LOG", Values: []string{"als"}},
+		&ConfigKey{Name: "MESH_METADATA_PROXY", Values: []string{"true", "false", "intercept"}},
+		&ConfigKey{Name: "MESH_METADATA_ADDR", Type: TypeHostPort, Default: "127.0.0.1:15082"},
+		&ConfigKey{Name: "MESH_GOOGLEAPIS", Values: []string{"private", "restricted", "auto"}},
+		&ConfigKey{Name: "MESH_SECRETS_REFRESH", Type: TypeDuration},
+		&ConfigKey{Name: "GATEWAY_PREWARM", Type: TypeBool},
+		&ConfigKey{Name: "GATEWAY_PREWARM_TIMEOUT", Type: TypeDuration, Default: "30s"},
+		&ConfigKey{Name: "HBONE_WEBSOCKET_FALLBACK", Type: TypeBool, Default: "true"},
+		&ConfigKey{Name: "HBONE_ALLOWED_PEERS", Doc: "SPIFFE ID prefixes allowed to reach the app ports over mTLS HBONE, default is the trust domain"},
+		&ConfigKey{Name: "CONFIG_CLUSTER_TIMEOUT", Type: TypeDuration, Default: "5s"},
+		&ConfigKey{Name: "CLOUDSQL_STARTUP_TIMEOUT", Type: TypeDuration, Default: "30s"},
+		&ConfigKey{Name: "DNS_UPSTREAM", Type: TypeURL},
+		&ConfigKey{Name: "DNS_UPSTREAM_LISTEN", Type: TypeHostPort, Default: "127.0.0.2:53"},
+		&ConfigKey{Name: "EGRESS_PORT", Type: TypeInt, Default: "15081"},
+		&ConfigKey{Name: "SNI_PORT", Type: TypeInt, Default: "15443"},
+	)
+	// String settings, declared so they are not reported as unknown.
+	for _, n := range []string{"MESH_ALS_ADDR", "MESH_BASE_DIR", "MESH_CA", "MESH_CA_AUDIENCE", "MESH_GATEWAY_URL",
+		"MESH_KUBECONFIG", "MESH_LOCAL_CA_DIR", "MESH_METADATA_ATTRIBUTES", "MESH_OIDC_TOKEN_FILE", "MESH_REVISION",
+		"MESH_SERVICE_ADDR", "MESH_SERVICE_HOST", "MESH_SERVICE_NAME", "MESH_SERVICE_PORTS", "MESH_STARTUP_METRIC",
+		"MESH_STATS_EXPORT", "MESH_STATS_LABELS", "MESH_TENANT"} {
+		DeclareConfig(&ConfigKey{Name: n})
+	}
+}
+
+// configState holds the flag and file sources, and the keys used so far.
+type configState struct {
+	m     sync.Mutex
+	flags map[string]string
+	file  map[string]string
+	used  map[string]string
+}
+
+// SetFlagConfig sets a value from the command line - it has the highest priority.
+func (kr *KRun) SetFlagConfig(name, val string) {
+	kr.config.m.Lock()
+	defer kr.config.m.Unlock()
+	if kr.config.flags == nil {
+		kr.config.flags = map[string]string{}
+	}
+	kr.config.flags[name] = val
+}
+
+// SetFileConfig sets the values loaded from a config file - used if not set in env or mesh-env.
+func (kr *KRun) SetFileConfig(vals map[string]string) {
+	kr.config.m.Lock()
+	defer kr.config.m.Unlock()
+	kr.config.file = vals
+}
+
+// ConfigSource returns the value of a setting and the source, without a default.
+func (kr *KRun) ConfigSource(name string) (string, string) {
+	kr.config.m.Lock()
+	v := kr.config.flags[name]
+	file := kr.config.file[name]
+	kr.config.m.Unlock()
+	if v != "" {
+		return v, SourceFlag
+	}
+	if v = os.Getenv(name); v != "" {
+		return v, SourceEnv
+	}
+	if v = kr.MeshEnv[name]; v != "" && !localConfig(name) {
+		return v, SourceMeshEnv
+	}
+	if file != "" {
+		return file, SourceFile
+	}
+	return "", ""
+}
+
+// localConfig returns true if the setting must not be read from mesh-env.
+func localConfig(name string) bool {
+	if k := ConfigKeys[name]; k != nil && k.Local {
+		return true
+	}
+	if strings.HasPrefix(name, "MESH_USER_") {
+		return true
+	}
+	// APP_N_CMD, APP_N_USER and the other settings of the additional apps.
+	return strings.HasPrefix(name, "APP_") && len(name) > 4 && name[4] >= '0' && name[4] <= '9'
+}
+
+func (kr *KRun) recordConfig(name, def string) {
+	kr.config.m.Lock()
+	defer kr.config.m.Unlock()
+	if kr.config.used == nil {
+		kr.config.used = map[string]string{}
+	}
+	kr.config.used[name] = def
+}
+
+// ValidateConfig checks the declared settings. Undeclared MESH_ settings are reported, they are likely typos.
+func (kr *KRun) ValidateConfig() error {
+	errs := []string{}
+	for _, k := range ConfigKeys {
+		v, src := kr.ConfigSource(k.Name)
+		if v == "" {
+			continue
+		}
+		if err := k.Validate(v); err != nil {
+			errs = append(errs, fmt.Sprintf("%s=%q (%s): %v", k.Name, v, src, err))
+		}
+	}
+	sort.Strings(errs)
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid config: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// UnknownConfig returns the MESH_ settings that are set but not declared.
+func (kr *KRun) UnknownConfig(environ []string) []string {
+	res := []string{}
+	for _, e := range environ {
+		k := strings.SplitN(e, "=", 2)[0]
+		if strings.HasPrefix(k, "MESH_") && ConfigKeys[k] == nil {
+			res = append(res, k)
+		}
+	}
+	sort.Strings(res)
+	return res
+}
+
+// Validate checks that a value matches the declared type.
+func (k *ConfigKey) Validate(v string) error {
+	if len(k.Values) > 0 {
+		for _, a := range k.Values {
+			if a == v {
+				return nil
+			}
+		}
+		return fmt.Errorf("expecting one of %s", strings.Join(k.Values, ","))
+	}
+	var err error
+	switch k.Type {
+	case TypeBool:
+		_, err = strconv.ParseBool(v)
+	case TypeInt:
+		_, err = strconv.Atoi(v)
+	case TypeDuration:
+		_, err = time.ParseDuration(v)
+	case TypeURL:
+		_, err = url.Parse(v)
+	case TypeHostPort:
+		if v != "-" {
+			_, _, err = net.SplitHostPort(v)
+		}
+	}
+	return err
+}
+
+// EffectiveConfig is an entry in the /debug/config response.
+type EffectiveConfig struct {
+	Value   string `json:"value,omitempty"`
+	Source  string `json:"source"`
+	Default string `json:"default,omitempty"`
+	Type    string `json:"type,omitempty"`
+}
+
+// EffectiveConfig returns the declared and used settings, with the value and source.
+func (kr *KRun) EffectiveConfig() map[string]*EffectiveConfig {
+	defs := map[string]string{}
+	kr.config.m.Lock()
+	for k, v := range kr.config.used {
+		defs[k] = v
+	}
+	kr.config.m.Unlock()
+	types := map[string]string{}
+	for _, k := range ConfigKeys {
+		if defs[k.Name] == "" {
+			defs[k.Name] = k.Default
+		}
+		types[k.Name] = k.Type
+	}
+	res := map[string]*EffectiveConfig{}
+	for name, def := range defs {
+		v, src := kr.ConfigSource(name)
+		if v == "" {
+			v, src = def, SourceDefault
+		}
+		res[name] = &EffectiveConfig{Value: v, Source: src, Default: def, Type: types[name]}
+	}
+	return res
+}
+
+// WriteConfigEnv writes the effective settings as env variables, with the source. Secrets are redacted.
+// If all is false, settings using the default are skipped.
+func (kr *KRun) WriteConfigEnv(w io.Writer, all bool) {
+	ec := kr.EffectiveConfig()
+	keys := []string{}
+	for k, e := range ec {
+		if all || e.Source != SourceDefault {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		e := ec[k]
+		fmt.Fprintf(w, "%s # %s\n", redactEnv(k+"="+e.Value), e.Source)
+	}
+}
+
+func (kr *KRun) handleConfig(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("content-type", "application/json")
+	e := json.NewEncoder(w)
+	e.SetIndent("", "  ")
+	e.Encode(kr.EffectiveConfig())
+}
@@ -0,0 +1,227 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mesh
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"strconv"
+	"syscall"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// KRunFile is the optional krun.yaml config file, loaded from KRUN_CONFIG or /etc/krun/krun.yaml.
+// Settings in env and mesh-env override the file.
+//
+//	app:
+//	  command: ["/app/server", "--port", "8080"]
+//	apps:
+//	- name: worker
+//	  command: ["/app/worker"]
+//	ports:
+//	  http: 8080
+//	  grpc: 9090
+//	interception:
+//	  mode: NONE
+//	  outboundIPRanges: 10.0.0.0/8
+//	  excludeOutboundPorts: 5432
+//	audiences:
+//	  https://example.com: /var/run/secrets/tokens/example
+//	hooks:
+//	  preStart:
+//	  - /app/migrate.sh
+//	  postStart:
+//	  - echo ready
+//	gateway: ingress
+//	labels:
+//	  team: payments
+//	annotations:
+//	  sidecar.istio.io/logLevel: debug
+//	filters:
+//	- name: authz
+//	  lua: |
+//	    function envoy_on_request(h) end
+//	env:
+//	  MESH_STRUCTURED_LOGS: "true"
+type KRunFile struct {
+	App struct {
+		Command []string `yaml:"command,omitempty"`
+	} `yaml:"app,omitempty"`
+
+	// Ports maps port names to app ports - same as PORT_name.
+	Ports map[string]int `yaml:"ports,omitempty"`
+
+	Interception struct {
+		// Mode is the ISTIO_META_INTERCEPTION_MODE - NONE for whitebox.
+		Mode                 string `yaml:"mode,omitempty"`
+		OutboundIPRanges     string `yaml:"outboundIPRanges,omitempty"`
+		ExcludeOutboundPorts string `yaml:"excludeOutboundPorts,omitempty"`
+	} `yaml:"interception,omitempty"`
+
+	// Audiences maps extra token audiences to the files where the tokens are saved.
+	Audiences map[string]string `yaml:"audiences,omitempty"`
+
+	// Hooks are shell commands run before the app starts, and after it is ready.
+	Hooks struct {
+		PreStart  []string `yaml:"preStart,omitempty"`
+		PostStart []string `yaml:"postStart,omitempty"`
+	} `yaml:"hooks,omitempty"`
+
+	// Labels are added to the pod labels, see PodLabels.
+	Labels map[string]string `yaml:"labels,omitempty"`
+
+	// Annotations use the same names as the k8s pod annotations, see PodAnnotations.
+	Annotations map[string]string `yaml:"annotations,omitempty"`
+
+	// Metadata is added to the proxy metadata, see ProxyMetadata.
+	Metadata map[string]interface{} `yaml:"metadata,omitempty"`
+
+	// Apps are additional app processes, see AppProcess.
+	Apps []*AppProcess `yaml:"apps,omitempty"`
+
+	// Filters are extra proxy filters, see ProxyFilter.
+	Filters []*ProxyFilter `yaml:"filters,omitempty"`
+
+	// Gateway is the gateway role, same as GATEWAY_NAME.
+	Gateway string `yaml:"gateway,omitempty"`
+
+	// Env holds any other setting, using the env variable names.
+	Env map[string]string `yaml:"env,omitempty"`
+}
+
+const defaultConfigFile = "/etc/krun/krun.yaml"
+
+// LoadConfigFile loads the krun.yaml file, if present. A missing default file is not an error.
+func (kr *KRun) LoadConfigFile() error {
+	f := os.Getenv("KRUN_CONFIG")
+	explicit := f != ""
+	if !explicit {
+		f = defaultConfigFile
+	}
+	data, err := ioutil.ReadFile(f)
+	if err != nil {
+		if !explicit && os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	kf := &KRunFile{}
+	if err := yaml.UnmarshalStrict(data, kf); err != nil {
+		return fmt.Errorf("invalid %s: %v", f, err)
+	}
+	kr.applyConfigFile(kf)
+	log.Println("Loaded config file", f)
+	return nil
+}
+
+func (kr *KRun) applyConfigFile(kf *KRunFile) {
+	vals := map[string]string{}
+	for k, v := range kf.Env {
+		vals[k] = v
+	}
+	for n, p := range kf.Ports {
+		vals["PORT_"+n] = strconv.Itoa(p)
+		// initPorts and app readiness use the MeshEnv - mesh-env from the cluster will override it.
+		if kr.MeshEnv["PORT_"+n] == "" && os.Getenv("PORT_"+n) == "" {
+			kr.MeshEnv["PORT_"+n] = strconv.Itoa(p)
+		}
+	}
+	if kf.Interception.Mode != "" {
+		vals["ISTIO_META_INTERCEPTION_MODE"] = kf.Interception.Mode
+	}
+	if kf.Interception.OutboundIPRanges != "" {
+		vals["OUTBOUND_IP_RANGES_INCLUDE"] = kf.Interception.OutboundIPRanges
+	}
+	if kf.Interception.ExcludeOutboundPorts != "" {
+		vals["OUTBOUND_PORTS_EXCLUDE"] = kf.Interception.ExcludeOutboundPorts
+	}
+	kr.SetFileConfig(vals)
+
+	for aud, f := range kf.Audiences {
+		kr.Aud2File[aud] = f
+	}
+	for k, v := range kf.Labels {
+		kr.Labels[k] = v
+	}
+	for k, v := range kf.Annotations {
+		kr.Annotations[k] = v
+	}
+	for k, v := range kf.Metadata {
+		j, err := yamlToJSON(v)
+		if err != nil {
+			log.Println("Invalid metadata in config file", k, err)
+			continue
+		}
+		if kr.Metadata == nil {
+			kr.Metadata = map[string]interface{}{}
+		}
+		switch j.(type) {
+		case map[string]interface{}, []interface{}:
+			kr.Metadata[k] = j
+		default:
+			// Numbers and booleans are set as ISTIO_META strings.
+			kr.Metadata[k] = fmt.Sprint(j)
+		}
+	}
+	if len(kr.AppCommand) == 0 && len(os.Args) <= 1 {
+		kr.AppCommand = kf.App.Command
+	}
+	kr.Apps = append(kr.Apps, kf.Apps...)
+	kr.Filters = append(kr.Filters, kf.Filters...)
+	if kr.Gateway == "" && kf.Gateway != "" {
+		kr.Gateway = kf.Gateway
+		kr.initGateways()
+	}
+	kr.hooks = map[string][]string{
+		HookPreStart:  kf.Hooks.PreStart,
+		HookPostStart: kf.Hooks.PostStart,
+	}
+}
+
+// Hook names.
+const (
+	HookPreStart  = "preStart"
+	HookPostStart = "postStart"
+)
+
+// RunHooks runs the commands for a hook, in order, using /bin/sh. Stops at the first failure.
+func (kr *KRun) RunHooks(ctx context.Context, hook string) error {
+	cred, err := kr.childCredential("hooks", "")
+	if err != nil {
+		return err
+	}
+	for _, c := range kr.hooks[hook] {
+		ctx, cf := context.WithTimeout(ctx, 5*time.Minute)
+		cmd := exec.CommandContext(ctx, "/bin/sh", "-c", c)
+		if cred != nil {
+			cmd.SysProcAttr = &syscall.SysProcAttr{Credential: cred}
+		}
+		cmd.Stdout = kr.LogWriter(hook, os.Stdout)
+		cmd.Stderr = kr.LogWriter(hook, os.Stderr)
+		err := cmd.Run()
+		closeLogWriters(cmd)
+		cf()
+		if err != nil {
+			return fmt.Errorf("%s hook %q: %v", hook, c, err)
+		}
+	}
+	return nil
+}
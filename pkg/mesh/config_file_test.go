@@ -0,0 +1,88 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mesh
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestConfigFile(t *testing.T) {
+	dir := t.TempDir()
+	f := filepath.Join(dir, "krun.yaml")
+	ioutil.WriteFile(f, []byte(`
+ports:
+  grpc: 9090
+interception:
+  mode: NONE
+audiences:
+  https://example.com: /tmp/example-token
+hooks:
+  preStart:
+  - touch `+filepath.Join(dir, "prestart")+`
+gateway: ingress
+labels:
+  team: payments
+  tier: frontend
+metadata:
+  NETWORK: vpc-1
+  PRIORITY: 2
+  PLATFORM_METADATA:
+    gcp_project: p1
+env:
+  MESH_STRUCTURED_LOGS: "true"
+  MESH_LABELS: tier=backend
+`), 0644)
+	os.Setenv("KRUN_CONFIG", f)
+	defer os.Unsetenv("KRUN_CONFIG")
+
+	kr := New()
+	if v, src := kr.ConfigSource("MESH_STRUCTURED_LOGS"); v != "true" || src != SourceFile {
+		t.Error("Unexpected env", v, src)
+	}
+	if v := kr.Config("ISTIO_META_INTERCEPTION_MODE", ""); v != "NONE" {
+		t.Error("Unexpected interception", v)
+	}
+	if kr.MeshEnv["PORT_grpc"] != "9090" {
+		t.Error("Missing port", kr.MeshEnv)
+	}
+	if kr.Aud2File["https://example.com"] != "/tmp/example-token" {
+		t.Error("Missing audience", kr.Aud2File)
+	}
+	if kr.Gateway != "ingressgateway" {
+		t.Error("Unexpected gateway", kr.Gateway)
+	}
+	if l := kr.PodLabels(); l["team"] != "payments" || l["tier"] != "backend" || l["security.istio.io/tlsMode"] != "istio" {
+		t.Error("Unexpected labels", l)
+	}
+	if m := kr.ProxyMetadata(); m["NETWORK"] != "vpc-1" || m["PRIORITY"] != "2" ||
+		m["PLATFORM_METADATA"].(map[string]interface{})["gcp_project"] != "p1" {
+		t.Error("Unexpected metadata", m)
+	}
+	if err := kr.RunHooks(context.Background(), HookPreStart); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "prestart")); err != nil {
+		t.Error("Hook not run", err)
+	}
+
+	ioutil.WriteFile(f, []byte("unknown: true\n"), 0644)
+	if err := kr.LoadConfigFile(); err == nil {
+		t.Error("Expecting error for unknown fields")
+	}
+}
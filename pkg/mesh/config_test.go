@@ -0,0 +1,116 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mesh
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestConfigPrecedence(t *testing.T) {
+	kr := &KRun{MeshEnv: map[string]string{"TEST_CFG_A": "mesh", "TEST_CFG_B": "mesh"}}
+	kr.SetFileConfig(map[string]string{"TEST_CFG_A": "file", "TEST_CFG_C": "file"})
+	os.Setenv("TEST_CFG_A", "env")
+	defer os.Unsetenv("TEST_CFG_A")
+
+	for name, exp := range map[string][]string{
+		"TEST_CFG_A": {"env", SourceEnv},
+		"TEST_CFG_B": {"mesh", SourceMeshEnv},
+		"TEST_CFG_C": {"file", SourceFile},
+	} {
+		if v, src := kr.ConfigSource(name); v != exp[0] || src != exp[1] {
+			t.Error("Unexpected value", name, v, src)
+		}
+	}
+	kr.SetFlagConfig("TEST_CFG_A", "flag")
+	if v := kr.Config("TEST_CFG_A", "def"); v != "flag" {
+		t.Error("Flag must override env", v)
+	}
+	if v := kr.Config("TEST_CFG_D", "def"); v != "def" {
+		t.Error("Expecting default", v)
+	}
+	ec := kr.EffectiveConfig()
+	if e := ec["TEST_CFG_D"]; e == nil || e.Source != SourceDefault || e.Value != "def" {
+		t.Error("Used setting missing from effective config", e)
+	}
+}
+
+func TestLocalConfig(t *testing.T) {
+	kr := &KRun{MeshEnv: map[string]string{
+		"MESH_PROXY_URL":     "https://evil.example.com/${NAME}",
+		"MESH_BINARY_SHA256": "envoy=00",
+		"APP_2_CMD":          "/bin/sh",
+		"MESH_USER_APP":      "0",
+		"APP_PORTS":          "8080",
+	}}
+	kr.SetFileConfig(map[string]string{"MESH_BINARY_SHA256": "envoy=11"})
+	for name, exp := range map[string]string{
+		"MESH_PROXY_URL":     "",
+		"MESH_BINARY_SHA256": "envoy=11",
+		"APP_2_CMD":          "",
+		"MESH_USER_APP":      "",
+		"APP_PORTS":          "8080",
+	} {
+		if v := kr.Config(name, ""); v != exp {
+			t.Error("Unexpected value", name, v)
+		}
+	}
+	if issues := ValidateMeshEnv(kr.MeshEnv); !strings.Contains(strings.Join(issues, ","), "local setting ignored APP_2_CMD") {
+		t.Error("Expecting local setting issue", issues)
+	}
+}
+
+func TestValidateConfig(t *testing.T) {
+	kr := &KRun{MeshEnv: map[string]string{
+		"MESH_STATUS_INTERVAL": "1x",
+		"MESH_GOOGLEAPIS":      "restricted",
+		"MESH_METADATA_PROXY":  "yes",
+	}}
+	err := kr.ValidateConfig()
+	if err == nil {
+		t.Fatal("Expecting errors")
+	}
+	if !strings.Contains(err.Error(), "MESH_STATUS_INTERVAL") || !strings.Contains(err.Error(), "MESH_METADATA_PROXY") ||
+		strings.Contains(err.Error(), "MESH_GOOGLEAPIS") {
+		t.Error("Unexpected errors", err)
+	}
+	if u := kr.UnknownConfig([]string{"MESH_STATUS=true", "MESH_STAUTS=true", "PATH=/bin"}); len(u) != 1 || u[0] != "MESH_STAUTS" {
+		t.Error("Unexpected unknown settings", u)
+	}
+}
+
+func TestWriteConfigEnv(t *testing.T) {
+	kr := &KRun{}
+	kr.SetFlagConfig("XDS_ADDR", "istiod.istio-system.svc:15012")
+	kr.SetFileConfig(map[string]string{"MESH_KUBECONFIG": "apiVersion: v1"})
+	b := &strings.Builder{}
+	kr.WriteConfigEnv(b, false)
+	out := b.String()
+	if !strings.Contains(out, "XDS_ADDR=istiod.istio-system.svc:15012 # flag\n") {
+		t.Error("Missing flag setting", out)
+	}
+	if !strings.Contains(out, "MESH_KUBECONFIG=REDACTED # file\n") {
+		t.Error("Secret not redacted", out)
+	}
+	if strings.Contains(out, "MESH_DEBUG_ADDR") {
+		t.Error("Default settings only with all", out)
+	}
+	b.Reset()
+	kr.WriteConfigEnv(b, true)
+	if !strings.Contains(b.String(), "MESH_DEBUG_ADDR=127.0.0.1:15030 # default\n") {
+		t.Error("Missing default setting", b.String())
+	}
+}
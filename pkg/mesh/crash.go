@@ -0,0 +1,102 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mesh
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrorEvent describes an unexpected exit of the agent or app.
+type ErrorEvent struct {
+	// Source is the child that exited - pilot-agent, envoy or app.
+	Source string
+
+	ExitCode int
+
+	// Message is the wait error.
+	Message string
+
+	// Lines holds the last lines of output from the child.
+	Lines []string
+
+	Time time.Time
+}
+
+// ErrorReporter abstracts the vendor error reporting system.
+type ErrorReporter interface {
+	ReportError(ctx context.Context, ev *ErrorEvent) error
+}
+
+// ReportExit is called when a child exits with an error. The last MESH_CRASH_LINES (default 50) lines of
+// output are logged as a single ERROR entry and sent to the ErrorReporter, if set - the exit status alone
+// rarely explains the failure.
+func (kr *KRun) ReportExit(source string, cmd *exec.Cmd, err error) {
+	n, cerr := strconv.Atoi(kr.Config("MESH_CRASH_LINES", "50"))
+	if cerr != nil || n < 0 {
+		n = 50
+	}
+	lines := kr.OutputBuffer(source).Lines()
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	ev := &ErrorEvent{
+		Source:   source,
+		ExitCode: -1,
+		Message:  fmt.Sprint(err),
+		Lines:    lines,
+		Time:     time.Now(),
+	}
+	if cmd != nil && cmd.ProcessState != nil {
+		ev.ExitCode = cmd.ProcessState.ExitCode()
+	}
+
+	data, _ := json.Marshal(map[string]interface{}{
+		"severity": "ERROR",
+		"message":  source + " exited: " + ev.Message + "\n" + strings.Join(lines, "\n"),
+		"exitCode": ev.ExitCode,
+		"uptime":   time.Since(kr.StartTime).String(),
+		"logging.googleapis.com/labels": map[string]string{
+			"source":     source,
+			"instanceId": kr.InstanceID,
+		},
+	})
+	logMutex.Lock()
+	os.Stderr.Write(append(data, '\n'))
+	logMutex.Unlock()
+
+	kr.PublishEvent(crashEvent(source), map[string]string{
+		"source":   source,
+		"exitCode": strconv.Itoa(ev.ExitCode),
+		"message":  ev.Message,
+	})
+	kr.UploadCrash(source, cmd, err)
+
+	if kr.ErrorReporter == nil {
+		return
+	}
+	ctx, cf := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cf()
+	if err := kr.ErrorReporter.ReportError(ctx, ev); err != nil {
+		log.Println("Failed to report error", err)
+	}
+}
@@ -0,0 +1,315 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mesh
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"runtime/pprof"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Crash artifacts - CloudRun instances are ephemeral, the core files and logs are lost with the instance.
+//
+// If MESH_CRASH_BUCKET is set (BUCKET or BUCKET/PREFIX), a child exiting with an error uploads a tar.gz with:
+// - the core file, if one was written after krun started, truncated to MESH_CORE_MAX_MB (default 256)
+// - the Envoy config dump - live if the admin port still answers, else the last snapshot (taken every 5 min)
+// - the output ring buffers of all children
+// - a manifest with the exit status and instance metadata
+//
+// Core dumps are enabled by raising RLIMIT_CORE, inherited by the agent, Envoy and app. The kernel writes the
+// core in the directory from /proc/sys/kernel/core_pattern, or the working directory of the process - MESH_CORE_DIR
+// adds a directory to search.
+//
+// SIGQUIT to krun uploads the same artifacts, with the krun goroutines instead of a core - without exiting.
+//
+// The object name is PREFIX/SERVICE/INSTANCE/SOURCE-TIME.tar.gz.
+
+// ArtifactUploader abstracts the vendor object storage.
+type ArtifactUploader interface {
+	UploadArtifact(ctx context.Context, bucket, name string, r io.Reader) error
+}
+
+// crashState holds the last Envoy config dump.
+type crashState struct {
+	m          sync.Mutex
+	configDump []byte
+}
+
+// crashBucket returns the bucket and object prefix, or "" if uploads are disabled.
+func (kr *KRun) crashBucket() (string, string) {
+	b := strings.TrimPrefix(kr.Config("MESH_CRASH_BUCKET", ""), "gs://")
+	parts := strings.SplitN(strings.Trim(b, "/"), "/", 2)
+	if len(parts) == 1 {
+		return parts[0], ""
+	}
+	return parts[0], parts[1] + "/"
+}
+
+func (kr *KRun) coreMaxSize() int64 {
+	n, err := strconv.Atoi(kr.Config("MESH_CORE_MAX_MB", "256"))
+	if err != nil || n < 0 {
+		n = 256
+	}
+	return int64(n) << 20
+}
+
+// EnableCoreDumps raises the core size limit, so crashes of krun and its children write a core - only if
+// MESH_CRASH_BUCKET is set.
+func (kr *KRun) EnableCoreDumps() {
+	if b, _ := kr.crashBucket(); b == "" || kr.DryRun {
+		return
+	}
+	if err := setCoreLimit(uint64(kr.coreMaxSize())); err != nil {
+		log.Println("Failed to enable core dumps", err)
+	}
+}
+
+// StartConfigDumpSnapshots keeps a copy of the Envoy config dump, included in the artifacts if Envoy crashes.
+func (kr *KRun) StartConfigDumpSnapshots(ctx context.Context) {
+	if b, _ := kr.crashBucket(); b == "" || kr.ArtifactUploader == nil {
+		return
+	}
+	go func() {
+		t := time.NewTicker(5 * time.Minute)
+		defer t.Stop()
+		for {
+			actx, cf := context.WithTimeout(ctx, 10*time.Second)
+			data, err := envoyAdminGet(actx, "/config_dump")
+			cf()
+			if err == nil {
+				kr.crash.m.Lock()
+				kr.crash.configDump = data
+				kr.crash.m.Unlock()
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-t.C:
+			}
+		}
+	}()
+}
+
+// UploadCrash uploads the artifacts for an unexpected exit of source. The call blocks until the upload is
+// done - the instance may be stopped after the child exits.
+func (kr *KRun) UploadCrash(source string, cmd *exec.Cmd, err error) {
+	bucket, prefix := kr.crashBucket()
+	if bucket == "" || kr.ArtifactUploader == nil || kr.DryRun {
+		return
+	}
+	manifest := map[string]string{
+		"source":  source,
+		"message": fmt.Sprint(err),
+	}
+	if cmd != nil && cmd.ProcessState != nil {
+		manifest["exitCode"] = strconv.Itoa(cmd.ProcessState.ExitCode())
+		if ws, ok := cmd.ProcessState.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+			manifest["signal"] = ws.Signal().String()
+			manifest["coreDumped"] = strconv.FormatBool(ws.CoreDump())
+		}
+	}
+	dir := ""
+	if cmd != nil {
+		dir = cmd.Dir
+	}
+	core := findCore(kr.coreDirs(dir), kr.StartTime)
+	kr.uploadArtifacts(bucket, prefix, source, kr.newEvent(crashEvent(source), manifest), core, nil)
+}
+
+// uploadArtifacts streams the tar.gz to the uploader.
+func (kr *KRun) uploadArtifacts(bucket, prefix, source string, ev *LifecycleEvent, core string, extra map[string][]byte) {
+	name := fmt.Sprintf("%s%s/%s/%s-%s.tar.gz", prefix, ev.Service, kr.InstanceID, source,
+		ev.Time.UTC().Format("20060102T150405Z"))
+
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(kr.writeArtifacts(pw, ev, core, extra))
+	}()
+	ctx, cf := context.WithTimeout(context.Background(), kr.configDuration("MESH_CRASH_UPLOAD_TIMEOUT", time.Minute))
+	defer cf()
+	t0 := time.Now()
+	err := kr.ArtifactUploader.UploadArtifact(ctx, bucket, name, pr)
+	pr.CloseWithError(err)
+	if err != nil {
+		log.Println("Failed to upload crash artifacts", "bucket", bucket, "name", name, "err", err)
+		return
+	}
+	log.Println("Uploaded crash artifacts", "url", "gs://"+bucket+"/"+name, "core", core, "dur", time.Since(t0))
+}
+
+// writeArtifacts writes the tar.gz with the manifest, output buffers, config dump and the core file.
+func (kr *KRun) writeArtifacts(w io.Writer, ev *LifecycleEvent, core string, extra map[string][]byte) error {
+	zw := gzip.NewWriter(w)
+	tw := tar.NewWriter(zw)
+	add := func(name string, data []byte) error {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(data)), ModTime: ev.Time}); err != nil {
+			return err
+		}
+		_, err := tw.Write(data)
+		return err
+	}
+
+	if core != "" {
+		ev.Details["core"] = core
+	}
+	data, _ := json.MarshalIndent(ev, "", "  ")
+	if err := add("manifest.json", data); err != nil {
+		return err
+	}
+	kr.outputsM.Lock()
+	sources := make([]string, 0, len(kr.outputs))
+	for s := range kr.outputs {
+		sources = append(sources, s)
+	}
+	kr.outputsM.Unlock()
+	sort.Strings(sources)
+	for _, s := range sources {
+		if err := add("output-"+s+".txt", []byte(strings.Join(kr.OutputBuffer(s).Lines(), "\n"))); err != nil {
+			return err
+		}
+	}
+	if err := add("config_dump.json", kr.lastConfigDump()); err != nil {
+		return err
+	}
+	names := make([]string, 0, len(extra))
+	for n := range extra {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	for _, n := range names {
+		if err := add(n, extra[n]); err != nil {
+			return err
+		}
+	}
+	if core != "" {
+		if err := addCore(tw, core, kr.coreMaxSize()); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// lastConfigDump returns the live config dump if Envoy still answers, or the last snapshot.
+func (kr *KRun) lastConfigDump() []byte {
+	ctx, cf := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cf()
+	if data, err := envoyAdminGet(ctx, "/config_dump"); err == nil {
+		return data
+	}
+	kr.crash.m.Lock()
+	defer kr.crash.m.Unlock()
+	return kr.crash.configDump
+}
+
+// addCore adds the first limit bytes of the core file.
+func addCore(tw *tar.Writer, core string, limit int64) error {
+	f, err := os.Open(core)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	st, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	size := st.Size()
+	if size > limit {
+		size = limit
+	}
+	if err := tw.WriteHeader(&tar.Header{Name: filepath.Base(core), Mode: 0600, Size: size, ModTime: st.ModTime()}); err != nil {
+		return err
+	}
+	_, err = io.CopyN(tw, f, size)
+	return err
+}
+
+// coreDirs returns the directories where the kernel may write core files.
+func (kr *KRun) coreDirs(cwd string) []string {
+	var dirs []string
+	if d := kr.Config("MESH_CORE_DIR", ""); d != "" {
+		dirs = append(dirs, d)
+	}
+	if p, err := ioutil.ReadFile("/proc/sys/kernel/core_pattern"); err == nil {
+		// Piped patterns send the core to a helper - not available in the instance.
+		if ps := strings.TrimSpace(string(p)); strings.HasPrefix(ps, "/") {
+			dirs = append(dirs, filepath.Dir(ps))
+		}
+	}
+	if cwd == "" {
+		cwd, _ = os.Getwd()
+	}
+	return append(dirs, cwd)
+}
+
+// findCore returns the newest core file modified after since.
+func findCore(dirs []string, since time.Time) string {
+	res := ""
+	var last time.Time
+	for _, d := range dirs {
+		files, err := ioutil.ReadDir(d)
+		if err != nil {
+			continue
+		}
+		for _, f := range files {
+			if !f.Mode().IsRegular() || !strings.HasPrefix(f.Name(), "core") || f.ModTime().Before(since) {
+				continue
+			}
+			if f.ModTime().After(last) {
+				last = f.ModTime()
+				res = filepath.Join(d, f.Name())
+			}
+		}
+	}
+	return res
+}
+
+// handleQuit uploads the artifacts with the krun goroutines on SIGQUIT. Only installed if MESH_CRASH_BUCKET is
+// set - otherwise SIGQUIT keeps the default behavior.
+func (kr *KRun) handleQuit() {
+	bucket, prefix := kr.crashBucket()
+	if bucket == "" || kr.ArtifactUploader == nil {
+		return
+	}
+	go func() {
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, syscall.SIGQUIT)
+		for range sigs {
+			log.Println("Received SIGQUIT, uploading debug artifacts")
+			b := &strings.Builder{}
+			pprof.Lookup("goroutine").WriteTo(b, 2)
+			kr.uploadArtifacts(bucket, prefix, "sigquit", kr.newEvent("sigquit", map[string]string{}), "",
+				map[string][]byte{"krun-goroutines.txt": []byte(b.String())})
+		}
+	}()
+}
@@ -0,0 +1,105 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mesh
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+type fakeUploader struct {
+	bucket, name string
+	files        map[string]string
+}
+
+func (f *fakeUploader) UploadArtifact(ctx context.Context, bucket, name string, r io.Reader) error {
+	f.bucket, f.name = bucket, name
+	f.files = map[string]string{}
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return err
+	}
+	tr := tar.NewReader(zr)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		b, _ := ioutil.ReadAll(tr)
+		f.files[h.Name] = string(b)
+	}
+}
+
+func TestUploadCrash(t *testing.T) {
+	dir, err := ioutil.TempDir("", "core")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	kr := New()
+	kr.InstanceID = "i1"
+	kr.Name = "fortio"
+	kr.StartTime = time.Now().Add(-time.Minute)
+	if b, _ := kr.crashBucket(); b != "" {
+		t.Error("Uploads enabled by default")
+	}
+	os.Setenv("MESH_CRASH_BUCKET", "gs://crashes/krun")
+	defer os.Unsetenv("MESH_CRASH_BUCKET")
+	os.Setenv("MESH_CORE_DIR", dir)
+	defer os.Unsetenv("MESH_CORE_DIR")
+	os.Setenv("MESH_CORE_MAX_MB", "0")
+	defer os.Unsetenv("MESH_CORE_MAX_MB")
+
+	// An old core file, from a previous run, is ignored.
+	old := filepath.Join(dir, "core.1")
+	ioutil.WriteFile(old, []byte("old"), 0600)
+	os.Chtimes(old, kr.StartTime.Add(-time.Hour), kr.StartTime.Add(-time.Hour))
+	ioutil.WriteFile(filepath.Join(dir, "core.2"), bytes.Repeat([]byte("x"), 1024), 0600)
+	kr.OutputBuffer("envoy").Add("assert failure")
+
+	fu := &fakeUploader{}
+	kr.ArtifactUploader = fu
+	kr.UploadCrash("envoy", nil, errors.New("signal: aborted"))
+
+	if fu.bucket != "crashes" || !strings.HasPrefix(fu.name, "krun/fortio/i1/envoy-") {
+		t.Fatal("Unexpected object", fu.bucket, fu.name)
+	}
+	if !strings.Contains(fu.files["output-envoy.txt"], "assert failure") {
+		t.Error("Missing output", fu.files)
+	}
+	if !strings.Contains(fu.files["manifest.json"], "core.2") {
+		t.Error("Missing core in manifest", fu.files["manifest.json"])
+	}
+	if c, ok := fu.files["core.2"]; !ok || len(c) != 0 {
+		t.Error("Core not truncated to MESH_CORE_MAX_MB", len(c), ok)
+	}
+	if _, ok := fu.files["core.1"]; ok {
+		t.Error("Old core uploaded")
+	}
+}
@@ -0,0 +1,86 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mesh
+
+import (
+	"errors"
+	"log"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// When running as root, each child process runs with its own credential - krun keeps root only for the iptables
+// setup. MESH_USER_<NAME> overrides the default for a child, as uid, uid:gid or a user name:
+//
+// - MESH_USER_APP - the main app. K8S_UID is also supported. Default is the krun user.
+// - MESH_USER_HOOKS - the preStart and postStart hooks. Default is the krun user.
+// - MESH_USER_CLOUDSQL - the Cloud SQL proxy, default 1337:1337.
+// - MESH_USER_AGENT - pilot-agent, default 0:1337.
+// - MESH_USER_ENVOY - Envoy, when started directly for TD, default 1337:1337.
+//
+// The proxy traffic is excluded from capture using the 1337 group - agent and Envoy must keep it.
+// The additional app processes use the 'user' setting.
+
+// proxyGID is the group used by iptables to identify the proxy traffic.
+const proxyGID = 1337
+
+// childCredential returns the credential for a child, or nil if the child should run as the krun user.
+func (kr *KRun) childCredential(name, def string) (*syscall.Credential, error) {
+	spec := kr.Config("MESH_USER_"+strings.ToUpper(name), def)
+	if spec == "" || os.Getuid() != 0 {
+		return nil, nil
+	}
+	cred, err := parseCredential(spec)
+	if err != nil {
+		return nil, err
+	}
+	if (name == "agent" || name == "envoy") && cred.Gid != proxyGID {
+		log.Println("Proxy group is not 1337, outbound traffic from the proxy will be captured", "child", name, "user", spec)
+	}
+	return cred, nil
+}
+
+// parseCredential parses uid, uid:gid or a user name. If the group is not set, the primary group of the user is
+// used for names, and the uid for numeric ids.
+func parseCredential(spec string) (*syscall.Credential, error) {
+	parts := strings.SplitN(spec, ":", 2)
+	uid, err := strconv.Atoi(parts[0])
+	gid := uid
+	if err != nil {
+		u, lerr := user.Lookup(parts[0])
+		if lerr != nil {
+			return nil, lerr
+		}
+		uid, _ = strconv.Atoi(u.Uid)
+		gid, _ = strconv.Atoi(u.Gid)
+	}
+	if len(parts) == 2 {
+		gid, err = strconv.Atoi(parts[1])
+		if err != nil {
+			g, lerr := user.LookupGroup(parts[1])
+			if lerr != nil {
+				return nil, lerr
+			}
+			gid, _ = strconv.Atoi(g.Gid)
+		}
+	}
+	if uid < 0 || gid < 0 {
+		return nil, errors.New("invalid user " + spec)
+	}
+	return &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid)}, nil
+}
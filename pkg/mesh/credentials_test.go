@@ -0,0 +1,52 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mesh
+
+import (
+	"os"
+	"testing"
+)
+
+func TestParseCredential(t *testing.T) {
+	c, err := parseCredential("1000:2000")
+	if err != nil || c.Uid != 1000 || c.Gid != 2000 {
+		t.Error("Unexpected credential", c, err)
+	}
+	c, err = parseCredential("1000")
+	if err != nil || c.Uid != 1000 || c.Gid != 1000 {
+		t.Error("Unexpected credential", c, err)
+	}
+	if _, err = parseCredential("no-such-user-krun"); err == nil {
+		t.Error("Expecting error for unknown user")
+	}
+}
+
+func TestChildCredential(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("Requires root")
+	}
+	os.Setenv("MESH_USER_APP", "1000:1000")
+	defer os.Unsetenv("MESH_USER_APP")
+	kr := New()
+	if c, err := kr.childCredential("app", "5"); err != nil || c.Uid != 1000 {
+		t.Error("Expecting MESH_USER_APP", c, err)
+	}
+	if c, err := kr.childCredential("hooks", ""); err != nil || c != nil {
+		t.Error("Expecting krun user for hooks", c, err)
+	}
+	if c, err := kr.childCredential("agent", "0:1337"); err != nil || c.Uid != 0 || c.Gid != 1337 {
+		t.Error("Unexpected agent user", c, err)
+	}
+}
@@ -0,0 +1,107 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mesh
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+)
+
+// StartDebugServer serves the DebugMux on MESH_DEBUG_ADDR (default 127.0.0.1:15030). Set to "-" to disable.
+// The server is only reachable from the instance - use ssh port forwarding to access it remotely.
+func (kr *KRun) StartDebugServer() error {
+	addr := kr.Config("MESH_DEBUG_ADDR", "127.0.0.1:15030")
+	if addr == "-" {
+		return nil
+	}
+	kr.DebugMux.HandleFunc("/debug/lastlogs", kr.handleLastLogs)
+	kr.DebugMux.HandleFunc("/debug/config", kr.handleConfig)
+	kr.DebugMux.HandleFunc("/debug/build", kr.handleBuild)
+	kr.DebugMux.HandleFunc("/debug/drain", kr.handleDrain)
+	kr.DebugMux.HandleFunc("/debug/config_dump", kr.handleConfigDump)
+	kr.DebugMux.HandleFunc("/debug/capture", kr.handleCapture)
+	kr.DebugMux.HandleFunc("/debug/xds_resolver", kr.handleXDSResolver)
+	kr.DebugMux.HandleFunc("/debug/healthz", kr.handleHealthz)
+	kr.DebugMux.HandleFunc("/debug/info", kr.handleMeshInfo)
+	kr.DebugMux.HandleFunc("/debug/mirror", kr.handleMirror)
+	kr.DebugMux.HandleFunc("/debug/versions", kr.handleVersions)
+	if t, err := kr.adminToken(); err != nil {
+		log.Println("Envoy admin subset disabled", err)
+	} else {
+		kr.DebugMux.Handle("/debug/envoy/", envoyAdminProxy(envoyAdmin, t))
+		kr.DebugMux.Handle("/debug/upgrade", kr.handleUpgrade(t))
+	}
+
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	go func() {
+		err := http.Serve(l, kr.DebugMux)
+		log.Println("Debug server closed", err)
+	}()
+	return nil
+}
+
+// handleLastLogs returns the buffered output of the children, as plain text.
+// The 'source' parameter selects one child (app, pilot-agent, envoy), 'lines' limits the number of lines.
+func (kr *KRun) handleLastLogs(w http.ResponseWriter, r *http.Request) {
+	src := r.FormValue("source")
+	n, _ := strconv.Atoi(r.FormValue("lines"))
+	w.Header().Set("content-type", "text/plain; charset=utf-8")
+	if src != "" {
+		kr.writeLastLogs(w, src, n)
+		return
+	}
+	for _, s := range kr.outputSources() {
+		fmt.Fprintf(w, "==> %s <==\n", s)
+		kr.writeLastLogs(w, s, n)
+	}
+}
+
+func (kr *KRun) writeLastLogs(w io.Writer, source string, n int) {
+	lines := kr.OutputBuffer(source).Lines()
+	if n > 0 && len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	for _, l := range lines {
+		io.WriteString(w, l+"\n")
+	}
+}
+
+func (kr *KRun) outputSources() []string {
+	kr.outputsM.Lock()
+	defer kr.outputsM.Unlock()
+	res := []string{}
+	for k := range kr.outputs {
+		res = append(res, k)
+	}
+	sort.Strings(res)
+	return res
+}
+
+// dumpLastLogs writes the buffered output of all children to w. Used on exit - with the pty relay the child
+// output may otherwise be lost or interleaved.
+func (kr *KRun) dumpLastLogs(w io.Writer) {
+	for _, s := range kr.outputSources() {
+		fmt.Fprintf(w, "==> last output of %s <==\n", s)
+		kr.writeLastLogs(w, s, 0)
+	}
+}
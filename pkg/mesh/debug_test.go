@@ -0,0 +1,65 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mesh
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestLastLogs(t *testing.T) {
+	kr := &KRun{}
+	kr.OutputBuffer("envoy").Add("e1\n")
+	kr.OutputBuffer("envoy").Add("e2\n")
+	kr.OutputBuffer("app").Add("a1\n")
+
+	for q, exp := range map[string]string{
+		"":                      "==> app <==\na1\n==> envoy <==\ne1\ne2\n",
+		"?source=envoy":         "e1\ne2\n",
+		"?source=envoy&lines=1": "e2\n",
+	} {
+		w := httptest.NewRecorder()
+		kr.handleLastLogs(w, httptest.NewRequest("GET", "/debug/lastlogs"+q, nil))
+		if w.Body.String() != exp {
+			t.Errorf("Unexpected output for %q: %q", q, w.Body.String())
+		}
+	}
+}
+
+func TestExitDumpsLogs(t *testing.T) {
+	defer func(g time.Duration, e func(int), s *os.File) {
+		exitGrace, exitProcess, os.Stderr = g, e, s
+	}(exitGrace, exitProcess, os.Stderr)
+	f, err := ioutil.TempFile(t.TempDir(), "stderr")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	exitGrace = 0
+	code := -1
+	exitProcess = func(c int) { code = c }
+	os.Stderr = f
+
+	kr := &KRun{}
+	kr.OutputBuffer("app").Add("bye\n")
+	kr.Exit(0)
+	out, _ := ioutil.ReadFile(f.Name())
+	if code != 0 || string(out) != "==> last output of app <==\nbye\n" {
+		t.Errorf("Unexpected exit %d %q", code, out)
+	}
+}
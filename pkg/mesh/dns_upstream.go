@@ -0,0 +1,330 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mesh
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/GoogleCloudPlatform/cloud-run-mesh/pkg/hbone"
+)
+
+// DNSUpstream forwards plain DNS queries to a DNS-over-TLS or DNS-over-HTTPS server.
+//
+// The pilot-agent DNS proxy resolves mesh names and forwards everything else to the nameservers in
+// /var/lib/istio/resolv.conf. In environments where egress to port 53 is blocked (or must be encrypted),
+// DNS_UPSTREAM can be set in mesh-env or env:
+//
+// - tls://8.8.8.8:853 - DoT, RFC 7858. DNS_UPSTREAM_SERVERNAME sets the SNI, default is the host in the URL.
+// - https://8.8.8.8/dns-query - DoH, RFC 8484
+//
+// The upstream host should be an IP address - krun resolves names using the same resolver that it is replacing.
+//
+// krun will listen on DNS_UPSTREAM_LISTEN (default 127.0.0.2:53) and use it as the only nameserver for the agent.
+//
+// DoT connections are kept open and reused for following queries. UDP responses larger than the client buffer
+// are truncated, with the TC bit set - the client will retry using TCP.
+type DNSUpstream struct {
+	// URL of the upstream server.
+	URL *url.URL
+
+	// Timeout for each query. Default 5s.
+	Timeout time.Duration
+
+	tlsConfig  *tls.Config
+	httpClient *http.Client
+	addr       string
+
+	// idle DoT connections.
+	idle chan net.Conn
+}
+
+// dotIdleConns is the max number of idle DoT connections kept open.
+const dotIdleConns = 4
+
+// minDNSUDPSize is the max UDP response size for clients not using EDNS0.
+const minDNSUDPSize = 512
+
+// NewDNSUpstream creates a forwarder for a tls:// or https:// upstream.
+func NewDNSUpstream(upstream string, serverName string) (*DNSUpstream, error) {
+	u, err := url.Parse(upstream)
+	if err != nil {
+		return nil, err
+	}
+	d := &DNSUpstream{URL: u, Timeout: 5 * time.Second}
+	switch u.Scheme {
+	case "tls":
+		d.addr = u.Host
+		if u.Port() == "" {
+			d.addr = net.JoinHostPort(u.Host, "853")
+		}
+		if serverName == "" && net.ParseIP(u.Hostname()) == nil {
+			serverName = u.Hostname()
+		}
+		d.tlsConfig = hbone.TLSConfig(&tls.Config{
+			ServerName:         serverName,
+			ClientSessionCache: tls.NewLRUClientSessionCache(16),
+		})
+		d.idle = make(chan net.Conn, dotIdleConns)
+	case "https":
+		d.httpClient = &http.Client{Timeout: d.Timeout}
+	default:
+		return nil, fmt.Errorf("unsupported DNS upstream %s, expecting tls:// or https://", upstream)
+	}
+	return d, nil
+}
+
+// StartDNSUpstream starts the local forwarder and configures it as the agent nameserver, if DNS_UPSTREAM is set.
+// Only used when running as root, with DNS capture.
+func (kr *KRun) StartDNSUpstream() error {
+	upstream := kr.Config("DNS_UPSTREAM", "")
+	if upstream == "" {
+		return nil
+	}
+	d, err := NewDNSUpstream(upstream, kr.Config("DNS_UPSTREAM_SERVERNAME", ""))
+	if err != nil {
+		return err
+	}
+	listen := kr.Config("DNS_UPSTREAM_LISTEN", "127.0.0.2:53")
+	err = d.ListenAndServe(listen)
+	if err != nil {
+		return err
+	}
+	host, _, _ := net.SplitHostPort(listen)
+	// resolv.conf doesn't allow a port - the listener must use 53.
+	err = ioutil.WriteFile("/var/lib/istio/resolv.conf", []byte("nameserver "+host+"\n"), 0644)
+	if err != nil {
+		return err
+	}
+	log.Println("DNS upstream enabled", "upstream", upstream, "listen", listen)
+	return nil
+}
+
+// ListenAndServe starts UDP and TCP listeners for plain DNS.
+func (d *DNSUpstream) ListenAndServe(addr string) error {
+	pc, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return err
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		pc.Close()
+		return err
+	}
+	go d.serveUDP(pc)
+	go d.serveTCP(l)
+	return nil
+}
+
+func (d *DNSUpstream) serveUDP(pc net.PacketConn) {
+	for {
+		buf := make([]byte, 4096)
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			log.Println("DNS upstream UDP listener closed", err)
+			return
+		}
+		go func() {
+			res, err := d.Exchange(context.Background(), buf[0:n])
+			if err != nil {
+				if Debug {
+					log.Println("DNS upstream error", err)
+				}
+				return
+			}
+			pc.WriteTo(truncateUDP(buf[0:n], res), addr)
+		}()
+	}
+}
+
+func (d *DNSUpstream) serveTCP(l net.Listener) {
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			log.Println("DNS upstream TCP listener closed", err)
+			return
+		}
+		go func() {
+			defer c.Close()
+			for {
+				c.SetReadDeadline(time.Now().Add(10 * time.Second))
+				q, err := readTCPMsg(c)
+				if err != nil {
+					return
+				}
+				res, err := d.Exchange(context.Background(), q)
+				if err != nil {
+					return
+				}
+				if err = writeTCPMsg(c, res); err != nil {
+					return
+				}
+			}
+		}()
+	}
+}
+
+// Exchange sends a query in wire format to the upstream server, and returns the response.
+func (d *DNSUpstream) Exchange(ctx context.Context, q []byte) ([]byte, error) {
+	ctx, cf := context.WithTimeout(ctx, d.Timeout)
+	defer cf()
+	if d.httpClient != nil {
+		return d.exchangeHTTPS(ctx, q)
+	}
+	return d.exchangeTLS(ctx, q)
+}
+
+func (d *DNSUpstream) exchangeTLS(ctx context.Context, q []byte) ([]byte, error) {
+	for {
+		c, reused, err := d.tlsConn(ctx)
+		if err != nil {
+			return nil, err
+		}
+		res, err := dnsRoundTrip(ctx, c, q)
+		if err == nil {
+			c.SetDeadline(time.Time{})
+			select {
+			case d.idle <- c:
+			default:
+				c.Close()
+			}
+			return res, nil
+		}
+		c.Close()
+		// The server may have closed an idle connection - retry, using a new connection if none is left.
+		if !reused || ctx.Err() != nil {
+			return nil, err
+		}
+	}
+}
+
+// tlsConn returns an idle DoT connection, or a new one.
+func (d *DNSUpstream) tlsConn(ctx context.Context) (net.Conn, bool, error) {
+	select {
+	case c := <-d.idle:
+		return c, true, nil
+	default:
+	}
+	td := &tls.Dialer{Config: d.tlsConfig}
+	c, err := td.DialContext(ctx, "tcp", d.addr)
+	return c, false, err
+}
+
+// dnsRoundTrip sends a query on a stream connection and reads the response, which must have the query ID.
+func dnsRoundTrip(ctx context.Context, c net.Conn, q []byte) ([]byte, error) {
+	if dl, ok := ctx.Deadline(); ok {
+		c.SetDeadline(dl)
+	}
+	if err := writeTCPMsg(c, q); err != nil {
+		return nil, err
+	}
+	res, err := readTCPMsg(c)
+	if err != nil {
+		return nil, err
+	}
+	if len(q) < 2 || len(res) < 2 || res[0] != q[0] || res[1] != q[1] {
+		return nil, errors.New("DNS response ID mismatch")
+	}
+	return res, nil
+}
+
+func (d *DNSUpstream) exchangeHTTPS(ctx context.Context, q []byte) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", d.URL.String(), bytes.NewReader(q))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("content-type", "application/dns-message")
+	req.Header.Set("accept", "application/dns-message")
+	res, err := d.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		return nil, fmt.Errorf("DoH upstream status %d", res.StatusCode)
+	}
+	return ioutil.ReadAll(io.LimitReader(res.Body, 65535))
+}
+
+// truncateUDP returns the response if it fits the client UDP buffer. Otherwise returns the header and question,
+// with the TC bit set.
+func truncateUDP(q, res []byte) []byte {
+	if len(res) <= dnsUDPSize(q) || len(res) < 12 {
+		return res
+	}
+	tc := make([]byte, 12, minDNSUDPSize)
+	copy(tc, res[0:4])
+	tc[2] |= 0x02
+	if _, end := dnsQuestionName(q); end > 0 && end+4 <= len(q) && binary.BigEndian.Uint16(q[4:6]) == 1 {
+		binary.BigEndian.PutUint16(tc[4:], 1)
+		tc = append(tc, q[12:end+4]...)
+	}
+	return tc
+}
+
+// dnsUDPSize returns the UDP payload size from the EDNS0 OPT record of a query, or 512. Only the usual query
+// format is checked - one question and the OPT record as the only additional record.
+func dnsUDPSize(q []byte) int {
+	if len(q) < 12 || binary.BigEndian.Uint16(q[4:6]) != 1 || binary.BigEndian.Uint16(q[6:10]) != 0 ||
+		binary.BigEndian.Uint16(q[10:12]) != 1 {
+		return minDNSUDPSize
+	}
+	_, end := dnsQuestionName(q)
+	// Root name, type OPT, class is the payload size.
+	opt := end + 4
+	if end < 0 || opt+5 > len(q) || q[opt] != 0 || binary.BigEndian.Uint16(q[opt+1:]) != 41 {
+		return minDNSUDPSize
+	}
+	if size := int(binary.BigEndian.Uint16(q[opt+3:])); size > minDNSUDPSize {
+		return size
+	}
+	return minDNSUDPSize
+}
+
+// DNS over TCP (and TLS) messages are prefixed with a 2 byte length.
+func readTCPMsg(r io.Reader) ([]byte, error) {
+	var l uint16
+	if err := binary.Read(r, binary.BigEndian, &l); err != nil {
+		return nil, err
+	}
+	if l == 0 {
+		return nil, errors.New("invalid DNS message length")
+	}
+	msg := make([]byte, l)
+	_, err := io.ReadFull(r, msg)
+	return msg, err
+}
+
+func writeTCPMsg(w io.Writer, msg []byte) error {
+	if len(msg) > 65535 {
+		return errors.New("DNS message too large")
+	}
+	b := make([]byte, 2+len(msg))
+	binary.BigEndian.PutUint16(b, uint16(len(msg)))
+	copy(b[2:], msg)
+	_, err := w.Write(b)
+	return err
+}
@@ -0,0 +1,142 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mesh
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+// withEDNS adds an EDNS0 OPT record with the UDP payload size to a query.
+func withEDNS(q []byte, size uint16) []byte {
+	q = append([]byte{}, q...)
+	binary.BigEndian.PutUint16(q[10:], 1)
+	return append(q, 0, 0, 41, byte(size>>8), byte(size), 0, 0, 0, 0, 0, 0)
+}
+
+// dnsEcho returns the query as response, padded to size.
+func dnsEcho(q []byte, size int) []byte {
+	res := append([]byte{}, q...)
+	res[2] |= 0x80
+	for len(res) < size {
+		res = append(res, 0)
+	}
+	return res
+}
+
+func TestDNSUpstreamTLS(t *testing.T) {
+	ts := httptest.NewTLSServer(nil)
+	ts.Close()
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: ts.TLS.Certificates})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	var conns int32
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&conns, 1)
+			// Each connection is closed by the server after 2 queries.
+			go func() {
+				defer c.Close()
+				for i := 0; i < 2; i++ {
+					q, err := readTCPMsg(c)
+					if err != nil {
+						return
+					}
+					writeTCPMsg(c, dnsEcho(q, 0))
+				}
+			}()
+		}
+	}()
+
+	d, err := NewDNSUpstream("tls://"+l.Addr().String(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.tlsConfig.RootCAs = x509.NewCertPool()
+	d.tlsConfig.RootCAs.AddCert(ts.Certificate())
+	for i := 0; i < 3; i++ {
+		res, err := d.Exchange(context.Background(), dnsQuery(uint16(i), "www.test", 1))
+		if err != nil {
+			t.Fatal(i, err)
+		}
+		if binary.BigEndian.Uint16(res) != uint16(i) {
+			t.Error("Unexpected response ID", i, res)
+		}
+	}
+	if n := atomic.LoadInt32(&conns); n != 2 {
+		t.Error("Expecting reused connections", n)
+	}
+}
+
+func TestDNSUpstreamHTTPS(t *testing.T) {
+	s := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q, _ := ioutil.ReadAll(r.Body)
+		if r.Header.Get("content-type") != "application/dns-message" {
+			http.Error(w, "bad content type", 400)
+			return
+		}
+		w.Write(dnsEcho(q, 0))
+	}))
+	defer s.Close()
+	d, err := NewDNSUpstream(s.URL+"/dns-query", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.httpClient = s.Client()
+	res, err := d.Exchange(context.Background(), dnsQuery(7, "www.test", 1))
+	if err != nil || binary.BigEndian.Uint16(res) != 7 {
+		t.Fatal("Unexpected DoH response", res, err)
+	}
+	if _, err := NewDNSUpstream("udp://8.8.8.8", ""); err == nil {
+		t.Error("Expecting error for unsupported upstream")
+	}
+}
+
+func TestTruncateUDP(t *testing.T) {
+	q := dnsQuery(1, "www.test", 1)
+	if res := dnsEcho(q, 400); len(truncateUDP(q, res)) != 400 {
+		t.Error("Unexpected truncation")
+	}
+	res := truncateUDP(q, dnsEcho(q, 600))
+	if len(res) != len(q) || res[2]&0x02 == 0 || binary.BigEndian.Uint16(res[4:]) != 1 {
+		t.Error("Expecting truncated response", res)
+	}
+	for _, a := range res[6:12] {
+		if a != 0 {
+			t.Error("Expecting no records", res)
+		}
+	}
+
+	q = withEDNS(dnsQuery(1, "www.test", 1), 1232)
+	if dnsUDPSize(q) != 1232 {
+		t.Error("Unexpected EDNS0 size", dnsUDPSize(q))
+	}
+	if res := truncateUDP(q, dnsEcho(q, 1000)); len(res) != 1000 || res[2]&0x02 != 0 {
+		t.Error("Unexpected truncation with EDNS0")
+	}
+}
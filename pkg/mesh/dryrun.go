@@ -0,0 +1,97 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mesh
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os/exec"
+	"strings"
+)
+
+// Dry run prints what StartIstioAgent would execute, after the normal discovery - useful for comparing the
+// injection between revisions or with a Pod injected by Istio.
+
+// Env variables with values that are not printed in dry-run mode. Variables ending with _FILE or _PATH hold
+// the location of the secret, and are printed.
+var secretEnvNames = []string{"TOKEN", "SECRET", "PASSWORD", "PASSWD", "CREDENTIAL", "PRIVATE", "_KEY", "KUBECONFIG"}
+
+// redactEnv replaces the value of a KEY=VALUE env entry if the name suggests it holds a secret.
+func redactEnv(kv string) string {
+	parts := strings.SplitN(kv, "=", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return kv
+	}
+	name := strings.ToUpper(parts[0])
+	if strings.HasSuffix(name, "_FILE") || strings.HasSuffix(name, "_PATH") || name == "KUBECONFIG" {
+		return kv
+	}
+	for _, s := range secretEnvNames {
+		if strings.Contains(name, s) {
+			return parts[0] + "=REDACTED"
+		}
+	}
+	return kv
+}
+
+// writeEnv writes the env as shell exports, optionally redacting the secrets.
+func writeEnv(w io.Writer, env []string, redact bool) {
+	for _, e := range env {
+		if redact {
+			e = redactEnv(e)
+		}
+		kv := strings.SplitN(e, "=", 2)
+		if len(kv) == 2 {
+			fmt.Fprintf(w, "export %s='%s'\n", kv[0], strings.Replace(kv[1], "'", `'\''`, -1))
+		}
+	}
+}
+
+// writeLaunchInfo prints the PROXY_CONFIG, env, iptables and agent commands, as a shell script.
+func writeLaunchInfo(w io.Writer, cmd *exec.Cmd, iptables *exec.Cmd) {
+	for _, e := range cmd.Env {
+		if strings.HasPrefix(e, "PROXY_CONFIG=") {
+			b := &bytes.Buffer{}
+			if json.Indent(b, []byte(e[len("PROXY_CONFIG="):]), "# ", "  ") == nil {
+				fmt.Fprintf(w, "# PROXY_CONFIG:\n# %s\n\n", b.String())
+			}
+		}
+	}
+	writeEnv(w, cmd.Env, true)
+	fmt.Fprintln(w)
+	if iptables != nil {
+		fmt.Fprintln(w, "# iptables")
+		fmt.Fprintln(w, shellCommand(iptables.Args))
+		fmt.Fprintln(w)
+	} else {
+		fmt.Fprintln(w, "# iptables: not used, INTERCEPTION_MODE=NONE")
+		fmt.Fprintln(w)
+	}
+	fmt.Fprintln(w, "# agent")
+	fmt.Fprintln(w, shellCommand(cmd.Args))
+}
+
+func shellCommand(args []string) string {
+	q := []string{}
+	for _, a := range args {
+		if a == "" || strings.ContainsAny(a, " *'\"$;&|<>(){}") {
+			a = "'" + strings.Replace(a, "'", `'\''`, -1) + "'"
+		}
+		q = append(q, a)
+	}
+	return strings.Join(q, " ")
+}
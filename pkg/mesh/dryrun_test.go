@@ -0,0 +1,58 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mesh
+
+import (
+	"bytes"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+func TestRedactEnv(t *testing.T) {
+	for in, exp := range map[string]string{
+		"XDS_ADDR=istiod:15012":               "XDS_ADDR=istiod:15012",
+		"GITHUB_TOKEN=abc":                    "GITHUB_TOKEN=REDACTED",
+		"DB_PASSWORD=abc":                     "DB_PASSWORD=REDACTED",
+		"AWS_SECRET_ACCESS_KEY=abc":           "AWS_SECRET_ACCESS_KEY=REDACTED",
+		"MESH_KUBECONFIG=apiVersion: v1":      "MESH_KUBECONFIG=REDACTED",
+		"KUBECONFIG=/var/run/kubeconfig":      "KUBECONFIG=/var/run/kubeconfig",
+		"MESH_OIDC_TOKEN_FILE=/var/run/token": "MESH_OIDC_TOKEN_FILE=/var/run/token",
+		"EMPTY_TOKEN=":                        "EMPTY_TOKEN=",
+	} {
+		if got := redactEnv(in); got != exp {
+			t.Error("Unexpected", in, got)
+		}
+	}
+}
+
+func TestWriteLaunchInfo(t *testing.T) {
+	cmd := exec.Command("/usr/local/bin/pilot-agent", "proxy", "sidecar")
+	cmd.Env = []string{`PROXY_CONFIG={"discoveryAddress": "istiod:15012"}`, "API_KEY=x'y"}
+	ipt := exec.Command("/usr/local/bin/pilot-agent", "istio-iptables", "-i", "*")
+	b := &bytes.Buffer{}
+	writeLaunchInfo(b, cmd, ipt)
+	out := b.String()
+	for _, exp := range []string{
+		`"discoveryAddress": "istiod:15012"`,
+		"export API_KEY='REDACTED'",
+		"/usr/local/bin/pilot-agent istio-iptables -i '*'",
+		"/usr/local/bin/pilot-agent proxy sidecar",
+	} {
+		if !strings.Contains(out, exp) {
+			t.Error("Missing", exp, out)
+		}
+	}
+}
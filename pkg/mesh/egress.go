@@ -0,0 +1,211 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mesh
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/GoogleCloudPlatform/cloud-run-mesh/pkg/hbone"
+)
+
+// Egress gateway role.
+//
+// With the egressgateway role, krun redirects all outbound TCP connections from the instance to a local policy
+// proxy on EGRESS_PORT (default 15081). The proxy extracts the destination hostname from the TLS SNI or the HTTP
+// Host header, and only forwards connections to hosts in EGRESS_ALLOW - a comma separated list of names,
+// '*.example.com' wildcards, or CIDR ranges for connections without a hostname. Each decision is logged, giving
+// an auditable egress path. Connections allowed by hostname are dialed to the resolved hostname, not to the
+// original destination - the app can't use an allowed SNI or Host to reach a different IP.
+//
+// The redirect is inserted before the Istio capture, so in mesh mode the app traffic is checked before it reaches
+// Envoy - connections from the proxy are marked, and captured by Envoy as usual. Traffic from Envoy (uid 1337),
+// to localhost and to the metadata server is not redirected. Connections opened by krun itself - to the K8S API
+// server, STS or Google APIs - are recognized by the proxy and forwarded without checking the policy.
+// IPv6 uses the same rules and proxy, if the instance has IPv6. Requires root.
+
+const egressMark = 1337
+
+// StartEgressPolicy starts the policy proxy and installs the iptables rules, if the egress role is enabled.
+func (kr *KRun) StartEgressPolicy() error {
+	if !kr.HasGateway("egressgateway") {
+		return nil
+	}
+	if os.Getuid() != 0 {
+		return errors.New("egress gateway requires root")
+	}
+	allow := splitList(kr.Config("EGRESS_ALLOW", ""))
+	port := kr.Config("EGRESS_PORT", "15081")
+	l, err := net.Listen("tcp", "127.0.0.1:"+port)
+	if err != nil {
+		return err
+	}
+	go hbone.ServeListener(l, func(c net.Conn) {
+		kr.handleEgress(c, allow)
+	})
+	if err := egressChain("iptables", port).install(); err != nil {
+		return err
+	}
+
+	// The IPv6 redirect goes to ::1. If the instance doesn't have IPv6 there is no IPv6 egress to restrict.
+	l6, err := net.Listen("tcp", "[::1]:"+port)
+	if err != nil {
+		log.Println("Egress policy: IPv6 not available", err)
+	} else {
+		go hbone.ServeListener(l6, func(c net.Conn) {
+			kr.handleEgress(c, allow)
+		})
+		if err := egressChain("ip6tables", port).install(); err != nil {
+			return err
+		}
+	}
+	log.Println("Egress policy enabled", "port", port, "allow", allow)
+	return nil
+}
+
+// egressChain returns the rules redirecting TCP connections to the policy proxy, for iptables or ip6tables.
+func egressChain(cmd, port string) *iptablesChain {
+	local, metadata := "127.0.0.0/8", "169.254.0.0/16"
+	if cmd == "ip6tables" {
+		local, metadata = "::1/128", "fe80::/10"
+	}
+	return &iptablesChain{
+		Cmd:    cmd,
+		Table:  "nat",
+		Name:   "KRUN_EGRESS",
+		Parent: "OUTPUT",
+		Match:  []string{"-p", "tcp"},
+		Rules: [][]string{
+			{"-m", "mark", "--mark", strconv.Itoa(egressMark), "-j", "RETURN"},
+			{"-m", "owner", "--uid-owner", "1337", "-j", "RETURN"},
+			{"-d", local, "-j", "RETURN"},
+			{"-d", metadata, "-j", "RETURN"},
+			{"-p", "tcp", "-j", "REDIRECT", "--to-ports", port},
+		},
+	}
+}
+
+func (kr *KRun) handleEgress(c net.Conn, allow []string) {
+	t0 := time.Now()
+	br := hbone.NewBufferReader(c)
+	defer br.Close()
+
+	dst, err := originalDst(c)
+	if err != nil {
+		log.Println("egress: failed to get original destination", c.RemoteAddr(), err)
+		return
+	}
+	var host, action string
+	target := dst
+	if ownConn(c) {
+		action = "krun"
+	} else {
+		c.SetReadDeadline(time.Now().Add(5 * time.Second))
+		host = egressHost(br)
+		c.SetReadDeadline(time.Time{})
+		action = "allow"
+		target = egressTarget(host, dst, allow)
+		if target == "" {
+			log.Println("egress", "action", "deny", "host", host, "dst", dst)
+			return
+		}
+	}
+
+	d := markedDialer(egressMark)
+	ctx, cf := context.WithTimeout(context.Background(), 10*time.Second)
+	oc, err := d.DialContext(ctx, "tcp", target)
+	cf()
+	if err != nil {
+		log.Println("egress", "action", action, "host", host, "dst", dst, "target", target, "err", err)
+		return
+	}
+	defer oc.Close()
+
+	s1 := hbone.Stream{ID: "egress-o", Src: br, Dst: oc}
+	ch := make(chan int)
+	go s1.CopyBuffered(ch, true)
+	s2 := hbone.Stream{ID: "egress-i", Src: oc, Dst: c}
+	s2.CopyBuffered(nil, true)
+	<-ch
+	log.Println("egress", "action", action, "host", host, "dst", dst, "target", target, "out", s1.Written,
+		"in", s2.Written, "dur", time.Since(t0))
+}
+
+// egressHost returns the hostname from the TLS ClientHello or HTTP request, if any.
+func egressHost(br *hbone.BufferReader) string {
+	buf, err := br.Fill(1)
+	if err != nil || len(buf) == 0 {
+		return ""
+	}
+	if buf[0] == 0x16 {
+		sni, _ := hbone.ParseTLS(br)
+		return sni
+	}
+	// Look for a HTTP/1.x request head.
+	for len(buf) < 8*1024 {
+		if i := bytes.Index(buf, []byte("\r\n\r\n")); i > 0 {
+			req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(buf[0 : i+4])))
+			if err != nil {
+				return ""
+			}
+			if h, _, err := net.SplitHostPort(req.Host); err == nil {
+				return h
+			}
+			return req.Host
+		}
+		buf, err = br.Fill(len(buf) + 1)
+		if err != nil {
+			return ""
+		}
+	}
+	return ""
+}
+
+// egressTarget checks the host - or the destination IP if the host is not known - against the allowlist, and
+// returns the address to dial, or "" if the connection is denied. Connections allowed by hostname are sent to
+// the hostname, using the port of the original destination.
+func egressTarget(host, dst string, allow []string) string {
+	ip, port, err := net.SplitHostPort(dst)
+	if err != nil {
+		return ""
+	}
+	pip := net.ParseIP(ip)
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, a := range allow {
+		if _, cidr, err := net.ParseCIDR(a); err == nil {
+			if pip != nil && cidr.Contains(pip) {
+				return dst
+			}
+			continue
+		}
+		if host == "" {
+			continue
+		}
+		a = strings.ToLower(a)
+		if a == host || (strings.HasPrefix(a, "*.") && strings.HasSuffix(host, a[1:])) {
+			return net.JoinHostPort(host, port)
+		}
+	}
+	return ""
+}
@@ -0,0 +1,155 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mesh
+
+import (
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// SO_ORIGINAL_DST, from linux/netfilter_ipv4.h - IP6T_SO_ORIGINAL_DST has the same value.
+const soOriginalDst = 80
+
+// originalDst returns the destination of a connection redirected by iptables.
+func originalDst(c net.Conn) (string, error) {
+	tc, ok := c.(*net.TCPConn)
+	if !ok {
+		return "", errors.New("not a TCP connection")
+	}
+	rc, err := tc.SyscallConn()
+	if err != nil {
+		return "", err
+	}
+	if la, ok := c.LocalAddr().(*net.TCPAddr); ok && la.IP.To4() == nil {
+		// sockaddr_in6 - IPv6MTUInfo is the only getsockopt result large enough to hold it.
+		var info *syscall.IPv6MTUInfo
+		var serr error
+		err = rc.Control(func(fd uintptr) {
+			info, serr = syscall.GetsockoptIPv6MTUInfo(int(fd), syscall.IPPROTO_IPV6, soOriginalDst)
+		})
+		if err != nil {
+			return "", err
+		}
+		if serr != nil {
+			return "", serr
+		}
+		// The port is in network order, read as a little endian uint16.
+		port := int(info.Addr.Port>>8 | info.Addr.Port<<8)
+		ip := net.IP(info.Addr.Addr[:])
+		return net.JoinHostPort(ip.String(), strconv.Itoa(port)), nil
+	}
+	var addr *syscall.IPv6Mreq
+	var serr error
+	err = rc.Control(func(fd uintptr) {
+		addr, serr = syscall.GetsockoptIPv6Mreq(int(fd), syscall.IPPROTO_IP, soOriginalDst)
+	})
+	if err != nil {
+		return "", err
+	}
+	if serr != nil {
+		return "", serr
+	}
+	// sockaddr_in: family(2), port(2, big endian), addr(4)
+	m := addr.Multiaddr
+	ip := net.IPv4(m[4], m[5], m[6], m[7])
+	port := int(m[2])<<8 | int(m[3])
+	return net.JoinHostPort(ip.String(), strconv.Itoa(port)), nil
+}
+
+// markedDialer sets SO_MARK on outgoing connections, to bypass the egress redirect.
+func markedDialer(mark int) *net.Dialer {
+	return &net.Dialer{
+		Control: func(network, address string, c syscall.RawConn) error {
+			var serr error
+			err := c.Control(func(fd uintptr) {
+				serr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_MARK, mark)
+			})
+			if err != nil {
+				return err
+			}
+			return serr
+		},
+	}
+}
+
+// ownConn returns true if the redirected connection c was opened by the krun process. The kernel socket table
+// maps the client address to a socket inode, which is checked against the descriptors of krun.
+func ownConn(c net.Conn) bool {
+	ra, ok := c.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	inode := socketInode(ra)
+	if inode == "" {
+		return false
+	}
+	fds, err := ioutil.ReadDir("/proc/self/fd")
+	if err != nil {
+		return false
+	}
+	for _, fd := range fds {
+		if l, err := os.Readlink("/proc/self/fd/" + fd.Name()); err == nil && l == "socket:["+inode+"]" {
+			return true
+		}
+	}
+	return false
+}
+
+// socketInode returns the inode of the TCP socket with the local address a, from /proc/net/tcp or tcp6.
+func socketInode(a *net.TCPAddr) string {
+	for _, f := range []string{"/proc/net/tcp", "/proc/net/tcp6"} {
+		data, err := ioutil.ReadFile(f)
+		if err != nil {
+			continue
+		}
+		for _, l := range strings.Split(string(data), "\n")[1:] {
+			fields := strings.Fields(l)
+			if len(fields) < 10 {
+				continue
+			}
+			if ip, port := parseProcAddr(fields[1]); port == a.Port && ip.Equal(a.IP) {
+				return fields[9]
+			}
+		}
+	}
+	return ""
+}
+
+// parseProcAddr parses an address from /proc/net/tcp - hex IP, as 32 bit words in host (little endian) order,
+// and hex port.
+func parseProcAddr(s string) (net.IP, int) {
+	parts := strings.Split(s, ":")
+	if len(parts) != 2 {
+		return nil, 0
+	}
+	b, err := hex.DecodeString(parts[0])
+	if err != nil || (len(b) != 4 && len(b) != 16) {
+		return nil, 0
+	}
+	for i := 0; i < len(b); i += 4 {
+		b[i], b[i+1], b[i+2], b[i+3] = b[i+3], b[i+2], b[i+1], b[i]
+	}
+	port, err := strconv.ParseUint(parts[1], 16, 16)
+	if err != nil {
+		return nil, 0
+	}
+	return net.IP(b), int(port)
+}
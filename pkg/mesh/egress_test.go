@@ -0,0 +1,94 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mesh
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/cloud-run-mesh/pkg/hbone"
+)
+
+func TestEgressTarget(t *testing.T) {
+	allow := []string{"*.googleapis.com", "example.com", "10.10.0.0/16"}
+	for _, c := range []struct {
+		host, dst string
+		res       string
+	}{
+		// Allowed by name: the hostname is dialed, not the original IP.
+		{"storage.googleapis.com", "1.2.3.4:443", "storage.googleapis.com:443"},
+		{"googleapis.com", "1.2.3.4:443", ""},
+		{"Example.com.", "1.2.3.4:80", "example.com:80"},
+		{"evil.com", "10.10.1.1:443", "10.10.1.1:443"},
+		{"", "10.11.1.1:443", ""},
+		{"example.com", "[2001:db8::1]:443", "example.com:443"},
+	} {
+		if r := egressTarget(c.host, c.dst, allow); r != c.res {
+			t.Error("Unexpected result", c, r)
+		}
+	}
+}
+
+func TestEgressHostTLS(t *testing.T) {
+	c, s := net.Pipe()
+	defer s.Close()
+	go func() {
+		tc := tls.Client(c, &tls.Config{ServerName: "storage.googleapis.com"})
+		tc.Handshake()
+		c.Close()
+	}()
+	br := hbone.NewBufferReader(s)
+	if h := egressHost(br); h != "storage.googleapis.com" {
+		t.Error("Unexpected host", h)
+	}
+}
+
+func TestEgressChain(t *testing.T) {
+	defer func(f func(string, ...string) ([]byte, error)) { iptablesRun = f }(iptablesRun)
+	for _, exists := range []bool{false, true} {
+		var cmds []string
+		iptablesRun = func(cmd string, args ...string) ([]byte, error) {
+			l := cmd + " " + strings.Join(args, " ")
+			cmds = append(cmds, l)
+			if (strings.Contains(l, " -L ") || strings.Contains(l, " -C ")) && !exists {
+				return nil, errors.New("missing")
+			}
+			return nil, nil
+		}
+		if err := egressChain("ip6tables", "15009").install(); err != nil {
+			t.Fatal(err)
+		}
+		all := strings.Join(cmds, "\n")
+		if exists != strings.Contains(all, "-F KRUN_EGRESS") || exists == strings.Contains(all, "-N KRUN_EGRESS") {
+			t.Error("Unexpected chain setup", exists, all)
+		}
+		if exists == strings.Contains(all, "ip6tables -t nat -I OUTPUT 1 -p tcp -j KRUN_EGRESS") {
+			t.Error("Unexpected jump", exists, all)
+		}
+		if !strings.Contains(all, "-A KRUN_EGRESS -d ::1/128 -j RETURN") {
+			t.Error("Missing IPv6 rule", all)
+		}
+	}
+}
+
+func TestEgressHost(t *testing.T) {
+	br := hbone.NewBufferReader(strings.NewReader("GET / HTTP/1.1\r\nHost: example.com:8080\r\n\r\n"))
+	if h := egressHost(br); h != "example.com" {
+		t.Error("Unexpected host", h)
+	}
+}
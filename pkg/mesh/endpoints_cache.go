@@ -0,0 +1,467 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mesh
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// EndpointCache keeps a copy of the mesh names known to the proxy, in krun memory and in a file on the in-memory
+// volume.
+//
+// Envoy and the pilot-agent DNS proxy only keep this state in memory - if the agent is restarted while the
+// control plane is not reachable, the app can't resolve mesh names until XDS is back. The agent DNS proxy
+// forwards the names it doesn't know to the nameservers in /var/lib/istio/resolv.conf - krun listens on
+// MESH_ENDPOINT_CACHE_DNS (default 127.0.0.3:53) and is set as the agent nameserver, answering the cached mesh
+// names and forwarding other queries to the original nameserver. A restarted agent resolves the mesh names
+// using the cache until it gets them from XDS again.
+//
+// Enabled with MESH_ENDPOINT_CACHE=true, requires DNS capture.
+type EndpointCache struct {
+	// Hosts maps a mesh hostname (foo.ns.svc.cluster.local) to the addresses returned by the DNS proxy (VIPs).
+	Hosts map[string][]string `json:"hosts,omitempty"`
+
+	Updated time.Time `json:"updated,omitempty"`
+
+	m        sync.RWMutex
+	file     string
+	adminURL string
+
+	// upstream is the nameserver for names that are not cached, host:port.
+	upstream string
+}
+
+// hostsFile is replaced in tests.
+var hostsFile = "/etc/hosts"
+
+// lookupHost resolves the mesh hostnames, replaced in tests.
+var lookupHost = net.DefaultResolver.LookupHost
+
+// istioResolvConf holds the nameservers used by the agent DNS proxy.
+const istioResolvConf = "/var/lib/istio/resolv.conf"
+
+// TTL of the cached answers - short, the agent DNS proxy takes over once it has the names from XDS.
+const endpointCacheTTL = 30
+
+// NewEndpointCache creates a cache persisted under the base dir.
+func (kr *KRun) NewEndpointCache() *EndpointCache {
+	return &EndpointCache{
+		Hosts:    map[string][]string{},
+		file:     filepath.Join(kr.BaseDir, "/var/lib/istio/endpoints.json"),
+		adminURL: "http://127.0.0.1:15000",
+	}
+}
+
+// StartEndpointCache starts a periodic refresh from the Envoy admin interface, until ctx is done.
+// Should be called after Envoy is ready.
+func (kr *KRun) StartEndpointCache(ctx context.Context) {
+	if kr.Config("MESH_ENDPOINT_CACHE", "") == "" || kr.EndpointCache == nil {
+		return
+	}
+	interval, err := time.ParseDuration(kr.Config("MESH_ENDPOINT_CACHE_INTERVAL", "30s"))
+	if err != nil {
+		interval = 30 * time.Second
+	}
+	go func() {
+		for {
+			rctx, cf := context.WithTimeout(ctx, 10*time.Second)
+			err := kr.EndpointCache.Refresh(rctx)
+			cf()
+			if err != nil {
+				if Debug {
+					log.Println("Endpoint cache refresh failed", err)
+				}
+			} else {
+				kr.EndpointCache.Save()
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(interval):
+			}
+		}
+	}()
+}
+
+// SeedEndpointCache loads the names saved by a previous krun, and sets krun as the nameserver of the agent DNS
+// proxy, answering the cached names. Called with the DNS capture, before starting the agent.
+func (kr *KRun) SeedEndpointCache(ctx context.Context) {
+	if kr.Config("MESH_ENDPOINT_CACHE", "") == "" || kr.EndpointCache != nil {
+		return
+	}
+	ec := kr.NewEndpointCache()
+	if err := ec.Load(); err != nil && !os.IsNotExist(err) {
+		log.Println("Failed to load endpoint cache", err)
+	}
+	data, err := ioutil.ReadFile(istioResolvConf)
+	if err != nil {
+		log.Println("Endpoint cache disabled, no agent resolv.conf", err)
+		return
+	}
+	ec.upstream = firstNameserver(string(data))
+	if ec.upstream == "" {
+		log.Println("Endpoint cache disabled, no nameserver in", istioResolvConf)
+		return
+	}
+	listen := kr.Config("MESH_ENDPOINT_CACHE_DNS", "127.0.0.3:53")
+	if err := ec.ListenDNS(ctx, listen); err != nil {
+		log.Println("Endpoint cache disabled", err)
+		return
+	}
+	host, _, _ := net.SplitHostPort(listen)
+	// resolv.conf doesn't allow a port - the listener must use 53.
+	if err := ioutil.WriteFile(istioResolvConf, []byte("nameserver "+host+"\n"), 0644); err != nil {
+		log.Println("Endpoint cache disabled", err)
+		return
+	}
+	kr.EndpointCache = ec
+	log.Println("Endpoint cache enabled", "hosts", len(ec.Hosts), "listen", listen, "upstream", ec.upstream)
+}
+
+// firstNameserver returns the address of the first nameserver in a resolv.conf, with port 53.
+func firstNameserver(resolvConf string) string {
+	for _, l := range strings.Split(resolvConf, "\n") {
+		f := strings.Fields(l)
+		if len(f) >= 2 && f[0] == "nameserver" {
+			return net.JoinHostPort(f[1], "53")
+		}
+	}
+	return ""
+}
+
+// Refresh loads the current outbound clusters from Envoy, and resolves the hostnames using the local resolver.
+// All names are resolved again on each refresh, so VIP changes are picked up - the cached addresses are kept
+// only if the lookup fails.
+func (ec *EndpointCache) Refresh(ctx context.Context) error {
+	req, _ := http.NewRequestWithContext(ctx, "GET", ec.adminURL+"/clusters?format=json", nil)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	data, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	eps, err := parseEnvoyClusters(data)
+	if err != nil {
+		return err
+	}
+
+	ec.m.RLock()
+	oldHosts := ec.Hosts
+	ec.m.RUnlock()
+
+	hosts := map[string][]string{}
+	for c := range eps {
+		h := clusterHostname(c)
+		if h == "" {
+			continue
+		}
+		rctx, cf := context.WithTimeout(ctx, 1*time.Second)
+		addrs, err := lookupHost(rctx, h)
+		cf()
+		if err == nil && len(addrs) > 0 {
+			hosts[h] = addrs
+		} else if a := oldHosts[h]; len(a) > 0 {
+			hosts[h] = a
+		}
+	}
+
+	ec.m.Lock()
+	ec.Hosts = hosts
+	ec.Updated = time.Now()
+	ec.m.Unlock()
+	return nil
+}
+
+// Lookup returns the cached addresses for a mesh hostname.
+func (ec *EndpointCache) Lookup(host string) []string {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	ec.m.RLock()
+	defer ec.m.RUnlock()
+	return ec.Hosts[host]
+}
+
+// Save writes the cache to the in-memory volume.
+func (ec *EndpointCache) Save() error {
+	ec.m.RLock()
+	data, err := json.Marshal(ec)
+	ec.m.RUnlock()
+	if err != nil {
+		return err
+	}
+	os.MkdirAll(filepath.Dir(ec.file), 0755)
+	return ioutil.WriteFile(ec.file, data, 0644)
+}
+
+// Load reads a cache saved by a previous krun.
+func (ec *EndpointCache) Load() error {
+	data, err := ioutil.ReadFile(ec.file)
+	if err != nil {
+		return err
+	}
+	ec.m.Lock()
+	defer ec.m.Unlock()
+	return json.Unmarshal(data, ec)
+}
+
+// ListenDNS answers queries for the cached names on addr, UDP and TCP, and forwards the other queries to the
+// upstream nameserver. The listeners are closed when ctx is done.
+func (ec *EndpointCache) ListenDNS(ctx context.Context, addr string) error {
+	pc, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return err
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		pc.Close()
+		return err
+	}
+	go func() {
+		<-ctx.Done()
+		pc.Close()
+		l.Close()
+	}()
+	go func() {
+		for {
+			buf := make([]byte, 4096)
+			n, raddr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			go func() {
+				if res, err := ec.exchange("udp", buf[0:n]); err == nil {
+					pc.WriteTo(res, raddr)
+				}
+			}()
+		}
+	}()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				c.SetReadDeadline(time.Now().Add(10 * time.Second))
+				q, err := readTCPMsg(c)
+				if err != nil {
+					return
+				}
+				if res, err := ec.exchange("tcp", q); err == nil {
+					writeTCPMsg(c, res)
+				}
+			}()
+		}
+	}()
+	return nil
+}
+
+// exchange answers a query from the cache, or forwards it to the upstream nameserver using the same network.
+func (ec *EndpointCache) exchange(network string, q []byte) ([]byte, error) {
+	if res := ec.answer(q); res != nil {
+		return res, nil
+	}
+	c, err := net.DialTimeout(network, ec.upstream, 5*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	if network == "tcp" {
+		if err := writeTCPMsg(c, q); err != nil {
+			return nil, err
+		}
+		return readTCPMsg(c)
+	}
+	if _, err := c.Write(q); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 4096)
+	n, err := c.Read(buf)
+	if err != nil {
+		return nil, err
+	}
+	return buf[0:n], nil
+}
+
+// answer returns the response for an A or AAAA query for a cached name, or nil if the query must be forwarded.
+// A cached name without addresses of the requested type gets an empty answer.
+func (ec *EndpointCache) answer(q []byte) []byte {
+	// Standard query, one question.
+	if len(q) < 12 || q[2]&0xF8 != 0 || binary.BigEndian.Uint16(q[4:6]) != 1 {
+		return nil
+	}
+	name, end := dnsQuestionName(q)
+	if end < 0 || end+4 > len(q) {
+		return nil
+	}
+	qtype, qclass := binary.BigEndian.Uint16(q[end:]), binary.BigEndian.Uint16(q[end+2:])
+	if qclass != 1 || (qtype != 1 && qtype != 28) {
+		return nil
+	}
+	addrs := ec.Lookup(name)
+	if len(addrs) == 0 {
+		return nil
+	}
+	res := make([]byte, 12, 512)
+	copy(res, q[0:2])
+	// QR, AA and the RD bit of the query; RA.
+	res[2] = 0x84 | q[2]&0x01
+	res[3] = 0x80
+	binary.BigEndian.PutUint16(res[4:], 1)
+	res = append(res, q[12:end+4]...)
+	n := 0
+	for _, a := range addrs {
+		ip := net.ParseIP(a)
+		if ip == nil {
+			continue
+		}
+		rdata := ip.To4()
+		if qtype == 28 {
+			if rdata != nil {
+				continue
+			}
+			rdata = ip.To16()
+		} else if rdata == nil {
+			continue
+		}
+		// Name is a pointer to the question.
+		rr := []byte{0xC0, 12, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0}
+		binary.BigEndian.PutUint16(rr[2:], qtype)
+		binary.BigEndian.PutUint32(rr[6:], endpointCacheTTL)
+		binary.BigEndian.PutUint16(rr[10:], uint16(len(rdata)))
+		res = append(append(res, rr...), rdata...)
+		n++
+	}
+	binary.BigEndian.PutUint16(res[6:], uint16(n))
+	return res
+}
+
+// dnsQuestionName returns the name in the first question of a query, and the offset of the question type.
+// Returns -1 for an invalid or compressed name.
+func dnsQuestionName(q []byte) (string, int) {
+	labels := []string{}
+	off := 12
+	for {
+		if off >= len(q) {
+			return "", -1
+		}
+		l := int(q[off])
+		if l == 0 {
+			return strings.Join(labels, "."), off + 1
+		}
+		if l > 63 || off+1+l > len(q) {
+			return "", -1
+		}
+		labels = append(labels, string(q[off+1:off+1+l]))
+		off += 1 + l
+	}
+}
+
+// updateHostsSection replaces the section between the start and end markers, or removes it if block is empty.
+func updateHostsSection(hostsBlockStart, hostsBlockEnd, block string) error {
+	if os.Getuid() != 0 {
+		return nil
+	}
+	data, err := ioutil.ReadFile(hostsFile)
+	if err != nil {
+		return err
+	}
+	orig := string(data)
+	content := orig
+	if s := strings.Index(content, hostsBlockStart); s >= 0 {
+		if e := strings.Index(content[s:], hostsBlockEnd); e >= 0 {
+			end := s + e + len(hostsBlockEnd)
+			if end < len(content) && content[end] == '\n' {
+				end++
+			}
+			content = content[:s] + content[end:]
+		}
+	}
+	if block != "" {
+		if !strings.HasSuffix(content, "\n") {
+			content = content + "\n"
+		}
+		content = content + block
+	}
+	if content == orig {
+		return nil
+	}
+	return ioutil.WriteFile(hostsFile, []byte(content), 0644)
+}
+
+// Subset of the Envoy admin /clusters?format=json response.
+type envoyClusters struct {
+	ClusterStatuses []struct {
+		Name         string `json:"name"`
+		HostStatuses []struct {
+			Address struct {
+				SocketAddress struct {
+					Address   string `json:"address"`
+					PortValue int    `json:"port_value"`
+				} `json:"socket_address"`
+			} `json:"address"`
+		} `json:"host_statuses"`
+	} `json:"cluster_statuses"`
+}
+
+// parseEnvoyClusters returns the endpoints for each outbound cluster.
+func parseEnvoyClusters(data []byte) (map[string][]string, error) {
+	ec := &envoyClusters{}
+	err := json.Unmarshal(data, ec)
+	if err != nil {
+		return nil, err
+	}
+	res := map[string][]string{}
+	for _, c := range ec.ClusterStatuses {
+		if !strings.HasPrefix(c.Name, "outbound|") {
+			continue
+		}
+		eps := []string{}
+		for _, h := range c.HostStatuses {
+			sa := h.Address.SocketAddress
+			if sa.Address == "" {
+				continue
+			}
+			eps = append(eps, net.JoinHostPort(sa.Address, strconv.Itoa(sa.PortValue)))
+		}
+		res[c.Name] = eps
+	}
+	return res, nil
+}
+
+// clusterHostname extracts the hostname from an Istio cluster name - outbound|8080|subset|fortio.fortio.svc.cluster.local
+func clusterHostname(cluster string) string {
+	parts := strings.Split(cluster, "|")
+	if len(parts) != 4 {
+		return ""
+	}
+	return parts[3]
+}
@@ -0,0 +1,247 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mesh
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseEnvoyClusters(t *testing.T) {
+	data := `{"cluster_statuses":[
+{"name":"outbound|8080||fortio.fortio.svc.cluster.local","host_statuses":[
+  {"address":{"socket_address":{"address":"10.4.9.15","port_value":8080}}},
+  {"address":{"socket_address":{"address":"10.4.9.16","port_value":8080}}}]},
+{"name":"inbound|8080||","host_statuses":[{"address":{"socket_address":{"address":"127.0.0.1","port_value":8080}}}]},
+{"name":"BlackHoleCluster"}]}`
+
+	eps, err := parseEnvoyClusters([]byte(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(eps) != 1 {
+		t.Fatal("Expecting only outbound clusters", eps)
+	}
+	c := eps["outbound|8080||fortio.fortio.svc.cluster.local"]
+	if len(c) != 2 || c[0] != "10.4.9.15:8080" {
+		t.Error("Unexpected endpoints", c)
+	}
+	if h := clusterHostname("outbound|8080||fortio.fortio.svc.cluster.local"); h != "fortio.fortio.svc.cluster.local" {
+		t.Error("Unexpected hostname", h)
+	}
+	if h := clusterHostname("BlackHoleCluster"); h != "" {
+		t.Error("Unexpected hostname", h)
+	}
+}
+
+// dnsQuery returns a query for name, with the given id and type.
+func dnsQuery(id uint16, name string, qtype uint16) []byte {
+	q := []byte{0, 0, 1, 0, 0, 1, 0, 0, 0, 0, 0, 0}
+	binary.BigEndian.PutUint16(q, id)
+	for _, l := range strings.Split(name, ".") {
+		q = append(append(q, byte(len(l))), l...)
+	}
+	q = append(q, 0, 0, 0, 0, 1)
+	binary.BigEndian.PutUint16(q[len(q)-4:], qtype)
+	return q
+}
+
+func TestEndpointCacheSaveLoad(t *testing.T) {
+	kr := New()
+	kr.BaseDir = t.TempDir()
+	ec := kr.NewEndpointCache()
+	ec.Hosts["fortio.fortio.svc.cluster.local"] = []string{"10.8.0.1"}
+	if err := ec.Save(); err != nil {
+		t.Fatal(err)
+	}
+	ec2 := kr.NewEndpointCache()
+	if err := ec2.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if a := ec2.Lookup("Fortio.fortio.svc.cluster.local."); len(a) != 1 || a[0] != "10.8.0.1" {
+		t.Error("Unexpected cached addresses", a)
+	}
+}
+
+func TestEndpointCacheDNS(t *testing.T) {
+	// Upstream returns the query with the QR bit set.
+	up, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer up.Close()
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := up.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			buf[2] |= 0x80
+			up.WriteTo(buf[0:n], addr)
+		}
+	}()
+
+	kr := New()
+	kr.BaseDir = t.TempDir()
+	ec := kr.NewEndpointCache()
+	ec.Hosts["fortio.fortio.svc.cluster.local"] = []string{"10.8.0.1", "10.8.0.2"}
+	ec.upstream = up.LocalAddr().String()
+
+	ctx, cf := context.WithCancel(context.Background())
+	defer cf()
+	// Find a free port for both UDP and TCP.
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	addr := l.Addr().String()
+	l.Close()
+	if err := ec.ListenDNS(ctx, addr); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := net.Dial("udp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	exchange := func(q []byte) []byte {
+		c.SetDeadline(time.Now().Add(5 * time.Second))
+		c.Write(q)
+		buf := make([]byte, 512)
+		n, err := c.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return buf[0:n]
+	}
+
+	res := exchange(dnsQuery(0x1234, "fortio.fortio.svc.cluster.local", 1))
+	if binary.BigEndian.Uint16(res) != 0x1234 || res[2]&0x80 == 0 || binary.BigEndian.Uint16(res[6:]) != 2 {
+		t.Fatal("Unexpected response", res)
+	}
+	if ip := net.IP(res[len(res)-4:]); !ip.Equal(net.ParseIP("10.8.0.2")) {
+		t.Error("Unexpected address", ip)
+	}
+	// Cached name, no IPv6 addresses - empty answer, not forwarded.
+	res = exchange(dnsQuery(2, "fortio.fortio.svc.cluster.local", 28))
+	if binary.BigEndian.Uint16(res[6:]) != 0 || res[2]&0x04 == 0 {
+		t.Error("Unexpected AAAA response", res)
+	}
+	// Other names are forwarded.
+	q := dnsQuery(3, "www.google.com", 1)
+	res = exchange(q)
+	if len(res) != len(q) || res[2]&0x04 != 0 {
+		t.Error("Expecting upstream response", res)
+	}
+
+	tc, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tc.Close()
+	tc.SetDeadline(time.Now().Add(5 * time.Second))
+	writeTCPMsg(tc, dnsQuery(4, "fortio.fortio.svc.cluster.local", 1))
+	res, err = readTCPMsg(tc)
+	if err != nil || binary.BigEndian.Uint16(res[6:]) != 2 {
+		t.Error("Unexpected TCP response", res, err)
+	}
+}
+
+func TestFirstNameserver(t *testing.T) {
+	if ns := firstNameserver("search google.internal\nnameserver 169.254.169.254\nnameserver 8.8.8.8\n"); ns != "169.254.169.254:53" {
+		t.Error("Unexpected nameserver", ns)
+	}
+	if ns := firstNameserver("nameserver ::1\n"); ns != "[::1]:53" {
+		t.Error("Unexpected nameserver", ns)
+	}
+}
+
+func TestUpdateHostsSection(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("hosts are only updated as root")
+	}
+	defer func(f string) { hostsFile = f }(hostsFile)
+	hostsFile = filepath.Join(t.TempDir(), "hosts")
+	ioutil.WriteFile(hostsFile, []byte("127.0.0.1 localhost"), 0644)
+
+	if err := updateHostsSection("# BEGIN test", "# END test", "# BEGIN test\n10.0.0.1 a\n# END test\n"); err != nil {
+		t.Fatal(err)
+	}
+	if err := updateHostsSection("# BEGIN test", "# END test", "# BEGIN test\n10.0.0.2 a\n# END test\n"); err != nil {
+		t.Fatal(err)
+	}
+	data, _ := ioutil.ReadFile(hostsFile)
+	if string(data) != "127.0.0.1 localhost\n# BEGIN test\n10.0.0.2 a\n# END test\n" {
+		t.Errorf("Unexpected hosts %q", data)
+	}
+	updateHostsSection("# BEGIN test", "# END test", "")
+	data, _ = ioutil.ReadFile(hostsFile)
+	if string(data) != "127.0.0.1 localhost\n" {
+		t.Errorf("Unexpected hosts %q", data)
+	}
+}
+
+func TestEndpointCacheRefresh(t *testing.T) {
+	admin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"cluster_statuses":[
+{"name":"outbound|8080||fortio.fortio.svc.cluster.local"},
+{"name":"outbound|80||echo.echo.svc.cluster.local"}]}`))
+	}))
+	defer admin.Close()
+	resolved := map[string][]string{
+		"fortio.fortio.svc.cluster.local": {"10.8.0.1"},
+		"echo.echo.svc.cluster.local":     {"10.8.0.2"},
+	}
+	defer func(f func(context.Context, string) ([]string, error)) { lookupHost = f }(lookupHost)
+	lookupHost = func(ctx context.Context, host string) ([]string, error) {
+		if a := resolved[host]; a != nil {
+			return a, nil
+		}
+		return nil, errors.New("no such host")
+	}
+
+	kr := New()
+	kr.BaseDir = t.TempDir()
+	ec := kr.NewEndpointCache()
+	ec.adminURL = admin.URL
+	if err := ec.Refresh(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if a := ec.Lookup("fortio.fortio.svc.cluster.local"); len(a) != 1 || a[0] != "10.8.0.1" {
+		t.Fatal("Unexpected addresses", a)
+	}
+
+	// A changed VIP is picked up, a failed lookup keeps the cached addresses.
+	resolved["fortio.fortio.svc.cluster.local"] = []string{"10.8.0.10"}
+	delete(resolved, "echo.echo.svc.cluster.local")
+	if err := ec.Refresh(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if a := ec.Lookup("fortio.fortio.svc.cluster.local"); len(a) != 1 || a[0] != "10.8.0.10" {
+		t.Error("Address not refreshed", a)
+	}
+	if a := ec.Lookup("echo.echo.svc.cluster.local"); len(a) != 1 || a[0] != "10.8.0.2" {
+		t.Error("Cached address lost", a)
+	}
+}
@@ -18,26 +18,31 @@ import (
 	"bytes"
 	"errors"
 	"fmt"
-	"io"
 	"log"
 	"os"
 	"os/exec"
 	"strconv"
 	"syscall"
-
-	"github.com/creack/pty"
 )
 
 const envoyUID = 1337
 const envoyGID = 1337
 
 func (kr *KRun) envoyCommand() *exec.Cmd {
+	envoy := kr.EnvoyPath()
+	if envoy == "" {
+		envoy = defaultEnvoyPath
+	}
 	// For Istio:
 	// -c etc/istio/proxy/envoy-rev0.json --restart-epoch 0 --drain-time-s 45 --drain-strategy immediate --parent-shutdown-time-s 60 --local-address-ip-version v4 --file-flush-interval-msec 1000 --disable-hot-restart --log-format %Y-%m-%dT%T.%fZ  %l      envoy %n        %v -l warning --component-log-level misc:error --concurrency 2
+	concurrency := kr.EstimatedConcurrency()
 	if kr.TdSidecarEnv == nil {
+		if concurrency == 0 {
+			concurrency = 2
+		}
 		// TODO: add a simplified template, customize from ProxyConfig.
 		// ProxyConfig needs to be loaded
-		return exec.Command("/usr/local/bin/envoy",
+		return exec.Command(envoy,
 			"--config-path", "etc/istio/proxy/envoy-rev0.json",
 			"--allow-unknown-static-fields",
 			"--restart-epoch", "0",
@@ -49,17 +54,21 @@ func (kr *KRun) envoyCommand() *exec.Cmd {
 			"--disable-hot-restart",
 			"--log-format", "%Y-%m-%dT%T.%fZ  %l      envoy %n        %v -l warning",
 			"--component-log-level", "misc:error",
-			"--concurrency", "2",
+			"--concurrency", strconv.Itoa(concurrency),
 		)
 	}
 	// For TD:
-	return exec.Command("/usr/local/bin/envoy",
+	cmd := exec.Command(envoy,
 		"--config-path", fmt.Sprintf("%s/bootstrap.yaml", kr.TdSidecarEnv.PackageDirectory),
 		"--log-level", kr.TdSidecarEnv.LogLevel,
 		// Settings this will make the logs invisible and may run out of mem:
 		// "--log-path", "/var/log/envoy/envoy.log",
 		"--allow-unknown-static-fields",
 	)
+	if concurrency > 0 {
+		cmd.Args = append(cmd.Args, "--concurrency", strconv.Itoa(concurrency))
+	}
+	return cmd
 }
 
 // StartEnvoy does iptables interception, envoy bootstrap preparation and
@@ -70,9 +79,14 @@ func (kr *KRun) StartEnvoy() error {
 	}
 
 	// Prepare envoy bootstrap
-	if err := kr.PrepareTrafficDirectorBootstrap(
-		fmt.Sprintf("%s/bootstrap_template.yaml", kr.TdSidecarEnv.PackageDirectory),
-		fmt.Sprintf("%s/bootstrap.yaml", kr.TdSidecarEnv.PackageDirectory)); err != nil {
+	out := fmt.Sprintf("%s/bootstrap.yaml", kr.TdSidecarEnv.PackageDirectory)
+	if pre := kr.Config("MESH_ENVOY_BOOTSTRAP", ""); pre != "" {
+		// Generated at build time - JSON is valid YAML.
+		if err := ExpandBootstrap(pre, out, kr.tdBootstrapVars()); err != nil {
+			return err
+		}
+	} else if err := kr.PrepareTrafficDirectorBootstrap(
+		fmt.Sprintf("%s/bootstrap_template.yaml", kr.TdSidecarEnv.PackageDirectory), out); err != nil {
 		return err
 	}
 	log.Println("TD bootstrap ready")
@@ -80,40 +94,30 @@ func (kr *KRun) StartEnvoy() error {
 	os.Chown(kr.TdSidecarEnv.LogDirectory, envoyUID, envoyGID)
 
 	cmd := kr.envoyCommand()
-
-	cmd.SysProcAttr = &syscall.SysProcAttr{}
-	cmd.SysProcAttr.Credential = &syscall.Credential{
-		Uid: envoyUID,
-		Gid: envoyGID,
+	if err := kr.VerifyBinary("envoy", cmd.Path); err != nil {
+		return err
 	}
 
-	var stdout io.ReadCloser
-	pty, tty, err := pty.Open()
+	cred, err := kr.childCredential("envoy", strconv.Itoa(envoyUID)+":"+strconv.Itoa(envoyGID))
 	if err != nil {
-		log.Println("Error opening pty: ", err)
-		stdout, _ = cmd.StdoutPipe()
-		os.Stdout.Chown(envoyUID, envoyGID)
-	} else {
-		cmd.Stdout = tty
-		if err = tty.Chown(envoyUID, envoyGID); err != nil {
-			log.Println("Error chown: ", err)
-		}
-		stdout = pty
+		return err
 	}
-	cmd.Stderr = os.Stderr
+	cmd.SysProcAttr = &syscall.SysProcAttr{Credential: cred}
+
+	started := kr.setChildStdout(cmd, "envoy", int(cred.Uid), int(cred.Gid))
+	cmd.Stderr = kr.LogWriter("envoy", os.Stderr)
 
 	go func() {
-		if err := cmd.Start(); err != nil {
+		if err := kr.startChild(cmd); err != nil {
 			log.Println("Failed to start: ", cmd, err)
 		}
 		kr.agentCmd = cmd
-		if stdout != nil {
-			go func() {
-				io.Copy(os.Stdout, stdout)
-			}()
-		}
-		if err := cmd.Wait(); err != nil {
+		started()
+		err := cmd.Wait()
+		closeLogWriters(cmd)
+		if err != nil {
 			log.Println("Wait err: ", err)
+			kr.ReportExit("envoy", cmd, err)
 		}
 		kr.Exit(0)
 	}()
@@ -0,0 +1,200 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mesh
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// Lifecycle events, published to a Pub/Sub topic if MESH_EVENTS_TOPIC is set - so platform automation can react
+// to instances starting, joining the mesh, crashing or draining. The topic is a name in the project of the
+// config cluster, or a full projects/PROJECT/topics/TOPIC name.
+//
+// The message data is the JSON LifecycleEvent. The type, service and instance are also set as message
+// attributes, for subscription filters.
+const (
+	EventStarted     = "instance_started"
+	EventMeshJoined  = "mesh_joined"
+	EventCertRotated = "cert_rotated"
+	EventAgentCrash  = "agent_crashed"
+	EventAppCrash    = "app_crashed"
+	EventDraining    = "instance_draining"
+)
+
+// LifecycleEvent is a change in the state of the instance.
+type LifecycleEvent struct {
+	Type string    `json:"type"`
+	Time time.Time `json:"time"`
+
+	InstanceID string `json:"instanceId,omitempty"`
+	Service    string `json:"service,omitempty"`
+	Revision   string `json:"revision,omitempty"`
+	Namespace  string `json:"namespace,omitempty"`
+	Name       string `json:"name,omitempty"`
+	Project    string `json:"project,omitempty"`
+	Region     string `json:"region,omitempty"`
+
+	// Uptime of the instance when the event happened.
+	Uptime string `json:"uptime"`
+
+	// Details depend on the type - for example the source and exit code for crashes.
+	Details map[string]string `json:"details,omitempty"`
+}
+
+// Attributes returns the message attributes for the event.
+func (ev *LifecycleEvent) Attributes() map[string]string {
+	return map[string]string{
+		"type":       ev.Type,
+		"service":    ev.Service,
+		"instanceId": ev.InstanceID,
+	}
+}
+
+// EventPublisher abstracts the vendor message queue.
+type EventPublisher interface {
+	PublishEvent(ctx context.Context, topic string, data []byte, attrs map[string]string) error
+}
+
+// eventsTopic returns the full topic name, or "" if events are disabled.
+func (kr *KRun) eventsTopic() string {
+	t := kr.Config("MESH_EVENTS_TOPIC", "")
+	if t == "" || strings.HasPrefix(t, "projects/") {
+		return t
+	}
+	return "projects/" + kr.ProjectId + "/topics/" + t
+}
+
+// newEvent creates an event with the instance metadata.
+func (kr *KRun) newEvent(typ string, details map[string]string) *LifecycleEvent {
+	region := kr.InstanceRegion
+	if region == "" {
+		region = kr.Region()
+	}
+	service := os.Getenv("K_SERVICE")
+	if service == "" {
+		service = kr.Name
+	}
+	return &LifecycleEvent{
+		Type:       typ,
+		Time:       time.Now(),
+		InstanceID: kr.InstanceID,
+		Service:    service,
+		Revision:   os.Getenv("K_REVISION"),
+		Namespace:  kr.Namespace,
+		Name:       kr.Name,
+		Project:    kr.ProjectId,
+		Region:     region,
+		Uptime:     time.Since(kr.StartTime).String(),
+		Details:    details,
+	}
+}
+
+// PublishEvent sends a lifecycle event in the background, if MESH_EVENTS_TOPIC is set. Failures are logged.
+func (kr *KRun) PublishEvent(typ string, details map[string]string) {
+	topic := kr.eventsTopic()
+	if topic == "" || kr.EventPublisher == nil || kr.DryRun {
+		return
+	}
+	go kr.publishEvent(topic, kr.newEvent(typ, details))
+}
+
+func (kr *KRun) publishEvent(topic string, ev *LifecycleEvent) error {
+	data, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	ctx, cf := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cf()
+	err = kr.EventPublisher.PublishEvent(ctx, topic, data, ev.Attributes())
+	if err != nil {
+		log.Println("Failed to publish event", "type", ev.Type, "topic", topic, "err", err)
+	}
+	return err
+}
+
+// crashEvent returns the event type for a child exit.
+func crashEvent(source string) string {
+	switch source {
+	case "pilot-agent", "envoy", "watchdog":
+		return EventAgentCrash
+	}
+	return EventAppCrash
+}
+
+// WatchCertRotation publishes EventCertRotated when the workload certificate used by Envoy changes. The
+// certificates are rotated by the agent, the serial number is checked every minute on the admin port.
+func (kr *KRun) WatchCertRotation(ctx context.Context) {
+	if kr.eventsTopic() == "" || kr.EventPublisher == nil {
+		return
+	}
+	go func() {
+		last := ""
+		t := time.NewTicker(time.Minute)
+		defer t.Stop()
+		for {
+			actx, cf := context.WithTimeout(ctx, 5*time.Second)
+			data, err := envoyAdminGet(actx, "/certs")
+			cf()
+			if err == nil {
+				serial, exp := workloadCertSerial(data)
+				if serial != "" && last != "" && serial != last {
+					kr.PublishEvent(EventCertRotated, map[string]string{"serial": serial, "expiration": exp})
+				}
+				if serial != "" {
+					last = serial
+				}
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-t.C:
+			}
+		}
+	}()
+}
+
+// workloadCertSerial returns the serial number and expiration of the first SPIFFE certificate in the Envoy
+// /certs response.
+func workloadCertSerial(data []byte) (string, string) {
+	var certs struct {
+		Certificates []struct {
+			CertChain []struct {
+				SerialNumber    string `json:"serial_number"`
+				ExpirationTime  string `json:"expiration_time"`
+				SubjectAltNames []struct {
+					URI string `json:"uri"`
+				} `json:"subject_alt_names"`
+			} `json:"cert_chain"`
+		} `json:"certificates"`
+	}
+	if json.Unmarshal(data, &certs) != nil {
+		return "", ""
+	}
+	for _, c := range certs.Certificates {
+		for _, cc := range c.CertChain {
+			for _, san := range cc.SubjectAltNames {
+				if strings.HasPrefix(san.URI, "spiffe://") {
+					return cc.SerialNumber, cc.ExpirationTime
+				}
+			}
+		}
+	}
+	return "", ""
+}
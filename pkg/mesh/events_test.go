@@ -0,0 +1,76 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mesh
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"testing"
+)
+
+type fakePublisher struct {
+	topic string
+	data  []byte
+	attrs map[string]string
+}
+
+func (f *fakePublisher) PublishEvent(ctx context.Context, topic string, data []byte, attrs map[string]string) error {
+	f.topic, f.data, f.attrs = topic, data, attrs
+	return nil
+}
+
+func TestEvents(t *testing.T) {
+	kr := New()
+	kr.ProjectId = "p1"
+	kr.InstanceID = "i1"
+	if kr.eventsTopic() != "" {
+		t.Error("Events enabled by default")
+	}
+	os.Setenv("MESH_EVENTS_TOPIC", "krun-events")
+	defer os.Unsetenv("MESH_EVENTS_TOPIC")
+	topic := kr.eventsTopic()
+	if topic != "projects/p1/topics/krun-events" {
+		t.Error("Unexpected topic", topic)
+	}
+
+	fp := &fakePublisher{}
+	kr.EventPublisher = fp
+	if err := kr.publishEvent(topic, kr.newEvent(crashEvent("envoy"), map[string]string{"exitCode": "1"})); err != nil {
+		t.Fatal(err)
+	}
+	ev := &LifecycleEvent{}
+	if err := json.Unmarshal(fp.data, ev); err != nil {
+		t.Fatal(err)
+	}
+	if ev.Type != EventAgentCrash || ev.InstanceID != "i1" || ev.Details["exitCode"] != "1" {
+		t.Error("Unexpected event", string(fp.data))
+	}
+	if fp.attrs["type"] != EventAgentCrash || fp.topic != topic {
+		t.Error("Unexpected attributes", fp.attrs, fp.topic)
+	}
+	if crashEvent("app") != EventAppCrash {
+		t.Error("App exit is not an agent crash")
+	}
+}
+
+func TestWorkloadCertSerial(t *testing.T) {
+	serial, exp := workloadCertSerial([]byte(`{"certificates":[
+{"ca_cert":[{"serial_number":"1"}],"cert_chain":[{"serial_number":"abc","expiration_time":"2021-10-01T00:00:00Z",
+ "subject_alt_names":[{"uri":"spiffe://cluster.local/ns/default/sa/default"}]}]}]}`))
+	if serial != "abc" || exp != "2021-10-01T00:00:00Z" {
+		t.Error("Unexpected cert", serial, exp)
+	}
+}
@@ -0,0 +1,191 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mesh
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+// Extra proxy filters, declared in krun.yaml:
+//
+//	filters:
+//	- name: authz
+//	  lua: |
+//	    function envoy_on_request(h) ... end
+//	- name: custom-auth
+//	  wasm:
+//	    url: oci://gcr.io/project/auth-plugin:v1
+//	    phase: AUTHN
+//	    pluginConfig: {...}
+//	- name: headers
+//	  patches:
+//	  - applyTo: HTTP_FILTER
+//	    ...
+//
+// The sidecar filters are configured by Istiod, over XDS - like for GKE workloads, krun applies an EnvoyFilter
+// (lua, patches) or WasmPlugin (wasm) in the workload namespace, selecting the workload labels. Wasm modules
+// are fetched by the agent and delivered to Envoy using ECDS. The resources are shared by all instances and
+// are not deleted on exit.
+
+// ProxyFilter is an extra filter for the workload proxy. One of Lua, Wasm or Patches must be set.
+type ProxyFilter struct {
+	// Name is appended to the workload name, for the name of the EnvoyFilter or WasmPlugin.
+	Name string `yaml:"name"`
+
+	// Lua is inline Lua code, inserted before the router.
+	Lua string `yaml:"lua,omitempty"`
+
+	// Context is the EnvoyFilter patch context for Lua - SIDECAR_INBOUND (default), SIDECAR_OUTBOUND, GATEWAY
+	// or ANY.
+	Context string `yaml:"context,omitempty"`
+
+	// Wasm is the WasmPlugin spec, without the selector.
+	Wasm map[string]interface{} `yaml:"wasm,omitempty"`
+
+	// Patches are EnvoyFilter configPatches, used as is.
+	Patches []interface{} `yaml:"patches,omitempty"`
+}
+
+// API paths for the filter resources.
+const (
+	EnvoyFilterAPI = "/apis/networking.istio.io/v1alpha3"
+	WasmPluginAPI  = "/apis/extensions.istio.io/v1alpha1"
+)
+
+// ApplyFilters creates or updates the EnvoyFilter and WasmPlugin resources for the filters in the config file.
+// Should be called before the agent is started, so the first XDS response includes the filters.
+func (kr *KRun) ApplyFilters(ctx context.Context) error {
+	if len(kr.Filters) == 0 {
+		return nil
+	}
+	rw, ok := kr.Cfg.(ResourceWriter)
+	if !ok {
+		return errors.New("config source doesn't support writing EnvoyFilter")
+	}
+	ctx, cf := context.WithTimeout(ctx, 10*time.Second)
+	defer cf()
+	for _, f := range kr.Filters {
+		api, resource, obj, err := kr.filterObject(f)
+		if err != nil {
+			return err
+		}
+		name := kr.Name + "-" + f.Name
+		if err := rw.ApplyResource(ctx, api, resource, kr.Namespace, name, obj); err != nil {
+			return fmt.Errorf("filter %s: %v", f.Name, err)
+		}
+		log.Println("Applied proxy filter", "name", name, "kind", obj["kind"])
+	}
+	return nil
+}
+
+// filterSelector returns the labels selecting this workload.
+func (kr *KRun) filterSelector() map[string]interface{} {
+	res := map[string]interface{}{}
+	if kr.Gateway != "" {
+		for k, v := range kr.GatewayLabels() {
+			res[k] = v
+		}
+		return res
+	}
+	res["service.istio.io/canonical-name"] = kr.CanonicalService()
+	return res
+}
+
+// filterObject returns the API path, resource and object for a filter.
+func (kr *KRun) filterObject(f *ProxyFilter) (string, string, map[string]interface{}, error) {
+	if f.Name == "" {
+		return "", "", nil, errors.New("filter name is required")
+	}
+	meta := map[string]interface{}{
+		"labels": map[string]interface{}{"app": kr.Name},
+	}
+	if f.Wasm != nil {
+		spec := map[string]interface{}{}
+		for k, v := range f.Wasm {
+			j, err := yamlToJSON(v)
+			if err != nil {
+				return "", "", nil, fmt.Errorf("filter %s: %v", f.Name, err)
+			}
+			spec[k] = j
+		}
+		spec["selector"] = map[string]interface{}{"matchLabels": kr.filterSelector()}
+		return WasmPluginAPI, "wasmplugins", map[string]interface{}{
+			"apiVersion": "extensions.istio.io/v1alpha1",
+			"kind":       "WasmPlugin",
+			"metadata":   meta,
+			"spec":       spec,
+		}, nil
+	}
+
+	var patches []interface{}
+	switch {
+	case f.Lua != "":
+		patches = []interface{}{luaPatch(f.Lua, f.Context)}
+	case len(f.Patches) > 0:
+		for _, p := range f.Patches {
+			j, err := yamlToJSON(p)
+			if err != nil {
+				return "", "", nil, fmt.Errorf("filter %s: %v", f.Name, err)
+			}
+			patches = append(patches, j)
+		}
+	default:
+		return "", "", nil, errors.New("filter " + f.Name + " requires lua, wasm or patches")
+	}
+	return EnvoyFilterAPI, "envoyfilters", map[string]interface{}{
+		"apiVersion": "networking.istio.io/v1alpha3",
+		"kind":       "EnvoyFilter",
+		"metadata":   meta,
+		"spec": map[string]interface{}{
+			"workloadSelector": map[string]interface{}{"labels": kr.filterSelector()},
+			"configPatches":    patches,
+		},
+	}, nil
+}
+
+// luaPatch inserts the Lua filter before the router.
+func luaPatch(code, context string) map[string]interface{} {
+	if context == "" {
+		context = "SIDECAR_INBOUND"
+	}
+	return map[string]interface{}{
+		"applyTo": "HTTP_FILTER",
+		"match": map[string]interface{}{
+			"context": context,
+			"listener": map[string]interface{}{
+				"filterChain": map[string]interface{}{
+					"filter": map[string]interface{}{
+						"name":      "envoy.filters.network.http_connection_manager",
+						"subFilter": map[string]interface{}{"name": "envoy.filters.http.router"},
+					},
+				},
+			},
+		},
+		"patch": map[string]interface{}{
+			"operation": "INSERT_BEFORE",
+			"value": map[string]interface{}{
+				"name": "envoy.filters.http.lua",
+				"typed_config": map[string]interface{}{
+					"@type":      "type.googleapis.com/envoy.extensions.filters.http.lua.v3.Lua",
+					"inlineCode": code,
+				},
+			},
+		},
+	}
+}
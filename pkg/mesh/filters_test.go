@@ -0,0 +1,95 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mesh
+
+import (
+	"context"
+	"testing"
+
+	"gopkg.in/yaml.v2"
+)
+
+type fakeResourceWriter struct {
+	objs map[string]map[string]interface{}
+}
+
+func (f *fakeResourceWriter) GetSecret(ctx context.Context, ns string, name string) (map[string][]byte, error) {
+	return nil, nil
+}
+
+func (f *fakeResourceWriter) GetCM(ctx context.Context, ns string, name string) (map[string]string, error) {
+	return nil, nil
+}
+
+func (f *fakeResourceWriter) ApplyResource(ctx context.Context, api, resource, ns, name string, obj map[string]interface{}) error {
+	f.objs[api+"/"+resource+"/"+ns+"/"+name] = obj
+	return nil
+}
+
+func (f *fakeResourceWriter) DeleteResource(ctx context.Context, api, resource, ns, name string) error {
+	delete(f.objs, api+"/"+resource+"/"+ns+"/"+name)
+	return nil
+}
+
+func TestApplyFilters(t *testing.T) {
+	kf := &KRunFile{}
+	err := yaml.UnmarshalStrict([]byte(`
+filters:
+- name: authz
+  lua: |
+    function envoy_on_request(h) end
+- name: auth
+  wasm:
+    url: oci://gcr.io/p/auth:v1
+    pluginConfig:
+      mode: strict
+`), kf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kr := New()
+	kr.Name = "fortio"
+	kr.Namespace = "ns"
+	kr.applyConfigFile(kf)
+	rw := &fakeResourceWriter{objs: map[string]map[string]interface{}{}}
+	kr.Cfg = rw
+	if err := kr.ApplyFilters(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	ef := rw.objs[EnvoyFilterAPI+"/envoyfilters/ns/fortio-authz"]
+	if ef == nil || ef["kind"] != "EnvoyFilter" {
+		t.Fatal("Missing EnvoyFilter", rw.objs)
+	}
+	spec := ef["spec"].(map[string]interface{})
+	sel := spec["workloadSelector"].(map[string]interface{})["labels"].(map[string]interface{})
+	if sel["service.istio.io/canonical-name"] != "fortio" {
+		t.Error("Unexpected selector", sel)
+	}
+
+	wp := rw.objs[WasmPluginAPI+"/wasmplugins/ns/fortio-auth"]
+	if wp == nil {
+		t.Fatal("Missing WasmPlugin", rw.objs)
+	}
+	ws := wp["spec"].(map[string]interface{})
+	if ws["url"] != "oci://gcr.io/p/auth:v1" || ws["pluginConfig"].(map[string]interface{})["mode"] != "strict" {
+		t.Error("Unexpected WasmPlugin", ws)
+	}
+
+	kr.Filters = []*ProxyFilter{{Name: "empty"}}
+	if err := kr.ApplyFilters(context.Background()); err == nil {
+		t.Error("Expecting error for a filter without config")
+	}
+}
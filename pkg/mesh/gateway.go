@@ -0,0 +1,183 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mesh
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"strings"
+)
+
+// East-west gateway.
+//
+// A CloudRun service with the eastwestgateway role accepts HBONE CONNECT streams from GKE pods
+// (on the CloudRun port, and on 15008 with mTLS when reachable directly) and forwards them to other CloudRun
+// services, using the same tunnel as the mesh connector. The stream content is the original mTLS connection,
+// the gateway doesn't terminate it.
+//
+// The destination is the CONNECT authority - svc.ns.svc.cluster.local:port or svc:port - mapped to the
+// CloudRun URL https://SVC + CLOUDRUN_URL_SUFFIX. The suffix is the project and region specific part of the
+// CloudRun URLs, for example "-jnbfkbvtza-uc.a.run.app". It is required - without it the URLs can't be built.
+//
+// The gateway URL is published in mesh-env as EW_GATEWAY_URL, so the mesh connector and clusters can
+// program routes to CloudRun services through it.
+
+// Gateway roles.
+//
+// GATEWAY_NAME can be a comma separated list of roles, for example "ingressgateway,eastwestgateway", allowing one
+// CloudRun service to serve combined gateway duties. The first role is used as the "istio" label - which is what
+// the default Istio Gateway selectors use. Each role also adds a "gateway.istio.io/ROLE=true" label, so Gateway
+// resources for the other roles can select the instance, and GATEWAY_ROLE_LABELS_ROLE adds custom labels
+// (k=v,k2=v2).
+//
+// Roles may also reserve ports handled by krun, which are excluded from the Envoy outbound capture.
+type GatewayRole struct {
+	// Labels added to the pod labels when the role is enabled.
+	Labels map[string]string
+
+	// ExcludePorts are handled by krun and not captured by Envoy.
+	ExcludePorts []string
+}
+
+// GatewayRoles holds the known roles. Unknown roles are allowed - they only add the default label.
+var GatewayRoles = map[string]*GatewayRole{
+	"ingressgateway":  {},
+	"eastwestgateway": {ExcludePorts: []string{"15008", "15443"}},
+	"egressgateway":   {},
+}
+
+// Aliases for roles.
+var gatewayAliases = map[string]string{
+	"ingress":   "ingressgateway",
+	"east-west": "eastwestgateway",
+	"eastwest":  "eastwestgateway",
+	"egress":    "egressgateway",
+}
+
+// initGateways parses the list of roles from the Gateway setting. Gateway is set to the first role.
+// Called when the config is loaded - Gateways is not modified after.
+func (kr *KRun) initGateways() {
+	kr.Gateways = nil
+	for _, g := range strings.Split(kr.Gateway, ",") {
+		g = strings.TrimSpace(g)
+		if g == "" {
+			continue
+		}
+		if a, f := gatewayAliases[g]; f {
+			g = a
+		}
+		kr.Gateways = append(kr.Gateways, g)
+	}
+	if len(kr.Gateways) > 0 {
+		kr.Gateway = kr.Gateways[0]
+	}
+}
+
+// HasGateway returns true if the gateway role is enabled.
+func (kr *KRun) HasGateway(role string) bool {
+	for _, g := range kr.Gateways {
+		if g == role {
+			return true
+		}
+	}
+	return false
+}
+
+// GatewayLabels returns the pod labels for the enabled gateway roles.
+func (kr *KRun) GatewayLabels() map[string]string {
+	res := map[string]string{}
+	roles := kr.Gateways
+	if len(roles) == 0 {
+		return res
+	}
+	res["istio"] = roles[0]
+	for _, g := range roles {
+		res["gateway.istio.io/"+g] = "true"
+		if r := GatewayRoles[g]; r != nil {
+			for k, v := range r.Labels {
+				res[k] = v
+			}
+		}
+		for _, kv := range strings.Split(kr.Config("GATEWAY_ROLE_LABELS_"+g, ""), ",") {
+			p := strings.SplitN(kv, "=", 2)
+			if len(p) == 2 && p[0] != "" {
+				res[p[0]] = p[1]
+			}
+		}
+	}
+	return res
+}
+
+// GatewayExcludePorts returns the ports reserved by the enabled roles.
+func (kr *KRun) GatewayExcludePorts() []string {
+	res := []string{}
+	for _, g := range kr.Gateways {
+		if r := GatewayRoles[g]; r != nil {
+			res = append(res, r.ExcludePorts...)
+		}
+	}
+	return res
+}
+
+// EastWestGateway returns true if krun runs as an east-west gateway.
+func (kr *KRun) EastWestGateway() bool {
+	return kr.HasGateway("eastwestgateway")
+}
+
+// CloudRunURL returns the URL of the CloudRun service for a mesh authority, or "" if CLOUDRUN_URL_SUFFIX is not
+// set.
+func (kr *KRun) CloudRunURL(authority string) string {
+	host := authority
+	if h, _, err := net.SplitHostPort(authority); err == nil {
+		host = h
+	}
+	svc := strings.Split(host, ".")[0]
+	suffix := kr.Config("CLOUDRUN_URL_SUFFIX", "")
+	if svc == "" || suffix == "" {
+		return ""
+	}
+	return "https://" + svc + suffix + "/_hbone/15003"
+}
+
+// GatewayURL returns the external URL of this instance - MESH_GATEWAY_URL or derived from K_SERVICE and
+// CLOUDRUN_URL_SUFFIX. Returns "" if neither is available.
+func (kr *KRun) GatewayURL() string {
+	u := kr.Config("MESH_GATEWAY_URL", "")
+	if u != "" {
+		return u
+	}
+	svc := os.Getenv("K_SERVICE")
+	suffix := kr.Config("CLOUDRUN_URL_SUFFIX", "")
+	if svc == "" || suffix == "" {
+		return ""
+	}
+	return "https://" + svc + suffix
+}
+
+// AdvertiseGateway saves the gateway URL in istio-system/mesh-env.
+// The service account of the gateway must have permission to update the config map.
+func (kr *KRun) AdvertiseGateway(ctx context.Context) error {
+	u := kr.GatewayURL()
+	if u == "" {
+		return errors.New("unknown gateway URL, set MESH_GATEWAY_URL")
+	}
+	cw, ok := kr.Cfg.(CfgWriter)
+	if !ok {
+		return errors.New("config doesn't support updates")
+	}
+	return cw.UpdateCM(ctx, "istio-system", "mesh-env", map[string]string{"EW_GATEWAY_URL": u})
+}
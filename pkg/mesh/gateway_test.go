@@ -0,0 +1,53 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mesh
+
+import (
+	"os"
+	"testing"
+)
+
+func TestGatewayRoles(t *testing.T) {
+	kr := &KRun{Gateway: "ingress, eastwestgateway"}
+	kr.setDefaults()
+	if !kr.EastWestGateway() || kr.Gateway != "ingressgateway" {
+		t.Fatal("Unexpected roles", kr.Gateways, kr.Gateway)
+	}
+	l := kr.GatewayLabels()
+	if l["istio"] != "ingressgateway" || l["gateway.istio.io/eastwestgateway"] != "true" {
+		t.Error("Unexpected labels", l)
+	}
+	if p := kr.GatewayExcludePorts(); len(p) != 2 || p[0] != "15008" {
+		t.Error("Unexpected excluded ports", p)
+	}
+
+	// The URLs can't be built without the project and region specific suffix.
+	if u := kr.CloudRunURL("fortio.fortio.svc.cluster.local:8080"); u != "" {
+		t.Error("Unexpected URL without suffix", u)
+	}
+	os.Setenv("K_SERVICE", "gate")
+	defer os.Unsetenv("K_SERVICE")
+	if u := kr.GatewayURL(); u != "" {
+		t.Error("Unexpected gateway URL without suffix", u)
+	}
+
+	kr.MeshEnv = map[string]string{"CLOUDRUN_URL_SUFFIX": "-abc-uc.a.run.app"}
+	if u := kr.CloudRunURL("fortio.fortio.svc.cluster.local:8080"); u != "https://fortio-abc-uc.a.run.app/_hbone/15003" {
+		t.Error("Unexpected URL", u)
+	}
+	if u := kr.GatewayURL(); u != "https://gate-abc-uc.a.run.app" {
+		t.Error("Unexpected gateway URL", u)
+	}
+}
@@ -0,0 +1,125 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mesh
+
+import (
+	"bytes"
+	"log"
+	"net"
+	"os"
+	"time"
+)
+
+// Private Google API access, for running inside a VPC Service Controls perimeter or without internet egress.
+//
+// MESH_GOOGLEAPIS selects the endpoints used for the Google APIs krun and the agent depend on:
+// - private - private.googleapis.com, 199.36.153.8/30
+// - restricted - restricted.googleapis.com, 199.36.153.4/30, required for APIs protected by VPC-SC
+// - auto - restricted if the public endpoint is not reachable and the restricted VIP is
+//
+// The API names are mapped to the VIPs in /etc/hosts - the same names and certificates are used, only the
+// addresses change. Requires root. The DNS zone for googleapis.com can be used instead, when running as a
+// regular user.
+
+// GoogleAPIs are the endpoints used by krun, the agent and the mesh integrations.
+var GoogleAPIs = []string{
+	"cloudresourcemanager.googleapis.com",
+	"cloudtrace.googleapis.com",
+	"clouderrorreporting.googleapis.com",
+	"connectgateway.googleapis.com",
+	"container.googleapis.com",
+	"gkehub.googleapis.com",
+	"iamcredentials.googleapis.com",
+	"logging.googleapis.com",
+	"meshca.googleapis.com",
+	"meshconfig.googleapis.com",
+	"monitoring.googleapis.com",
+	"oauth2.googleapis.com",
+	"privateca.googleapis.com",
+	"secretmanager.googleapis.com",
+	"sqladmin.googleapis.com",
+	"sts.googleapis.com",
+}
+
+var googleAPIVIPs = map[string][]string{
+	"private":    {"199.36.153.8", "199.36.153.9", "199.36.153.10", "199.36.153.11"},
+	"restricted": {"199.36.153.4", "199.36.153.5", "199.36.153.6", "199.36.153.7"},
+}
+
+const (
+	googleAPIsBlockStart = "# BEGIN krun googleapis"
+	googleAPIsBlockEnd   = "# END krun googleapis"
+)
+
+// InitGoogleAPIs maps the Google APIs to the private or restricted VIPs, if MESH_GOOGLEAPIS is set.
+// Must be called before any Google API is used.
+func (kr *KRun) InitGoogleAPIs() {
+	mode := kr.Config("MESH_GOOGLEAPIS", "")
+	if mode == "auto" {
+		mode = detectGoogleAPIs()
+	}
+	vips := googleAPIVIPs[mode]
+	if len(vips) == 0 {
+		if mode != "" {
+			log.Println("Unknown MESH_GOOGLEAPIS, using public endpoints", mode)
+		}
+		return
+	}
+	if os.Getuid() != 0 {
+		log.Println("MESH_GOOGLEAPIS requires root to update /etc/hosts, use a private DNS zone instead", mode)
+		return
+	}
+	err := updateHostsSection(googleAPIsBlockStart, googleAPIsBlockEnd, googleAPIsHosts(vips))
+	if err != nil {
+		log.Println("Failed to update /etc/hosts for googleapis", err)
+		return
+	}
+	log.Println("Using private Google APIs", "mode", mode, "vip", vips[0])
+}
+
+// googleAPIsHosts returns the hosts block. Only the first VIP is used - /etc/hosts has no load balancing.
+func googleAPIsHosts(vips []string) string {
+	b := &bytes.Buffer{}
+	b.WriteString(googleAPIsBlockStart + "\n")
+	for _, h := range GoogleAPIs {
+		b.WriteString(vips[0] + " " + h + "\n")
+	}
+	b.WriteString(googleAPIsBlockEnd + "\n")
+	return b.String()
+}
+
+// detectGoogleAPIs returns 'restricted' if the public googleapis.com endpoint can't be reached but the restricted
+// VIP can - which is the case in a perimeter with restricted egress.
+func detectGoogleAPIs() string {
+	if tcpReachable("oauth2.googleapis.com:443") {
+		return ""
+	}
+	if tcpReachable(googleAPIVIPs["restricted"][0] + ":443") {
+		return "restricted"
+	}
+	if tcpReachable(googleAPIVIPs["private"][0] + ":443") {
+		return "private"
+	}
+	return ""
+}
+
+func tcpReachable(addr string) bool {
+	c, err := net.DialTimeout("tcp", addr, 1*time.Second)
+	if err != nil {
+		return false
+	}
+	c.Close()
+	return true
+}
@@ -0,0 +1,32 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mesh
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestGoogleAPIsHosts(t *testing.T) {
+	b := googleAPIsHosts(googleAPIVIPs["restricted"])
+	if !strings.HasPrefix(b, googleAPIsBlockStart+"\n") || !strings.HasSuffix(b, googleAPIsBlockEnd+"\n") {
+		t.Fatal("Missing markers", b)
+	}
+	for _, h := range []string{"meshca.googleapis.com", "sts.googleapis.com", "connectgateway.googleapis.com"} {
+		if !strings.Contains(b, "199.36.153.4 "+h+"\n") {
+			t.Error("Missing host", h, b)
+		}
+	}
+}
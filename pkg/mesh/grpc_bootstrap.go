@@ -51,6 +51,16 @@ type Bootstrap struct {
 	Node                       *Node                          `json:"node,omitempty"`
 	CertProviders              map[string]CertificateProvider `json:"certificate_providers,omitempty"`
 	ServerListenerNameTemplate string                         `json:"server_listener_resource_name_template,omitempty"`
+
+	// Federation: resource names using xdstp:// are fetched from the servers of the authority.
+	ClientDefaultListenerResourceNameTemplate string               `json:"client_default_listener_resource_name_template,omitempty"`
+	Authorities                               map[string]Authority `json:"authorities,omitempty"`
+}
+
+// Authority is a federated control plane. If XDSServers is empty the top level servers are used.
+type Authority struct {
+	ClientListenerResourceNameTemplate string      `json:"client_listener_resource_name_template,omitempty"`
+	XDSServers                         []XdsServer `json:"xds_servers,omitempty"`
 }
 
 type ChannelCreds struct {
@@ -125,6 +135,20 @@ type GenerateBootstrapOptions struct {
 	XdsUdsPath       string
 	DiscoveryAddress string
 	CertDir          string
+
+	// ChannelCreds for the XDS server, default insecure (connect locally via agent).
+	ChannelCreds []ChannelCreds
+
+	// Authorities for xDS federation.
+	Authorities map[string]Authority
+
+	// Cert file names in CertDir, default to the Istio names (key.pem, cert-chain.pem, root-cert.pem).
+	KeyFile      string
+	CertFile     string
+	RootCertFile string
+
+	// Meta is added to the node metadata, for values that are not strings (LABELS).
+	Meta map[string]interface{}
 }
 
 type Locality struct {
@@ -147,7 +171,7 @@ type Locality struct {
 
 // GenerateBootstrap generates the bootstrap structure for gRPC XDS integration.
 func GenerateBootstrap(opts GenerateBootstrapOptions, meta map[string]string) (*Bootstrap, error) {
-	xdsMeta, err := extractMeta(meta)
+	xdsMeta, err := extractMeta(meta, opts.Meta)
 	if err != nil {
 		return nil, fmt.Errorf("failed extracting xds metadata: %v", err)
 	}
@@ -158,11 +182,16 @@ func GenerateBootstrap(opts GenerateBootstrapOptions, meta map[string]string) (*
 		serverURI = fmt.Sprintf("unix:///%s", opts.XdsUdsPath)
 	}
 
+	creds := opts.ChannelCreds
+	if len(creds) == 0 {
+		// connect locally via agent
+		creds = []ChannelCreds{{Type: "insecure"}}
+	}
+
 	bootstrap := Bootstrap{
 		XDSServers: []XdsServer{{
-			ServerURI: serverURI,
-			// connect locally via agent
-			ChannelCreds:   []ChannelCreds{{Type: "insecure"}},
+			ServerURI:      serverURI,
+			ChannelCreds:   creds,
 			ServerFeatures: []string{"xds_v3"},
 		}},
 		Node: &Node{
@@ -171,6 +200,7 @@ func GenerateBootstrap(opts GenerateBootstrapOptions, meta map[string]string) (*
 			Metadata: xdsMeta,
 		},
 		ServerListenerNameTemplate: ServerListenerNameTemplate,
+		Authorities:                opts.Authorities,
 	}
 
 	if opts.CertDir != "" {
@@ -184,9 +214,9 @@ func GenerateBootstrap(opts GenerateBootstrapOptions, meta map[string]string) (*
 			"default": {
 				PluginName: "file_watcher",
 				Config: FileWatcherCertProviderConfig{
-					PrivateKeyFile:    path.Join(opts.CertDir, "key.pem"),
-					CertificateFile:   path.Join(opts.CertDir, "cert-chain.pem"),
-					CACertificateFile: path.Join(opts.CertDir, "root-cert.pem"),
+					PrivateKeyFile:    path.Join(opts.CertDir, orDefault(opts.KeyFile, "key.pem")),
+					CertificateFile:   path.Join(opts.CertDir, orDefault(opts.CertFile, "cert-chain.pem")),
+					CACertificateFile: path.Join(opts.CertDir, orDefault(opts.RootCertFile, "root-cert.pem")),
 					RefreshDuration:   refresh,
 				},
 			},
@@ -196,7 +226,14 @@ func GenerateBootstrap(opts GenerateBootstrapOptions, meta map[string]string) (*
 	return &bootstrap, err
 }
 
-func extractMeta(meta map[string]string) (*structpb.Struct, error) {
+func orDefault(v, def string) string {
+	if v == "" {
+		return def
+	}
+	return v
+}
+
+func extractMeta(meta map[string]string, extra map[string]interface{}) (*structpb.Struct, error) {
 	bytes, err := json.Marshal(meta)
 	if err != nil {
 		return nil, err
@@ -205,6 +242,12 @@ func extractMeta(meta map[string]string) (*structpb.Struct, error) {
 	if err := json.Unmarshal(bytes, &rawMeta); err != nil {
 		return nil, err
 	}
+	if rawMeta == nil {
+		rawMeta = map[string]interface{}{}
+	}
+	for k, v := range extra {
+		rawMeta[k] = v
+	}
 	xdsMeta, err := structpb.NewStruct(rawMeta)
 	if err != nil {
 		return nil, err
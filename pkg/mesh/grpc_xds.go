@@ -0,0 +1,195 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mesh
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Proxyless gRPC apps load the XDS bootstrap from GRPC_XDS_BOOTSTRAP. When pilot-agent is running it generates the
+// file (or MESH_GRPC_BOOTSTRAP is expanded), pointing to the agent XDS proxy. Without an agent krun generates the
+// bootstrap, connecting the app directly to the control plane and using the certificates saved by krun.
+//
+// MESH_GRPC_XDS_SERVER overrides the discovery address, MESH_GRPC_XDS_CREDS the channel credentials - the default
+// is google_default for port 443 (MCP, Traffic Director) and insecure otherwise.
+// MESH_GRPC_XDS_AUTHORITIES is a list of federated authorities, as name or name=serverURI.
+
+// GRPCBootstrapPath returns the location of the gRPC bootstrap used by the app.
+func (kr *KRun) GRPCBootstrapPath() string {
+	if p := os.Getenv("GRPC_XDS_BOOTSTRAP"); p != "" {
+		return p
+	}
+	if os.Getuid() == 0 {
+		return "/etc/istio/proxy/grpc_bootstrap.json"
+	}
+	return "./etc/istio/proxy/grpc_bootstrap.json"
+}
+
+// grpcXDSServer returns the control plane the app connects to, without the agent.
+func (kr *KRun) grpcXDSServer() XdsServer {
+	addr := kr.Config("MESH_GRPC_XDS_SERVER", kr.FindXDSAddr())
+	def := "insecure"
+	if strings.HasSuffix(addr, ":443") {
+		def = "google_default"
+	}
+	return XdsServer{
+		ServerURI:      addr,
+		ChannelCreds:   []ChannelCreds{{Type: kr.Config("MESH_GRPC_XDS_CREDS", def)}},
+		ServerFeatures: []string{"xds_v3"},
+	}
+}
+
+// grpcAuthorities returns the federated authorities from MESH_GRPC_XDS_AUTHORITIES.
+func (kr *KRun) grpcAuthorities(server XdsServer) map[string]Authority {
+	list := splitList(kr.Config("MESH_GRPC_XDS_AUTHORITIES", ""))
+	if len(list) == 0 {
+		return nil
+	}
+	res := map[string]Authority{}
+	for _, a := range list {
+		name := a
+		var servers []XdsServer
+		if i := strings.Index(a, "="); i > 0 {
+			name = a[0:i]
+			s := server
+			s.ServerURI = a[i+1:]
+			servers = []XdsServer{s}
+		}
+		res[name] = Authority{
+			ClientListenerResourceNameTemplate: "xdstp://" + name + "/envoy.config.listener.v3.Listener/%s",
+			XDSServers:                         servers,
+		}
+	}
+	return res
+}
+
+// xdsNodeID returns the Istio sidecar node ID, used by apps and krun without an agent.
+func (kr *KRun) xdsNodeID() string {
+	ns := kr.Namespace
+	return fmt.Sprintf("sidecar~%s~%s.%s~%s.svc.cluster.local", kr.InstanceIP(), kr.PodName(), ns, ns)
+}
+
+// xdsNodeMeta returns the node metadata for connecting directly to the control plane.
+func (kr *KRun) xdsNodeMeta() map[string]string {
+	meta := map[string]string{
+		"NAMESPACE":       kr.Namespace,
+		"INSTANCE_IPS":    kr.InstanceIP(),
+		"SERVICE_ACCOUNT": kr.KSA,
+		"WORKLOAD_NAME":   kr.Name,
+		"NAME":            kr.PodName(),
+		"KRUN_VERSION":    BuildVersion,
+	}
+	if kr.ClusterID != "" {
+		meta["CLUSTER_ID"] = kr.ClusterID
+	}
+	if kr.ProjectNumber != "" {
+		meta["MESH_ID"] = "proj-" + kr.ProjectNumber
+	}
+	if kr.MeshTenant != "" && kr.MeshTenant != "-" {
+		meta["CLOUDRUN_ADDR"] = kr.MeshTenant
+		if kr.ClusterID == "" {
+			meta["CLUSTER_ID"] = fmt.Sprintf("cn-%s-%s-%s", kr.ProjectId, kr.ClusterLocation, kr.ClusterName)
+		}
+	}
+	if n := kr.Network(); n != "" {
+		meta["NETWORK"] = n
+	}
+	if nv := kr.requestedNetworkView(); nv != "" {
+		meta["REQUESTED_NETWORK_VIEW"] = nv
+	}
+	for k, v := range kr.ProxyMetadata() {
+		if s, ok := v.(string); ok {
+			meta[k] = s
+		}
+	}
+	return meta
+}
+
+// xdsNodeExtraMeta returns the metadata that is not a string - pod labels and explicit JSON metadata.
+func (kr *KRun) xdsNodeExtraMeta() map[string]interface{} {
+	labels := map[string]interface{}{}
+	for k, v := range kr.PodLabels() {
+		labels[k] = v
+	}
+	res := map[string]interface{}{"LABELS": labels}
+	for k, v := range kr.ProxyMetadata() {
+		if _, ok := v.(string); !ok {
+			res[k] = v
+		}
+	}
+	return res
+}
+
+// GRPCBootstrap returns the gRPC bootstrap for apps running without pilot-agent.
+func (kr *KRun) GRPCBootstrap() (*Bootstrap, error) {
+	meta := kr.xdsNodeMeta()
+	meta["GENERATOR"] = "grpc"
+
+	certDir, err := filepath.Abs(WorkloadCertDir)
+	if err != nil {
+		return nil, err
+	}
+	server := kr.grpcXDSServer()
+	return GenerateBootstrap(GenerateBootstrapOptions{
+		Node: &Node{
+			Id:       kr.xdsNodeID(),
+			Locality: kr.Locality(),
+		},
+		DiscoveryAddress: server.ServerURI,
+		ChannelCreds:     server.ChannelCreds,
+		Authorities:      kr.grpcAuthorities(server),
+		CertDir:          certDir,
+		KeyFile:          privateKey,
+		CertFile:         cert,
+		RootCertFile:     WorkloadRootCAs,
+		Meta:             kr.xdsNodeExtraMeta(),
+	}, meta)
+}
+
+// WriteGRPCBootstrap generates the gRPC bootstrap, for proxyless apps running without pilot-agent.
+// An existing file set explicitly with GRPC_XDS_BOOTSTRAP is not replaced.
+func (kr *KRun) WriteGRPCBootstrap() error {
+	if kr.XDSAddr == "-" {
+		return nil
+	}
+	p := kr.GRPCBootstrapPath()
+	if os.Getenv("GRPC_XDS_BOOTSTRAP") != "" {
+		if _, err := os.Stat(p); err == nil {
+			return nil
+		}
+	}
+	b, err := kr.GRPCBootstrap()
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(b, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(p, data, 0644); err != nil {
+		return fmt.Errorf("failed writing to %s: %v", p, err)
+	}
+	log.Println("Generated gRPC bootstrap", "path", p, "xds", b.XDSServers[0].ServerURI)
+	return nil
+}
@@ -0,0 +1,95 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mesh
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestGRPCBootstrap(t *testing.T) {
+	kr := New()
+	kr.Namespace = "fortio"
+	kr.Name = "fortio-cr"
+	kr.XDSAddr = "meshconfig.googleapis.com:443"
+	kr.MeshTenant = "proj-1234"
+	kr.podName = "fortio-cr-1"
+	kr.podNameOnce.Do(func() {})
+	os.Setenv("MESH_GRPC_XDS_AUTHORITIES", "td,istiod=istiod.istio-system.svc:15010")
+	defer os.Unsetenv("MESH_GRPC_XDS_AUTHORITIES")
+
+	b, err := kr.GRPCBootstrap()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := b.XDSServers[0]
+	if s.ServerURI != "meshconfig.googleapis.com:443" || s.ChannelCreds[0].Type != "google_default" {
+		t.Error("Unexpected server", s)
+	}
+	if !strings.HasPrefix(b.Node.Id, "sidecar~") || !strings.HasSuffix(b.Node.Id, "~fortio-cr-1.fortio~fortio.svc.cluster.local") {
+		t.Error("Unexpected node", b.Node.Id)
+	}
+	m := b.Node.Metadata.AsMap()
+	if m["NAMESPACE"] != "fortio" || m["GENERATOR"] != "grpc" || m["CLOUDRUN_ADDR"] != "proj-1234" {
+		t.Error("Unexpected meta", m)
+	}
+	if l, ok := m["LABELS"].(map[string]interface{}); !ok || l["app"] == nil {
+		t.Error("Missing labels", m)
+	}
+	if a := b.Authorities["td"]; len(a.XDSServers) != 0 ||
+		a.ClientListenerResourceNameTemplate != "xdstp://td/envoy.config.listener.v3.Listener/%s" {
+		t.Error("Unexpected authority", a)
+	}
+	if a := b.Authorities["istiod"]; len(a.XDSServers) != 1 || a.XDSServers[0].ServerURI != "istiod.istio-system.svc:15010" {
+		t.Error("Unexpected authority", a)
+	}
+	data, _ := json.Marshal(b)
+	if !strings.Contains(string(data), "workload-spiffe-credentials/"+cert) {
+		t.Error("Unexpected cert provider", string(data))
+	}
+}
+
+func TestWriteGRPCBootstrap(t *testing.T) {
+	kr := New()
+	kr.Namespace = "fortio"
+	kr.XDSAddr = "istiod.istio-system.svc:15010"
+	p := filepath.Join(t.TempDir(), "proxy", "grpc_bootstrap.json")
+	os.Setenv("GRPC_XDS_BOOTSTRAP", p)
+	defer os.Unsetenv("GRPC_XDS_BOOTSTRAP")
+
+	if err := kr.WriteGRPCBootstrap(); err != nil {
+		t.Fatal(err)
+	}
+	b, err := LoadBootstrap(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.XDSServers[0].ChannelCreds[0].Type != "insecure" {
+		t.Error("Unexpected creds", b.XDSServers[0])
+	}
+
+	// An explicit bootstrap is not replaced.
+	ioutil.WriteFile(p, []byte("{}"), 0644)
+	if err := kr.WriteGRPCBootstrap(); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := ioutil.ReadFile(p); string(data) != "{}" {
+		t.Error("Bootstrap replaced", string(data))
+	}
+}
@@ -0,0 +1,208 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mesh
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log"
+	"net"
+	"time"
+)
+
+// Hedged dialing for the control plane and CA.
+//
+// The XDS and CA hostnames may resolve to several addresses, IPv4 and IPv6. During startup a slow or broken path
+// adds seconds to the cold start - the Go dialer tries the addresses of a family one after the other. The hedged
+// dialer starts a connection to the next address every MESH_HEDGE_DELAY (default 250ms), or as soon as the
+// previous attempt fails, alternating the address families, and uses the first that connects.
+//
+// krun connections to the control plane use the hedged dialer, unless MESH_HEDGE=false. pilot-agent connects
+// by itself: with MESH_HEDGE_PIN=true and root, the fastest XDS and CA addresses are added to /etc/hosts until
+// the proxy is ready, so the agent doesn't retry on the slow path.
+
+const (
+	hedgeHostsBlockStart = "# BEGIN krun hedged addresses"
+	hedgeHostsBlockEnd   = "# END krun hedged addresses"
+)
+
+// hedgedDialer races connections to the addresses of a host.
+type hedgedDialer struct {
+	// Delay between attempts.
+	Delay time.Duration
+
+	// lookup and dial are replaced in tests.
+	lookup func(ctx context.Context, host string) ([]string, error)
+	dial   func(ctx context.Context, addr string) (net.Conn, error)
+}
+
+func newHedgedDialer(delay, keepAlive time.Duration) *hedgedDialer {
+	d := &net.Dialer{KeepAlive: keepAlive}
+	return &hedgedDialer{
+		Delay:  delay,
+		lookup: net.DefaultResolver.LookupHost,
+		dial: func(ctx context.Context, addr string) (net.Conn, error) {
+			return d.DialContext(ctx, "tcp", addr)
+		},
+	}
+}
+
+// hedgedDialer returns the dialer for control plane connections, or nil if disabled.
+func (kr *KRun) hedgedDialer() *hedgedDialer {
+	if kr.Config("MESH_HEDGE", "true") != "true" {
+		return nil
+	}
+	return newHedgedDialer(kr.configDuration("MESH_HEDGE_DELAY", 250*time.Millisecond), kr.KeepAlive().TCP)
+}
+
+// DialContext connects to addr (host:port), returning the first successful connection.
+func (h *hedgedDialer) DialContext(ctx context.Context, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	ips := []string{host}
+	if net.ParseIP(host) == nil {
+		ips, err = h.lookup(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+	}
+	ips = interleaveFamilies(ips)
+
+	type result struct {
+		c   net.Conn
+		err error
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	results := make(chan result, len(ips))
+	next := 0
+	pending := 0
+	start := func() {
+		a := net.JoinHostPort(ips[next], port)
+		next++
+		pending++
+		go func() {
+			c, err := h.dial(ctx, a)
+			results <- result{c, err}
+		}()
+	}
+	start()
+	var lastErr error
+	timer := time.NewTimer(h.Delay)
+	defer timer.Stop()
+	for pending > 0 {
+		select {
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				cancel()
+				// Close the connections that complete after the winner.
+				go func(n int) {
+					for ; n > 0; n-- {
+						if o := <-results; o.c != nil {
+							o.c.Close()
+						}
+					}
+				}(pending)
+				return r.c, nil
+			}
+			lastErr = r.err
+			if next < len(ips) {
+				start()
+				timer.Reset(h.Delay)
+			}
+		case <-timer.C:
+			if next < len(ips) {
+				start()
+				timer.Reset(h.Delay)
+			}
+		}
+	}
+	if lastErr == nil {
+		lastErr = errors.New("no addresses for " + host)
+	}
+	return nil, lastErr
+}
+
+// interleaveFamilies orders the addresses alternating IPv6 and IPv4, starting with the family of the first.
+func interleaveFamilies(ips []string) []string {
+	var first, second []string
+	firstV4 := len(ips) > 0 && net.ParseIP(ips[0]).To4() != nil
+	for _, ip := range ips {
+		if (net.ParseIP(ip).To4() != nil) == firstV4 {
+			first = append(first, ip)
+		} else {
+			second = append(second, ip)
+		}
+	}
+	res := make([]string, 0, len(ips))
+	for i := 0; i < len(first) || i < len(second); i++ {
+		if i < len(first) {
+			res = append(res, first[i])
+		}
+		if i < len(second) {
+			res = append(res, second[i])
+		}
+	}
+	return res
+}
+
+// pinControlPlane adds the fastest address of each host to /etc/hosts, if MESH_HEDGE_PIN is set. The block is
+// removed by UnpinControlPlane, once the proxy is ready.
+func (kr *KRun) pinControlPlane(ctx context.Context, addrs ...string) {
+	h := kr.hedgedDialer()
+	if h == nil || kr.Config("MESH_HEDGE_PIN", "") != "true" || kr.DryRun {
+		return
+	}
+	b := &bytes.Buffer{}
+	for _, a := range addrs {
+		host, _, err := net.SplitHostPort(a)
+		if err != nil || net.ParseIP(host) != nil {
+			continue
+		}
+		dctx, cf := context.WithTimeout(ctx, 5*time.Second)
+		c, err := h.DialContext(dctx, a)
+		cf()
+		if err != nil {
+			log.Println("Hedged dial failed", "addr", a, "err", err)
+			continue
+		}
+		ip, _, _ := net.SplitHostPort(c.RemoteAddr().String())
+		c.Close()
+		b.WriteString(ip + " " + host + "\n")
+	}
+	if b.Len() == 0 {
+		return
+	}
+	if err := updateHostsSection(hedgeHostsBlockStart, hedgeHostsBlockEnd,
+		hedgeHostsBlockStart+"\n"+b.String()+hedgeHostsBlockEnd+"\n"); err != nil {
+		log.Println("Failed to pin control plane addresses", err)
+		return
+	}
+	log.Println("Pinned control plane addresses", "hosts", b.String())
+}
+
+// UnpinControlPlane removes the addresses added by pinControlPlane.
+func (kr *KRun) UnpinControlPlane() {
+	if kr.Config("MESH_HEDGE_PIN", "") != "true" {
+		return
+	}
+	if err := updateHostsSection(hedgeHostsBlockStart, hedgeHostsBlockEnd, ""); err != nil {
+		log.Println("Failed to remove pinned addresses", err)
+	}
+}
@@ -0,0 +1,77 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mesh
+
+import (
+	"context"
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestInterleaveFamilies(t *testing.T) {
+	got := interleaveFamilies([]string{"2001:db8::1", "2001:db8::2", "10.0.0.1", "10.0.0.2", "10.0.0.3"})
+	want := []string{"2001:db8::1", "10.0.0.1", "2001:db8::2", "10.0.0.2", "10.0.0.3"}
+	if !reflect.DeepEqual(got, want) {
+		t.Error("Unexpected order", got)
+	}
+}
+
+func TestHedgedDial(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+
+	h := newHedgedDialer(50*time.Millisecond, 0)
+	h.lookup = func(ctx context.Context, host string) ([]string, error) {
+		return []string{"10.0.0.1", "10.0.0.2", "127.0.0.1"}, nil
+	}
+	dial := h.dial
+	h.dial = func(ctx context.Context, addr string) (net.Conn, error) {
+		switch addr {
+		case net.JoinHostPort("10.0.0.1", port):
+			// Black hole - the first address doesn't respond.
+			<-ctx.Done()
+			return nil, ctx.Err()
+		case net.JoinHostPort("10.0.0.2", port):
+			return nil, errors.New("connection refused")
+		}
+		return dial(ctx, addr)
+	}
+
+	ctx, cf := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cf()
+	t0 := time.Now()
+	c, err := h.DialContext(ctx, "istiod.example:"+port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	if time.Since(t0) > 2*time.Second {
+		t.Error("Hedged dial waited for the slow address", time.Since(t0))
+	}
+
+	h.lookup = func(ctx context.Context, host string) ([]string, error) {
+		return []string{"10.0.0.2"}, nil
+	}
+	if _, err := h.DialContext(ctx, "istiod.example:"+port); err == nil {
+		t.Error("Expected error")
+	}
+}
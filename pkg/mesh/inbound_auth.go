@@ -0,0 +1,335 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mesh
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Inbound authentication for requests arriving on the CloudRun port.
+//
+// CloudRun terminates TLS - requests that are not tunneling mTLS (to krun or Envoy) have no verifiable identity.
+// When the service is restricted to internal traffic, MESH_INBOUND_AUTH can be set to:
+// - mtls: only mTLS tunnels are accepted - /_hbone/mtls and the Envoy port. Plain text HBONE CONNECT, CONNECT-UDP
+// and other tunnels are rejected. The mTLS HBONE port (15008) is not on the CloudRun port, and is not affected.
+// - jwt: regular requests, CONNECT, CONNECT-UDP and plain text tunnels require a JWT in the Authorization header,
+// signed by one of MESH_INBOUND_ISSUERS (default: the config cluster and accounts.google.com). The audience must be
+// one of MESH_INBOUND_AUDIENCES, default is the gateway URL - MESH_GATEWAY_URL or derived from K_SERVICE. The Host
+// header is controlled by the client, and is not used.
+//
+// The identity is forwarded to the app: for K8S tokens the SPIFFE identity is added as
+// x-forwarded-client-cert, the same as Envoy does for mTLS. x-jwt-principal is set to 'iss/sub', the same format
+// as the Istio request.auth.principal. Both headers are removed from incoming requests.
+
+// JWTVerifier checks the signature of OIDC tokens, using the keys published by the issuer.
+type JWTVerifier struct {
+	// Issuers that are trusted.
+	Issuers []string
+
+	// Audiences that are accepted. If empty, the audience is checked by the caller.
+	Audiences []string
+
+	HTTPClient *http.Client
+
+	m    sync.Mutex
+	keys map[string]*jwks
+}
+
+type jwks struct {
+	keys    map[string]crypto.PublicKey
+	fetched time.Time
+}
+
+// JWTClaims are the verified claims used by krun.
+type JWTClaims struct {
+	Iss string          `json:"iss"`
+	Sub string          `json:"sub"`
+	Aud json.RawMessage `json:"aud"`
+	Exp int64           `json:"exp"`
+	Nbf int64           `json:"nbf"`
+}
+
+// Audiences returns the 'aud' claim, which may be a string or a list.
+func (c *JWTClaims) Audiences() []string {
+	var res []string
+	if json.Unmarshal(c.Aud, &res) == nil {
+		return res
+	}
+	var s string
+	if json.Unmarshal(c.Aud, &s) == nil {
+		return []string{s}
+	}
+	return nil
+}
+
+// NewJWTVerifier creates a verifier for the issuers.
+func NewJWTVerifier(issuers []string, audiences []string) *JWTVerifier {
+	return &JWTVerifier{
+		Issuers:    issuers,
+		Audiences:  audiences,
+		HTTPClient: &http.Client{Timeout: 5 * time.Second},
+		keys:       map[string]*jwks{},
+	}
+}
+
+// Verify checks the signature, issuer, expiration and - if Audiences is set - the audience.
+func (v *JWTVerifier) Verify(ctx context.Context, token string) (*JWTClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed JWT")
+	}
+	head := struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}{}
+	if err := decodeJWTPart(parts[0], &head); err != nil {
+		return nil, err
+	}
+	claims := &JWTClaims{}
+	if err := decodeJWTPart(parts[1], claims); err != nil {
+		return nil, err
+	}
+	if !contains(v.Issuers, claims.Iss) {
+		return nil, fmt.Errorf("untrusted issuer %s", claims.Iss)
+	}
+	now := time.Now().Unix()
+	if claims.Exp == 0 || now > claims.Exp {
+		return nil, errors.New("JWT expired")
+	}
+	if claims.Nbf != 0 && now < claims.Nbf {
+		return nil, errors.New("JWT not yet valid")
+	}
+	if len(v.Audiences) > 0 && !v.audienceOK(claims) {
+		return nil, fmt.Errorf("unexpected audience %v", claims.Audiences())
+	}
+
+	key, err := v.key(ctx, claims.Iss, head.Kid)
+	if err != nil {
+		return nil, err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, err
+	}
+	h := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		if head.Alg != "RS256" {
+			return nil, errors.New("unexpected algorithm " + head.Alg)
+		}
+		if err := rsa.VerifyPKCS1v15(k, crypto.SHA256, h[:], sig); err != nil {
+			return nil, err
+		}
+	case *ecdsa.PublicKey:
+		if head.Alg != "ES256" || len(sig) != 64 {
+			return nil, errors.New("unexpected algorithm " + head.Alg)
+		}
+		r := new(big.Int).SetBytes(sig[0:32])
+		s := new(big.Int).SetBytes(sig[32:])
+		if !ecdsa.Verify(k, h[:], r, s) {
+			return nil, errors.New("invalid signature")
+		}
+	default:
+		return nil, errors.New("unsupported key")
+	}
+	return claims, nil
+}
+
+func (v *JWTVerifier) audienceOK(claims *JWTClaims) bool {
+	for _, a := range claims.Audiences() {
+		if contains(v.Audiences, a) {
+			return true
+		}
+	}
+	return false
+}
+
+// key returns the issuer key with the kid. Keys are refreshed hourly, or if the kid is not found - but not more
+// than once a minute.
+func (v *JWTVerifier) key(ctx context.Context, iss, kid string) (crypto.PublicKey, error) {
+	v.m.Lock()
+	ks := v.keys[iss]
+	v.m.Unlock()
+	if ks != nil {
+		if k := ks.keys[kid]; k != nil && time.Since(ks.fetched) < time.Hour {
+			return k, nil
+		}
+		if time.Since(ks.fetched) < time.Minute {
+			if k := ks.keys[kid]; k != nil {
+				return k, nil
+			}
+			return nil, fmt.Errorf("unknown key %s for %s", kid, iss)
+		}
+	}
+	ks, err := v.fetchKeys(ctx, iss)
+	if err != nil {
+		return nil, err
+	}
+	v.m.Lock()
+	v.keys[iss] = ks
+	v.m.Unlock()
+	if k := ks.keys[kid]; k != nil {
+		return k, nil
+	}
+	return nil, fmt.Errorf("unknown key %s for %s", kid, iss)
+}
+
+// fetchKeys loads the JWKS, using the OIDC discovery document of the issuer.
+func (v *JWTVerifier) fetchKeys(ctx context.Context, iss string) (*jwks, error) {
+	disc := struct {
+		JWKSURI string `json:"jwks_uri"`
+	}{}
+	if err := v.getJSON(ctx, strings.TrimSuffix(iss, "/")+"/.well-known/openid-configuration", &disc); err != nil {
+		return nil, err
+	}
+	if disc.JWKSURI == "" {
+		return nil, errors.New("missing jwks_uri for " + iss)
+	}
+	set := struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			Crv string `json:"crv"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		} `json:"keys"`
+	}{}
+	if err := v.getJSON(ctx, disc.JWKSURI, &set); err != nil {
+		return nil, err
+	}
+	res := &jwks{keys: map[string]crypto.PublicKey{}, fetched: time.Now()}
+	for _, k := range set.Keys {
+		switch {
+		case k.Kty == "RSA":
+			n, err1 := base64.RawURLEncoding.DecodeString(k.N)
+			e, err2 := base64.RawURLEncoding.DecodeString(k.E)
+			if err1 != nil || err2 != nil {
+				continue
+			}
+			res.keys[k.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		case k.Kty == "EC" && k.Crv == "P-256":
+			x, err1 := base64.RawURLEncoding.DecodeString(k.X)
+			y, err2 := base64.RawURLEncoding.DecodeString(k.Y)
+			if err1 != nil || err2 != nil {
+				continue
+			}
+			res.keys[k.Kid] = &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x),
+				Y: new(big.Int).SetBytes(y)}
+		}
+	}
+	return res, nil
+}
+
+func (v *JWTVerifier) getJSON(ctx context.Context, url string, o interface{}) error {
+	req, _ := http.NewRequestWithContext(ctx, "GET", url, nil)
+	res, err := v.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		return fmt.Errorf("%s: status %d", url, res.StatusCode)
+	}
+	return json.NewDecoder(res.Body).Decode(o)
+}
+
+func decodeJWTPart(p string, o interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(p, "="))
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, o)
+}
+
+// InboundAuth returns the function authenticating requests on the CloudRun port, or nil if MESH_INBOUND_AUTH is
+// not set.
+func (kr *KRun) InboundAuth() func(r *http.Request) error {
+	mode := kr.Config("MESH_INBOUND_AUTH", "")
+	switch mode {
+	case "":
+		return nil
+	case "mtls":
+		return func(r *http.Request) error {
+			return errors.New("mTLS required")
+		}
+	}
+	issuers := splitList(kr.Config("MESH_INBOUND_ISSUERS", ""))
+	if len(issuers) == 0 {
+		if kr.ProjectId != "" && kr.ClusterLocation != "" && kr.ClusterName != "" {
+			issuers = append(issuers, fmt.Sprintf("https://container.googleapis.com/v1/projects/%s/locations/%s/clusters/%s",
+				kr.ProjectId, kr.ClusterLocation, kr.ClusterName))
+		}
+		issuers = append(issuers, "https://accounts.google.com")
+	}
+	audiences := splitList(kr.Config("MESH_INBOUND_AUDIENCES", ""))
+	if len(audiences) == 0 {
+		if gw := kr.GatewayURL(); gw != "" {
+			audiences = append(audiences, gw)
+		}
+	}
+	if len(audiences) == 0 {
+		log.Println("MESH_INBOUND_AUTH=jwt requires MESH_INBOUND_AUDIENCES or MESH_GATEWAY_URL, rejecting all requests")
+		return func(r *http.Request) error {
+			return errors.New("missing JWT audience")
+		}
+	}
+	v := NewJWTVerifier(issuers, audiences)
+	return func(r *http.Request) error {
+		r.Header.Del("x-forwarded-client-cert")
+		r.Header.Del("x-jwt-principal")
+		auth := r.Header.Get("authorization")
+		if !strings.HasPrefix(auth, "Bearer ") {
+			return errors.New("missing JWT")
+		}
+		ctx, cf := context.WithTimeout(r.Context(), 10*time.Second)
+		defer cf()
+		claims, err := v.Verify(ctx, strings.TrimPrefix(auth, "Bearer "))
+		if err != nil {
+			return err
+		}
+		r.Header.Set("x-jwt-principal", claims.Iss+"/"+claims.Sub)
+		if id := kr.spiffeFromSub(claims.Sub); id != "" {
+			r.Header.Set("x-forwarded-client-cert",
+				"By=spiffe://"+kr.TrustDomain+"/ns/"+kr.Namespace+"/sa/"+kr.KSA+";URI="+id)
+		}
+		return nil
+	}
+}
+
+// spiffeFromSub returns the SPIFFE identity for a K8S token subject - system:serviceaccount:NAMESPACE:KSA.
+func (kr *KRun) spiffeFromSub(sub string) string {
+	p := strings.Split(sub, ":")
+	if len(p) != 4 || p[0] != "system" || p[1] != "serviceaccount" {
+		return ""
+	}
+	return "spiffe://" + kr.TrustDomain + "/ns/" + p[2] + "/sa/" + p[3]
+}
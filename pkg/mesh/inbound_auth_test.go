@@ -0,0 +1,113 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mesh
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func signTestJWT(t *testing.T, key *rsa.PrivateKey, claims map[string]interface{}) string {
+	h, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": "k1"})
+	c, _ := json.Marshal(claims)
+	s := base64.RawURLEncoding.EncodeToString(h) + "." + base64.RawURLEncoding.EncodeToString(c)
+	d := sha256.Sum256([]byte(s))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, d[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func TestInboundAuth(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	s := httptest.NewServer(mux)
+	defer s.Close()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{"jwks_uri": s.URL + "/jwks"})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{{
+			"kty": "RSA", "kid": "k1",
+			"n": base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e": base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+
+	kr := New()
+	kr.TrustDomain = "p1.svc.id.goog"
+	kr.Namespace = "fortio"
+	kr.KSA = "default"
+	kr.SetFlagConfig("MESH_INBOUND_AUTH", "jwt")
+	kr.SetFlagConfig("MESH_INBOUND_ISSUERS", s.URL)
+	if err := kr.InboundAuth()(httptest.NewRequest("GET", "https://fortio-abc.a.run.app/", nil)); err == nil {
+		t.Error("Expecting error without audience")
+	}
+	kr.SetFlagConfig("MESH_GATEWAY_URL", "https://fortio-abc.a.run.app")
+	auth := kr.InboundAuth()
+
+	exp := time.Now().Add(time.Hour).Unix()
+	tok := signTestJWT(t, key, map[string]interface{}{"iss": s.URL, "sub": "system:serviceaccount:client:ksa1",
+		"aud": "https://fortio-abc.a.run.app", "exp": exp})
+	r := httptest.NewRequest("GET", "https://fortio-abc.a.run.app/", nil)
+	r.Header.Set("authorization", "Bearer "+tok)
+	r.Header.Set("x-jwt-principal", "spoofed")
+	if err := auth(r); err != nil {
+		t.Fatal(err)
+	}
+	if p := r.Header.Get("x-jwt-principal"); p != s.URL+"/system:serviceaccount:client:ksa1" {
+		t.Error("Unexpected principal", p)
+	}
+	if x := r.Header.Get("x-forwarded-client-cert"); x != "By=spiffe://p1.svc.id.goog/ns/fortio/sa/default;URI=spiffe://p1.svc.id.goog/ns/client/sa/ksa1" {
+		t.Error("Unexpected XFCC", x)
+	}
+
+	for name, tok := range map[string]string{
+		"audience":  signTestJWT(t, key, map[string]interface{}{"iss": s.URL, "sub": "a", "aud": "https://other", "exp": exp}),
+		"expired":   signTestJWT(t, key, map[string]interface{}{"iss": s.URL, "sub": "a", "aud": "https://fortio-abc.a.run.app", "exp": 1}),
+		"issuer":    signTestJWT(t, key, map[string]interface{}{"iss": "https://evil", "sub": "a", "aud": "https://fortio-abc.a.run.app", "exp": exp}),
+		"signature": tok[0:len(tok)-4] + "AAAA",
+	} {
+		r := httptest.NewRequest("GET", "https://fortio-abc.a.run.app/", nil)
+		r.Header.Set("authorization", "Bearer "+tok)
+		if err := auth(r); err == nil {
+			t.Error("Expecting error for", name)
+		}
+	}
+	if err := auth(httptest.NewRequest("GET", "https://fortio-abc.a.run.app/", nil)); err == nil {
+		t.Error("Expecting error without JWT")
+	}
+
+	// The Host is controlled by the client - a token for a different service is rejected.
+	r = httptest.NewRequest("CONNECT", "https://other.a.run.app", nil)
+	r.Header.Set("authorization", "Bearer "+signTestJWT(t, key, map[string]interface{}{"iss": s.URL, "sub": "a",
+		"aud": "https://other.a.run.app", "exp": exp}))
+	if err := auth(r); err == nil {
+		t.Error("Expecting error for audience matching the host")
+	}
+}
@@ -0,0 +1,72 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mesh
+
+import (
+	"errors"
+	"os/exec"
+	"strings"
+)
+
+// iptablesChain is a chain installed by krun, with a jump from a built-in chain. Installing is idempotent: the
+// chain is created or flushed, and the jump is only added if missing - krun may be restarted in the same
+// instance, and the rules must not fail or be duplicated.
+type iptablesChain struct {
+	// Cmd is iptables or ip6tables.
+	Cmd   string
+	Table string
+	Name  string
+
+	// Parent is the built-in chain jumping to Name, with the Match conditions. The jump is inserted first, so it
+	// runs before chains added by the agent (ISTIO_OUTPUT).
+	Parent string
+	Match  []string
+
+	// Rules are appended to the chain, without the '-A NAME' prefix.
+	Rules [][]string
+}
+
+// iptablesRun runs an iptables command, returning the combined output. Replaced in tests.
+var iptablesRun = func(cmd string, args ...string) ([]byte, error) {
+	return exec.Command(cmd, args...).CombinedOutput()
+}
+
+func (c *iptablesChain) run(args ...string) error {
+	out, err := iptablesRun(c.Cmd, append([]string{"-t", c.Table}, args...)...)
+	if err != nil {
+		return errors.New(c.Cmd + " " + strings.Join(args, " ") + ": " + err.Error() + " " + string(out))
+	}
+	return nil
+}
+
+func (c *iptablesChain) install() error {
+	if c.run("-n", "-L", c.Name) == nil {
+		if err := c.run("-F", c.Name); err != nil {
+			return err
+		}
+	} else if err := c.run("-N", c.Name); err != nil {
+		return err
+	}
+	for _, r := range c.Rules {
+		if err := c.run(append([]string{"-A", c.Name}, r...)...); err != nil {
+			return err
+		}
+	}
+	jump := append(append([]string{}, c.Match...), "-j", c.Name)
+	if c.run(append([]string{"-C", c.Parent}, jump...)...) == nil {
+		return nil
+	}
+	return c.run(append([]string{"-I", c.Parent, "1"}, jump...)...)
+}
@@ -16,18 +16,19 @@ package mesh
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
 	"fmt"
-	"io"
 	"io/ioutil"
 	"log"
 	"os"
 	"os/exec"
+	"sort"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"syscall"
 	"time"
-
-	"github.com/creack/pty"
 )
 
 // Istio injected environment:
@@ -50,6 +51,25 @@ type ProxyConfig struct {
 	CaCertificatesPem []string          `yaml:"caCertificatesPem,omitempty"`
 }
 
+// proxyConfig returns the generated PROXY_CONFIG, as JSON. Used if PROXY_CONFIG is not injected.
+func (kr *KRun) proxyConfig(addr string) string {
+	pc := map[string]interface{}{"discoveryAddress": addr}
+	if envoy := kr.EnvoyPath(); envoy != "" && envoy != defaultEnvoyPath {
+		pc["binaryPath"] = envoy
+	}
+	if sp := kr.agentStatusPort(); sp != defaultAgentStatusPort {
+		// The metrics merge is served by krun on the default status port.
+		pc["statusPort"] = sp
+	}
+	if tr, err := kr.tracingConfig(); err != nil {
+		log.Println("Invalid tracing config, using defaults", err)
+	} else if tr != nil {
+		pc["tracing"] = tr
+	}
+	data, _ := json.Marshal(pc)
+	return string(data)
+}
+
 // Setup /etc/resolv.conf when running as root, with pilot-agent resolving DNS
 //
 // When running as root:
@@ -112,19 +132,30 @@ func (kr *KRun) agentCommand() *exec.Cmd {
 	//args = append(args, "--serviceCluster")
 	//args = append(args, kr.Name+"."+kr.Namespace)
 
-	if kr.AgentDebug != "" {
-		args = append(args, "--log_output_level="+kr.AgentDebug)
+	if l := kr.annotation(annoAgentLogLevel, kr.AgentDebug); l != "" {
+		args = append(args, "--log_output_level="+l)
+	}
+	if l := kr.annotation(annoLogLevel, os.Getenv("ENVOY_LOG_LEVEL")); l != "" {
+		args = append(args, "--proxyLogLevel="+l)
 	}
-	if os.Getenv("ENVOY_LOG_LEVEL") != "" {
-		args = append(args, "--proxyLogLevel="+os.Getenv("ENVOY_LOG_LEVEL"))
+	if l := kr.annotation(annoComponentLogLevel, ""); l != "" {
+		args = append(args, "--proxyComponentLogLevel="+l)
+	}
+	if c := kr.EstimatedConcurrency(); c > 0 {
+		args = append(args, "--concurrency", strconv.Itoa(c))
 	}
 	args = append(args, "--stsPort=15463")
-	return exec.Command("/usr/local/bin/pilot-agent", args...)
+	agent := kr.AgentPath()
+	if agent == "" {
+		agent = defaultAgentPath
+	}
+	return exec.Command(agent, args...)
 }
 
 // StartIstioAgent creates the env and starts istio agent.
 // If running as root, will also init iptables and change UID to 1337.
-func (kr *KRun) StartIstioAgent() error {
+// The XDS discovery and the initial tokens use the deadline of ctx.
+func (kr *KRun) StartIstioAgent(ctx context.Context) error {
 	if kr.XDSAddr == "-" {
 		return nil
 	}
@@ -133,30 +164,8 @@ func (kr *KRun) StartIstioAgent() error {
 	if os.Getuid() == 0 {
 		prefix = ""
 	}
-	os.MkdirAll(prefix+"/etc/istio/proxy", 0755)
-	//os.MkdirAll(prefix+"/var/lib/istio/envoy", 0755)
-
-	// Save the istio certificates - for proxyless or app use.
-	os.MkdirAll(prefix+"/var/run/secrets/istio", 0755)
-	os.MkdirAll(prefix+"/var/run/secrets/mesh", 0755)
-	os.MkdirAll(prefix+"/var/run/secrets/istio.io", 0755)
-	os.MkdirAll(prefix+"/etc/istio/pod", 0755)
-	if os.Getuid() == 0 {
-		//os.Chown(prefix+"/var/lib/istio/envoy", 1337, 1337)
-		os.Chown(prefix+"/var/run/secrets/istio.io", 1337, 1337)
-		os.Chown(prefix+"/var/run/secrets/istio", 1337, 1337)
-		os.Chown(prefix+"/var/run/secrets/mesh", 1337, 1337)
-		os.Chown(prefix+"/etc/istio/pod", 1337, 1337)
-		os.Chown(prefix+"/etc/istio/proxy", 1337, 1337)
-	}
-
-	// Pilot agent expects this file, containing citadel roots. Will be used to connect to the XDS server, and as
-	// default root CA.
-	if kr.CitadelRoot != "" {
-		err := ioutil.WriteFile(prefix+"/var/run/secrets/istio/root-cert.pem", []byte(kr.CitadelRoot), 0755)
-		if err != nil {
-			log.Println("Failed to write citadel root", "rootCAFile", prefix+"/var/run/secrets/istio/root-cert.pem", "error", err)
-		}
+	if !kr.DryRun {
+		kr.initAgentDirs(prefix)
 	}
 
 	// /dev/stdout is rejected - it is a pipe.
@@ -173,12 +182,11 @@ func (kr *KRun) StartIstioAgent() error {
 	// and simpler !
 	proxyConfigEnv := os.Getenv("PROXY_CONFIG")
 	if proxyConfigEnv == "" {
-		addr := kr.FindXDSAddr()
+		addr := kr.ResolveXDS(ctx).Addr
 		kr.XDSAddr = addr
 		log.Println("XDSAddr discovery", addr, "XDS_ADDR", kr.XDSAddr, "MESH_TENANT", kr.MeshTenant)
 
-		proxyConfig := fmt.Sprintf(`{"discoveryAddress": "%s"}`, addr)
-		env = append(env, "PROXY_CONFIG="+proxyConfig)
+		env = append(env, "PROXY_CONFIG="+kr.proxyConfig(addr))
 	} else {
 		log.Println("Using injected PROXY_CONFIG", proxyConfigEnv)
 	}
@@ -195,57 +203,34 @@ func (kr *KRun) StartIstioAgent() error {
 		// Temp workaround to handle OSS-specific behavior. By default we will expect OSS Istio
 		// to be installed in 'compatibility' mode with ASM, i.e. accept both istio-ca and trust domain
 		// as audience.
-		// TODO: use the trust domain from mesh-env
-		if os.Getenv("OSS_ISTIO") != "" {
-			log.Println("Using istio-ca audience")
-			kr.Aud2File["istio-ca"] = kr.BaseDir + "/var/run/secrets/tokens/istio-token"
-		} else {
-			log.Println("Using audience", kr.TrustDomain)
-			kr.Aud2File[kr.TrustDomain] = kr.BaseDir + "/var/run/secrets/tokens/istio-token"
-		}
+		// The CA audience defaults to 'istio-ca' if OSS_ISTIO is set, see SelectCA.
 	} else {
 		log.Println("Using system certifates for XDS and CA")
-		kr.Aud2File[kr.TrustDomain] = kr.BaseDir + "/var/run/secrets/tokens/istio-token"
 		env = addIfMissing(env, "XDS_ROOT_CA", "SYSTEM")
 		env = addIfMissing(env, "PILOT_CERT_PROVIDER", "system")
 		env = addIfMissing(env, "CA_ROOT_CA", "SYSTEM")
 	}
+	ca := kr.SelectCA()
+	log.Println("Using CA", ca.Name, "audience", ca.Audience)
+	if tf := kr.BaseDir + "/var/run/secrets/tokens/istio-token"; !kr.projectedToken(tf) {
+		kr.Aud2File[ca.Audience] = tf
+	}
 	env = addIfMissing(env, "POD_NAMESPACE", kr.Namespace)
 
-	kr.RefreshAndSaveTokens()
-
-	// Pod name MUST be an unique name - it is used in stackdriver which requires this ( errors on 'ordered updates' and
-	//  lost data otherwise)
-	// This also shows up in 'istioctl ps' and in istio logs
-
-	// K_REVISION (ex: fortio-cr-00011-duq) and metadata.
-	podName := os.Getenv("K_REVISION")
-	hn := os.Getenv("HOSTNAME")
-	if hn == "" {
-		hn, _ = os.Hostname()
-		hnp := strings.Split(hn, ".")
-		if len(hnp) > 0 {
-			hn = hnp[0]
-		}
+	if !kr.DryRun {
+		kr.refreshTokens(ctx)
+		kr.TokensTime = time.Now()
+		time.AfterFunc(30*time.Minute, kr.RefreshAndSaveTokens)
 	}
-	if podName != "" {
+
+	podName := kr.PodName()
+	if rev := os.Getenv("K_REVISION"); rev != "" {
 		if kr.InstanceID == "" {
-			podName = podName + "-" + strconv.Itoa(time.Now().Second())
 			kr.InstanceID = podName
-		} else if len(kr.InstanceID) > 8 {
-			podName = podName + "-" + kr.InstanceID[0:8]
-		} else {
-			podName = podName + "-" + kr.InstanceID
 		}
-
 		if kr.Rev == "" {
-			kr.Rev = podName
+			kr.Rev = rev
 		}
-	} else if hn != "" {
-		podName = os.Getenv("HOSTNAME")
-	} else {
-		podName = kr.Name + "-" + "-" + strconv.Itoa(time.Now().Second())
-		log.Println("Setting POD_NAME from name, missing instance ", podName)
 	}
 	// Some default value.
 	if kr.Rev == "" {
@@ -261,17 +246,34 @@ func (kr *KRun) StartIstioAgent() error {
 	if kr.ProjectNumber != "" {
 		env = addIfMissing(env, "ISTIO_META_MESH_ID", "proj-"+kr.ProjectNumber)
 	}
-	env = addIfMissing(env, "CANONICAL_SERVICE", kr.Name)
-	env = addIfMissing(env, "CANONICAL_REVISION", kr.Rev)
-	kr.initLabelsFile()
+	if n := kr.Network(); n != "" {
+		env = addIfMissing(env, "ISTIO_META_NETWORK", n)
+	}
+	if nv := kr.requestedNetworkView(); nv != "" {
+		env = addIfMissing(env, "ISTIO_META_REQUESTED_NETWORK_VIEW", nv)
+	}
+	env = addIfMissing(env, "CANONICAL_SERVICE", kr.CanonicalService())
+	env = addIfMissing(env, "CANONICAL_REVISION", kr.CanonicalRevision())
+	labels := kr.PodLabels()
+	if lj, err := json.Marshal(labels); err == nil {
+		env = addIfMissing(env, "ISTIO_METAJSON_LABELS", string(lj))
+	}
+	annotations := kr.PodAnnotations()
+	if aj, err := json.Marshal(annotations); err == nil && len(annotations) > 0 {
+		env = addIfMissing(env, "ISTIO_METAJSON_ANNOTATIONS", string(aj))
+	}
+	if !kr.DryRun {
+		kr.initLabelsFile(labels)
+		kr.initAnnotationsFile(annotations)
+	}
 
-	env = addIfMissing(env, "OUTPUT_CERTS", prefix+"/var/run/secrets/istio.io/")
+	env = addIfMissing(env, "OUTPUT_CERTS", kr.OutputCerts())
 
 	// This would be used if a audience-less JWT was present - not possible with TokenRequest
 	// TODO: add support for passing a long lived 1p JWT in a file, for local run
 	//env = append(env, "JWT_POLICY=first-party-jwt")
 
-	kr.WhiteboxMode = kr.Config("ISTIO_META_INTERCEPTION_MODE", "") == "NONE"
+	kr.WhiteboxMode = kr.annotation(annoInterceptionMode, kr.Config("ISTIO_META_INTERCEPTION_MODE", "")) == "NONE"
 	if os.Getuid() != 0 {
 		kr.WhiteboxMode = true
 	}
@@ -281,8 +283,14 @@ func (kr *KRun) StartIstioAgent() error {
 
 	iptablesEnv := []string{}
 	iptablesEnv = append(iptablesEnv, env...)
-
-	if !kr.WhiteboxMode {
+	var iptablesCmd *exec.Cmd
+
+	if !kr.WhiteboxMode && kr.DryRun {
+		iptablesCmd = kr.istioIptablesCommand(iptablesEnv)
+	} else if !kr.WhiteboxMode && kr.LazyProxy {
+		kr.lazyIptablesEnv = iptablesEnv
+		log.Println("iptables interception deferred until the proxy is ready")
+	} else if !kr.WhiteboxMode {
 		err := kr.runIptablesSetup(iptablesEnv)
 		if err != nil {
 			log.Println("iptables disabled ", err)
@@ -295,15 +303,21 @@ func (kr *KRun) StartIstioAgent() error {
 	}
 
 	// Currently broken in iptables - use whitebox interception, but still run it
+	if !kr.WhiteboxMode && !kr.DryRun && !kr.LazyProxy {
+		kr.initDNSCapture()
+		// Must be after the DNS upstream - it is used for the names that are not cached.
+		kr.SeedEndpointCache(ctx)
+	}
 	if !kr.WhiteboxMode {
-		resolvConfForRoot()
 		env = addIfMissing(env, "ISTIO_META_DNS_CAPTURE", "true")
 		env = addIfMissing(env, "DNS_PROXY_ADDR", "localhost:53")
 	}
 
 	// MCP config
 	// The following 2 are required for MeshCA.
-	if kr.ClusterAddress != "" {
+	if kr.Platform != "" {
+		env = addIfMissing(env, "CLOUD_PLATFORM", kr.Platform)
+	} else if kr.ClusterAddress != "" {
 		env = addIfMissing(env, "GKE_CLUSTER_URL", kr.ClusterAddress)
 		env = addIfMissing(env, "GCP_METADATA", fmt.Sprintf("%s|%s|%s|%s",
 			kr.ProjectId, kr.ProjectNumber, kr.ClusterName, kr.ClusterLocation))
@@ -322,16 +336,26 @@ func (kr *KRun) StartIstioAgent() error {
 
 	// Gets translated to "APP_CONTAINERS" metadata, used to identify the container.
 	env = addIfMissing(env, "ISTIO_META_APP_CONTAINERS", "cloudrun")
+	// Used by istiod to build the inbound listeners, same as the containerPorts.
+	env = addIfMissing(env, "ISTIO_META_POD_PORTS", podPortsJSON(kr.AppPorts()))
 
-	if kr.X509KeyPair != nil && kr.ClusterAddress != "" {
+	if kr.X509KeyPair != nil && (kr.ClusterAddress != "" || kr.Platform != "") {
 		// Loaded from workload cert file - no need to use citadel or mesh CA.
 		env = addIfMissing(env, "CA_PROVIDER", "GoogleGkeWorkloadCertificate")
+	} else if ca.Provider != "" {
+		env = addIfMissing(env, "CA_PROVIDER", ca.Provider)
+	}
+	if ca.Addr != "" {
+		env = addIfMissing(env, "CA_ADDR", ca.Addr)
+	}
+	if kr.ClusterID != "" {
+		env = addIfMissing(env, "ISTIO_META_CLUSTER_ID", kr.ClusterID)
 	}
+
 	// If MCP is available, and PROXY_CONFIG is not set explicitly
 	if kr.MeshTenant != "" &&
 		kr.MeshTenant != "-" &&
 		os.Getenv("PROXY_CONFIG") == "" {
-		env = addIfMissing(env, "CA_ADDR", "meshca.googleapis.com:443")
 		env = addIfMissing(env, "XDS_AUTH_PROVIDER", "gcp")
 
 		env = addIfMissing(env, "ISTIO_META_CLOUDRUN_ADDR", kr.MeshTenant)
@@ -347,13 +371,9 @@ func (kr *KRun) StartIstioAgent() error {
 		env = append(env, "HTTP_PROXY_PORT=15007")
 	}
 
-	// WIP: automate getting the CR addr (or have Thetis handle it)
-	// For example by reading a configmap in cluster
-	//--set-env-vars="ISTIO_META_CLOUDRUN_ADDR=asm-stg-asm-cr-asm-managed-rapid-c-2o26nc3aha-uc.a.run.app:443" \
-
 	// Environment detection: if the docker image or VM does not include an Envoy use the 'grpc agent' mode,
 	// i.e. only get certificate.
-	if _, err := os.Stat("/usr/local/bin/envoy"); os.IsNotExist(err) {
+	if kr.EnvoyPath() == "" {
 		env = append(env, "DISABLE_ENVOY=true")
 	}
 	// TODO: look in /var...
@@ -367,85 +387,163 @@ func (kr *KRun) StartIstioAgent() error {
 
 	// Generate grpc bootstrap - no harm, low cost.
 	// TODO: New version of Istio does this automatically, will be removed
-	if os.Getenv("GRPC_XDS_BOOTSTRAP") == "" {
+	if pre := kr.Config("MESH_GRPC_BOOTSTRAP", ""); pre != "" && !kr.DryRun {
+		// Generated at build time - the agent doesn't need to generate it.
+		if err := ExpandBootstrap(pre, prefix+"/etc/istio/proxy/grpc_bootstrap.json", envVars(env)); err != nil {
+			log.Println("Failed to expand gRPC bootstrap", pre, err)
+		}
+	} else if os.Getenv("GRPC_XDS_BOOTSTRAP") == "" {
 		env = append(env, "GRPC_XDS_BOOTSTRAP=./etc/istio/proxy/grpc_bootstrap.json")
 	}
+
+	env = kr.metadataEnv(env)
+	env = provenanceEnv(env)
+	// Refuse to start binaries that don't match the expected digests.
+	if err := kr.verifyProxyBinaries(); err != nil {
+		return err
+	}
+
 	cmd := kr.agentCommand()
-	var stdout io.ReadCloser
+	if kr.DryRun {
+		if os.Getuid() != 0 {
+			env = append(env, "ISTIO_META_UNPRIVILEGED_POD=true")
+		}
+		cmd.Env = env
+		writeLaunchInfo(os.Stdout, cmd, iptablesCmd)
+		return nil
+	}
+	// Saved for restarting the agent after a proxy upgrade.
+	kr.agentEnv = env
+	started, err := kr.prepareAgentCommand(cmd, env)
+	if err != nil {
+		return err
+	}
+	os.MkdirAll(prefix+"/var/lib/istio/envoy/", 0700)
+
+	//saveLaunchInfo(cmd)
+
+	kr.pinControlPlane(ctx, kr.XDSAddr, ca.Addr)
+
+	// Set after the tokens and bootstrap config are ready - the proxy_start phase ends here.
+	kr.EnvoyStartTime = time.Now()
+	go kr.runAgent(cmd, started)
+
+	return nil
+}
+
+// prepareAgentCommand sets the env, credentials and output of the agent. Returns the function to call after the
+// agent is started.
+func (kr *KRun) prepareAgentCommand(cmd *exec.Cmd, env []string) (func(), error) {
+	started := func() {}
 	if os.Getuid() == 0 {
 		os.MkdirAll("/etc/istio/proxy", 777)
 		os.Chown("/etc/istio/proxy", 1337, 1337)
 
-		cmd.SysProcAttr = &syscall.SysProcAttr{}
-		cmd.SysProcAttr.Credential = &syscall.Credential{
-			Uid: 0,
-			Gid: 1337,
-		}
-		pty, tty, err := pty.Open()
+		cred, err := kr.childCredential("agent", "0:1337")
 		if err != nil {
-			log.Println("Error opening pty ", err)
-			stdout, _ = cmd.StdoutPipe()
-			os.Stdout.Chown(1337, 1337)
-		} else {
-			cmd.Stdout = tty
-			err = tty.Chown(1337, 1337)
-			if err != nil {
-				log.Println("Error chown ", tty.Name(), err)
-			}
-			stdout = pty
+			return nil, err
 		}
+		cmd.SysProcAttr = &syscall.SysProcAttr{Credential: cred}
+		started = kr.setChildStdout(cmd, "pilot-agent", 1337, 1337)
 		cmd.Dir = "/"
 	} else {
-		cmd.Stdout = os.Stdout
+		cmd.Stdout = kr.LogWriter("pilot-agent", os.Stdout)
 		env = append(env, "ISTIO_META_UNPRIVILEGED_POD=true")
 	}
 	cmd.Env = env
 
-	cmd.Stderr = os.Stderr
-	os.MkdirAll(prefix+"/var/lib/istio/envoy/", 0700)
-
-	//saveLaunchInfo(cmd)
+	cmd.Stderr = kr.LogWriter("pilot-agent", os.Stderr)
+	return started, nil
+}
 
-	go func() {
-		if Debug {
-			log.Println("Starting cmd", cmd.Args, cmd.Env)
-		}
-		err := cmd.Start()
-		if err != nil {
-			log.Println("Failed to start ", cmd, err)
-		}
-		kr.agentCmd = cmd
-		if stdout != nil {
-			go func() {
-				io.Copy(os.Stdout, stdout)
-			}()
-		}
-		err = cmd.Wait()
-		if err != nil {
-			if cmd.ProcessState.ExitCode() == 255 {
-				log.Println("Wait err ", err, cmd.Env)
-			} else {
-				log.Println("Wait err ", err)
-			}
-			kr.Exit(1)
+// runAgent starts the agent and waits for it to exit. krun exits with the agent, unless the agent was stopped
+// for a proxy upgrade.
+func (kr *KRun) runAgent(cmd *exec.Cmd, started func()) {
+	if Debug {
+		log.Println("Starting cmd", cmd.Args, cmd.Env)
+	}
+	atomic.StoreInt64(&kr.agentStarted, time.Now().UnixNano())
+	err := kr.startChild(cmd)
+	if err != nil {
+		log.Println("Failed to start ", cmd, err)
+	}
+	kr.agentCmd = cmd
+	started()
+	err = cmd.Wait()
+	closeLogWriters(cmd)
+	if done := kr.agentRestarting(); done != nil {
+		close(done)
+		return
+	}
+	if err != nil {
+		if cmd.ProcessState.ExitCode() == 255 {
+			log.Println("Wait err ", err, cmd.Env)
+		} else {
+			log.Println("Wait err ", err)
 		}
-		kr.Exit(0)
-	}()
+		kr.ReportExit("pilot-agent", cmd, err)
+		kr.Exit(1)
+	}
+	kr.Exit(0)
+}
+
+func (kr *KRun) initDNSCapture() {
+	resolvConfForRoot()
+	if err := kr.StartDNSUpstream(); err != nil {
+		log.Println("Failed to start DNS upstream, using resolv.conf", err)
+	}
+}
 
+// EnableInterception installs the iptables capture and DNS redirection deferred by LazyProxy. Should be called
+// after the proxy is ready. Connections opened by the app before the call are not captured.
+func (kr *KRun) EnableInterception() error {
+	if kr.lazyIptablesEnv == nil {
+		return nil
+	}
+	if err := kr.runIptablesSetup(kr.lazyIptablesEnv); err != nil {
+		return err
+	}
+	kr.lazyIptablesEnv = nil
+	kr.initDNSCapture()
+	log.Println("iptables interception enabled", "sinceStart", time.Since(kr.StartTime))
 	return nil
 }
 
+// initAgentDirs creates the directories used by the agent, and saves the Citadel roots.
+func (kr *KRun) initAgentDirs(prefix string) {
+	os.MkdirAll(prefix+"/etc/istio/proxy", 0755)
+	//os.MkdirAll(prefix+"/var/lib/istio/envoy", 0755)
+
+	// Save the istio certificates - for proxyless or app use.
+	os.MkdirAll(prefix+"/var/run/secrets/istio", 0755)
+	os.MkdirAll(prefix+"/var/run/secrets/mesh", 0755)
+	os.MkdirAll(prefix+"/var/run/secrets/istio.io", 0755)
+	os.MkdirAll(prefix+"/etc/istio/pod", 0755)
+	if os.Getuid() == 0 {
+		//os.Chown(prefix+"/var/lib/istio/envoy", 1337, 1337)
+		os.Chown(prefix+"/var/run/secrets/istio.io", 1337, 1337)
+		os.Chown(prefix+"/var/run/secrets/istio", 1337, 1337)
+		os.Chown(prefix+"/var/run/secrets/mesh", 1337, 1337)
+		os.Chown(prefix+"/etc/istio/pod", 1337, 1337)
+		os.Chown(prefix+"/etc/istio/proxy", 1337, 1337)
+	}
+
+	// Pilot agent expects this file, containing citadel roots. Will be used to connect to the XDS server, and as
+	// default root CA.
+	if kr.CitadelRoot != "" {
+		err := ioutil.WriteFile(prefix+"/var/run/secrets/istio/root-cert.pem", []byte(kr.CitadelRoot), 0755)
+		if err != nil {
+			log.Println("Failed to write citadel root", "rootCAFile", prefix+"/var/run/secrets/istio/root-cert.pem", "error", err)
+		}
+	}
+}
+
 // For troubleshooting, generate a file with the env and command.
 // This can also be used for running krun as a periodic job instead of as a launcher
 // Compile with  -gcflags  "all=-N -l"
 func saveLaunchInfo(cmd *exec.Cmd) {
 	b := bytes.Buffer{}
-	for _, e := range cmd.Env {
-		kv := strings.SplitN(e, "=", 2)
-		if len(kv) == 2 {
-			b.Write([]byte("export " + kv[0] + "=" + "'" + kv[1] + "'\n"))
-		}
-	}
+	writeEnv(&b, cmd.Env, false)
 	b.Write([]byte{'\n'})
 	b.Write([]byte("dlv --listen=127.0.0.1:44997 --headless=true --api-version=2 --check-go-version=false --only-same-user=false exec "))
 	b.Write([]byte(cmd.Args[0]))
@@ -466,17 +564,28 @@ func addIfMissing(env []string, key, val string) []string {
 	return append(env, key+"="+val)
 }
 
+// exitGrace is the time children have to exit after SIGTERM, and exitProcess ends krun. Replaced in tests.
+var (
+	exitGrace   = 5 * time.Second
+	exitProcess = os.Exit
+)
+
+// Exit stops the children and exits with the code. The buffered output of the children is written to stderr
+// first, for post-mortem - including on clean exits.
 func (kr *KRun) Exit(code int) {
+	atomic.StoreInt32(&kr.shuttingDown, 1)
+	kr.UnregisterWorkloadEntry()
 	if kr.agentCmd != nil && kr.agentCmd.Process != nil {
 		kr.agentCmd.Process.Signal(syscall.SIGTERM)
 	}
 	if kr.appCmd != nil && kr.appCmd.Process != nil {
-		kr.agentCmd.Process.Signal(syscall.SIGTERM)
+		kr.appCmd.Process.Signal(syscall.SIGTERM)
 	}
 	for _, a := range kr.Children {
 		a.Process.Signal(syscall.SIGTERM)
 	}
-	time.Sleep(5 * time.Second)
+	go kr.stopApps(syscall.SIGTERM)
+	time.Sleep(exitGrace)
 	if kr.agentCmd != nil && kr.agentCmd.Process != nil {
 		kr.agentCmd.Process.Kill()
 	}
@@ -486,28 +595,84 @@ func (kr *KRun) Exit(code int) {
 	for _, a := range kr.Children {
 		a.Process.Kill()
 	}
-	os.Exit(code)
+	kr.killApps()
+	kr.dumpLastLogs(os.Stderr)
+	exitProcess(code)
+}
+
+// CanonicalService returns the service.istio.io/canonical-name, from CANONICAL_SERVICE or the workload name.
+func (kr *KRun) CanonicalService() string {
+	return kr.Config("CANONICAL_SERVICE", kr.Name)
+}
+
+// CanonicalRevision returns the service.istio.io/canonical-revision, from CANONICAL_REVISION or the revision.
+func (kr *KRun) CanonicalRevision() string {
+	return kr.Config("CANONICAL_REVISION", kr.Rev)
 }
 
-func (kr *KRun) initLabelsFile() {
-	labels := ""
+// PodLabels returns the labels of the workload, equivalent to the k8s pod labels. Used for telemetry and
+// for selecting the workload in Istio config.
+//
+// The default labels are merged with kr.Labels (including 'labels' from krun.yaml) and MESH_LABELS, a list
+// of key=value - for example "team=payments,tier=backend". Extra labels override the defaults.
+func (kr *KRun) PodLabels() map[string]string {
+	res := map[string]string{
+		"version":                   kr.Rev,
+		"security.istio.io/tlsMode": "istio",
+	}
 	if kr.Gateway != "" {
-		labels = fmt.Sprintf(
-			`version="%s"
-security.istio.io/tlsMode="istio"
-istio="%s"
-`, kr.Rev, kr.Gateway)
+		for k, v := range kr.GatewayLabels() {
+			res[k] = v
+		}
 	} else {
-		labels = fmt.Sprintf(
-			`version="%s"
-security.istio.io/tlsMode="istio"
-app="%s"
-service.istio.io/canonical-name="%s"
-environment="cloud-run-mesh"
-`, kr.Rev, kr.Name, kr.Name)
+		res["app"] = kr.Name
+		res["service.istio.io/canonical-name"] = kr.CanonicalService()
+		res["service.istio.io/canonical-revision"] = kr.CanonicalRevision()
+		res["environment"] = "cloud-run-mesh"
 	}
+	for k, v := range kr.topologyLabels() {
+		res[k] = v
+	}
+	for k, v := range kr.Labels {
+		res[k] = v
+	}
+	for k, v := range parseLabels(kr.Config("MESH_LABELS", "")) {
+		res[k] = v
+	}
+	return res
+}
+
+// parseLabels parses a list of key=value.
+func parseLabels(s string) map[string]string {
+	res := map[string]string{}
+	for _, kv := range splitList(s) {
+		p := strings.SplitN(kv, "=", 2)
+		if len(p) != 2 || p[0] == "" {
+			log.Println("Invalid label, expecting key=value", kv)
+			continue
+		}
+		res[strings.TrimSpace(p[0])] = strings.TrimSpace(p[1])
+	}
+	return res
+}
+
+// formatLabels returns the labels in the downward API format used by /etc/istio/pod/labels, sorted by key.
+func formatLabels(labels map[string]string) string {
+	keys := []string{}
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	res := ""
+	for _, k := range keys {
+		res = res + fmt.Sprintf("%s=%q\n", k, labels[k])
+	}
+	return res
+}
+
+func (kr *KRun) initLabelsFile(labels map[string]string) {
 	os.MkdirAll("./etc/istio/pod", 755)
-	err := ioutil.WriteFile("./etc/istio/pod/labels", []byte(labels), 0777)
+	err := ioutil.WriteFile("./etc/istio/pod/labels", []byte(formatLabels(labels)), 0777)
 	if err != nil {
 		log.Println("Error writing labels", err)
 	}
@@ -534,28 +699,7 @@ func (kr *KRun) runIptablesSetup(env []string) error {
 		    - 15090,15021,15020
 
 	*/
-	outRange := kr.Config("OUTBOUND_IP_RANGES_INCLUDE", "10.0.0.0/8")
-	// Exclude ports from Envoy capture - hbone-h2, hbone-h2c
-	excludePorts := kr.Config("OUTBOUND_PORTS_EXCLUDE", "15008,15009")
-	if excludePorts != "15008,15009" {
-		excludePorts = excludePorts + ",15008,15009"
-	}
-
-	cmd := exec.Command("/usr/local/bin/pilot-agent",
-		"istio-iptables",
-		// "-p", "15001", // outbound capture port, default value
-		//"-z", "15006", - no inbound interception, default value
-		"-u", "1337", // REQUIRED - code default is 128
-		//"-m", "REDIRECT", // default value
-		//"-i", "*", // OUTBOUND_IP_RANGES_INCLUDE
-		"-i", outRange, // Alternative - only mesh traffic
-		// "-b", "", // disable all inbound redirection, default
-		// "-d", "15090,15021,15020", // exclude specific ports from inbound capture, if -b '*'
-		"-o", excludePorts,
-		//"-x", "", // exclude CIDR, default
-	)
-	cmd.Env = env
-	cmd.Dir = "/"
+	cmd := kr.istioIptablesCommand(env)
 	so := &bytes.Buffer{}
 	se := &bytes.Buffer{}
 	cmd.Stdout = so
@@ -575,5 +719,46 @@ func (kr *KRun) runIptablesSetup(env []string) error {
 	return nil
 }
 
+// istioIptablesCommand returns the istio-iptables command for capturing the outbound traffic.
+func (kr *KRun) istioIptablesCommand(env []string) *exec.Cmd {
+	outRange := kr.annotation(annoIncludeOutboundRanges, kr.Config("OUTBOUND_IP_RANGES_INCLUDE", "10.0.0.0/8"))
+	// Exclude ports from Envoy capture - hbone-h2, hbone-h2c
+	excludePorts := kr.annotation(annoExcludeOutboundPorts, kr.Config("OUTBOUND_PORTS_EXCLUDE", "15008,15009"))
+	if excludePorts != "15008,15009" {
+		excludePorts = excludePorts + ",15008,15009"
+	}
+	for _, p := range kr.GatewayExcludePorts() {
+		if !contains(strings.Split(excludePorts, ","), p) {
+			excludePorts = excludePorts + "," + p
+		}
+	}
+
+	agent := kr.AgentPath()
+	if agent == "" {
+		agent = defaultAgentPath
+	}
+	cmd := exec.Command(agent,
+		"istio-iptables",
+		// "-p", "15001", // outbound capture port, default value
+		//"-z", "15006", - no inbound interception, default value
+		"-u", "1337", // REQUIRED - code default is 128
+		//"-m", "REDIRECT", // default value
+		//"-i", "*", // OUTBOUND_IP_RANGES_INCLUDE
+		"-i", outRange, // Alternative - only mesh traffic
+		// "-d", "15090,15021,15020", // exclude specific ports from inbound capture, if -b '*'
+		"-o", excludePorts,
+	)
+	// No inbound redirection by default - only the declared app ports.
+	if b := kr.inboundCapturePorts(); b != "" {
+		cmd.Args = append(cmd.Args, "-b", b)
+	}
+	if x := kr.annotation(annoExcludeOutboundRanges, ""); x != "" {
+		cmd.Args = append(cmd.Args, "-x", x) // exclude CIDR
+	}
+	cmd.Env = env
+	cmd.Dir = "/"
+	return cmd
+}
+
 // TODO: lookup istiod service and endpoints ( instead of using an ILB or external name)
 //
@@ -0,0 +1,65 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mesh
+
+import (
+	"time"
+
+	"github.com/GoogleCloudPlatform/cloud-run-mesh/pkg/hbone"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/keepalive"
+)
+
+// Keepalive for the persistent connections - XDS, HBONE tunnels and reverse tunnels.
+//
+// Cloud Run egress (VPC connector, Cloud NAT) drops idle connections without sending a reset. Without probes the
+// connection is only found broken on the next write, after the TCP retransmit timeout, and all instances
+// reconnect at once. The defaults keep the connections active well below the NAT idle timeouts:
+//
+// - MESH_TCP_KEEPALIVE (30s) - TCP keepalive period for dialed connections, -1s to disable
+// - MESH_H2_PING (60s) - HTTP/2 and gRPC ping interval when no frames are received
+// - MESH_H2_PING_TIMEOUT (15s) - close the connection if the ping is not answered
+// - MESH_RECONNECT_JITTER (5s) - random delay added to the reverse tunnel reconnects, 0s to disable
+//
+// Istiod rejects gRPC pings more frequent than 15s, MESH_H2_PING should not be lower.
+
+// KeepAlive returns the keepalive settings for HBONE connections.
+func (kr *KRun) KeepAlive() hbone.KeepAlive {
+	return hbone.KeepAlive{
+		TCP:         kr.configSignedDuration("MESH_TCP_KEEPALIVE", 30*time.Second),
+		Ping:        kr.configDuration("MESH_H2_PING", 60*time.Second),
+		PingTimeout: kr.configDuration("MESH_H2_PING_TIMEOUT", 15*time.Second),
+		Jitter:      kr.configSignedDuration("MESH_RECONNECT_JITTER", 5*time.Second),
+	}
+}
+
+// configSignedDuration is like configDuration, but accepts 0 and negative values - used to disable a feature.
+func (kr *KRun) configSignedDuration(name string, def time.Duration) time.Duration {
+	d, err := time.ParseDuration(kr.Config(name, def.String()))
+	if err != nil {
+		return def
+	}
+	return d
+}
+
+// xdsKeepalive returns the gRPC keepalive option for control plane connections.
+func (kr *KRun) xdsKeepalive() grpc.DialOption {
+	ka := kr.KeepAlive()
+	return grpc.WithKeepaliveParams(keepalive.ClientParameters{
+		Time:                ka.Ping,
+		Timeout:             ka.PingTimeout,
+		PermitWithoutStream: true,
+	})
+}
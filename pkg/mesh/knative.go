@@ -0,0 +1,111 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mesh
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Knative on GKE (CloudRun for Anthos) runs the same image as a real pod: the kubelet mounts the service account
+// token, the hostname is the pod name and the pod IP is routable in the cluster.
+//
+// When detected:
+// - namespace and KSA are taken from the mounted service account, POD_NAME and POD_IP from the downward API if set.
+// - the pod name is used as the instance ID and agent POD_NAME, instead of K_REVISION plus a suffix.
+// - WorkloadEntry registration and Service publishing are skipped - the pod is already an endpoint.
+// - kubelet-projected tokens (istio-token) are used as is.
+//
+// MESH_KNATIVE=false disables the detection.
+
+const serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// OnKnativePod returns true if running as a Knative pod, with a mounted service account.
+func OnKnativePod() bool {
+	if os.Getenv("K_SERVICE") == "" || os.Getenv("KUBERNETES_SERVICE_HOST") == "" {
+		return false
+	}
+	_, err := os.Stat(filepath.Join(serviceAccountDir, "token"))
+	return err == nil
+}
+
+func (kr *KRun) initKnative() {
+	if kr.Config("MESH_KNATIVE", "") == "false" || !OnKnativePod() {
+		return
+	}
+	kr.Knative = true
+	if kr.Namespace == "" {
+		kr.Namespace = os.Getenv("POD_NAMESPACE")
+	}
+	if kr.Namespace == "" {
+		ns, _ := ioutil.ReadFile(filepath.Join(serviceAccountDir, "namespace"))
+		kr.Namespace = strings.TrimSpace(string(ns))
+	}
+	if kr.KSA == "" || kr.KSA == "default" {
+		if ksa := os.Getenv("SERVICE_ACCOUNT"); ksa != "" {
+			kr.KSA = ksa
+		} else if tok, err := ioutil.ReadFile(filepath.Join(serviceAccountDir, "token")); err == nil {
+			if _, ksa := tokenServiceAccount(string(tok)); ksa != "" {
+				kr.KSA = ksa
+			}
+		}
+	}
+	if kr.InstanceID == "" {
+		kr.InstanceID = os.Getenv("POD_NAME")
+	}
+	if kr.InstanceID == "" {
+		kr.InstanceID, _ = os.Hostname()
+	}
+	if kr.Rev == "" {
+		kr.Rev = os.Getenv("K_REVISION")
+	}
+}
+
+// tokenServiceAccount returns the namespace and service account from the 'sub' of a K8S JWT -
+// system:serviceaccount:NAMESPACE:KSA. The token is not verified.
+func tokenServiceAccount(jwt string) (string, string) {
+	parts := strings.Split(strings.TrimSpace(jwt), ".")
+	if len(parts) != 3 {
+		return "", ""
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return "", ""
+	}
+	claims := struct {
+		Sub string `json:"sub"`
+	}{}
+	if json.Unmarshal(payload, &claims) != nil {
+		return "", ""
+	}
+	p := strings.Split(claims.Sub, ":")
+	if len(p) != 4 || p[0] != "system" || p[1] != "serviceaccount" {
+		return "", ""
+	}
+	return p[2], p[3]
+}
+
+// projectedToken returns true if the token file was mounted by the kubelet - it must not be replaced.
+func (kr *KRun) projectedToken(file string) bool {
+	if !kr.Knative {
+		return false
+	}
+	_, err := os.Stat(file)
+	return err == nil
+}
@@ -0,0 +1,32 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mesh
+
+import (
+	"encoding/base64"
+	"testing"
+)
+
+func TestTokenServiceAccount(t *testing.T) {
+	payload := base64.RawURLEncoding.EncodeToString([]byte(`{"iss":"kubernetes/serviceaccount","sub":"system:serviceaccount:fortio:fortio-sa"}`))
+	ns, ksa := tokenServiceAccount("e30." + payload + ".sig\n")
+	if ns != "fortio" || ksa != "fortio-sa" {
+		t.Error("Unexpected service account", ns, ksa)
+	}
+	payload = base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"user@example.com"}`))
+	if _, ksa := tokenServiceAccount("e30." + payload + ".sig"); ksa != "" {
+		t.Error("Unexpected service account", ksa)
+	}
+}
@@ -28,6 +28,8 @@ import (
 	"os/exec"
 	"os/signal"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -40,6 +42,36 @@ type Cfg interface {
 	GetCM(ctx context.Context, ns string, name string) (map[string]string, error)
 }
 
+// CfgWriter is optionally implemented by the Cfg, for components that publish config or status.
+type CfgWriter interface {
+	// UpdateCM merges the keys into a config map. Empty values remove the key.
+	UpdateCM(ctx context.Context, ns string, name string, data map[string]string) error
+}
+
+// ResourceWriter is optionally implemented by the Cfg, for objects without a typed client (Istio CRDs).
+type ResourceWriter interface {
+	// ApplyResource creates or replaces the object. api is the path of the group version, resource the plural name.
+	ApplyResource(ctx context.Context, api, resource, ns, name string, obj map[string]interface{}) error
+
+	DeleteResource(ctx context.Context, api, resource, ns, name string) error
+}
+
+// LeaseHolder is optionally implemented by the Cfg, to keep a coordination.k8s.io Lease for objects that must be
+// garbage collected if the instance is killed without cleanup.
+type LeaseHolder interface {
+	// RenewLease creates or renews the lease, returning its UID.
+	RenewLease(ctx context.Context, ns, name, holder string, duration time.Duration) (string, error)
+
+	DeleteLease(ctx context.Context, ns, name string) error
+}
+
+// ServicePublisher is optionally implemented by the Cfg, to make the workload callable from the cluster using
+// a Service name.
+type ServicePublisher interface {
+	// PublishService creates or updates a Service with the addresses, or an ExternalName Service if addrs is empty.
+	PublishService(ctx context.Context, ns, name string, ports map[string]int32, addrs []string, externalName string) error
+}
+
 type TokenProvider interface {
 	GetToken(ctx context.Context, aud string) (string, error)
 }
@@ -89,8 +121,12 @@ type KRun struct {
 
 	// If not empty, will run Istio-agent as a gateway (router instead of sidecar)
 	// with the "istio: $Gateway" label.
+	// Set from GATEWAY_NAME, which may be a list of roles - Gateway is the first one.
 	Gateway string
 
+	// Gateways is the list of gateway roles for this instance.
+	Gateways []string
+
 	// Agent debug config (example dns:debug).
 	// Based on ISTIO_DEBUG
 	AgentDebug string
@@ -134,12 +170,32 @@ type KRun struct {
 	// Can be set using CLUSTER_LOCATION, or will be detected.
 	ClusterLocation string
 
+	// AppCommand is the app to start. If empty, the krun command line arguments are used.
+	AppCommand []string
+
 	Children    []*exec.Cmd
 	agentCmd    *exec.Cmd
 	appCmd      *exec.Cmd
+
+	// Address of the metadata proxy, set as GCE_METADATA_HOST for the app.
+	metadataAddr string
+
+	// Address of the mesh info API, see StartMeshInfo.
+	meshInfoAddr    string
+	meshInfoStarted bool
+
+	// Socket of the SPIFFE Workload API, see StartWorkloadAPI.
+	workloadAPIAddr string
+
+	// metadataUpstream replaces the metadata server for the proxy - set in local mode.
+	metadataUpstream http.Handler
+
 	TrustDomain string
 
 	StartTime      time.Time
+	MeshEnvTime    time.Time
+	CertsReadyTime time.Time
+	TokensTime     time.Time
 	EnvoyStartTime time.Time
 	EnvoyReadyTime time.Time
 	AppReadyTime   time.Time
@@ -147,10 +203,45 @@ type KRun struct {
 	Labels     map[string]string
 	VendorInit func(context.Context, *KRun) error
 
+	// Annotations set in the config file, see PodAnnotations.
+	Annotations map[string]string
+
+	// Metadata set in the config file, see ProxyMetadata.
+	Metadata map[string]interface{}
+
+	// Apps are the additional app processes, see AppProcess.
+	Apps     []*AppProcess
+	appsOnce sync.Once
+
+	// Filters are the extra proxy filters, see ApplyFilters.
+	Filters []*ProxyFilter
+
+	// Rewritten app probes, see AppProbers.
+	appProbers     map[string]*AppProber
+	appProbersOnce sync.Once
+
 	// WhiteboxMode indicates no iptables capture
 	WhiteboxMode bool
 	InCluster    bool
 
+	// Knative is set when running as a Knative pod on GKE (CloudRun for Anthos), instead of managed CloudRun.
+	Knative bool
+
+	// DryRun makes StartIstioAgent print the agent command, env, iptables rules and PROXY_CONFIG instead of
+	// executing them. Set with --dry-run or MESH_DRY_RUN=true.
+	DryRun bool
+
+	// LazyProxy starts the app without waiting for the proxy. The iptables capture is installed by
+	// EnableInterception once the proxy is ready - until then the app traffic bypasses the mesh.
+	// Set with MESH_LAZY_PROXY=true.
+	LazyProxy bool
+
+	// Env for the deferred iptables setup, with LazyProxy.
+	lazyIptablesEnv []string
+
+	// Proxy settings for the app, with MESH_ROOTLESS.
+	rootlessEnv []string
+
 	// PEM cert roots detected in the cluster - Citadel, custom CAs from mesh config.
 	// Will be saved to a file.
 	CARoots []string
@@ -169,18 +260,38 @@ type KRun struct {
 	// - https://.... - regular URL, using system certificates. Will return the mesh env directly.
 	// - file://... - load from file
 	// - gke://CONFIG_PROJECT_ID[/CLUSTER_LOCATION/CLUSTER_NAME/WORKLOAD_NAMESPACE] - GKE Container API.
+	// - //gkehub.googleapis.com/projects/FLEET_PROJECT/locations/LOCATION/memberships/NAME - fleet member, using Connect Gateway.
+	// - //gkehub.googleapis.com/projects/FLEET_PROJECT - fleet membership discovery, using FLEET_LABEL.
 	MeshAddr *url.URL
 
+	// ClusterID is the Istio cluster ID of the config cluster, if it was selected from a list of clusters.
+	// Used as ISTIO_META_CLUSTER_ID.
+	ClusterID string
+
 	// Config cluster address - https://container.googleapis.com/v1/projects/%s/locations/%s/clusters/%s
 	// Used in the identitynamespace config for STS exchange.
 	ClusterAddress string
 
 	InstanceID string
 
+	// InstanceRegion and InstanceZone are the locality of the instance - set from the metadata server on GCP.
+	// See Locality.
+	InstanceRegion string
+	InstanceZone   string
+
+	// InstanceNetwork is the VPC network of the instance, loaded from the metadata server if MESH_NETWORK=vpc.
+	InstanceNetwork string
+
+	// Platform is set when not running on GCP ("aws"). GCP-specific settings are not passed to the agent.
+	Platform string
+
 	// Content of the 'mesh environment' - loaded from the config file in istio-system (or the address of the mesh).
 	// Additional entries may be merged from env or app specific config file.
 	MeshEnv map[string]string
 
+	// MeshEnvIssues are the problems found validating the mesh-env - see ValidateMeshEnv.
+	MeshEnvIssues []string
+
 	CSRSigner CSRSigner
 
 	// Interface to abstract k8s implementation
@@ -188,11 +299,18 @@ type KRun struct {
 	Cfg              Cfg
 	TransportWrapper func(transport http.RoundTripper) http.RoundTripper
 
+	// MetadataTokenProvider returns the tokens served to the app by the metadata proxy - access tokens for an
+	// empty audience, ID tokens otherwise. If nil, tokens from the metadata server are returned.
+	MetadataTokenProvider TokenProvider
+
 	// Function to call after config has been loaded, before init certs.
 	PostConfigLoad func(ctx context.Context, kr *KRun) error
 
+	// X509KeyPair is the workload certificate. It is replaced when the certificate is renewed - code running
+	// after startup should use WorkloadCertificate.
 	X509KeyPair     *tls.Certificate
 	TrustedCertPool *x509.CertPool
+	certM           sync.RWMutex
 
 	// Holds Traffic Director sidecar environment.
 	TdSidecarEnv *TdSidecarEnv
@@ -202,22 +320,117 @@ type KRun struct {
 	NetworkName string
 	// If true, will not attempt to save the certificates to ./var/run/secrets/workload-certs/...
 	SkipSaveCerts bool
+
+	// StartupCache holds the values discovered by a previous instance of the revision, if MESH_STARTUP_CACHE is set.
+	StartupCache *StartupCache
+
+	// EndpointCache holds the mesh names seen by the proxy, if MESH_ENDPOINT_CACHE is set.
+	EndpointCache *EndpointCache
+
+	// XDSClient is the in-process ADS client, if MESH_XDS_CLIENT is set.
+	XDSClient *XDSClient
+
+	// Metrics is used to export krun and proxy metrics to the vendor monitoring system. May be nil.
+	Metrics MetricWriter
+
+	// ErrorReporter is used to report crashes of the agent or app to the vendor error reporting system. May be nil.
+	ErrorReporter ErrorReporter
+
+	// EventPublisher is used to publish lifecycle events to the vendor message queue, see PublishEvent. May be nil.
+	EventPublisher EventPublisher
+
+	// ArtifactUploader is used to upload crash artifacts to the vendor object storage, see UploadCrash. May be nil.
+	ArtifactUploader ArtifactUploader
+
+	// DebugMux holds the debug handlers, served on localhost by StartDebugServer.
+	DebugMux *http.ServeMux
+
+	// Flag and file config sources, see Config.
+	config configState
+
+	// Commands to run for each hook, from the config file.
+	hooks map[string][]string
+
+	// Last lines of output for each child process.
+	outputs  map[string]*LineBuffer
+	outputsM sync.Mutex
+
+	// Guards AppReadyTime, which is checked by the startup budget timer.
+	startupM sync.Mutex
+
+	signalsOnce sync.Once
+
+	// Whitebox proxy drain, see DrainStatus.
+	drain drainState
+
+	// Proxy upgrade, see UpgradeProxy.
+	upgrade  upgradeState
+	agentEnv []string
+
+	// Set to 1 when krun is shutting down - app processes are no longer restarted.
+	shuttingDown int32
+
+	// UnixNano start time of the running agent - updated when the agent is restarted, unlike EnvoyStartTime.
+	agentStarted int64
+
+	// Unique name of the instance, see PodName.
+	podName     string
+	podNameOnce sync.Once
+
+	// Name of the WorkloadEntry registered by krun, if any.
+	workloadEntry  string
+	workloadEntryM sync.Mutex
+	// Address and health of the registered WorkloadEntry, to re-apply it if the lease is recreated.
+	workloadEntryIP      string
+	workloadEntryHealthy bool
+
+	vpcOnce sync.Once
+	vpcMode string
+
+	xdsResolutionM sync.Mutex
+	xdsResolution  *XDSResolution
+
+	retryM  sync.Mutex
+	retries map[string]*RetryStats
+
+	watchdog watchdogState
+
+	// Mirror comparison totals, see Mirror.
+	mirror mirrorState
+
+	// Last Envoy config dump, for crash artifacts - see UploadCrash.
+	crash crashState
+
+	// Result of the last version skew check, see Versions.
+	versions versionState
+
+	// Bundle is the verified offline bootstrap bundle, if any - see LoadBundle.
+	Bundle       *Bundle
+	bundleActive bool
 }
 
 var Debug = false
 
-// New creates an uninitialized mesh launcher.
-func New() *KRun {
+// New creates an uninitialized mesh launcher, configured from env and the config file, with the options applied.
+func New(opts ...Option) *KRun {
 	kr := &KRun{
 		MeshEnv:         map[string]string{},
 		TrustedCertPool: x509.NewCertPool(),
 		StartTime:       time.Now(),
 		Aud2File:        map[string]string{},
 		Labels:          map[string]string{},
+		Annotations:     map[string]string{},
 		ProxyConfig:     &ProxyConfig{},
 		TdSidecarEnv:    NewTdSidecarEnv(),
+		DebugMux:        http.NewServeMux(),
 	}
 	kr.initFromEnv()
+	if err := kr.LoadConfigFile(); err != nil {
+		log.Println("Failed to load config file", err)
+	}
+	for _, o := range opts {
+		o(kr)
+	}
 	return kr
 }
 
@@ -331,6 +544,7 @@ func (kr *KRun) initFromEnv() {
 	if kr.Gateway == "" {
 		kr.Gateway = os.Getenv("GATEWAY_NAME")
 	}
+	kr.initGateways()
 	if kr.MeshTenant == "" {
 		kr.MeshTenant = os.Getenv("MESH_TENANT")
 	}
@@ -394,6 +608,7 @@ func (kr *KRun) initFromEnv() {
 			kr.MeshEnv[k[0]] = k[1]
 		}
 	}
+	kr.initKnative()
 }
 
 // Set defaults, after all config was loaded, for missing configs
@@ -410,22 +625,34 @@ func (kr *KRun) setDefaults() {
 	if kr.KSA == "" {
 		kr.KSA = "default"
 	}
+	// Gateway may also be set directly by code embedding krun.
+	if len(kr.Gateways) == 0 && kr.Gateway != "" {
+		kr.initGateways()
+	}
 }
 
 func (kr *KRun) LoadConfig(ctx context.Context) error {
-	if kr.XDSAddr == "" { // if the XDS_ADDR is set explicitly, no need to load mesh env.
+	if kr.XDSAddr == "" && kr.cachedMeshEnv() {
+		kr.MeshEnvTime = time.Now()
+	} else if kr.XDSAddr == "" && kr.bundleMeshEnv() {
+		kr.MeshEnvTime = time.Now()
+	} else if kr.XDSAddr == "" { // if the XDS_ADDR is set explicitly, no need to load mesh env.
 		err := kr.loadMeshEnv(ctx)
-		if err != nil {
+		if err != nil && kr.UseBundle() && kr.bundleMeshEnv() {
+			log.Println("Error loadMeshEnv, using bootstrap bundle", "err", err)
+		} else if err != nil {
 			log.Println("Error loadMeshEnv", "err", err)
 			return err
 		}
+		kr.FindMeshTenant(ctx)
+		kr.MeshEnvTime = time.Now()
 		// Adjust 'derived' values if needed.
 		if kr.TrustDomain == "" && kr.ProjectId != "" {
 			kr.TrustDomain = kr.ProjectId + ".svc.id.goog"
 		}
 	}
 
-	if kr.ClusterAddress == "" {
+	if kr.ClusterAddress == "" && kr.Platform == "" {
 		kr.ClusterAddress = fmt.Sprintf("https://container.googleapis.com/v1/projects/%s/locations/%s/clusters/%s",
 			kr.ProjectId, kr.ClusterLocation, kr.ClusterName)
 	}
@@ -446,6 +673,7 @@ func (kr *KRun) LoadConfig(ctx context.Context) error {
 		log.Println("InitRoots", "err", err)
 		return err
 	}
+	kr.CertsReadyTime = time.Now()
 
 	return nil
 }
@@ -459,8 +687,20 @@ func (kr *KRun) LoadConfig(ctx context.Context) error {
 // 'library' means linking this or a similar package with the application.
 func (kr *KRun) RefreshAndSaveTokens() {
 	// TODO: trace on errors
-	ctx, _ := context.WithTimeout(context.Background(), 10*time.Second)
+	ctx, cf := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cf()
+	kr.refreshTokens(ctx)
+	if kr.meshInfoStarted {
+		if err := kr.WriteMeshInfo(); err != nil {
+			log.Println("Failed to update mesh info", err)
+		}
+	}
 
+	time.AfterFunc(30*time.Minute, kr.RefreshAndSaveTokens)
+}
+
+// refreshTokens saves the tokens and renews the certificates once, using the deadline of ctx.
+func (kr *KRun) refreshTokens(ctx context.Context) {
 	if kr.TokenProvider != nil {
 		for aud, f := range kr.Aud2File {
 			kr.saveTokenToFile(ctx, kr.Namespace, aud, f)
@@ -470,8 +710,6 @@ func (kr *KRun) RefreshAndSaveTokens() {
 	kr.InitCertificates(ctx, WorkloadCertDir)
 	// TODO: we may want to reload mesh-env, and adjust behavior ( log levels, etc)
 	// Then we can also call  kr.InitRoots(ctx, certBase).
-
-	time.AfterFunc(30*time.Minute, kr.RefreshAndSaveTokens)
 }
 
 func (kr *KRun) saveTokenToFile(ctx context.Context, ns string, audience string, destFile string) error {
@@ -502,47 +740,65 @@ func (kr *KRun) saveTokenToFile(ctx context.Context, ns string, audience string,
 // - if "mesh tenant" is set - use MCP. This is the main case.
 // - if "mesh tehant" is not set - use the mesh connector for ASM/OSS
 // - if an XDS_ADDR is explicitly set, use it - unless it is invalid ( MCP without tenant ID)
+//
+// The steps are XDSResolvers, see ResolveXDS.
 func (kr *KRun) FindXDSAddr() string {
-	if kr.XDSAddr != "" {
-		if (kr.MeshTenant == "-" || kr.MeshTenant == "") &&
-				strings.Contains(kr.XDSAddr, "googleapis.com") &&
-				strings.Contains(kr.XDSAddr, "meshconfig") {
-			log.Println("Ignoring meshconfig XDS address without tenant, using mesh connector")
-		} else {
-			return kr.XDSAddr
-		}
-	}
-	addr := ""
-	if kr.MeshTenant == "-" || kr.MeshTenant == "" {
-		// Explicitly in-cluster
-		addr = kr.MeshConnectorInternalAddr + ":15012"
-	} else {
-		// we have a mesh tenant - use MCP
-		// For staging: explicitly set XDS_ADDR in mesh-env
-		// To force use of in-cluster: set tenant to "-" in mesh-env
-		addr = "meshconfig.googleapis.com:443"
-	}
-	return addr
+	return kr.ResolveXDS(context.Background()).Addr
 }
 
 // loadMeshEnv will lookup the 'mesh-env', an opaque config for the mesh.
 // Currently it is loaded from K8S
 // TODO: URL, like 'konfig' ( including gcp pseudo-URL like gcp://cluster.location.project/.... )
 //
+// The mesh-env is a hierarchy, each level overriding keys from the previous one:
+// - istio-system/mesh-env - mesh wide defaults, maintained by the mesh connector and platform team
+// - NAMESPACE/mesh-env - namespace defaults
+// - NAMESPACE/mesh-env-NAME - service specific settings
+//
+// Only the mesh-wide config is required - missing or unreadable overrides are skipped.
 func (kr *KRun) loadMeshEnv(ctx context.Context) error {
 	if kr.Cfg == nil {
 		return nil // no k8s, skip loading.
 	}
-	d, err := kr.Cfg.GetCM(ctx, "istio-system", "mesh-env")
+	base, err := kr.Cfg.GetCM(ctx, "istio-system", "mesh-env")
 	if err != nil {
 		return err
 	}
+	// The Cfg may return shared (cached) maps - merge into a copy.
+	d := map[string]string{}
+	for k, v := range base {
+		d[k] = v
+	}
+	if kr.Namespace != "" && kr.Namespace != "istio-system" {
+		kr.mergeMeshEnv(ctx, d, kr.Namespace, "mesh-env")
+		if kr.Name != "" {
+			kr.mergeMeshEnv(ctx, d, kr.Namespace, "mesh-env-"+kr.Name)
+		}
+	}
 	return kr.initFromMeshEnv(d)
 }
 
+// mergeMeshEnv overrides the keys in d with the content of an override config map.
+func (kr *KRun) mergeMeshEnv(ctx context.Context, d map[string]string, ns, name string) {
+	o, err := kr.Cfg.GetCM(ctx, ns, name)
+	if err != nil {
+		log.Println("Skipping mesh-env override", ns, name, err)
+		return
+	}
+	for k, v := range o {
+		d[k] = v
+	}
+	if Debug && len(o) > 0 {
+		log.Println("Merged mesh-env override", ns, name, len(o))
+	}
+}
+
 // initFromMeshEnv updates settings in KR - but only if they were not explicitly set by env
 // variables.
 func (kr *KRun) initFromMeshEnv(d map[string]string) error {
+	if err := kr.checkMeshEnv(d); err != nil {
+		return err
+	}
 	kr.MeshEnv = d
 	// See connector for supported values
 	kr.updateFromMap(d, "PROJECT_NUMBER", &kr.ProjectNumber)
@@ -551,8 +807,8 @@ func (kr *KRun) initFromMeshEnv(d map[string]string) error {
 	kr.updateFromMap(d, "CLUSTER_NAME", &kr.ClusterName)
 	kr.updateFromMap(d, "CLUSTER_LOCATION", &kr.ClusterLocation)
 	kr.updateFromMap(d, "PROJECT_ID", &kr.ProjectId)
-	kr.updateFromMap(d, "MCON_ADDR", &kr.MeshConnectorAddr)
-	kr.updateFromMap(d, "IMCON_ADDR", &kr.MeshConnectorInternalAddr)
+	kr.updateFromMap(d, "MESH_CONNECTOR_ADDR", &kr.MeshConnectorAddr)
+	kr.updateFromMap(d, "MESH_CONNECTOR_INTERNAL_ADDR", &kr.MeshConnectorInternalAddr)
 
 	kr.updateFromMap(d, "CAROOT_ISTIOD", &kr.CitadelRoot)
 	if kr.CitadelRoot != "" {
@@ -567,19 +823,12 @@ func (kr *KRun) updateFromMap(d map[string]string, key string, dest *string) {
 	}
 }
 
-// Config returns a mesh setting, from env variable or the loaded mesh-env.
+// Config returns a mesh setting, from flags, env variable, the loaded mesh-env or config file - see config.go.
 func (kr *KRun) Config(name, def string) string {
-	v := os.Getenv(name)
-	if v != "" {
+	kr.recordConfig(name, def)
+	if v, _ := kr.ConfigSource(name); v != "" {
 		return v
 	}
-	if kr.MeshEnv != nil {
-		v = kr.MeshEnv[name]
-		if v != "" {
-			return v
-		}
-	}
-
 	return def
 }
 
@@ -588,6 +837,11 @@ func (kr *KRun) Config(name, def string) string {
 // SIGTERM - send by docker on 'docker stop'.
 // See https://cloud.google.com/blog/products/containers-kubernetes/kubernetes-best-practices-terminating-with-grace
 func (kr *KRun) Signals() {
+	kr.signalsOnce.Do(kr.handleSignals)
+}
+
+func (kr *KRun) handleSignals() {
+	kr.handleQuit()
 	go func() {
 		sigs := make(chan os.Signal, 1)
 		signal.Notify(sigs, syscall.SIGINT)
@@ -605,9 +859,17 @@ func (kr *KRun) Signals() {
 		signal.Notify(sigs, syscall.SIGTERM)
 		s := <-sigs
 		log.Println("Received SIGTERM", "total_time", time.Since(kr.StartTime))
-		// Will start draining envoy
+		atomic.StoreInt32(&kr.shuttingDown, 1)
+		kr.PublishEvent(EventDraining, nil)
+		// Stop receiving new mesh traffic before draining.
+		kr.UnregisterWorkloadEntry()
+		// Will start draining envoy. In whitebox mode the app uses the proxy - Envoy is stopped after the app.
 		if kr.agentCmd != nil {
-			kr.agentCmd.Process.Signal(s)
+			if kr.WhiteboxMode && kr.appCmd != nil {
+				go kr.drainProxyAfterApp(s)
+			} else {
+				kr.agentCmd.Process.Signal(s)
+			}
 		}
 		if kr.appCmd != nil {
 			kr.appCmd.Process.Signal(s)
@@ -615,6 +877,7 @@ func (kr *KRun) Signals() {
 		for _, a := range kr.Children {
 			a.Process.Signal(s)
 		}
+		kr.stopApps(s)
 	}()
 }
 
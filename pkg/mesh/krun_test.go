@@ -50,7 +50,7 @@ func TestK8S(t *testing.T) {
 	// For Istio agent
 	kr.RefreshAndSaveTokens()
 
-	kr.StartIstioAgent()
+	kr.StartIstioAgent(ctx)
 
 	t.Log(kr)
 
@@ -0,0 +1,282 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mesh
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Local developer mode - krun --local or MESH_LOCAL=true.
+//
+// No GCP project or cluster is used:
+// - a self-signed CA is created in MESH_LOCAL_CA_DIR (default ./var/run/secrets/local-ca), or loaded if it exists.
+//   Sharing the dir between containers (docker-compose volume) creates a mesh with a single trust domain.
+//   The files use the Istio 'plugged-in CA' names, the dir can be mounted as /etc/cacerts for a local istiod.
+// - workload certificates and tokens are signed by the local CA.
+// - the metadata server is stubbed, with tokens signed by the local CA.
+// - the agent connects to LOCAL_ISTIOD (host:15012) if set, otherwise it is not started (XDSAddr "-").
+
+// LocalPlatform is the KRun.Platform in local mode - the Istio CLOUD_PLATFORM for no platform.
+const LocalPlatform = "none"
+
+// InitLocal configures krun for local development. Replaces the vendor init and mesh-env loading.
+func (kr *KRun) InitLocal(ctx context.Context) error {
+	kr.Platform = LocalPlatform
+	if kr.TrustDomain == "" {
+		kr.TrustDomain = "cluster.local"
+	}
+	if kr.ProjectId == "" {
+		kr.ProjectId = "local"
+	}
+	if kr.InstanceID == "" {
+		kr.InstanceID, _ = os.Hostname()
+	}
+	dir := kr.Config("MESH_LOCAL_CA_DIR", filepath.Join(kr.BaseDir, "var/run/secrets/local-ca"))
+	ca, err := NewLocalCA(dir, kr.TrustDomain)
+	if err != nil {
+		return err
+	}
+	ca.kr = kr
+	kr.CSRSigner = ca
+	kr.TokenProvider = ca
+	kr.MetadataTokenProvider = ca
+	kr.metadataUpstream = kr.localMetadata()
+	kr.MeshEnv["CAROOT_LOCAL"] = string(ca.CertPEM)
+
+	istiod := kr.Config("LOCAL_ISTIOD", "")
+	if istiod != "" {
+		kr.XDSAddr = istiod
+		os.Setenv("XDS_ROOT_CA", filepath.Join(dir, "root-cert.pem"))
+		os.Setenv("CA_ROOT_CA", filepath.Join(dir, "root-cert.pem"))
+	} else if kr.XDSAddr == "" {
+		kr.XDSAddr = "-"
+	}
+	log.Println("Local mode", "trustDomain", kr.TrustDomain, "ca", dir, "xds", kr.XDSAddr)
+	return nil
+}
+
+// localMetadata stubs the metadata server - the metadata proxy adds tokens and mesh attributes.
+func (kr *KRun) localMetadata() http.Handler {
+	const prefix = "/computeMetadata/v1/"
+	values := map[string]string{
+		"project/project-id":                       kr.ProjectId,
+		"project/numeric-project-id":               "0",
+		"instance/id":                              kr.InstanceID,
+		"instance/zone":                            "projects/0/zones/local-a",
+		"instance/region":                          "projects/0/regions/local",
+		"instance/attributes/":                     "",
+		"instance/service-accounts/default/email":  kr.KSA + "@" + kr.TrustDomain,
+		"instance/service-accounts/default/scopes": "https://www.googleapis.com/auth/cloud-platform",
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		v, f := values[strings.TrimPrefix(r.URL.Path, prefix)]
+		if !f || !strings.HasPrefix(r.URL.Path, prefix) {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Metadata-Flavor", "Google")
+		w.Header().Set("content-type", "application/text")
+		w.Write([]byte(v))
+	})
+}
+
+// LocalCA is a self-signed CA, used to sign workload certificates and tokens in local mode.
+type LocalCA struct {
+	TrustDomain string
+	Key         *ecdsa.PrivateKey
+	Cert        *x509.Certificate
+	CertPEM     []byte
+
+	kr *KRun
+}
+
+// NewLocalCA loads the CA from dir, or creates a new one.
+func NewLocalCA(dir, trustDomain string) (*LocalCA, error) {
+	ca := &LocalCA{TrustDomain: trustDomain}
+	certPEM, err := ioutil.ReadFile(filepath.Join(dir, "ca-cert.pem"))
+	if err == nil {
+		keyPEM, err := ioutil.ReadFile(filepath.Join(dir, "ca-key.pem"))
+		if err != nil {
+			return nil, err
+		}
+		return ca, ca.load(certPEM, keyPEM)
+	}
+
+	ca.Key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{trustDomain}, CommonName: "krun local CA"},
+		NotBefore:             time.Now().Add(-1 * time.Hour),
+		NotAfter:              time.Now().Add(10 * 365 * 24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &ca.Key.PublicKey, ca.Key)
+	if err != nil {
+		return nil, err
+	}
+	ca.Cert, _ = x509.ParseCertificate(der)
+	ca.CertPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyDER, err := x509.MarshalECPrivateKey(ca.Key)
+	if err != nil {
+		return nil, err
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: blockTypeECPrivateKey, Bytes: keyDER})
+
+	err = os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+	// Same names as the Istio plugged-in CA.
+	for f, data := range map[string][]byte{
+		"ca-key.pem":     keyPEM,
+		"ca-cert.pem":    ca.CertPEM,
+		"root-cert.pem":  ca.CertPEM,
+		"cert-chain.pem": ca.CertPEM,
+	} {
+		mode := os.FileMode(0644)
+		if f == "ca-key.pem" {
+			mode = 0600
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, f), data, mode); err != nil {
+			return nil, err
+		}
+	}
+	log.Println("Created local CA", dir)
+	return ca, nil
+}
+
+func (ca *LocalCA) load(certPEM, keyPEM []byte) error {
+	b, _ := pem.Decode(certPEM)
+	if b == nil {
+		return errors.New("invalid local CA certificate")
+	}
+	cert, err := x509.ParseCertificate(b.Bytes)
+	if err != nil {
+		return err
+	}
+	b, _ = pem.Decode(keyPEM)
+	if b == nil {
+		return errors.New("invalid local CA key")
+	}
+	key, err := x509.ParseECPrivateKey(b.Bytes)
+	if err != nil {
+		return err
+	}
+	ca.Cert, ca.Key, ca.CertPEM = cert, key, certPEM
+	return nil
+}
+
+// CSRSign implements CSRSigner. The SAN is the SPIFFE identity of the workload - like the real CAs, the
+// identity in the CSR is ignored.
+func (ca *LocalCA) CSRSign(ctx context.Context, csrPEM []byte, certValidTTLInSec int64) ([]string, error) {
+	b, _ := pem.Decode(csrPEM)
+	if b == nil {
+		return nil, errors.New("invalid CSR")
+	}
+	csr, err := x509.ParseCertificateRequest(b.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	if err = csr.CheckSignature(); err != nil {
+		return nil, err
+	}
+	id, err := url.Parse(ca.spiffeID())
+	if err != nil {
+		return nil, err
+	}
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{Organization: []string{ca.TrustDomain}},
+		NotBefore:    time.Now().Add(-5 * time.Minute),
+		NotAfter:     time.Now().Add(time.Duration(certValidTTLInSec) * time.Second),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		URIs:         []*url.URL{id},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.Cert, csr.PublicKey, ca.Key)
+	if err != nil {
+		return nil, err
+	}
+	return []string{string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})), string(ca.CertPEM)}, nil
+}
+
+func (ca *LocalCA) spiffeID() string {
+	ns, ksa := "default", "default"
+	if ca.kr != nil {
+		ns, ksa = ca.kr.Namespace, ca.kr.KSA
+	}
+	return "spiffe://" + ca.TrustDomain + "/ns/" + ns + "/sa/" + ksa
+}
+
+// GetToken implements TokenProvider, returning a K8S-style JWT signed with the CA key (ES256).
+func (ca *LocalCA) GetToken(ctx context.Context, aud string) (string, error) {
+	ns, ksa := "default", "default"
+	if ca.kr != nil {
+		ns, ksa = ca.kr.Namespace, ca.kr.KSA
+	}
+	now := time.Now()
+	claims := map[string]interface{}{
+		"iss": "https://" + ca.TrustDomain,
+		"sub": "system:serviceaccount:" + ns + ":" + ksa,
+		"iat": now.Unix(),
+		"exp": now.Add(1 * time.Hour).Unix(),
+	}
+	if aud != "" {
+		claims["aud"] = []string{aud}
+	}
+	hdr, _ := json.Marshal(map[string]string{"alg": "ES256", "typ": "JWT"})
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	enc := base64.RawURLEncoding
+	signed := enc.EncodeToString(hdr) + "." + enc.EncodeToString(payload)
+	h := sha256.Sum256([]byte(signed))
+	r, s, err := ecdsa.Sign(rand.Reader, ca.Key, h[:])
+	if err != nil {
+		return "", err
+	}
+	// JWS uses the fixed size R || S encoding.
+	sig := make([]byte, 64)
+	r.FillBytes(sig[0:32])
+	s.FillBytes(sig[32:])
+	return signed + "." + enc.EncodeToString(sig), nil
+}
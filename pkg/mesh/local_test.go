@@ -0,0 +1,89 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mesh
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"math/big"
+	"strings"
+	"testing"
+)
+
+func TestLocalCA(t *testing.T) {
+	dir := t.TempDir()
+	ca, err := NewLocalCA(dir, "cluster.local")
+	if err != nil {
+		t.Fatal(err)
+	}
+	kr := &KRun{Namespace: "fortio", KSA: "default"}
+	ca.kr = kr
+
+	priv, csr, err := kr.NewCSR("rsa", "cluster.local", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	chain, err := ca.CSRSign(context.Background(), csr, 3600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kp, err := tls.X509KeyPair([]byte(strings.Join(chain, "\n")), priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, _ := x509.ParseCertificate(kp.Certificate[0])
+	if len(leaf.URIs) != 1 || leaf.URIs[0].String() != "spiffe://cluster.local/ns/fortio/sa/default" {
+		t.Error("Unexpected SAN", leaf.URIs)
+	}
+
+	// A second instance sharing the dir must use the same root.
+	ca2, err := NewLocalCA(dir, "cluster.local")
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(ca2.Cert)
+	if _, err := leaf.Verify(x509.VerifyOptions{Roots: roots, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageAny}}); err != nil {
+		t.Error("Leaf not signed by the persisted CA", err)
+	}
+
+	tok, err := ca.GetToken(context.Background(), "istio-ca")
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts := strings.Split(tok, ".")
+	if len(parts) != 3 {
+		t.Fatal("Invalid JWT", tok)
+	}
+	if p := decodeSegment(parts[1]); !strings.Contains(p, `"aud":["istio-ca"]`) ||
+		!strings.Contains(p, "system:serviceaccount:fortio:default") {
+		t.Error("Unexpected claims", p)
+	}
+	sig, _ := base64.RawURLEncoding.DecodeString(parts[2])
+	h := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	r, s := new(big.Int).SetBytes(sig[0:32]), new(big.Int).SetBytes(sig[32:])
+	if !ecdsa.Verify(&ca2.Key.PublicKey, h[:], r, s) {
+		t.Error("Invalid token signature")
+	}
+}
+
+func decodeSegment(p string) string {
+	d, _ := base64.RawURLEncoding.DecodeString(p)
+	return string(d)
+}
@@ -0,0 +1,89 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mesh
+
+import (
+	"strings"
+)
+
+// Locality and network of the instance, used by istiod for locality-aware load balancing and multi-network routing.
+//
+// The region and zone are loaded from the metadata server on GCP - Cloud Run zones are named region-N. MESH_LOCALITY
+// overrides them, as region/zone/subzone.
+//
+// MESH_NETWORK sets the ISTIO_META_NETWORK. 'vpc' uses the name of the VPC network of the instance - only if
+// the Cloud Run service uses VPC egress on the same network as the clusters. By default the NETWORK from mesh-env
+// is used, if set - instances on a different network need an east-west gateway to reach the cluster pods.
+//
+// The locality is added to the labels (topology.kubernetes.io/region and zone, istio-locality) and to the gRPC
+// bootstrap, the network to the labels (topology.istio.io/network) and ISTIO_META_NETWORK.
+
+const (
+	labelRegion   = "topology.kubernetes.io/region"
+	labelZone     = "topology.kubernetes.io/zone"
+	labelSubzone  = "topology.istio.io/subzone"
+	labelLocality = "istio-locality"
+	labelNetwork  = "topology.istio.io/network"
+)
+
+// Locality returns the locality of the instance, or nil if not known.
+func (kr *KRun) Locality() *Locality {
+	if l := kr.Config("MESH_LOCALITY", ""); l != "" {
+		p := strings.SplitN(l, "/", 3)
+		res := &Locality{Region: p[0]}
+		if len(p) > 1 {
+			res.Zone = p[1]
+		}
+		if len(p) > 2 {
+			res.SubZone = p[2]
+		}
+		return res
+	}
+	if kr.InstanceRegion == "" && kr.InstanceZone == "" {
+		return nil
+	}
+	return &Locality{Region: kr.InstanceRegion, Zone: kr.InstanceZone}
+}
+
+// Network returns the Istio network of the instance, or "" for the default network.
+func (kr *KRun) Network() string {
+	n := kr.Config("MESH_NETWORK", kr.MeshEnv["NETWORK"])
+	if n == "vpc" {
+		return kr.InstanceNetwork
+	}
+	return n
+}
+
+// topologyLabels returns the locality and network labels.
+func (kr *KRun) topologyLabels() map[string]string {
+	res := map[string]string{}
+	if l := kr.Locality(); l != nil {
+		if l.Region != "" {
+			res[labelRegion] = l.Region
+		}
+		if l.Zone != "" {
+			res[labelZone] = l.Zone
+		}
+		if l.SubZone != "" {
+			res[labelSubzone] = l.SubZone
+		}
+		// Istio label format - '/' is not allowed in label values.
+		res[labelLocality] = strings.TrimRight(strings.Join([]string{l.Region, l.Zone, l.SubZone}, "."), ".")
+	}
+	if n := kr.Network(); n != "" {
+		res[labelNetwork] = n
+	}
+	return res
+}
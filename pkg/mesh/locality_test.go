@@ -0,0 +1,65 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mesh
+
+import (
+	"os"
+	"testing"
+)
+
+func TestLocality(t *testing.T) {
+	kr := New()
+	if kr.Locality() != nil || len(kr.topologyLabels()) != 0 {
+		t.Error("Expecting no locality")
+	}
+
+	kr.InstanceRegion = "us-central1"
+	kr.InstanceZone = "us-central1-1"
+	l := kr.PodLabels()
+	if l[labelRegion] != "us-central1" || l[labelZone] != "us-central1-1" || l[labelLocality] != "us-central1.us-central1-1" {
+		t.Error("Unexpected labels", l)
+	}
+	b, err := kr.GRPCBootstrap()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.Node.Locality == nil || b.Node.Locality.Zone != "us-central1-1" {
+		t.Error("Missing bootstrap locality", b.Node)
+	}
+
+	os.Setenv("MESH_LOCALITY", "europe-west1/europe-west1-b/rack1")
+	defer os.Unsetenv("MESH_LOCALITY")
+	l = kr.topologyLabels()
+	if l[labelLocality] != "europe-west1.europe-west1-b.rack1" || l[labelSubzone] != "rack1" {
+		t.Error("Unexpected override", l)
+	}
+}
+
+func TestNetwork(t *testing.T) {
+	kr := New()
+	if kr.Network() != "" {
+		t.Error("Expecting default network")
+	}
+	kr.MeshEnv["NETWORK"] = "network1"
+	if kr.Network() != "network1" || kr.PodLabels()[labelNetwork] != "network1" {
+		t.Error("Expecting mesh-env network", kr.Network())
+	}
+	os.Setenv("MESH_NETWORK", "vpc")
+	defer os.Unsetenv("MESH_NETWORK")
+	kr.InstanceNetwork = "default"
+	if kr.Network() != "default" {
+		t.Error("Expecting VPC network", kr.Network())
+	}
+}
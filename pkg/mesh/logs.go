@@ -0,0 +1,284 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mesh
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Envoy and pilot-agent write plain text logs, with their own format. CloudRun treats each line on stdout as an
+// INFO entry - unless the line is a JSON object with a 'severity' field.
+//
+// The relay parses the level from the child output and re-emits each line as a structured entry.
+// See https://cloud.google.com/logging/docs/structured-logging
+//
+// Enabled by default when running in CloudRun (K_SERVICE set), MESH_STRUCTURED_LOGS=false disables it.
+
+// Serialize writes from multiple children - each line must be written atomically.
+var logMutex sync.Mutex
+
+type logEntry struct {
+	Severity string            `json:"severity"`
+	Message  string            `json:"message"`
+	Labels   map[string]string `json:"logging.googleapis.com/labels,omitempty"`
+}
+
+// Map of Envoy, zap (pilot-agent) and klog levels to Cloud Logging severity.
+var severities = map[string]string{
+	"trace":    "DEBUG",
+	"debug":    "DEBUG",
+	"info":     "INFO",
+	"warn":     "WARNING",
+	"warning":  "WARNING",
+	"error":    "ERROR",
+	"critical": "CRITICAL",
+	"fatal":    "CRITICAL",
+	"panic":    "CRITICAL",
+}
+
+// StructuredLogs returns true if the child process output should be converted to structured entries.
+func (kr *KRun) StructuredLogs() bool {
+	def := "false"
+	if os.Getenv("K_SERVICE") != "" {
+		def = "true"
+	}
+	return kr.Config("MESH_STRUCTURED_LOGS", def) == "true"
+}
+
+// LogWriter returns a writer that can be used as Stdout or Stderr for a child. Each line will be relayed to dst,
+// converted to a structured entry if StructuredLogs is enabled, and kept in the output buffer for the source.
+// exec.Cmd doesn't close it - call closeLogWriters when the child exits, to end the relay.
+func (kr *KRun) LogWriter(source string, dst io.Writer) io.WriteCloser {
+	r, w := io.Pipe()
+	go kr.RelayLogs(source, r, dst)
+	return w
+}
+
+// closeLogWriters closes the LogWriter pipes used as Stdout and Stderr of a child that exited or failed to start.
+func closeLogWriters(cmd *exec.Cmd) {
+	for _, w := range []io.Writer{cmd.Stdout, cmd.Stderr} {
+		if pw, ok := w.(*io.PipeWriter); ok {
+			pw.Close()
+		}
+	}
+}
+
+// RelayLogs copies the output of a child to dst, line by line. Blocks until src is closed.
+func (kr *KRun) RelayLogs(source string, src io.Reader, dst io.Writer) {
+	out := kr.logOutput(source, dst)
+	br := bufio.NewReaderSize(src, 16*1024)
+	for {
+		line, err := br.ReadString('\n')
+		if len(line) > 0 {
+			out(line)
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// relayLogsQueued is like RelayLogs, but doesn't block the child if dst is slow. Up to MESH_LOG_QUEUE lines
+// (default 1000) are queued - additional lines are dropped, and the number of dropped lines is logged.
+func (kr *KRun) relayLogsQueued(source string, src io.Reader, dst io.Writer) {
+	n, err := strconv.Atoi(kr.Config("MESH_LOG_QUEUE", "1000"))
+	if err != nil || n <= 0 {
+		n = 1000
+	}
+	q := make(chan string, n)
+	done := make(chan struct{})
+	go func() {
+		out := kr.logOutput(source, dst)
+		for l := range q {
+			out(l)
+		}
+		close(done)
+	}()
+	dropped := 0
+	br := bufio.NewReaderSize(src, 16*1024)
+	for {
+		line, err := br.ReadString('\n')
+		if len(line) > 0 {
+			if dropped > 0 {
+				select {
+				case q <- fmt.Sprintf("krun: dropped %d lines from %s\n", dropped, source):
+					dropped = 0
+				default:
+				}
+			}
+			select {
+			case q <- line:
+			default:
+				dropped++
+			}
+		}
+		if err != nil {
+			if dropped > 0 {
+				q <- fmt.Sprintf("krun: dropped %d lines from %s\n", dropped, source)
+			}
+			close(q)
+			<-done
+			return
+		}
+	}
+}
+
+// logOutput returns the function handling a line of output from a child.
+func (kr *KRun) logOutput(source string, dst io.Writer) func(string) {
+	structured := kr.StructuredLogs()
+	buf := kr.OutputBuffer(source)
+	labels := map[string]string{"source": source}
+	if kr.InstanceID != "" {
+		labels["instanceId"] = kr.InstanceID
+	}
+	return func(line string) {
+		buf.Add(line)
+		if structured {
+			writeLogLine(dst, line, labels)
+		} else {
+			dst.Write([]byte(line))
+		}
+	}
+}
+
+// OutputBuffer returns the buffer holding the last lines of output from a child process.
+// MESH_LOG_BUFFER_LINES sets the number of lines kept for each source, default 200.
+func (kr *KRun) OutputBuffer(source string) *LineBuffer {
+	kr.outputsM.Lock()
+	defer kr.outputsM.Unlock()
+	if kr.outputs == nil {
+		kr.outputs = map[string]*LineBuffer{}
+	}
+	b := kr.outputs[source]
+	if b == nil {
+		n, err := strconv.Atoi(kr.Config("MESH_LOG_BUFFER_LINES", "200"))
+		if err != nil || n <= 0 {
+			n = 200
+		}
+		b = NewLineBuffer(n)
+		kr.outputs[source] = b
+	}
+	return b
+}
+
+// LineBuffer is a ring buffer with the last lines of output.
+// It can also be used as a Writer - for example in a MultiWriter with the app stdout.
+type LineBuffer struct {
+	m       sync.Mutex
+	lines   []string
+	next    int
+	full    bool
+	partial string
+}
+
+func NewLineBuffer(size int) *LineBuffer {
+	return &LineBuffer{lines: make([]string, size)}
+}
+
+// Add appends a line, replacing the oldest line if the buffer is full.
+func (lb *LineBuffer) Add(line string) {
+	line = strings.TrimRight(line, "\r\n")
+	lb.m.Lock()
+	lb.add(line)
+	lb.m.Unlock()
+}
+
+func (lb *LineBuffer) add(line string) {
+	lb.lines[lb.next] = line
+	lb.next++
+	if lb.next == len(lb.lines) {
+		lb.next = 0
+		lb.full = true
+	}
+}
+
+// Write implements io.Writer, splitting the data in lines.
+func (lb *LineBuffer) Write(p []byte) (int, error) {
+	lb.m.Lock()
+	defer lb.m.Unlock()
+	data := lb.partial + string(p)
+	for {
+		i := strings.IndexByte(data, '\n')
+		if i < 0 {
+			break
+		}
+		lb.add(strings.TrimRight(data[0:i], "\r"))
+		data = data[i+1:]
+	}
+	if len(data) > 16*1024 {
+		data = data[0 : 16*1024]
+	}
+	lb.partial = data
+	return len(p), nil
+}
+
+// Lines returns the buffered lines, oldest first.
+func (lb *LineBuffer) Lines() []string {
+	lb.m.Lock()
+	defer lb.m.Unlock()
+	res := []string{}
+	if lb.full {
+		res = append(res, lb.lines[lb.next:]...)
+	}
+	res = append(res, lb.lines[0:lb.next]...)
+	return res
+}
+
+func writeLogLine(dst io.Writer, line string, labels map[string]string) {
+	line = strings.TrimRight(line, "\r\n")
+	if line == "" {
+		return
+	}
+	var data []byte
+	if line[0] == '{' && json.Valid([]byte(line)) {
+		// Already structured (--log_as_json)
+		data = []byte(line)
+	} else {
+		data, _ = json.Marshal(&logEntry{
+			Severity: parseSeverity(line),
+			Message:  line,
+			Labels:   labels,
+		})
+	}
+	logMutex.Lock()
+	dst.Write(append(data, '\n'))
+	logMutex.Unlock()
+}
+
+// parseSeverity finds the level in a log line. Supported formats:
+//
+// - envoy default: [2021-09-01 18:16:33.123][12][warning][config] message
+// - envoy, as configured by istio: 2021-09-01T18:16:33.123Z  warning  envoy config  message
+// - zap (pilot-agent): 2021-09-01T18:16:33.123456Z	info	sds	message
+func parseSeverity(line string) string {
+	fields := strings.FieldsFunc(line, func(r rune) bool {
+		return r == ' ' || r == '\t' || r == '[' || r == ']'
+	})
+	// The level is in the first few fields, after the timestamp and thread id.
+	for i := 0; i < len(fields) && i < 5; i++ {
+		if s, f := severities[strings.ToLower(fields[i])]; f {
+			return s
+		}
+	}
+	return "INFO"
+}
@@ -0,0 +1,140 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mesh
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLineBuffer(t *testing.T) {
+	lb := NewLineBuffer(3)
+	lb.Add("1\n")
+	lb.Write([]byte("2\n3\n4"))
+	l := lb.Lines()
+	if len(l) != 3 || l[0] != "1" || l[2] != "3" {
+		t.Error("Unexpected lines", l)
+	}
+	lb.Write([]byte("5\n"))
+	l = lb.Lines()
+	if len(l) != 3 || l[0] != "2" || l[2] != "45" {
+		t.Error("Unexpected lines after wrap", l)
+	}
+}
+
+func TestParseSeverity(t *testing.T) {
+	for line, sev := range map[string]string{
+		"[2021-09-01 18:16:33.123][12][warning][config] message": "WARNING",
+		"2021-09-01T18:16:33.123456Z\terror\tsds\tmessage":       "ERROR",
+		"plain message": "INFO",
+	} {
+		if s := parseSeverity(line); s != sev {
+			t.Error("Unexpected severity", line, s)
+		}
+	}
+}
+
+func TestRelayLogsQueued(t *testing.T) {
+	kr := &KRun{}
+	kr.SetFlagConfig("MESH_STRUCTURED_LOGS", "false")
+	out := &bytes.Buffer{}
+	kr.relayLogsQueued("envoy", strings.NewReader("line1\nline2\nline3"), out)
+	if out.String() != "line1\nline2\nline3" {
+		t.Error("Unexpected output", out.String())
+	}
+
+	// A blocked writer must not block the child - lines over the queue size are dropped.
+	kr = &KRun{}
+	kr.SetFlagConfig("MESH_STRUCTURED_LOGS", "false")
+	kr.SetFlagConfig("MESH_LOG_QUEUE", "2")
+	bw := &blockingWriter{release: make(chan struct{}), b: &bytes.Buffer{}}
+	r, w := io.Pipe()
+	done := make(chan struct{})
+	go func() {
+		kr.relayLogsQueued("envoy", r, bw)
+		close(done)
+	}()
+	for i := 0; i < 10; i++ {
+		w.Write([]byte("line\n"))
+	}
+	// Returns after the relay is done with the buffered lines and reads again.
+	w.Write([]byte{})
+	w.Close()
+	close(bw.release)
+	<-done
+	if !strings.Contains(bw.b.String(), "krun: dropped") {
+		t.Error("Expecting dropped lines", bw.b.String())
+	}
+	if n := strings.Count(bw.b.String(), "line\n"); n > 3 {
+		t.Error("Expecting at most queue size and in flight lines", n)
+	}
+}
+
+type blockingWriter struct {
+	release chan struct{}
+	b       *bytes.Buffer
+}
+
+func (bw *blockingWriter) Write(p []byte) (int, error) {
+	<-bw.release
+	return bw.b.Write(p)
+}
+
+func TestSetChildStdout(t *testing.T) {
+	kr := &KRun{}
+	kr.SetFlagConfig("MESH_STRUCTURED_LOGS", "false")
+	cmd := exec.Command("/bin/sh", "-c", "echo hello > /dev/stdout")
+	started := kr.setChildStdout(cmd, "test-child", os.Getuid(), os.Getgid())
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	started()
+	cmd.Wait()
+	for i := 0; i < 100; i++ {
+		if l := kr.OutputBuffer("test-child").Lines(); len(l) > 0 {
+			if l[0] != "hello" {
+				t.Error("Unexpected output", l)
+			}
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Error("No output relayed")
+}
+
+func TestLogWriterClose(t *testing.T) {
+	kr := &KRun{}
+	kr.SetFlagConfig("MESH_STRUCTURED_LOGS", "false")
+	out := &bytes.Buffer{}
+	cmd := exec.Command("/bin/sh", "-c", "printf 'a\\nb'")
+	cmd.Stdout = kr.LogWriter("hook", out)
+	if err := cmd.Run(); err != nil {
+		t.Fatal(err)
+	}
+	closeLogWriters(cmd)
+	// The last line has no newline - it is only relayed when the relay gets EOF.
+	for i := 0; i < 100; i++ {
+		if l := kr.OutputBuffer("hook").Lines(); len(l) == 2 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Error("Relay not closed", kr.OutputBuffer("hook").Lines())
+}
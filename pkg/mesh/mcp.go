@@ -0,0 +1,56 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mesh
+
+import (
+	"context"
+	"log"
+)
+
+// Managed control plane discovery.
+//
+// MCP creates an env-REVISION config map in istio-system, with the CLOUDRUN_ADDR used as ISTIO_META_CLOUDRUN_ADDR.
+// The mesh connector copies it to mesh-env as MESH_TENANT - if the connector is not installed or the mesh-env was
+// created before MCP was enabled, krun reads the config map directly.
+//
+// MESH_REVISION selects the revision (for example asm-managed-rapid). By default the asm-managed, asm-managed-rapid
+// and asm-managed-stable revisions are tried, in order. MESH_TENANT=- disables MCP.
+
+var mcpRevisions = []string{"asm-managed", "asm-managed-rapid", "asm-managed-stable"}
+
+// FindMeshTenant sets MeshTenant from the MCP config map, if not already set.
+func (kr *KRun) FindMeshTenant(ctx context.Context) {
+	if kr.MeshTenant != "" || kr.Cfg == nil {
+		return
+	}
+	revs := mcpRevisions
+	if r := kr.Config("MESH_REVISION", ""); r != "" {
+		revs = []string{r}
+	}
+	for _, r := range revs {
+		cm, err := kr.Cfg.GetCM(ctx, "istio-system", "env-"+r)
+		if err != nil {
+			if Debug {
+				log.Println("MCP config not found", r, err)
+			}
+			continue
+		}
+		if a := cm["CLOUDRUN_ADDR"]; a != "" {
+			kr.MeshTenant = a
+			log.Println("MCP discovered", "revision", r, "addr", a)
+			return
+		}
+	}
+}
@@ -0,0 +1,51 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mesh
+
+import (
+	"context"
+	"testing"
+)
+
+// mapCfg is a Cfg backed by a map of ns/name to config map data.
+type mapCfg map[string]map[string]string
+
+func (m mapCfg) GetCM(ctx context.Context, ns string, name string) (map[string]string, error) {
+	if d, f := m[ns+"/"+name]; f {
+		return d, nil
+	}
+	return map[string]string{}, nil
+}
+
+func (m mapCfg) GetSecret(ctx context.Context, ns string, name string) (map[string][]byte, error) {
+	return nil, nil
+}
+
+func TestFindMeshTenant(t *testing.T) {
+	kr := New()
+	kr.Cfg = mapCfg{
+		"istio-system/env-asm-managed-rapid": {"CLOUDRUN_ADDR": "rapid.a.run.app:443"},
+	}
+	kr.FindMeshTenant(context.Background())
+	if kr.MeshTenant != "rapid.a.run.app:443" {
+		t.Error("Expecting rapid channel tenant", kr.MeshTenant)
+	}
+
+	kr.MeshTenant = "-"
+	kr.FindMeshTenant(context.Background())
+	if kr.MeshTenant != "-" {
+		t.Error("Explicit MESH_TENANT should not be replaced", kr.MeshTenant)
+	}
+}
@@ -0,0 +1,55 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mesh
+
+import (
+	"context"
+	"testing"
+)
+
+func TestLoadMeshEnvOverrides(t *testing.T) {
+	cfg := mapCfg{
+		"istio-system/mesh-env":  {"XDS_ADDR": "istiod.example.com:15012", "CLUSTER_NAME": "mesh", "PROJECT_ID": "mesh-p"},
+		"fortio/mesh-env":        {"CLUSTER_NAME": "ns", "PROJECT_ID": "ns-p"},
+		"fortio/mesh-env-fortio": {"PROJECT_ID": "svc-p"},
+		"other/mesh-env-fortio":  {"PROJECT_ID": "other-p"},
+	}
+	for _, tc := range []struct {
+		ns, name         string
+		cluster, project string
+	}{
+		// The service override wins over the namespace, which wins over the mesh-wide defaults.
+		{"fortio", "fortio", "ns", "svc-p"},
+		{"fortio", "other", "ns", "ns-p"},
+		// Missing namespace config, service override only.
+		{"other", "fortio", "mesh", "other-p"},
+		// Mesh-wide only.
+		{"istio-system", "fortio", "mesh", "mesh-p"},
+		{"", "fortio", "mesh", "mesh-p"},
+	} {
+		kr := New()
+		kr.Cfg = cfg
+		kr.Namespace, kr.Name = tc.ns, tc.name
+		if err := kr.loadMeshEnv(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		if kr.ClusterName != tc.cluster || kr.ProjectId != tc.project || kr.XDSAddr != "istiod.example.com:15012" {
+			t.Error("Unexpected mesh-env", tc.ns, tc.name, kr.ClusterName, kr.ProjectId, kr.XDSAddr)
+		}
+	}
+	if d := cfg["istio-system/mesh-env"]; d["PROJECT_ID"] != "mesh-p" {
+		t.Error("Overrides changed the mesh-wide config", d)
+	}
+}
@@ -0,0 +1,198 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mesh
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Mesh state for the app.
+//
+// Before the app starts, krun writes the identity and mesh settings of the instance to MESH_INFO_FILE (default
+// /var/run/secrets/mesh/info.json, '-' to disable), and updates it when the tokens and certificates are refreshed.
+// The app env has MESH_INFO_FILE set to the location. With MESH_INFO_ADDR (a local address, like
+// 127.0.0.1:15083) the same document is served as /krun/info, with MESH_INFO_URL set in the app env. It is also
+// available on the debug port, as /debug/info.
+//
+// Apps can use it to adapt at runtime - for example use plaintext to mesh services if outbound traffic is
+// intercepted, set the SNI, or find the certificates for proxyless mTLS.
+
+// Interception modes, reported in MeshInfo.
+const (
+	InterceptionIptables = "iptables"
+	InterceptionWhitebox = "whitebox"
+	InterceptionRootless = "rootless"
+	InterceptionPending  = "pending"
+	InterceptionNone     = "none"
+)
+
+// MeshInfo is the mesh state exposed to the app.
+type MeshInfo struct {
+	TrustDomain    string `json:"trustDomain,omitempty"`
+	Namespace      string `json:"namespace,omitempty"`
+	Name           string `json:"name,omitempty"`
+	ServiceAccount string `json:"serviceAccount,omitempty"`
+	SpiffeID       string `json:"spiffeId,omitempty"`
+	Revision       string `json:"revision,omitempty"`
+	Network        string `json:"network,omitempty"`
+	XDSAddr        string `json:"xdsAddr,omitempty"`
+	MeshTenant     string `json:"meshTenant,omitempty"`
+
+	// CertDir holds the workload certificates saved by krun, for proxyless mTLS.
+	CertDir    string     `json:"certDir,omitempty"`
+	CertExpiry *time.Time `json:"certExpiry,omitempty"`
+
+	// Interception is how outbound traffic of the app reaches the mesh - see the Interception constants.
+	Interception string `json:"interception"`
+
+	// HTTPProxy is the proxy the app must use for mesh destinations, in whitebox and rootless mode.
+	HTTPProxy string `json:"httpProxy,omitempty"`
+
+	// ProxyReady is set once the proxy is ready.
+	ProxyReady bool `json:"proxyReady"`
+
+	Updated time.Time `json:"updated"`
+}
+
+// SpiffeID returns the identity of the workload.
+func (kr *KRun) SpiffeID() string {
+	if kr.TrustDomain == "" || kr.Namespace == "" || kr.KSA == "" {
+		return ""
+	}
+	return "spiffe://" + kr.TrustDomain + "/ns/" + kr.Namespace + "/sa/" + kr.KSA
+}
+
+// InterceptionMode returns how the outbound traffic of the app is sent to the mesh.
+func (kr *KRun) InterceptionMode() string {
+	switch {
+	case kr.Rootless():
+		return InterceptionRootless
+	case kr.EnvoyStartTime.IsZero() || kr.XDSAddr == "-":
+		return InterceptionNone
+	case kr.WhiteboxMode:
+		return InterceptionWhitebox
+	case kr.lazyIptablesEnv != nil:
+		return InterceptionPending
+	}
+	return InterceptionIptables
+}
+
+// MeshInfo returns the current mesh state. The cert expiry is read from Envoy if the agent manages the certificates.
+func (kr *KRun) MeshInfo(ctx context.Context) *MeshInfo {
+	mi := &MeshInfo{
+		TrustDomain:    kr.TrustDomain,
+		Namespace:      kr.Namespace,
+		Name:           kr.Name,
+		ServiceAccount: kr.KSA,
+		SpiffeID:       kr.SpiffeID(),
+		Revision:       kr.Rev,
+		Network:        kr.Network(),
+		XDSAddr:        kr.XDSAddr,
+		MeshTenant:     kr.MeshTenant,
+		Interception:   kr.InterceptionMode(),
+		ProxyReady:     !kr.EnvoyReadyTime.IsZero(),
+		Updated:        time.Now(),
+	}
+	switch mi.Interception {
+	case InterceptionWhitebox:
+		mi.HTTPProxy = "127.0.0.1:15007"
+	case InterceptionRootless:
+		mi.HTTPProxy = kr.Config("MESH_ROOTLESS_PROXY_ADDR", "127.0.0.1:15084")
+	}
+	if kp := kr.X509KeyPair; kp != nil && kp.Leaf != nil {
+		exp := kp.Leaf.NotAfter
+		mi.CertExpiry = &exp
+		if !kr.SkipSaveCerts {
+			mi.CertDir, _ = filepath.Abs(WorkloadCertDir)
+		}
+	} else if mi.ProxyReady {
+		if exp, err := envoyCertExpiry(ctx); err == nil {
+			mi.CertExpiry = &exp
+		}
+	}
+	return mi
+}
+
+func (kr *KRun) meshInfoFile() string {
+	return kr.Config("MESH_INFO_FILE", filepath.Join(kr.BaseDir, "/var/run/secrets/mesh/info.json"))
+}
+
+// StartMeshInfo writes the mesh info file and starts the local API, if enabled. Must be called before StartApp.
+func (kr *KRun) StartMeshInfo() error {
+	if addr := kr.Config("MESH_INFO_ADDR", ""); addr != "" {
+		l, err := net.Listen("tcp", addr)
+		if err != nil {
+			return err
+		}
+		mux := http.NewServeMux()
+		mux.HandleFunc("/krun/info", kr.handleMeshInfo)
+		go func() {
+			err := http.Serve(l, mux)
+			log.Println("Mesh info server closed", err)
+		}()
+		kr.meshInfoAddr = l.Addr().String()
+	}
+	kr.meshInfoStarted = true
+	return kr.WriteMeshInfo()
+}
+
+// WriteMeshInfo saves the current mesh info, readable by the app. The file is replaced atomically.
+func (kr *KRun) WriteMeshInfo() error {
+	f := kr.meshInfoFile()
+	if f == "-" || kr.DryRun {
+		return nil
+	}
+	ctx, cf := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cf()
+	data, err := json.MarshalIndent(kr.MeshInfo(ctx), "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(f), 0755); err != nil {
+		return err
+	}
+	tmp := f + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, f)
+}
+
+// meshInfoEnv returns the app env pointing to the mesh info.
+func (kr *KRun) meshInfoEnv() []string {
+	res := []string{}
+	if f := kr.meshInfoFile(); f != "-" {
+		res = append(res, "MESH_INFO_FILE="+f)
+	}
+	if kr.meshInfoAddr != "" {
+		res = append(res, "MESH_INFO_URL=http://"+kr.meshInfoAddr+"/krun/info")
+	}
+	return res
+}
+
+func (kr *KRun) handleMeshInfo(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("content-type", "application/json")
+	e := json.NewEncoder(w)
+	e.SetIndent("", "  ")
+	e.Encode(kr.MeshInfo(r.Context()))
+}
@@ -0,0 +1,71 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mesh
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMeshInfo(t *testing.T) {
+	f := filepath.Join(t.TempDir(), "mesh", "info.json")
+	os.Setenv("MESH_INFO_FILE", f)
+	defer os.Unsetenv("MESH_INFO_FILE")
+	os.Setenv("MESH_INFO_ADDR", "127.0.0.1:0")
+	defer os.Unsetenv("MESH_INFO_ADDR")
+
+	kr := New()
+	kr.TrustDomain = "example.svc.id.goog"
+	kr.Namespace = "ns"
+	kr.KSA = "default"
+	kr.WhiteboxMode = true
+	kr.EnvoyStartTime = time.Now()
+	if err := kr.StartMeshInfo(); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadFile(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mi := &MeshInfo{}
+	if err := json.Unmarshal(data, mi); err != nil {
+		t.Fatal(err)
+	}
+	if mi.SpiffeID != "spiffe://example.svc.id.goog/ns/ns/sa/default" || mi.Interception != InterceptionWhitebox ||
+		mi.HTTPProxy == "" {
+		t.Error("Unexpected info", string(data))
+	}
+
+	env := strings.Join(kr.meshInfoEnv(), " ")
+	if !strings.Contains(env, "MESH_INFO_FILE="+f) || !strings.Contains(env, "MESH_INFO_URL=") {
+		t.Error("Unexpected env", env)
+	}
+	res, err := http.Get("http://" + kr.meshInfoAddr + "/krun/info")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	mi = &MeshInfo{}
+	if err := json.NewDecoder(res.Body).Decode(mi); err != nil || mi.Namespace != "ns" {
+		t.Error("Unexpected response", mi, err)
+	}
+}
@@ -0,0 +1,194 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mesh
+
+import (
+	"errors"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// mesh-env schema.
+//
+// The mesh-env config map is written by the mesh connector and platform admins, and read by krun versions that
+// may be older or newer. MESH_ENV_VERSION identifies the schema - a missing version is 1, the format written by
+// the mesh connector. Older versions are migrated in memory on load:
+// - 1 to 2: MCON_ADDR and IMCON_ADDR are renamed MESH_CONNECTOR_ADDR and MESH_CONNECTOR_INTERNAL_ADDR.
+//
+// After migration the keys are validated:
+// - at least one key from each required group must be set - krun needs a way to find the control plane.
+// - keys that are not in the schema, not a known setting and don't have a setting prefix are reported as unknown -
+// usually a typo or a key renamed in a newer schema.
+// - a version newer than MeshEnvVersion is reported, the known keys are still used.
+//
+// Problems are logged and saved in MeshEnvIssues (also in /debug/status). With MESH_ENV_STRICT=true loading
+// the mesh-env fails instead.
+
+// MeshEnvVersion is the current mesh-env schema version.
+const MeshEnvVersion = 2
+
+// MeshEnvKey describes a mesh-env key.
+type MeshEnvKey struct {
+	Name string
+
+	// Prefix is set for key families, like PORT_name.
+	Prefix bool
+
+	Doc string
+}
+
+// MeshEnvKeys is the current mesh-env schema. Any setting from ConfigKeys can also be set in mesh-env.
+var MeshEnvKeys = []*MeshEnvKey{
+	{Name: "MESH_ENV_VERSION", Doc: "Schema version, missing is 1"},
+	{Name: "PROJECT_ID", Doc: "Project of the config cluster"},
+	{Name: "PROJECT_NUMBER", Doc: "Project number, used in the mesh ID"},
+	{Name: "CLUSTER_NAME", Doc: "Name of the config cluster"},
+	{Name: "CLUSTER_LOCATION", Doc: "Location of the config cluster"},
+	{Name: "MESH_TENANT", Doc: "Managed control plane tenant, '-' for in-cluster"},
+	{Name: "XDS_ADDR", Doc: "Explicit XDS address"},
+	{Name: "MESH_CONNECTOR_ADDR", Doc: "External address of the mesh connector"},
+	{Name: "MESH_CONNECTOR_INTERNAL_ADDR", Doc: "Internal (ILB) address of the mesh connector"},
+	{Name: "CA_POOL", Doc: "CAS pool for workload certificates"},
+	{Name: "CAROOT_", Prefix: true, Doc: "Root certificates - CAROOT_ISTIOD, CAROOT_CAS"},
+	{Name: "EW_GATEWAY_URL", Doc: "URL of the CloudRun east-west gateway"},
+	{Name: "NETWORK", Doc: "Default Istio network"},
+	{Name: "NETWORK_GATEWAYS", Doc: "East-west gateway for each network"},
+	{Name: "CLOUDRUN_URL_SUFFIX", Doc: "Project and region specific suffix of the CloudRun URLs"},
+	{Name: "PORT_", Prefix: true, Doc: "Named app ports"},
+	{Name: "APP_ENV_", Prefix: true, Doc: "Env variables for the app"},
+}
+
+// meshEnvRequired holds groups of keys - at least one key from each group must be set.
+var meshEnvRequired = [][]string{
+	{"MESH_TENANT", "XDS_ADDR", "MESH_CONNECTOR_ADDR", "MESH_CONNECTOR_INTERNAL_ADDR"},
+}
+
+// meshEnvMigrations converts the mesh-env from version N to N+1, in place.
+var meshEnvMigrations = map[int]func(d map[string]string){
+	1: func(d map[string]string) {
+		renameMeshEnvKey(d, "MCON_ADDR", "MESH_CONNECTOR_ADDR")
+		renameMeshEnvKey(d, "IMCON_ADDR", "MESH_CONNECTOR_INTERNAL_ADDR")
+	},
+}
+
+func renameMeshEnvKey(d map[string]string, from, to string) {
+	if v, f := d[from]; f {
+		if d[to] == "" {
+			d[to] = v
+		}
+		delete(d, from)
+	}
+}
+
+// meshEnvVersion returns the schema version of the mesh-env.
+func meshEnvVersion(d map[string]string) (int, error) {
+	v := d["MESH_ENV_VERSION"]
+	if v == "" {
+		return 1, nil
+	}
+	n, err := strconv.Atoi(strings.TrimPrefix(v, "v"))
+	if err != nil || n < 1 {
+		return 0, errors.New("invalid MESH_ENV_VERSION " + v)
+	}
+	return n, nil
+}
+
+// MigrateMeshEnv converts the mesh-env to the current schema, in place. Returns the original version.
+// Newer versions are not changed.
+func MigrateMeshEnv(d map[string]string) (int, error) {
+	from, err := meshEnvVersion(d)
+	if err != nil {
+		return 0, err
+	}
+	for v := from; v < MeshEnvVersion; v++ {
+		if m := meshEnvMigrations[v]; m != nil {
+			m(d)
+		}
+	}
+	if from < MeshEnvVersion {
+		d["MESH_ENV_VERSION"] = strconv.Itoa(MeshEnvVersion)
+	}
+	return from, nil
+}
+
+// ValidateMeshEnv returns the problems found in a migrated mesh-env, sorted.
+func ValidateMeshEnv(d map[string]string) []string {
+	res := []string{}
+	if v, err := meshEnvVersion(d); err != nil {
+		res = append(res, err.Error())
+	} else if v > MeshEnvVersion {
+		res = append(res, "newer MESH_ENV_VERSION "+strconv.Itoa(v)+", supported "+strconv.Itoa(MeshEnvVersion))
+	}
+	for _, g := range meshEnvRequired {
+		found := false
+		for _, k := range g {
+			if d[k] != "" {
+				found = true
+				break
+			}
+		}
+		if !found {
+			res = append(res, "missing one of "+strings.Join(g, ","))
+		}
+	}
+	for k := range d {
+		if localConfig(k) {
+			res = append(res, "local setting ignored "+k)
+		} else if !knownMeshEnvKey(k) {
+			res = append(res, "unknown key "+k)
+		}
+	}
+	sort.Strings(res)
+	return res
+}
+
+func knownMeshEnvKey(k string) bool {
+	for _, mk := range MeshEnvKeys {
+		if k == mk.Name || mk.Prefix && strings.HasPrefix(k, mk.Name) {
+			return true
+		}
+	}
+	for _, ck := range ConfigKeys {
+		if k == ck.Name {
+			return true
+		}
+	}
+	for _, p := range meshEnvPrefixes {
+		if strings.HasPrefix(k, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkMeshEnv migrates and validates the mesh-env. Returns an error only with MESH_ENV_STRICT=true.
+func (kr *KRun) checkMeshEnv(d map[string]string) error {
+	from, err := MigrateMeshEnv(d)
+	issues := ValidateMeshEnv(d)
+	if err == nil && from < MeshEnvVersion {
+		log.Println("Migrated mesh-env", "from", from, "to", MeshEnvVersion)
+	}
+	kr.MeshEnvIssues = issues
+	if len(issues) == 0 {
+		return nil
+	}
+	log.Println("mesh-env problems", "issues", issues)
+	if kr.Config("MESH_ENV_STRICT", "") == "true" {
+		return errors.New("invalid mesh-env: " + strings.Join(issues, "; "))
+	}
+	return nil
+}
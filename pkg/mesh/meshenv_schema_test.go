@@ -0,0 +1,81 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mesh
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestMeshEnvMigrate(t *testing.T) {
+	d := map[string]string{
+		"PROJECT_ID": "p1",
+		"MCON_ADDR":  "34.1.2.3",
+		"IMCON_ADDR": "10.1.2.3",
+	}
+	from, err := MigrateMeshEnv(d)
+	if err != nil || from != 1 {
+		t.Fatal("Unexpected version", from, err)
+	}
+	if d["MESH_CONNECTOR_ADDR"] != "34.1.2.3" || d["MESH_CONNECTOR_INTERNAL_ADDR"] != "10.1.2.3" || d["MCON_ADDR"] != "" ||
+		d["MESH_ENV_VERSION"] != "2" {
+		t.Error("Unexpected migration", d)
+	}
+	if issues := ValidateMeshEnv(d); len(issues) != 0 {
+		t.Error("Unexpected issues", issues)
+	}
+
+	kr := New()
+	if err := kr.initFromMeshEnv(map[string]string{"IMCON_ADDR": "10.1.2.3"}); err != nil {
+		t.Fatal(err)
+	}
+	if kr.MeshConnectorInternalAddr != "10.1.2.3" {
+		t.Error("Expecting v1 mesh-env to be supported", kr.MeshConnectorInternalAddr)
+	}
+}
+
+func TestMeshEnvValidate(t *testing.T) {
+	d := map[string]string{
+		"MESH_ENV_VERSION": "3",
+		"PROJECT_ID":       "p1",
+		"PORT_grpc":        "9090",
+		"CAROOT_ISTIOD":    "pem",
+		"MESH_DEBUG":       "true",
+		"PROJET_NUMBER":    "123",
+	}
+	if _, err := MigrateMeshEnv(d); err != nil {
+		t.Fatal(err)
+	}
+	issues := ValidateMeshEnv(d)
+	if len(issues) != 3 || !strings.HasPrefix(issues[0], "missing one of MESH_TENANT") ||
+		issues[1] != "newer MESH_ENV_VERSION 3, supported 2" || issues[2] != "unknown key PROJET_NUMBER" {
+		t.Error("Unexpected issues", issues)
+	}
+
+	kr := New()
+	if err := kr.initFromMeshEnv(d); err != nil || len(kr.MeshEnvIssues) != 3 {
+		t.Error("Expecting issues to be reported", err, kr.MeshEnvIssues)
+	}
+	os.Setenv("MESH_ENV_STRICT", "true")
+	defer os.Unsetenv("MESH_ENV_STRICT")
+	if err := kr.initFromMeshEnv(d); err == nil {
+		t.Error("Expecting strict mode to fail")
+	}
+
+	if _, err := MigrateMeshEnv(map[string]string{"MESH_ENV_VERSION": "x"}); err == nil {
+		t.Error("Expecting invalid version")
+	}
+}
@@ -0,0 +1,157 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mesh
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Proxy metadata.
+//
+// krun computes the ISTIO_META_ settings for the agent - cluster, mesh ID, labels, etc. Additional metadata (platform,
+// network, locality labels) can be set with:
+// - ISTIO_META_NAME=value or ISTIO_METAJSON_NAME=json, in env or mesh-env.
+// - 'metadata' map in krun.yaml. String values set ISTIO_META_NAME, maps and lists ISTIO_METAJSON_NAME.
+// - MESH_METADATA=NAME=value,NAME2={"a":"b"} - values starting with '{' or '[' are JSON.
+//
+// The explicit metadata replaces the computed values. Env has the highest priority, followed by MESH_METADATA,
+// krun.yaml and mesh-env. Names are upper case (A-Z, 0-9 and _). LABELS and ANNOTATIONS are computed from
+// MESH_LABELS and MESH_ANNOTATIONS and can't be set.
+
+var metaNameRE = regexp.MustCompile(`^[A-Z][A-Z0-9_]*$`)
+
+var reservedMeta = []string{"LABELS", "ANNOTATIONS"}
+
+const (
+	metaPrefix     = "ISTIO_META_"
+	metaJSONPrefix = "ISTIO_METAJSON_"
+)
+
+// ProxyMetadata returns the explicitly configured metadata. Values are strings, or the decoded JSON.
+func (kr *KRun) ProxyMetadata() map[string]interface{} {
+	res := map[string]interface{}{}
+	add := func(source string, vals map[string]interface{}) {
+		for k, v := range vals {
+			if err := validMetaName(k); err != nil {
+				log.Println("Invalid metadata", "source", source, "err", err)
+				continue
+			}
+			res[k] = v
+		}
+	}
+	add("mesh-env", metaFromEnv(kr.MeshEnv))
+	add("krun.yaml", kr.Metadata)
+	m, err := parseMetadata(kr.Config("MESH_METADATA", ""))
+	if err != nil {
+		log.Println("Invalid MESH_METADATA", err)
+	}
+	add("MESH_METADATA", m)
+	env := map[string]string{}
+	for _, e := range os.Environ() {
+		kv := strings.SplitN(e, "=", 2)
+		env[kv[0]] = kv[1]
+	}
+	add("env", metaFromEnv(env))
+	return res
+}
+
+func validMetaName(n string) error {
+	if !metaNameRE.MatchString(n) {
+		return fmt.Errorf("%s: name must be upper case letters, digits and _", n)
+	}
+	if contains(reservedMeta, n) {
+		return fmt.Errorf("%s: computed by krun, use MESH_%s", n, n)
+	}
+	return nil
+}
+
+// metaFromEnv returns the ISTIO_META_ and ISTIO_METAJSON_ settings in a set of variables.
+func metaFromEnv(env map[string]string) map[string]interface{} {
+	res := map[string]interface{}{}
+	for k, v := range env {
+		switch {
+		case strings.HasPrefix(k, metaJSONPrefix):
+			var j interface{}
+			if err := json.Unmarshal([]byte(v), &j); err != nil {
+				log.Println("Invalid metadata JSON", k, err)
+				continue
+			}
+			res[strings.TrimPrefix(k, metaJSONPrefix)] = j
+		case strings.HasPrefix(k, metaPrefix):
+			res[strings.TrimPrefix(k, metaPrefix)] = v
+		}
+	}
+	return res
+}
+
+// parseMetadata parses the MESH_METADATA list of NAME=value.
+func parseMetadata(s string) (map[string]interface{}, error) {
+	res := map[string]interface{}{}
+	for k, v := range parseAnnotations(s) {
+		if strings.HasPrefix(v, "{") || strings.HasPrefix(v, "[") {
+			var j interface{}
+			if err := json.Unmarshal([]byte(v), &j); err != nil {
+				return res, fmt.Errorf("%s: invalid JSON: %v", k, err)
+			}
+			res[k] = j
+			continue
+		}
+		res[k] = v
+	}
+	return res, nil
+}
+
+// metadataEnv sets the explicit metadata in the agent env, replacing the computed values.
+func (kr *KRun) metadataEnv(env []string) []string {
+	meta := kr.ProxyMetadata()
+	if len(meta) == 0 {
+		return env
+	}
+	res := make([]string, 0, len(env)+len(meta))
+	for _, e := range env {
+		k := strings.SplitN(e, "=", 2)[0]
+		if _, f := meta[strings.TrimPrefix(k, metaPrefix)]; f && strings.HasPrefix(k, metaPrefix) {
+			continue
+		}
+		if _, f := meta[strings.TrimPrefix(k, metaJSONPrefix)]; f && strings.HasPrefix(k, metaJSONPrefix) {
+			continue
+		}
+		res = append(res, e)
+	}
+	names := make([]string, 0, len(meta))
+	for k := range meta {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	for _, k := range names {
+		if s, ok := meta[k].(string); ok {
+			res = append(res, metaPrefix+k+"="+s)
+			continue
+		}
+		data, err := json.Marshal(meta[k])
+		if err != nil {
+			log.Println("Invalid metadata", k, err)
+			continue
+		}
+		res = append(res, metaJSONPrefix+k+"="+string(data))
+	}
+	return res
+}
@@ -0,0 +1,306 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mesh
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Metadata server proxy for the app.
+//
+// Apps and client libraries expecting GCE-style metadata use GCE_METADATA_HOST or 169.254.169.254. With
+// MESH_METADATA_PROXY=true krun serves the metadata API on MESH_METADATA_ADDR (default 127.0.0.1:15082) and sets
+// GCE_METADATA_HOST for the app. With MESH_METADATA_PROXY=intercept, connections to 169.254.169.254:80 are also
+// redirected using iptables - this requires root.
+//
+// The proxy:
+// - returns tokens from MetadataTokenProvider for the default service account, if set - for example for a GSA
+//   different from the one running the CloudRun service (METADATA_GSA). The 'scopes' parameter is ignored: the
+//   provider returns cloud-platform access tokens, which cover all the GCP APIs.
+// - adds the mesh namespace, name, KSA and labels as instance attributes, with MESH_METADATA_ATTRIBUTES for
+//   additional k=v pairs.
+// - forwards all other requests to the real metadata server.
+//
+// Requests from krun itself (for example the GCP client libraries used for the mesh config) are passed to the real
+// server unchanged: they are not redirected if marked or running as uid 1337, and connections owned by krun are
+// detected when intercepted.
+
+const metadataServer = "169.254.169.254"
+
+// Access tokens don't carry an expiration - GCP access tokens are valid for 1h.
+const metadataTokenLifetime = 1 * time.Hour
+
+// Cached tokens are refreshed before expiring, so clients don't get a token that expires while in use.
+const metadataTokenMargin = 5 * time.Minute
+
+// StartMetadataProxy starts the metadata proxy, if enabled. Must be called before StartApp.
+func (kr *KRun) StartMetadataProxy() error {
+	mode := kr.Config("MESH_METADATA_PROXY", "")
+	if mode == "" && kr.metadataUpstream != nil {
+		mode = "true"
+	}
+	if mode == "" || mode == "false" {
+		return nil
+	}
+	addr := kr.Config("MESH_METADATA_ADDR", "127.0.0.1:15082")
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	upstream := os.Getenv("GCE_METADATA_HOST")
+	if upstream == "" {
+		upstream = metadataServer
+	}
+	var up http.Handler
+	if kr.metadataUpstream != nil {
+		up = kr.metadataUpstream
+		upstream = "local"
+	} else {
+		rp := httputil.NewSingleHostReverseProxy(&url.URL{Scheme: "http", Host: upstream})
+		// Must not be redirected back to the proxy when intercepting.
+		rp.Transport = &http.Transport{DialContext: markedDialer(egressMark).DialContext}
+		up = rp
+	}
+
+	attrs := kr.metadataAttributes()
+	s := &http.Server{
+		Handler:     kr.metadataHandler(attrs, up),
+		ConnContext: metadataConnContext,
+	}
+	go func() {
+		err := s.Serve(l)
+		log.Println("Metadata proxy closed", err)
+	}()
+	kr.metadataAddr = l.Addr().String()
+
+	if mode == "intercept" {
+		if os.Getuid() != 0 {
+			return errors.New("metadata intercept requires root")
+		}
+		_, port, _ := net.SplitHostPort(kr.metadataAddr)
+		err = metadataChain(port).install()
+		if err != nil {
+			return err
+		}
+	}
+	log.Println("Metadata proxy enabled", "addr", kr.metadataAddr, "mode", mode, "upstream", upstream)
+	return nil
+}
+
+func metadataChain(port string) *iptablesChain {
+	return &iptablesChain{
+		Cmd:    "iptables",
+		Table:  "nat",
+		Name:   "KRUN_METADATA",
+		Parent: "OUTPUT",
+		Match:  []string{"-d", metadataServer + "/32", "-p", "tcp", "--dport", "80"},
+		Rules: [][]string{
+			{"-m", "mark", "--mark", strconv.Itoa(egressMark), "-j", "RETURN"},
+			{"-m", "owner", "--uid-owner", "1337", "-j", "RETURN"},
+			{"-p", "tcp", "-j", "REDIRECT", "--to-ports", port},
+		},
+	}
+}
+
+type metadataConnKey struct{}
+
+// metadataConnContext records the accepted connection, to detect requests made by krun.
+func metadataConnContext(ctx context.Context, c net.Conn) context.Context {
+	return context.WithValue(ctx, metadataConnKey{}, c)
+}
+
+// fromKRun returns true if the request was made by krun and captured by the intercept rules.
+func fromKRun(r *http.Request) bool {
+	c, ok := r.Context().Value(metadataConnKey{}).(net.Conn)
+	return ok && ownConn(c)
+}
+
+// metadataTokens caches the tokens returned by the proxy, by audience - "" for access tokens. Tokens are returned
+// until metadataTokenMargin before they expire.
+type metadataTokens struct {
+	m      sync.Mutex
+	tokens map[string]*metadataToken
+}
+
+type metadataToken struct {
+	token  string
+	expiry time.Time
+}
+
+func (mt *metadataTokens) get(ctx context.Context, tp TokenProvider, aud string, now time.Time) (*metadataToken, error) {
+	mt.m.Lock()
+	t := mt.tokens[aud]
+	mt.m.Unlock()
+	if t != nil && now.Add(metadataTokenMargin).Before(t.expiry) {
+		return t, nil
+	}
+
+	s, err := tp.GetToken(ctx, aud)
+	if err != nil {
+		return nil, err
+	}
+	t = &metadataToken{token: s, expiry: tokenExpiry(s, now)}
+	mt.m.Lock()
+	if mt.tokens == nil {
+		mt.tokens = map[string]*metadataToken{}
+	}
+	mt.tokens[aud] = t
+	mt.m.Unlock()
+	return t, nil
+}
+
+// tokenExpiry returns the 'exp' claim for JWTs, or the default access token lifetime.
+func tokenExpiry(token string, now time.Time) time.Time {
+	if p := strings.Split(token, "."); len(p) == 3 {
+		claims := &JWTClaims{}
+		if decodeJWTPart(p[1], claims) == nil && claims.Exp > 0 {
+			return time.Unix(claims.Exp, 0)
+		}
+	}
+	return now.Add(metadataTokenLifetime)
+}
+
+// metadataAttributes returns the custom attributes added to the instance attributes.
+func (kr *KRun) metadataAttributes() map[string]string {
+	attrs := map[string]string{
+		"mesh-namespace": kr.Namespace,
+		"mesh-name":      kr.Name,
+		"mesh-ksa":       kr.KSA,
+	}
+	for k, v := range kr.Labels {
+		attrs[k] = v
+	}
+	for _, kv := range splitList(kr.Config("MESH_METADATA_ATTRIBUTES", "")) {
+		p := strings.SplitN(kv, "=", 2)
+		if len(p) == 2 {
+			attrs[p[0]] = p[1]
+		}
+	}
+	for k, v := range attrs {
+		if v == "" {
+			delete(attrs, k)
+		}
+	}
+	return attrs
+}
+
+func (kr *KRun) metadataHandler(attrs map[string]string, upstream http.Handler) http.Handler {
+	const saPrefix = "/computeMetadata/v1/instance/service-accounts/default/"
+	const attrPrefix = "/computeMetadata/v1/instance/attributes/"
+	tokens := &metadataTokens{}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if fromKRun(r) {
+			upstream.ServeHTTP(w, r)
+			return
+		}
+		if strings.HasPrefix(r.URL.Path, "/computeMetadata/") && r.Header.Get("Metadata-Flavor") != "Google" {
+			http.Error(w, "Missing Metadata-Flavor:Google header", http.StatusForbidden)
+			return
+		}
+		p := r.URL.Path
+		switch {
+		case kr.MetadataTokenProvider != nil && p == saPrefix+"token":
+			now := time.Now()
+			t, err := tokens.get(r.Context(), kr.MetadataTokenProvider, "", now)
+			if err != nil {
+				log.Println("Metadata proxy token error", err)
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("content-type", "application/json")
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"access_token": t.token,
+				// Clients refresh before the cached token is replaced.
+				"expires_in": int(t.expiry.Sub(now).Seconds()),
+				"token_type": "Bearer",
+			})
+			return
+		case kr.MetadataTokenProvider != nil && p == saPrefix+"identity":
+			aud := r.FormValue("audience")
+			if aud == "" {
+				http.Error(w, "missing audience", http.StatusBadRequest)
+				return
+			}
+			t, err := tokens.get(r.Context(), kr.MetadataTokenProvider, aud, time.Now())
+			if err != nil {
+				log.Println("Metadata proxy identity error", aud, err)
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("content-type", "application/text")
+			w.Write([]byte(t.token))
+			return
+		case p == attrPrefix && r.FormValue("recursive") != "true":
+			// Merge the keys with the real attributes, if available.
+			keys := map[string]bool{}
+			for k := range attrs {
+				keys[k] = true
+			}
+			rw := &bufferedResponse{header: http.Header{}}
+			upstream.ServeHTTP(rw, r)
+			if rw.code == 0 || rw.code == 200 {
+				for _, k := range strings.Split(rw.body.String(), "\n") {
+					if k != "" {
+						keys[k] = true
+					}
+				}
+			}
+			res := []string{}
+			for k := range keys {
+				res = append(res, k)
+			}
+			sort.Strings(res)
+			w.Header().Set("content-type", "application/text")
+			w.Write([]byte(strings.Join(res, "\n") + "\n"))
+			return
+		case strings.HasPrefix(p, attrPrefix):
+			if v, f := attrs[p[len(attrPrefix):]]; f {
+				w.Header().Set("content-type", "application/text")
+				w.Write([]byte(v))
+				return
+			}
+		}
+		w.Header().Set("Metadata-Flavor", "Google")
+		upstream.ServeHTTP(w, r)
+	})
+}
+
+// bufferedResponse captures the upstream response, for merging.
+type bufferedResponse struct {
+	header http.Header
+	code   int
+	body   bytes.Buffer
+}
+
+func (b *bufferedResponse) Header() http.Header { return b.header }
+
+func (b *bufferedResponse) WriteHeader(code int) { b.code = code }
+
+func (b *bufferedResponse) Write(p []byte) (int, error) { return b.body.Write(p) }
@@ -0,0 +1,166 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mesh
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+type staticTokens struct{}
+
+func (staticTokens) GetToken(ctx context.Context, aud string) (string, error) {
+	if aud == "" {
+		return "access", nil
+	}
+	return "id-" + aud, nil
+}
+
+func TestMetadataProxy(t *testing.T) {
+	upstream := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/computeMetadata/v1/instance/attributes/" {
+			w.Write([]byte("cluster-name\n"))
+			return
+		}
+		w.Write([]byte("upstream"))
+	})
+	kr := New()
+	kr.Namespace = "fortio"
+	kr.MetadataTokenProvider = staticTokens{}
+	s := httptest.NewServer(kr.metadataHandler(kr.metadataAttributes(), upstream))
+	defer s.Close()
+
+	get := func(path string) (int, string) {
+		req, _ := http.NewRequest("GET", s.URL+path, nil)
+		req.Header.Set("Metadata-Flavor", "Google")
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		body, _ := ioutil.ReadAll(res.Body)
+		return res.StatusCode, string(body)
+	}
+
+	if _, b := get("/computeMetadata/v1/instance/attributes/mesh-namespace"); b != "fortio" {
+		t.Error("Unexpected namespace", b)
+	}
+	if _, b := get("/computeMetadata/v1/instance/attributes/"); b != "cluster-name\nmesh-ksa\nmesh-namespace\n" {
+		t.Error("Unexpected attributes", b)
+	}
+	if _, b := get("/computeMetadata/v1/instance/service-accounts/default/identity?audience=a"); b != "id-a" {
+		t.Error("Unexpected identity", b)
+	}
+	// Scopes are ignored, the access token covers all APIs.
+	for _, q := range []string{"", "?scopes=https://www.googleapis.com/auth/devstorage.read_only"} {
+		if _, b := get("/computeMetadata/v1/instance/service-accounts/default/token" + q); !strings.Contains(b, `"access_token":"access"`) {
+			t.Error("Unexpected access token", q, b)
+		}
+	}
+	if _, b := get("/computeMetadata/v1/instance/zone"); b != "upstream" {
+		t.Error("Expecting upstream", b)
+	}
+	res, err := http.Get(s.URL + "/computeMetadata/v1/instance/zone")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusForbidden {
+		t.Error("Expecting 403 without Metadata-Flavor", res.StatusCode)
+	}
+}
+
+type countingTokens struct {
+	calls int
+	exp   int64
+}
+
+func (c *countingTokens) GetToken(ctx context.Context, aud string) (string, error) {
+	c.calls++
+	if aud == "" {
+		return "access" + strconv.Itoa(c.calls), nil
+	}
+	payload := base64.RawURLEncoding.EncodeToString([]byte(`{"exp":` + strconv.FormatInt(c.exp, 10) + `}`))
+	return "e30." + payload + ".sig", nil
+}
+
+func TestMetadataTokenCache(t *testing.T) {
+	now := time.Unix(1600000000, 0)
+	tp := &countingTokens{exp: now.Add(10 * time.Minute).Unix()}
+	mt := &metadataTokens{}
+	ctx := context.Background()
+
+	t1, _ := mt.get(ctx, tp, "", now)
+	if t1.expiry != now.Add(metadataTokenLifetime) {
+		t.Error("Unexpected access token expiry", t1.expiry)
+	}
+	t2, _ := mt.get(ctx, tp, "", now.Add(30*time.Minute))
+	if t2.token != t1.token || tp.calls != 1 {
+		t.Error("Expecting cached token", t2.token, tp.calls)
+	}
+	if t4, _ := mt.get(ctx, tp, "", now.Add(metadataTokenLifetime-metadataTokenMargin)); t4.token == t1.token {
+		t.Error("Expecting refresh before expiry", t4.token)
+	}
+
+	calls := tp.calls
+	id, _ := mt.get(ctx, tp, "a", now)
+	if id.expiry != now.Add(10*time.Minute) {
+		t.Error("Expecting JWT expiry", id.expiry)
+	}
+	mt.get(ctx, tp, "a", now.Add(4*time.Minute))
+	if tp.calls != calls+1 {
+		t.Error("Expecting cached identity token", tp.calls)
+	}
+	mt.get(ctx, tp, "a", now.Add(6*time.Minute))
+	if tp.calls != calls+2 {
+		t.Error("Expecting refreshed identity token", tp.calls)
+	}
+}
+
+func TestMetadataChain(t *testing.T) {
+	defer func(f func(string, ...string) ([]byte, error)) { iptablesRun = f }(iptablesRun)
+	var cmds []string
+	iptablesRun = func(cmd string, args ...string) ([]byte, error) {
+		l := cmd + " " + strings.Join(args, " ")
+		cmds = append(cmds, l)
+		if strings.Contains(l, " -C ") {
+			return nil, errors.New("missing")
+		}
+		return nil, nil
+	}
+	if err := metadataChain("15082").install(); err != nil {
+		t.Fatal(err)
+	}
+	all := strings.Join(cmds, "\n")
+	if strings.Contains(all, "-N KRUN_METADATA") || !strings.Contains(all, "-F KRUN_METADATA") {
+		t.Error("Expecting existing chain to be flushed", all)
+	}
+	for _, r := range []string{
+		"-A KRUN_METADATA -m owner --uid-owner 1337 -j RETURN",
+		"-I OUTPUT 1 -d 169.254.169.254/32 -p tcp --dport 80 -j KRUN_METADATA",
+	} {
+		if !strings.Contains(all, r) {
+			t.Error("Missing rule", r, all)
+		}
+	}
+}
@@ -0,0 +1,64 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mesh
+
+import (
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestProxyMetadata(t *testing.T) {
+	kr := New()
+	kr.MeshEnv = map[string]string{
+		"ISTIO_META_NETWORK":       "mesh-env-net",
+		"ISTIO_META_PLATFORM":      "cloudrun",
+		"ISTIO_METAJSON_PLATFORMS": `{"gcp": {"project": "p1"}}`,
+	}
+	kr.Metadata = map[string]interface{}{"NETWORK": "file-net", "REGION": "us-central1", "bad-name": "x"}
+	os.Setenv("MESH_METADATA", `REGION=us-east1,LOCALITY_LABELS={"zone":"a","region":"b"},LABELS=x`)
+	defer os.Unsetenv("MESH_METADATA")
+	os.Setenv("ISTIO_META_PLATFORM", "env")
+	defer os.Unsetenv("ISTIO_META_PLATFORM")
+
+	m := kr.ProxyMetadata()
+	if m["NETWORK"] != "file-net" || m["REGION"] != "us-east1" || m["PLATFORM"] != "env" {
+		t.Error("Unexpected priority", m)
+	}
+	if _, f := m["bad-name"]; f {
+		t.Error("Invalid name not rejected")
+	}
+	if _, f := m["LABELS"]; f {
+		t.Error("Reserved name not rejected")
+	}
+	if !reflect.DeepEqual(m["LOCALITY_LABELS"], map[string]interface{}{"zone": "a", "region": "b"}) {
+		t.Error("Unexpected JSON value", m["LOCALITY_LABELS"])
+	}
+
+	env := kr.metadataEnv([]string{"A=b", "ISTIO_META_NETWORK=computed", "ISTIO_META_CLUSTER_ID=c1"})
+	exp := []string{"A=b", "ISTIO_META_CLUSTER_ID=c1",
+		`ISTIO_METAJSON_LOCALITY_LABELS={"region":"b","zone":"a"}`,
+		"ISTIO_META_NETWORK=file-net",
+		"ISTIO_META_PLATFORM=env",
+		`ISTIO_METAJSON_PLATFORMS={"gcp":{"project":"p1"}}`,
+		"ISTIO_META_REGION=us-east1"}
+	if !reflect.DeepEqual(env, exp) {
+		t.Error("Unexpected env", env)
+	}
+
+	if _, err := parseMetadata(`A={"x":`); err == nil {
+		t.Error("Expecting invalid JSON error")
+	}
+}
@@ -0,0 +1,45 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mesh
+
+import (
+	"context"
+	"time"
+)
+
+// Metric is a single data point exported by krun. The vendor implementation maps the name to a metric type
+// and adds the resource labels for the instance.
+type Metric struct {
+	// Name of the metric, for example "krun/startup_latencies". Vendor specific prefix will be added.
+	Name string
+
+	Labels map[string]string
+
+	Value float64
+
+	// Counter is set for cumulative values - the interval will start at Start, or KRun.StartTime if not set.
+	Counter bool
+
+	// Start of the cumulative interval, for counters that reset when a child process restarts.
+	Start time.Time
+
+	// Time of the measurement. If zero, the current time is used.
+	Time time.Time
+}
+
+// MetricWriter abstracts the monitoring system.
+type MetricWriter interface {
+	WriteMetrics(ctx context.Context, metrics []Metric) error
+}
@@ -0,0 +1,233 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mesh
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Prometheus metrics merge.
+//
+// Like the injected istio-agent, krun serves /stats/prometheus on :15020 with the Envoy stats, the app metrics
+// and its own metrics in a single response, so existing scrape configs and sidecar-style collectors work
+// without changes. Enabled with MESH_METRICS_MERGE=true.
+//
+// Since krun takes the port, the generated PROXY_CONFIG moves the pilot-agent status port to 15026 - Envoy
+// health checks on 15021 are not affected. If PROXY_CONFIG is injected it must set a different statusPort,
+// or MESH_METRICS_ADDR must use a different port.
+//
+// The app is scraped if the prometheus.io/scrape annotation is "true", using prometheus.io/port (default
+// PORT_http) and prometheus.io/path (default /metrics) - the same annotations used by the injector.
+// MESH_APP_METRICS can be set to the full URL instead.
+
+const (
+	annoPromScrape = "prometheus.io/scrape"
+	annoPromPort   = "prometheus.io/port"
+	annoPromPath   = "prometheus.io/path"
+
+	// defaultAgentStatusPort is the pilot-agent status port. mergeAgentStatusPort is used when krun
+	// serves the merged metrics on the default port.
+	defaultAgentStatusPort = 15020
+	mergeAgentStatusPort   = 15026
+)
+
+// metricsEnvoyURL is the Envoy Prometheus endpoint.
+var metricsEnvoyURL = statsURL
+
+const promContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+var promLabelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// metricsMergeAddr returns the address for the merged metrics, or empty if disabled.
+func (kr *KRun) metricsMergeAddr() string {
+	if kr.Config("MESH_METRICS_MERGE", "") != "true" {
+		return ""
+	}
+	return kr.Config("MESH_METRICS_ADDR", ":"+strconv.Itoa(defaultAgentStatusPort))
+}
+
+// agentStatusPort returns the status port for the generated PROXY_CONFIG - moved if the metrics merge
+// takes the default port.
+func (kr *KRun) agentStatusPort() int {
+	addr := kr.metricsMergeAddr()
+	if addr == "" {
+		return defaultAgentStatusPort
+	}
+	if _, p, err := net.SplitHostPort(addr); err == nil && p == strconv.Itoa(defaultAgentStatusPort) {
+		return mergeAgentStatusPort
+	}
+	return defaultAgentStatusPort
+}
+
+// appMetricsURL returns the URL of the app metrics, or empty if the app is not scraped.
+func (kr *KRun) appMetricsURL() string {
+	if u := kr.Config("MESH_APP_METRICS", ""); u != "" {
+		return u
+	}
+	if kr.annotation(annoPromScrape, "") != "true" {
+		return ""
+	}
+	port := kr.annotation(annoPromPort, kr.Config("PORT_http", "8080"))
+	path := kr.annotation(annoPromPath, "/metrics")
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	return "http://127.0.0.1:" + port + path
+}
+
+// StartMetricsMerge serves the merged metrics, if MESH_METRICS_MERGE is enabled. Must be called before the
+// agent is started, so the port is not taken.
+func (kr *KRun) StartMetricsMerge() error {
+	addr := kr.metricsMergeAddr()
+	if addr == "" {
+		return nil
+	}
+	if kr.agentStatusPort() == mergeAgentStatusPort && os.Getenv("PROXY_CONFIG") != "" {
+		return errors.New("injected PROXY_CONFIG uses the metrics port, set statusPort and MESH_METRICS_ADDR")
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/stats/prometheus", kr.handleMergedMetrics)
+	go http.Serve(l, mux)
+	log.Println("Serving merged metrics", "addr", l.Addr().String(), "app", kr.appMetricsURL())
+	return nil
+}
+
+// handleMergedMetrics returns the Envoy, app and krun metrics. Sources that fail are skipped, so the
+// endpoint is usable before the proxy or the app are ready.
+func (kr *KRun) handleMergedMetrics(w http.ResponseWriter, r *http.Request) {
+	ctx, cf := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cf()
+
+	var b bytes.Buffer
+	for _, u := range []string{metricsEnvoyURL, kr.appMetricsURL()} {
+		if u == "" {
+			continue
+		}
+		data, err := scrapeMetrics(ctx, u)
+		if err != nil {
+			log.Println("Metrics merge: failed to scrape", u, err)
+			continue
+		}
+		b.Write(data)
+	}
+	writePrometheus(&b, kr.krunMetrics())
+
+	w.Header().Set("content-type", promContentType)
+	w.Write(b.Bytes())
+}
+
+// scrapeMetrics returns the metrics from url in text format, ending in a newline. The OpenMetrics EOF
+// marker is removed, since the output is concatenated.
+func scrapeMetrics(ctx context.Context, url string) ([]byte, error) {
+	req, _ := http.NewRequestWithContext(ctx, "GET", url, nil)
+	req.Header.Set("accept", "text/plain;version=0.0.4;q=1,*/*;q=0.1")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		return nil, errors.New("scrape failed " + res.Status)
+	}
+	data, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	data = bytes.TrimSuffix(bytes.TrimRight(data, "\n"), []byte("# EOF"))
+	if len(data) > 0 && data[len(data)-1] != '\n' {
+		data = append(data, '\n')
+	}
+	return data, nil
+}
+
+// krunMetrics returns the krun metrics - the same values exported with the MetricWriter.
+func (kr *KRun) krunMetrics() []Metric {
+	ml := append(kr.retryMetrics(), kr.mirrorMetrics()...)
+	ml = append(ml, kr.versionMetrics()...)
+	if ready := kr.appReadyTime(); !ready.IsZero() {
+		total := ready.Sub(kr.StartTime)
+		for _, p := range append(kr.StartupPhases(), StartupPhase{Name: "total", Duration: total}) {
+			ml = append(ml, Metric{
+				Name:   "krun/startup_latencies",
+				Labels: map[string]string{"phase": p.Name},
+				Value:  float64(p.Duration.Milliseconds()),
+			})
+		}
+	}
+	if ws := kr.WatchdogStatus(); ws != nil {
+		ml = append(ml, Metric{
+			Name:    "krun/watchdog_restarts",
+			Value:   float64(ws.Restarts),
+			Counter: true,
+		})
+	}
+	ml = append(ml, Metric{
+		Name:  "krun/uptime_seconds",
+		Value: time.Since(kr.StartTime).Seconds(),
+	})
+	return ml
+}
+
+// writePrometheus writes the metrics in Prometheus text format. '/' in names is replaced with '_', and
+// metrics with the same name must be adjacent.
+func writePrometheus(b *bytes.Buffer, ml []Metric) {
+	last := ""
+	for _, m := range ml {
+		name := strings.ReplaceAll(m.Name, "/", "_")
+		if name != last {
+			t := "gauge"
+			if m.Counter {
+				t = "counter"
+			}
+			fmt.Fprintf(b, "# TYPE %s %s\n", name, t)
+			last = name
+		}
+		b.WriteString(name)
+		if len(m.Labels) > 0 {
+			keys := make([]string, 0, len(m.Labels))
+			for k := range m.Labels {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+			b.WriteByte('{')
+			for i, k := range keys {
+				if i > 0 {
+					b.WriteByte(',')
+				}
+				fmt.Fprintf(b, "%s=\"%s\"", k, promLabelEscaper.Replace(m.Labels[k]))
+			}
+			b.WriteByte('}')
+		}
+		b.WriteByte(' ')
+		b.WriteString(strconv.FormatFloat(m.Value, 'g', -1, 64))
+		b.WriteByte('\n')
+	}
+}
@@ -0,0 +1,75 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mesh
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetricsMerge(t *testing.T) {
+	envoy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("# TYPE envoy_server_live gauge\nenvoy_server_live 1"))
+	}))
+	defer envoy.Close()
+	app := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("# TYPE app_requests counter\napp_requests 3\n# EOF\n"))
+	}))
+	defer app.Close()
+
+	defer func(u string) { metricsEnvoyURL = u }(metricsEnvoyURL)
+	metricsEnvoyURL = envoy.URL
+	os.Setenv("MESH_METRICS_MERGE", "true")
+	defer os.Unsetenv("MESH_METRICS_MERGE")
+	os.Setenv("MESH_APP_METRICS", app.URL)
+	defer os.Unsetenv("MESH_APP_METRICS")
+
+	kr := New()
+	kr.StartTime = time.Now()
+	if kr.agentStatusPort() != mergeAgentStatusPort {
+		t.Error("Expecting the agent status port to move", kr.agentStatusPort())
+	}
+	kr.recordRetry("xds", 1, nil)
+
+	w := httptest.NewRecorder()
+	kr.handleMergedMetrics(w, httptest.NewRequest("GET", "/stats/prometheus", nil))
+	out, _ := ioutil.ReadAll(w.Result().Body)
+	res := string(out)
+	for _, exp := range []string{"envoy_server_live 1\n", "app_requests 3\n",
+		"# TYPE krun_retries counter\n", `krun_retries{op="xds",type="retry"} 1`, "krun_uptime_seconds "} {
+		if !strings.Contains(res, exp) {
+			t.Error("Missing", exp, res)
+		}
+	}
+	if strings.Contains(res, "# EOF") {
+		t.Error("Unexpected EOF marker", res)
+	}
+}
+
+func TestAppMetricsURL(t *testing.T) {
+	kr := New()
+	if u := kr.appMetricsURL(); u != "" {
+		t.Error("Unexpected app scrape", u)
+	}
+	kr.Annotations = map[string]string{annoPromScrape: "true", annoPromPort: "9090", annoPromPath: "stats"}
+	if u := kr.appMetricsURL(); u != "http://127.0.0.1:9090/stats" {
+		t.Error("Unexpected app URL", u)
+	}
+}
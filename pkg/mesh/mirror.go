@@ -0,0 +1,147 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mesh
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/GoogleCloudPlatform/cloud-run-mesh/pkg/hbone"
+)
+
+// Traffic mirroring, to validate a migration from GKE.
+//
+// MESH_MIRROR_URL is the secondary destination - for example the internal load balancer of the GKE service.
+// MESH_MIRROR_PERCENT (default 10) of the requests received on the CloudRun port are sent to both the app and the
+// mirror, and the status and body of the responses are compared. Only MESH_MIRROR_METHODS (default GET,HEAD)
+// are mirrored, so requests with side effects are not duplicated. Mirrored requests have x-krun-mirror: true.
+//
+// Differences are logged, and the totals and last differences are available as /debug/mirror and in the
+// krun metrics.
+
+// maxMirrorDiffs is the number of differences kept for /debug/mirror.
+const maxMirrorDiffs = 20
+
+// MirrorStats holds the comparison totals.
+type MirrorStats struct {
+	URL     string                `json:"url"`
+	Match   int                   `json:"match"`
+	Diff    int                   `json:"diff"`
+	Errors  int                   `json:"errors"`
+	Recent  []*hbone.MirrorResult `json:"recent,omitempty"`
+	Percent float64               `json:"percent"`
+}
+
+type mirrorState struct {
+	m sync.Mutex
+	MirrorStats
+}
+
+// Mirror returns the mirror for the serving port, or nil if MESH_MIRROR_URL is not set.
+func (kr *KRun) Mirror() *hbone.Mirror {
+	dest := kr.Config("MESH_MIRROR_URL", "")
+	if dest == "" {
+		return nil
+	}
+	pct, err := strconv.ParseFloat(kr.Config("MESH_MIRROR_PERCENT", "10"), 64)
+	if err != nil || pct < 0 || pct > 100 {
+		log.Println("Invalid MESH_MIRROR_PERCENT, mirroring disabled")
+		return nil
+	}
+	m, err := hbone.NewMirror(dest, pct)
+	if err != nil {
+		log.Println("Invalid MESH_MIRROR_URL, mirroring disabled", err)
+		return nil
+	}
+	if methods := splitList(kr.Config("MESH_MIRROR_METHODS", "")); len(methods) > 0 {
+		m.Methods = methods
+	}
+	kr.mirror.m.Lock()
+	kr.mirror.URL = dest
+	kr.mirror.Percent = pct
+	kr.mirror.m.Unlock()
+	m.OnResult = kr.recordMirror
+	log.Println("Mirroring requests", "url", dest, "percent", pct, "methods", strings.Join(m.Methods, ","))
+	return m
+}
+
+func (kr *KRun) recordMirror(res *hbone.MirrorResult) {
+	kr.mirror.m.Lock()
+	defer kr.mirror.m.Unlock()
+	switch {
+	case res.Error != "":
+		kr.mirror.Errors++
+	case res.Match():
+		kr.mirror.Match++
+		return
+	default:
+		kr.mirror.Diff++
+		log.Println("Mirror diff", "method", res.Method, "path", res.Path, "status", res.Status,
+			"mirror_status", res.MirrorStatus, "body_match", res.BodyMatch)
+	}
+	kr.mirror.Recent = append(kr.mirror.Recent, res)
+	if len(kr.mirror.Recent) > maxMirrorDiffs {
+		kr.mirror.Recent = kr.mirror.Recent[1:]
+	}
+}
+
+// MirrorStats returns the comparison totals, or nil if mirroring is not enabled.
+func (kr *KRun) MirrorStats() *MirrorStats {
+	kr.mirror.m.Lock()
+	defer kr.mirror.m.Unlock()
+	if kr.mirror.URL == "" {
+		return nil
+	}
+	s := kr.mirror.MirrorStats
+	s.Recent = append([]*hbone.MirrorResult{}, s.Recent...)
+	return &s
+}
+
+// mirrorMetrics returns the totals as krun/mirror_requests counters.
+func (kr *KRun) mirrorMetrics() []Metric {
+	s := kr.MirrorStats()
+	if s == nil {
+		return nil
+	}
+	ml := []Metric{}
+	for _, r := range []struct {
+		name string
+		v    int
+	}{{"match", s.Match}, {"diff", s.Diff}, {"error", s.Errors}} {
+		ml = append(ml, Metric{
+			Name:    "krun/mirror_requests",
+			Labels:  map[string]string{"result": r.name},
+			Value:   float64(r.v),
+			Counter: true,
+		})
+	}
+	return ml
+}
+
+// handleMirror returns the mirror totals and the last differences, as JSON.
+func (kr *KRun) handleMirror(w http.ResponseWriter, r *http.Request) {
+	s := kr.MirrorStats()
+	if s == nil {
+		http.Error(w, "Mirroring not enabled, set MESH_MIRROR_URL", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("content-type", "application/json")
+	data, _ := json.MarshalIndent(s, "", "  ")
+	w.Write(data)
+}
@@ -0,0 +1,56 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mesh
+
+import (
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/GoogleCloudPlatform/cloud-run-mesh/pkg/hbone"
+)
+
+func TestMirrorStats(t *testing.T) {
+	kr := New()
+	if kr.Mirror() != nil || kr.MirrorStats() != nil {
+		t.Error("Mirroring should be disabled by default")
+	}
+	os.Setenv("MESH_MIRROR_URL", "http://gke.example.internal")
+	defer os.Unsetenv("MESH_MIRROR_URL")
+	os.Setenv("MESH_MIRROR_METHODS", "GET,POST")
+	defer os.Unsetenv("MESH_MIRROR_METHODS")
+
+	m := kr.Mirror()
+	if m == nil || m.Percent != 10 || len(m.Methods) != 2 {
+		t.Fatal("Unexpected mirror", m)
+	}
+	m.OnResult(&hbone.MirrorResult{Path: "/a", Status: 200, MirrorStatus: 200, BodyMatch: true})
+	m.OnResult(&hbone.MirrorResult{Path: "/b", Status: 200, MirrorStatus: 404})
+	m.OnResult(&hbone.MirrorResult{Path: "/c", Status: 200, Error: "timeout"})
+
+	s := kr.MirrorStats()
+	if s.Match != 1 || s.Diff != 1 || s.Errors != 1 || len(s.Recent) != 2 {
+		t.Error("Unexpected stats", s)
+	}
+	w := httptest.NewRecorder()
+	kr.handleMirror(w, httptest.NewRequest("GET", "/debug/mirror", nil))
+	if !strings.Contains(w.Body.String(), `"diff": 1`) {
+		t.Error("Unexpected debug response", w.Body.String())
+	}
+	if ml := kr.mirrorMetrics(); len(ml) != 3 || ml[1].Value != 1 {
+		t.Error("Unexpected metrics", ml)
+	}
+}
@@ -0,0 +1,168 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mesh
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Multi-network support.
+//
+// When the CloudRun VPC can't reach the pod IPs in the cluster, the instance must be on a separate Istio network
+// (MESH_NETWORK) and Istiod must know the east-west gateway of each network - it will then return the gateway
+// address instead of the unreachable pod IPs, and the gateway forwards the mTLS connection (AUTO_PASSTHROUGH).
+//
+// MESH_NETWORK_GATEWAYS is a list of network=address[:port] - the default port is 15443 and the default value is
+// NETWORK_GATEWAYS from mesh-env. The address must be reachable from the CloudRun VPC, typically an internal
+// load balancer for the cluster east-west gateway.
+//
+// The proxy requests a network view (ISTIO_META_REQUESTED_NETWORK_VIEW) with its own network and the networks
+// that have a gateway - endpoints on other networks are not reachable.
+//
+// With MESH_NETWORK_GATEWAYS_PUBLISH=true krun also creates a Service in istio-system for each gateway, with the
+// topology.istio.io/network label and the gateway address as external IP - this is how Istiod discovers network
+// gateways in a cluster. Requires permission to write Services in istio-system.
+
+const (
+	defaultGatewayPort = 15443
+	labelGatewayPort   = "networking.istio.io/gatewayPort"
+)
+
+// NetworkGateways returns the configured east-west gateway address for each network, as host:port.
+func (kr *KRun) NetworkGateways() (map[string]string, error) {
+	res := map[string]string{}
+	for _, ng := range splitList(kr.Config("MESH_NETWORK_GATEWAYS", kr.MeshEnv["NETWORK_GATEWAYS"])) {
+		p := strings.SplitN(ng, "=", 2)
+		if len(p) != 2 || p[0] == "" || p[1] == "" {
+			return nil, errors.New("invalid network gateway " + ng + ", expecting network=address")
+		}
+		addr := p[1]
+		if _, port, err := net.SplitHostPort(addr); err == nil {
+			if n, err := strconv.Atoi(port); err != nil || n <= 0 || n > 65535 {
+				return nil, errors.New("invalid network gateway port " + ng)
+			}
+		} else {
+			addr = net.JoinHostPort(addr, strconv.Itoa(defaultGatewayPort))
+		}
+		res[p[0]] = addr
+	}
+	return res, nil
+}
+
+// requestedNetworkView returns the networks the proxy can reach - its own and the networks with a gateway.
+// Empty if no gateways are configured.
+func (kr *KRun) requestedNetworkView() string {
+	gws, err := kr.NetworkGateways()
+	if err != nil || len(gws) == 0 {
+		return ""
+	}
+	own := kr.Network()
+	nets := []string{}
+	for n := range gws {
+		if n != own {
+			nets = append(nets, n)
+		}
+	}
+	sort.Strings(nets)
+	if own != "" {
+		nets = append([]string{own}, nets...)
+	}
+	return strings.Join(nets, ",")
+}
+
+// PublishNetworkGateways creates a Service in istio-system for each network gateway, so Istiod returns the
+// gateway address for endpoints on that network. All instances publish the same content.
+func (kr *KRun) PublishNetworkGateways(ctx context.Context) error {
+	if kr.Config("MESH_NETWORK_GATEWAYS_PUBLISH", "") != "true" {
+		return nil
+	}
+	gws, err := kr.NetworkGateways()
+	if err != nil {
+		return err
+	}
+	rw, ok := kr.Cfg.(ResourceWriter)
+	if !ok {
+		return errors.New("config source doesn't support writing services")
+	}
+	for n, addr := range gws {
+		obj, err := networkGatewayService(n, addr)
+		if err != nil {
+			return err
+		}
+		name := networkGatewayName(n)
+		err = rw.ApplyResource(ctx, "/api/v1", "services", "istio-system", name, obj)
+		if err != nil {
+			return err
+		}
+		log.Println("Published network gateway", "network", n, "addr", addr, "name", name)
+	}
+	return nil
+}
+
+// networkGatewayName returns a valid Service name for the network.
+func networkGatewayName(network string) string {
+	name := strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= '0' && r <= '9' {
+			return r
+		}
+		if r >= 'A' && r <= 'Z' {
+			return r - 'A' + 'a'
+		}
+		return '-'
+	}, network)
+	name = "krun-gw-" + name
+	if len(name) > 63 {
+		name = name[0:63]
+	}
+	return strings.TrimRight(name, "-")
+}
+
+// networkGatewayService returns the Service for a gateway. Istiod only uses the external IPs of Services with the
+// network label - the address must be an IP.
+func networkGatewayService(network, addr string) (map[string]interface{}, error) {
+	host, port, _ := net.SplitHostPort(addr)
+	if net.ParseIP(host) == nil {
+		return nil, errors.New("network gateway address must be an IP to publish: " + addr)
+	}
+	p, _ := strconv.Atoi(port)
+	return map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       "Service",
+		"metadata": map[string]interface{}{
+			"labels": map[string]interface{}{
+				labelNetwork:     network,
+				labelGatewayPort: port,
+			},
+		},
+		"spec": map[string]interface{}{
+			// Headless - no cluster IP to preserve on update, and nothing selected.
+			"clusterIP":   "None",
+			"externalIPs": []interface{}{host},
+			"ports": []interface{}{
+				map[string]interface{}{
+					"name":     "tls",
+					"port":     p,
+					"protocol": "TCP",
+				},
+			},
+		},
+	}, nil
+}
@@ -0,0 +1,67 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mesh
+
+import (
+	"os"
+	"testing"
+)
+
+func TestNetworkGateways(t *testing.T) {
+	kr := New()
+	kr.MeshEnv["NETWORK_GATEWAYS"] = "cluster1=10.1.0.5,cluster2=10.2.0.5:443"
+	gws, err := kr.NetworkGateways()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gws["cluster1"] != "10.1.0.5:15443" || gws["cluster2"] != "10.2.0.5:443" {
+		t.Error("Unexpected gateways", gws)
+	}
+
+	if nv := kr.requestedNetworkView(); nv != "cluster1,cluster2" {
+		t.Error("Unexpected network view", nv)
+	}
+	os.Setenv("MESH_NETWORK", "cloudrun")
+	defer os.Unsetenv("MESH_NETWORK")
+	if nv := kr.requestedNetworkView(); nv != "cloudrun,cluster1,cluster2" {
+		t.Error("Unexpected network view", nv)
+	}
+	if kr.workloadEntryObject("10.0.0.1", true, "", "")["spec"].(map[string]interface{})["network"] != "cloudrun" {
+		t.Error("Missing WorkloadEntry network")
+	}
+
+	os.Setenv("MESH_NETWORK_GATEWAYS", "cluster1")
+	defer os.Unsetenv("MESH_NETWORK_GATEWAYS")
+	if _, err := kr.NetworkGateways(); err == nil {
+		t.Error("Expecting error")
+	}
+}
+
+func TestNetworkGatewayService(t *testing.T) {
+	if n := networkGatewayName("VPC_Net.1"); n != "krun-gw-vpc-net-1" {
+		t.Error("Unexpected name", n)
+	}
+	if _, err := networkGatewayService("net1", "gw.example.com:15443"); err == nil {
+		t.Error("Expecting error for hostname")
+	}
+	svc, err := networkGatewayService("net1", "10.1.0.5:15443")
+	if err != nil {
+		t.Fatal(err)
+	}
+	labels := svc["metadata"].(map[string]interface{})["labels"].(map[string]interface{})
+	if labels[labelNetwork] != "net1" || labels[labelGatewayPort] != "15443" {
+		t.Error("Unexpected labels", labels)
+	}
+}
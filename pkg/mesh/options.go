@@ -0,0 +1,102 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mesh
+
+import (
+	"context"
+)
+
+// Option customizes a KRun created with New. Options are applied after the env and config file are loaded,
+// and take precedence over them.
+//
+// Apps embedding the mesh bootstrap in-process, instead of exec'ing krun:
+//
+//	kr := mesh.New(mesh.WithVendorInit(gcp.InitGCP), mesh.WithoutIptables())
+//	if err := kr.Bootstrap(ctx); err != nil { ... }
+//	// kr.X509KeyPair, kr.TrustedCertPool are the workload identity - or call kr.StartIstioAgent(ctx)
+type Option func(kr *KRun)
+
+// WithXDSAddr sets the XDS server address, skipping mesh-env loading and discovery. "-" disables the agent.
+func WithXDSAddr(addr string) Option {
+	return func(kr *KRun) {
+		kr.XDSAddr = addr
+	}
+}
+
+// WithTokenProvider sets the source of K8S tokens, replacing the vendor default.
+func WithTokenProvider(tp TokenProvider) Option {
+	return func(kr *KRun) {
+		kr.TokenProvider = tp
+	}
+}
+
+// WithCfg sets the config source (mesh-env, config maps), replacing the vendor default.
+func WithCfg(cfg Cfg) Option {
+	return func(kr *KRun) {
+		kr.Cfg = cfg
+	}
+}
+
+// WithVendorInit sets the platform init, called by Bootstrap - for example gcp.InitGCP.
+func WithVendorInit(f func(context.Context, *KRun) error) Option {
+	return func(kr *KRun) {
+		kr.VendorInit = f
+	}
+}
+
+// WithoutIptables disables traffic capture - the app must use the proxy explicitly or proxyless gRPC.
+func WithoutIptables() Option {
+	return WithConfig("ISTIO_META_INTERCEPTION_MODE", "NONE")
+}
+
+// WithWorkload sets the namespace, name and K8S service account of the workload. Empty values are ignored.
+func WithWorkload(namespace, name, ksa string) Option {
+	return func(kr *KRun) {
+		if namespace != "" {
+			kr.Namespace = namespace
+		}
+		if name != "" {
+			kr.Name = name
+		}
+		if ksa != "" {
+			kr.KSA = ksa
+		}
+	}
+}
+
+// WithTrustDomain sets the mesh trust domain.
+func WithTrustDomain(td string) Option {
+	return func(kr *KRun) {
+		kr.TrustDomain = td
+	}
+}
+
+// WithConfig sets a setting, overriding env, mesh-env and the config file.
+func WithConfig(name, val string) Option {
+	return func(kr *KRun) {
+		kr.SetFlagConfig(name, val)
+	}
+}
+
+// Bootstrap runs the vendor init, if XDS_ADDR is not set, and loads the mesh config and workload certificates.
+// Equivalent to the krun startup, without starting the agent or the app.
+func (kr *KRun) Bootstrap(ctx context.Context) error {
+	if kr.XDSAddr == "" && kr.VendorInit != nil {
+		if err := kr.VendorInit(ctx, kr); err != nil {
+			return err
+		}
+	}
+	return kr.LoadConfig(ctx)
+}
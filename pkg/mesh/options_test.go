@@ -0,0 +1,47 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mesh
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestOptions(t *testing.T) {
+	tp := &LocalCA{}
+	kr := New(WithXDSAddr("-"), WithTokenProvider(tp), WithoutIptables(),
+		WithWorkload("fortio", "echo", ""), WithTrustDomain("example.com"))
+	if kr.XDSAddr != "-" || kr.TokenProvider != tp || kr.TrustDomain != "example.com" {
+		t.Error("Options not applied", kr.XDSAddr, kr.TrustDomain)
+	}
+	if kr.Namespace != "fortio" || kr.Name != "echo" || kr.KSA != "default" {
+		t.Error("Unexpected workload", kr.Namespace, kr.Name, kr.KSA)
+	}
+	if v, src := kr.ConfigSource("ISTIO_META_INTERCEPTION_MODE"); v != "NONE" || src != SourceFlag {
+		t.Error("Unexpected interception mode", v, src)
+	}
+
+	// Vendor init is skipped when the XDS address is explicit.
+	called := false
+	kr = New(WithXDSAddr("-"), WithVendorInit(func(ctx context.Context, kr *KRun) error {
+		called = true
+		return errors.New("unexpected")
+	}))
+	kr.SkipSaveCerts = true
+	if err := kr.Bootstrap(context.Background()); err != nil || called {
+		t.Error("Unexpected vendor init", err, called)
+	}
+}
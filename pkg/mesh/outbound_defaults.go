@@ -0,0 +1,158 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mesh
+
+import (
+	"context"
+	"log"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Outbound defaults for the circuit breakers and retries, usually set in mesh-env so all CloudRun clients of the
+// mesh use the same values. DestinationRules and VirtualServices remain the way to configure specific services.
+//
+// The values are applied as Envoy runtime overrides, using the admin layer of the Istio bootstrap:
+// - MESH_OUTBOUND_MAX_CONNECTIONS, MESH_OUTBOUND_MAX_PENDING_REQUESTS, MESH_OUTBOUND_MAX_REQUESTS and
+// MESH_OUTBOUND_MAX_RETRIES set the default priority circuit breaker thresholds of each outbound cluster.
+// - MESH_OUTBOUND_RETRY_BACKOFF sets the base interval of the retry back-off.
+//
+// Runtime keys are per cluster - new clusters pushed by Istiod are detected every outboundDefaultsPoll.
+// MESH_OUTBOUND_CONNECT_TIMEOUT is not a runtime setting; it applies to the streams proxied by krun (rootless mode).
+
+// outboundDefaultsPoll is the interval for checking new clusters.
+var outboundDefaultsPoll = 30 * time.Second
+
+// circuitBreakerKeys maps the config names to the Envoy threshold names.
+var circuitBreakerKeys = map[string]string{
+	"MESH_OUTBOUND_MAX_CONNECTIONS":      "max_connections",
+	"MESH_OUTBOUND_MAX_PENDING_REQUESTS": "max_pending_requests",
+	"MESH_OUTBOUND_MAX_REQUESTS":         "max_requests",
+	"MESH_OUTBOUND_MAX_RETRIES":          "max_retries",
+}
+
+// outboundThresholds returns the configured circuit breaker thresholds, by Envoy name.
+func (kr *KRun) outboundThresholds() map[string]string {
+	res := map[string]string{}
+	for k, t := range circuitBreakerKeys {
+		v := kr.Config(k, "")
+		if v == "" {
+			continue
+		}
+		if n, err := strconv.Atoi(v); err != nil || n <= 0 {
+			log.Println("Invalid circuit breaker threshold, ignored", k, v)
+			continue
+		}
+		res[t] = v
+	}
+	return res
+}
+
+// globalRuntime returns the runtime values that are not per cluster.
+func (kr *KRun) globalRuntime() map[string]string {
+	res := map[string]string{}
+	if d := kr.configDuration("MESH_OUTBOUND_RETRY_BACKOFF", 0); d > 0 {
+		res["upstream.base_retry_backoff_ms"] = strconv.FormatInt(d.Milliseconds(), 10)
+	}
+	return res
+}
+
+// StartOutboundDefaults applies the outbound defaults to Envoy, if any is set. Should be called after the
+// proxy is ready.
+func (kr *KRun) StartOutboundDefaults(ctx context.Context) {
+	thresholds := kr.outboundThresholds()
+	global := kr.globalRuntime()
+	if len(thresholds) == 0 && len(global) == 0 {
+		return
+	}
+	log.Println("Applying outbound defaults", "thresholds", thresholds, "runtime", global)
+	go func() {
+		applied := map[string]bool{}
+		globalDone := len(global) == 0
+		for {
+			if !globalDone {
+				globalDone = applyEnvoyRuntime(ctx, global) == nil
+			}
+			if len(thresholds) > 0 {
+				kr.applyOutboundThresholds(ctx, thresholds, applied)
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(outboundDefaultsPoll):
+			}
+		}
+	}()
+}
+
+// applyOutboundThresholds sets the thresholds for the outbound clusters not in applied.
+func (kr *KRun) applyOutboundThresholds(ctx context.Context, thresholds map[string]string, applied map[string]bool) {
+	data, err := envoyAdminGet(ctx, "/clusters")
+	if err != nil {
+		log.Println("Failed to get envoy clusters", err)
+		return
+	}
+	for _, c := range outboundClusterNames(string(data)) {
+		if applied[c] {
+			continue
+		}
+		if err := applyEnvoyRuntime(ctx, circuitBreakerRuntime(c, thresholds)); err != nil {
+			log.Println("Failed to set circuit breakers", "cluster", c, "err", err)
+			return
+		}
+		applied[c] = true
+	}
+}
+
+// circuitBreakerRuntime returns the runtime keys overriding the default priority thresholds of a cluster.
+func circuitBreakerRuntime(cluster string, thresholds map[string]string) map[string]string {
+	res := map[string]string{}
+	for t, v := range thresholds {
+		res["circuit_breakers."+cluster+".default."+t] = v
+	}
+	return res
+}
+
+// outboundClusterNames returns the outbound clusters in the /clusters text output, sorted.
+func outboundClusterNames(data string) []string {
+	seen := map[string]bool{}
+	res := []string{}
+	for _, l := range strings.Split(data, "\n") {
+		i := strings.Index(l, "::")
+		if i <= 0 || !strings.HasPrefix(l, "outbound|") {
+			continue
+		}
+		if n := l[0:i]; !seen[n] {
+			seen[n] = true
+			res = append(res, n)
+		}
+	}
+	sort.Strings(res)
+	return res
+}
+
+func applyEnvoyRuntime(ctx context.Context, vals map[string]string) error {
+	if len(vals) == 0 {
+		return nil
+	}
+	q := url.Values{}
+	for k, v := range vals {
+		q.Set(k, v)
+	}
+	return envoyAdminPost(ctx, "/runtime_modify?"+q.Encode())
+}
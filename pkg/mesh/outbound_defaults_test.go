@@ -0,0 +1,53 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mesh
+
+import (
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestOutboundDefaults(t *testing.T) {
+	os.Setenv("MESH_OUTBOUND_MAX_REQUESTS", "100")
+	defer os.Unsetenv("MESH_OUTBOUND_MAX_REQUESTS")
+	os.Setenv("MESH_OUTBOUND_MAX_RETRIES", "-1")
+	defer os.Unsetenv("MESH_OUTBOUND_MAX_RETRIES")
+	os.Setenv("MESH_OUTBOUND_RETRY_BACKOFF", "50ms")
+	defer os.Unsetenv("MESH_OUTBOUND_RETRY_BACKOFF")
+
+	kr := New()
+	th := kr.outboundThresholds()
+	if !reflect.DeepEqual(th, map[string]string{"max_requests": "100"}) {
+		t.Error("Unexpected thresholds", th)
+	}
+	if g := kr.globalRuntime(); g["upstream.base_retry_backoff_ms"] != "50" {
+		t.Error("Unexpected runtime", g)
+	}
+
+	clusters := outboundClusterNames(`outbound|8080||fortio.fortio.svc.cluster.local::observability_name::x
+outbound|8080||fortio.fortio.svc.cluster.local::default_priority::max_requests::1024
+inbound|8080||::default_priority::max_requests::1024
+BlackHoleCluster::default_priority::max_requests::1024
+outbound|443||www.google.com::10.0.0.1:443::cx_active::0
+`)
+	if !reflect.DeepEqual(clusters, []string{"outbound|443||www.google.com", "outbound|8080||fortio.fortio.svc.cluster.local"}) {
+		t.Error("Unexpected clusters", clusters)
+	}
+	rt := circuitBreakerRuntime(clusters[0], th)
+	if rt["circuit_breakers.outbound|443||www.google.com.default.max_requests"] != "100" {
+		t.Error("Unexpected runtime", rt)
+	}
+}
@@ -0,0 +1,88 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mesh
+
+import (
+	"errors"
+	"net"
+	"strings"
+)
+
+// Outbound policy for the krun proxy.
+//
+// With Envoy, the Sidecar egress scope and the mesh outboundTrafficPolicy are enforced by the outbound listeners.
+// The rootless proxy (HTTPS_PROXY/HTTP_PROXY) has no listeners - without a policy any destination is allowed.
+//
+// MESH_OUTBOUND_POLICY enables the same checks in krun, using the outbound clusters received by the in-process
+// XDS client (MESH_XDS_CLIENT=true) - Istiod only sends the clusters in the Sidecar egress scope:
+// - ALLOW_ANY - mesh destinations (*.svc, MESH_UPSTREAMS) must be in the egress scope, others are allowed.
+// - REGISTRY_ONLY - all destinations must be in the egress scope, or declared with a ServiceEntry.
+//
+// Requests are rejected until the first CDS response. AuthorizationPolicy is enforced by the destination, using
+// the workload identity of the mTLS connection.
+
+const (
+	OutboundAllowAny     = "ALLOW_ANY"
+	OutboundRegistryOnly = "REGISTRY_ONLY"
+)
+
+// errOutboundDenied is returned for destinations rejected by the outbound policy.
+var errOutboundDenied = errors.New("outbound policy denied")
+
+func (kr *KRun) outboundPolicy() string {
+	return kr.Config("MESH_OUTBOUND_POLICY", "")
+}
+
+// outboundAllowed returns an error if the policy doesn't allow dest (host:port). Mesh is true for mesh
+// destinations.
+func (kr *KRun) outboundAllowed(dest string, mesh bool) error {
+	policy := kr.outboundPolicy()
+	if policy == "" || (policy == OutboundAllowAny && !mesh) {
+		return nil
+	}
+	c := kr.XDSClient
+	if c == nil {
+		return errors.New("outbound policy requires MESH_XDS_CLIENT")
+	}
+	host, port, err := net.SplitHostPort(dest)
+	if err != nil {
+		return err
+	}
+	in, loaded := c.InScope(kr.outboundNames(host), port)
+	if !loaded {
+		return errors.New("outbound policy: egress scope not loaded")
+	}
+	if !in {
+		return errOutboundDenied
+	}
+	return nil
+}
+
+// outboundNames returns the names that may match a cluster - short names are expanded using the search
+// domains of the namespace.
+func (kr *KRun) outboundNames(host string) []string {
+	host = strings.TrimSuffix(host, ".")
+	if net.ParseIP(host) != nil {
+		return []string{host}
+	}
+	if strings.HasSuffix(host, ".svc") {
+		return []string{host + ".cluster.local"}
+	}
+	res := []string{host, host + ".svc.cluster.local"}
+	if kr.Namespace != "" {
+		res = append(res, host+"."+kr.Namespace+".svc.cluster.local")
+	}
+	return res
+}
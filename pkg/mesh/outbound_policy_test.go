@@ -0,0 +1,89 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mesh
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestOutboundPolicy(t *testing.T) {
+	os.Setenv("MESH_OUTBOUND_POLICY", OutboundRegistryOnly)
+	defer os.Unsetenv("MESH_OUTBOUND_POLICY")
+
+	kr := New()
+	kr.Namespace = "fortio"
+	c := &XDSClient{state: map[string]*XDSTypeState{}}
+	kr.XDSClient = c
+	if err := kr.outboundAllowed("fortio.fortio.svc:8080", true); err == nil || errors.Is(err, errOutboundDenied) {
+		t.Error("Expecting scope not loaded", err)
+	}
+
+	c.handleResponse(&discoveryResponse{TypeURL: ClusterType, Resources: [][]byte{
+		appendBytesField(nil, 1, []byte("outbound|8080||fortio.fortio.svc.cluster.local")),
+		appendBytesField(nil, 1, []byte("outbound|443||*.googleapis.com")),
+		appendBytesField(nil, 1, []byte("inbound|8080||")),
+	}})
+	c.hosts = map[string][]string{"fortio.fortio.svc.cluster.local": {"10.0.0.1"}}
+
+	for dest, exp := range map[string]bool{
+		"fortio.fortio.svc:8080":                  true,
+		"fortio:8080":                             true,
+		"fortio.fortio.svc.cluster.local:8080":    true,
+		"10.0.0.1:8080":                           true,
+		"storage.googleapis.com:443":              true,
+		"fortio.fortio.svc:9090":                  false,
+		"other.fortio.svc.cluster.local:8080":     false,
+		"example.com:443":                         false,
+		"storage.googleapis.com.evil.example:443": false,
+	} {
+		err := kr.outboundAllowed(dest, true)
+		if (err == nil) != exp {
+			t.Error("Unexpected result", dest, err)
+		}
+	}
+
+	// The proxy returns 403 for denied destinations.
+	rp := newRootlessProxy(nil, func(ctx context.Context, dest string) (net.Conn, error) {
+		t.Error("Unexpected mesh dial", dest)
+		return nil, errors.New("unexpected")
+	})
+	rp.allow = kr.outboundAllowed
+	pl, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pl.Close()
+	go http.Serve(pl, rp)
+	pu, _ := url.Parse("http://" + pl.Addr().String())
+	hc := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(pu)}}
+	res, err := hc.Get("http://example.com/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != 403 {
+		t.Error("Unexpected status", res.StatusCode)
+	}
+	if _, err := hc.Get("https://example.com/"); err == nil || !strings.Contains(err.Error(), "Forbidden") {
+		t.Error("Expecting CONNECT to be rejected", err)
+	}
+}
@@ -0,0 +1,81 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mesh
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"os"
+	"strings"
+)
+
+// PodName returns the unique name of this instance, used as POD_NAME for the agent. The name MUST be unique - it is
+// used in Stackdriver, which requires it for ordered updates (data is lost otherwise), and shows up in
+// 'istioctl ps' and in the Istio logs.
+//
+// The name is generated once, and is stable for the life of the krun process:
+// - POD_NAME from env, if set (k8s downward API)
+// - the real pod name, for Knative
+// - K_REVISION and a hash of the full Cloud Run instance ID
+// - HOSTNAME (docker, VMs)
+// - the workload name and a random suffix.
+func (kr *KRun) PodName() string {
+	kr.podNameOnce.Do(func() {
+		kr.podName = kr.newPodName()
+	})
+	return kr.podName
+}
+
+func (kr *KRun) newPodName() string {
+	if pn := os.Getenv("POD_NAME"); pn != "" {
+		return pn
+	}
+	if kr.Knative && kr.InstanceID != "" {
+		return kr.InstanceID
+	}
+	// K_REVISION (ex: fortio-cr-00011-duq)
+	if rev := os.Getenv("K_REVISION"); rev != "" {
+		return rev + "-" + instanceSuffix(kr.InstanceID)
+	}
+	hn := os.Getenv("HOSTNAME")
+	if hn == "" {
+		hn, _ = os.Hostname()
+		hn = strings.Split(hn, ".")[0]
+	}
+	if hn != "" {
+		return hn
+	}
+	name := kr.Name
+	if name == "" {
+		name = "krun"
+	}
+	pn := name + "-" + instanceSuffix(kr.InstanceID)
+	log.Println("Setting POD_NAME from name, missing hostname", pn)
+	return pn
+}
+
+// instanceSuffix returns a short suffix derived from the full instance ID. Cloud Run instance IDs are long and share
+// a common prefix - a truncated ID is not unique. If the instance ID is not known a random suffix is used.
+func instanceSuffix(id string) string {
+	if id == "" {
+		b := make([]byte, 5)
+		rand.Read(b)
+		return hex.EncodeToString(b)
+	}
+	h := sha256.Sum256([]byte(id))
+	return hex.EncodeToString(h[:])[0:10]
+}
@@ -0,0 +1,50 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mesh
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestPodName(t *testing.T) {
+	os.Setenv("K_REVISION", "fortio-cr-00011-duq")
+	defer os.Unsetenv("K_REVISION")
+
+	// Cloud Run instance IDs share a long prefix.
+	kr1 := New()
+	kr1.InstanceID = "00bf4bf02d0a1b2c3d4e5f"
+	kr2 := New()
+	kr2.InstanceID = "00bf4bf02d0a1b2c3d4e60"
+
+	p1 := kr1.PodName()
+	if !strings.HasPrefix(p1, "fortio-cr-00011-duq-") {
+		t.Error("Expecting revision prefix", p1)
+	}
+	if p1 == kr2.PodName() {
+		t.Error("Collision for instances with common prefix", p1)
+	}
+	if p1 != kr1.PodName() {
+		t.Error("Pod name should be stable")
+	}
+
+	// Without instance ID - random suffix.
+	kr3 := New()
+	kr4 := New()
+	if kr3.PodName() == kr4.PodName() {
+		t.Error("Collision without instance ID", kr3.PodName())
+	}
+}
@@ -0,0 +1,204 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mesh
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Gateway pre-warming.
+//
+// The agent reports ready as soon as Envoy has a listener - on scale from zero the first requests may arrive
+// before the routes and clusters from the first full push are applied, resulting in 503s.
+//
+// With GATEWAY_PREWARM=true, in gateway mode krun delays accepting traffic (binding the CloudRun port) until:
+// - LDS and CDS were ACKed at least once, and no clusters or listeners are warming
+// - each Envoy listener accepts connections
+// - the hostnames of the outbound clusters are resolved, warming the DNS proxy cache
+//
+// GATEWAY_PREWARM_TIMEOUT (default 30s) limits the wait - traffic is accepted after the timeout.
+
+const envoyAdmin = "127.0.0.1:15000"
+
+// PrewarmGateway waits for the first full push to be applied. No-op unless enabled in gateway mode.
+func (kr *KRun) PrewarmGateway(ctx context.Context) error {
+	if kr.Gateway == "" || kr.Config("GATEWAY_PREWARM", "") != "true" {
+		return nil
+	}
+	timeout, err := time.ParseDuration(kr.Config("GATEWAY_PREWARM_TIMEOUT", "30s"))
+	if err != nil {
+		timeout = 30 * time.Second
+	}
+	t0 := time.Now()
+	ctx, cf := context.WithTimeout(ctx, timeout)
+	defer cf()
+
+	for {
+		ok, err := envoyXDSSynced(ctx)
+		if ok {
+			break
+		}
+		if ctx.Err() != nil {
+			return fmt.Errorf("timeout waiting for XDS sync: %v", err)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	tsync := time.Now()
+
+	ports, err := envoyListenerPorts(ctx)
+	if err != nil {
+		return err
+	}
+	for _, p := range ports {
+		for {
+			c, err := net.DialTimeout("tcp", net.JoinHostPort("127.0.0.1", p), 1*time.Second)
+			if err == nil {
+				c.Close()
+				break
+			}
+			if ctx.Err() != nil {
+				return fmt.Errorf("listener %s not ready: %v", p, err)
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+	}
+
+	resolved := kr.preresolveClusters(ctx)
+
+	log.Println("Gateway prewarmed", "xds_sync", tsync.Sub(t0), "listeners", len(ports),
+		"resolved", resolved, "total", time.Since(t0))
+	return nil
+}
+
+// envoyXDSSynced checks the LDS/CDS update and warming stats.
+func envoyXDSSynced(ctx context.Context) (bool, error) {
+	st, err := envoyStats(ctx, "^(cluster_manager|listener_manager)\\.")
+	if err != nil {
+		return false, err
+	}
+	return st["cluster_manager.cds.update_success"] > 0 &&
+		st["listener_manager.lds.update_success"] > 0 &&
+		st["cluster_manager.warming_clusters"] == 0 &&
+		st["listener_manager.total_listeners_warming"] == 0, nil
+}
+
+// envoyStats returns the numeric stats matching the filter.
+func envoyStats(ctx context.Context, filter string) (map[string]int64, error) {
+	data, err := envoyAdminGet(ctx, "/stats?filter="+url.QueryEscape(filter))
+	if err != nil {
+		return nil, err
+	}
+	return parseEnvoyStats(string(data)), nil
+}
+
+// parseEnvoyStats parses the 'name: value' text format. Histograms are skipped.
+func parseEnvoyStats(data string) map[string]int64 {
+	res := map[string]int64{}
+	for _, l := range strings.Split(data, "\n") {
+		kv := strings.SplitN(l, ":", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		v, err := strconv.ParseInt(strings.TrimSpace(kv[1]), 10, 64)
+		if err != nil {
+			continue
+		}
+		res[strings.TrimSpace(kv[0])] = v
+	}
+	return res
+}
+
+func envoyAdminGet(ctx context.Context, path string) ([]byte, error) {
+	req, _ := http.NewRequestWithContext(ctx, "GET", "http://"+envoyAdmin+path, nil)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		return nil, fmt.Errorf("envoy admin %s: %s", path, res.Status)
+	}
+	return ioutil.ReadAll(res.Body)
+}
+
+type envoyListeners struct {
+	ListenerStatuses []struct {
+		Name         string `json:"name"`
+		LocalAddress struct {
+			SocketAddress struct {
+				Address   string `json:"address"`
+				PortValue int    `json:"port_value"`
+			} `json:"socket_address"`
+		} `json:"local_address"`
+	} `json:"listener_statuses"`
+}
+
+// envoyListenerPorts returns the ports of the active listeners. Virtual listeners (bind_to_port false) have
+// port 0 or are not bound - Istio gateways only have bound listeners.
+func envoyListenerPorts(ctx context.Context) ([]string, error) {
+	data, err := envoyAdminGet(ctx, "/listeners?format=json")
+	if err != nil {
+		return nil, err
+	}
+	el := &envoyListeners{}
+	if err := json.Unmarshal(data, el); err != nil {
+		return nil, err
+	}
+	res := []string{}
+	for _, l := range el.ListenerStatuses {
+		p := l.LocalAddress.SocketAddress.PortValue
+		if p == 0 || strings.HasPrefix(l.Name, "virtual") {
+			continue
+		}
+		res = append(res, strconv.Itoa(p))
+	}
+	return res, nil
+}
+
+// preresolveClusters looks up the hostnames of the outbound clusters. Returns the number of resolved names.
+func (kr *KRun) preresolveClusters(ctx context.Context) int {
+	data, err := envoyAdminGet(ctx, "/clusters?format=json")
+	if err != nil {
+		return 0
+	}
+	eps, err := parseEnvoyClusters(data)
+	if err != nil {
+		return 0
+	}
+	n := 0
+	for c := range eps {
+		h := clusterHostname(c)
+		if h == "" {
+			continue
+		}
+		rctx, cf := context.WithTimeout(ctx, 1*time.Second)
+		_, err := net.DefaultResolver.LookupHost(rctx, h)
+		cf()
+		if err == nil {
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,126 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mesh
+
+import (
+	"fmt"
+	"os/exec"
+	"runtime"
+	"strings"
+	"sync"
+)
+
+// Child processes don't need the privileges krun uses for the interception setup. With MESH_DROP_PRIVS=true,
+// pilot-agent, Envoy, the app and the Cloud SQL proxy are started from a dedicated OS thread with:
+// - the capabilities in MESH_DROP_CAPS removed from the bounding, permitted, effective and inheritable sets
+// - no_new_privs, so setuid binaries can't regain them
+// - a seccomp filter denying mount, module loading, kexec, ptrace, bpf and similar calls, unless MESH_SECCOMP=off
+//
+// krun itself keeps its capabilities - iptables may be installed after the agent starts (MESH_LAZY_PROXY,
+// egress policy, metadata interception). Only the children are restricted, the restrictions are inherited by
+// the processes they start.
+
+// Default capabilities dropped for children. SETUID and SETGID are kept - they are needed to start the children
+// with a different uid.
+const defaultDropCaps = "NET_ADMIN,NET_RAW,SYS_ADMIN,SYS_MODULE,SYS_PTRACE,SYS_BOOT,SYS_RAWIO,SYS_TIME,MKNOD," +
+	"AUDIT_CONTROL,MAC_ADMIN,MAC_OVERRIDE,SYS_CHROOT,SETFCAP,SETPCAP,BPF,PERFMON"
+
+// Linux capability numbers, from linux/capability.h
+var capNames = map[string]int{
+	"CHOWN": 0, "DAC_OVERRIDE": 1, "DAC_READ_SEARCH": 2, "FOWNER": 3, "FSETID": 4, "KILL": 5, "SETGID": 6,
+	"SETUID": 7, "SETPCAP": 8, "LINUX_IMMUTABLE": 9, "NET_BIND_SERVICE": 10, "NET_BROADCAST": 11,
+	"NET_ADMIN": 12, "NET_RAW": 13, "IPC_LOCK": 14, "IPC_OWNER": 15, "SYS_MODULE": 16, "SYS_RAWIO": 17,
+	"SYS_CHROOT": 18, "SYS_PTRACE": 19, "SYS_PACCT": 20, "SYS_ADMIN": 21, "SYS_BOOT": 22, "SYS_NICE": 23,
+	"SYS_RESOURCE": 24, "SYS_TIME": 25, "SYS_TTY_CONFIG": 26, "MKNOD": 27, "LEASE": 28, "AUDIT_WRITE": 29,
+	"AUDIT_CONTROL": 30, "SETFCAP": 31, "MAC_OVERRIDE": 32, "MAC_ADMIN": 33, "SYSLOG": 34, "WAKE_ALARM": 35,
+	"BLOCK_SUSPEND": 36, "AUDIT_READ": 37, "PERFMON": 38, "BPF": 39, "CHECKPOINT_RESTORE": 40,
+}
+
+// parseCaps converts a list of capability names - with or without the CAP_ prefix - to numbers.
+func parseCaps(s string) ([]int, error) {
+	res := []int{}
+	for _, c := range splitList(s) {
+		n, f := capNames[strings.TrimPrefix(strings.ToUpper(c), "CAP_")]
+		if !f {
+			return nil, fmt.Errorf("unknown capability %s", c)
+		}
+		res = append(res, n)
+	}
+	return res, nil
+}
+
+// childLauncher starts processes from a locked OS thread, with the restrictions applied to the thread. The
+// forked child inherits the capabilities, no_new_privs and seccomp filter of the calling thread.
+type childLauncher struct {
+	ch chan *launchReq
+}
+
+type launchReq struct {
+	cmd *exec.Cmd
+	res chan error
+}
+
+func newChildLauncher(drop []int, seccomp bool) (*childLauncher, error) {
+	cl := &childLauncher{ch: make(chan *launchReq)}
+	errc := make(chan error)
+	go func() {
+		// Never unlocked - the restricted thread must not run other goroutines.
+		runtime.LockOSThread()
+		if err := restrictThread(drop, seccomp); err != nil {
+			errc <- err
+			return
+		}
+		errc <- nil
+		for r := range cl.ch {
+			r.res <- r.cmd.Start()
+		}
+	}()
+	if err := <-errc; err != nil {
+		return nil, err
+	}
+	return cl, nil
+}
+
+func (cl *childLauncher) start(cmd *exec.Cmd) error {
+	r := &launchReq{cmd: cmd, res: make(chan error)}
+	cl.ch <- r
+	return <-r.res
+}
+
+var (
+	launcherOnce sync.Once
+	launcher     *childLauncher
+	launcherErr  error
+)
+
+// startChild starts a child process - from the restricted thread if MESH_DROP_PRIVS is set. If the restrictions
+// can't be applied the child is not started.
+func (kr *KRun) startChild(cmd *exec.Cmd) error {
+	if kr.Config("MESH_DROP_PRIVS", "") != "true" {
+		return cmd.Start()
+	}
+	launcherOnce.Do(func() {
+		var drop []int
+		drop, launcherErr = parseCaps(kr.Config("MESH_DROP_CAPS", defaultDropCaps))
+		if launcherErr != nil {
+			return
+		}
+		launcher, launcherErr = newChildLauncher(drop, kr.Config("MESH_SECCOMP", "default") != "off")
+	})
+	if launcherErr != nil {
+		return fmt.Errorf("failed to drop privileges for %s: %v", cmd.Path, launcherErr)
+	}
+	return launcher.start(cmd)
+}
@@ -0,0 +1,167 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mesh
+
+import (
+	"errors"
+	"runtime"
+	"syscall"
+	"unsafe"
+)
+
+// From linux/prctl.h, linux/seccomp.h and linux/capability.h
+const (
+	prSetSeccomp            = 22
+	prCapbsetDrop           = 24
+	prSetNoNewPrivs         = 38
+	seccompModeFilter       = 2
+	seccompRetAllow         = 0x7fff0000
+	seccompRetErrno         = 0x00050000
+	linuxCapabilityVersion3 = 0x20080522
+)
+
+// AUDIT_ARCH values, from linux/audit.h - the seccomp filter checks the arch before the syscall number.
+var auditArch = map[string]uint32{
+	"amd64": 0xc000003e,
+	"arm64": 0xc00000b7,
+	"386":   0x40000003,
+	"arm":   0x40000028,
+}
+
+// Calls denied to children - not needed by the proxy or typical apps, and commonly used in container escapes.
+var deniedSyscalls = []uint32{
+	syscall.SYS_MOUNT,
+	syscall.SYS_UMOUNT2,
+	syscall.SYS_PIVOT_ROOT,
+	syscall.SYS_KEXEC_LOAD,
+	syscall.SYS_INIT_MODULE,
+	syscall.SYS_DELETE_MODULE,
+	syscall.SYS_REBOOT,
+	syscall.SYS_SWAPON,
+	syscall.SYS_SWAPOFF,
+	syscall.SYS_PTRACE,
+	syscall.SYS_ACCT,
+	syscall.SYS_UNSHARE,
+	syscall.SYS_PERF_EVENT_OPEN,
+}
+
+// Denied calls missing from the syscall package tables, by arch: finit_module, kexec_file_load and bpf. From
+// the kernel syscall tables - 386 has no kexec_file_load.
+var deniedSyscallsArch = map[string][]uint32{
+	"amd64": {313, 320, 321},
+	"arm64": {273, 294, 280},
+	"386":   {350, 357},
+	"arm":   {379, 401, 386},
+}
+
+type capHeader struct {
+	version uint32
+	pid     int32
+}
+
+type capData struct {
+	effective   uint32
+	permitted   uint32
+	inheritable uint32
+}
+
+// restrictThread applies the restrictions to the calling thread, which must be locked.
+func restrictThread(drop []int, seccomp bool) error {
+	if err := dropCaps(drop); err != nil {
+		return err
+	}
+	if err := prctl(prSetNoNewPrivs, 1); err != nil {
+		return err
+	}
+	if !seccomp {
+		return nil
+	}
+	arch, f := auditArch[runtime.GOARCH]
+	if !f {
+		return errors.New("seccomp not supported on " + runtime.GOARCH)
+	}
+	denied := append(append([]uint32{}, deniedSyscalls...), deniedSyscallsArch[runtime.GOARCH]...)
+	filter := seccompFilter(arch, denied)
+	prog := &syscall.SockFprog{Len: uint16(len(filter)), Filter: &filter[0]}
+	return prctl(prSetSeccomp, seccompModeFilter, uintptr(unsafe.Pointer(prog)))
+}
+
+// dropCaps removes the capabilities from the bounding set and the thread sets. Without CAP_SETPCAP - not
+// running as root - the bounding set can't be changed, and there is nothing to drop from the thread sets.
+func dropCaps(drop []int) error {
+	for _, c := range drop {
+		err := prctl(prCapbsetDrop, uintptr(c))
+		if err == syscall.EPERM {
+			return nil
+		}
+		// EINVAL: capability not known to the kernel.
+		if err != nil && err != syscall.EINVAL {
+			return err
+		}
+	}
+	hdr := &capHeader{version: linuxCapabilityVersion3}
+	data := [2]capData{}
+	_, _, e := syscall.RawSyscall(syscall.SYS_CAPGET, uintptr(unsafe.Pointer(hdr)), uintptr(unsafe.Pointer(&data[0])), 0)
+	if e != 0 {
+		return e
+	}
+	for _, c := range drop {
+		bit := uint32(1) << uint(c%32)
+		d := &data[c/32]
+		d.effective &^= bit
+		d.permitted &^= bit
+		d.inheritable &^= bit
+	}
+	_, _, e = syscall.RawSyscall(syscall.SYS_CAPSET, uintptr(unsafe.Pointer(hdr)), uintptr(unsafe.Pointer(&data[0])), 0)
+	if e != 0 {
+		return e
+	}
+	return nil
+}
+
+// seccompFilter returns a BPF program returning EPERM for the denied calls, and allowing everything else.
+// Calls from a different arch (like x32 or 32 bit compat) are denied - the numbers would not match.
+func seccompFilter(arch uint32, denied []uint32) []syscall.SockFilter {
+	f := []syscall.SockFilter{
+		// Offset 4 in seccomp_data: arch
+		{Code: syscall.BPF_LD | syscall.BPF_W | syscall.BPF_ABS, K: 4},
+		{Code: syscall.BPF_JMP | syscall.BPF_JEQ | syscall.BPF_K, Jt: 1, K: arch},
+		{Code: syscall.BPF_RET | syscall.BPF_K, K: seccompRetErrno | uint32(syscall.EPERM)},
+		// Offset 0: syscall number
+		{Code: syscall.BPF_LD | syscall.BPF_W | syscall.BPF_ABS, K: 0},
+	}
+	if arch == auditArch["amd64"] {
+		// x32 calls have the same arch, with bit 30 set.
+		f = append(f,
+			syscall.SockFilter{Code: syscall.BPF_JMP | syscall.BPF_JGE | syscall.BPF_K, Jf: 1, K: 0x40000000},
+			syscall.SockFilter{Code: syscall.BPF_RET | syscall.BPF_K, K: seccompRetErrno | uint32(syscall.EPERM)})
+	}
+	for _, nr := range denied {
+		f = append(f,
+			syscall.SockFilter{Code: syscall.BPF_JMP | syscall.BPF_JEQ | syscall.BPF_K, Jf: 1, K: nr},
+			syscall.SockFilter{Code: syscall.BPF_RET | syscall.BPF_K, K: seccompRetErrno | uint32(syscall.EPERM)})
+	}
+	return append(f, syscall.SockFilter{Code: syscall.BPF_RET | syscall.BPF_K, K: seccompRetAllow})
+}
+
+func prctl(option int, args ...uintptr) error {
+	a := [4]uintptr{}
+	copy(a[:], args)
+	_, _, e := syscall.RawSyscall6(syscall.SYS_PRCTL, uintptr(option), a[0], a[1], a[2], a[3], 0)
+	if e != 0 {
+		return e
+	}
+	return nil
+}
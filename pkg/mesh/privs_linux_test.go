@@ -0,0 +1,65 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mesh
+
+import (
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestChildLauncher(t *testing.T) {
+	cl, err := newChildLauncher([]int{capNames["NET_ADMIN"]}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := &strings.Builder{}
+	cmd := exec.Command("/bin/sh", "-c", "cat /proc/self/status")
+	cmd.Stdout = out
+	if err := cl.start(cmd); err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	status := map[string]string{}
+	for _, l := range strings.Split(out.String(), "\n") {
+		if kv := strings.SplitN(l, ":", 2); len(kv) == 2 {
+			status[kv[0]] = strings.TrimSpace(kv[1])
+		}
+	}
+	if status["NoNewPrivs"] != "1" {
+		t.Error("no_new_privs not set", status["NoNewPrivs"])
+	}
+	if status["Seccomp"] != "2" {
+		t.Error("seccomp filter not set", status["Seccomp"])
+	}
+	if os.Getuid() == 0 {
+		bnd, _ := strconv.ParseUint(status["CapBnd"], 16, 64)
+		if bnd&(1<<uint(capNames["NET_ADMIN"])) != 0 {
+			t.Error("NET_ADMIN not dropped from the bounding set", status["CapBnd"])
+		}
+	}
+}
+
+func TestDeniedSyscallsArch(t *testing.T) {
+	for arch := range auditArch {
+		if len(deniedSyscallsArch[arch]) == 0 {
+			t.Error("Missing arch specific denied calls", arch)
+		}
+	}
+}
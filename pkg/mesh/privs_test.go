@@ -0,0 +1,33 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mesh
+
+import "testing"
+
+func TestParseCaps(t *testing.T) {
+	caps, err := parseCaps("NET_ADMIN, cap_sys_admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(caps) != 2 || caps[0] != 12 || caps[1] != 21 {
+		t.Error("Unexpected caps", caps)
+	}
+	if _, err := parseCaps(defaultDropCaps); err != nil {
+		t.Error(err)
+	}
+	if _, err := parseCaps("NET_FOO"); err == nil {
+		t.Error("Expecting error for unknown capability")
+	}
+}
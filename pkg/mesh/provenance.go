@@ -0,0 +1,176 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mesh
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+)
+
+// Build provenance, set at build time with -ldflags "-X github.com/GoogleCloudPlatform/cloud-run-mesh/pkg/mesh.BuildCommit=..."
+// See the Makefile.
+var (
+	// BuildVersion is the release tag.
+	BuildVersion = "dev"
+
+	// BuildCommit is the git commit of the source.
+	BuildCommit = ""
+
+	// BuildBuilder identifies the build system or user that produced the binary.
+	BuildBuilder = ""
+
+	// BuildDigest is an optional digest provided by the builder - for example the source or image digest.
+	// The digest of the krun binary itself is computed at runtime, see Provenance.
+	BuildDigest = ""
+)
+
+// Provenance describes the krun build and the proxy binaries started by krun.
+type Provenance struct {
+	Version string `json:"version"`
+	Commit  string `json:"commit,omitempty"`
+	Builder string `json:"builder,omitempty"`
+	Digest  string `json:"digest,omitempty"`
+	Go      string `json:"go"`
+
+	// Binary is the sha256 of the running krun executable.
+	Binary string `json:"binary,omitempty"`
+
+	// Verified holds the sha256 of the pilot-agent and envoy binaries that were checked before starting them.
+	Verified map[string]string `json:"verified,omitempty"`
+}
+
+var (
+	verifiedM sync.Mutex
+	verified  = map[string]string{}
+)
+
+// Provenance returns the build information. The digest of the krun binary is computed on each call - it is only
+// used by the debug endpoint, to avoid hashing the binary at startup.
+func (kr *KRun) Provenance() *Provenance {
+	p := &Provenance{
+		Version:  BuildVersion,
+		Commit:   BuildCommit,
+		Builder:  BuildBuilder,
+		Digest:   BuildDigest,
+		Go:       runtime.Version(),
+		Verified: map[string]string{},
+	}
+	if exe, err := os.Executable(); err == nil {
+		p.Binary, _ = fileSHA256(exe)
+	}
+	verifiedM.Lock()
+	for k, v := range verified {
+		p.Verified[k] = v
+	}
+	verifiedM.Unlock()
+	return p
+}
+
+// provenanceEnv adds the build information to the agent env, as ISTIO_META_KRUN_*. Istiod will include it in the
+// proxy metadata, visible with 'istioctl proxy-status' and in the config dump.
+func provenanceEnv(env []string) []string {
+	env = addIfMissing(env, "ISTIO_META_KRUN_VERSION", BuildVersion)
+	if BuildCommit != "" {
+		env = addIfMissing(env, "ISTIO_META_KRUN_COMMIT", BuildCommit)
+	}
+	if BuildBuilder != "" {
+		env = addIfMissing(env, "ISTIO_META_KRUN_BUILDER", BuildBuilder)
+	}
+	if BuildDigest != "" {
+		env = addIfMissing(env, "ISTIO_META_KRUN_DIGEST", BuildDigest)
+	}
+	return env
+}
+
+// handleBuild returns the Provenance, as JSON.
+func (kr *KRun) handleBuild(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("content-type", "application/json")
+	data, _ := json.MarshalIndent(kr.Provenance(), "", "  ")
+	w.Write(data)
+}
+
+// expectedDigests parses MESH_BINARY_SHA256, a list of name=sha256 - for example
+// "pilot-agent=3b1f...,envoy=9ac2...". The name is the base name of the binary.
+func (kr *KRun) expectedDigests() map[string]string {
+	res := map[string]string{}
+	for _, e := range splitList(kr.Config("MESH_BINARY_SHA256", "")) {
+		kv := strings.SplitN(e, "=", 2)
+		if len(kv) != 2 {
+			log.Println("Invalid MESH_BINARY_SHA256 entry, expecting name=sha256", e)
+			continue
+		}
+		res[strings.TrimSpace(kv[0])] = strings.ToLower(strings.TrimSpace(kv[1]))
+	}
+	return res
+}
+
+// VerifyBinary checks the binary against the digest in MESH_BINARY_SHA256, if one is set for its name.
+// Returns an error if the digest doesn't match - the binary must not be started.
+func (kr *KRun) VerifyBinary(name, path string) error {
+	expected := kr.expectedDigests()[name]
+	if expected == "" {
+		return nil
+	}
+	if path == "" {
+		return fmt.Errorf("%s: binary not found, expecting sha256 %s", name, expected)
+	}
+	d, err := fileSHA256(path)
+	if err != nil {
+		return err
+	}
+	if d != expected {
+		return fmt.Errorf("%s: sha256 mismatch for %s, got %s expecting %s", name, path, d, expected)
+	}
+	verifiedM.Lock()
+	verified[name] = d
+	verifiedM.Unlock()
+	log.Println("Verified binary", "name", name, "path", path, "sha256", d)
+	return nil
+}
+
+// verifyProxyBinaries checks the pilot-agent and envoy binaries that will be started against MESH_BINARY_SHA256.
+func (kr *KRun) verifyProxyBinaries() error {
+	if err := kr.VerifyBinary("pilot-agent", kr.AgentPath()); err != nil {
+		return err
+	}
+	if envoy := kr.EnvoyPath(); envoy != "" {
+		if err := kr.VerifyBinary("envoy", envoy); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func fileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,62 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mesh
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestVerifyBinary(t *testing.T) {
+	bin := filepath.Join(t.TempDir(), "envoy")
+	ioutil.WriteFile(bin, []byte("envoy"), 0755)
+	// sha256 of "envoy"
+	d := "84532b306f259587c364bd7301e0813963d5b84fd27c9338f0862dab8f0499d7"
+
+	kr := New()
+	if err := kr.VerifyBinary("envoy", bin); err != nil {
+		t.Error("No expected digest, should not fail", err)
+	}
+
+	os.Setenv("MESH_BINARY_SHA256", "pilot-agent=00, envoy="+strings.ToUpper(d))
+	defer os.Unsetenv("MESH_BINARY_SHA256")
+	if err := kr.VerifyBinary("envoy", bin); err != nil {
+		t.Error("Expected digest match", err)
+	}
+	if p := kr.Provenance(); p.Verified["envoy"] != d {
+		t.Error("Missing verified digest", p.Verified)
+	}
+	if err := kr.VerifyBinary("pilot-agent", bin); err == nil {
+		t.Error("Expected digest mismatch")
+	}
+	if err := kr.VerifyBinary("pilot-agent", ""); err == nil {
+		t.Error("Expected error for missing binary")
+	}
+}
+
+func TestProvenanceEnv(t *testing.T) {
+	BuildCommit = "abc123"
+	defer func() { BuildCommit = "" }()
+	env := strings.Join(provenanceEnv(nil), " ")
+	if !strings.Contains(env, "ISTIO_META_KRUN_COMMIT=abc123") || !strings.Contains(env, "ISTIO_META_KRUN_VERSION=") {
+		t.Error("Missing provenance metadata", env)
+	}
+	if strings.Contains(env, "ISTIO_META_KRUN_BUILDER") {
+		t.Error("Unexpected empty builder", env)
+	}
+}
@@ -0,0 +1,328 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mesh
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2/google"
+)
+
+// Proxy version pinning - krun downloads pilot-agent and envoy at startup, so a small generic image can run any
+// Istio version without a rebuild.
+//
+// MESH_PROXY_URL is the location of the binaries, with ${NAME} (pilot-agent, envoy), ${VERSION}
+// (MESH_PROXY_VERSION) and ${ARCH} placeholders:
+// - gs://bucket/istio/${VERSION}/${NAME}-${ARCH} - using the default Google credentials, if available.
+// - https://example.com/istio/${VERSION}/${NAME}
+// - oci://us-docker.pkg.dev/project/repo/proxy:${VERSION} - an artifact with one layer per binary, with the
+//   binary name as org.opencontainers.image.title annotation (the 'oras push' format).
+//
+// Each binary must have a digest in MESH_BINARY_SHA256 - downloads are verified before use. Binaries are saved to
+// MESH_PROXY_CACHE_DIR (default /var/lib/krun/bin), named by digest - an existing file is not downloaded again.
+
+const ociTitleAnnotation = "org.opencontainers.image.title"
+
+var challengeParam = regexp.MustCompile(`(\w+)="([^"]*)"`)
+
+// DownloadProxy fetches the proxy binaries, if MESH_PROXY_URL is set, and uses them instead of the binaries in
+// the image.
+func (kr *KRun) DownloadProxy(ctx context.Context) error {
+	tmpl := kr.Config("MESH_PROXY_URL", "")
+	if tmpl == "" {
+		return nil
+	}
+	digests := kr.expectedDigests()
+	dir := kr.proxyCacheDir()
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	for _, name := range splitList(kr.Config("MESH_PROXY_BINARIES", "pilot-agent,envoy")) {
+		d := digests[name]
+		if len(d) != 64 {
+			return fmt.Errorf("%s: missing sha256 in MESH_BINARY_SHA256, required for MESH_PROXY_URL", name)
+		}
+		p := cachedBinaryPath(dir, name, d)
+		if h, err := fileSHA256(p); err != nil || h != d {
+			u := string(expandBootstrap([]byte(tmpl), map[string]string{
+				"NAME":    name,
+				"VERSION": kr.Config("MESH_PROXY_VERSION", ""),
+				"ARCH":    runtime.GOARCH,
+			}))
+			t0 := time.Now()
+			if err := kr.downloadBinary(ctx, u, name, p, d); err != nil {
+				return err
+			}
+			log.Println("Downloaded proxy binary", "name", name, "url", u, "sha256", d, "duration", time.Since(t0))
+		}
+		switch name {
+		case "pilot-agent":
+			kr.SetFlagConfig("PILOT_AGENT_BINARY", p)
+		case "envoy":
+			kr.SetFlagConfig("ENVOY_BINARY", p)
+		}
+	}
+	return nil
+}
+
+// downloadBinary saves the binary at u to dst, if the sha256 matches.
+func (kr *KRun) downloadBinary(ctx context.Context, u, name, dst, digest string) error {
+	var body io.ReadCloser
+	var err error
+	switch {
+	case strings.HasPrefix(u, "gs://"):
+		body, err = httpGet(ctx, "https://storage.googleapis.com/"+strings.TrimPrefix(u, "gs://"), gcpAuth(ctx))
+	case strings.HasPrefix(u, "oci://"):
+		body, err = ociFetch(ctx, strings.TrimPrefix(u, "oci://"), name)
+	case strings.HasPrefix(u, "https://") || strings.HasPrefix(u, "http://"):
+		body, err = httpGet(ctx, u, "")
+	default:
+		return fmt.Errorf("unsupported MESH_PROXY_URL %s, expecting gs://, oci:// or https://", u)
+	}
+	if err != nil {
+		return fmt.Errorf("%s: download failed: %v", name, err)
+	}
+	defer body.Close()
+	return saveBinary(body, name, u, dst, digest)
+}
+
+func (kr *KRun) proxyCacheDir() string {
+	return kr.Config("MESH_PROXY_CACHE_DIR", filepath.Join(kr.BaseDir, "/var/lib/krun/bin"))
+}
+
+// cachedBinaryPath returns the name of a binary in the cache dir - including the digest, so a file is never
+// replaced while it may be running.
+func cachedBinaryPath(dir, name, digest string) string {
+	return filepath.Join(dir, name+"-"+digest[0:16])
+}
+
+// saveBinary copies the binary from src to dst, if the sha256 of the copy matches. The copy is verified, not
+// src - which may be modified after it was read.
+func saveBinary(src io.Reader, name, from, dst, digest string) error {
+	f, err := ioutil.TempFile(filepath.Dir(dst), name+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	_, err = io.Copy(f, src)
+	f.Close()
+	if err != nil {
+		return fmt.Errorf("%s: copy from %s failed: %v", name, from, err)
+	}
+	h, err := fileSHA256(f.Name())
+	if err != nil {
+		return err
+	}
+	if h != digest {
+		return fmt.Errorf("%s: sha256 mismatch for %s, got %s expecting %s", name, from, h, digest)
+	}
+	if err := os.Chmod(f.Name(), 0755); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), dst)
+}
+
+// gcpAuth returns the Authorization header using the default Google credentials, or "" if not available.
+func gcpAuth(ctx context.Context) string {
+	ts, err := google.DefaultTokenSource(ctx, "https://www.googleapis.com/auth/devstorage.read_only")
+	if err != nil {
+		return ""
+	}
+	t, err := ts.Token()
+	if err != nil {
+		return ""
+	}
+	return "Bearer " + t.AccessToken
+}
+
+func httpGet(ctx context.Context, u string, auth string, accept ...string) (io.ReadCloser, error) {
+	res, err := httpDo(ctx, u, auth, accept...)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != 200 {
+		res.Body.Close()
+		return nil, fmt.Errorf("GET %s: %s", u, res.Status)
+	}
+	return res.Body, nil
+}
+
+func httpDo(ctx context.Context, u string, auth string, accept ...string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	if auth != "" {
+		req.Header.Set("Authorization", auth)
+	}
+	if len(accept) > 0 {
+		req.Header.Set("Accept", strings.Join(accept, ","))
+	}
+	return http.DefaultClient.Do(req)
+}
+
+type ociManifest struct {
+	Layers []struct {
+		Digest      string            `json:"digest"`
+		Annotations map[string]string `json:"annotations,omitempty"`
+	} `json:"layers"`
+}
+
+// ociFetch returns the layer with the given title from an OCI artifact, host/repo:tag or host/repo@digest.
+func ociFetch(ctx context.Context, ref, name string) (io.ReadCloser, error) {
+	slash := strings.Index(ref, "/")
+	if slash < 0 {
+		return nil, errors.New("invalid OCI reference " + ref)
+	}
+	host, repo := ref[0:slash], ref[slash+1:]
+	tag := "latest"
+	if i := strings.Index(repo, "@"); i > 0 {
+		repo, tag = repo[0:i], repo[i+1:]
+	} else if i := strings.LastIndex(repo, ":"); i > 0 {
+		repo, tag = repo[0:i], repo[i+1:]
+	}
+	base := "https://" + host + "/v2/" + repo
+
+	auth, err := ociAuth(ctx, host, base+"/manifests/"+tag)
+	if err != nil {
+		return nil, err
+	}
+	body, err := httpGet(ctx, base+"/manifests/"+tag, auth,
+		"application/vnd.oci.image.manifest.v1+json", "application/vnd.docker.distribution.manifest.v2+json")
+	if err != nil {
+		return nil, err
+	}
+	m := &ociManifest{}
+	err = json.NewDecoder(body).Decode(m)
+	body.Close()
+	if err != nil {
+		return nil, err
+	}
+	digest := ""
+	for _, l := range m.Layers {
+		if l.Annotations[ociTitleAnnotation] == name {
+			digest = l.Digest
+		}
+	}
+	if digest == "" {
+		return nil, fmt.Errorf("%s not found in %s", name, ref)
+	}
+	return httpGet(ctx, base+"/blobs/"+digest, auth)
+}
+
+// ociAuth returns the Authorization header for a registry, using the Bearer token challenge. Google registries
+// use the default Google credentials, other registries an anonymous token. The credentials are only sent if the
+// token realm is also a Google registry.
+func ociAuth(ctx context.Context, host, u string) (string, error) {
+	res, err := httpDo(ctx, u, "")
+	if err != nil {
+		return "", err
+	}
+	res.Body.Close()
+	if res.StatusCode != 401 {
+		return "", nil
+	}
+	params := parseChallenge(res.Header.Get("WWW-Authenticate"))
+	if params["realm"] == "" {
+		return "", fmt.Errorf("unauthorized, no token realm for %s", host)
+	}
+	req, _ := http.NewRequestWithContext(ctx, "GET", params["realm"], nil)
+	q := req.URL.Query()
+	for _, k := range []string{"service", "scope"} {
+		if params[k] != "" {
+			q.Set(k, params[k])
+		}
+	}
+	req.URL.RawQuery = q.Encode()
+	if googleRealm(host, params["realm"]) {
+		if a := gcpAuth(ctx); a != "" {
+			req.SetBasicAuth("oauth2accesstoken", strings.TrimPrefix(a, "Bearer "))
+		}
+	}
+	tres, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer tres.Body.Close()
+	if tres.StatusCode != 200 {
+		return "", fmt.Errorf("registry token for %s: %s", host, tres.Status)
+	}
+	t := struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}{}
+	if err := json.NewDecoder(tres.Body).Decode(&t); err != nil {
+		return "", err
+	}
+	if t.Token == "" {
+		t.Token = t.AccessToken
+	}
+	return "Bearer " + t.Token, nil
+}
+
+// googleRegistries are the domains of the Google registries, using the default Google credentials.
+var googleRegistries = []string{"gcr.io", "pkg.dev"}
+
+// googleRealm returns true if the Google credentials can be sent to the token realm: both the registry and the
+// realm returned in the challenge must be Google registries, over https.
+func googleRealm(host, realm string) bool {
+	u, err := url.Parse(realm)
+	if err != nil || u.Scheme != "https" {
+		return false
+	}
+	return googleRegistry(host) && googleRegistry(u.Host)
+}
+
+func googleRegistry(host string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(host)
+	for _, d := range googleRegistries {
+		if host == d || strings.HasSuffix(host, "."+d) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseChallenge returns the parameters of a 'Bearer realm="...",service="..."' header.
+func parseChallenge(h string) map[string]string {
+	res := map[string]string{}
+	h = strings.TrimSpace(h)
+	if !strings.HasPrefix(strings.ToLower(h), "bearer ") {
+		return res
+	}
+	// Values are quoted, and may contain commas (scope).
+	for _, m := range challengeParam.FindAllStringSubmatch(h, -1) {
+		res[m[1]] = m[2]
+	}
+	return res
+}
@@ -0,0 +1,139 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mesh
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDownloadProxy(t *testing.T) {
+	bin := []byte("#!/bin/sh\necho pilot-agent\n")
+	h := sha256.Sum256(bin)
+	digest := hex.EncodeToString(h[:])
+	gets := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gets++
+		if r.URL.Path != "/istio/1.11.2/pilot-agent" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(bin)
+	}))
+	defer srv.Close()
+
+	kr := New()
+	kr.BaseDir = t.TempDir()
+	os.Setenv("MESH_PROXY_URL", srv.URL+"/istio/${VERSION}/${NAME}")
+	defer os.Unsetenv("MESH_PROXY_URL")
+	os.Setenv("MESH_PROXY_VERSION", "1.11.2")
+	defer os.Unsetenv("MESH_PROXY_VERSION")
+	os.Setenv("MESH_PROXY_BINARIES", "pilot-agent")
+	defer os.Unsetenv("MESH_PROXY_BINARIES")
+
+	if err := kr.DownloadProxy(context.Background()); err == nil {
+		t.Fatal("Expecting error without digest")
+	}
+
+	os.Setenv("MESH_BINARY_SHA256", "pilot-agent="+digest)
+	defer os.Unsetenv("MESH_BINARY_SHA256")
+	if err := kr.DownloadProxy(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	p := filepath.Join(kr.BaseDir, "/var/lib/krun/bin", "pilot-agent-"+digest[0:16])
+	if kr.AgentPath() != p {
+		t.Error("Unexpected agent path", kr.AgentPath())
+	}
+	// Cached - not downloaded again.
+	if err := kr.DownloadProxy(context.Background()); err != nil || gets != 1 {
+		t.Error("Expecting cached binary", gets, err)
+	}
+
+	os.Setenv("MESH_BINARY_SHA256", "pilot-agent="+strings.Repeat("0", 64))
+	if err := kr.DownloadProxy(context.Background()); err == nil || !strings.Contains(err.Error(), "mismatch") {
+		t.Error("Expecting digest mismatch", err)
+	}
+	files, _ := ioutil.ReadDir(filepath.Join(kr.BaseDir, "/var/lib/krun/bin"))
+	if len(files) != 1 {
+		t.Error("Unexpected files", len(files))
+	}
+}
+
+func TestOCIFetch(t *testing.T) {
+	var srv *httptest.Server
+	srv = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/token":
+			if r.URL.Query().Get("scope") != "repository:istio/proxy:pull" {
+				t.Error("Unexpected scope", r.URL.RawQuery)
+			}
+			w.Write([]byte(`{"token": "t1"}`))
+		case r.Header.Get("Authorization") != "Bearer t1":
+			w.Header().Set("WWW-Authenticate",
+				`Bearer realm="`+srv.URL+`/token",service="registry",scope="repository:istio/proxy:pull"`)
+			w.WriteHeader(401)
+		case r.URL.Path == "/v2/istio/proxy/manifests/1.11.2":
+			w.Write([]byte(`{"layers": [{"digest": "sha256:aaa", "annotations": {"` + ociTitleAnnotation + `": "envoy"}},
+{"digest": "sha256:bbb", "annotations": {"` + ociTitleAnnotation + `": "pilot-agent"}}]}`))
+		case r.URL.Path == "/v2/istio/proxy/blobs/sha256:bbb":
+			w.Write([]byte("agent"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+	old := http.DefaultClient
+	http.DefaultClient = srv.Client()
+	defer func() { http.DefaultClient = old }()
+
+	body, err := ociFetch(context.Background(), strings.TrimPrefix(srv.URL, "https://")+"/istio/proxy:1.11.2", "pilot-agent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := ioutil.ReadAll(body)
+	body.Close()
+	if string(data) != "agent" {
+		t.Error("Unexpected blob", string(data))
+	}
+}
+
+func TestGoogleRealm(t *testing.T) {
+	for _, c := range []struct {
+		host, realm string
+		res         bool
+	}{
+		{"gcr.io", "https://gcr.io/v2/token", true},
+		{"us-docker.pkg.dev", "https://us-docker.pkg.dev/v2/token", true},
+		{"eu.gcr.io:443", "https://eu.gcr.io/v2/token", true},
+		{"evilgcr.io", "https://gcr.io/v2/token", false},
+		{"gcr.io.evil.com", "https://gcr.io/v2/token", false},
+		{"gcr.io", "https://auth.evil.com/token", false},
+		{"gcr.io", "https://evilpkg.dev/token", false},
+		{"gcr.io", "http://gcr.io/v2/token", false},
+		{"docker.io", "https://auth.docker.io/token", false},
+	} {
+		if r := googleRealm(c.host, c.realm); r != c.res {
+			t.Error("Unexpected result", c, r)
+		}
+	}
+}
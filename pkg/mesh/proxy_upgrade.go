@@ -0,0 +1,375 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mesh
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Hot upgrade of the proxy binaries, without restarting the instance.
+//
+// With MESH_PROXY_UPGRADE=true krun checks MESH_PROXY_UPGRADE_DIR (default /var/lib/krun/upgrade) every
+// MESH_PROXY_UPGRADE_INTERVAL (default 60s). The directory is a mounted volume or is populated by a download, and
+// holds the new pilot-agent and/or envoy binaries and a SHA256SUMS file in the sha256sum format - binaries that are
+// not listed are ignored, and a digest mismatch aborts the upgrade. New binaries are copied to MESH_PROXY_CACHE_DIR
+// and verified there, so the upgrade dir can't change them after the check.
+//
+// When a binary differs from the running one, krun drains the Envoy listeners for MESH_PROXY_UPGRADE_DRAIN (default
+// 5s), stops the agent and starts a new one with the new binaries. The app keeps running - connections on the old
+// proxy are drained, new outbound connections fail until the new proxy is ready.
+//
+// POST /debug/upgrade on the debug port (with the admin token) checks the directory immediately.
+
+const sha256SumsFile = "SHA256SUMS"
+
+var upgradeBinaries = []string{"pilot-agent", "envoy"}
+
+type upgradeState struct {
+	m sync.Mutex
+
+	// running is the sha256 of the running binaries, by name.
+	running map[string]string
+
+	// restart is closed when the agent stopped for the upgrade exits.
+	restart chan struct{}
+
+	// inProgress prevents concurrent upgrades.
+	inProgress bool
+}
+
+// StartProxyUpgradeWatcher periodically checks for new proxy binaries, if MESH_PROXY_UPGRADE is enabled.
+func (kr *KRun) StartProxyUpgradeWatcher(ctx context.Context) {
+	if kr.Config("MESH_PROXY_UPGRADE", "") != "true" {
+		return
+	}
+	interval, err := time.ParseDuration(kr.Config("MESH_PROXY_UPGRADE_INTERVAL", "60s"))
+	if err != nil {
+		interval = 60 * time.Second
+	}
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(interval):
+			}
+			if _, err := kr.UpgradeProxy(ctx); err != nil {
+				log.Println("Proxy upgrade failed", err)
+			}
+		}
+	}()
+}
+
+func (kr *KRun) upgradeDir() string {
+	return kr.Config("MESH_PROXY_UPGRADE_DIR", filepath.Join(kr.BaseDir, "/var/lib/krun/upgrade"))
+}
+
+// pendingUpgrade returns the binaries in the upgrade dir that differ from the running ones. The binaries are
+// copied to the private cache dir, named by digest, and the returned paths are the verified copies.
+func (kr *KRun) pendingUpgrade() (map[string]string, error) {
+	dir := kr.upgradeDir()
+	sums, err := readSHA256Sums(filepath.Join(dir, sha256SumsFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	res := map[string]string{}
+	for _, name := range upgradeBinaries {
+		p := filepath.Join(dir, name)
+		expected := sums[name]
+		if len(expected) != 64 || !isExecutable(p) {
+			continue
+		}
+		if expected == kr.runningDigest(name) {
+			continue
+		}
+		dst, err := kr.stageBinary(p, name, expected)
+		if err != nil {
+			return nil, err
+		}
+		res[name] = dst
+	}
+	return res, nil
+}
+
+// stageBinary copies a binary to the cache dir, verifying the digest of the copy. An existing copy with the
+// same digest is reused.
+func (kr *KRun) stageBinary(src, name, digest string) (string, error) {
+	dir := kr.proxyCacheDir()
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	dst := cachedBinaryPath(dir, name, digest)
+	if d, err := fileSHA256(dst); err == nil && d == digest {
+		return dst, nil
+	}
+	f, err := os.Open(src)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	return dst, saveBinary(f, name, src, dst, digest)
+}
+
+// runningDigest returns the sha256 of the running binary.
+func (kr *KRun) runningDigest(name string) string {
+	kr.upgrade.m.Lock()
+	defer kr.upgrade.m.Unlock()
+	if d, f := kr.upgrade.running[name]; f {
+		return d
+	}
+	p := kr.AgentPath()
+	if name == "envoy" {
+		p = kr.EnvoyPath()
+	}
+	d := ""
+	if p != "" {
+		d, _ = fileSHA256(p)
+	}
+	if kr.upgrade.running == nil {
+		kr.upgrade.running = map[string]string{}
+	}
+	kr.upgrade.running[name] = d
+	return d
+}
+
+// UpgradeProxy restarts the agent if new binaries are available. Returns true if the proxy was upgraded.
+func (kr *KRun) UpgradeProxy(ctx context.Context) (bool, error) {
+	if !kr.lockAgent() {
+		return false, errors.New("upgrade in progress")
+	}
+	defer kr.unlockAgent()
+
+	bins, err := kr.pendingUpgrade()
+	if err != nil || len(bins) == 0 {
+		return false, err
+	}
+	if kr.agentCmd == nil || kr.agentCmd.Process == nil || kr.stopping() {
+		return false, errors.New("agent not running")
+	}
+	// The SHA256SUMS in the upgrade dir don't replace the pinned digests - check before draining the proxy.
+	for name, p := range bins {
+		if err := kr.VerifyBinary(name, p); err != nil {
+			return false, err
+		}
+	}
+	env := kr.agentEnv
+	if p := bins["envoy"]; p != "" {
+		env, err = withEnvoyBinary(env, p)
+		if err != nil {
+			return false, err
+		}
+	}
+	t0 := time.Now()
+	log.Println("Proxy upgrade started", "binaries", bins)
+
+	drain, err := time.ParseDuration(kr.Config("MESH_PROXY_UPGRADE_DRAIN", "5s"))
+	if err != nil {
+		drain = 5 * time.Second
+	}
+	if err := envoyAdminPost(ctx, "/drain_listeners?graceful"); err != nil {
+		log.Println("Failed to drain listeners", err)
+	} else {
+		select {
+		case <-ctx.Done():
+			return false, ctx.Err()
+		case <-time.After(drain):
+		}
+	}
+
+	if err := kr.restartAgent(env, bins); err != nil {
+		return false, err
+	}
+	// Used by later restarts - only set once the new agent was started.
+	if p := bins["pilot-agent"]; p != "" {
+		kr.SetFlagConfig("PILOT_AGENT_BINARY", p)
+	}
+	if p := bins["envoy"]; p != "" {
+		kr.SetFlagConfig("ENVOY_BINARY", p)
+	}
+
+	kr.upgrade.m.Lock()
+	for name, p := range bins {
+		d, _ := fileSHA256(p)
+		kr.upgrade.running[name] = d
+	}
+	kr.upgrade.m.Unlock()
+	log.Println("Proxy upgraded", "binaries", bins, "duration", time.Since(t0))
+	return true, nil
+}
+
+// lockAgent prevents concurrent upgrades and restarts of the agent. Returns false if one is in progress.
+func (kr *KRun) lockAgent() bool {
+	kr.upgrade.m.Lock()
+	defer kr.upgrade.m.Unlock()
+	if kr.upgrade.inProgress {
+		return false
+	}
+	kr.upgrade.inProgress = true
+	return true
+}
+
+func (kr *KRun) unlockAgent() {
+	kr.upgrade.m.Lock()
+	kr.upgrade.inProgress = false
+	kr.upgrade.m.Unlock()
+}
+
+// restartAgent stops the running agent and starts a new one with env. Must be called with lockAgent held.
+// bins replaces the configured pilot-agent or envoy binaries, for upgrades. The binaries are verified first - the
+// running agent is not stopped if they don't match the pinned digests.
+func (kr *KRun) restartAgent(env []string, bins map[string]string) error {
+	agent := bins["pilot-agent"]
+	if agent == "" {
+		agent = kr.AgentPath()
+	}
+	envoy := bins["envoy"]
+	if envoy == "" {
+		envoy = kr.EnvoyPath()
+	}
+	if err := kr.VerifyBinary("pilot-agent", agent); err != nil {
+		return err
+	}
+	if envoy != "" {
+		if err := kr.VerifyBinary("envoy", envoy); err != nil {
+			return err
+		}
+	}
+	done := make(chan struct{})
+	kr.upgrade.m.Lock()
+	kr.upgrade.restart = done
+	kr.upgrade.m.Unlock()
+	kr.agentCmd.Process.Signal(syscall.SIGTERM)
+	select {
+	case <-done:
+	case <-time.After(30 * time.Second):
+		kr.agentCmd.Process.Kill()
+		<-done
+	}
+
+	cmd := kr.agentCommand()
+	if p := bins["pilot-agent"]; p != "" {
+		cmd = exec.Command(p, cmd.Args[1:]...)
+	}
+	started, err := kr.prepareAgentCommand(cmd, env)
+	if err != nil {
+		return err
+	}
+	kr.agentEnv = env
+	go kr.runAgent(cmd, started)
+	return nil
+}
+
+// agentRestarting returns the channel to close if the agent was stopped for an upgrade, or nil.
+func (kr *KRun) agentRestarting() chan struct{} {
+	kr.upgrade.m.Lock()
+	defer kr.upgrade.m.Unlock()
+	c := kr.upgrade.restart
+	kr.upgrade.restart = nil
+	return c
+}
+
+// withEnvoyBinary sets the binaryPath in the PROXY_CONFIG. Only JSON PROXY_CONFIG can be updated.
+func withEnvoyBinary(env []string, path string) ([]string, error) {
+	res := make([]string, 0, len(env)+1)
+	pc := map[string]interface{}{}
+	for _, e := range env {
+		if strings.HasPrefix(e, "PROXY_CONFIG=") {
+			if err := json.Unmarshal([]byte(strings.TrimPrefix(e, "PROXY_CONFIG=")), &pc); err != nil {
+				return nil, errors.New("PROXY_CONFIG is not JSON, can't upgrade envoy")
+			}
+			continue
+		}
+		res = append(res, e)
+	}
+	pc["binaryPath"] = path
+	data, err := json.Marshal(pc)
+	if err != nil {
+		return nil, err
+	}
+	return append(res, "PROXY_CONFIG="+string(data)), nil
+}
+
+// readSHA256Sums parses a file in the sha256sum format, returning the digest by file name.
+func readSHA256Sums(file string) (map[string]string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	res := map[string]string{}
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		parts := strings.Fields(s.Text())
+		if len(parts) != 2 {
+			continue
+		}
+		// Binary mode marker
+		res[filepath.Base(strings.TrimPrefix(parts[1], "*"))] = strings.ToLower(parts[0])
+	}
+	return res, s.Err()
+}
+
+func envoyAdminPost(ctx context.Context, path string) error {
+	req, _ := http.NewRequestWithContext(ctx, "POST", "http://"+envoyAdmin+path, nil)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode != 200 {
+		return fmt.Errorf("envoy admin %s: %s", path, res.Status)
+	}
+	return nil
+}
+
+// handleUpgrade checks for new proxy binaries, and upgrades the proxy. Requires the admin token.
+func (kr *KRun) handleUpgrade(token string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !adminAuthorized(r, token) {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if r.Method != "POST" {
+			http.Error(w, "POST required", http.StatusMethodNotAllowed)
+			return
+		}
+		ok, err := kr.UpgradeProxy(r.Context())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !ok {
+			w.Write([]byte("No upgrade available\n"))
+			return
+		}
+		w.Write([]byte("Proxy upgraded\n"))
+	}
+}
@@ -0,0 +1,109 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mesh
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestPendingUpgrade(t *testing.T) {
+	dir := t.TempDir()
+	kr := New()
+	kr.BaseDir = dir
+	cur := filepath.Join(dir, "pilot-agent")
+	ioutil.WriteFile(cur, []byte("#!/bin/sh\necho old\n"), 0755)
+	kr.SetFlagConfig("PILOT_AGENT_BINARY", cur)
+
+	up := kr.upgradeDir()
+	os.MkdirAll(up, 0755)
+	if bins, err := kr.pendingUpgrade(); err != nil || len(bins) != 0 {
+		t.Fatal("Expecting no upgrade without SHA256SUMS", bins, err)
+	}
+
+	// Same binary - nothing to do.
+	ioutil.WriteFile(filepath.Join(up, "pilot-agent"), []byte("#!/bin/sh\necho old\n"), 0755)
+	d, _ := fileSHA256(cur)
+	ioutil.WriteFile(filepath.Join(up, sha256SumsFile), []byte(d+"  pilot-agent\n"), 0644)
+	if bins, err := kr.pendingUpgrade(); err != nil || len(bins) != 0 {
+		t.Fatal("Expecting no upgrade for the running binary", bins, err)
+	}
+
+	// The binary doesn't match SHA256SUMS.
+	ioutil.WriteFile(filepath.Join(up, "pilot-agent"), []byte("#!/bin/sh\necho new\n"), 0755)
+	ioutil.WriteFile(filepath.Join(up, sha256SumsFile), []byte(strings.Repeat("0", 64)+"  pilot-agent\n"), 0644)
+	if _, err := kr.pendingUpgrade(); err == nil || !strings.Contains(err.Error(), "mismatch") {
+		t.Fatal("Expecting digest mismatch", err)
+	}
+	nd, _ := fileSHA256(filepath.Join(up, "pilot-agent"))
+	ioutil.WriteFile(filepath.Join(up, sha256SumsFile), []byte(nd+" *pilot-agent\n"), 0644)
+	bins, err := kr.pendingUpgrade()
+	staged := cachedBinaryPath(kr.proxyCacheDir(), "pilot-agent", nd)
+	if err != nil || bins["pilot-agent"] != staged || len(bins) != 1 {
+		t.Fatal("Expecting agent upgrade", bins, err)
+	}
+	// The verified copy is used - changes in the upgrade dir after the check don't affect it.
+	ioutil.WriteFile(filepath.Join(up, "pilot-agent"), []byte("#!/bin/sh\necho replaced\n"), 0755)
+	if sd, _ := fileSHA256(staged); sd != nd || !isExecutable(staged) {
+		t.Error("Unexpected staged binary", sd)
+	}
+	ioutil.WriteFile(filepath.Join(up, "pilot-agent"), []byte("#!/bin/sh\necho new\n"), 0755)
+
+	// The agent is not running.
+	if ok, err := kr.UpgradeProxy(context.Background()); ok || err == nil {
+		t.Error("Expecting error without agent", ok, err)
+	}
+
+	// The new binary must match the pinned digest, even if it matches SHA256SUMS. The agent is not stopped.
+	agent := exec.Command("sleep", "10")
+	if err := agent.Start(); err != nil {
+		t.Skip("sleep not available", err)
+	}
+	defer agent.Process.Kill()
+	kr.agentCmd = agent
+	os.Setenv("MESH_BINARY_SHA256", "pilot-agent="+d)
+	defer os.Unsetenv("MESH_BINARY_SHA256")
+	if ok, err := kr.UpgradeProxy(context.Background()); ok || err == nil || !strings.Contains(err.Error(), "mismatch") {
+		t.Error("Expecting pinned digest mismatch", ok, err)
+	}
+	if err := agent.Process.Signal(syscall.Signal(0)); err != nil {
+		t.Error("Agent stopped", err)
+	}
+	if kr.AgentPath() != cur {
+		t.Error("Unexpected agent path", kr.AgentPath())
+	}
+	if p := kr.Provenance(); p.Verified["pilot-agent"] == nd {
+		t.Error("Unpinned binary marked as verified", p.Verified)
+	}
+}
+
+func TestWithEnvoyBinary(t *testing.T) {
+	env, err := withEnvoyBinary([]string{"A=b", `PROXY_CONFIG={"discoveryAddress": "istiod:15012"}`}, "/new/envoy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(env) != 2 || env[1] != `PROXY_CONFIG={"binaryPath":"/new/envoy","discoveryAddress":"istiod:15012"}` {
+		t.Error("Unexpected env", env)
+	}
+	if _, err := withEnvoyBinary([]string{"PROXY_CONFIG=discoveryAddress: istiod:15012"}, "/new/envoy"); err == nil {
+		t.Error("Expecting error for YAML PROXY_CONFIG")
+	}
+}
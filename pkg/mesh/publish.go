@@ -0,0 +1,81 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mesh
+
+import (
+	"context"
+	"errors"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// PublishService creates a Service in the config cluster for the CloudRun service, so in-cluster workloads can
+// use a stable NAME.NAMESPACE.svc.cluster.local name. Enabled with MESH_PUBLISH_SERVICE=true.
+//
+// - MESH_SERVICE_NAME - the Service name, defaults to the workload name.
+// - MESH_SERVICE_ADDR - comma separated IPs of an internal load balancer for the CloudRun service. If set, the
+// Service has an EndpointSlice with the addresses.
+// - MESH_SERVICE_HOST - if no ILB is used, an ExternalName Service is created with this host. Defaults to the
+// CloudRun hostname, K_SERVICE + CLOUDRUN_URL_SUFFIX, if the suffix is set.
+// - MESH_SERVICE_PORTS - comma separated name:port list, default http:80.
+//
+// All instances publish the same content - updates are skipped if nothing changed.
+func (kr *KRun) PublishService(ctx context.Context) error {
+	if kr.Config("MESH_PUBLISH_SERVICE", "") != "true" || kr.Knative {
+		return nil
+	}
+	sp, ok := kr.Cfg.(ServicePublisher)
+	if !ok {
+		return errors.New("config source doesn't support publishing services")
+	}
+	name := kr.Config("MESH_SERVICE_NAME", kr.Name)
+	addrs := splitList(kr.Config("MESH_SERVICE_ADDR", ""))
+	host := kr.Config("MESH_SERVICE_HOST", "")
+	if suffix := kr.Config("CLOUDRUN_URL_SUFFIX", ""); host == "" && os.Getenv("K_SERVICE") != "" && suffix != "" {
+		host = os.Getenv("K_SERVICE") + suffix
+	}
+	if len(addrs) == 0 && host == "" {
+		return errors.New("MESH_SERVICE_ADDR or MESH_SERVICE_HOST required")
+	}
+	ports, err := parseServicePorts(kr.Config("MESH_SERVICE_PORTS", "http:80"))
+	if err != nil {
+		return err
+	}
+	err = sp.PublishService(ctx, kr.Namespace, name, ports, addrs, host)
+	if err != nil {
+		return err
+	}
+	log.Println("Published service", "name", name, "ns", kr.Namespace, "addrs", addrs, "host", host, "ports", ports)
+	return nil
+}
+
+// parseServicePorts parses a name:port list.
+func parseServicePorts(s string) (map[string]int32, error) {
+	res := map[string]int32{}
+	for _, np := range splitList(s) {
+		parts := strings.SplitN(np, ":", 2)
+		if len(parts) != 2 {
+			return nil, errors.New("invalid port " + np + ", expecting name:port")
+		}
+		p, err := strconv.Atoi(parts[1])
+		if err != nil || p <= 0 || p > 65535 {
+			return nil, errors.New("invalid port " + np)
+		}
+		res[parts[0]] = int32(p)
+	}
+	return res, nil
+}
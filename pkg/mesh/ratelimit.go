@@ -0,0 +1,48 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mesh
+
+import (
+	"log"
+	"strconv"
+
+	"github.com/GoogleCloudPlatform/cloud-run-mesh/pkg/hbone"
+)
+
+// Local rate limit for requests arriving on the CloudRun port.
+//
+// During cold start the frontend may queue and retry many requests on the first instances. MESH_RATE_LIMIT sets
+// the requests per second accepted by krun, with MESH_RATE_LIMIT_BURST (default: the rate) and optionally a
+// separate bucket for each client IP (MESH_RATE_LIMIT_PER_CLIENT, the address added by the frontend). Rejected
+// requests get a 429 with Retry-After. Health checks, probes and mTLS tunnels are not limited - Envoy enforces its
+// own limits.
+
+// RateLimiter returns the limiter for the serving port, or nil if MESH_RATE_LIMIT is not set.
+func (kr *KRun) RateLimiter() *hbone.RateLimiter {
+	v := kr.Config("MESH_RATE_LIMIT", "")
+	if v == "" {
+		return nil
+	}
+	rps, err := strconv.ParseFloat(v, 64)
+	if err != nil || rps <= 0 {
+		log.Println("Invalid MESH_RATE_LIMIT, ignored", v)
+		return nil
+	}
+	burst, _ := strconv.Atoi(kr.Config("MESH_RATE_LIMIT_BURST", ""))
+	perClient := kr.Config("MESH_RATE_LIMIT_PER_CLIENT", "") == "true"
+	rl := hbone.NewRateLimiter(rps, burst, perClient)
+	log.Println("Rate limit", "rps", rps, "burst", rl.Burst, "per_client", perClient)
+	return rl
+}
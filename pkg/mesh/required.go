@@ -0,0 +1,138 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mesh
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"time"
+)
+
+// Fail-closed mode, for workloads where plaintext egress is a compliance violation.
+//
+// By default krun is best effort: if certificates or tokens can't be created, or the proxy can't reach XDS,
+// the app is started anyway and may send traffic outside the mesh. With MESH_REQUIRED=strict the app is not
+// started unless, within MESH_REQUIRED_TIMEOUT (default 60s):
+// - a workload certificate is available, to krun or to Envoy
+// - the tokens for the agent are saved
+// - the proxy is ready, which requires XDS config - or XDS_ADDR is reachable for proxyless gRPC
+// - outbound traffic is captured, using iptables or MESH_ROOTLESS
+
+// Strict returns true if MESH_REQUIRED=strict.
+func (kr *KRun) Strict() bool {
+	return kr.Config("MESH_REQUIRED", "") == "strict"
+}
+
+// RequiredTimeout is the deadline for the mesh to be ready, in strict mode.
+func (kr *KRun) RequiredTimeout() time.Duration {
+	d, err := time.ParseDuration(kr.Config("MESH_REQUIRED_TIMEOUT", "60s"))
+	if err != nil || d <= 0 {
+		return 60 * time.Second
+	}
+	return d
+}
+
+// CheckRequired verifies the mesh is usable, retrying until the deadline. Returns the last error if the
+// certificates, tokens, XDS or interception are still missing. proxy is true if Envoy is used.
+func (kr *KRun) CheckRequired(ctx context.Context, proxy bool) error {
+	deadline := kr.StartTime.Add(kr.RequiredTimeout())
+	if time.Until(deadline) < 5*time.Second {
+		// At least one retry window, if the startup took longer than the timeout.
+		deadline = time.Now().Add(5 * time.Second)
+	}
+	for {
+		err := kr.checkRequired(ctx, proxy)
+		if err == nil {
+			log.Println("Mesh required checks passed", "time", time.Since(kr.StartTime))
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(1 * time.Second):
+		}
+	}
+}
+
+func (kr *KRun) checkRequired(ctx context.Context, proxy bool) error {
+	if proxy {
+		if err := checkHTTPOK(ctx, "http://127.0.0.1:15021/healthz/ready"); err != nil {
+			return fmt.Errorf("proxy not ready, no XDS config: %v", err)
+		}
+		if kr.WhiteboxMode && !kr.Rootless() {
+			return errors.New("no traffic capture, iptables not available and MESH_ROOTLESS not set")
+		}
+	} else {
+		if kr.XDSAddr == "" || kr.XDSAddr == "-" {
+			return errors.New("no mesh proxy and no XDS_ADDR")
+		}
+		dctx, cf := context.WithTimeout(ctx, 2*time.Second)
+		var c net.Conn
+		var err error
+		if h := kr.hedgedDialer(); h != nil {
+			c, err = h.DialContext(dctx, kr.XDSAddr)
+		} else {
+			c, err = (&net.Dialer{}).DialContext(dctx, "tcp", kr.XDSAddr)
+		}
+		cf()
+		if err != nil {
+			return fmt.Errorf("XDS not reachable: %v", err)
+		}
+		c.Close()
+	}
+
+	if kr.X509KeyPair == nil {
+		if !proxy {
+			return errors.New("no workload certificate")
+		}
+		exp, err := envoyCertExpiry(ctx)
+		if err != nil {
+			return fmt.Errorf("no workload certificate in krun or Envoy: %v", err)
+		}
+		if exp.Before(time.Now()) {
+			return errors.New("workload certificate expired")
+		}
+	}
+
+	for aud, f := range kr.Aud2File {
+		if fi, err := os.Stat(f); err != nil || fi.Size() == 0 {
+			return fmt.Errorf("token for %s not saved: %v", aud, err)
+		}
+	}
+	return nil
+}
+
+func checkHTTPOK(ctx context.Context, url string) error {
+	ctx, cf := context.WithTimeout(ctx, 2*time.Second)
+	defer cf()
+	req, _ := http.NewRequestWithContext(ctx, "GET", url, nil)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode != 200 {
+		return fmt.Errorf("status %d", res.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,57 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mesh
+
+import (
+	"context"
+	"crypto/tls"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCheckRequiredProxyless(t *testing.T) {
+	kr := New()
+	ctx := context.Background()
+
+	kr.XDSAddr = "-"
+	if err := kr.checkRequired(ctx, false); err == nil || !strings.Contains(err.Error(), "XDS") {
+		t.Error("Expecting XDS error", err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	kr.XDSAddr = l.Addr().String()
+	if err := kr.checkRequired(ctx, false); err == nil || !strings.Contains(err.Error(), "certificate") {
+		t.Error("Expecting certificate error", err)
+	}
+
+	kr.X509KeyPair = &tls.Certificate{}
+	tf := filepath.Join(t.TempDir(), "istio-token")
+	kr.Aud2File["istio-ca"] = tf
+	if err := kr.checkRequired(ctx, false); err == nil || !strings.Contains(err.Error(), "token") {
+		t.Error("Expecting token error", err)
+	}
+
+	ioutil.WriteFile(tf, []byte("token"), 0600)
+	if err := kr.checkRequired(ctx, false); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,177 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mesh
+
+import (
+	"context"
+	"errors"
+	"log"
+	"math/rand"
+	"sort"
+	"time"
+)
+
+// Retries for control plane calls.
+//
+// Cold starts may hit transient errors or slow responses from the K8s API, the metadata server and the token
+// endpoints. Config map reads, token requests and cluster discovery use the same policy:
+// - MESH_RETRY_DEADLINE - total time for a call, including retries, default 20s.
+// - MESH_RETRY_ATTEMPT_TIMEOUT - timeout for each attempt, default 5s - a hung request is retried.
+// - MESH_RETRY_BACKOFF - delay after the first failure, doubled after each attempt with 20% jitter, default 250ms.
+// - MESH_RETRY_MAX_BACKOFF - max delay between attempts, default 4s.
+//
+// Errors wrapped with Permanent - not found, permission denied - are returned without retry. The attempts per
+// operation are in /debug/status, and exported as krun/retries with the startup metrics.
+
+// RetryPolicy holds the retry settings.
+type RetryPolicy struct {
+	Deadline       time.Duration
+	AttemptTimeout time.Duration
+	Backoff        time.Duration
+	MaxBackoff     time.Duration
+}
+
+// RetryStats counts the calls for one operation.
+type RetryStats struct {
+	Calls    int `json:"calls"`
+	Retries  int `json:"retries"`
+	Failures int `json:"failures"`
+}
+
+type permanentError struct {
+	error
+}
+
+// Permanent marks an error that should not be retried.
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &permanentError{err}
+}
+
+// RetryPolicy returns the policy from the config.
+func (kr *KRun) RetryPolicy() *RetryPolicy {
+	return &RetryPolicy{
+		Deadline:       kr.configDuration("MESH_RETRY_DEADLINE", 20*time.Second),
+		AttemptTimeout: kr.configDuration("MESH_RETRY_ATTEMPT_TIMEOUT", 5*time.Second),
+		Backoff:        kr.configDuration("MESH_RETRY_BACKOFF", 250*time.Millisecond),
+		MaxBackoff:     kr.configDuration("MESH_RETRY_MAX_BACKOFF", 4*time.Second),
+	}
+}
+
+func (kr *KRun) configDuration(name string, def time.Duration) time.Duration {
+	d, err := time.ParseDuration(kr.Config(name, def.String()))
+	if err != nil || d <= 0 {
+		return def
+	}
+	return d
+}
+
+// Retry calls f until it succeeds, returns a Permanent error or the deadline expires. The context passed to f
+// has the attempt timeout. Returns the last error.
+func (kr *KRun) Retry(ctx context.Context, op string, f func(ctx context.Context) error) error {
+	p := kr.RetryPolicy()
+	ctx, cf := context.WithTimeout(ctx, p.Deadline)
+	defer cf()
+	backoff := p.Backoff
+	retries := 0
+	var err error
+	for {
+		actx, acf := context.WithTimeout(ctx, p.AttemptTimeout)
+		err = f(actx)
+		acf()
+		var pe *permanentError
+		if err == nil || errors.As(err, &pe) {
+			if pe != nil {
+				err = pe.error
+			}
+			break
+		}
+		d := time.Duration(float64(backoff) * (0.8 + 0.4*rand.Float64()))
+		if dl, _ := ctx.Deadline(); time.Until(dl) < d {
+			break
+		}
+		log.Println("Retrying", "op", op, "attempt", retries+1, "backoff", d, "err", err)
+		select {
+		case <-ctx.Done():
+		case <-time.After(d):
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		retries++
+		if backoff *= 2; backoff > p.MaxBackoff {
+			backoff = p.MaxBackoff
+		}
+	}
+	kr.recordRetry(op, retries, err)
+	return err
+}
+
+func (kr *KRun) recordRetry(op string, retries int, err error) {
+	kr.retryM.Lock()
+	defer kr.retryM.Unlock()
+	if kr.retries == nil {
+		kr.retries = map[string]*RetryStats{}
+	}
+	s := kr.retries[op]
+	if s == nil {
+		s = &RetryStats{}
+		kr.retries[op] = s
+	}
+	s.Calls++
+	s.Retries += retries
+	if err != nil {
+		s.Failures++
+	}
+}
+
+// RetryStats returns the retry totals by operation.
+func (kr *KRun) RetryStats() map[string]RetryStats {
+	kr.retryM.Lock()
+	defer kr.retryM.Unlock()
+	res := map[string]RetryStats{}
+	for k, v := range kr.retries {
+		res[k] = *v
+	}
+	return res
+}
+
+// retryMetrics returns the totals as krun/retries counters.
+func (kr *KRun) retryMetrics() []Metric {
+	stats := kr.RetryStats()
+	ops := []string{}
+	for op := range stats {
+		ops = append(ops, op)
+	}
+	sort.Strings(ops)
+	ml := []Metric{}
+	for _, op := range ops {
+		s := stats[op]
+		for _, r := range []struct {
+			name string
+			v    int
+		}{{"call", s.Calls}, {"retry", s.Retries}, {"failure", s.Failures}} {
+			ml = append(ml, Metric{
+				Name:    "krun/retries",
+				Labels:  map[string]string{"op": op, "type": r.name},
+				Value:   float64(r.v),
+				Counter: true,
+			})
+		}
+	}
+	return ml
+}
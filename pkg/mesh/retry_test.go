@@ -0,0 +1,75 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mesh
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestRetry(t *testing.T) {
+	os.Setenv("MESH_RETRY_BACKOFF", "1ms")
+	defer os.Unsetenv("MESH_RETRY_BACKOFF")
+	kr := New()
+
+	n := 0
+	err := kr.Retry(context.Background(), "test", func(ctx context.Context) error {
+		n++
+		if n < 3 {
+			return errors.New("transient")
+		}
+		return nil
+	})
+	if err != nil || n != 3 {
+		t.Error("Expecting success after 3 attempts", n, err)
+	}
+
+	perm := errors.New("forbidden")
+	n = 0
+	err = kr.Retry(context.Background(), "test", func(ctx context.Context) error {
+		n++
+		return Permanent(perm)
+	})
+	if err != perm || n != 1 {
+		t.Error("Expecting no retry for permanent errors", n, err)
+	}
+
+	os.Setenv("MESH_RETRY_DEADLINE", "50ms")
+	defer os.Unsetenv("MESH_RETRY_DEADLINE")
+	os.Setenv("MESH_RETRY_ATTEMPT_TIMEOUT", "10ms")
+	defer os.Unsetenv("MESH_RETRY_ATTEMPT_TIMEOUT")
+	t0 := time.Now()
+	err = kr.Retry(context.Background(), "hang", func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	if err == nil || time.Since(t0) > 1*time.Second {
+		t.Error("Expecting attempt timeout and deadline", err, time.Since(t0))
+	}
+
+	st := kr.RetryStats()
+	if s := st["test"]; s.Calls != 2 || s.Retries != 2 || s.Failures != 1 {
+		t.Error("Unexpected stats", s)
+	}
+	if s := st["hang"]; s.Calls != 1 || s.Retries == 0 || s.Failures != 1 {
+		t.Error("Unexpected stats", s)
+	}
+	if ml := kr.retryMetrics(); len(ml) != 6 || ml[0].Labels["op"] != "hang" || !ml[0].Counter {
+		t.Error("Unexpected metrics", ml)
+	}
+}
@@ -0,0 +1,303 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mesh
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/GoogleCloudPlatform/cloud-run-mesh/pkg/hbone"
+)
+
+// Rootless mode provides mTLS to mesh destinations without iptables, when krun is not running as root.
+//
+// Without root there is no traffic capture - the app uses the mesh only if it is configured to use the proxy.
+// With MESH_ROOTLESS=true krun will:
+// - listen on MESH_ROOTLESS_PROXY_ADDR (default 127.0.0.1:15084) as a HTTP proxy, and set HTTPS_PROXY for the app.
+// CONNECT requests for mesh hosts are tunneled over HBONE, other hosts are dialed directly. If Envoy is not
+// running, HTTP_PROXY is also set - otherwise plain HTTP keeps using the Envoy whitebox listener.
+// - listen on a local port for each upstream declared in MESH_UPSTREAMS, forwarding to the mesh destination.
+//
+// Mesh streams use the workload certificate and are sent to the east-west gateway at MESH_ROOTLESS_GATEWAY
+// (default HBONE_REVERSE_GATEWAY), which resolves the service names.
+
+// Upstream is a mesh destination declared in MESH_UPSTREAMS.
+type Upstream struct {
+	// Local is the address where the app connects - 127.0.0.1:port
+	Local string
+
+	// Dest is the mesh destination, as host:port.
+	Dest string
+}
+
+// ParseUpstreams parses a comma separated list of upstreams, in the form 'host:port' or 'localPort=host:port'.
+// If the local port is not set the port of the destination is used - or port + 10000 for privileged ports.
+func ParseUpstreams(s string) ([]*Upstream, error) {
+	res := []*Upstream{}
+	for _, u := range splitList(s) {
+		local := ""
+		if i := strings.Index(u, "="); i >= 0 {
+			local = u[0:i]
+			u = u[i+1:]
+		}
+		host, port, err := net.SplitHostPort(u)
+		if err != nil || host == "" {
+			return nil, fmt.Errorf("invalid upstream %q, expecting host:port", u)
+		}
+		p, err := strconv.Atoi(port)
+		if err != nil || p <= 0 || p > 65535 {
+			return nil, fmt.Errorf("invalid upstream port %q", u)
+		}
+		if local == "" {
+			if p < 1024 {
+				p += 10000
+			}
+			local = strconv.Itoa(p)
+		}
+		if !strings.Contains(local, ":") {
+			local = "127.0.0.1:" + local
+		}
+		res = append(res, &Upstream{Local: local, Dest: u})
+	}
+	return res, nil
+}
+
+// Rootless returns true if the local forwarders should be used instead of iptables.
+func (kr *KRun) Rootless() bool {
+	return kr.Config("MESH_ROOTLESS", "") == "true"
+}
+
+// rootlessProxy forwards the app streams to mesh destinations over HBONE, and to other destinations directly.
+type rootlessProxy struct {
+	// dialMesh opens a stream to a mesh destination (host:port).
+	dialMesh func(ctx context.Context, dest string) (net.Conn, error)
+
+	// upstreams are the declared mesh destinations.
+	upstreams []*Upstream
+
+	// allow, if set, checks the outbound policy for a destination - see outboundAllowed.
+	allow func(dest string, mesh bool) error
+
+	// connectTimeout is the dial timeout, MESH_OUTBOUND_CONNECT_TIMEOUT.
+	connectTimeout time.Duration
+
+	rp *httputil.ReverseProxy
+}
+
+// StartRootless starts the HTTP proxy and local forwarders, if MESH_ROOTLESS is set. Must be called before
+// StartApp - the app env is updated with the proxy settings.
+func (kr *KRun) StartRootless() error {
+	if !kr.Rootless() {
+		if os.Getuid() != 0 {
+			log.Println("Not running as root, no traffic capture - only HTTP_PROXY traffic uses the mesh. " +
+				"Set MESH_ROOTLESS=true for the local forwarders")
+		}
+		return nil
+	}
+	ups, err := ParseUpstreams(kr.Config("MESH_UPSTREAMS", ""))
+	if err != nil {
+		return err
+	}
+	gw := kr.Config("MESH_ROOTLESS_GATEWAY", kr.Config("HBONE_REVERSE_GATEWAY", ""))
+	if gw == "" {
+		return errors.New("rootless mode requires MESH_ROOTLESS_GATEWAY or HBONE_REVERSE_GATEWAY")
+	}
+	if kr.X509KeyPair == nil {
+		return errors.New("rootless mode requires workload certificates, CA_POOL must be set")
+	}
+	if p := kr.outboundPolicy(); p != "" && kr.Config("MESH_XDS_CLIENT", "") != "true" {
+		return errors.New("MESH_OUTBOUND_POLICY requires MESH_XDS_CLIENT=true")
+	}
+	hb := hbone.New()
+	hb.Cert = kr.X509KeyPair
+	hb.MeshRoots = kr.TrustedCertPool
+	hb.SetKeepAlive(kr.KeepAlive())
+
+	rp := newRootlessProxy(ups, func(ctx context.Context, dest string) (net.Conn, error) {
+		return hb.DialVia(ctx, gw, dest)
+	})
+	if kr.outboundPolicy() != "" {
+		rp.allow = kr.outboundAllowed
+	}
+	rp.connectTimeout = kr.configDuration("MESH_OUTBOUND_CONNECT_TIMEOUT", rp.connectTimeout)
+	for _, u := range ups {
+		l, err := net.Listen("tcp", u.Local)
+		if err != nil {
+			return err
+		}
+		dest := u.Dest
+		go hbone.ServeListener(l, func(c net.Conn) {
+			rp.forward(c, dest)
+		})
+	}
+
+	addr := kr.Config("MESH_ROOTLESS_PROXY_ADDR", "127.0.0.1:15084")
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	go http.Serve(l, rp)
+
+	kr.rootlessEnv = []string{"HTTPS_PROXY=" + addr, "https_proxy=" + addr,
+		"NO_PROXY=localhost,127.0.0.1,169.254.169.254,metadata.google.internal",
+		"no_proxy=localhost,127.0.0.1,169.254.169.254,metadata.google.internal"}
+	if !kr.WhiteboxMode {
+		// No Envoy whitebox listener for plain HTTP.
+		kr.rootlessEnv = append(kr.rootlessEnv, "HTTP_PROXY="+addr, "http_proxy="+addr)
+	}
+	log.Println("Rootless mode", "proxy", addr, "gateway", gw, "upstreams", len(ups), "policy", kr.outboundPolicy())
+	return nil
+}
+
+func newRootlessProxy(ups []*Upstream, dialMesh func(ctx context.Context, dest string) (net.Conn, error)) *rootlessProxy {
+	rp := &rootlessProxy{upstreams: ups, dialMesh: dialMesh, connectTimeout: 10 * time.Second}
+	rp.rp = &httputil.ReverseProxy{
+		Director: func(r *http.Request) {},
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return rp.dial(ctx, addr)
+			},
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			log.Println("rootless", "dest", r.URL.Host, "err", err)
+			w.WriteHeader(proxyErrorCode(err))
+		},
+	}
+	return rp
+}
+
+// isMesh returns true if the destination should use the mesh.
+func (rp *rootlessProxy) isMesh(dest string) bool {
+	host, _, err := net.SplitHostPort(dest)
+	if err != nil {
+		host = dest
+	}
+	if strings.HasSuffix(host, ".svc.cluster.local") || strings.HasSuffix(host, ".svc") {
+		return true
+	}
+	for _, u := range rp.upstreams {
+		if u.Dest == dest {
+			return true
+		}
+	}
+	return false
+}
+
+func (rp *rootlessProxy) dial(ctx context.Context, dest string) (net.Conn, error) {
+	mesh := rp.isMesh(dest)
+	if rp.allow != nil {
+		if err := rp.allow(dest, mesh); err != nil {
+			return nil, err
+		}
+	}
+	if mesh {
+		return rp.dialMesh(ctx, dest)
+	}
+	d := &net.Dialer{}
+	return d.DialContext(ctx, "tcp", dest)
+}
+
+// ServeHTTP handles CONNECT and absolute-URL requests from the app.
+func (rp *rootlessProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodConnect {
+		if r.URL.Host == "" {
+			http.Error(w, "not a proxy request", http.StatusBadRequest)
+			return
+		}
+		rp.rp.ServeHTTP(w, r)
+		return
+	}
+	ctx, cf := context.WithTimeout(r.Context(), rp.connectTimeout)
+	oc, err := rp.dial(ctx, r.Host)
+	cf()
+	if err != nil {
+		log.Println("rootless", "dest", r.Host, "err", err)
+		http.Error(w, err.Error(), proxyErrorCode(err))
+		return
+	}
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		oc.Close()
+		http.Error(w, "hijack not supported", http.StatusInternalServerError)
+		return
+	}
+	c, brw, err := hj.Hijack()
+	if err != nil {
+		oc.Close()
+		return
+	}
+	brw.WriteString("HTTP/1.1 200 Connection established\r\n\r\n")
+	brw.Flush()
+	rp.proxy(&bufferedConn{Conn: c, r: brw.Reader}, oc)
+}
+
+// forward handles a connection accepted on the local port of an upstream.
+func (rp *rootlessProxy) forward(c net.Conn, dest string) {
+	if rp.allow != nil {
+		if err := rp.allow(dest, true); err != nil {
+			log.Println("rootless", "dest", dest, "err", err)
+			c.Close()
+			return
+		}
+	}
+	ctx, cf := context.WithTimeout(context.Background(), rp.connectTimeout)
+	oc, err := rp.dialMesh(ctx, dest)
+	cf()
+	if err != nil {
+		log.Println("rootless", "dest", dest, "err", err)
+		c.Close()
+		return
+	}
+	rp.proxy(c, oc)
+}
+
+// proxyErrorCode returns 403 for destinations denied by the outbound policy, 502 for other dial errors.
+func proxyErrorCode(err error) int {
+	if errors.Is(err, errOutboundDenied) {
+		return http.StatusForbidden
+	}
+	return http.StatusBadGateway
+}
+
+func (rp *rootlessProxy) proxy(c net.Conn, oc net.Conn) {
+	defer c.Close()
+	defer oc.Close()
+	s1 := hbone.Stream{ID: "rootless-o", Src: c, Dst: oc}
+	ch := make(chan int)
+	go s1.CopyBuffered(ch, true)
+	s2 := hbone.Stream{ID: "rootless-i", Src: oc, Dst: c}
+	s2.CopyBuffered(nil, true)
+	<-ch
+}
+
+// bufferedConn reads the bytes buffered by the HTTP server before the connection was hijacked.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (b *bufferedConn) Read(p []byte) (int, error) {
+	return b.r.Read(p)
+}
@@ -0,0 +1,122 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mesh
+
+import (
+	"bufio"
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+func TestParseUpstreams(t *testing.T) {
+	ups, err := ParseUpstreams("fortio.fortio.svc.cluster.local:8080, 9000=redis.db:6379,db.db.svc:443")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ups) != 3 {
+		t.Fatal("Unexpected upstreams", ups)
+	}
+	if ups[0].Local != "127.0.0.1:8080" || ups[0].Dest != "fortio.fortio.svc.cluster.local:8080" {
+		t.Error("Unexpected upstream", ups[0])
+	}
+	if ups[1].Local != "127.0.0.1:9000" || ups[1].Dest != "redis.db:6379" {
+		t.Error("Unexpected upstream", ups[1])
+	}
+	if ups[2].Local != "127.0.0.1:10443" {
+		t.Error("Privileged port not remapped", ups[2])
+	}
+	if _, err := ParseUpstreams("fortio"); err == nil {
+		t.Error("Expecting error for missing port")
+	}
+}
+
+func TestRootlessProxy(t *testing.T) {
+	// Echo server standing in for the mesh destination.
+	el, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer el.Close()
+	go func() {
+		for {
+			c, err := el.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				l, _ := bufio.NewReader(c).ReadString('\n')
+				c.Write([]byte("echo " + l))
+			}()
+		}
+	}()
+
+	dialed := ""
+	rp := newRootlessProxy(nil, func(ctx context.Context, dest string) (net.Conn, error) {
+		dialed = dest
+		return net.Dial("tcp", el.Addr().String())
+	})
+	pl, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pl.Close()
+	go http.Serve(pl, rp)
+
+	c, err := net.Dial("tcp", pl.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.Write([]byte("CONNECT fortio.fortio.svc:8080 HTTP/1.1\r\nHost: fortio.fortio.svc:8080\r\n\r\nhello\n"))
+	br := bufio.NewReader(c)
+	res, err := http.ReadResponse(br, &http.Request{Method: "CONNECT"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != 200 {
+		t.Fatal("Unexpected status", res.StatusCode)
+	}
+	l, err := br.ReadString('\n')
+	if err != nil || l != "echo hello\n" {
+		t.Error("Unexpected response", l, err)
+	}
+	if dialed != "fortio.fortio.svc:8080" {
+		t.Error("Mesh host not dialed over the mesh", dialed)
+	}
+
+	// Plain HTTP for a non-mesh host is dialed directly.
+	hs := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("direct"))
+	})}
+	hl, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer hl.Close()
+	go hs.Serve(hl)
+	pu, _ := url.Parse("http://" + pl.Addr().String())
+	hc := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(pu)}}
+	hres, err := hc.Get("http://" + hl.Addr().String() + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(hres.Body)
+	hres.Body.Close()
+	if string(body) != "direct" {
+		t.Error("Unexpected body", string(body))
+	}
+}
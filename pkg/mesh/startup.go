@@ -0,0 +1,168 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mesh
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"os"
+	"sort"
+	"time"
+)
+
+// Startup latency budget.
+//
+// Cold start time is the main cost of running the mesh in CloudRun. MESH_STARTUP_BUDGET (a duration, like "5s")
+// sets the expected time from krun start to the app being ready. If the budget is exceeded - or startup is
+// still in progress when it expires - a structured entry with the duration of each phase is logged as a WARNING.
+//
+// If MESH_STARTUP_METRIC is set, the phases are also exported as metrics (krun/startup_latencies), labeled with the
+// phase name, so regressions are visible per revision.
+
+// StartupPhase is the duration of one step in the startup chain.
+type StartupPhase struct {
+	Name     string        `json:"name"`
+	Duration time.Duration `json:"-"`
+	Millis   int64         `json:"ms"`
+}
+
+// StartupPhases returns the completed startup phases, in the order they completed. Each phase lasts from the end
+// of the previous one - with MESH_LAZY_PROXY the app may be ready before the proxy. Phases that were skipped (for
+// example proxyless mode or XDS_ADDR set explicitly) are not included.
+func (kr *KRun) StartupPhases() []StartupPhase {
+	events := []StartupPhase{}
+	add := func(name string, t time.Time) {
+		if !t.IsZero() {
+			events = append(events, StartupPhase{Name: name, Duration: t.Sub(kr.StartTime)})
+		}
+	}
+	add("mesh_env", kr.MeshEnvTime)
+	add("certs", kr.CertsReadyTime)
+	add("tokens", kr.TokensTime)
+	add("proxy_start", kr.EnvoyStartTime)
+	add("proxy_ready", kr.EnvoyReadyTime)
+	add("app_ready", kr.AppReadyTime)
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].Duration < events[j].Duration
+	})
+
+	res := []StartupPhase{}
+	var last time.Duration
+	for _, e := range events {
+		d := e.Duration - last
+		res = append(res, StartupPhase{Name: e.Name, Duration: d, Millis: d.Milliseconds()})
+		last = e.Duration
+	}
+	return res
+}
+
+func (kr *KRun) startupBudget() time.Duration {
+	b := kr.Config("MESH_STARTUP_BUDGET", "")
+	if b == "" {
+		return 0
+	}
+	d, err := time.ParseDuration(b)
+	if err != nil {
+		log.Println("Invalid MESH_STARTUP_BUDGET", b, err)
+		return 0
+	}
+	return d
+}
+
+// WatchStartupBudget starts a timer that reports the phases completed so far if the app is not ready
+// when the budget expires. Should be called after the config is loaded.
+func (kr *KRun) WatchStartupBudget() {
+	budget := kr.startupBudget()
+	if budget == 0 {
+		return
+	}
+	remaining := budget - time.Since(kr.StartTime)
+	if remaining < 0 {
+		remaining = 0
+	}
+	time.AfterFunc(remaining, func() {
+		kr.startupM.Lock()
+		defer kr.startupM.Unlock()
+		if kr.AppReadyTime.IsZero() {
+			kr.logStartup("Startup budget exceeded, still starting", budget)
+		}
+	})
+}
+
+// setAppReady records the time the app became ready. AppReadyTime is not changed after this, readers in other
+// goroutines use appReadyTime.
+func (kr *KRun) setAppReady(t time.Time) {
+	kr.startupM.Lock()
+	kr.AppReadyTime = t
+	kr.startupM.Unlock()
+}
+
+func (kr *KRun) appReadyTime() time.Time {
+	kr.startupM.Lock()
+	defer kr.startupM.Unlock()
+	return kr.AppReadyTime
+}
+
+// ReportStartup is called once the app is ready. Logs the breakdown if the budget was exceeded, and exports
+// the phases as metrics if enabled.
+func (kr *KRun) ReportStartup(ctx context.Context) {
+	total := kr.AppReadyTime.Sub(kr.StartTime)
+	if budget := kr.startupBudget(); budget > 0 && total > budget {
+		kr.logStartup("Startup budget exceeded", budget)
+	}
+
+	if kr.Metrics == nil {
+		return
+	}
+	ml := kr.retryMetrics()
+	if kr.Config("MESH_STARTUP_METRIC", "") != "" {
+		for _, p := range append(kr.StartupPhases(), StartupPhase{Name: "total", Duration: total}) {
+			ml = append(ml, Metric{
+				Name:   "krun/startup_latencies",
+				Labels: map[string]string{"phase": p.Name},
+				Value:  float64(p.Duration.Milliseconds()),
+				Time:   kr.AppReadyTime,
+			})
+		}
+	}
+	if len(ml) == 0 {
+		return
+	}
+	go func() {
+		ctx, cf := context.WithTimeout(ctx, 10*time.Second)
+		defer cf()
+		if err := kr.Metrics.WriteMetrics(ctx, ml); err != nil {
+			log.Println("Failed to export startup metrics", err)
+		}
+	}()
+}
+
+func (kr *KRun) logStartup(msg string, budget time.Duration) {
+	data, _ := json.Marshal(map[string]interface{}{
+		"severity": "WARNING",
+		"message":  msg,
+		"budget":   budget.Milliseconds(),
+		"elapsed":  time.Since(kr.StartTime).Milliseconds(),
+		"phases":   kr.StartupPhases(),
+		"logging.googleapis.com/labels": map[string]string{
+			"source":     "krun",
+			"instanceId": kr.InstanceID,
+		},
+	})
+	logMutex.Lock()
+	os.Stderr.Write(append(data, '\n'))
+	logMutex.Unlock()
+}
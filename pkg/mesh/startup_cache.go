@@ -0,0 +1,244 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mesh
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// StartupCache holds the values discovered by an instance of a revision, so the next instances of the same
+// revision can skip the cluster discovery and the mesh-env reads on the config cluster.
+//
+// Enabled by setting MESH_STARTUP_CACHE to a directory on a volume shared by the instances of the revision - for
+// example a Cloud Storage or NFS mount. In-memory volumes are per instance, and are only useful if krun is restarted
+// in the same instance. The cache is keyed by revision (K_REVISION or MESH_REVISION_ID), and is used if it is newer
+// than MESH_STARTUP_CACHE_TTL (default 10m). Per-instance values (instance ID, tokens, certificates) are not cached.
+//
+// The cache selects the XDS server, the roots and the config cluster - anyone who can write to the volume can
+// redirect the mesh. With MESH_STARTUP_CACHE_KEY set, the cache is signed with HMAC-SHA256 and unsigned or modified
+// files are ignored. The XDS address and roots are checked in all cases.
+type StartupCache struct {
+	Revision string    `json:"revision"`
+	Time     time.Time `json:"time"`
+
+	ProjectId       string `json:"projectId,omitempty"`
+	ProjectNumber   string `json:"projectNumber,omitempty"`
+	ClusterName     string `json:"clusterName,omitempty"`
+	ClusterLocation string `json:"clusterLocation,omitempty"`
+	ClusterAddress  string `json:"clusterAddress,omitempty"`
+	ClusterID       string `json:"clusterId,omitempty"`
+	Namespace       string `json:"namespace,omitempty"`
+	TrustDomain     string `json:"trustDomain,omitempty"`
+	MeshTenant      string `json:"meshTenant,omitempty"`
+
+	// MeshEnv is the merged mesh-env, including the XDS address and Citadel root.
+	MeshEnv map[string]string `json:"meshEnv,omitempty"`
+
+	// KubeConfig for the config cluster, set by the vendor init if the cluster was discovered.
+	KubeConfig []byte `json:"kubeConfig,omitempty"`
+
+	// MAC is the base64 HMAC-SHA256 of the cache with an empty MAC, using MESH_STARTUP_CACHE_KEY.
+	MAC string `json:"mac,omitempty"`
+
+	// Loaded is set if the cache was loaded from a fresh file.
+	Loaded bool `json:"-"`
+}
+
+// mac returns the signature of the cache.
+func (sc *StartupCache) mac(key string) (string, error) {
+	c := *sc
+	c.MAC = ""
+	data, err := json.Marshal(&c)
+	if err != nil {
+		return "", err
+	}
+	h := hmac.New(sha256.New, []byte(key))
+	h.Write(data)
+	return base64.StdEncoding.EncodeToString(h.Sum(nil)), nil
+}
+
+// validate checks the cached XDS address and roots.
+func (sc *StartupCache) validate() error {
+	if a := sc.MeshEnv["XDS_ADDR"]; a != "" {
+		_, port, err := net.SplitHostPort(a)
+		if err != nil {
+			return err
+		}
+		if _, err := strconv.Atoi(port); err != nil {
+			return errors.New("invalid XDS_ADDR port " + a)
+		}
+	}
+	if r := sc.MeshEnv["CAROOT_ISTIOD"]; r != "" {
+		rest := []byte(r)
+		n := 0
+		for {
+			var b *pem.Block
+			b, rest = pem.Decode(rest)
+			if b == nil {
+				break
+			}
+			if _, err := x509.ParseCertificate(b.Bytes); err != nil {
+				return err
+			}
+			n++
+		}
+		if n == 0 {
+			return errors.New("invalid CAROOT_ISTIOD")
+		}
+	}
+	return nil
+}
+
+// startupCacheFile returns the cache file and the revision, or empty if the cache is not enabled.
+func (kr *KRun) startupCacheFile() (string, string) {
+	dir := kr.Config("MESH_STARTUP_CACHE", "")
+	rev := os.Getenv("K_REVISION")
+	if rev == "" {
+		rev = kr.Config("MESH_REVISION_ID", "")
+	}
+	if dir == "" || rev == "" {
+		return "", ""
+	}
+	return filepath.Join(dir, "startup-"+strings.Replace(rev, "/", "_", -1)+".json"), rev
+}
+
+// LoadStartupCache sets kr.StartupCache, and applies the cached values that are not set explicitly. If the cache is
+// missing or stale, an empty cache is set, to be filled by the vendor init and saved by SaveStartupCache.
+func (kr *KRun) LoadStartupCache() {
+	f, rev := kr.startupCacheFile()
+	if f == "" {
+		return
+	}
+	kr.StartupCache = &StartupCache{}
+	data, err := ioutil.ReadFile(f)
+	if err != nil {
+		return
+	}
+	sc := &StartupCache{}
+	if err := json.Unmarshal(data, sc); err != nil {
+		log.Println("Ignoring invalid startup cache", f, err)
+		return
+	}
+	ttl, err := time.ParseDuration(kr.Config("MESH_STARTUP_CACHE_TTL", "10m"))
+	if err != nil {
+		ttl = 10 * time.Minute
+	}
+	if time.Since(sc.Time) > ttl || sc.Revision != rev {
+		return
+	}
+	if key := kr.Config("MESH_STARTUP_CACHE_KEY", ""); key != "" {
+		mac, err := sc.mac(key)
+		if err != nil || !hmac.Equal([]byte(mac), []byte(sc.MAC)) {
+			log.Println("Ignoring startup cache with invalid signature", f)
+			return
+		}
+	}
+	if err := sc.validate(); err != nil {
+		log.Println("Ignoring invalid startup cache", f, err)
+		return
+	}
+	sc.Loaded = true
+	kr.StartupCache = sc
+
+	for dst, v := range map[*string]string{
+		&kr.ProjectId:       sc.ProjectId,
+		&kr.ProjectNumber:   sc.ProjectNumber,
+		&kr.ClusterName:     sc.ClusterName,
+		&kr.ClusterLocation: sc.ClusterLocation,
+		&kr.ClusterAddress:  sc.ClusterAddress,
+		&kr.ClusterID:       sc.ClusterID,
+		&kr.Namespace:       sc.Namespace,
+		&kr.TrustDomain:     sc.TrustDomain,
+	} {
+		if *dst == "" {
+			*dst = v
+		}
+	}
+	log.Println("Using startup cache", "file", f, "age", time.Since(sc.Time))
+}
+
+// SaveStartupCache writes the discovered values, after LoadConfig. Skipped if the values were loaded from the cache.
+func (kr *KRun) SaveStartupCache() error {
+	f, rev := kr.startupCacheFile()
+	sc := kr.StartupCache
+	if f == "" || sc == nil || sc.Loaded || kr.DryRun {
+		return nil
+	}
+	sc.Revision = rev
+	sc.Time = time.Now()
+	sc.ProjectId = kr.ProjectId
+	sc.ProjectNumber = kr.ProjectNumber
+	sc.ClusterName = kr.ClusterName
+	sc.ClusterLocation = kr.ClusterLocation
+	sc.ClusterAddress = kr.ClusterAddress
+	sc.ClusterID = kr.ClusterID
+	sc.Namespace = kr.Namespace
+	sc.TrustDomain = kr.TrustDomain
+	sc.MeshTenant = kr.MeshTenant
+	sc.MeshEnv = kr.MeshEnv
+	sc.MAC = ""
+	if key := kr.Config("MESH_STARTUP_CACHE_KEY", ""); key != "" {
+		mac, err := sc.mac(key)
+		if err != nil {
+			return err
+		}
+		sc.MAC = mac
+	}
+
+	data, err := json.Marshal(sc)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(f), 0755); err != nil {
+		return err
+	}
+	// Other instances may read the file while it is written.
+	tmp := f + ".tmp" + kr.InstanceID
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, f)
+}
+
+// cachedMeshEnv applies the mesh-env and tenant from a fresh startup cache. Returns false if there is no cache.
+func (kr *KRun) cachedMeshEnv() bool {
+	sc := kr.StartupCache
+	if sc == nil || !sc.Loaded || len(sc.MeshEnv) == 0 {
+		return false
+	}
+	d := map[string]string{}
+	for k, v := range sc.MeshEnv {
+		d[k] = v
+	}
+	kr.initFromMeshEnv(d)
+	if kr.MeshTenant == "" {
+		kr.MeshTenant = sc.MeshTenant
+	}
+	return true
+}
@@ -0,0 +1,129 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mesh
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStartupCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "krun-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	kr := &KRun{}
+	kr.SetFlagConfig("MESH_STARTUP_CACHE", dir)
+	kr.SetFlagConfig("MESH_REVISION_ID", "fortio-00001")
+	kr.LoadStartupCache()
+	if kr.StartupCache == nil || kr.StartupCache.Loaded {
+		t.Fatal("Expecting empty cache", kr.StartupCache)
+	}
+	kr.ProjectId = "wlhe-cr"
+	kr.ClusterName = "asm-cr"
+	kr.Namespace = "fortio"
+	kr.MeshTenant = "-"
+	kr.MeshEnv = map[string]string{"XDS_ADDR": "istiod.example.com:15012", "CAROOT_ISTIOD": ""}
+	kr.StartupCache.KubeConfig = []byte("apiVersion: v1")
+	if err := kr.SaveStartupCache(); err != nil {
+		t.Fatal(err)
+	}
+
+	kr2 := &KRun{Namespace: "explicit"}
+	kr2.SetFlagConfig("MESH_STARTUP_CACHE", dir)
+	kr2.SetFlagConfig("MESH_REVISION_ID", "fortio-00001")
+	kr2.LoadStartupCache()
+	if !kr2.StartupCache.Loaded || string(kr2.StartupCache.KubeConfig) != "apiVersion: v1" {
+		t.Fatal("Expecting cache", kr2.StartupCache)
+	}
+	if kr2.ProjectId != "wlhe-cr" || kr2.ClusterName != "asm-cr" || kr2.Namespace != "explicit" {
+		t.Error("Unexpected values", kr2.ProjectId, kr2.ClusterName, kr2.Namespace)
+	}
+	if !kr2.cachedMeshEnv() || kr2.XDSAddr != "istiod.example.com:15012" || kr2.MeshTenant != "-" {
+		t.Error("Mesh env not applied", kr2.XDSAddr, kr2.MeshTenant)
+	}
+
+	// Other revisions and stale entries are ignored.
+	kr3 := &KRun{}
+	kr3.SetFlagConfig("MESH_STARTUP_CACHE", dir)
+	kr3.SetFlagConfig("MESH_REVISION_ID", "fortio-00002")
+	kr3.LoadStartupCache()
+	if kr3.StartupCache.Loaded {
+		t.Error("Loaded cache for a different revision")
+	}
+	time.Sleep(10 * time.Millisecond)
+	kr4 := &KRun{}
+	kr4.SetFlagConfig("MESH_STARTUP_CACHE", dir)
+	kr4.SetFlagConfig("MESH_REVISION_ID", "fortio-00001")
+	kr4.SetFlagConfig("MESH_STARTUP_CACHE_TTL", "1ms")
+	kr4.LoadStartupCache()
+	if kr4.StartupCache.Loaded {
+		t.Error("Loaded stale cache")
+	}
+}
+
+func TestStartupCacheSigned(t *testing.T) {
+	dir := t.TempDir()
+	newKRun := func(key string) *KRun {
+		kr := &KRun{}
+		kr.SetFlagConfig("MESH_STARTUP_CACHE", dir)
+		kr.SetFlagConfig("MESH_REVISION_ID", "fortio-00001")
+		kr.SetFlagConfig("MESH_STARTUP_CACHE_KEY", key)
+		kr.LoadStartupCache()
+		return kr
+	}
+	kr := newKRun("k1")
+	kr.ProjectId = "wlhe-cr"
+	kr.MeshEnv = map[string]string{"XDS_ADDR": "istiod.example.com:15012"}
+	if err := kr.SaveStartupCache(); err != nil {
+		t.Fatal(err)
+	}
+	if !newKRun("k1").StartupCache.Loaded {
+		t.Error("Expecting signed cache to be loaded")
+	}
+	if newKRun("k2").StartupCache.Loaded {
+		t.Error("Loaded cache signed with a different key")
+	}
+
+	f, _ := kr.startupCacheFile()
+	data, _ := ioutil.ReadFile(f)
+	ioutil.WriteFile(f, []byte(strings.Replace(string(data), "istiod.example.com", "evil.example.com", 1)), 0600)
+	if newKRun("k1").StartupCache.Loaded {
+		t.Error("Loaded modified cache")
+	}
+}
+
+func TestStartupCacheValidate(t *testing.T) {
+	for _, env := range []map[string]string{
+		{"XDS_ADDR": "istiod.example.com"},
+		{"XDS_ADDR": "istiod.example.com:http"},
+		{"CAROOT_ISTIOD": "not a pem"},
+		{"CAROOT_ISTIOD": "-----BEGIN CERTIFICATE-----\nYWJj\n-----END CERTIFICATE-----\n"},
+	} {
+		sc := &StartupCache{MeshEnv: env}
+		if sc.validate() == nil {
+			t.Error("Expecting invalid cache", env)
+		}
+	}
+	sc := &StartupCache{MeshEnv: map[string]string{"XDS_ADDR": "istiod.example.com:15012"}}
+	if err := sc.validate(); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,122 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mesh
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Startup phase timeouts.
+//
+// Each blocking startup phase runs with a deadline, so a hung call - metadata server, K8S API, CA, XDS - fails
+// with an error naming the phase instead of wedging the instance until Cloud Run kills it at the startup deadline.
+//
+// MESH_TIMEOUT_<PHASE> (a duration) overrides the default timeout of a phase. All phases are also bounded by
+// MESH_STARTUP_TIMEOUT, measured from the krun start - the default is 4m, the max startup probe in Cloud Run.
+
+// Startup phases with a timeout. The names match the StartupPhases where possible.
+const (
+	PhasePlatform   = "platform"
+	PhaseMeshEnv    = "mesh_env"
+	PhaseProxyStart = "proxy_start"
+	PhaseProxyReady = "proxy_ready"
+	PhaseSecrets    = "secrets"
+	PhaseAppReady   = "app_ready"
+)
+
+// phaseTimeouts are the defaults, also declared as MESH_TIMEOUT_ config keys.
+var phaseTimeouts = map[string]time.Duration{
+	PhasePlatform:   30 * time.Second,
+	PhaseMeshEnv:    60 * time.Second,
+	PhaseProxyStart: 30 * time.Second,
+	PhaseProxyReady: 10 * time.Second,
+	PhaseSecrets:    30 * time.Second,
+	PhaseAppReady:   10 * time.Second,
+}
+
+const defaultStartupTimeout = 4 * time.Minute
+
+// PhaseError is returned when a startup phase doesn't complete before the deadline.
+type PhaseError struct {
+	Phase   string
+	Timeout time.Duration
+
+	// Key is the setting controlling the timeout.
+	Key string
+
+	Err error
+}
+
+func (e *PhaseError) Error() string {
+	return fmt.Sprintf("startup phase %s timed out after %v (%s): %v", e.Phase, e.Timeout, e.Key, e.Err)
+}
+
+func (e *PhaseError) Unwrap() error {
+	return e.Err
+}
+
+func phaseKey(phase string) string {
+	return "MESH_TIMEOUT_" + strings.ToUpper(phase)
+}
+
+// PhaseTimeout returns the timeout for a startup phase, and the setting that determines it - the phase timeout
+// or the remaining MESH_STARTUP_TIMEOUT.
+func (kr *KRun) PhaseTimeout(phase string) (time.Duration, string) {
+	key := phaseKey(phase)
+	d := kr.configDuration(key, phaseTimeouts[phase])
+	if d == 0 {
+		d = kr.configDuration("MESH_STARTUP_TIMEOUT", defaultStartupTimeout)
+	}
+	if kr.StartTime.IsZero() {
+		return d, key
+	}
+	remaining := kr.configDuration("MESH_STARTUP_TIMEOUT", defaultStartupTimeout) - time.Since(kr.StartTime)
+	if remaining < d {
+		if remaining < 0 {
+			remaining = 0
+		}
+		return remaining, "MESH_STARTUP_TIMEOUT"
+	}
+	return d, key
+}
+
+// RunPhase runs f with the deadline of the startup phase. If f doesn't return by the deadline - for example a
+// blocking call that doesn't take a context - a PhaseError is returned and f is left running in the background.
+// Errors caused by the deadline are also returned as PhaseError.
+func (kr *KRun) RunPhase(ctx context.Context, phase string, f func(ctx context.Context) error) error {
+	to, key := kr.PhaseTimeout(phase)
+	ctx, cf := context.WithTimeout(ctx, to)
+	defer cf()
+
+	ch := make(chan error, 1)
+	go func() {
+		ch <- f(ctx)
+	}()
+	var err error
+	select {
+	case err = <-ch:
+		if err == nil || ctx.Err() == nil {
+			return err
+		}
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	perr := &PhaseError{Phase: phase, Timeout: to, Key: key, Err: err}
+	kr.logStartup(perr.Error(), kr.startupBudget())
+	return perr
+}
@@ -0,0 +1,67 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mesh
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestRunPhase(t *testing.T) {
+	os.Setenv("MESH_TIMEOUT_PLATFORM", "50ms")
+	defer os.Unsetenv("MESH_TIMEOUT_PLATFORM")
+	kr := New()
+	kr.StartTime = time.Now()
+
+	if d, key := kr.PhaseTimeout(PhasePlatform); d != 50*time.Millisecond || key != "MESH_TIMEOUT_PLATFORM" {
+		t.Error("Unexpected timeout", d, key)
+	}
+
+	// A call ignoring the context doesn't block the phase past the deadline.
+	block := make(chan struct{})
+	defer close(block)
+	t0 := time.Now()
+	err := kr.RunPhase(context.Background(), PhasePlatform, func(ctx context.Context) error {
+		<-block
+		return nil
+	})
+	perr := &PhaseError{}
+	if !errors.As(err, &perr) || perr.Phase != PhasePlatform || time.Since(t0) > 2*time.Second {
+		t.Error("Expecting phase timeout", err, time.Since(t0))
+	}
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Error("Expecting deadline exceeded", err)
+	}
+
+	// Errors not caused by the deadline are returned as is.
+	werr := errors.New("failed")
+	if err := kr.RunPhase(context.Background(), PhaseAppReady, func(ctx context.Context) error {
+		return werr
+	}); err != werr {
+		t.Error("Unexpected error", err)
+	}
+
+	t.Run("startup", func(t *testing.T) {
+		os.Setenv("MESH_STARTUP_TIMEOUT", "1s")
+		defer os.Unsetenv("MESH_STARTUP_TIMEOUT")
+		kr.StartTime = time.Now().Add(-900 * time.Millisecond)
+		if d, key := kr.PhaseTimeout(PhaseMeshEnv); d > 100*time.Millisecond || key != "MESH_STARTUP_TIMEOUT" {
+			t.Error("Expecting the remaining startup time", d, key)
+		}
+	})
+}
@@ -0,0 +1,73 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mesh
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestWatchStartupBudget(t *testing.T) {
+	os.Setenv("MESH_STARTUP_BUDGET", "1ms")
+	defer os.Unsetenv("MESH_STARTUP_BUDGET")
+	kr := New()
+	kr.StartTime = time.Now()
+	kr.WatchStartupBudget()
+	// The app may become ready while the timer runs - checked by the race detector.
+	kr.setAppReady(time.Now())
+	time.Sleep(10 * time.Millisecond)
+	if kr.appReadyTime().IsZero() {
+		t.Error("Expecting app ready")
+	}
+	if p := kr.StartupPhases(); len(p) != 1 || p[0].Name != "app_ready" {
+		t.Error("Unexpected phases", p)
+	}
+}
+
+func TestStartupPhases(t *testing.T) {
+	kr := New()
+	t0 := time.Now()
+	kr.StartTime = t0
+	kr.MeshEnvTime = t0.Add(100 * time.Millisecond)
+	kr.CertsReadyTime = t0.Add(300 * time.Millisecond)
+	kr.TokensTime = t0.Add(400 * time.Millisecond)
+	kr.EnvoyStartTime = t0.Add(450 * time.Millisecond)
+	kr.EnvoyReadyTime = t0.Add(1200 * time.Millisecond)
+	kr.AppReadyTime = t0.Add(2000 * time.Millisecond)
+
+	expected := []struct {
+		name string
+		ms   int64
+	}{
+		{"mesh_env", 100}, {"certs", 200}, {"tokens", 100}, {"proxy_start", 50}, {"proxy_ready", 750}, {"app_ready", 800},
+	}
+	p := kr.StartupPhases()
+	if len(p) != len(expected) {
+		t.Fatal("Unexpected phases", p)
+	}
+	for i, e := range expected {
+		if p[i].Name != e.name || p[i].Millis != e.ms {
+			t.Error("Unexpected phase", i, p[i], e)
+		}
+	}
+
+	// With a lazy proxy the app is ready first - phases are in completion order, never negative.
+	kr.AppReadyTime = t0.Add(500 * time.Millisecond)
+	p = kr.StartupPhases()
+	if p[4].Name != "app_ready" || p[4].Millis != 50 || p[5].Name != "proxy_ready" || p[5].Millis != 700 {
+		t.Error("Unexpected lazy proxy phases", p)
+	}
+}
@@ -0,0 +1,231 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mesh
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Envoy stats export.
+//
+// CloudRun doesn't scrape Prometheus endpoints. If MESH_STATS_EXPORT is set to a comma separated list of metric name
+// prefixes (for example "istio_requests_total,istio_request_duration_milliseconds"), krun will periodically scrape
+// the merged Envoy/agent stats and write the matching metrics using the vendor MetricWriter (Cloud Monitoring custom
+// metrics on GCP, with the CloudRun service, revision and instance as resource labels).
+//
+// MESH_STATS_LABELS optionally restricts the exported labels - custom metrics are limited to 10 labels.
+// MESH_STATS_INTERVAL controls the scrape interval, default 60s - the minimum allowed by Cloud Monitoring.
+
+const statsURL = "http://127.0.0.1:15090/stats/prometheus"
+
+// StartStatsExporter starts the periodic scrape, if enabled and a MetricWriter is available.
+// Should be called after Envoy is ready.
+func (kr *KRun) StartStatsExporter() {
+	allow := splitList(kr.Config("MESH_STATS_EXPORT", ""))
+	if len(allow) == 0 || kr.Metrics == nil {
+		return
+	}
+	labels := splitList(kr.Config("MESH_STATS_LABELS", ""))
+	interval, err := time.ParseDuration(kr.Config("MESH_STATS_INTERVAL", "60s"))
+	if err != nil || interval < 10*time.Second {
+		interval = 60 * time.Second
+	}
+	log.Println("Exporting envoy stats", "prefixes", allow, "interval", interval)
+	go func() {
+		for {
+			time.Sleep(interval)
+			ctx, cf := context.WithTimeout(context.Background(), 20*time.Second)
+			err := kr.exportStats(ctx, allow, labels)
+			cf()
+			if err != nil {
+				log.Println("Failed to export stats", err)
+			}
+		}
+	}()
+}
+
+func (kr *KRun) exportStats(ctx context.Context, allow, labels []string) error {
+	req, _ := http.NewRequestWithContext(ctx, "GET", statsURL, nil)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		return errors.New("stats scrape failed " + res.Status)
+	}
+	data, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	// Envoy counters reset when the proxy is restarted or upgraded.
+	ml := parsePrometheus(data, allow, labels, kr.agentStartTime())
+	if len(ml) == 0 {
+		return nil
+	}
+	return kr.Metrics.WriteMetrics(ctx, ml)
+}
+
+// agentStartTime returns the start time of the running agent, zero if not started.
+func (kr *KRun) agentStartTime() time.Time {
+	if t := atomic.LoadInt64(&kr.agentStarted); t != 0 {
+		return time.Unix(0, t)
+	}
+	return time.Time{}
+}
+
+// parsePrometheus converts the metrics in Prometheus text format that match one of the prefixes.
+// Histogram buckets are skipped - only _sum and _count are exported. Counters start at start.
+func parsePrometheus(data []byte, allow, labels []string, start time.Time) []Metric {
+	res := []Metric{}
+	types := map[string]string{}
+	now := time.Now()
+	s := bufio.NewScanner(bytes.NewReader(data))
+	s.Buffer(make([]byte, 64*1024), 1024*1024)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" {
+			continue
+		}
+		if line[0] == '#' {
+			f := strings.Fields(line)
+			if len(f) >= 4 && f[1] == "TYPE" {
+				types[f[2]] = f[3]
+			}
+			continue
+		}
+		name, l, v, ok := parsePromLine(line)
+		if !ok || !hasPrefix(name, allow) || strings.HasSuffix(name, "_bucket") {
+			continue
+		}
+		if len(labels) > 0 {
+			for k := range l {
+				if !contains(labels, k) {
+					delete(l, k)
+				}
+			}
+		}
+		family := strings.TrimSuffix(strings.TrimSuffix(name, "_sum"), "_count")
+		t := types[name]
+		if t == "" {
+			t = types[family]
+		}
+		m := Metric{
+			Name:    "envoy/" + name,
+			Labels:  l,
+			Value:   v,
+			Counter: t == "counter" || t == "histogram" || t == "summary",
+			Time:    now,
+		}
+		if m.Counter {
+			m.Start = start
+		}
+		res = append(res, m)
+	}
+	return res
+}
+
+// parsePromLine parses 'name{k="v",...} value [timestamp]'.
+func parsePromLine(line string) (string, map[string]string, float64, bool) {
+	labels := map[string]string{}
+	var name, rest string
+	if i := strings.IndexByte(line, '{'); i > 0 {
+		name = line[0:i]
+		j := i + 1
+		for j < len(line) && line[j] != '}' {
+			eq := strings.IndexByte(line[j:], '=')
+			if eq < 0 || j+eq+1 >= len(line) || line[j+eq+1] != '"' {
+				return "", nil, 0, false
+			}
+			k := strings.TrimSpace(line[j : j+eq])
+			j = j + eq + 2
+			val := strings.Builder{}
+			for ; j < len(line) && line[j] != '"'; j++ {
+				if line[j] == '\\' && j+1 < len(line) {
+					j++
+					if line[j] == 'n' {
+						val.WriteByte('\n')
+						continue
+					}
+				}
+				val.WriteByte(line[j])
+			}
+			labels[k] = val.String()
+			j++ // closing quote
+			if j < len(line) && line[j] == ',' {
+				j++
+			}
+		}
+		if j >= len(line) {
+			return "", nil, 0, false
+		}
+		rest = line[j+1:]
+	} else {
+		sp := strings.IndexAny(line, " \t")
+		if sp < 0 {
+			return "", nil, 0, false
+		}
+		name = line[0:sp]
+		rest = line[sp:]
+	}
+	f := strings.Fields(rest)
+	if len(f) == 0 {
+		return "", nil, 0, false
+	}
+	v, err := strconv.ParseFloat(f[0], 64)
+	if err != nil {
+		return "", nil, 0, false
+	}
+	return name, labels, v, true
+}
+
+func splitList(s string) []string {
+	res := []string{}
+	for _, p := range strings.Split(s, ",") {
+		p = strings.TrimSpace(p)
+		if p != "" {
+			res = append(res, p)
+		}
+	}
+	return res
+}
+
+func hasPrefix(s string, prefixes []string) bool {
+	for _, p := range prefixes {
+		if strings.HasPrefix(s, p) {
+			return true
+		}
+	}
+	return false
+}
+
+func contains(l []string, s string) bool {
+	for _, e := range l {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,58 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mesh
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParsePrometheus(t *testing.T) {
+	data := `# TYPE istio_requests_total counter
+istio_requests_total{response_code="200",source_workload="fortio",destination_service="a\"b"} 12
+# TYPE istio_request_duration_milliseconds histogram
+istio_request_duration_milliseconds_bucket{response_code="200",le="0.5"} 1
+istio_request_duration_milliseconds_sum{response_code="200"} 45.5
+istio_request_duration_milliseconds_count{response_code="200"} 12
+# TYPE envoy_server_uptime gauge
+envoy_server_uptime 100
+`
+	start := time.Unix(1600000000, 0)
+	ml := parsePrometheus([]byte(data), []string{"istio_"}, []string{"response_code", "destination_service"}, start)
+	if len(ml) != 3 {
+		t.Fatal("Unexpected metrics", ml)
+	}
+	m := ml[0]
+	if m.Name != "envoy/istio_requests_total" || m.Value != 12 || !m.Counter || m.Start != start {
+		t.Error("Unexpected counter", m)
+	}
+	if len(m.Labels) != 2 || m.Labels["destination_service"] != `a"b` {
+		t.Error("Unexpected labels", m.Labels)
+	}
+	if !ml[1].Counter || ml[1].Value != 45.5 || ml[1].Start != start {
+		t.Error("Unexpected histogram sum", ml[1])
+	}
+	if g := parsePrometheus([]byte(data), []string{"envoy_"}, nil, start); len(g) != 1 || g[0].Counter || !g[0].Start.IsZero() {
+		t.Error("Unexpected gauge", g)
+	}
+}
+
+func TestParseEnvoyStats(t *testing.T) {
+	st := parseEnvoyStats("cluster_manager.cds.update_success: 2\ncluster_manager.warming_clusters: 0\n" +
+		"listener_manager.lds.update_time: P0(nan,1) P25(nan,1)\n")
+	if st["cluster_manager.cds.update_success"] != 2 || len(st) != 2 {
+		t.Error("Unexpected stats", st)
+	}
+}
@@ -0,0 +1,200 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mesh
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Each instance periodically writes a status entry in the krun-status-NAME config map, in the workload namespace
+// of the config cluster. Platform teams can check the health of all CloudRun mesh participants with:
+//
+//   kubectl -n NAMESPACE get cm krun-status-NAME -o yaml
+//
+// Entries that were not updated in 3 intervals are removed by the other instances.
+//
+// Enabled with MESH_STATUS=true, MESH_STATUS_INTERVAL sets the update interval (default 60s).
+
+// InstanceStatus is the status entry written by each instance.
+type InstanceStatus struct {
+	Instance string `json:"instance"`
+	Revision string `json:"revision,omitempty"`
+
+	Started time.Time `json:"started"`
+	Updated time.Time `json:"updated"`
+
+	// Instances is the number of live entries seen in the status map at the last update, including this one.
+	Instances int `json:"instances"`
+
+	// MeshConnected is true if Envoy has received the listeners and clusters from XDS.
+	MeshConnected bool   `json:"meshConnected"`
+	XDSAddr       string `json:"xdsAddr,omitempty"`
+
+	CertExpiry   *time.Time `json:"certExpiry,omitempty"`
+	AgentVersion string     `json:"agentVersion,omitempty"`
+
+	MeshEnvIssues []string `json:"meshEnvIssues,omitempty"`
+
+	// Versions of krun, the proxy and istiod, with the skew warnings.
+	Versions *Versions `json:"versions,omitempty"`
+
+	// Retries are the totals of the retried control plane calls, by operation.
+	Retries map[string]RetryStats `json:"retries,omitempty"`
+
+	// Watchdog is the state of the proxy watchdog, if enabled.
+	Watchdog *WatchdogStatus `json:"watchdog,omitempty"`
+}
+
+// StatusMapName returns the name of the config map holding the status of all instances of the workload.
+func (kr *KRun) StatusMapName() string {
+	return "krun-status-" + kr.Name
+}
+
+// StartStatusReporter starts the periodic status update, if MESH_STATUS is enabled.
+// The current status is also available on the debug server, as /debug/status.
+func (kr *KRun) StartStatusReporter() {
+	kr.DebugMux.HandleFunc("/debug/status", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("content-type", "application/json")
+		json.NewEncoder(w).Encode(kr.Status(r.Context()))
+	})
+	if kr.Config("MESH_STATUS", "") != "true" {
+		return
+	}
+	interval, err := time.ParseDuration(kr.Config("MESH_STATUS_INTERVAL", "60s"))
+	if err != nil || interval <= 0 {
+		interval = 60 * time.Second
+	}
+	go func() {
+		for {
+			ctx, cf := context.WithTimeout(context.Background(), 10*time.Second)
+			err := kr.ReportStatus(ctx, interval)
+			cf()
+			if err != nil {
+				log.Println("Failed to report status", "cm", kr.StatusMapName(), "err", err)
+			}
+			time.Sleep(interval)
+		}
+	}()
+}
+
+// Status returns the current status of this instance.
+func (kr *KRun) Status(ctx context.Context) *InstanceStatus {
+	st := &InstanceStatus{
+		Instance:     kr.InstanceID,
+		Revision:     kr.Rev,
+		Started:      kr.StartTime,
+		Updated:      time.Now(),
+		XDSAddr:      kr.XDSAddr,
+		AgentVersion: kr.Config("ISTIO_META_ISTIO_VERSION", ""),
+
+		MeshEnvIssues: kr.MeshEnvIssues,
+		Versions:      kr.Versions(),
+		Retries:       kr.RetryStats(),
+		Watchdog:      kr.WatchdogStatus(),
+	}
+	if r := kr.Config("K_REVISION", ""); r != "" {
+		st.Revision = r
+	}
+	if !kr.EnvoyReadyTime.IsZero() {
+		st.MeshConnected, _ = envoyXDSSynced(ctx)
+	}
+	if kp := kr.X509KeyPair; kp != nil && kp.Leaf != nil {
+		exp := kp.Leaf.NotAfter
+		st.CertExpiry = &exp
+	} else if exp, err := envoyCertExpiry(ctx); err == nil {
+		st.CertExpiry = &exp
+	}
+	return st
+}
+
+// ReportStatus writes the status of this instance, and removes the entries of instances that have not reported
+// in 3 intervals.
+func (kr *KRun) ReportStatus(ctx context.Context, interval time.Duration) error {
+	cw, ok := kr.Cfg.(CfgWriter)
+	if !ok {
+		return errors.New("config cluster doesn't support writes")
+	}
+	st := kr.Status(ctx)
+	key := kr.WorkloadEntryName()
+
+	data := map[string]string{}
+	st.Instances = 1
+	cm, err := kr.Cfg.GetCM(ctx, kr.Namespace, kr.StatusMapName())
+	if err == nil {
+		for k, v := range cm {
+			if k == key {
+				continue
+			}
+			other := &InstanceStatus{}
+			if json.Unmarshal([]byte(v), other) != nil || st.Updated.Sub(other.Updated) > 3*interval {
+				data[k] = ""
+				continue
+			}
+			st.Instances++
+		}
+	}
+	sd, err := json.Marshal(st)
+	if err != nil {
+		return err
+	}
+	data[key] = string(sd)
+	return cw.UpdateCM(ctx, kr.Namespace, kr.StatusMapName(), data)
+}
+
+// Subset of the Envoy admin /certs response.
+type envoyCerts struct {
+	Certificates []struct {
+		CertChain []struct {
+			ExpirationTime time.Time `json:"expiration_time"`
+		} `json:"cert_chain"`
+	} `json:"certificates"`
+}
+
+// envoyCertExpiry returns the earliest expiration of the workload certificates loaded by Envoy, when certificates
+// are managed by the agent.
+func envoyCertExpiry(ctx context.Context) (time.Time, error) {
+	data, err := envoyAdminGet(ctx, "/certs")
+	if err != nil {
+		return time.Time{}, err
+	}
+	return parseEnvoyCertExpiry(data)
+}
+
+func parseEnvoyCertExpiry(data []byte) (time.Time, error) {
+	certs := &envoyCerts{}
+	if err := json.Unmarshal(data, certs); err != nil {
+		return time.Time{}, err
+	}
+	var res time.Time
+	for _, c := range certs.Certificates {
+		for _, cc := range c.CertChain {
+			if cc.ExpirationTime.IsZero() {
+				continue
+			}
+			if res.IsZero() || cc.ExpirationTime.Before(res) {
+				res = cc.ExpirationTime
+			}
+		}
+	}
+	if res.IsZero() {
+		return res, errors.New("no certificates loaded")
+	}
+	return res, nil
+}
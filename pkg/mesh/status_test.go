@@ -0,0 +1,36 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mesh
+
+import (
+	"testing"
+)
+
+func TestParseEnvoyCertExpiry(t *testing.T) {
+	data := `{"certificates":[
+{"ca_cert":[{"expiration_time":"2031-09-01T00:00:00Z"}],
+ "cert_chain":[{"expiration_time":"2021-09-02T18:16:33Z"}]},
+{"cert_chain":[{"expiration_time":"2021-09-01T18:16:33Z"}]}]}`
+	exp, err := parseEnvoyCertExpiry([]byte(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exp.Format("2006-01-02T15:04:05Z") != "2021-09-01T18:16:33Z" {
+		t.Error("Expecting earliest expiration", exp)
+	}
+	if _, err := parseEnvoyCertExpiry([]byte(`{"certificates":[]}`)); err == nil {
+		t.Error("Expecting error without certificates")
+	}
+}
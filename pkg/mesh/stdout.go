@@ -0,0 +1,56 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mesh
+
+import (
+	"log"
+	"os"
+	"os/exec"
+)
+
+// Envoy opens /dev/stdout to write the access log - the stdout of the proxy must be a file that can be reopened by
+// the proxy uid. A pipe with the write end owned by the proxy works, without the terminal processing and extra
+// fd of a pty. MESH_STDOUT=pty uses a pty owned by the proxy instead - the pty support can be removed from the
+// binary with the NO_PTY build tag.
+
+// setChildStdout sets the stdout of a child running as uid/gid. The returned function must be called after the
+// child is started, to start relaying the output.
+func (kr *KRun) setChildStdout(cmd *exec.Cmd, source string, uid, gid int) func() {
+	if kr.Config("MESH_STDOUT", "pipe") == "pty" {
+		r, tty, err := openPty(uid, gid)
+		if err == nil {
+			cmd.Stdout = tty
+			return func() {
+				go kr.RelayLogs(source, r, os.Stdout)
+			}
+		}
+		log.Println("Error opening pty, using pipe", err)
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		log.Println("Error creating stdout pipe", err)
+		cmd.Stdout = kr.LogWriter(source, os.Stdout)
+		return func() {}
+	}
+	if err := w.Chown(uid, gid); err != nil {
+		log.Println("Error chown stdout pipe", err)
+	}
+	cmd.Stdout = w
+	return func() {
+		// The child has a copy - close ours, so the relay gets EOF when the child exits.
+		w.Close()
+		go kr.relayLogsQueued(source, r, os.Stdout)
+	}
+}
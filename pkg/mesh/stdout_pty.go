@@ -0,0 +1,38 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !NO_PTY
+// +build !NO_PTY
+
+package mesh
+
+import (
+	"os"
+
+	"github.com/creack/pty"
+)
+
+// openPty returns a pty, with the tty owned by uid/gid.
+func openPty(uid, gid int) (*os.File, *os.File, error) {
+	p, tty, err := pty.Open()
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := tty.Chown(uid, gid); err != nil {
+		p.Close()
+		tty.Close()
+		return nil, nil, err
+	}
+	return p, tty, nil
+}
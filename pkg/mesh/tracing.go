@@ -0,0 +1,84 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mesh
+
+import (
+	"errors"
+	"strconv"
+)
+
+// Tracing settings for the generated PROXY_CONFIG, so the provider and sampling can be changed in mesh-env
+// or env without maintaining a full PROXY_CONFIG.
+//
+// MESH_TRACING selects the provider:
+// - cloudtrace (or stackdriver) - Cloud Trace, using the project of the instance.
+// - zipkin - MESH_TRACING_ADDR is the collector host:port.
+// - opencensus - MESH_TRACING_ADDR is the OpenCensus agent, with W3C trace context.
+// - otlp - ProxyConfig has no OTLP tracer; same as opencensus, for an OpenTelemetry collector with the
+//   opencensus receiver enabled.
+// - none - sampling is set to 0.
+//
+// MESH_TRACING_SAMPLING is the percentage of requests sampled, 0 to 100. If only the sampling is set, the
+// mesh default provider is kept.
+
+const (
+	TracingCloudTrace = "cloudtrace"
+	TracingZipkin     = "zipkin"
+	TracingOpenCensus = "opencensus"
+	TracingOTLP       = "otlp"
+	TracingNone       = "none"
+)
+
+// tracingConfig returns the 'tracing' field of the ProxyConfig, or nil if tracing is not configured.
+func (kr *KRun) tracingConfig() (map[string]interface{}, error) {
+	provider := kr.Config("MESH_TRACING", "")
+	sampling := kr.Config("MESH_TRACING_SAMPLING", "")
+	if provider == "" && sampling == "" {
+		return nil, nil
+	}
+	tr := map[string]interface{}{}
+	if sampling != "" {
+		s, err := strconv.ParseFloat(sampling, 64)
+		if err != nil || s < 0 || s > 100 {
+			return nil, errors.New("MESH_TRACING_SAMPLING must be a percentage " + sampling)
+		}
+		tr["sampling"] = s
+	}
+
+	addr := kr.Config("MESH_TRACING_ADDR", "")
+	switch provider {
+	case "":
+	case TracingCloudTrace, "stackdriver":
+		tr["stackdriver"] = map[string]interface{}{}
+	case TracingZipkin:
+		if addr == "" {
+			return nil, errors.New("MESH_TRACING_ADDR is required for zipkin")
+		}
+		tr["zipkin"] = map[string]interface{}{"address": addr}
+	case TracingOpenCensus, TracingOTLP:
+		if addr == "" {
+			return nil, errors.New("MESH_TRACING_ADDR is required for " + provider)
+		}
+		tr["openCensusAgent"] = map[string]interface{}{
+			"address": addr,
+			"context": []string{"W3C_TRACE_CONTEXT"},
+		}
+	case TracingNone:
+		tr["sampling"] = 0.0
+	default:
+		return nil, errors.New("unknown MESH_TRACING provider " + provider)
+	}
+	return tr, nil
+}
@@ -0,0 +1,55 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mesh
+
+import (
+	"encoding/json"
+	"os"
+	"testing"
+)
+
+func TestTracingConfig(t *testing.T) {
+	kr := New()
+	if pc := kr.proxyConfig("istiod:15012"); pc != `{"discoveryAddress":"istiod:15012"}` {
+		t.Error("Unexpected default", pc)
+	}
+
+	os.Setenv("MESH_TRACING", TracingZipkin)
+	defer os.Unsetenv("MESH_TRACING")
+	os.Setenv("MESH_TRACING_ADDR", "zipkin.istio-system:9411")
+	defer os.Unsetenv("MESH_TRACING_ADDR")
+	os.Setenv("MESH_TRACING_SAMPLING", "2.5")
+	defer os.Unsetenv("MESH_TRACING_SAMPLING")
+
+	pc := map[string]interface{}{}
+	if err := json.Unmarshal([]byte(kr.proxyConfig("istiod:15012")), &pc); err != nil {
+		t.Fatal(err)
+	}
+	tr, _ := pc["tracing"].(map[string]interface{})
+	zipkin, _ := tr["zipkin"].(map[string]interface{})
+	if tr["sampling"] != 2.5 || zipkin["address"] != "zipkin.istio-system:9411" {
+		t.Error("Unexpected tracing", pc)
+	}
+
+	os.Setenv("MESH_TRACING_SAMPLING", "200")
+	if _, err := kr.tracingConfig(); err == nil {
+		t.Error("Expecting sampling error")
+	}
+	os.Setenv("MESH_TRACING", "jaeger")
+	os.Setenv("MESH_TRACING_SAMPLING", "1")
+	if _, err := kr.tracingConfig(); err == nil {
+		t.Error("Expecting provider error")
+	}
+}
@@ -0,0 +1,240 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mesh
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Version skew - krun, the Istio proxy in the image and istiod are upgraded independently, and features fail in
+// obscure ways when they drift apart. The versions are checked 30s after the proxy or XDS client start - once
+// connected - and every 10 minutes, since istiod may be upgraded while the instance runs:
+//
+// - krun: BuildVersion
+// - proxy: ISTIO_META_ISTIO_VERSION (set in the proxyv2 image), or 'pilot-agent version -s'
+// - istiod: the control plane identifier - from the in-process XDS client, or the Envoy text stat
+//
+// A skew between the proxy and istiod of more than MESH_VERSION_MAX_SKEW minor versions (default 1), a proxy older
+// than MinProxyVersion or krun older than MESH_KRUN_MIN_VERSION (usually set in mesh-env by the operators, as an
+// update check) is logged as a warning on each check. The versions and warnings are in /debug/versions, the
+// instance status and the krun/build_info and krun/version_skew metrics.
+
+// MinProxyVersion is the oldest Istio proxy version tested with this krun version.
+const MinProxyVersion = "1.10"
+
+// Versions are the versions of the mesh components.
+type Versions struct {
+	Krun   string `json:"krun"`
+	Proxy  string `json:"proxy,omitempty"`
+	Istiod string `json:"istiod,omitempty"`
+
+	// Skew holds the warnings from the last check.
+	Skew []string `json:"skew,omitempty"`
+}
+
+type versionState struct {
+	m        sync.Mutex
+	proxy    string
+	istiod   string
+	warnings []string
+}
+
+// Versions returns the result of the last version check.
+func (kr *KRun) Versions() *Versions {
+	kr.versions.m.Lock()
+	defer kr.versions.m.Unlock()
+	return &Versions{
+		Krun:   BuildVersion,
+		Proxy:  kr.versions.proxy,
+		Istiod: kr.versions.istiod,
+		Skew:   kr.versions.warnings,
+	}
+}
+
+// StartVersionCheck starts the periodic version skew check.
+func (kr *KRun) StartVersionCheck(ctx context.Context) {
+	if kr.DryRun {
+		return
+	}
+	go func() {
+		delay := 30 * time.Second
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(delay):
+			}
+			kr.checkVersions(ctx)
+			delay = 10 * time.Minute
+		}
+	}()
+}
+
+func (kr *KRun) checkVersions(ctx context.Context) {
+	proxy := kr.proxyVersion(ctx)
+	istiod := kr.istiodVersion(ctx)
+	maxSkew, err := strconv.Atoi(kr.Config("MESH_VERSION_MAX_SKEW", "1"))
+	if err != nil || maxSkew < 0 {
+		maxSkew = 1
+	}
+	warnings := versionSkew(BuildVersion, proxy, istiod, kr.Config("MESH_KRUN_MIN_VERSION", ""), maxSkew)
+
+	kr.versions.m.Lock()
+	kr.versions.proxy = proxy
+	kr.versions.istiod = istiod
+	kr.versions.warnings = warnings
+	kr.versions.m.Unlock()
+	for _, w := range warnings {
+		log.Println("WARNING: version skew", "krun", BuildVersion, "proxy", proxy, "istiod", istiod, "issue", w)
+	}
+}
+
+// versionSkew returns the unsupported combinations. Unknown and development versions are not checked.
+func versionSkew(krun, proxy, istiod, krunMin string, maxSkew int) []string {
+	var res []string
+	if compareMinor(krun, krunMin) < 0 {
+		res = append(res, fmt.Sprintf("krun %s is older than the minimum %s, update the image", krun, krunMin))
+	}
+	if compareMinor(proxy, MinProxyVersion) < 0 {
+		res = append(res, fmt.Sprintf("proxy %s is older than %s, the oldest supported by krun %s", proxy, MinProxyVersion, krun))
+	}
+	pmaj, pmin, pok := minorVersion(proxy)
+	imaj, imin, iok := minorVersion(istiod)
+	if pok && iok {
+		if pmaj != imaj {
+			res = append(res, fmt.Sprintf("proxy %s and istiod %s have different major versions", proxy, istiod))
+		} else if d := pmin - imin; d > maxSkew || -d > maxSkew {
+			res = append(res, fmt.Sprintf("proxy %s and istiod %s are more than %d minor versions apart", proxy, istiod, maxSkew))
+		}
+	}
+	return res
+}
+
+// compareMinor compares the major.minor of 2 versions, returning 0 if either can't be parsed.
+func compareMinor(a, b string) int {
+	amaj, amin, aok := minorVersion(a)
+	bmaj, bmin, bok := minorVersion(b)
+	switch {
+	case !aok || !bok:
+		return 0
+	case amaj != bmaj:
+		return amaj - bmaj
+	}
+	return amin - bmin
+}
+
+// minorVersion parses the major and minor from versions like 1.11.4, v1.12.0-asm.2 or 1.13-master-cloudrun.
+func minorVersion(v string) (int, int, bool) {
+	parts := strings.SplitN(strings.TrimPrefix(v, "v"), ".", 3)
+	if len(parts) < 2 {
+		return 0, 0, false
+	}
+	maj, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, 0, false
+	}
+	n := 0
+	for n < len(parts[1]) && parts[1][n] >= '0' && parts[1][n] <= '9' {
+		n++
+	}
+	minor, err := strconv.Atoi(parts[1][:n])
+	if err != nil {
+		return 0, 0, false
+	}
+	return maj, minor, true
+}
+
+// proxyVersion returns the version of the Istio proxy in the image.
+func (kr *KRun) proxyVersion(ctx context.Context) string {
+	if v := kr.Config("ISTIO_META_ISTIO_VERSION", ""); v != "" {
+		return v
+	}
+	kr.versions.m.Lock()
+	v := kr.versions.proxy
+	kr.versions.m.Unlock()
+	if v != "" || kr.AgentPath() == "" {
+		return v
+	}
+	ctx, cf := context.WithTimeout(ctx, 5*time.Second)
+	defer cf()
+	out, err := exec.CommandContext(ctx, kr.AgentPath(), "version", "-s").Output()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(out))
+}
+
+// istiodVersion returns the version from the control plane identifier, or "" if not connected.
+func (kr *KRun) istiodVersion(ctx context.Context) string {
+	id := ""
+	if kr.XDSClient != nil {
+		id = kr.XDSClient.ControlPlane()
+	}
+	if id == "" && !kr.EnvoyReadyTime.IsZero() {
+		actx, cf := context.WithTimeout(ctx, 5*time.Second)
+		data, err := envoyAdminGet(actx, "/stats?filter=^control_plane.identifier$")
+		cf()
+		if err == nil {
+			id = strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(string(data)), "control_plane.identifier:"))
+		}
+	}
+	return controlPlaneVersion(id)
+}
+
+// controlPlaneVersion extracts the version from an istiod identifier, like
+// {"Component":"istiod","ID":"istiod-5d8f7b6b8c-x2x5z","Info":{"version":"1.12.0",...}}.
+func controlPlaneVersion(id string) string {
+	var cp struct {
+		Info struct {
+			Version string `json:"version"`
+		}
+	}
+	if json.Unmarshal([]byte(id), &cp) != nil {
+		return ""
+	}
+	return cp.Info.Version
+}
+
+// versionMetrics returns the build info and the number of skew warnings.
+func (kr *KRun) versionMetrics() []Metric {
+	v := kr.Versions()
+	return []Metric{
+		{
+			Name:   "krun/build_info",
+			Labels: map[string]string{"krun_version": v.Krun, "proxy_version": v.Proxy, "istiod_version": v.Istiod},
+			Value:  1,
+		},
+		{
+			Name:  "krun/version_skew",
+			Value: float64(len(v.Skew)),
+		},
+	}
+}
+
+// handleVersions returns the Versions, as JSON.
+func (kr *KRun) handleVersions(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("content-type", "application/json")
+	data, _ := json.MarshalIndent(kr.Versions(), "", "  ")
+	w.Write(data)
+}
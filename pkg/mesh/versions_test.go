@@ -0,0 +1,63 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mesh
+
+import (
+	"testing"
+)
+
+func TestVersionSkew(t *testing.T) {
+	for _, tc := range []struct {
+		krun, proxy, istiod, krunMin string
+		want                         int
+	}{
+		{"dev", "1.12.1", "1.12.0", "", 0},
+		{"dev", "1.13-master-cloudrun", "1.12.0-asm.2", "1.2", 0},
+		{"v1.1.0", "1.11.4", "1.13.0", "1.2", 2},
+		{"v1.2.0", "1.9.0", "", "", 1},
+		{"v1.2.0", "1.12.0", "2.0.0", "", 1},
+		{"v1.2.0", "", "1.12.0", "", 0},
+	} {
+		if got := versionSkew(tc.krun, tc.proxy, tc.istiod, tc.krunMin, 1); len(got) != tc.want {
+			t.Error("Unexpected skew", tc, got)
+		}
+	}
+}
+
+func TestControlPlaneVersion(t *testing.T) {
+	v := controlPlaneVersion(`{"Component":"istiod","ID":"istiod-5d8f7b6b8c-x2x5z","Info":{"version":"1.12.0","revision":"abc"}}`)
+	if v != "1.12.0" {
+		t.Error("Unexpected version", v)
+	}
+	if controlPlaneVersion("td") != "" {
+		t.Error("Unexpected version for non-istiod control plane")
+	}
+}
+
+func TestDiscoveryResponseControlPlane(t *testing.T) {
+	id := `{"Component":"istiod","Info":{"version":"1.12.0"}}`
+	msg := appendBytesField(testNameTable("v1", "n1", nil), 7, appendBytesField(nil, 1, []byte(id)))
+	res, err := parseDiscoveryResponse(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &XDSClient{state: map[string]*XDSTypeState{}}
+	if err := c.handleResponse(res); err != nil {
+		t.Fatal(err)
+	}
+	if v := controlPlaneVersion(c.ControlPlane()); v != "1.12.0" {
+		t.Error("Unexpected control plane", c.ControlPlane())
+	}
+}
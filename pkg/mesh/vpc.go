@@ -0,0 +1,165 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mesh
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// VPC access modes for CloudRun.
+//
+// - direct - Direct VPC egress: the instance has an address on the VPC network (eth1), and can be reached by
+// other workloads on the VPC.
+// - connector - Serverless VPC access connector: private ranges are routed through the connector, but the
+// instance has no VPC address and is only reachable through the CloudRun frontend.
+// - none - no VPC access, only public addresses are reachable.
+//
+// MESH_VPC overrides the detection. Outside CloudRun (K_SERVICE not set) the mode is 'direct' - the instance
+// address is on the network. The connector can't be observed from the instance - it is detected by connecting to
+// the internal mesh connector (MESH_CONNECTOR_INTERNAL_ADDR from mesh-env) with a short timeout,
+// MESH_VPC_PROBE_TIMEOUT (default 1s).
+//
+// The mode affects:
+// - WorkloadEntry registration requires a VPC address - INSTANCE_IP or Direct VPC egress.
+// - Inbound capture of the APP_PORTS only applies with Direct VPC egress - there are no VPC clients otherwise.
+// - Without VPC access the in-cluster Istiod is reached using the external mesh connector address (MCON_ADDR).
+//
+// The VPC interface is MESH_INTERFACE if set, else the interface of the most specific route to the cluster CIDR -
+// MESH_CLUSTER_CIDR, default the first OUTBOUND_IP_RANGES_INCLUDE range. The default route is ignored, and 'eth1' is
+// used if no specific route is found.
+const (
+	VPCDirect    = "direct"
+	VPCConnector = "connector"
+	VPCNone      = "none"
+)
+
+// VPCMode returns the VPC access mode of the instance. Detection happens once, after the mesh-env is loaded.
+func (kr *KRun) VPCMode() string {
+	kr.vpcOnce.Do(func() {
+		kr.vpcMode = kr.detectVPC()
+		log.Println("VPC access", "mode", kr.vpcMode, "iface", kr.vpcInterface(), "ip", kr.vpcInterfaceIP())
+	})
+	return kr.vpcMode
+}
+
+func (kr *KRun) detectVPC() string {
+	switch m := kr.Config("MESH_VPC", ""); m {
+	case VPCDirect, VPCConnector, VPCNone:
+		return m
+	case "":
+	default:
+		log.Println("Invalid MESH_VPC, detecting", "value", m)
+	}
+	if os.Getenv("K_SERVICE") == "" || kr.Knative {
+		return VPCDirect
+	}
+	if kr.vpcInterfaceIP() != "" {
+		return VPCDirect
+	}
+	if kr.MeshConnectorInternalAddr == "" {
+		return VPCNone
+	}
+	d, err := time.ParseDuration(kr.Config("MESH_VPC_PROBE_TIMEOUT", "1s"))
+	if err != nil {
+		d = time.Second
+	}
+	c, err := net.DialTimeout("tcp", net.JoinHostPort(kr.MeshConnectorInternalAddr, "15012"), d)
+	if err != nil {
+		return VPCNone
+	}
+	c.Close()
+	return VPCConnector
+}
+
+// routeFile is the kernel IPv4 routing table.
+var routeFile = "/proc/net/route"
+
+// vpcInterfaceIP returns the address of the Direct VPC egress interface, or "".
+func (kr *KRun) vpcInterfaceIP() string {
+	return interfaceIP(kr.vpcInterface())
+}
+
+// vpcInterface returns the name of the interface on the VPC. CloudRun currently uses eth0 for the default network
+// and adds eth1 for the VPC.
+func (kr *KRun) vpcInterface() string {
+	if i := kr.Config("MESH_INTERFACE", ""); i != "" {
+		return i
+	}
+	if f, err := os.Open(routeFile); err == nil {
+		defer f.Close()
+		if i := routeInterface(f, kr.clusterCIDR()); i != "" {
+			return i
+		}
+	}
+	return "eth1"
+}
+
+// clusterCIDR returns the first address of the cluster range.
+func (kr *KRun) clusterCIDR() net.IP {
+	cidr := kr.Config("MESH_CLUSTER_CIDR", "")
+	if cidr == "" {
+		cidr = strings.Split(kr.Config("OUTBOUND_IP_RANGES_INCLUDE", "10.0.0.0/8"), ",")[0]
+	}
+	_, n, err := net.ParseCIDR(strings.TrimSpace(cidr))
+	if err != nil {
+		_, n, _ = net.ParseCIDR("10.0.0.0/8")
+	}
+	return n.IP
+}
+
+// routeInterface returns the interface of the most specific route to the address, in /proc/net/route format.
+// Default routes and loopback are skipped.
+func routeInterface(r io.Reader, ip net.IP) string {
+	ip4 := ip.To4()
+	if ip4 == nil {
+		return ""
+	}
+	addr := binary.BigEndian.Uint32(ip4)
+	best, bestMask := "", uint32(0)
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		f := strings.Fields(s.Text())
+		if len(f) < 8 || f[0] == "Iface" || f[0] == "lo" {
+			continue
+		}
+		dst, err1 := routeHex(f[1])
+		mask, err2 := routeHex(f[7])
+		if err1 != nil || err2 != nil || mask == 0 {
+			continue
+		}
+		if addr&mask == dst && mask > bestMask {
+			best, bestMask = f[0], mask
+		}
+	}
+	return best
+}
+
+// routeHex parses an address in the /proc/net/route format - hex, in host byte order.
+func routeHex(s string) (uint32, error) {
+	b, err := hex.DecodeString(s)
+	if err != nil || len(b) != 4 {
+		return 0, errors.New("invalid route address " + s)
+	}
+	return binary.BigEndian.Uint32([]byte{b[3], b[2], b[1], b[0]}), nil
+}
@@ -0,0 +1,99 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mesh
+
+import (
+	"net"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestVPCMode(t *testing.T) {
+	kr := New()
+	if kr.VPCMode() != VPCDirect {
+		t.Error("Expecting direct outside CloudRun", kr.VPCMode())
+	}
+
+	os.Setenv("K_SERVICE", "fortio")
+	defer os.Unsetenv("K_SERVICE")
+	if New().vpcInterfaceIP() != "" {
+		t.Skip("eth1 present")
+	}
+
+	kr = New()
+	kr.MeshConnectorAddr = "34.1.2.3"
+	kr.MeshConnectorInternalAddr = "10.1.2.3"
+	os.Setenv("MESH_VPC", VPCNone)
+	defer os.Unsetenv("MESH_VPC")
+	if kr.VPCMode() != VPCNone {
+		t.Error("Expecting override", kr.VPCMode())
+	}
+	if a := kr.FindXDSAddr(); a != "34.1.2.3:15012" {
+		t.Error("Expecting external mesh connector", a)
+	}
+	os.Setenv("APP_PORTS", "8081")
+	defer os.Unsetenv("APP_PORTS")
+	if p := kr.inboundCapturePorts(); p != "" {
+		t.Error("Unexpected inbound capture", p)
+	}
+
+	os.Unsetenv("MESH_VPC")
+	kr = New()
+	if kr.VPCMode() != VPCNone {
+		t.Error("Expecting no VPC", kr.VPCMode())
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:15012")
+	if err != nil {
+		t.Skip("port in use")
+	}
+	defer l.Close()
+	kr = New()
+	kr.MeshConnectorInternalAddr = "127.0.0.1"
+	if kr.VPCMode() != VPCConnector {
+		t.Error("Expecting connector", kr.VPCMode())
+	}
+}
+
+func TestRouteInterface(t *testing.T) {
+	routes := `Iface	Destination	Gateway 	Flags	RefCnt	Use	Metric	Mask		MTU	Window	IRTT
+eth0	00000000	010200C0	0003	0	0	0	00000000	0	0	0
+eth0	000200C0	00000000	0001	0	0	0	00FFFFFF	0	0	0
+vpc0	0000000A	0100800A	0003	0	0	0	000000FF	0	0	0
+vpc1	0000800A	00000000	0001	0	0	0	0000F0FF	0	0	0
+`
+	if i := routeInterface(strings.NewReader(routes), net.ParseIP("10.0.0.0")); i != "vpc0" {
+		t.Error("Expecting vpc0", i)
+	}
+	if i := routeInterface(strings.NewReader(routes), net.ParseIP("10.128.1.2")); i != "vpc1" {
+		t.Error("Expecting most specific route", i)
+	}
+	if i := routeInterface(strings.NewReader(routes), net.ParseIP("172.16.0.0")); i != "" {
+		t.Error("Default route should be ignored", i)
+	}
+
+	kr := New()
+	os.Setenv("MESH_INTERFACE", "ens5")
+	defer os.Unsetenv("MESH_INTERFACE")
+	if kr.vpcInterface() != "ens5" {
+		t.Error("Expecting MESH_INTERFACE", kr.vpcInterface())
+	}
+	os.Setenv("MESH_CLUSTER_CIDR", "172.16.0.0/12")
+	defer os.Unsetenv("MESH_CLUSTER_CIDR")
+	if ip := kr.clusterCIDR(); ip.String() != "172.16.0.0" {
+		t.Error("Unexpected cluster CIDR", ip)
+	}
+}
@@ -0,0 +1,215 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mesh
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Liveness watchdog for the agent and Envoy.
+//
+// With MESH_WATCHDOG set, krun checks Envoy /ready and the agent /healthz/ready every MESH_WATCHDOG_INTERVAL
+// (default 10s), after the proxy was ready. If a check keeps failing for MESH_WATCHDOG_WINDOW (default 60s), the
+// policy is applied:
+//
+// - restart - the agent is stopped and started again, like for a proxy upgrade. After MESH_WATCHDOG_MAX_RESTARTS
+// (default 3) restarts the instance is marked unhealthy.
+// - unhealthy - /_krun/healthz on the serving port returns 503. Cloud Run recycles the instance if the liveness
+// probe is configured with this path.
+// - exit - krun exits and Cloud Run starts a new instance.
+//
+// The state is reported in /debug/status.
+
+// Watchdog policies.
+const (
+	WatchdogRestart   = "restart"
+	WatchdogUnhealthy = "unhealthy"
+	WatchdogExit      = "exit"
+)
+
+// watchdogChecks are the health URLs of the proxy, by name.
+var watchdogChecks = map[string]string{
+	"envoy":       "http://" + envoyAdmin + "/ready",
+	"pilot-agent": "http://127.0.0.1:15021/healthz/ready",
+}
+
+// WatchdogStatus is the state of the watchdog.
+type WatchdogStatus struct {
+	Policy string `json:"policy"`
+
+	// FailingSince is the time of the first failed check, reset when the checks pass.
+	FailingSince time.Time `json:"failingSince,omitempty"`
+	LastError    string    `json:"lastError,omitempty"`
+	Restarts     int       `json:"restarts,omitempty"`
+
+	// Unhealthy is the reason the instance was marked unhealthy.
+	Unhealthy string `json:"unhealthy,omitempty"`
+}
+
+type watchdogState struct {
+	m sync.Mutex
+	WatchdogStatus
+}
+
+// StartWatchdog starts the periodic proxy checks, if MESH_WATCHDOG is set. Should be called after the proxy is
+// ready.
+func (kr *KRun) StartWatchdog(ctx context.Context) {
+	policy := kr.Config("MESH_WATCHDOG", "")
+	if policy == "" {
+		return
+	}
+	kr.watchdog.m.Lock()
+	kr.watchdog.Policy = policy
+	kr.watchdog.m.Unlock()
+	interval := kr.configDuration("MESH_WATCHDOG_INTERVAL", 10*time.Second)
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(interval):
+			}
+			if kr.stopping() {
+				return
+			}
+			kr.watchdogCheck(ctx, time.Now())
+		}
+	}()
+}
+
+// watchdogCheck runs the checks once, and applies the policy if they failed for longer than the window.
+func (kr *KRun) watchdogCheck(ctx context.Context, now time.Time) {
+	err := proxyHealth(ctx)
+
+	w := &kr.watchdog
+	w.m.Lock()
+	if err == nil {
+		if !w.FailingSince.IsZero() {
+			log.Println("Watchdog: proxy healthy", "failedFor", now.Sub(w.FailingSince))
+		}
+		w.FailingSince = time.Time{}
+		w.LastError = ""
+		w.m.Unlock()
+		return
+	}
+	if w.FailingSince.IsZero() {
+		w.FailingSince = now
+		log.Println("Watchdog: proxy unhealthy", "err", err)
+	}
+	w.LastError = err.Error()
+	failing := now.Sub(w.FailingSince)
+	policy := w.Policy
+	restarts := w.Restarts
+	w.m.Unlock()
+
+	if failing < kr.configDuration("MESH_WATCHDOG_WINDOW", 60*time.Second) {
+		return
+	}
+	reason := fmt.Sprintf("proxy unhealthy for %v: %v", failing.Round(time.Second), err)
+	switch policy {
+	case WatchdogRestart:
+		maxRestarts, cerr := strconv.Atoi(kr.Config("MESH_WATCHDOG_MAX_RESTARTS", "3"))
+		if cerr != nil {
+			maxRestarts = 3
+		}
+		if restarts >= maxRestarts {
+			kr.markUnhealthy(reason + fmt.Sprintf(", after %d restarts", restarts))
+			return
+		}
+		if rerr := kr.watchdogRestart(); rerr != nil {
+			kr.markUnhealthy(reason + ", restart failed: " + rerr.Error())
+			return
+		}
+		log.Println("Watchdog: restarted the agent", "reason", reason)
+		w.m.Lock()
+		w.Restarts++
+		w.FailingSince = time.Time{}
+		w.m.Unlock()
+	case WatchdogExit:
+		log.Println("Watchdog: exit", "reason", reason)
+		kr.ReportExit("watchdog", nil, errors.New(reason))
+		kr.Exit(1)
+	default:
+		kr.markUnhealthy(reason)
+	}
+}
+
+// watchdogRestart restarts the agent, unless an upgrade is in progress.
+func (kr *KRun) watchdogRestart() error {
+	if kr.agentCmd == nil || kr.agentCmd.Process == nil || kr.agentEnv == nil {
+		return errors.New("agent not running")
+	}
+	if !kr.lockAgent() {
+		return errors.New("upgrade in progress")
+	}
+	defer kr.unlockAgent()
+	return kr.restartAgent(kr.agentEnv, nil)
+}
+
+func (kr *KRun) markUnhealthy(reason string) {
+	kr.watchdog.m.Lock()
+	defer kr.watchdog.m.Unlock()
+	if kr.watchdog.Unhealthy == "" {
+		log.Println("Watchdog: marking the instance unhealthy", "reason", reason)
+	}
+	kr.watchdog.Unhealthy = reason
+}
+
+// Healthy returns an error if the watchdog marked the instance unhealthy. Used for the liveness probe.
+func (kr *KRun) Healthy() error {
+	kr.watchdog.m.Lock()
+	defer kr.watchdog.m.Unlock()
+	if kr.watchdog.Unhealthy != "" {
+		return errors.New(kr.watchdog.Unhealthy)
+	}
+	return nil
+}
+
+// WatchdogStatus returns the state of the watchdog, nil if not enabled.
+func (kr *KRun) WatchdogStatus() *WatchdogStatus {
+	kr.watchdog.m.Lock()
+	defer kr.watchdog.m.Unlock()
+	if kr.watchdog.Policy == "" {
+		return nil
+	}
+	s := kr.watchdog.WatchdogStatus
+	return &s
+}
+
+// proxyHealth returns the first failed proxy check.
+func proxyHealth(ctx context.Context) error {
+	for name, u := range watchdogChecks {
+		if err := checkHTTPOK(ctx, u); err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// handleHealthz is the liveness check on the debug port.
+func (kr *KRun) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	if err := kr.Healthy(); err != nil {
+		http.Error(w, err.Error(), 503)
+		return
+	}
+	w.Write([]byte("ok\n"))
+}
@@ -0,0 +1,78 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mesh
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestWatchdog(t *testing.T) {
+	status := 200
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	}))
+	defer ts.Close()
+	old := watchdogChecks
+	watchdogChecks = map[string]string{"envoy": ts.URL}
+	defer func() { watchdogChecks = old }()
+
+	os.Setenv("MESH_WATCHDOG", WatchdogUnhealthy)
+	defer os.Unsetenv("MESH_WATCHDOG")
+	kr := New()
+	ctx, cf := context.WithCancel(context.Background())
+	defer cf()
+	kr.StartWatchdog(ctx)
+
+	now := time.Now()
+	kr.watchdogCheck(ctx, now)
+	if kr.Healthy() != nil || !kr.WatchdogStatus().FailingSince.IsZero() {
+		t.Error("Expecting healthy", kr.WatchdogStatus())
+	}
+
+	status = 503
+	kr.watchdogCheck(ctx, now)
+	if kr.Healthy() != nil || kr.WatchdogStatus().LastError == "" {
+		t.Error("Expecting healthy within the window", kr.WatchdogStatus())
+	}
+	kr.watchdogCheck(ctx, now.Add(61*time.Second))
+	if kr.Healthy() == nil {
+		t.Error("Expecting unhealthy after the window", kr.WatchdogStatus())
+	}
+
+	// Recovery resets the failure window, the instance stays unhealthy.
+	status = 200
+	kr.watchdogCheck(ctx, now.Add(62*time.Second))
+	if kr.Healthy() == nil || !kr.WatchdogStatus().FailingSince.IsZero() {
+		t.Error("Unexpected status", kr.WatchdogStatus())
+	}
+
+	t.Run("restart", func(t *testing.T) {
+		os.Setenv("MESH_WATCHDOG", WatchdogRestart)
+		kr := New()
+		kr.StartWatchdog(ctx)
+		status = 503
+		kr.watchdogCheck(ctx, now)
+		kr.watchdogCheck(ctx, now.Add(61*time.Second))
+		// No agent running - the restart fails and the instance is marked unhealthy.
+		if kr.Healthy() == nil {
+			t.Error("Expecting unhealthy if the restart fails", kr.WatchdogStatus())
+		}
+	})
+}
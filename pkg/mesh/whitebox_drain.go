@@ -0,0 +1,129 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mesh
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// In whitebox mode the app sends outbound requests to the Envoy HTTP proxy on 15007. On SIGTERM the proxy must
+// keep working until the app is done - otherwise in-flight requests fail when Envoy exits.
+//
+// The app is signaled first. The agent (and Envoy) are stopped when the app exits, or after
+// MESH_PROXY_DRAIN_TIMEOUT (default 8s - CloudRun kills the instance 10s after SIGTERM).
+//
+// The drain status is available on the debug server, as /debug/drain.
+
+// DrainStatus reports the state of the whitebox proxy during shutdown.
+type DrainStatus struct {
+	Whitebox   bool       `json:"whitebox"`
+	Draining   bool       `json:"draining"`
+	DrainStart *time.Time `json:"drainStart,omitempty"`
+	AppRunning bool       `json:"appRunning"`
+
+	// ActiveRequests is the number of requests in progress on the HTTP proxy port, -1 if unknown.
+	ActiveRequests int64 `json:"activeRequests"`
+}
+
+type drainState struct {
+	m       sync.Mutex
+	start   time.Time
+	appDone chan struct{}
+}
+
+// drainProxyAfterApp waits for the app to exit, up to MESH_PROXY_DRAIN_TIMEOUT, then signals the agent.
+func (kr *KRun) drainProxyAfterApp(s os.Signal) {
+	timeout, err := time.ParseDuration(kr.Config("MESH_PROXY_DRAIN_TIMEOUT", "8s"))
+	if err != nil {
+		timeout = 8 * time.Second
+	}
+	t0 := time.Now()
+	kr.drain.m.Lock()
+	kr.drain.start = t0
+	done := kr.drain.appDone
+	kr.drain.m.Unlock()
+
+	log.Println("Draining whitebox proxy", "timeout", timeout)
+	select {
+	case <-done:
+		log.Println("App exited, stopping proxy", "drain", time.Since(t0))
+	case <-time.After(timeout):
+		n, _ := proxyActiveRequests(context.Background())
+		log.Println("Proxy drain timeout, stopping proxy", "activeRequests", n)
+	}
+	if kr.agentCmd != nil && kr.agentCmd.Process != nil {
+		kr.agentCmd.Process.Signal(s)
+	}
+}
+
+// appStarted creates the channel closed when the app exits.
+func (kr *KRun) appStarted() chan struct{} {
+	kr.drain.m.Lock()
+	defer kr.drain.m.Unlock()
+	kr.drain.appDone = make(chan struct{})
+	return kr.drain.appDone
+}
+
+// DrainStatus returns the current drain state.
+func (kr *KRun) DrainStatus(ctx context.Context) *DrainStatus {
+	kr.drain.m.Lock()
+	st := &DrainStatus{
+		Whitebox: kr.WhiteboxMode,
+		Draining: !kr.drain.start.IsZero(),
+	}
+	if st.Draining {
+		t := kr.drain.start
+		st.DrainStart = &t
+	}
+	if done := kr.drain.appDone; done != nil {
+		select {
+		case <-done:
+		default:
+			st.AppRunning = true
+		}
+	}
+	kr.drain.m.Unlock()
+	st.ActiveRequests = -1
+	if st.Whitebox {
+		if n, err := proxyActiveRequests(ctx); err == nil {
+			st.ActiveRequests = n
+		}
+	}
+	return st
+}
+
+func (kr *KRun) handleDrain(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("content-type", "application/json")
+	json.NewEncoder(w).Encode(kr.DrainStatus(r.Context()))
+}
+
+// proxyActiveRequests returns the requests in progress on the whitebox HTTP proxy listener.
+func proxyActiveRequests(ctx context.Context) (int64, error) {
+	st, err := envoyStats(ctx, "15007.*\\.downstream_rq_active$")
+	if err != nil {
+		return 0, err
+	}
+	var n int64
+	for _, v := range st {
+		n += v
+	}
+	return n, nil
+}
@@ -0,0 +1,53 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mesh
+
+import (
+	"context"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestDrainProxyAfterApp(t *testing.T) {
+	os.Setenv("MESH_PROXY_DRAIN_TIMEOUT", "100ms")
+	defer os.Unsetenv("MESH_PROXY_DRAIN_TIMEOUT")
+	kr := New()
+	kr.WhiteboxMode = true
+	done := kr.appStarted()
+	if st := kr.DrainStatus(context.Background()); st.Draining || !st.AppRunning {
+		t.Error("Unexpected status before drain", st)
+	}
+
+	t0 := time.Now()
+	kr.drainProxyAfterApp(syscall.SIGTERM)
+	if time.Since(t0) < 100*time.Millisecond {
+		t.Error("Expecting drain timeout", time.Since(t0))
+	}
+	close(done)
+	st := kr.DrainStatus(context.Background())
+	if !st.Draining || st.DrainStart == nil || st.AppRunning {
+		t.Error("Unexpected status after drain", st)
+	}
+
+	// App already exited - the proxy is stopped without waiting.
+	os.Setenv("MESH_PROXY_DRAIN_TIMEOUT", "10s")
+	t0 = time.Now()
+	kr.drainProxyAfterApp(syscall.SIGTERM)
+	if time.Since(t0) > 5*time.Second {
+		t.Error("Drain should not wait for an exited app")
+	}
+}
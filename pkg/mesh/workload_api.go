@@ -0,0 +1,431 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mesh
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// SPIFFE Workload API and SDS.
+//
+// With MESH_WORKLOAD_API=true krun serves the workload certificates on a UDS socket - MESH_WORKLOAD_API_SOCKET,
+// default /var/run/secrets/workload-spiffe-uds/socket - with two gRPC services:
+//
+// - SpiffeWorkloadAPI - X509-SVIDs and bundles for go-spiffe, ghostunnel and other SPIFFE clients. The socket is set
+// as SPIFFE_ENDPOINT_SOCKET for the app. JWT-SVIDs are not supported - K8S tokens don't have a SPIFFE subject.
+// - envoy.service.secret.v3.SecretDiscoveryService - SDS with the Istio resource names, 'default' for the workload
+// certificate and 'ROOTCA' for the roots. pilot-agent uses the socket instead of its own SDS server if it exists
+// when the agent starts, so Envoy gets the certificates from krun.
+//
+// Requires the certificates to be managed by krun - CA_POOL or a CSR signer. Updates are pushed to the open streams
+// when the certificate is renewed.
+
+const (
+	spiffeSecurityHeader = "workload.spiffe.io"
+	sdsSecretType        = "type.googleapis.com/envoy.extensions.transport_sockets.tls.v3.Secret"
+	sdsDefaultName       = "default"
+	sdsRootName          = "ROOTCA"
+)
+
+// workloadAPIPoll is the interval for checking renewed certificates.
+var workloadAPIPoll = 10 * time.Second
+
+func (kr *KRun) workloadAPISocket() string {
+	return kr.Config("MESH_WORKLOAD_API_SOCKET", filepath.Join(kr.BaseDir, "/var/run/secrets/workload-spiffe-uds/socket"))
+}
+
+// StartWorkloadAPI starts the SPIFFE Workload API and SDS server, if MESH_WORKLOAD_API is enabled. Must be
+// called after the certificates are loaded and before the agent is started.
+func (kr *KRun) StartWorkloadAPI() error {
+	if kr.Config("MESH_WORKLOAD_API", "") != "true" {
+		return nil
+	}
+	if kr.WorkloadCertificate() == nil {
+		return errors.New("workload API requires workload certificates, CA_POOL must be set")
+	}
+	sock := kr.workloadAPISocket()
+	if err := os.MkdirAll(filepath.Dir(sock), 0755); err != nil {
+		return err
+	}
+	os.Remove(sock)
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		return err
+	}
+	// The app and the proxy may run as different users.
+	os.Chmod(sock, 0777)
+
+	go kr.workloadAPIServer().Serve(l)
+	kr.workloadAPIAddr = sock
+	log.Println("SPIFFE Workload API and SDS started", "socket", sock)
+	return nil
+}
+
+func (kr *KRun) workloadAPIServer() *grpc.Server {
+	gs := grpc.NewServer(grpc.ForceServerCodec(rawCodec{}))
+	unimplemented := func(srv interface{}, ctx context.Context, dec func(interface{}) error,
+		_ grpc.UnaryServerInterceptor) (interface{}, error) {
+		return nil, status.Error(codes.Unimplemented, "JWT-SVIDs are not supported")
+	}
+	gs.RegisterService(&grpc.ServiceDesc{
+		ServiceName: "SpiffeWorkloadAPI.SpiffeWorkloadAPI",
+		HandlerType: (*interface{})(nil),
+		Methods: []grpc.MethodDesc{
+			{MethodName: "FetchJWTSVID", Handler: unimplemented},
+			{MethodName: "ValidateJWTSVID", Handler: unimplemented},
+		},
+		Streams: []grpc.StreamDesc{
+			{StreamName: "FetchX509SVID", Handler: kr.fetchX509SVID, ServerStreams: true},
+			{StreamName: "FetchX509Bundles", Handler: kr.fetchX509Bundles, ServerStreams: true},
+			{StreamName: "FetchJWTBundles", ServerStreams: true,
+				Handler: func(srv interface{}, stream grpc.ServerStream) error {
+					return status.Error(codes.Unimplemented, "JWT bundles are not supported")
+				}},
+		},
+		Metadata: "workload.proto",
+	}, kr)
+	gs.RegisterService(&grpc.ServiceDesc{
+		ServiceName: "envoy.service.secret.v3.SecretDiscoveryService",
+		HandlerType: (*interface{})(nil),
+		Streams: []grpc.StreamDesc{{
+			StreamName:    "StreamSecrets",
+			Handler:       kr.streamSecrets,
+			ServerStreams: true,
+			ClientStreams: true,
+		}},
+		Metadata: "envoy/service/secret/v3/sds.proto",
+	}, kr)
+	return gs
+}
+
+// checkSpiffeHeader rejects requests without the security header, required by the Workload API spec.
+func checkSpiffeHeader(ctx context.Context) error {
+	md, _ := metadata.FromIncomingContext(ctx)
+	if v := md.Get(spiffeSecurityHeader); len(v) == 0 || v[0] != "true" {
+		return status.Error(codes.InvalidArgument, "security header missing from request")
+	}
+	return nil
+}
+
+// watchCerts sends the current certificate, and again each time it is renewed.
+func (kr *KRun) watchCerts(stream grpc.ServerStream, send func(kp *tls.Certificate) error) error {
+	if err := checkSpiffeHeader(stream.Context()); err != nil {
+		return err
+	}
+	var msg []byte
+	if err := stream.RecvMsg(&msg); err != nil {
+		return err
+	}
+	var sent *tls.Certificate
+	for {
+		if kp := kr.WorkloadCertificate(); !sameCertificate(kp, sent) {
+			if err := send(kp); err != nil {
+				return err
+			}
+			sent = kp
+		}
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case <-time.After(workloadAPIPoll):
+		}
+	}
+}
+
+func (kr *KRun) fetchX509SVID(srv interface{}, stream grpc.ServerStream) error {
+	return kr.watchCerts(stream, func(kp *tls.Certificate) error {
+		msg, err := kr.encodeX509SVIDResponse(kp)
+		if err != nil {
+			return status.Error(codes.Unavailable, err.Error())
+		}
+		return stream.SendMsg(msg)
+	})
+}
+
+func (kr *KRun) fetchX509Bundles(srv interface{}, stream grpc.ServerStream) error {
+	return kr.watchCerts(stream, func(kp *tls.Certificate) error {
+		// X509BundlesResponse, bundles map keyed by trust domain
+		var b []byte
+		b = protowire.AppendTag(b, 2, protowire.BytesType)
+		b = protowire.AppendBytes(b, kr.encodeBundleEntry())
+		return stream.SendMsg(b)
+	})
+}
+
+// encodeX509SVIDResponse returns a X509SVIDResponse with the workload certificate.
+func (kr *KRun) encodeX509SVIDResponse(kp *tls.Certificate) ([]byte, error) {
+	if kp == nil || len(kp.Certificate) == 0 {
+		return nil, errors.New("no workload certificate")
+	}
+	key, err := x509.MarshalPKCS8PrivateKey(kp.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+	leaf := kp.Leaf
+	if leaf == nil {
+		if leaf, err = x509.ParseCertificate(kp.Certificate[0]); err != nil {
+			return nil, err
+		}
+	}
+	id := kr.SpiffeID()
+	for _, u := range leaf.URIs {
+		if u.Scheme == "spiffe" {
+			id = u.String()
+		}
+	}
+	var svid []byte
+	svid = protowire.AppendTag(svid, 1, protowire.BytesType)
+	svid = protowire.AppendString(svid, id)
+	svid = protowire.AppendTag(svid, 2, protowire.BytesType)
+	svid = protowire.AppendBytes(svid, bytes.Join(kp.Certificate, nil))
+	svid = protowire.AppendTag(svid, 3, protowire.BytesType)
+	svid = protowire.AppendBytes(svid, key)
+	svid = protowire.AppendTag(svid, 4, protowire.BytesType)
+	svid = protowire.AppendBytes(svid, bytes.Join(kr.meshRootsDER(), nil))
+
+	var b []byte
+	b = protowire.AppendTag(b, 1, protowire.BytesType)
+	b = protowire.AppendBytes(b, svid)
+	return b, nil
+}
+
+// encodeBundleEntry returns the map entry with the roots of the trust domain.
+func (kr *KRun) encodeBundleEntry() []byte {
+	var e []byte
+	e = protowire.AppendTag(e, 1, protowire.BytesType)
+	e = protowire.AppendString(e, "spiffe://"+kr.TrustDomain)
+	e = protowire.AppendTag(e, 2, protowire.BytesType)
+	e = protowire.AppendBytes(e, bytes.Join(kr.meshRootsDER(), nil))
+	return e
+}
+
+// meshRootsDER returns the mesh roots - saved by InitRoots, from the mesh-env and CARoots - without duplicates.
+func (kr *KRun) meshRootsDER() [][]byte {
+	pems := []string{}
+	if data, err := ioutil.ReadFile(filepath.Join(WorkloadCertDir, WorkloadRootCAs)); err == nil {
+		pems = append(pems, string(data))
+	}
+	for k, v := range kr.MeshEnv {
+		if strings.HasPrefix(k, "CAROOT") {
+			pems = append(pems, v)
+		}
+	}
+	pems = append(pems, kr.CARoots...)
+	res := [][]byte{}
+	for _, p := range pems {
+		block, rest := pem.Decode([]byte(p))
+		for block != nil {
+			dup := false
+			for _, r := range res {
+				if bytes.Equal(r, block.Bytes) {
+					dup = true
+				}
+			}
+			if !dup && block.Type == "CERTIFICATE" {
+				res = append(res, block.Bytes)
+			}
+			block, rest = pem.Decode(rest)
+		}
+	}
+	return res
+}
+
+type sdsRequest struct {
+	Names []string
+	Nonce string
+	Error string
+}
+
+func parseSDSRequest(b []byte) (*sdsRequest, error) {
+	r := &sdsRequest{}
+	err := protoFields(b, func(num protowire.Number, v []byte, _ uint64) error {
+		switch num {
+		case 3:
+			r.Names = append(r.Names, string(v))
+		case 5:
+			r.Nonce = string(v)
+		case 6:
+			r.Error = protoString(v, 2)
+		}
+		return nil
+	})
+	return r, err
+}
+
+// streamSecrets implements SDS, with the Istio resource names. Other names are ignored.
+func (kr *KRun) streamSecrets(srv interface{}, stream grpc.ServerStream) error {
+	reqs := make(chan *sdsRequest)
+	errc := make(chan error, 1)
+	go func() {
+		for {
+			var msg []byte
+			if err := stream.RecvMsg(&msg); err != nil {
+				errc <- err
+				return
+			}
+			r, err := parseSDSRequest(msg)
+			if err != nil {
+				errc <- err
+				return
+			}
+			select {
+			case reqs <- r:
+			case <-stream.Context().Done():
+				return
+			}
+		}
+	}()
+
+	var names []string
+	var sent *tls.Certificate
+	nonce := 0
+	for {
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case err := <-errc:
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		case r := <-reqs:
+			if r.Error != "" {
+				log.Println("SDS NACK", "names", r.Names, "err", r.Error)
+				continue
+			}
+			if r.Nonce != "" && strings.Join(r.Names, ",") == strings.Join(names, ",") {
+				continue // ACK
+			}
+			names = r.Names
+		case <-time.After(workloadAPIPoll):
+			if sameCertificate(kr.WorkloadCertificate(), sent) {
+				continue
+			}
+		}
+		kp := kr.WorkloadCertificate()
+		nonce++
+		msg, err := kr.encodeSDSResponse(kp, names, fmt.Sprint(nonce))
+		if err != nil {
+			return status.Error(codes.Unavailable, err.Error())
+		}
+		if err := stream.SendMsg(msg); err != nil {
+			return err
+		}
+		sent = kp
+	}
+}
+
+// encodeSDSResponse returns a DiscoveryResponse with the requested secrets.
+func (kr *KRun) encodeSDSResponse(kp *tls.Certificate, names []string, nonce string) ([]byte, error) {
+	var b []byte
+	version := ""
+	for _, n := range names {
+		var secret []byte
+		secret = protowire.AppendTag(secret, 1, protowire.BytesType)
+		secret = protowire.AppendString(secret, n)
+		switch n {
+		case sdsDefaultName:
+			if kp == nil || len(kp.Certificate) == 0 {
+				return nil, errors.New("no workload certificate")
+			}
+			key, err := x509.MarshalPKCS8PrivateKey(kp.PrivateKey)
+			if err != nil {
+				return nil, err
+			}
+			chain := &bytes.Buffer{}
+			for _, c := range kp.Certificate {
+				pem.Encode(chain, &pem.Block{Type: "CERTIFICATE", Bytes: c})
+			}
+			var tc []byte
+			tc = protowire.AppendTag(tc, 1, protowire.BytesType)
+			tc = protowire.AppendBytes(tc, inlineDataSource(chain.Bytes()))
+			tc = protowire.AppendTag(tc, 2, protowire.BytesType)
+			tc = protowire.AppendBytes(tc, inlineDataSource(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: key})))
+			secret = protowire.AppendTag(secret, 2, protowire.BytesType)
+			secret = protowire.AppendBytes(secret, tc)
+			if kp.Leaf != nil {
+				version = kp.Leaf.NotBefore.UTC().Format(time.RFC3339)
+			}
+		case sdsRootName:
+			roots := &bytes.Buffer{}
+			for _, r := range kr.meshRootsDER() {
+				pem.Encode(roots, &pem.Block{Type: "CERTIFICATE", Bytes: r})
+			}
+			var vc []byte
+			vc = protowire.AppendTag(vc, 1, protowire.BytesType)
+			vc = protowire.AppendBytes(vc, inlineDataSource(roots.Bytes()))
+			secret = protowire.AppendTag(secret, 4, protowire.BytesType)
+			secret = protowire.AppendBytes(secret, vc)
+		default:
+			continue
+		}
+		var res []byte
+		res = protowire.AppendTag(res, 1, protowire.BytesType)
+		res = protowire.AppendString(res, sdsSecretType)
+		res = protowire.AppendTag(res, 2, protowire.BytesType)
+		res = protowire.AppendBytes(res, secret)
+		b = protowire.AppendTag(b, 2, protowire.BytesType)
+		b = protowire.AppendBytes(b, res)
+	}
+	if version == "" {
+		version = nonce
+	}
+	b = protowire.AppendTag(b, 1, protowire.BytesType)
+	b = protowire.AppendString(b, version)
+	b = protowire.AppendTag(b, 4, protowire.BytesType)
+	b = protowire.AppendString(b, sdsSecretType)
+	b = protowire.AppendTag(b, 5, protowire.BytesType)
+	b = protowire.AppendString(b, nonce)
+	return b, nil
+}
+
+// inlineDataSource returns an envoy.config.core.v3.DataSource with inline_bytes.
+func inlineDataSource(data []byte) []byte {
+	var b []byte
+	b = protowire.AppendTag(b, 2, protowire.BytesType)
+	return protowire.AppendBytes(b, data)
+}
+
+// workloadAPIEnv returns the app env for the Workload API.
+func (kr *KRun) workloadAPIEnv() []string {
+	if kr.workloadAPIAddr == "" {
+		return nil
+	}
+	sock, err := filepath.Abs(kr.workloadAPIAddr)
+	if err != nil {
+		sock = kr.workloadAPIAddr
+	}
+	return []string{"SPIFFE_ENDPOINT_SOCKET=unix://" + sock}
+}
@@ -0,0 +1,175 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mesh
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+func init() {
+	// Renewed certificates are sent quickly in tests - set once, the servers keep running after the tests.
+	workloadAPIPoll = 10 * time.Millisecond
+}
+
+func TestWorkloadAPI(t *testing.T) {
+	dir := t.TempDir()
+	ca, err := NewLocalCA(dir, "cluster.local")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sock := filepath.Join(dir, "socket")
+	os.Setenv("MESH_WORKLOAD_API", "true")
+	defer os.Unsetenv("MESH_WORKLOAD_API")
+	os.Setenv("MESH_WORKLOAD_API_SOCKET", sock)
+	defer os.Unsetenv("MESH_WORKLOAD_API_SOCKET")
+
+	kr := New()
+	kr.TrustDomain = "cluster.local"
+	kr.Namespace = "ns"
+	kr.KSA = "sa"
+	ca.kr = kr
+	kr.CSRSigner = ca
+	kr.SkipSaveCerts = true
+	kr.CARoots = []string{string(ca.CertPEM)}
+	ctx := context.Background()
+	if err := kr.InitCertificates(ctx, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := kr.StartWorkloadAPI(); err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := grpc.Dial("workload", grpc.WithInsecure(),
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", sock)
+		}),
+		grpc.WithDefaultCallOptions(grpc.ForceCodec(rawCodec{})))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	fetch := func(ctx context.Context) ([]byte, error) {
+		s, err := conn.NewStream(ctx, &grpc.StreamDesc{ServerStreams: true},
+			"/SpiffeWorkloadAPI.SpiffeWorkloadAPI/FetchX509SVID")
+		if err != nil {
+			return nil, err
+		}
+		if err := s.SendMsg([]byte{}); err != nil {
+			return nil, err
+		}
+		s.CloseSend()
+		var msg []byte
+		return msg, s.RecvMsg(&msg)
+	}
+
+	sctx, cf := context.WithCancel(ctx)
+	defer cf()
+	if _, err := fetch(sctx); status.Code(err) != codes.InvalidArgument {
+		t.Error("Expecting security header error", err)
+	}
+
+	msg, err := fetch(metadata.AppendToOutgoingContext(sctx, spiffeSecurityHeader, "true"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	svid := protoBytes(msg, 1)
+	if id := protoString(svid, 1); id != "spiffe://cluster.local/ns/ns/sa/sa" {
+		t.Error("Unexpected SPIFFE ID", id)
+	}
+	if certs, err := x509.ParseCertificates(protoBytes(svid, 2)); err != nil || len(certs) == 0 {
+		t.Error("Invalid SVID", err)
+	}
+	if roots, err := x509.ParseCertificates(protoBytes(svid, 4)); err != nil || len(roots) != 1 {
+		t.Error("Invalid bundle", len(roots), err)
+	}
+
+	t.Run("sds", func(t *testing.T) {
+		s, err := conn.NewStream(sctx, &grpc.StreamDesc{ServerStreams: true, ClientStreams: true},
+			"/envoy.service.secret.v3.SecretDiscoveryService/StreamSecrets")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var req []byte
+		for _, n := range []string{sdsDefaultName, sdsRootName, "unknown"} {
+			req = protowire.AppendTag(req, 3, protowire.BytesType)
+			req = protowire.AppendString(req, n)
+		}
+		if err := s.SendMsg(req); err != nil {
+			t.Fatal(err)
+		}
+		var msg []byte
+		if err := s.RecvMsg(&msg); err != nil {
+			t.Fatal(err)
+		}
+		res, err := parseDiscoveryResponse(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.TypeURL != sdsSecretType || len(res.Resources) != 2 {
+			t.Fatal("Unexpected response", res.TypeURL, len(res.Resources))
+		}
+		if n := protoString(res.Resources[0], 1); n != sdsDefaultName || len(protoBytes(res.Resources[0], 2)) == 0 {
+			t.Error("Missing certificate", n)
+		}
+		if n := protoString(res.Resources[1], 1); n != sdsRootName || len(protoBytes(res.Resources[1], 4)) == 0 {
+			t.Error("Missing roots", n)
+		}
+
+		// ACK, then renew the certificate while the stream is watching it.
+		ack := protowire.AppendTag(append([]byte{}, req...), 5, protowire.BytesType)
+		ack = protowire.AppendString(ack, res.Nonce)
+		if err := s.SendMsg(ack); err != nil {
+			t.Fatal(err)
+		}
+		old := kr.WorkloadCertificate()
+		// Same certificate, new pointer - not sent again.
+		cp := *old
+		kr.setWorkloadCertificate(&cp)
+		go kr.InitCertificates(ctx, "")
+		if err := s.RecvMsg(&msg); err != nil {
+			t.Fatal(err)
+		}
+		res, err = parseDiscoveryResponse(msg)
+		if err != nil || len(res.Resources) != 2 {
+			t.Fatal("Unexpected response", err)
+		}
+		if sameCertificate(kr.WorkloadCertificate(), old) {
+			t.Error("Certificate not renewed")
+		}
+	})
+}
+
+func TestSameCertificate(t *testing.T) {
+	a := &tls.Certificate{Certificate: [][]byte{[]byte("leaf1"), []byte("root")}}
+	b := &tls.Certificate{Certificate: [][]byte{[]byte("leaf1")}}
+	c := &tls.Certificate{Certificate: [][]byte{[]byte("leaf2"), []byte("root")}}
+	if !sameCertificate(a, b) || sameCertificate(a, c) || sameCertificate(a, nil) || !sameCertificate(nil, nil) {
+		t.Error("Unexpected comparison")
+	}
+}
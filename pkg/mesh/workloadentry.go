@@ -0,0 +1,273 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mesh
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// WorkloadEntry registration by krun.
+//
+// Istiod can auto-register workloads connecting with ISTIO_META_AUTO_REGISTER_GROUP, but it requires a
+// WorkloadGroup and the entry lifetime is tied to the XDS connection. With MESH_WORKLOAD_ENTRY=true krun creates
+// the WorkloadEntry directly in the config cluster, using the instance IP on the VPC network, and deletes it on
+// exit. The Healthy condition reflects the app readiness.
+//
+// CloudRun instances may be killed without running the cleanup. The entry is owned by a Lease that krun renews
+// every MESH_WORKLOAD_LEASE_DURATION/3 (default 60s) - the mesh connector deletes expired leases, and the
+// WorkloadEntry is garbage collected with it. MESH_WORKLOAD_LEASE=false disables the lease.
+
+// WorkloadEntryAPI is the API path for WorkloadEntry resources.
+const WorkloadEntryAPI = "/apis/networking.istio.io/v1beta1"
+
+// RegisterWorkloadEntry creates or updates the WorkloadEntry for this instance. Should be called after the app
+// is ready.
+func (kr *KRun) RegisterWorkloadEntry(ctx context.Context, healthy bool) error {
+	if kr.Config("MESH_WORKLOAD_ENTRY", "") != "true" || kr.Knative {
+		return nil
+	}
+	rw, ok := kr.Cfg.(ResourceWriter)
+	if !ok {
+		return errors.New("config source doesn't support writing WorkloadEntry")
+	}
+	if kr.Config("INSTANCE_IP", "") == "" && kr.VPCMode() != VPCDirect {
+		return errors.New("no VPC address for WorkloadEntry, Direct VPC egress or INSTANCE_IP required, mode " + kr.VPCMode())
+	}
+	ip := kr.InstanceIP()
+	if ip == "" {
+		return errors.New("instance IP not found, set INSTANCE_IP")
+	}
+	name := kr.WorkloadEntryName()
+	lh, lease := kr.Cfg.(LeaseHolder)
+	lease = lease && kr.Config("MESH_WORKLOAD_LEASE", "true") == "true"
+	uid := ""
+	if lease {
+		var err error
+		uid, err = lh.RenewLease(ctx, kr.Namespace, name, kr.leaseHolder(), kr.leaseDuration())
+		if err != nil {
+			return err
+		}
+	}
+	err := rw.ApplyResource(ctx, WorkloadEntryAPI, "workloadentries", kr.Namespace, name,
+		kr.workloadEntryObject(ip, healthy, name, uid))
+	if err != nil {
+		return err
+	}
+	kr.workloadEntryM.Lock()
+	renew := kr.workloadEntry == ""
+	kr.workloadEntry = name
+	kr.workloadEntryIP = ip
+	kr.workloadEntryHealthy = healthy
+	kr.workloadEntryM.Unlock()
+	if lease && renew {
+		go kr.renewLease(lh, rw, name, uid)
+	}
+	log.Println("Registered WorkloadEntry", "name", name, "ip", ip, "healthy", healthy)
+	return nil
+}
+
+// UnregisterWorkloadEntry deletes the WorkloadEntry created by RegisterWorkloadEntry. Safe to call multiple times.
+func (kr *KRun) UnregisterWorkloadEntry() {
+	kr.workloadEntryM.Lock()
+	name := kr.workloadEntry
+	kr.workloadEntry = ""
+	kr.workloadEntryM.Unlock()
+	if name == "" {
+		return
+	}
+	rw, ok := kr.Cfg.(ResourceWriter)
+	if !ok {
+		return
+	}
+	ctx, cf := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cf()
+	err := rw.DeleteResource(ctx, WorkloadEntryAPI, "workloadentries", kr.Namespace, name)
+	log.Println("Deleted WorkloadEntry", "name", name, "err", err)
+	if lh, ok := kr.Cfg.(LeaseHolder); ok {
+		lh.DeleteLease(ctx, kr.Namespace, name)
+	}
+}
+
+// renewLease keeps the lease for the WorkloadEntry, until it is unregistered.
+func (kr *KRun) renewLease(lh LeaseHolder, rw ResourceWriter, name, uid string) {
+	d := kr.leaseDuration()
+	for {
+		time.Sleep(d / 3)
+		if !kr.renewLeaseOnce(lh, rw, name, &uid, d) {
+			return
+		}
+	}
+}
+
+// renewLeaseOnce renews the lease, returning false if the entry was unregistered. If the lease was deleted by
+// the mesh connector - for example after a long freeze of the instance - it is recreated with a new UID, and the
+// WorkloadEntry, which was garbage collected with the old lease, is applied again.
+func (kr *KRun) renewLeaseOnce(lh LeaseHolder, rw ResourceWriter, name string, uid *string, d time.Duration) bool {
+	kr.workloadEntryM.Lock()
+	cur, ip, healthy := kr.workloadEntry, kr.workloadEntryIP, kr.workloadEntryHealthy
+	kr.workloadEntryM.Unlock()
+	if cur != name {
+		return false
+	}
+	ctx, cf := context.WithTimeout(context.Background(), d/3)
+	defer cf()
+	newUID, err := lh.RenewLease(ctx, kr.Namespace, name, kr.leaseHolder(), d)
+	if err != nil {
+		log.Println("Failed to renew WorkloadEntry lease", "name", name, "err", err)
+		return true
+	}
+	if newUID == *uid {
+		return true
+	}
+	err = rw.ApplyResource(ctx, WorkloadEntryAPI, "workloadentries", kr.Namespace, name,
+		kr.workloadEntryObject(ip, healthy, name, newUID))
+	log.Println("Lease recreated, applied WorkloadEntry", "name", name, "uid", newUID, "err", err)
+	if err == nil {
+		*uid = newUID
+	}
+	return true
+}
+
+func (kr *KRun) leaseDuration() time.Duration {
+	d, err := time.ParseDuration(kr.Config("MESH_WORKLOAD_LEASE_DURATION", "60s"))
+	if err != nil || d < 3*time.Second {
+		d = 60 * time.Second
+	}
+	return d
+}
+
+func (kr *KRun) leaseHolder() string {
+	if kr.InstanceID != "" {
+		return kr.InstanceID
+	}
+	h, _ := os.Hostname()
+	return h
+}
+
+// WorkloadEntryName returns the name of the entry for this instance - the workload name and a hash of the
+// instance ID, which is too long to use directly.
+func (kr *KRun) WorkloadEntryName() string {
+	id := kr.InstanceID
+	if id == "" {
+		id, _ = os.Hostname()
+	}
+	h := sha256.Sum256([]byte(id))
+	return kr.Name + "-" + hex.EncodeToString(h[:])[0:10]
+}
+
+// workloadEntryObject returns the WorkloadEntry for the instance. If leaseUID is set, the entry is owned by the
+// lease with the same name.
+func (kr *KRun) workloadEntryObject(ip string, healthy bool, name, leaseUID string) map[string]interface{} {
+	labels := map[string]interface{}{}
+	for k, v := range kr.Labels {
+		labels[k] = v
+	}
+	spec := map[string]interface{}{
+		"address":        ip,
+		"labels":         labels,
+		"serviceAccount": kr.KSA,
+	}
+	if n := kr.Network(); n != "" {
+		spec["network"] = n
+	} else if kr.NetworkName != "" {
+		spec["network"] = kr.NetworkName
+	}
+	status := "False"
+	if healthy {
+		status = "True"
+	}
+	meta := map[string]interface{}{
+		"labels": labels,
+		"annotations": map[string]interface{}{
+			"krun.cloud.google.com/instance": kr.InstanceID,
+		},
+	}
+	if leaseUID != "" {
+		meta["ownerReferences"] = []interface{}{
+			map[string]interface{}{
+				"apiVersion": "coordination.k8s.io/v1",
+				"kind":       "Lease",
+				"name":       name,
+				"uid":        leaseUID,
+			},
+		}
+	}
+	return map[string]interface{}{
+		"apiVersion": "networking.istio.io/v1beta1",
+		"kind":       "WorkloadEntry",
+		"metadata":   meta,
+		"spec":       spec,
+		"status": map[string]interface{}{
+			"conditions": []interface{}{
+				map[string]interface{}{
+					"type":          "Healthy",
+					"status":        status,
+					"lastProbeTime": time.Now().UTC().Format(time.RFC3339),
+				},
+			},
+		},
+	}
+}
+
+// InstanceIP returns the address other workloads can use to reach this instance. INSTANCE_IP overrides the
+// detection. On Knative pods POD_IP is used, if set with the downward API. In CloudRun with Direct VPC egress the
+// VPC address is on eth1, eth0 is used otherwise - it is not reachable from the VPC, see VPCMode.
+func (kr *KRun) InstanceIP() string {
+	if ip := kr.Config("INSTANCE_IP", ""); ip != "" {
+		return ip
+	}
+	if ip := os.Getenv("POD_IP"); kr.Knative && ip != "" {
+		return ip
+	}
+	if ip := kr.vpcInterfaceIP(); ip != "" {
+		return ip
+	}
+	if ip := interfaceIP("eth0"); ip != "" {
+		return ip
+	}
+	ifs, _ := net.Interfaces()
+	for _, i := range ifs {
+		if i.Flags&net.FlagLoopback != 0 || i.Flags&net.FlagUp == 0 {
+			continue
+		}
+		if ip := interfaceIP(i.Name); ip != "" {
+			return ip
+		}
+	}
+	return ""
+}
+
+// interfaceIP returns the first IPv4 address of the interface, or "".
+func interfaceIP(name string) string {
+	i, err := net.InterfaceByName(name)
+	if err != nil {
+		return ""
+	}
+	addrs, _ := i.Addrs()
+	for _, a := range addrs {
+		if ipn, ok := a.(*net.IPNet); ok && ipn.IP.To4() != nil && !strings.HasPrefix(ipn.IP.String(), "169.254.") {
+			return ipn.IP.String()
+		}
+	}
+	return ""
+}
@@ -0,0 +1,184 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mesh
+
+import (
+	"context"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeLeaseHolder is a Cfg storing resources and returning a fixed lease UID.
+type fakeLeaseHolder struct {
+	fakeResourceWriter
+	uid     string
+	renewed int
+	deleted []string
+}
+
+func (f *fakeLeaseHolder) RenewLease(ctx context.Context, ns, name, holder string, duration time.Duration) (string, error) {
+	f.renewed++
+	return f.uid, nil
+}
+
+func (f *fakeLeaseHolder) DeleteLease(ctx context.Context, ns, name string) error {
+	f.deleted = append(f.deleted, ns+"/"+name)
+	return nil
+}
+
+func leaseOwner(obj map[string]interface{}) string {
+	refs, _ := obj["metadata"].(map[string]interface{})["ownerReferences"].([]interface{})
+	if len(refs) != 1 {
+		return ""
+	}
+	return refs[0].(map[string]interface{})["uid"].(string)
+}
+
+func TestRenewLeaseRecreated(t *testing.T) {
+	kr := New()
+	kr.Name = "fortio"
+	kr.Namespace = "ns"
+	lh := &fakeLeaseHolder{fakeResourceWriter: fakeResourceWriter{objs: map[string]map[string]interface{}{}}, uid: "uid1"}
+	name := kr.WorkloadEntryName()
+	key := WorkloadEntryAPI + "/workloadentries/ns/" + name
+	kr.workloadEntry = name
+	kr.workloadEntryIP = "10.0.0.1"
+	kr.workloadEntryHealthy = true
+
+	// Same lease - the entry is not written again.
+	uid := "uid1"
+	if !kr.renewLeaseOnce(lh, lh, name, &uid, time.Minute) || lh.objs[key] != nil {
+		t.Fatal("Unexpected apply", lh.objs)
+	}
+
+	// The lease was deleted by the mesh connector and recreated - the entry must be owned by the new lease.
+	lh.uid = "uid2"
+	if !kr.renewLeaseOnce(lh, lh, name, &uid, time.Minute) {
+		t.Fatal("Renew stopped")
+	}
+	if uid != "uid2" || leaseOwner(lh.objs[key]) != "uid2" {
+		t.Fatal("WorkloadEntry not re-applied", uid, lh.objs[key])
+	}
+
+	kr.workloadEntry = ""
+	if kr.renewLeaseOnce(lh, lh, name, &uid, time.Minute) || lh.renewed != 2 {
+		t.Error("Renewed after unregister", lh.renewed)
+	}
+}
+
+func TestWorkloadEntryName(t *testing.T) {
+	kr := New()
+	kr.Name = "fortio"
+	kr.InstanceID = "00bf4bf02d6a1b27bd9d3e7f1a2b3c4d5e6f"
+	n := kr.WorkloadEntryName()
+	if !strings.HasPrefix(n, "fortio-") || len(n) != len("fortio-")+10 {
+		t.Error("Unexpected name", n)
+	}
+	if kr.WorkloadEntryName() != n {
+		t.Error("Name not stable")
+	}
+	kr.InstanceID = "00bf4bf02d6a1b27bd9d3e7f1a2b3c4d5e70"
+	if kr.WorkloadEntryName() == n {
+		t.Error("Expecting a different name for each instance", n)
+	}
+}
+
+func TestWorkloadEntryObject(t *testing.T) {
+	kr := New()
+	kr.KSA = "sa"
+	kr.InstanceID = "instance1"
+	kr.Labels = map[string]string{"app": "fortio"}
+	kr.NetworkName = "default"
+
+	obj := kr.workloadEntryObject("10.0.0.1", false, "fortio-1", "")
+	spec := obj["spec"].(map[string]interface{})
+	if spec["address"] != "10.0.0.1" || spec["serviceAccount"] != "sa" || spec["network"] != "default" ||
+		spec["labels"].(map[string]interface{})["app"] != "fortio" {
+		t.Error("Unexpected spec", spec)
+	}
+	meta := obj["metadata"].(map[string]interface{})
+	if meta["annotations"].(map[string]interface{})["krun.cloud.google.com/instance"] != "instance1" {
+		t.Error("Missing instance annotation", meta)
+	}
+	if _, f := meta["ownerReferences"]; f {
+		t.Error("Unexpected owner without lease", meta)
+	}
+	cond := obj["status"].(map[string]interface{})["conditions"].([]interface{})[0].(map[string]interface{})
+	if cond["type"] != "Healthy" || cond["status"] != "False" {
+		t.Error("Unexpected condition", cond)
+	}
+
+	obj = kr.workloadEntryObject("10.0.0.1", true, "fortio-1", "uid1")
+	cond = obj["status"].(map[string]interface{})["conditions"].([]interface{})[0].(map[string]interface{})
+	if cond["status"] != "True" || leaseOwner(obj) != "uid1" {
+		t.Error("Unexpected healthy entry", cond, obj["metadata"])
+	}
+}
+
+func TestRegisterWorkloadEntry(t *testing.T) {
+	os.Setenv("MESH_WORKLOAD_ENTRY", "true")
+	defer os.Unsetenv("MESH_WORKLOAD_ENTRY")
+	os.Setenv("MESH_VPC", VPCNone)
+	defer os.Unsetenv("MESH_VPC")
+	ctx := context.Background()
+
+	kr := New()
+	kr.Name = "fortio"
+	kr.Namespace = "ns"
+	lh := &fakeLeaseHolder{fakeResourceWriter: fakeResourceWriter{objs: map[string]map[string]interface{}{}}, uid: "uid1"}
+	kr.Cfg = lh
+	// Without VPC access the instance address is not reachable from the mesh.
+	if err := kr.RegisterWorkloadEntry(ctx, true); err == nil {
+		t.Fatal("Expecting error without VPC address")
+	}
+
+	os.Setenv("INSTANCE_IP", "10.0.0.5")
+	defer os.Unsetenv("INSTANCE_IP")
+	if err := kr.RegisterWorkloadEntry(ctx, true); err != nil {
+		t.Fatal(err)
+	}
+	name := kr.WorkloadEntryName()
+	key := WorkloadEntryAPI + "/workloadentries/ns/" + name
+	obj := lh.objs[key]
+	if obj == nil || obj["spec"].(map[string]interface{})["address"] != "10.0.0.5" || leaseOwner(obj) != "uid1" {
+		t.Fatal("Unexpected WorkloadEntry", lh.objs)
+	}
+	if lh.renewed != 1 {
+		t.Error("Lease not created", lh.renewed)
+	}
+
+	kr.UnregisterWorkloadEntry()
+	if lh.objs[key] != nil || len(lh.deleted) != 1 || lh.deleted[0] != "ns/"+name {
+		t.Error("WorkloadEntry or lease not deleted", lh.objs, lh.deleted)
+	}
+	// Safe to call again.
+	kr.UnregisterWorkloadEntry()
+	if len(lh.deleted) != 1 {
+		t.Error("Lease deleted twice", lh.deleted)
+	}
+
+	// Without the lease the entry has no owner.
+	os.Setenv("MESH_WORKLOAD_LEASE", "false")
+	defer os.Unsetenv("MESH_WORKLOAD_LEASE")
+	if err := kr.RegisterWorkloadEntry(ctx, false); err != nil {
+		t.Fatal(err)
+	}
+	if obj := lh.objs[key]; obj == nil || leaseOwner(obj) != "" || lh.renewed != 1 {
+		t.Error("Unexpected entry without lease", obj, lh.renewed)
+	}
+	kr.UnregisterWorkloadEntry()
+}
@@ -0,0 +1,565 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mesh
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/google"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+)
+
+// In-process ADS client, for DISABLE_ENVOY mode.
+//
+// Without Envoy the agent is only used for certificates and the DNS proxy - krun can get the certificates itself,
+// and this client replaces the rest: it connects to the control plane (istiod using the mesh connector, or MCP),
+// and keeps the NDS name table and the LDS listener names.
+//
+// Mesh names are added to /etc/hosts when running as root, and are available with XDSClient.Lookup. The
+// current state is returned by /debug/config_dump on the debug port.
+//
+// Enabled with MESH_XDS_CLIENT=true. MESH_XDS_CLIENT_CREDS selects the credentials: google_default (default for
+// port 443), tls (default for 15012 - mesh roots and a token with the istio-ca audience) or insecure.
+//
+// To avoid a dependency on the large generated Envoy API, the messages are encoded directly in the wire format -
+// like the ALS receiver.
+
+const (
+	adsMethod = "/envoy.service.discovery.v3.AggregatedDiscoveryService/StreamAggregatedResources"
+
+	NameTableType = "type.googleapis.com/istio.networking.nds.v1.NameTable"
+	ListenerType  = "type.googleapis.com/envoy.config.listener.v3.Listener"
+	ClusterType   = "type.googleapis.com/envoy.config.cluster.v3.Cluster"
+
+	xdsHostsBlockStart = "# BEGIN krun xds names"
+	xdsHostsBlockEnd   = "# END krun xds names"
+)
+
+// XDSClient is a minimal ADS client, keeping the state of the subscribed types.
+type XDSClient struct {
+	// Addr is the control plane address.
+	Addr string
+
+	// Types to subscribe to - by default NDS and LDS. CDS is added for the outbound policy, see InScope.
+	Types []string
+
+	// OnNameTable is called with the mesh names and addresses, after each NDS update.
+	OnNameTable func(hosts map[string][]string)
+
+	m         sync.RWMutex
+	node      []byte
+	dialOpts  []grpc.DialOption
+	state     map[string]*XDSTypeState
+	hosts     map[string][]string
+	clusters  map[string]bool
+	connected bool
+	lastError string
+
+	// controlPlane is the identifier of the control plane, from the last response.
+	controlPlane string
+}
+
+// XDSTypeState is the last accepted response for a type.
+type XDSTypeState struct {
+	Version   string    `json:"version,omitempty"`
+	Resources []string  `json:"resources,omitempty"`
+	Updated   time.Time `json:"updated,omitempty"`
+}
+
+// XDSConfigDump is returned by /debug/config_dump.
+type XDSConfigDump struct {
+	Addr      string                   `json:"addr"`
+	Connected bool                     `json:"connected"`
+	LastError string                   `json:"last_error,omitempty"`
+	Types     map[string]*XDSTypeState `json:"types"`
+	NameTable map[string][]string      `json:"name_table,omitempty"`
+}
+
+// StartXDSClient connects to the control plane, if MESH_XDS_CLIENT is enabled.
+func (kr *KRun) StartXDSClient(ctx context.Context) error {
+	if kr.Config("MESH_XDS_CLIENT", "") != "true" || kr.XDSAddr == "-" {
+		return nil
+	}
+	addr := kr.FindXDSAddr()
+	opts, err := kr.xdsDialOptions(addr)
+	if err != nil {
+		return err
+	}
+	if h := kr.hedgedDialer(); h != nil {
+		opts = append(opts, grpc.WithContextDialer(h.DialContext))
+	}
+	opts = append(opts, kr.xdsKeepalive())
+	meta := kr.xdsNodeMeta()
+	// Required for istiod to send the name table.
+	meta["DNS_CAPTURE"] = "true"
+	meta["DNS_AUTO_ALLOCATE"] = "true"
+	c, err := NewXDSClient(addr, kr.xdsNodeID(), meta, kr.xdsNodeExtraMeta(), opts...)
+	if err != nil {
+		return err
+	}
+	if kr.outboundPolicy() != "" {
+		c.Types = append(c.Types, ClusterType)
+	}
+	c.OnNameTable = func(hosts map[string][]string) {
+		if err := updateHostsSection(xdsHostsBlockStart, xdsHostsBlockEnd, hostsBlock(hosts)); err != nil {
+			log.Println("Failed to update /etc/hosts with mesh names", err)
+		}
+	}
+	kr.XDSClient = c
+	go c.Run(ctx)
+	log.Println("XDS client started", "addr", addr)
+	return nil
+}
+
+func (kr *KRun) xdsDialOptions(addr string) ([]grpc.DialOption, error) {
+	def := "insecure"
+	if strings.HasSuffix(addr, ":443") {
+		def = "google_default"
+	} else if strings.HasSuffix(addr, ":15012") {
+		def = "tls"
+	}
+	switch kr.Config("MESH_XDS_CLIENT_CREDS", def) {
+	case "google_default":
+		return []grpc.DialOption{grpc.WithCredentialsBundle(google.NewDefaultCredentials())}, nil
+	case "tls":
+		cfg := &tls.Config{
+			RootCAs:    kr.TrustedCertPool,
+			ServerName: kr.Config("MESH_XDS_CLIENT_SAN", "istiod.istio-system.svc"),
+		}
+		if kr.X509KeyPair != nil {
+			cfg.Certificates = []tls.Certificate{*kr.X509KeyPair}
+		}
+		opts := []grpc.DialOption{grpc.WithTransportCredentials(credentials.NewTLS(cfg))}
+		if kr.TokenProvider != nil {
+			opts = append(opts, grpc.WithPerRPCCredentials(&audienceCredentials{kr: kr, aud: "istio-ca"}))
+		}
+		return opts, nil
+	case "insecure":
+		return []grpc.DialOption{grpc.WithInsecure()}, nil
+	}
+	return nil, errors.New("invalid MESH_XDS_CLIENT_CREDS, expecting google_default, tls or insecure")
+}
+
+// audienceCredentials returns K8S tokens with a fixed audience - gRPC passes the URI of the service.
+type audienceCredentials struct {
+	kr  *KRun
+	aud string
+}
+
+func (a *audienceCredentials) GetRequestMetadata(ctx context.Context, _ ...string) (map[string]string, error) {
+	return a.kr.GetRequestMetadata(ctx, a.aud)
+}
+
+func (a *audienceCredentials) RequireTransportSecurity() bool {
+	return true
+}
+
+// NewXDSClient creates a client for the control plane at addr. Extra holds the metadata that is not a string,
+// like LABELS.
+func NewXDSClient(addr string, id string, meta map[string]string, extra map[string]interface{},
+	opts ...grpc.DialOption) (*XDSClient, error) {
+	md, err := extractMeta(meta, extra)
+	if err != nil {
+		return nil, err
+	}
+	mdb, err := proto.Marshal(md)
+	if err != nil {
+		return nil, err
+	}
+	return &XDSClient{
+		Addr:     addr,
+		Types:    []string{NameTableType, ListenerType},
+		node:     encodeNode(id, mdb),
+		dialOpts: opts,
+		state:    map[string]*XDSTypeState{},
+	}, nil
+}
+
+// Run keeps a stream open to the control plane, reconnecting with backoff until the context is done.
+func (c *XDSClient) Run(ctx context.Context) {
+	backoff := 1 * time.Second
+	for {
+		start := time.Now()
+		err := c.stream(ctx)
+		c.m.Lock()
+		c.connected = false
+		if err != nil {
+			c.lastError = err.Error()
+		}
+		c.m.Unlock()
+		if ctx.Err() != nil {
+			return
+		}
+		log.Println("XDS stream closed", "addr", c.Addr, "err", err)
+		if time.Since(start) > 1*time.Minute {
+			backoff = 1 * time.Second
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		if backoff < 30*time.Second {
+			backoff = 2 * backoff
+		}
+	}
+}
+
+func (c *XDSClient) stream(ctx context.Context) error {
+	conn, err := grpc.DialContext(ctx, c.Addr, c.dialOpts...)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	sctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	s, err := conn.NewStream(sctx, &grpc.StreamDesc{ServerStreams: true, ClientStreams: true},
+		adsMethod, grpc.ForceCodec(rawCodec{}))
+	if err != nil {
+		return err
+	}
+	// After a reconnect, the last accepted versions are sent - the control plane may skip unchanged resources.
+	for i, t := range c.Types {
+		c.m.RLock()
+		ver := ""
+		if st := c.state[t]; st != nil {
+			ver = st.Version
+		}
+		c.m.RUnlock()
+		node := c.node
+		if i > 0 {
+			node = nil
+		}
+		if err := s.SendMsg(encodeDiscoveryRequest(node, t, ver, "", "")); err != nil {
+			return err
+		}
+	}
+	c.m.Lock()
+	c.connected = true
+	c.m.Unlock()
+
+	for {
+		var msg []byte
+		if err := s.RecvMsg(&msg); err != nil {
+			return err
+		}
+		res, err := parseDiscoveryResponse(msg)
+		if err != nil {
+			return err
+		}
+		nack := ""
+		if err := c.handleResponse(res); err != nil {
+			log.Println("XDS rejected", "type", res.TypeURL, "version", res.Version, "err", err)
+			nack = err.Error()
+		}
+		c.m.RLock()
+		ver := ""
+		if st := c.state[res.TypeURL]; st != nil {
+			ver = st.Version
+		}
+		c.m.RUnlock()
+		if err := s.SendMsg(encodeDiscoveryRequest(nil, res.TypeURL, ver, res.Nonce, nack)); err != nil {
+			return err
+		}
+	}
+}
+
+func (c *XDSClient) handleResponse(res *discoveryResponse) error {
+	st := &XDSTypeState{Version: res.Version, Updated: time.Now()}
+	var hosts map[string][]string
+	clusters := map[string]bool{}
+	for _, r := range res.Resources {
+		switch res.TypeURL {
+		case NameTableType:
+			h, err := parseNameTable(r)
+			if err != nil {
+				return err
+			}
+			hosts = h
+			for n := range h {
+				st.Resources = append(st.Resources, n)
+			}
+		case ListenerType:
+			st.Resources = append(st.Resources, protoString(r, 1))
+		case ClusterType:
+			name := protoString(r, 1)
+			st.Resources = append(st.Resources, name)
+			if hp := outboundClusterHostPort(name); hp != "" {
+				clusters[hp] = true
+			}
+		}
+	}
+	sort.Strings(st.Resources)
+
+	c.m.Lock()
+	c.state[res.TypeURL] = st
+	if res.ControlPlane != "" {
+		c.controlPlane = res.ControlPlane
+	}
+	if res.TypeURL == NameTableType {
+		c.hosts = hosts
+	}
+	if res.TypeURL == ClusterType {
+		c.clusters = clusters
+	}
+	c.m.Unlock()
+	if res.TypeURL == NameTableType && c.OnNameTable != nil {
+		c.OnNameTable(hosts)
+	}
+	return nil
+}
+
+// Lookup returns the addresses of a mesh hostname, from the name table.
+func (c *XDSClient) Lookup(host string) []string {
+	c.m.RLock()
+	defer c.m.RUnlock()
+	return c.hosts[host]
+}
+
+// InScope returns true if the control plane sent an outbound cluster for one of the hosts and the port - the
+// services in the Sidecar egress scope, and ServiceEntries. Wildcard ServiceEntry hosts and the addresses from
+// the name table are matched. Loaded is false until the first CDS response.
+func (c *XDSClient) InScope(hosts []string, port string) (in bool, loaded bool) {
+	c.m.RLock()
+	defer c.m.RUnlock()
+	if c.clusters == nil {
+		return false, false
+	}
+	for _, h := range hosts {
+		names := []string{h}
+		if net.ParseIP(h) != nil {
+			for n, ips := range c.hosts {
+				for _, ip := range ips {
+					if ip == h {
+						names = append(names, n)
+					}
+				}
+			}
+		}
+		for _, n := range names {
+			if c.clusters[net.JoinHostPort(n, port)] {
+				return true, true
+			}
+			for hp := range c.clusters {
+				wh, wp, _ := net.SplitHostPort(hp)
+				if wp == port && strings.HasPrefix(wh, "*.") && strings.HasSuffix(n, wh[1:]) {
+					return true, true
+				}
+			}
+		}
+	}
+	return false, true
+}
+
+// outboundClusterHostPort returns host:port for an Istio outbound cluster name - outbound|port|subset|host.
+func outboundClusterHostPort(name string) string {
+	p := strings.Split(name, "|")
+	if len(p) != 4 || p[0] != "outbound" {
+		return ""
+	}
+	return net.JoinHostPort(p[3], p[1])
+}
+
+// ControlPlane returns the identifier of the control plane, or "" if not received.
+func (c *XDSClient) ControlPlane() string {
+	c.m.RLock()
+	defer c.m.RUnlock()
+	return c.controlPlane
+}
+
+// ConfigDump returns the current state of the client.
+func (c *XDSClient) ConfigDump() *XDSConfigDump {
+	c.m.RLock()
+	defer c.m.RUnlock()
+	d := &XDSConfigDump{
+		Addr:      c.Addr,
+		Connected: c.connected,
+		LastError: c.lastError,
+		Types:     map[string]*XDSTypeState{},
+		NameTable: c.hosts,
+	}
+	for k, v := range c.state {
+		d.Types[k] = v
+	}
+	return d
+}
+
+// handleConfigDump returns the in-process XDS client state, as JSON.
+func (kr *KRun) handleConfigDump(w http.ResponseWriter, r *http.Request) {
+	if kr.XDSClient == nil {
+		http.Error(w, "XDS client not enabled, set MESH_XDS_CLIENT=true", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	data, _ := json.MarshalIndent(kr.XDSClient.ConfigDump(), "", "  ")
+	w.Write(data)
+}
+
+func hostsBlock(hosts map[string][]string) string {
+	if len(hosts) == 0 {
+		return ""
+	}
+	names := make([]string, 0, len(hosts))
+	for h := range hosts {
+		names = append(names, h)
+	}
+	sort.Strings(names)
+	b := &strings.Builder{}
+	b.WriteString(xdsHostsBlockStart + "\n")
+	for _, h := range names {
+		for _, a := range hosts[h] {
+			b.WriteString(a + " " + h + "\n")
+		}
+	}
+	b.WriteString(xdsHostsBlockEnd + "\n")
+	return b.String()
+}
+
+// encodeNode returns an envoy.config.core.v3.Node, with the encoded metadata Struct.
+func encodeNode(id string, meta []byte) []byte {
+	var b []byte
+	b = protowire.AppendTag(b, 1, protowire.BytesType)
+	b = protowire.AppendString(b, id)
+	b = protowire.AppendTag(b, 3, protowire.BytesType)
+	b = protowire.AppendBytes(b, meta)
+	b = protowire.AppendTag(b, 6, protowire.BytesType)
+	b = protowire.AppendString(b, "krun")
+	return b
+}
+
+// encodeDiscoveryRequest returns a DiscoveryRequest. A wildcard subscription is used for all types.
+func encodeDiscoveryRequest(node []byte, typeURL, version, nonce, nack string) []byte {
+	var b []byte
+	if version != "" {
+		b = protowire.AppendTag(b, 1, protowire.BytesType)
+		b = protowire.AppendString(b, version)
+	}
+	if node != nil {
+		b = protowire.AppendTag(b, 2, protowire.BytesType)
+		b = protowire.AppendBytes(b, node)
+	}
+	b = protowire.AppendTag(b, 4, protowire.BytesType)
+	b = protowire.AppendString(b, typeURL)
+	if nonce != "" {
+		b = protowire.AppendTag(b, 5, protowire.BytesType)
+		b = protowire.AppendString(b, nonce)
+	}
+	if nack != "" {
+		// google.rpc.Status, code 3 (INVALID_ARGUMENT)
+		var st []byte
+		st = protowire.AppendTag(st, 1, protowire.VarintType)
+		st = protowire.AppendVarint(st, 3)
+		st = protowire.AppendTag(st, 2, protowire.BytesType)
+		st = protowire.AppendString(st, nack)
+		b = protowire.AppendTag(b, 6, protowire.BytesType)
+		b = protowire.AppendBytes(b, st)
+	}
+	return b
+}
+
+type discoveryResponse struct {
+	Version   string
+	TypeURL   string
+	Nonce     string
+	Resources [][]byte
+
+	// ControlPlane is the control plane identifier - istiod sends a JSON with the version.
+	ControlPlane string
+}
+
+// parseDiscoveryResponse decodes a DiscoveryResponse. Resources are the values of the Any fields.
+func parseDiscoveryResponse(b []byte) (*discoveryResponse, error) {
+	res := &discoveryResponse{}
+	err := protoFields(b, func(num protowire.Number, v []byte, _ uint64) error {
+		switch num {
+		case 1:
+			res.Version = string(v)
+		case 2:
+			res.Resources = append(res.Resources, protoBytes(v, 2))
+		case 4:
+			res.TypeURL = string(v)
+		case 5:
+			res.Nonce = string(v)
+		case 7:
+			res.ControlPlane = protoString(v, 1)
+		}
+		return nil
+	})
+	return res, err
+}
+
+// parseNameTable decodes an istio.networking.nds.v1.NameTable, returning the IPs of each host.
+func parseNameTable(b []byte) (map[string][]string, error) {
+	hosts := map[string][]string{}
+	err := protoFields(b, func(num protowire.Number, v []byte, _ uint64) error {
+		if num != 1 {
+			return nil
+		}
+		// map<string, NameInfo> entry
+		var host string
+		var ips []string
+		err := protoFields(v, func(num protowire.Number, v []byte, _ uint64) error {
+			switch num {
+			case 1:
+				host = string(v)
+			case 2:
+				return protoFields(v, func(num protowire.Number, v []byte, _ uint64) error {
+					if num == 1 {
+						ips = append(ips, string(v))
+					}
+					return nil
+				})
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if host != "" {
+			hosts[host] = ips
+		}
+		return nil
+	})
+	return hosts, err
+}
+
+// protoBytes returns the last value of a length delimited field, or nil.
+func protoBytes(b []byte, field protowire.Number) []byte {
+	var res []byte
+	protoFields(b, func(num protowire.Number, v []byte, _ uint64) error {
+		if num == field {
+			res = v
+		}
+		return nil
+	})
+	return res
+}
+
+func protoString(b []byte, field protowire.Number) string {
+	return string(protoBytes(b, field))
+}
@@ -0,0 +1,176 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mesh
+
+import (
+	"context"
+	"net"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+func appendBytesField(b []byte, num protowire.Number, v []byte) []byte {
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, v)
+}
+
+// testNameTable returns a DiscoveryResponse with a NameTable resource.
+func testNameTable(version, nonce string, hosts map[string][]string) []byte {
+	var nt []byte
+	for h, ips := range hosts {
+		var info []byte
+		for _, ip := range ips {
+			info = appendBytesField(info, 1, []byte(ip))
+		}
+		var entry []byte
+		entry = appendBytesField(entry, 1, []byte(h))
+		entry = appendBytesField(entry, 2, info)
+		nt = appendBytesField(nt, 1, entry)
+	}
+	var r []byte
+	r = appendBytesField(r, 1, []byte(NameTableType))
+	r = appendBytesField(r, 2, nt)
+
+	var res []byte
+	res = appendBytesField(res, 1, []byte(version))
+	res = appendBytesField(res, 2, r)
+	res = appendBytesField(res, 4, []byte(NameTableType))
+	res = appendBytesField(res, 5, []byte(nonce))
+	return res
+}
+
+func TestXDSClient(t *testing.T) {
+	acks := make(chan *discoveryRequest, 10)
+	gs := grpc.NewServer(grpc.ForceServerCodec(rawCodec{}))
+	gs.RegisterService(&grpc.ServiceDesc{
+		ServiceName: "envoy.service.discovery.v3.AggregatedDiscoveryService",
+		HandlerType: (*interface{})(nil),
+		Streams: []grpc.StreamDesc{{
+			StreamName:    "StreamAggregatedResources",
+			ClientStreams: true,
+			ServerStreams: true,
+			Handler: func(srv interface{}, stream grpc.ServerStream) error {
+				for {
+					var msg []byte
+					if err := stream.RecvMsg(&msg); err != nil {
+						return nil
+					}
+					req := parseTestRequest(msg)
+					acks <- req
+					if req.TypeURL == NameTableType && req.Nonce == "" {
+						stream.SendMsg(testNameTable("v1", "n1", map[string][]string{
+							"fortio.fortio.svc.cluster.local": {"10.0.0.1"},
+						}))
+					}
+				}
+			},
+		}},
+	}, nil)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go gs.Serve(l)
+	defer gs.Stop()
+
+	c, err := NewXDSClient(l.Addr().String(), "sidecar~10.1.1.1~pod.fortio~fortio.svc.cluster.local",
+		map[string]string{"NAMESPACE": "fortio"}, map[string]interface{}{"LABELS": map[string]interface{}{"app": "fortio"}}, grpc.WithInsecure())
+	if err != nil {
+		t.Fatal(err)
+	}
+	updates := make(chan map[string][]string, 1)
+	c.OnNameTable = func(h map[string][]string) {
+		updates <- h
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go c.Run(ctx)
+
+	first := <-acks
+	if first.Node == "" || first.TypeURL != NameTableType {
+		t.Error("Unexpected first request", first)
+	}
+	select {
+	case h := <-updates:
+		if !reflect.DeepEqual(h["fortio.fortio.svc.cluster.local"], []string{"10.0.0.1"}) {
+			t.Error("Unexpected name table", h)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timeout waiting for NDS")
+	}
+	for {
+		select {
+		case r := <-acks:
+			if r.Nonce != "n1" {
+				continue
+			}
+			if r.Version != "v1" || r.Node != "" {
+				t.Error("Unexpected ACK", r)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Timeout waiting for ACK")
+		}
+		break
+	}
+	if a := c.Lookup("fortio.fortio.svc.cluster.local"); len(a) != 1 {
+		t.Error("Lookup failed", a)
+	}
+
+	kr := New()
+	kr.XDSClient = c
+	w := httptest.NewRecorder()
+	kr.handleConfigDump(w, httptest.NewRequest("GET", "/debug/config_dump", nil))
+	if !strings.Contains(w.Body.String(), `"version": "v1"`) || !strings.Contains(w.Body.String(), "10.0.0.1") {
+		t.Error("Unexpected config dump", w.Body.String())
+	}
+}
+
+type discoveryRequest struct {
+	Version, Node, TypeURL, Nonce string
+}
+
+func parseTestRequest(b []byte) *discoveryRequest {
+	r := &discoveryRequest{}
+	protoFields(b, func(num protowire.Number, v []byte, _ uint64) error {
+		switch num {
+		case 1:
+			r.Version = string(v)
+		case 2:
+			r.Node = protoString(v, 1)
+		case 4:
+			r.TypeURL = string(v)
+		case 5:
+			r.Nonce = string(v)
+		}
+		return nil
+	})
+	return r
+}
+
+func TestHostsBlock(t *testing.T) {
+	if hostsBlock(nil) != "" {
+		t.Error("Expecting empty block")
+	}
+	b := hostsBlock(map[string][]string{"b.svc": {"10.0.0.2"}, "a.svc": {"10.0.0.1"}})
+	if b != xdsHostsBlockStart+"\n10.0.0.1 a.svc\n10.0.0.2 b.svc\n"+xdsHostsBlockEnd+"\n" {
+		t.Error("Unexpected block", b)
+	}
+}
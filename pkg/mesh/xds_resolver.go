@@ -0,0 +1,246 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mesh
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// XDS address selection.
+//
+// The address is selected by the first resolver in MESH_XDS_RESOLVERS that returns a result. The default order is
+// "explicit,webhook,dns,mcp,ilb,mcon":
+// - explicit - XDS_ADDR from env or mesh-env. A meshconfig address without a tenant is ignored.
+// - webhook - GET MESH_XDS_WEBHOOK, with the workload name, namespace, region and tenant as query parameters.
+// The response is JSON {"addr": "host:port", "reason": "..."}, an empty addr skips the resolver.
+// - dns - MESH_XDS_DNS, a hostname (default port 15012) used if it resolves - for example a private DNS zone
+// for the Istiod ILB.
+// - mcp - the managed control plane, if a mesh tenant is set. Use "-" as tenant to force in-cluster.
+// - ilb - the internal mesh connector (MESH_CONNECTOR_INTERNAL_ADDR), if the instance has VPC access.
+// - mcon - the external mesh connector (MESH_CONNECTOR_ADDR), for instances without VPC access.
+//
+// Additional resolvers can be added to XDSResolvers by code embedding krun, and enabled in MESH_XDS_RESOLVERS.
+// The result - address, resolver and reason - is logged on change and available as /debug/xds_resolver.
+
+// XDSResolver selects the XDS address.
+type XDSResolver interface {
+	// ResolveXDS returns the address and the reason it was selected, or "" if the resolver doesn't apply.
+	ResolveXDS(ctx context.Context, kr *KRun) (addr string, reason string)
+}
+
+// XDSResolverFunc adapts a function to XDSResolver.
+type XDSResolverFunc func(ctx context.Context, kr *KRun) (string, string)
+
+func (f XDSResolverFunc) ResolveXDS(ctx context.Context, kr *KRun) (string, string) {
+	return f(ctx, kr)
+}
+
+// XDSResolvers holds the known resolvers, by name.
+var XDSResolvers = map[string]XDSResolver{
+	"explicit": XDSResolverFunc(resolveExplicitXDS),
+	"webhook":  &webhookXDSResolver{},
+	"dns":      XDSResolverFunc(resolveDNSXDS),
+	"mcp":      XDSResolverFunc(resolveMCPXDS),
+	"ilb":      XDSResolverFunc(resolveILBXDS),
+	"mcon":     XDSResolverFunc(resolveMCONXDS),
+}
+
+const defaultXDSResolvers = "explicit,webhook,dns,mcp,ilb,mcon"
+
+// XDSResolution is the result of the XDS address selection.
+type XDSResolution struct {
+	Addr     string `json:"addr"`
+	Resolver string `json:"resolver"`
+	Reason   string `json:"reason"`
+
+	// Skipped holds the resolvers tried before, which didn't apply.
+	Skipped []string `json:"skipped,omitempty"`
+}
+
+// ResolveXDS runs the resolvers in order. If none applies, the internal mesh connector address is used.
+func (kr *KRun) ResolveXDS(ctx context.Context) *XDSResolution {
+	res := &XDSResolution{}
+	for _, n := range splitList(kr.Config("MESH_XDS_RESOLVERS", defaultXDSResolvers)) {
+		r := XDSResolvers[n]
+		if r == nil {
+			log.Println("Unknown XDS resolver", "name", n)
+			continue
+		}
+		addr, reason := r.ResolveXDS(ctx, kr)
+		if addr != "" {
+			res.Addr, res.Resolver, res.Reason = addr, n, reason
+			break
+		}
+		res.Skipped = append(res.Skipped, n)
+	}
+	if res.Addr == "" {
+		res.Addr, res.Resolver, res.Reason = kr.MeshConnectorInternalAddr+":15012", "default", "no resolver applied"
+	}
+
+	kr.xdsResolutionM.Lock()
+	prev := kr.xdsResolution
+	kr.xdsResolution = res
+	kr.xdsResolutionM.Unlock()
+	if prev == nil || prev.Addr != res.Addr || prev.Resolver != res.Resolver {
+		log.Println("XDS address", "addr", res.Addr, "resolver", res.Resolver, "reason", res.Reason, "skipped", res.Skipped)
+	}
+	return res
+}
+
+func (kr *KRun) handleXDSResolver(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("content-type", "application/json")
+	e := json.NewEncoder(w)
+	e.SetIndent("", "  ")
+	e.Encode(kr.ResolveXDS(r.Context()))
+}
+
+func inCluster(kr *KRun) bool {
+	return kr.MeshTenant == "-" || kr.MeshTenant == ""
+}
+
+func resolveExplicitXDS(ctx context.Context, kr *KRun) (string, string) {
+	if kr.XDSAddr == "" {
+		return "", ""
+	}
+	if inCluster(kr) && strings.Contains(kr.XDSAddr, "googleapis.com") && strings.Contains(kr.XDSAddr, "meshconfig") {
+		log.Println("Ignoring meshconfig XDS address without tenant, using mesh connector")
+		return "", ""
+	}
+	return kr.XDSAddr, "XDS_ADDR set"
+}
+
+func resolveDNSXDS(ctx context.Context, kr *KRun) (string, string) {
+	h := kr.Config("MESH_XDS_DNS", "")
+	if h == "" {
+		return "", ""
+	}
+	addr := h
+	if _, _, err := net.SplitHostPort(h); err != nil {
+		addr = net.JoinHostPort(h, "15012")
+	} else {
+		h, _, _ = net.SplitHostPort(h)
+	}
+	rctx, cf := context.WithTimeout(ctx, 2*time.Second)
+	defer cf()
+	ips, err := net.DefaultResolver.LookupHost(rctx, h)
+	if err != nil || len(ips) == 0 {
+		log.Println("XDS DNS name not resolved", "host", h, "err", err)
+		return "", ""
+	}
+	return addr, "MESH_XDS_DNS resolved to " + strings.Join(ips, ",")
+}
+
+func resolveMCPXDS(ctx context.Context, kr *KRun) (string, string) {
+	if inCluster(kr) {
+		return "", ""
+	}
+	// For staging: explicitly set XDS_ADDR in mesh-env
+	return "meshconfig.googleapis.com:443", "mesh tenant " + kr.MeshTenant
+}
+
+func resolveILBXDS(ctx context.Context, kr *KRun) (string, string) {
+	if kr.MeshConnectorInternalAddr == "" {
+		return "", ""
+	}
+	if kr.MeshConnectorAddr != "" && kr.VPCMode() == VPCNone {
+		// No VPC access - the internal address is not reachable.
+		return "", ""
+	}
+	return kr.MeshConnectorInternalAddr + ":15012", "internal mesh connector, VPC " + kr.VPCMode()
+}
+
+func resolveMCONXDS(ctx context.Context, kr *KRun) (string, string) {
+	if kr.MeshConnectorAddr == "" {
+		return "", ""
+	}
+	return kr.MeshConnectorAddr + ":15012", "external mesh connector"
+}
+
+// webhookXDSResolver calls MESH_XDS_WEBHOOK. Successful responses are cached for the life of the instance.
+type webhookXDSResolver struct {
+	m     sync.Mutex
+	cache map[string][2]string
+}
+
+func (wr *webhookXDSResolver) ResolveXDS(ctx context.Context, kr *KRun) (string, string) {
+	wh := kr.Config("MESH_XDS_WEBHOOK", "")
+	if wh == "" {
+		return "", ""
+	}
+	u, err := url.Parse(wh)
+	if err != nil {
+		log.Println("Invalid MESH_XDS_WEBHOOK", "url", wh, "err", err)
+		return "", ""
+	}
+	q := u.Query()
+	q.Set("name", kr.Name)
+	q.Set("namespace", kr.Namespace)
+	q.Set("region", kr.InstanceRegion)
+	q.Set("tenant", kr.MeshTenant)
+	u.RawQuery = q.Encode()
+	key := u.String()
+
+	wr.m.Lock()
+	if r, f := wr.cache[key]; f {
+		wr.m.Unlock()
+		return r[0], r[1]
+	}
+	wr.m.Unlock()
+
+	rctx, cf := context.WithTimeout(ctx, 5*time.Second)
+	defer cf()
+	auth := ""
+	if kr.TokenProvider != nil {
+		if t, err := kr.TokenProvider.GetToken(rctx, u.Scheme+"://"+u.Host); err == nil {
+			auth = "Bearer " + t
+		}
+	}
+	body, err := httpGet(rctx, key, auth, "application/json")
+	if err != nil {
+		log.Println("XDS webhook failed", "url", wh, "err", err)
+		return "", ""
+	}
+	defer body.Close()
+	res := struct {
+		Addr   string `json:"addr"`
+		Reason string `json:"reason"`
+	}{}
+	if err := json.NewDecoder(body).Decode(&res); err != nil {
+		log.Println("Invalid XDS webhook response", "url", wh, "err", err)
+		return "", ""
+	}
+	if res.Addr == "" {
+		return "", ""
+	}
+	reason := "webhook"
+	if res.Reason != "" {
+		reason = "webhook: " + res.Reason
+	}
+	wr.m.Lock()
+	if wr.cache == nil {
+		wr.cache = map[string][2]string{}
+	}
+	wr.cache[key] = [2]string{res.Addr, reason}
+	wr.m.Unlock()
+	return res.Addr, reason
+}
@@ -0,0 +1,111 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mesh
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func TestResolveXDS(t *testing.T) {
+	kr := New()
+	kr.MeshConnectorInternalAddr = "10.1.2.3"
+	r := kr.ResolveXDS(context.Background())
+	if r.Addr != "10.1.2.3:15012" || r.Resolver != "ilb" {
+		t.Error("Expecting ILB", r)
+	}
+
+	kr.MeshTenant = "proj-123"
+	if r := kr.ResolveXDS(context.Background()); r.Addr != "meshconfig.googleapis.com:443" || r.Resolver != "mcp" {
+		t.Error("Expecting MCP", r)
+	}
+
+	kr.XDSAddr = "istiod.example.com:15012"
+	if a := kr.FindXDSAddr(); a != "istiod.example.com:15012" {
+		t.Error("Expecting explicit", a)
+	}
+
+	kr.MeshTenant = ""
+	kr.XDSAddr = "meshconfig.googleapis.com:443"
+	if r := kr.ResolveXDS(context.Background()); r.Resolver != "ilb" || len(r.Skipped) == 0 || r.Skipped[0] != "explicit" {
+		t.Error("Expecting meshconfig without tenant to be ignored", r)
+	}
+
+	kr = New()
+	if r := kr.ResolveXDS(context.Background()); r.Resolver != "default" {
+		t.Error("Expecting default", r)
+	}
+}
+
+func TestResolveXDSCustom(t *testing.T) {
+	XDSResolvers["test"] = XDSResolverFunc(func(ctx context.Context, kr *KRun) (string, string) {
+		return "custom:15012", "test"
+	})
+	defer delete(XDSResolvers, "test")
+	os.Setenv("MESH_XDS_RESOLVERS", "unknown,test,mcp")
+	defer os.Unsetenv("MESH_XDS_RESOLVERS")
+	kr := New()
+	if r := kr.ResolveXDS(context.Background()); r.Addr != "custom:15012" || r.Resolver != "test" {
+		t.Error("Expecting custom resolver", r)
+	}
+}
+
+func TestResolveXDSWebhook(t *testing.T) {
+	calls := 0
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if r.FormValue("name") != "fortio" {
+			w.Write([]byte(`{}`))
+			return
+		}
+		w.Write([]byte(`{"addr":"istiod.region1:15012","reason":"regional"}`))
+	}))
+	defer s.Close()
+	os.Setenv("MESH_XDS_WEBHOOK", s.URL)
+	defer os.Unsetenv("MESH_XDS_WEBHOOK")
+
+	kr := New()
+	kr.Name = "fortio"
+	for i := 0; i < 2; i++ {
+		r := kr.ResolveXDS(context.Background())
+		if r.Addr != "istiod.region1:15012" || r.Reason != "webhook: regional" {
+			t.Error("Expecting webhook", r)
+		}
+	}
+	if calls != 1 {
+		t.Error("Expecting cached response", calls)
+	}
+
+	kr.Name = "other"
+	if r := kr.ResolveXDS(context.Background()); r.Resolver == "webhook" {
+		t.Error("Expecting webhook to be skipped", r)
+	}
+}
+
+func TestResolveXDSDNS(t *testing.T) {
+	os.Setenv("MESH_XDS_DNS", "localhost")
+	defer os.Unsetenv("MESH_XDS_DNS")
+	kr := New()
+	if r := kr.ResolveXDS(context.Background()); r.Addr != "localhost:15012" || r.Resolver != "dns" {
+		t.Error("Expecting DNS", r)
+	}
+	os.Setenv("MESH_XDS_DNS", "invalid.invalid:443")
+	if r := kr.ResolveXDS(context.Background()); r.Resolver == "dns" {
+		t.Error("Expecting DNS to be skipped", r)
+	}
+}
@@ -30,6 +30,7 @@ import (
 	"strings"
 	"time"
 
+	"github.com/GoogleCloudPlatform/cloud-run-mesh/pkg/hbone"
 	"github.com/GoogleCloudPlatform/cloud-run-mesh/pkg/mesh"
 	"golang.org/x/oauth2"
 )
@@ -142,9 +143,9 @@ func NewSTS(kr *mesh.KRun) (*STS, error) {
 		httpClient: &http.Client{
 			Timeout: 5 * time.Second,
 			Transport: &http.Transport{
-				TLSClientConfig: &tls.Config{
+				TLSClientConfig: hbone.TLSConfig(&tls.Config{
 					RootCAs: caCertPool,
-				},
+				}),
 			},
 		},
 	}, nil
@@ -224,6 +225,22 @@ func (s *STS) GetRequestMetadata(ctx context.Context, aud ...string) (map[string
 	return s.md(token), nil
 }
 
+// GetToken implements mesh.TokenProvider, returning an access token for an empty audience and an ID token
+// otherwise.
+func (s *STS) GetToken(ctx context.Context, aud string) (string, error) {
+	var md map[string]string
+	var err error
+	if aud == "" {
+		md, err = s.GetRequestMetadata(ctx)
+	} else {
+		md, err = s.GetRequestMetadata(ctx, aud)
+	}
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimPrefix(md["authorization"], "Bearer "), nil
+}
+
 func (s *STS) RequireTransportSecurity() bool {
 	return false
 }
@@ -337,7 +354,12 @@ type federatedTokenResponse struct {
 // iam.googleapis.com/projects/<project-number>/locations/global/workloadIdentityPools/<pool-id>/providers/<provider-id>.
 // or gcloud URL
 // Required when exchanging an external credential for a Google access token.
+//
+// STS_AUDIENCE overrides the audience - used with workload identity pools, for tokens issued outside GCP.
 func (s *STS) constructAudience(provider, trustDomain string) string {
+	if aud := s.kr.Config("STS_AUDIENCE", ""); aud != "" {
+		return aud
+	}
 	if provider == "" {
 		provider = s.kr.ClusterAddress
 	}